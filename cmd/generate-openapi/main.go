@@ -0,0 +1,29 @@
+// Command generate-openapi writes the OpenAPI description of the HTTP API
+// to the path it is given, api/openapi.yaml by default; see
+// api.GenerateOpenAPI. It is run by go generate.
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/AndySung320/rate-limiter/internal/api"
+)
+
+func main() {
+	out := "api/openapi.yaml"
+	switch len(os.Args) {
+	case 1:
+	case 2:
+		out = os.Args[1]
+	default:
+		log.Fatal("usage: generate-openapi [output file]")
+	}
+	spec, err := api.GenerateOpenAPI()
+	if err != nil {
+		log.Fatalf("generating OpenAPI spec: %v", err)
+	}
+	if err := os.WriteFile(out, spec, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,311 @@
+// Command ratelimiter-cli talks to a running rate limiter from the terminal,
+// to try rules out without writing HTTP calls by hand:
+//
+//	ratelimiter-cli check --key=alice --endpoint=/api/upload --tier=free
+//	ratelimiter-cli reset --key=user:alice:/api/upload:free
+//	ratelimiter-cli validate --config=rules.yaml
+//
+// The server is --server or RATE_LIMITER_SERVER (default
+// http://localhost:8080), and admin commands send --admin-token or
+// RATE_LIMITER_ADMIN_TOKEN. Like grep, it exits 0 when a check is allowed
+// or a command succeeds, 1 when a check is denied or a rules file is
+// invalid, and 2 on errors.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/config"
+)
+
+const defaultServer = "http://localhost:8080"
+
+const (
+	exitOK      = 0
+	exitDenied  = 1 // A check was denied
+	exitInvalid = 1 // A rules file has errors
+	exitError   = 2
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Getenv, os.Stdout, os.Stderr))
+}
+
+// command is one subcommand. A command that calls the server adds its flags
+// to fs and returns the request to send once they are parsed; one that
+// works offline returns what to run instead.
+type command struct {
+	summary string
+	flags   func(fs *flag.FlagSet) func() (*http.Request, error)
+	offline func(fs *flag.FlagSet) func(stdout, stderr io.Writer) int
+}
+
+var commands = map[string]command{
+	"check":    {summary: "Charge a request against its limits (POST /check)", flags: checkCommand},
+	"reset":    {summary: "Delete a bucket so it starts over full (DELETE /admin/buckets/<key>)", flags: resetCommand},
+	"validate": {summary: "Check a rules file without a server", offline: validateCommand},
+}
+
+func run(args []string, getenv func(string) string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+		usage(stderr)
+		if len(args) == 0 {
+			return exitError
+		}
+		return exitOK
+	}
+	name := args[0]
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command %q\n\n", name)
+		usage(stderr)
+		return exitError
+	}
+
+	fs := flag.NewFlagSet("ratelimiter-cli "+name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "%s\n\nUsage: ratelimiter-cli %s [flags]\n\n", cmd.summary, name)
+		fs.PrintDefaults()
+	}
+	if cmd.offline != nil {
+		action := cmd.offline(fs)
+		if code, ok := parseArgs(fs, args[1:], stderr); !ok {
+			return code
+		}
+		return action(stdout, stderr)
+	}
+	c := &client{}
+	fs.StringVar(&c.server, "server", "", "base URL of the rate limiter (env RATE_LIMITER_SERVER, default "+defaultServer+")")
+	fs.StringVar(&c.token, "admin-token", "", "bearer token for admin commands (env RATE_LIMITER_ADMIN_TOKEN)")
+	output := fs.String("output", "table", "output format: table or json")
+	build := cmd.flags(fs)
+	if code, ok := parseArgs(fs, args[1:], stderr); !ok {
+		return code
+	}
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(stderr, "invalid --output %q: must be table or json\n", *output)
+		return exitError
+	}
+	if c.server == "" {
+		c.server = getenv("RATE_LIMITER_SERVER")
+	}
+	if c.server == "" {
+		c.server = defaultServer
+	}
+	if c.token == "" {
+		c.token = getenv("RATE_LIMITER_ADMIN_TOKEN")
+	}
+
+	req, err := build()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	status, body, err := c.do(req)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	if err := writeResponse(stdout, *output, body); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	switch {
+	case status == http.StatusTooManyRequests:
+		return exitDenied
+	case status >= 300:
+		fmt.Fprintf(stderr, "server returned %d %s\n", status, http.StatusText(status))
+		return exitError
+	}
+	return exitOK
+}
+
+// parseArgs parses a command's flags, returning false with the exit code
+// when the command shouldn't run: after --help or a usage error.
+func parseArgs(fs *flag.FlagSet, args []string, stderr io.Writer) (int, bool) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK, false
+		}
+		return exitError, false
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(stderr, "unexpected argument %q\n", fs.Arg(0))
+		return exitError, false
+	}
+	return 0, true
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: ratelimiter-cli <command> [flags]\n\nCommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-9s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintf(w, "\nRun 'ratelimiter-cli <command> --help' for a command's flags.\n")
+}
+
+func checkCommand(fs *flag.FlagSet) func() (*http.Request, error) {
+	key := fs.String("key", "", "key to limit, e.g. a user ID (required)")
+	endpoint := fs.String("endpoint", "", "endpoint to check, e.g. /api/upload (required)")
+	tier := fs.String("tier", "", "user tier")
+	cost := fs.Int64("cost", 0, "cost of the request; 0 uses the endpoint's")
+	ip := fs.String("ip", "", "client IP address, for IP rules")
+	namespace := fs.String("namespace", "", "bucket namespace, e.g. staging")
+	return func() (*http.Request, error) {
+		if *key == "" || *endpoint == "" {
+			return nil, errors.New("check needs --key and --endpoint")
+		}
+		body, err := json.Marshal(map[string]any{
+			"key":        *key,
+			"endpoint":   *endpoint,
+			"user_tier":  *tier,
+			"cost":       *cost,
+			"ip_address": *ip,
+			"namespace":  *namespace,
+		})
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest(http.MethodPost, "/check", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	}
+}
+
+func resetCommand(fs *flag.FlagSet) func() (*http.Request, error) {
+	key := fs.String("key", "", "full bucket key, e.g. user:alice:/api/upload:free (required)")
+	return func() (*http.Request, error) {
+		if *key == "" {
+			return nil, errors.New("reset needs --key")
+		}
+		segments := strings.Split(strings.TrimPrefix(*key, "/"), "/")
+		for i, segment := range segments {
+			segments[i] = url.PathEscape(segment)
+		}
+		return http.NewRequest(http.MethodDelete, "/admin/buckets/"+strings.Join(segments, "/"), nil)
+	}
+}
+
+func validateCommand(fs *flag.FlagSet) func(stdout, stderr io.Writer) int {
+	path := fs.String("config", "", "rules file to check, with the files it includes (required)")
+	return func(stdout, stderr io.Writer) int {
+		if *path == "" {
+			fmt.Fprintln(stderr, "validate needs --config")
+			return exitError
+		}
+		rules, err := config.LoadRuleSet(*path)
+		if errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		if err == nil {
+			if err = config.ValidateRuleSet(rules); err != nil {
+				err = fmt.Errorf("%s: %w", *path, err)
+			}
+		}
+		if err != nil {
+			// Every problem is reported, one per line, prefixed with the file
+			lines := strings.Split(err.Error(), "\n")
+			for i, line := range lines {
+				if i > 0 && !strings.HasPrefix(line, *path+":") {
+					line = *path + ": " + line
+				}
+				fmt.Fprintln(stdout, line)
+			}
+			return exitInvalid
+		}
+		for _, warning := range config.Warnings(rules) {
+			fmt.Fprintf(stderr, "%s: warning: %s\n", *path, warning)
+		}
+		fmt.Fprintf(stdout, "%s: OK (%d tiers, %d endpoints)\n", *path, len(rules.Tiers), len(rules.Endpoints))
+		return exitOK
+	}
+}
+
+type client struct {
+	server string
+	token  string
+}
+
+// do sends req, whose URL is relative to the server, and returns the
+// response status and body.
+func (c *client) do(req *http.Request) (int, []byte, error) {
+	base, err := url.Parse(strings.TrimSuffix(c.server, "/"))
+	if err != nil || base.Scheme == "" || base.Host == "" {
+		return 0, nil, fmt.Errorf("invalid server URL %q", c.server)
+	}
+	req.URL.Scheme, req.URL.Host = base.Scheme, base.Host
+	req.URL.Path = base.Path + req.URL.Path
+	req.URL.RawPath = base.EscapedPath() + req.URL.EscapedPath()
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, body, nil
+}
+
+// writeResponse writes a JSON response body as indented JSON or as a
+// two-column table of its fields.
+func writeResponse(w io.Writer, output string, body []byte) error {
+	var fields map[string]any
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&fields); err != nil {
+		return fmt.Errorf("unexpected response: %s", bytes.TrimSpace(body))
+	}
+	if output == "json" {
+		var out bytes.Buffer
+		if err := json.Indent(&out, body, "", "  "); err != nil {
+			return err
+		}
+		out.WriteByte('\n')
+		_, err := w.Write(out.Bytes())
+		return err
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FIELD\tVALUE")
+	for _, name := range names {
+		value := fields[name]
+		switch value.(type) {
+		case map[string]any, []any:
+			nested, _ := json.Marshal(value)
+			value = string(nested)
+		}
+		fmt.Fprintf(tw, "%s\t%v\n", name, value)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/api"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	rules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{"free": {Capacity: 20, RefillRate: 0.001}},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/upload": {Rule: "tiers+endpoints", Cost: 10, GlobalCapacity: 1000, GlobalRefillRate: 100},
+		},
+	}
+	handler := api.NewRateLimiterHandler(storage.NewMemoryStorage(), rules)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/check", handler.CheckHandler)
+	admin := router.Group("/admin", api.AdminAuth(map[string]string{"secret": "ops"}))
+	admin.DELETE("/buckets/*key", handler.DeleteBucketHandler)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func runCLI(args []string, env map[string]string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(args, func(name string) string { return env[name] }, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+// tableValue returns field's value from table output.
+func tableValue(out, field string) string {
+	for _, line := range strings.Split(out, "\n") {
+		if name, value, ok := strings.Cut(line, " "); ok && name == field {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+func TestRun_Check(t *testing.T) {
+	server := newTestServer(t)
+	check := []string{"check", "--server", server.URL, "--key=alice", "--endpoint=/api/upload", "--tier=free"}
+
+	code, out, errOut := runCLI(check, nil)
+	if code != exitOK || tableValue(out, "allowed") != "true" || tableValue(out, "userRemaining") != "10" {
+		t.Fatalf("expected an allowed check as a table, got %d: %s%s", code, out, errOut)
+	}
+
+	code, out, _ = runCLI(append(check, "--output=json"), nil)
+	var resp api.CheckResponse
+	if err := json.Unmarshal([]byte(out), &resp); err != nil || code != exitOK || resp.UserRemaining != 0 {
+		t.Fatalf("expected the second check as JSON, got %d: %s (err=%v)", code, out, err)
+	}
+
+	// The server comes from the environment when --server isn't given
+	code, out, _ = runCLI(append([]string{"check"}, check[3:]...), map[string]string{"RATE_LIMITER_SERVER": server.URL})
+	if code != exitDenied || tableValue(out, "allowed") != "false" {
+		t.Fatalf("expected the third check to be denied, got %d: %s", code, out)
+	}
+}
+
+func TestRun_Reset(t *testing.T) {
+	server := newTestServer(t)
+	for i := 0; i < 2; i++ {
+		runCLI([]string{"check", "--server", server.URL, "--key=alice", "--endpoint=/api/upload", "--tier=free"}, nil)
+	}
+	reset := []string{"reset", "--server", server.URL, "--key=user:alice:/api/upload:free"}
+
+	if code, _, errOut := runCLI(reset, nil); code != exitError || !strings.Contains(errOut, "401") {
+		t.Fatalf("expected reset without a token to be refused, got %d: %s", code, errOut)
+	}
+	code, out, errOut := runCLI(reset, map[string]string{"RATE_LIMITER_ADMIN_TOKEN": "secret"})
+	if code != exitOK || tableValue(out, "deleted") != "true" {
+		t.Fatalf("expected the bucket to be deleted, got %d: %s%s", code, out, errOut)
+	}
+	if code, out, _ := runCLI([]string{"check", "--server", server.URL, "--key=alice", "--endpoint=/api/upload", "--tier=free"}, nil); code != exitOK {
+		t.Fatalf("expected alice to start over after the reset, got %d: %s", code, out)
+	}
+}
+
+func TestRun_Usage(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		code int
+		want string // Substring of stderr
+	}{
+		{"no command", nil, exitError, "Commands:"},
+		{"help", []string{"--help"}, exitOK, "check"},
+		{"command help", []string{"check", "--help"}, exitOK, "-endpoint"},
+		{"unknown command", []string{"peek"}, exitError, `unknown command "peek"`},
+		{"missing key", []string{"check", "--endpoint=/api/upload"}, exitError, "check needs --key and --endpoint"},
+		{"bad output", []string{"reset", "--key=k", "--output=yaml"}, exitError, "invalid --output"},
+		{"bad server", []string{"reset", "--key=k", "--server=localhost"}, exitError, "invalid server URL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, errOut := runCLI(tt.args, nil)
+			if code != tt.code || !strings.Contains(errOut, tt.want) {
+				t.Errorf("expected exit %d mentioning %q, got %d: %s", tt.code, tt.want, code, errOut)
+			}
+		})
+	}
+}
+
+// TestMain runs the CLI itself when a test starts this binary as a
+// subprocess, so exit codes can be checked as a shell would see them.
+func TestMain(m *testing.M) {
+	if args, ok := os.LookupEnv("RATELIMITER_CLI_ARGS"); ok {
+		os.Exit(run(strings.Split(args, "\n"), os.Getenv, os.Stdout, os.Stderr))
+	}
+	os.Exit(m.Run())
+}
+
+// runSubprocess runs the CLI with args in a child process.
+func runSubprocess(t *testing.T, args ...string) (int, string, string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "RATELIMITER_CLI_ARGS="+strings.Join(args, "\n"))
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatalf("running the CLI: %v", err)
+	}
+	return cmd.ProcessState.ExitCode(), stdout.String(), stderr.String()
+}
+
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(data), 0o644)
+		return path
+	}
+	valid := write("valid.yaml", `
+tiers:
+  free: {capacity: 100, refill_rate: 10}
+endpoints:
+  /api/upload: {rule: tiers+endpoints, cost: 10, global_capacity: 1000, global_refill_rate: 100}
+`)
+	warned := write("warned.yaml", `
+tiers:
+  free: {capacity: 5, refill_rate: 1}
+  premium: {capacity: 100, refill_rate: 10}
+endpoints:
+  /api/upload: {rule: tiers+endpoints, cost: 10, global_capacity: 1000, global_refill_rate: 100}
+  /api: {rule: endpoint, cost: 1, global_capacity: 100, global_refill_rate: 10, match_mode: prefix}
+  /api/users: {rule: endpoint, cost: 1, global_capacity: 100, global_refill_rate: 10, match_mode: prefix}
+`)
+	invalid := write("invalid.yaml", `
+tiers:
+  free: {capacity: 0, refill_rate: 10}
+endpoints:
+  /api/upload: {rule: tiers+endpoints, cost: 10, global_capacity: 0, global_refill_rate: 100}
+`)
+	typo := write("typo.yaml", "tiers:\n  free:\n    capacity: 100\n    refillRate: 1\n")
+
+	tests := []struct {
+		name       string
+		args       []string
+		code       int
+		stdout     []string
+		stderr     []string
+		noWarnings bool
+	}{
+		{name: "valid", args: []string{"validate", "--config=" + valid}, code: exitOK, stdout: []string{valid + ": OK (1 tiers, 1 endpoints)"}, noWarnings: true},
+		{
+			name:   "warnings keep exit 0",
+			args:   []string{"validate", "--config", warned},
+			code:   exitOK,
+			stdout: []string{"OK"},
+			stderr: []string{
+				warned + ": warning: endpoint '/api/upload': cost 10 exceeds tier 'free' capacity 5",
+				warned + ": warning: endpoint '/api/users': prefix overlaps prefix endpoint '/api'",
+			},
+		},
+		{
+			name: "every error on its own line",
+			args: []string{"validate", "--config=" + invalid},
+			code: exitInvalid,
+			stdout: []string{
+				invalid + ": tier 'free': capacity must be positive\n",
+				invalid + ": endpoint '/api/upload': global_capacity must be positive\n",
+			},
+		},
+		{name: "unknown field", args: []string{"validate", "--config=" + typo}, code: exitInvalid, stdout: []string{typo + ": line 4: unknown field refillRate in tiers.free"}},
+		{name: "missing file", args: []string{"validate", "--config=" + filepath.Join(dir, "missing.yaml")}, code: exitError, stderr: []string{"no such file"}},
+		{name: "no config", args: []string{"validate"}, code: exitError, stderr: []string{"validate needs --config"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, stdout, stderr := runSubprocess(t, tt.args...)
+			if code != tt.code {
+				t.Errorf("expected exit %d, got %d\nstdout: %s\nstderr: %s", tt.code, code, stdout, stderr)
+			}
+			for _, want := range tt.stdout {
+				if !strings.Contains(stdout, want) {
+					t.Errorf("expected stdout to contain %q, got: %s", want, stdout)
+				}
+			}
+			for _, want := range tt.stderr {
+				if !strings.Contains(stderr, want) {
+					t.Errorf("expected stderr to contain %q, got: %s", want, stderr)
+				}
+			}
+			if tt.noWarnings && strings.Contains(stderr, "warning") {
+				t.Errorf("expected no warnings, got: %s", stderr)
+			}
+		})
+	}
+}
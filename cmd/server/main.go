@@ -1,32 +1,454 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	_ "time/tzdata" // Quota time zones on images without a zone database
 
 	"github.com/AndySung320/rate-limiter/config"
 	"github.com/AndySung320/rate-limiter/internal/api"
+	"github.com/AndySung320/rate-limiter/internal/grpclimit"
+	"github.com/AndySung320/rate-limiter/internal/jwtauth"
+	"github.com/AndySung320/rate-limiter/internal/notifier"
 	"github.com/AndySung320/rate-limiter/internal/storage"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
 )
 
 func main() {
+	// "server validate" checks the rules and exits without touching Redis
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(runValidate(os.Args[2:], os.Getenv, os.Stdout, os.Stderr))
+	}
+	settings, err := parseStartupConfig(os.Args[1:], os.Getenv, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalf("Invalid startup configuration: %v", err)
+	}
+	config.SetLenient(settings.LenientRules)
+	config.SetDirLastWins(settings.DirLastWins)
 	cwd, _ := os.Getwd()
 	log.Println("Running from:", cwd)
-	rulSet, err := config.LoadRuleSet("config/rules.yaml")
+
+	// Storage backend: Redis by default, or process memory for a single
+	// instance whose limits may reset on restart
+	var store storage.Storage
+	var memoryStore *storage.MemoryStorage
+	stateFile := os.Getenv("MEMORY_STATE_FILE")
+	backend := os.Getenv("RATE_LIMITER_BACKEND")
+	switch backend {
+	case "", "redis":
+		backend = "redis"
+		store = connectRedis(settings)
+	case "memory":
+		memoryStore = storage.NewMemoryStorageWithOptions(storage.MemoryOptions{
+			EagerRefill:    envBool("MEMORY_EAGER_REFILL", false),
+			RefillInterval: envDuration("MEMORY_REFILL_INTERVAL", storage.DefaultMemoryRefillInterval),
+			MaxBuckets:     envInt("MEMORY_MAX_BUCKETS", 0),
+		})
+		store = memoryStore
+		if stateFile == "" {
+			log.Println("⚠️ Using in-memory storage: limits are per instance and lost on restart")
+			break
+		}
+		log.Printf("Using in-memory storage, saved to %s on shutdown", stateFile)
+		if err := memoryStore.RestoreFromFile(stateFile); err == nil {
+			log.Printf("Restored bucket state from %s", stateFile)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("⚠️ Starting with empty buckets: %v", err)
+		}
+	default:
+		log.Fatalf("Unknown RATE_LIMITER_BACKEND %q (want redis or memory)", backend)
+	}
+
+	// Rules published to Redis take precedence over the rules file, which
+	// is used until the first publish
+	var remote remoteRules
+	if envBool("RULES_FROM_REDIS", false) {
+		redisStore, ok := store.(*storage.RedisStorage)
+		if !ok {
+			log.Fatalf("RULES_FROM_REDIS needs the redis backend, not %s", backend)
+		}
+		ruleStore, err := redisStore.RuleStore(os.Getenv("RULES_REDIS_KEY"))
+		if err != nil {
+			log.Fatalf("Failed to read rules from Redis: %v", err)
+		}
+		remote = ruleStore
+	}
+	rulesPath := settings.ConfigPath
+	// With CONFIG_SOURCE=etcd the rules follow an etcd key instead of the
+	// file, which is only read when the key doesn't exist yet
+	etcdEndpoints, etcdKey, etcdTLS := etcdSource()
+	if etcdEndpoints != nil && remote != nil {
+		log.Fatal("Set either CONFIG_SOURCE=etcd or RULES_FROM_REDIS, not both")
+	}
+	var rulSet *config.RuleSet
+	var rulesHash, rulesOrigin string
+	var rulesFiles []string
+	if etcdEndpoints != nil {
+		rulesOrigin = "etcd key " + etcdKey
+		rulSet, err = config.LoadRuleSetFromEtcd(etcdEndpoints, etcdKey, etcdTLS)
+		if err == nil {
+			rulesHash = rulesDigest(rulSet)
+		} else if errors.Is(err, config.ErrEtcdKeyNotFound) {
+			log.Printf("⚠️ No rules at %s yet, using %s until they are written", rulesOrigin, rulesPath)
+			rulSet, rulesHash, rulesFiles, rulesOrigin, err = loadRules(nil, rulesPath)
+		}
+	} else {
+		rulSet, rulesHash, rulesFiles, rulesOrigin, err = loadRules(remote, rulesPath)
+	}
 	if err != nil {
-		log.Fatalf("Failed to load rate limit rules: %v", err)
+		log.Fatalf("Failed to load rate limit rules from %s: %v", rulesOrigin, err)
 	}
 
-	// Try to initialize Redis storage
-	// ✅ Redis address from environment (fallback to localhost)
-	redisAddr := os.Getenv("REDIS_ADDR")
-	if redisAddr == "" {
-		redisAddr = "localhost:6379"
+	// Namespace and limit overrides from the environment, see config/env.go
+	if err := config.ApplyEnvOverrides(rulSet); err != nil {
+		log.Fatalf("Invalid rule overrides in the environment:\n%v", err)
+	}
+	if err := config.ValidateRuleSet(rulSet); err != nil {
+		log.Fatalf("Invalid rate limit rules in %s:\n%v", rulesOrigin, err)
+	}
+	log.Printf("Loaded rules from %s", rulesOrigin)
+	logDisabledEndpoints(rulSet)
+
+	// Initialize handler
+	var handlerOpts api.HandlerOptions
+	var verifier *jwtauth.Verifier
+	if rulSet.JWT.Enabled {
+		var secrets [][]byte
+		for _, secret := range strings.Split(os.Getenv("JWT_HMAC_SECRETS"), ",") {
+			if secret = strings.TrimSpace(secret); secret != "" {
+				secrets = append(secrets, []byte(secret))
+			}
+		}
+		verifier, err = jwtauth.NewVerifier(jwtauth.Options{
+			HMACSecrets: secrets,
+			JWKSURL:     rulSet.JWT.JWKSURL,
+			JWKSRefresh: rulSet.JWT.JWKSRefresh,
+			ClockSkew:   rulSet.JWT.ClockSkew,
+		})
+		if err != nil {
+			log.Fatalf("Failed to configure JWT verification: %v", err)
+		}
+		handlerOpts.TokenVerifier = verifier
+		log.Println("JWT verification enabled for /check")
+	}
+	// Shadow mode: evaluate and record every limit but never deny
+	if handlerOpts.ShadowMode = envBool("SHADOW_MODE", false); handlerOpts.ShadowMode {
+		log.Println("👻 Shadow mode enabled: would-be denials are logged and counted but allowed")
+	}
+	// Per-check debug lines are off unless asked for; errors are always logged
+	handlerOpts.Verbose = envBool("RATE_LIMITER_VERBOSE", false)
+	if ruleStore, ok := remote.(*storage.RedisRuleStore); ok {
+		handlerOpts.RulesPublisher = ruleStore
+	}
+	// Every decision goes to the audit log, as JSON lines, when one is set
+	var auditLog *api.FileAuditLogger
+	if path := os.Getenv("RATE_LIMITER_AUDIT_LOG"); path != "" {
+		if auditLog, err = api.NewFileAuditLogger(path, api.FileAuditOptions{}); err != nil {
+			log.Fatalf("Failed to open audit log: %v", err)
+		}
+		handlerOpts.AuditLogger = auditLog
+		log.Printf("📝 Auditing rate limit decisions to %s", path)
+	}
+	// Bans, high denial rates and exhausted quotas go to the rules' webhook, if any
+	webhooks := notifier.NewWebhookNotifier(notifier.WebhookOptions{})
+	handlerOpts.Notifier = webhooks
+	handler := api.NewRateLimiterHandlerWithOptions(store, rulSet, handlerOpts)
+
+	// Rules reload on SIGHUP and when the file changes, or when new rules
+	// are published to Redis
+	reloader := &ruleReloader{
+		path:    rulesPath,
+		remote:  remote,
+		poll:    envDuration("RULES_REDIS_POLL", 30*time.Second),
+		prepare: config.ApplyEnvOverrides,
+		apply:   handler.SetRules,
+	}
+	reloader.started(rulesHash, rulesFiles, rulesOrigin)
+
+	r := gin.Default()
+	// Every request gets an X-Request-ID that its log lines and audit entry carry
+	r.Use(api.RequestIDMiddleware())
+	// Counted so shutdown can report what it is draining
+	r.Use(api.InFlightMiddleware())
+	// Browsers on the origins in the rules' cors section may call the API
+	r.Use(handler.CORSMiddleware())
+
+	// Health check, with the storage's latency and connection pool
+	r.GET("/health", handler.HealthHandler(api.HealthOptions{
+		Backend:          backend,
+		LatencyThreshold: time.Duration(envInt("RATE_LIMITER_HEALTH_LATENCY_MS", 0)) * time.Millisecond,
+		RulesStatus:      reloader.status,
+	}))
+
+	// Prometheus metrics
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
+	// Rate limit calls, each client IP held to the rules' self_protect limits first
+	selfProtect := handler.SelfProtectMiddleware()
+	r.POST("/check", selfProtect, handler.CheckHandler)
+
+	// Blocking check that waits for tokens up to max_wait_ms
+	r.POST("/wait", selfProtect, handler.WaitHandler)
+
+	// Two-phase consumption: reserve tokens, then commit or release them
+	r.POST("/reserve", selfProtect, handler.ReserveHandler)
+	r.POST("/commit", handler.CommitHandler)
+	r.POST("/release", handler.ReleaseHandler)
+
+	// Return the cost of a check whose work failed
+	r.POST("/refund", selfProtect, handler.RefundHandler)
+
+	// nginx auth_request subrequests; header names are configurable per deployment
+	r.GET("/check/authrequest", selfProtect, handler.AuthRequestHandler(api.AuthRequestHeaders{
+		Key:  os.Getenv("AUTH_REQUEST_KEY_HEADER"),
+		URI:  os.Getenv("AUTH_REQUEST_URI_HEADER"),
+		Tier: os.Getenv("AUTH_REQUEST_TIER_HEADER"),
+		IP:   os.Getenv("AUTH_REQUEST_IP_HEADER"),
+		Cost: os.Getenv("AUTH_REQUEST_COST_HEADER"),
+	}))
+
+	// Loaded rules, for verifying what is in effect
+	r.GET("/rules", handler.RulesHandler)
+	r.GET("/limits", handler.LimitsHandler)
+
+	// OpenAPI description of every route, admin ones included
+	r.GET("/openapi.yaml", handler.OpenAPIHandler)
+
+	// Admin endpoints need an operator token from ADMIN_TOKENS, or the
+	// single RATE_LIMITER_ADMIN_TOKEN; without either they answer 503
+	var adminTokens map[string]string
+	if raw := os.Getenv("ADMIN_TOKENS"); raw != "" {
+		tokens, err := api.ParseAdminTokens(raw)
+		if err != nil {
+			log.Fatalf("Invalid ADMIN_TOKENS: %v", err)
+		}
+		adminTokens = tokens
+	} else if token := os.Getenv("RATE_LIMITER_ADMIN_TOKEN"); token != "" {
+		adminTokens = map[string]string{token: api.AdminOperator}
+	} else {
+		log.Println("Neither ADMIN_TOKENS nor RATE_LIMITER_ADMIN_TOKEN set, admin endpoints disabled")
+	}
+	{
+		admin := r.Group("/admin", api.AdminAuth(adminTokens))
+		admin.POST("/topup", handler.TopUpHandler)
+		admin.POST("/buckets/reset", handler.ResetBucketsHandler)
+		admin.DELETE("/buckets/*key", handler.DeleteBucketHandler)
+		admin.POST("/purge", handler.PurgeKeysHandler)
+		admin.POST("/set", handler.SetBucketHandler)
+		admin.POST("/simulate", handler.SimulateHandler)
+		admin.POST("/tiers/set", handler.SetTierHandler)
+		admin.POST("/tiers/remove", handler.RemoveTierHandler)
+		admin.GET("/top", handler.TopConsumersHandler)
+		admin.GET("/config", handler.ConfigHandler(reloader.provenance))
+		admin.GET("/schema", handler.SchemaHandler)
+		if remote != nil {
+			admin.POST("/rules", handler.PublishRulesHandler)
+		}
+	}
+
+	// Optional gRPC Check service for remote-mode interceptors
+	var grpcServer *grpc.Server
+	if grpcPort := os.Getenv("GRPC_PORT"); grpcPort != "" {
+		lis, err := net.Listen("tcp", ":"+grpcPort)
+		if err != nil {
+			log.Fatalf("Failed to listen for gRPC on :%s: %v", grpcPort, err)
+		}
+		grpcServer = grpc.NewServer()
+		grpclimit.RegisterCheckService(grpcServer, grpclimit.NewHandlerLimiter(handler))
+		go func() {
+			log.Printf("🚀 Starting gRPC server on :%s", grpcPort)
+			if err := grpcServer.Serve(lis); err != nil {
+				log.Printf("gRPC server stopped: %v", err)
+			}
+		}()
+	}
+
+	// Profiles are served on a port of their own, behind the admin tokens
+	var pprofServer *http.Server
+	if envBool("RATE_LIMITER_PPROF", false) {
+		pprofPort := os.Getenv("PPROF_PORT")
+		if pprofPort == "" {
+			pprofPort = defaultPprofPort
+		} else if !validPort(pprofPort) {
+			log.Fatalf("Invalid PPROF_PORT %q: must be a number from 1 to 65535", pprofPort)
+		}
+		if adminTokens == nil {
+			log.Println("No admin tokens set, pprof disabled")
+		} else {
+			pprofServer = NewPprofServer(pprofPort, adminTokens)
+			go func() {
+				log.Printf("🔬 Serving pprof on :%s", pprofPort)
+				if err := pprofServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+					log.Printf("pprof server stopped: %v", err)
+				}
+			}()
+		}
+	}
+
+	port := settings.Port
+	lis, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		log.Fatalf("Failed to listen on :%s: %v", port, err)
+	}
+
+	// SIGINT/SIGTERM stop new connections and drain in-flight requests
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if etcdEndpoints != nil {
+		// Rules that fail to load or validate leave the current ones in effect
+		origin := "etcd key " + etcdKey
+		err := config.WatchRuleSetEtcd(ctx, etcdEndpoints, etcdKey, etcdTLS, func(rules *config.RuleSet, err error) {
+			if err == nil {
+				err = reloader.applyRules(rules, rulesDigest(rules), origin, "etcd watch")
+			}
+			if err != nil {
+				log.Printf("❌ Keeping current rules: %v", err)
+			}
+		})
+		if err != nil {
+			log.Printf("⚠️ Not watching %s for changes: %v", origin, err)
+		}
+	} else if err := reloader.watch(ctx); err != nil {
+		log.Printf("⚠️ Not watching %s for changes, SIGHUP reloads are disabled: %v", rulesPath, err)
+	}
+	if remote != nil {
+		reloader.watchRemote(ctx)
+	}
+
+	log.Printf("🚀 Starting server on :%s", port)
+	err = serve(ctx, &http.Server{Handler: r}, lis, envDuration("SHUTDOWN_TIMEOUT", defaultShutdownTimeout), func() {
+		if grpcServer != nil {
+			grpcServer.GracefulStop()
+		}
+		if pprofServer != nil {
+			pprofServer.Close()
+		}
+		if verifier != nil {
+			verifier.Close()
+		}
+		// Closed once requests have drained so their decisions are written
+		if auditLog != nil {
+			if err := auditLog.Close(); err != nil {
+				log.Printf("Failed to close audit log: %v", err)
+			}
+		}
+		// Closed once requests have drained so their events are sent
+		webhooks.Close()
+		// Saved once requests have drained so no late consumption is lost
+		if memoryStore != nil && stateFile != "" {
+			if err := memoryStore.PersistToFile(stateFile); err != nil {
+				log.Printf("Failed to save bucket state: %v", err)
+			} else {
+				log.Printf("Saved bucket state to %s", stateFile)
+			}
+		}
+		if err := store.Close(); err != nil {
+			log.Printf("Failed to close storage: %v", err)
+		}
+	})
+	if err != nil {
+		log.Fatalf("Server stopped: %v", err)
+	}
+	log.Println("✅ Server stopped")
+}
+
+// etcdSource returns the etcd endpoints, key and TLS settings to read rules
+// from when CONFIG_SOURCE=etcd, or nil endpoints when rules come from the
+// rules file, including when ETCD_ENDPOINTS or ETCD_CONFIG_KEY is unset.
+func etcdSource() ([]string, string, *tls.Config) {
+	switch source := os.Getenv("CONFIG_SOURCE"); source {
+	case "", "file":
+		return nil, "", nil
+	case "etcd":
+	default:
+		log.Fatalf("Unknown CONFIG_SOURCE %q (want file or etcd)", source)
+	}
+	var endpoints []string
+	for _, endpoint := range strings.Split(os.Getenv("ETCD_ENDPOINTS"), ",") {
+		if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	key := os.Getenv("ETCD_CONFIG_KEY")
+	if len(endpoints) == 0 || key == "" {
+		log.Println("⚠️ CONFIG_SOURCE=etcd needs ETCD_ENDPOINTS and ETCD_CONFIG_KEY, using the rules file")
+		return nil, "", nil
+	}
+	var tlsConfig *tls.Config
+	certFile, keyFile, caFile := os.Getenv("ETCD_TLS_CERT"), os.Getenv("ETCD_TLS_KEY"), os.Getenv("ETCD_TLS_CA")
+	if certFile != "" || keyFile != "" || caFile != "" {
+		var err error
+		if tlsConfig, err = storage.TLSFromFiles(certFile, keyFile, caFile); err != nil {
+			log.Fatalf("Failed to configure etcd TLS: %v", err)
+		}
+	}
+	return endpoints, key, tlsConfig
+}
+
+// connectRedis builds the Redis storage from the resolved address, password
+// and database plus REDIS_* tuning settings, exiting when Redis is
+// unreachable.
+func connectRedis(settings startupConfig) *storage.RedisStorage {
+	redisAddr := settings.RedisAddr
+	redisOpts := storage.DefaultRedisOptions()
+	redisOpts.PoolSize = envInt("REDIS_POOL_SIZE", redisOpts.PoolSize)
+	redisOpts.MinIdleConns = envInt("REDIS_MIN_IDLE_CONNS", redisOpts.MinIdleConns)
+	redisOpts.MaxRetries = envInt("REDIS_MAX_RETRIES", redisOpts.MaxRetries)
+	redisOpts.DialTimeout = envDuration("REDIS_DIAL_TIMEOUT", redisOpts.DialTimeout)
+	redisOpts.ReadTimeout = envDuration("REDIS_READ_TIMEOUT", redisOpts.ReadTimeout)
+	redisOpts.WriteTimeout = envDuration("REDIS_WRITE_TIMEOUT", redisOpts.WriteTimeout)
+	redisOpts.PoolTimeout = envDuration("REDIS_POOL_TIMEOUT", redisOpts.PoolTimeout)
+	redisOpts.PingTimeout = envDuration("REDIS_PING_TIMEOUT", redisOpts.PingTimeout)
+	// Per-key consumption tracking for /admin/top; "0" disables it
+	redisOpts.TopConsumersWindow = envDuration("TOP_CONSUMERS_WINDOW", redisOpts.TopConsumersWindow)
+	if prefix := os.Getenv("REDIS_KEY_PREFIX"); prefix != "" {
+		redisOpts.KeyPrefix = prefix
+	}
+	// What dual checks do when one of their keys is unreachable: fail, global or key
+	if mode := os.Getenv("REDIS_PARTIAL_FAILURE_MODE"); mode != "" {
+		redisOpts.PartialFailureMode = storage.PartialFailureMode(mode)
+	}
+	// Hash of key -> tier read when tier_lookup is enabled
+	if tierHash := os.Getenv("REDIS_TIER_HASH_KEY"); tierHash != "" {
+		redisOpts.TierHashKey = tierHash
+	}
+	// Read replica for tier lookups and /admin/top; checks always use the primary
+	redisOpts.ReplicaAddr = os.Getenv("REDIS_REPLICA_ADDR")
+
+	certFile, keyFile, caFile := os.Getenv("REDIS_TLS_CERT"), os.Getenv("REDIS_TLS_KEY"), os.Getenv("REDIS_TLS_CA")
+	if certFile != "" || keyFile != "" || caFile != "" {
+		tlsConfig, err := storage.TLSFromFiles(certFile, keyFile, caFile)
+		if err != nil {
+			log.Fatalf("Failed to configure Redis TLS: %v", err)
+		}
+		redisOpts.TLSConfig = tlsConfig
+		log.Println("Redis TLS enabled")
+	}
+
+	log.Printf("Connecting to Redis at %s (db %d)", redisAddr, settings.RedisDB)
+	if redisOpts.ReplicaAddr != "" {
+		log.Printf("Reading tiers and top consumers from replica %s", redisOpts.ReplicaAddr)
+	}
+	redisStorage, err := storage.NewRedisStorageWithOptions(redisAddr, settings.RedisPassword, settings.RedisDB, redisOpts)
+	if err != nil {
+		log.Fatalf("Failed to initialize Redis storage: %v", err)
 	}
-	log.Printf("Connecting to Redis at %s", redisAddr)
-	redisStorage := storage.NewRedisStorage(redisAddr, "", 0)
 
 	// Test Redis connection
 	if err := redisStorage.Ping(); err != nil {
@@ -36,35 +458,44 @@ func main() {
 	}
 
 	log.Println("✅ Connected to Redis")
+	return redisStorage
+}
 
-	// Initialize handler
-	handler := api.NewRateLimiterHandler(redisStorage, rulSet)
-
-	r := gin.Default()
-
-	// Health check
-	r.GET("/health", func(c *gin.Context) {
-		// Also check Redis health
-		if err := redisStorage.Ping(); err != nil {
-			c.JSON(http.StatusServiceUnavailable, gin.H{
-				"status": "unhealthy",
-				"redis":  "disconnected",
-			})
-			return
-		}
-		c.JSON(http.StatusOK, gin.H{
-			"status": "ok",
-			"redis":  "connected",
-		})
-	})
+// envInt reads an integer setting, falling back to def when unset.
+func envInt(name string, def int) int {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", name, raw, err)
+	}
+	return v
+}
 
-	// Rate limit check
-	r.POST("/check", handler.CheckHandler)
+// envBool reads a boolean setting such as "true" or "1", falling back to def when unset.
+func envBool(name string, def bool) bool {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	v, err := strconv.ParseBool(raw)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", name, raw, err)
+	}
+	return v
+}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+// envDuration reads a duration setting such as "500ms", falling back to def when unset.
+func envDuration(name string, def time.Duration) time.Duration {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
 	}
-	log.Printf("🚀 Starting server on :%s", port)
-	r.Run(":" + port)
+	v, err := time.ParseDuration(raw)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", name, raw, err)
+	}
+	return v
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/internal/api"
+	"github.com/gin-gonic/gin"
+)
+
+// defaultPprofPort is where profiles are served unless PPROF_PORT says
+// otherwise.
+const defaultPprofPort = "6060"
+
+// NewPprofServer returns a server for the net/http/pprof handlers under
+// /debug/pprof/, for CPU, heap and goroutine profiles of a live instance.
+// It is meant for a port of its own, never the public one, and every
+// request needs one of adminTokens as a bearer token, as for /admin.
+//
+// Profiling is switched on at run time with RATE_LIMITER_PPROF so the
+// binary that misbehaves in production is the one profiled. The
+// alternative is to register these routes in a file built with
+// //go:build !prod, so production builds can't serve profiles at all,
+// at the cost of a rebuild to investigate.
+func NewPprofServer(port string, adminTokens map[string]string) *http.Server {
+	mux := http.NewServeMux()
+	// Index also serves the named profiles: heap, goroutine, allocs, ...
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	r := gin.New()
+	r.Use(gin.Recovery(), api.AdminAuth(adminTokens))
+	r.Any("/debug/pprof/*profile", gin.WrapH(mux))
+	return &http.Server{
+		Addr:              ":" + port,
+		Handler:           r,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
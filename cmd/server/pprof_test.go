@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewPprofServer(t *testing.T) {
+	srv := NewPprofServer("6061", map[string]string{"s3cret": "alice"})
+	if srv.Addr != ":6061" {
+		t.Errorf("expected the server on :6061, got %q", srv.Addr)
+	}
+
+	tests := []struct {
+		name  string
+		path  string
+		token string
+		want  int
+	}{
+		{"no token", "/debug/pprof/", "", http.StatusUnauthorized},
+		{"wrong token", "/debug/pprof/", "guess", http.StatusForbidden},
+		{"index", "/debug/pprof/", "s3cret", http.StatusOK},
+		{"named profile", "/debug/pprof/goroutine?debug=1", "s3cret", http.StatusOK},
+		{"cmdline", "/debug/pprof/cmdline", "s3cret", http.StatusOK},
+		{"outside pprof", "/check", "s3cret", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			srv.Handler.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Fatalf("expected %d, got %d: %s", tt.want, w.Code, w.Body)
+			}
+			if tt.name == "named profile" && !strings.Contains(w.Body.String(), "goroutine profile") {
+				t.Errorf("expected a goroutine profile, got %q", w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/api"
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDebounce coalesces the burst of events an editor or a Kubernetes
+// ConfigMap update produces into one reload.
+const reloadDebounce = 200 * time.Millisecond
+
+// ruleReloader reloads the rules file on SIGHUP and whenever it changes on
+// disk, or the rules published to remote when it holds any. New rules are
+// only applied when they load and validate; otherwise the current rules
+// stay in effect and the reason is logged.
+type ruleReloader struct {
+	path    string
+	remote  remoteRules                 // Optional; takes precedence over the file
+	poll    time.Duration               // How often remote is read in case a notification was missed; 0 never
+	prepare func(*config.RuleSet) error // Applies overrides such as the env namespace after each load
+	apply   func(*config.RuleSet)       // Swaps the rules in, e.g. handler.SetRules
+	mu      sync.Mutex                  // Serializes reloads and guards the fields below
+	loaded  time.Time
+	hash    string
+	files   []string // The rules file and the files it includes; none for remote rules
+	origin  string   // Where the rules in effect came from
+	// The latest reload attempt, whether or not it changed the rules
+	attempted  time.Time
+	attemptErr error
+}
+
+// remoteRules holds rules published for every replica, e.g.
+// *storage.RedisRuleStore. Load returns nil when none are published.
+type remoteRules interface {
+	Key() string
+	Load() ([]byte, error)
+	Subscribe(ctx context.Context) <-chan struct{}
+}
+
+// loadRules reads the rules published to remote, or the rules file at path
+// when remote is nil or holds none. Besides what readRules returns, it says
+// where the rules came from.
+func loadRules(remote remoteRules, path string) (*config.RuleSet, string, []string, string, error) {
+	if remote != nil {
+		origin := "redis key " + remote.Key()
+		data, err := remote.Load()
+		if err != nil {
+			return nil, "", nil, origin, err
+		}
+		if data != nil {
+			rules, err := config.ParseRuleSet(data)
+			if err != nil {
+				return nil, "", nil, origin, err
+			}
+			sum := sha256.Sum256(data)
+			return rules, hex.EncodeToString(sum[:]), nil, origin, nil
+		}
+	}
+	rules, hash, files, err := readRules(path)
+	return rules, hash, files, path, err
+}
+
+// readRules loads the rules file and its includes, returning the rules with
+// the SHA-256 of the bytes they were parsed from and the files read. With no
+// includes the hash is simply that of the rules file.
+func readRules(path string) (*config.RuleSet, string, []string, error) {
+	rules, files, err := config.LoadRuleFiles(path)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	sum := sha256.New()
+	paths := make([]string, len(files))
+	for i, file := range files {
+		if i > 0 {
+			fmt.Fprintf(sum, "\x00%s\x00", file.Path)
+		}
+		sum.Write(file.Data)
+		paths[i] = file.Path
+	}
+	return rules, hex.EncodeToString(sum.Sum(nil)), paths, nil
+}
+
+// started records the hash, files and origin of the rules the server
+// started with.
+func (r *ruleReloader) started(hash string, files []string, origin string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.loaded, r.hash, r.files, r.origin = time.Now(), hash, files, origin
+}
+
+// watchedFiles returns the files whose changes trigger a reload.
+func (r *ruleReloader) watchedFiles() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.files) == 0 {
+		return []string{r.path}
+	}
+	return r.files
+}
+
+// status returns when the rules in effect were loaded and their hash.
+func (r *ruleReloader) status() (time.Time, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.loaded, r.hash
+}
+
+// provenance describes the rules in effect and the latest reload, for
+// GET /admin/config.
+func (r *ruleReloader) provenance() api.RulesProvenance {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p := api.RulesProvenance{Source: r.origin, Files: r.files, SHA256: r.hash, LoadedAt: r.loaded}
+	if !r.attempted.IsZero() {
+		p.LastReload = &api.ReloadAttempt{At: r.attempted, Succeeded: r.attemptErr == nil}
+		if r.attemptErr != nil {
+			p.LastReload.Error = r.attemptErr.Error()
+		}
+	}
+	return p
+}
+
+// reload loads the rules and applies them if they changed and are valid.
+func (r *ruleReloader) reload(trigger string) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer func() { r.attempted, r.attemptErr = time.Now(), err }()
+
+	rules, hash, files, origin, err := loadRules(r.remote, r.path)
+	if err != nil {
+		return fmt.Errorf("failed to load %s: %w", origin, err)
+	}
+	return r.applyLocked(rules, hash, files, origin, trigger)
+}
+
+// applyRules applies rules pushed from origin, such as by an etcd watch, if
+// they changed and are valid. hash identifies them, e.g. rulesDigest(rules).
+func (r *ruleReloader) applyRules(rules *config.RuleSet, hash, origin, trigger string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.applyLocked(rules, hash, nil, origin, trigger)
+	r.attempted, r.attemptErr = time.Now(), err
+	return err
+}
+
+func (r *ruleReloader) applyLocked(rules *config.RuleSet, hash string, files []string, origin, trigger string) error {
+	if hash == r.hash {
+		return nil
+	}
+	if r.prepare != nil {
+		if err := r.prepare(rules); err != nil {
+			return fmt.Errorf("invalid rule overrides in the environment:\n%w", err)
+		}
+	}
+	if err := config.ValidateRuleSet(rules); err != nil {
+		return fmt.Errorf("invalid rules in %s:\n%w", origin, err)
+	}
+	r.apply(rules)
+	r.loaded, r.hash, r.files, r.origin = time.Now(), hash, files, origin
+	log.Printf("🔁 Reloaded rules from %s (%s, sha256 %.12s)", origin, trigger, hash)
+	logDisabledEndpoints(rules)
+	return nil
+}
+
+// logDisabledEndpoints names the endpoints whose limit_enabled is false, so
+// a kill switch left on shows up in the logs at every load.
+func logDisabledEndpoints(rules *config.RuleSet) {
+	for _, path := range sortedKeys(rules.Endpoints) {
+		if !rules.Endpoints[path].Limited() {
+			log.Printf("⏸️ Limiting disabled for endpoint %s", path)
+		}
+	}
+}
+
+// rulesDigest is the SHA-256 of rules encoded as JSON, for rules that were
+// not read as bytes this process can hash.
+func rulesDigest(rules *config.RuleSet) string {
+	data, _ := json.Marshal(rules)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// watchRemote reloads whenever rules are published to remote, and every
+// poll as well, until ctx is done.
+func (r *ruleReloader) watchRemote(ctx context.Context) {
+	updates := r.remote.Subscribe(ctx)
+	go func() {
+		var ticks <-chan time.Time
+		if r.poll > 0 {
+			ticker := time.NewTicker(r.poll)
+			defer ticker.Stop()
+			ticks = ticker.C
+		}
+		for {
+			trigger := ""
+			select {
+			case <-ctx.Done():
+				return
+			case <-updates:
+				trigger = "published"
+			case <-ticks:
+				trigger = "poll"
+			}
+			if err := r.reload(trigger); err != nil {
+				log.Printf("❌ Keeping current rules: %v", err)
+			}
+		}
+	}()
+}
+
+// watch reloads on SIGHUP and on changes to the rules file or the files it
+// includes, or to the rules files in the rules directory, until ctx is done. Directories are watched rather than files so
+// that editors that replace a file and ConfigMap symlink swaps are both seen.
+func (r *ruleReloader) watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	targets, err := watchFiles(watcher, r.watchedFiles())
+	if err != nil {
+		watcher.Close()
+		return err
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		defer watcher.Close()
+		defer signal.Stop(hup)
+
+		debounce := time.NewTimer(reloadDebounce)
+		debounce.Stop()
+		for {
+			trigger := ""
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				trigger = "SIGHUP"
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if targets[filepath.Clean(event.Name)] || filepath.Base(event.Name) == "..data" || r.inRulesDir(event.Name) {
+					debounce.Reset(reloadDebounce)
+				}
+				continue
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("⚠️ Watching %s: %v", r.path, err)
+				continue
+			case <-debounce.C:
+				trigger = "file changed"
+			}
+			if err := r.reload(trigger); err != nil {
+				log.Printf("❌ Keeping current rules: %v", err)
+				continue
+			}
+			// Includes may have been added since the last load
+			if targets, err = watchFiles(watcher, r.watchedFiles()); err != nil {
+				log.Printf("⚠️ Watching %s: %v", r.path, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// inRulesDir reports whether name is a rules file in the rules directory,
+// when the rules come from one, so that files added to it are loaded too.
+func (r *ruleReloader) inRulesDir(name string) bool {
+	return filepath.Dir(filepath.Clean(name)) == filepath.Clean(r.path) && config.IsRulesFile(filepath.Base(name))
+}
+
+// watchFiles adds the directory of each file to watcher and returns the set
+// of files to react to.
+func watchFiles(watcher *fsnotify.Watcher, files []string) (map[string]bool, error) {
+	targets := make(map[string]bool, len(files))
+	for _, file := range files {
+		if err := watcher.Add(filepath.Dir(file)); err != nil {
+			return nil, err
+		}
+		targets[filepath.Clean(file)] = true
+	}
+	return targets, nil
+}
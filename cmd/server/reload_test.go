@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/config"
+)
+
+func writeRules(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write rules: %v", err)
+	}
+}
+
+func newTestReloader(t *testing.T) (*ruleReloader, *atomic.Pointer[config.RuleSet]) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	writeRules(t, path, "ips:\n  capacity: 500\n  refill_rate: 50\n")
+	_, hash, files, err := readRules(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var current atomic.Pointer[config.RuleSet]
+	r := &ruleReloader{
+		path:    path,
+		prepare: func(rules *config.RuleSet) error { rules.Namespace = "prod"; return nil },
+		apply:   current.Store,
+	}
+	r.started(hash, files, path)
+	return r, &current
+}
+
+func TestRuleReloader_AppliesOnlyValidRules(t *testing.T) {
+	r, current := newTestReloader(t)
+	_, startHash := r.status()
+
+	writeRules(t, r.path, "ips:\n  capacity: 0\n  refill_rate: 50\n")
+	if err := r.reload("test"); err == nil {
+		t.Fatal("expected invalid rules to be rejected")
+	}
+	if current.Load() != nil {
+		t.Fatal("expected invalid rules not to be applied")
+	}
+	if _, hash := r.status(); hash != startHash {
+		t.Errorf("expected the hash of the rules in effect to stay %s, got %s", startHash, hash)
+	}
+
+	writeRules(t, r.path, "ips:\n  capacity: 800\n  refill_rate: 50\n")
+	if err := r.reload("test"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rules := current.Load()
+	if rules == nil || rules.IPs.Capacity != 800 || rules.Namespace != "prod" {
+		t.Fatalf("expected new rules with overrides applied, got %+v", rules)
+	}
+	if loadedAt, hash := r.status(); hash == startHash || time.Since(loadedAt) > time.Second {
+		t.Errorf("expected a new hash and load time, got %s at %v", hash, loadedAt)
+	}
+
+	// Reloading unchanged bytes is a no-op
+	current.Store(nil)
+	if err := r.reload("test"); err != nil || current.Load() != nil {
+		t.Errorf("expected no reapply for an unchanged file, got %v (err %v)", current.Load(), err)
+	}
+}
+
+func TestRuleReloader_Provenance(t *testing.T) {
+	r, _ := newTestReloader(t)
+	p := r.provenance()
+	if p.Source != r.path || len(p.Files) != 1 || p.SHA256 == "" || p.LoadedAt.IsZero() || p.LastReload != nil {
+		t.Fatalf("expected the startup rules with no reload yet, got %+v", p)
+	}
+
+	writeRules(t, r.path, "ips:\n  capacity: 0\n  refill_rate: 50\n")
+	r.reload("test")
+	failed := r.provenance()
+	if failed.SHA256 != p.SHA256 || failed.LastReload == nil || failed.LastReload.Succeeded || !strings.Contains(failed.LastReload.Error, "capacity must be positive") {
+		t.Fatalf("expected a failed reload that kept the rules, got %+v", failed)
+	}
+
+	writeRules(t, r.path, "ips:\n  capacity: 800\n  refill_rate: 50\n")
+	r.reload("test")
+	if reloaded := r.provenance(); reloaded.SHA256 == p.SHA256 || !reloaded.LastReload.Succeeded || reloaded.LastReload.Error != "" {
+		t.Errorf("expected a successful reload, got %+v", reloaded)
+	}
+}
+
+func TestRuleReloader_WatchesFile(t *testing.T) {
+	r, current := newTestReloader(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := r.watch(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Replace the file the way editors do: write a new one and rename it over
+	tmp := r.path + ".tmp"
+	writeRules(t, tmp, "ips:\n  capacity: 900\n  refill_rate: 50\n")
+	if err := os.Rename(tmp, r.path); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if rules := current.Load(); rules != nil {
+			if rules.IPs.Capacity != 900 {
+				t.Fatalf("expected reloaded capacity 900, got %d", rules.IPs.Capacity)
+			}
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("expected the change to be picked up")
+}
+
+func TestRuleReloader_ReloadsIncludedFiles(t *testing.T) {
+	r, current := newTestReloader(t)
+	included := filepath.Join(filepath.Dir(r.path), "ips.yaml")
+	writeRules(t, included, "ips:\n  capacity: 600\n")
+	writeRules(t, r.path, "include: ips.yaml\nips:\n  capacity: 500\n  refill_rate: 50\n")
+	if err := r.reload("test"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rules := current.Load(); rules == nil || rules.IPs.Capacity != 600 || rules.IPs.RefillRate != 50 {
+		t.Fatalf("expected the include merged over the rules file, got %+v", rules)
+	}
+
+	// Changing only the included file changes the hash, so it is reloaded
+	writeRules(t, included, "ips:\n  capacity: 700\n")
+	if err := r.reload("test"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rules := current.Load(); rules.IPs.Capacity != 700 {
+		t.Fatalf("expected the included change to apply, got %+v", rules.IPs)
+	}
+	if files := r.watchedFiles(); len(files) != 2 || files[1] != included {
+		t.Errorf("expected the include to be watched, got %v", files)
+	}
+}
+
+func TestRuleReloader_WatchesDirectory(t *testing.T) {
+	dir := t.TempDir()
+	writeRules(t, filepath.Join(dir, "ips.yaml"), "ips:\n  capacity: 500\n  refill_rate: 50\n")
+	_, hash, files, err := readRules(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var current atomic.Pointer[config.RuleSet]
+	r := &ruleReloader{path: dir, apply: current.Store}
+	r.started(hash, files, dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := r.watch(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A team adding its own file is picked up without touching the others
+	writeRules(t, filepath.Join(dir, "search.yaml"), "tiers:\n  free: {capacity: 100, refill_rate: 10}\n")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if rules := current.Load(); rules != nil {
+			if rules.Tiers["free"].Capacity != 100 || rules.IPs.Capacity != 500 {
+				t.Fatalf("expected both files merged, got %+v", rules)
+			}
+			if files := r.watchedFiles(); len(files) != 2 {
+				t.Errorf("expected both files watched, got %v", files)
+			}
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("expected the new file to be picked up")
+}
+
+// fakeRemote is a remoteRules whose published rules the test sets.
+type fakeRemote struct {
+	mu      sync.Mutex
+	data    []byte
+	err     error
+	updates chan struct{}
+}
+
+func (f *fakeRemote) Key() string { return "rate_limit:rules" }
+
+func (f *fakeRemote) Load() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.data, f.err
+}
+
+func (f *fakeRemote) Subscribe(ctx context.Context) <-chan struct{} { return f.updates }
+
+func (f *fakeRemote) publish(data string) {
+	f.mu.Lock()
+	f.data = []byte(data)
+	f.mu.Unlock()
+	f.updates <- struct{}{}
+}
+
+func TestRuleReloader_RemoteRules(t *testing.T) {
+	r, current := newTestReloader(t)
+	remote := &fakeRemote{updates: make(chan struct{}, 1)}
+	r.remote = remote
+
+	// Nothing published: the rules file stays in effect
+	_, fileHash := r.status()
+	if err := r.reload("test"); err != nil || current.Load() != nil {
+		t.Fatalf("expected the unchanged file to stay in effect, got %v (err %v)", current.Load(), err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.watchRemote(ctx)
+	waitFor := func(capacity int64) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if rules := current.Load(); rules != nil && rules.IPs.Capacity == capacity {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("expected published capacity %d to be applied, got %+v", capacity, current.Load())
+	}
+
+	remote.publish(`{"ips": {"capacity": 700, "refill_rate": 70}}`)
+	waitFor(700)
+	if rules := current.Load(); rules.Namespace != "prod" {
+		t.Errorf("expected overrides applied to published rules, got namespace %q", rules.Namespace)
+	}
+	if _, hash := r.status(); hash == fileHash {
+		t.Error("expected the hash of the published rules")
+	}
+	if files := r.watchedFiles(); len(files) != 1 || files[0] != r.path {
+		t.Errorf("expected the rules file to stay watched, got %v", files)
+	}
+
+	// Invalid rules are never applied
+	remote.publish("ips:\n  capacity: 0\n  refill_rate: 50\n")
+	if err := r.reload("test"); err == nil || !strings.Contains(err.Error(), "invalid rules in redis key rate_limit:rules") {
+		t.Fatalf("expected the published rules to be rejected, got %v", err)
+	}
+	if rules := current.Load(); rules.IPs.Capacity != 700 {
+		t.Fatalf("expected the last valid rules to stay in effect, got %+v", rules.IPs)
+	}
+
+	// So is anything while Redis is unreachable
+	remote.mu.Lock()
+	remote.err = errors.New("connection refused")
+	remote.mu.Unlock()
+	if err := r.reload("test"); err == nil {
+		t.Fatal("expected a load error")
+	}
+	if rules := current.Load(); rules.IPs.Capacity != 700 {
+		t.Fatalf("expected the last valid rules to stay in effect, got %+v", rules.IPs)
+	}
+}
+
+func TestRuleReloader_ApplyRules(t *testing.T) {
+	r, current := newTestReloader(t)
+
+	invalid := &config.RuleSet{IPs: config.IPConfig{Capacity: 0, RefillRate: 50}}
+	if err := r.applyRules(invalid, rulesDigest(invalid), "etcd key /rules", "test"); err == nil || !strings.Contains(err.Error(), "invalid rules in etcd key /rules") {
+		t.Fatalf("expected invalid rules to be rejected, got %v", err)
+	}
+	if current.Load() != nil {
+		t.Fatal("expected invalid rules not to be applied")
+	}
+
+	pushed := &config.RuleSet{IPs: config.IPConfig{Capacity: 900, RefillRate: 50}}
+	if err := r.applyRules(pushed, rulesDigest(pushed), "etcd key /rules", "test"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rules := current.Load(); rules != pushed || rules.Namespace != "prod" {
+		t.Fatalf("expected the pushed rules with overrides applied, got %+v", rules)
+	}
+
+	// The same rules pushed again are not reapplied
+	current.Store(nil)
+	again := &config.RuleSet{IPs: config.IPConfig{Capacity: 900, RefillRate: 50}}
+	if err := r.applyRules(again, rulesDigest(again), "etcd key /rules", "test"); err != nil || current.Load() != nil {
+		t.Errorf("expected no reapply for unchanged rules, got %v (err %v)", current.Load(), err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const (
+	defaultConfigPath = "config/rules.yaml"
+	defaultRedisAddr  = "localhost:6379"
+	defaultPort       = "8080"
+)
+
+// startupConfig is what main needs to know before loading anything: where
+// the rules are, which Redis to use and which port to serve on. Each setting comes from its flag,
+// else its environment variable, else the default.
+type startupConfig struct {
+	ConfigPath    string // -config, RATE_LIMITER_CONFIG
+	RedisAddr     string // -redis-addr, REDIS_ADDR
+	RedisPassword string // -redis-password, REDIS_PASSWORD
+	RedisDB       int    // -redis-db, REDIS_DB
+	Port          string // -port, PORT
+	LenientRules  bool   // -lenient-rules, RATE_LIMITER_LENIENT_RULES
+	DirLastWins   bool   // -rules-dir-last-wins, RATE_LIMITER_RULES_DIR_LAST_WINS
+}
+
+// parseStartupConfig resolves the startup settings from command line args
+// (without the program name) and getenv. An empty variable counts as unset.
+// Errors name the flag or variable that was wrong.
+func parseStartupConfig(args []string, getenv func(string) string, usage io.Writer) (startupConfig, error) {
+	fs := flag.NewFlagSet("rate-limiter", flag.ContinueOnError)
+	fs.SetOutput(usage)
+	configPath := fs.String("config", defaultConfigPath, "rules file, or directory of rules files (env RATE_LIMITER_CONFIG)")
+	redisAddr := fs.String("redis-addr", defaultRedisAddr, "Redis host:port (env REDIS_ADDR)")
+	redisPassword := fs.String("redis-password", "", "Redis password (env REDIS_PASSWORD)")
+	redisDB := fs.Int("redis-db", 0, "Redis database number (env REDIS_DB)")
+	port := fs.String("port", defaultPort, "HTTP listen port (env PORT)")
+	lenientRules := fs.Bool("lenient-rules", false, "ignore unknown fields in rules files instead of failing (env RATE_LIMITER_LENIENT_RULES)")
+	dirLastWins := fs.Bool("rules-dir-last-wins", false, "let later files in a rules directory override tiers and endpoints of earlier ones instead of failing (env RATE_LIMITER_RULES_DIR_LAST_WINS)")
+	if err := fs.Parse(args); err != nil {
+		return startupConfig{}, err
+	}
+	if fs.NArg() > 0 {
+		return startupConfig{}, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	cfg := startupConfig{
+		ConfigPath:    *configPath,
+		RedisAddr:     *redisAddr,
+		RedisPassword: *redisPassword,
+		RedisDB:       *redisDB,
+		Port:          *port,
+		LenientRules:  *lenientRules,
+		DirLastWins:   *dirLastWins,
+	}
+	if v := getenv("RATE_LIMITER_CONFIG"); v != "" && !set["config"] {
+		cfg.ConfigPath = v
+	}
+	if v := getenv("REDIS_ADDR"); v != "" && !set["redis-addr"] {
+		cfg.RedisAddr = v
+	}
+	if v := getenv("REDIS_PASSWORD"); v != "" && !set["redis-password"] {
+		cfg.RedisPassword = v
+	}
+	if v := getenv("REDIS_DB"); v != "" && !set["redis-db"] {
+		db, err := strconv.Atoi(v)
+		if err != nil || db < 0 {
+			return startupConfig{}, fmt.Errorf("invalid REDIS_DB %q: must be a non-negative integer", v)
+		}
+		cfg.RedisDB = db
+	}
+	if v := getenv("PORT"); v != "" && !set["port"] {
+		if !validPort(v) {
+			return startupConfig{}, fmt.Errorf("invalid PORT %q: must be a number from 1 to 65535", v)
+		}
+		cfg.Port = v
+	}
+	if v := getenv("RATE_LIMITER_LENIENT_RULES"); v != "" && !set["lenient-rules"] {
+		lenient, err := strconv.ParseBool(v)
+		if err != nil {
+			return startupConfig{}, fmt.Errorf("invalid RATE_LIMITER_LENIENT_RULES %q: must be true or false", v)
+		}
+		cfg.LenientRules = lenient
+	}
+	if v := getenv("RATE_LIMITER_RULES_DIR_LAST_WINS"); v != "" && !set["rules-dir-last-wins"] {
+		lastWins, err := strconv.ParseBool(v)
+		if err != nil {
+			return startupConfig{}, fmt.Errorf("invalid RATE_LIMITER_RULES_DIR_LAST_WINS %q: must be true or false", v)
+		}
+		cfg.DirLastWins = lastWins
+	}
+
+	if cfg.ConfigPath == "" {
+		return startupConfig{}, fmt.Errorf("-config must not be empty")
+	}
+	if cfg.RedisAddr == "" {
+		return startupConfig{}, fmt.Errorf("-redis-addr must not be empty")
+	}
+	if cfg.RedisDB < 0 {
+		return startupConfig{}, fmt.Errorf("invalid -redis-db %d: must be a non-negative integer", cfg.RedisDB)
+	}
+	if !validPort(cfg.Port) {
+		return startupConfig{}, fmt.Errorf("invalid -port %q: must be a number from 1 to 65535", cfg.Port)
+	}
+	return cfg, nil
+}
+
+func validPort(s string) bool {
+	n, err := strconv.Atoi(s)
+	return err == nil && n >= 1 && n <= 65535
+}
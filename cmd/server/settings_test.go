@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParseStartupConfig_Precedence(t *testing.T) {
+	env := map[string]string{
+		"RATE_LIMITER_CONFIG":              "/etc/limiter/rules.yaml",
+		"REDIS_ADDR":                       "redis:6379",
+		"REDIS_PASSWORD":                   "from-env",
+		"REDIS_DB":                         "2",
+		"PORT":                             "9090",
+		"RATE_LIMITER_LENIENT_RULES":       "true",
+		"RATE_LIMITER_RULES_DIR_LAST_WINS": "true",
+	}
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want startupConfig
+	}{
+		{
+			name: "defaults",
+			want: startupConfig{ConfigPath: "config/rules.yaml", RedisAddr: "localhost:6379", Port: "8080"},
+		},
+		{
+			name: "environment over defaults",
+			env:  env,
+			want: startupConfig{ConfigPath: "/etc/limiter/rules.yaml", RedisAddr: "redis:6379", RedisPassword: "from-env", RedisDB: 2, Port: "9090", LenientRules: true, DirLastWins: true},
+		},
+		{
+			name: "flags over environment",
+			args: []string{"-config", "rules.yaml", "-redis-addr", "10.0.0.5:6380", "-redis-password", "from-flag", "-redis-db", "0", "-port", "8081", "-lenient-rules=false", "-rules-dir-last-wins=false"},
+			env:  env,
+			want: startupConfig{ConfigPath: "rules.yaml", RedisAddr: "10.0.0.5:6380", RedisPassword: "from-flag", RedisDB: 0, Port: "8081"},
+		},
+		{
+			name: "flags and environment mixed",
+			args: []string{"-redis-db=5"},
+			env:  map[string]string{"REDIS_ADDR": "redis:6379", "REDIS_DB": "2", "PORT": "9090"},
+			want: startupConfig{ConfigPath: "config/rules.yaml", RedisAddr: "redis:6379", RedisDB: 5, Port: "9090"},
+		},
+		{
+			name: "empty variables count as unset",
+			env:  map[string]string{"REDIS_ADDR": "", "RATE_LIMITER_CONFIG": ""},
+			want: startupConfig{ConfigPath: "config/rules.yaml", RedisAddr: "localhost:6379", Port: "8080"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseStartupConfig(tt.args, func(name string) string { return tt.env[name] }, io.Discard)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseStartupConfig_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want string // Substring naming the bad setting
+	}{
+		{"bad REDIS_DB", nil, map[string]string{"REDIS_DB": "one"}, "REDIS_DB"},
+		{"negative REDIS_DB", nil, map[string]string{"REDIS_DB": "-1"}, "REDIS_DB"},
+		{"bad -redis-db", []string{"-redis-db", "one"}, nil, "redis-db"},
+		{"negative -redis-db", []string{"-redis-db", "-1"}, nil, "-redis-db"},
+		{"empty -config", []string{"-config", ""}, nil, "-config"},
+		{"empty -redis-addr", []string{"-redis-addr="}, nil, "-redis-addr"},
+		{"bad PORT", nil, map[string]string{"PORT": "http"}, "PORT"},
+		{"-port out of range", []string{"-port", "70000"}, nil, "-port"},
+		{"unknown flag", []string{"-listen", ":8080"}, nil, "listen"},
+		{"bad RATE_LIMITER_LENIENT_RULES", nil, map[string]string{"RATE_LIMITER_LENIENT_RULES": "sometimes"}, "RATE_LIMITER_LENIENT_RULES"},
+		{"bad RATE_LIMITER_RULES_DIR_LAST_WINS", nil, map[string]string{"RATE_LIMITER_RULES_DIR_LAST_WINS": "maybe"}, "RATE_LIMITER_RULES_DIR_LAST_WINS"},
+		{"stray argument", []string{"rules.yaml"}, nil, "rules.yaml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseStartupConfig(tt.args, func(name string) string { return tt.env[name] }, io.Discard)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("expected an error mentioning %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/internal/api"
+)
+
+// defaultShutdownTimeout is how long in-flight requests get to finish
+// unless SHUTDOWN_TIMEOUT says otherwise.
+const defaultShutdownTimeout = 15 * time.Second
+
+// serve runs srv on lis until ctx is cancelled. It then stops accepting
+// connections, waits up to timeout for in-flight requests to finish and
+// finally runs cleanup, e.g. to close Redis. An error is returned if the
+// server fails to serve or the drain times out.
+func serve(ctx context.Context, srv *http.Server, lis net.Listener, timeout time.Duration, cleanup func()) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(lis)
+	}()
+
+	select {
+	case err := <-serveErr:
+		cleanup()
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down, waiting up to %s for %d in-flight requests", timeout, api.InFlightRequests())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := srv.Shutdown(shutdownCtx)
+	if serveErr := <-serveErr; !errors.Is(serveErr, http.ErrServerClosed) {
+		err = errors.Join(err, serveErr)
+	}
+	cleanup()
+	return err
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/internal/api"
+	"github.com/gin-gonic/gin"
+)
+
+func TestServe_DrainsInFlightRequestsBeforeCleanup(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := "http://" + lis.Addr().String()
+
+	started := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var cleanedUpAt time.Time
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(ctx, srv, lis, time.Second, func() { cleanedUpAt = time.Now() })
+	}()
+
+	respDone := make(chan time.Time, 1)
+	go func() {
+		resp, err := http.Get(addr)
+		if err != nil {
+			t.Errorf("in-flight request failed: %v", err)
+		} else if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status 200, got %d", resp.StatusCode)
+		}
+		respDone <- time.Now()
+	}()
+
+	<-started
+	cancel()
+
+	if err := <-done; err != nil {
+		t.Fatalf("expected clean shutdown, got %v", err)
+	}
+	finishedAt := <-respDone
+	if cleanedUpAt.IsZero() {
+		t.Fatal("expected cleanup to run")
+	}
+	if cleanedUpAt.Before(finishedAt.Add(-50 * time.Millisecond)) {
+		t.Errorf("cleanup ran before the in-flight request finished")
+	}
+
+	if _, err := http.Get(addr); err == nil {
+		t.Error("expected new connections to be refused after shutdown")
+	}
+}
+
+func TestServe_TimesOutSlowRequests(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cleanedUp := false
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(ctx, srv, lis, 50*time.Millisecond, func() { cleanedUp = true })
+	}()
+
+	go http.Get("http://" + lis.Addr().String())
+	<-started
+	cancel()
+
+	if err := <-done; err == nil {
+		t.Error("expected a timeout error when requests do not drain")
+	}
+	if !cleanedUp {
+		t.Error("expected cleanup to run even when the drain times out")
+	}
+}
+
+func TestServe_SIGTERMDrainsSlowRequest(t *testing.T) {
+	started := make(chan struct{})
+	router := gin.New()
+	router.Use(api.InFlightMiddleware())
+	router.GET("/slow", func(c *gin.Context) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		c.Status(http.StatusOK)
+	})
+	// Only its listener is used; serve runs the server
+	ts := httptest.NewUnstartedServer(router)
+	lis := ts.Listener
+
+	// As main does, so the signal cancels ctx instead of killing the test
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+	defer stop()
+	var cleanedUpAt time.Time
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(ctx, &http.Server{Handler: router}, lis, time.Second, func() { cleanedUpAt = time.Now() })
+	}()
+
+	respDone := make(chan time.Time, 1)
+	go func() {
+		resp, err := http.Get("http://" + lis.Addr().String() + "/slow")
+		if err != nil {
+			t.Errorf("in-flight request failed: %v", err)
+		} else if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status 200, got %d", resp.StatusCode)
+		}
+		respDone <- time.Now()
+	}()
+
+	<-started
+	if got := api.InFlightRequests(); got != 1 {
+		t.Errorf("expected 1 request in flight, got %d", got)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatalf("failed to send SIGTERM: %v", err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("expected clean shutdown, got %v", err)
+	}
+	finishedAt := <-respDone
+	if cleanedUpAt.Before(finishedAt.Add(-50 * time.Millisecond)) {
+		t.Errorf("server exited before the in-flight request finished")
+	}
+	if got := api.InFlightRequests(); got != 0 {
+		t.Errorf("expected nothing in flight after shutdown, got %d", got)
+	}
+}
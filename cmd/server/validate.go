@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"gopkg.in/yaml.v3"
+)
+
+// Exit codes of the validate subcommand, as ratelimiter-cli validate uses.
+const (
+	validateOK      = 0
+	validateInvalid = 1 // The rules have errors
+	validateError   = 2 // Bad arguments, or the rules couldn't be read
+)
+
+// runValidate implements "server validate [flags]": it loads the rules as
+// startup would, with the same flags, environment variables and overrides,
+// and reports every problem without connecting to Redis. Errors go to
+// stdout one per line, prefixed with the rules path; on success a summary
+// of the rules follows any warnings.
+func runValidate(args []string, getenv func(string) string, stdout, stderr io.Writer) int {
+	settings, err := parseStartupConfig(args, getenv, stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return validateOK
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Invalid startup configuration: %v\n", err)
+		return validateError
+	}
+	config.SetLenient(settings.LenientRules)
+	config.SetDirLastWins(settings.DirLastWins)
+	path := settings.ConfigPath
+
+	rules, files, err := config.LoadRuleFiles(path)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintln(stderr, err)
+		return validateError
+	}
+	if err == nil {
+		if err = config.ApplyEnvOverrides(rules); err == nil {
+			err = config.ValidateRuleSet(rules)
+		}
+	}
+	if err != nil {
+		defined := definitionLines(files)
+		for _, line := range strings.Split(err.Error(), "\n") {
+			if at, ok := defined[definitionPattern.FindString(line)]; ok {
+				line = at + ": " + line
+			} else if !strings.HasPrefix(line, path) {
+				line = path + ": " + line
+			}
+			fmt.Fprintln(stdout, line)
+		}
+		return validateInvalid
+	}
+
+	for _, warning := range config.Warnings(rules) {
+		fmt.Fprintf(stderr, "%s: warning: %s\n", path, warning)
+	}
+	fmt.Fprintf(stdout, "%s: OK\n", path)
+	fmt.Fprintf(stdout, "  files:        %d\n", len(files))
+	fmt.Fprintf(stdout, "  tiers:        %s\n", countedNames(sortedKeys(rules.Tiers)))
+	byRule := make(map[string]int)
+	for _, ep := range rules.Endpoints {
+		byRule[ep.Rule]++
+	}
+	var ruleCounts []string
+	for _, rule := range sortedKeys(byRule) {
+		ruleCounts = append(ruleCounts, fmt.Sprintf("%d %s", byRule[rule], rule))
+	}
+	endpoints := fmt.Sprint(len(rules.Endpoints))
+	if ruleCounts != nil {
+		endpoints += " (" + strings.Join(ruleCounts, ", ") + ")"
+	}
+	fmt.Fprintf(stdout, "  endpoints:    %s\n", endpoints)
+	fmt.Fprintf(stdout, "  ip_overrides: %d\n", len(rules.IPOverrides))
+	if rules.Namespace != "" {
+		fmt.Fprintf(stdout, "  namespace:    %s\n", rules.Namespace)
+	}
+	return validateOK
+}
+
+// definitionPattern matches the tier or endpoint a validation error starts
+// with, e.g. "endpoint '/api/upload'".
+var definitionPattern = regexp.MustCompile(`^(tier|endpoint) '[^']*'`)
+
+// definitionLines maps each tier and endpoint, named as validation errors
+// name them, to the file and line that define it. One defined in several
+// files is placed in the last, whose settings take precedence.
+func definitionLines(files []config.RuleFile) map[string]string {
+	kinds := map[string]string{"tiers": "tier", "endpoints": "endpoint"}
+	defined := make(map[string]string)
+	for _, file := range files {
+		var doc yaml.Node
+		if yaml.Unmarshal(file.Data, &doc) != nil || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+			continue
+		}
+		top := doc.Content[0].Content
+		for i := 0; i+1 < len(top); i += 2 {
+			kind, ok := kinds[top[i].Value]
+			if !ok || top[i+1].Kind != yaml.MappingNode {
+				continue
+			}
+			entries := top[i+1].Content
+			for j := 0; j+1 < len(entries); j += 2 {
+				defined[fmt.Sprintf("%s '%s'", kind, entries[j].Value)] = fmt.Sprintf("%s:%d", file.Path, entries[j].Line)
+			}
+		}
+	}
+	return defined
+}
+
+// countedNames formats names as "2 (free, premium)".
+func countedNames(names []string) string {
+	if len(names) == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%d (%s)", len(names), strings.Join(names, ", "))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
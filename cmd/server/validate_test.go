@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/AndySung320/rate-limiter/config"
+)
+
+func TestRunValidate(t *testing.T) {
+	t.Cleanup(func() {
+		config.SetLenient(false)
+		config.SetDirLastWins(false)
+	})
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.yaml")
+	writeRules(t, valid, `
+tiers:
+  free: {capacity: 100, refill_rate: 10}
+endpoints:
+  /api/upload: {rule: tiers+endpoints, cost: 10, global_capacity: 1000, global_refill_rate: 100}
+`)
+	invalid := filepath.Join(dir, "invalid.yaml")
+	writeRules(t, invalid, `tiers:
+  free: {capacity: 0, refill_rate: 10}
+endpoints:
+  /api/upload: {rule: tiers+endpoints, cost: 10, global_capacity: 1000, global_refill_rate: 100}
+  /api/list: {rule: endpoint, cost: 5000, global_capacity: 1000, global_refill_rate: 100}
+`)
+	typo := filepath.Join(dir, "typo.yaml")
+	writeRules(t, typo, `tiers:
+  free:
+    capacity: 100
+    refillRate: 10
+`)
+	confd := filepath.Join(dir, "conf.d")
+	if err := os.Mkdir(confd, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeRules(t, filepath.Join(confd, "00-tiers.yaml"), "tiers:\n  free: {capacity: 100, refill_rate: 10}\n")
+	writeRules(t, filepath.Join(confd, "search.yaml"), "endpoints:\n  /api/search: {rule: tiers+endpoints, cost: 500, global_capacity: 1000, global_refill_rate: 100}\n")
+
+	tests := []struct {
+		name   string
+		args   []string
+		env    map[string]string
+		code   int
+		stdout []string
+		stderr string
+	}{
+		{
+			name:   "valid",
+			args:   []string{"-config", valid},
+			code:   validateOK,
+			stdout: []string{valid + ": OK\n", "tiers:        1 (free)\n", "endpoints:    1 (1 tiers+endpoints)\n"},
+		},
+		{
+			name:   "path from the environment",
+			env:    map[string]string{"RATE_LIMITER_CONFIG": valid},
+			code:   validateOK,
+			stdout: []string{valid + ": OK\n"},
+		},
+		{
+			name: "every problem at the line defining it",
+			args: []string{"-config", invalid},
+			code: validateInvalid,
+			stdout: []string{
+				invalid + ":2: tier 'free': capacity must be positive\n",
+				invalid + ":5: endpoint '/api/list': cost 5000 exceeds global_capacity 1000",
+			},
+		},
+		{
+			name:   "unknown field",
+			args:   []string{"-config", typo},
+			code:   validateInvalid,
+			stdout: []string{typo + ": line 4: unknown field refillRate in tiers.free"},
+		},
+		{
+			name:   "lenient rules as the server would load them",
+			args:   []string{"-config", typo, "-lenient-rules"},
+			code:   validateInvalid,
+			stdout: []string{typo + ":2: tier 'free': refill_rate must be positive"},
+		},
+		{
+			name:   "directory problems point into its files",
+			args:   []string{"-config", confd},
+			code:   validateInvalid,
+			stdout: []string{filepath.Join(confd, "search.yaml") + ":2: endpoint '/api/search'"},
+		},
+		{name: "missing file", args: []string{"-config", filepath.Join(dir, "missing.yaml")}, code: validateError, stderr: "no such file"},
+		{name: "bad flag", args: []string{"-port", "0"}, code: validateError, stderr: "invalid -port"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := runValidate(tt.args, func(name string) string { return tt.env[name] }, &stdout, &stderr)
+			if code != tt.code {
+				t.Errorf("expected exit %d, got %d\nstdout: %s\nstderr: %s", tt.code, code, stdout.String(), stderr.String())
+			}
+			for _, want := range tt.stdout {
+				if !strings.Contains(stdout.String(), want) {
+					t.Errorf("expected stdout to contain %q, got: %s", want, stdout.String())
+				}
+			}
+			if !strings.Contains(stderr.String(), tt.stderr) {
+				t.Errorf("expected stderr to contain %q, got: %s", tt.stderr, stderr.String())
+			}
+		})
+	}
+}
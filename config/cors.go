@@ -0,0 +1,76 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// CORSConfig lets browsers call the limiter from pages on other origins,
+// such as an admin UI served from its own host. It is off while
+// AllowOrigins is empty.
+type CORSConfig struct {
+	// AllowOrigins lists the origins allowed, e.g.
+	// "https://admin.example.com"; "*" allows any
+	AllowOrigins []string `yaml:"allow_origins" json:"allow_origins,omitempty"`
+	AllowMethods []string `yaml:"allow_methods" json:"allow_methods,omitempty"` // Defaults to GET, POST and DELETE
+	AllowHeaders []string `yaml:"allow_headers" json:"allow_headers,omitempty"` // Defaults to the request headers the API reads
+	// AllowCredentials lets browsers send cookies and Authorization headers.
+	// Browsers refuse "*" with credentials, so the caller's origin is echoed
+	// back instead
+	AllowCredentials bool          `yaml:"allow_credentials" json:"allow_credentials,omitempty"`
+	MaxAge           time.Duration `yaml:"max_age" json:"max_age,omitempty"` // How long browsers may cache a preflight; unset leaves it to them
+}
+
+// Enabled reports whether any origin is allowed.
+func (c CORSConfig) Enabled() bool {
+	return len(c.AllowOrigins) > 0
+}
+
+// AllowsAnyOrigin reports whether AllowOrigins includes "*".
+func (c CORSConfig) AllowsAnyOrigin() bool {
+	return slices.Contains(c.AllowOrigins, "*")
+}
+
+// AllowsOrigin reports whether a page on origin may call the API.
+func (c CORSConfig) AllowsOrigin(origin string) bool {
+	for _, allowed := range c.AllowOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// corsMethods are the methods allow_methods may list.
+var corsMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+func validateCORS(c CORSConfig) error {
+	var errs []error
+	for _, origin := range c.AllowOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+			errs = append(errs, fmt.Errorf("allow_origins entry '%s' must be \"*\" or a scheme and host such as https://admin.example.com", origin))
+		}
+	}
+	for _, method := range c.AllowMethods {
+		if !slices.Contains(corsMethods, method) {
+			errs = append(errs, fmt.Errorf("unknown method '%s' in allow_methods (want %s)", method, strings.Join(corsMethods, ", ")))
+		}
+	}
+	for _, header := range c.AllowHeaders {
+		if header == "" || strings.ContainsAny(header, " \t,:") {
+			errs = append(errs, fmt.Errorf("allow_headers entry '%s' is not a header name", header))
+		}
+	}
+	if c.MaxAge < 0 {
+		errs = append(errs, errors.New("max_age must not be negative"))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,42 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+// CostFromConfig derives a request's cost from a numeric metadata field in
+// place of the endpoint's static cost, e.g. rows with a multiplier of 0.01
+// charges one token per hundred rows exported. Costs round up and are then
+// clamped to Min and Max.
+type CostFromConfig struct {
+	Metadata   string  `yaml:"metadata" json:"metadata"`               // The metadata field, an integer
+	Multiplier float64 `yaml:"multiplier" json:"multiplier,omitempty"` // Defaults to 1
+	Min        int64   `yaml:"min" json:"min,omitempty"`               // Lower bound on the cost
+	Max        int64   `yaml:"max" json:"max,omitempty"`               // Upper bound on the cost; 0 is unbounded
+	Strict     bool    `yaml:"strict" json:"strict,omitempty"`         // Reject a request whose field is missing or not an integer, instead of charging the static cost
+}
+
+// Scale returns the multiplier, 1 when unset.
+func (c CostFromConfig) Scale() float64 {
+	if c.Multiplier == 0 {
+		return 1
+	}
+	return c.Multiplier
+}
+
+func validateCostFrom(c CostFromConfig) error {
+	var errs []error
+	if c.Metadata == "" {
+		errs = append(errs, errors.New("metadata must name a metadata field"))
+	}
+	if c.Multiplier < 0 {
+		errs = append(errs, errors.New("multiplier must not be negative"))
+	}
+	if c.Min < 0 || c.Max < 0 {
+		errs = append(errs, errors.New("min and max must not be negative"))
+	} else if c.Max > 0 && c.Min > c.Max {
+		errs = append(errs, fmt.Errorf("min %d exceeds max %d", c.Min, c.Max))
+	}
+	return errors.Join(errs...)
+}
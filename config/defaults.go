@@ -0,0 +1,160 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// resolveEndpointDefaults fills in the endpoints of a merged rules document
+// from endpoint_defaults and from the endpoints they extend, key by key as
+// includes merge, so an endpoint only needs the settings that differ and
+// the loaded rules hold each endpoint's complete settings. It reports
+// whether there was anything to fill in.
+//
+// An endpoint that extends another starts from that endpoint's resolved
+// settings, which already include the defaults.
+func resolveEndpointDefaults(doc map[string]any) (bool, error) {
+	var defaults map[string]any
+	if value, ok := doc["endpoint_defaults"]; ok && value != nil {
+		if defaults, ok = value.(map[string]any); !ok {
+			return false, errors.New("endpoint_defaults: must be a mapping of endpoint settings")
+		}
+		for _, key := range []string{"extends", "template"} {
+			if _, ok := defaults[key]; ok {
+				return false, fmt.Errorf("endpoint_defaults: can't set %s", key)
+			}
+		}
+	}
+	endpoints, _ := doc["endpoints"].(map[string]any)
+	extends := false
+	for _, value := range endpoints {
+		if endpoint, ok := value.(map[string]any); ok && endpoint["extends"] != nil {
+			extends = true
+		}
+	}
+	if defaults == nil && !extends {
+		return false, nil
+	}
+
+	if err := resolveExtends("endpoint", endpoints, defaults); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// resolveTierExtends fills in the tiers of a merged rules document from the
+// tiers they extend, key by key as for endpoints, so premium can extend
+// free and set only what differs. It reports whether any tier extends
+// another.
+func resolveTierExtends(doc map[string]any) (bool, error) {
+	tiers, _ := doc["tiers"].(map[string]any)
+	for _, value := range tiers {
+		if tier, ok := value.(map[string]any); ok && tier["extends"] != nil {
+			return true, resolveExtends("tier", tiers, nil)
+		}
+	}
+	return false, nil
+}
+
+// resolveInheritance resolves tier and endpoint inheritance, templates
+// included, in a merged rules document, reporting whether it changed
+// anything.
+func resolveInheritance(doc map[string]any) (bool, error) {
+	tiers, err := resolveTierExtends(doc)
+	if err != nil {
+		return false, err
+	}
+	templates, err := resolveTemplates(doc)
+	if err != nil {
+		return false, err
+	}
+	endpoints, err := resolveEndpointDefaults(doc)
+	if err != nil {
+		return false, err
+	}
+	return tiers || templates || endpoints, nil
+}
+
+// resolveExtends replaces each of entries, the kind's mapping such as the
+// endpoints, with base merged with the entry it extends and then its own
+// settings. Chains resolve parent first; a chain that comes back to where
+// it started is an error naming every entry in it.
+func resolveExtends(kind string, entries, base map[string]any) error {
+	resolved := make(map[string]map[string]any, len(entries))
+	var resolve func(name string, stack []string) (map[string]any, error)
+	resolve = func(name string, stack []string) (map[string]any, error) {
+		if entry, ok := resolved[name]; ok {
+			return entry, nil
+		}
+		for i, extending := range stack {
+			if extending == name {
+				return nil, fmt.Errorf("circular extends: %s", strings.Join(append(stack[i:], name), " -> "))
+			}
+		}
+		own, _ := entries[name].(map[string]any)
+		entry := copyYAML(base).(map[string]any)
+		if entry == nil {
+			entry = make(map[string]any)
+		}
+		if value, ok := own["extends"]; ok && value != nil {
+			parent, ok := value.(string)
+			if !ok || parent == "" {
+				article := "a"
+				if strings.ContainsRune("aeiou", rune(kind[0])) {
+					article = "an"
+				}
+				return nil, fmt.Errorf("%s '%s': extends must name %s %s", kind, name, article, kind)
+			}
+			if _, ok := entries[parent]; !ok {
+				return nil, fmt.Errorf("%s '%s': extends unknown %s '%s'", kind, name, kind, parent)
+			}
+			inherited, err := resolve(parent, append(stack[:len(stack):len(stack)], name))
+			if err != nil {
+				return nil, err
+			}
+			entry = copyYAML(inherited).(map[string]any)
+		}
+		mergeYAML(entry, copyYAML(own).(map[string]any))
+		resolved[name] = entry
+		return entry, nil
+	}
+	for _, name := range sortedKeys(entries) {
+		switch entries[name].(type) {
+		case map[string]any, nil:
+		default:
+			// Left for decoding to report
+			continue
+		}
+		if _, err := resolve(name, nil); err != nil {
+			return err
+		}
+	}
+	for name, entry := range resolved {
+		entries[name] = entry
+	}
+	return nil
+}
+
+// copyYAML deep-copies a decoded document value, so merging into the copy
+// leaves the original alone.
+func copyYAML(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		if v == nil {
+			return v
+		}
+		m := make(map[string]any, len(v))
+		for key, item := range v {
+			m[key] = copyYAML(item)
+		}
+		return m
+	case []any:
+		items := make([]any, len(v))
+		for i, item := range v {
+			items[i] = copyYAML(item)
+		}
+		return items
+	}
+	return value
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Environment variables that override the rules file, so a container can
+// tune limits without a new rules.yaml:
+//
+//	RATE_LIMITER_NAMESPACE                    namespace
+//	RATE_LIMITER_ENDPOINT_<ENDPOINT>_<FIELD>  COST, MAX_COST, GLOBAL_CAPACITY, GLOBAL_REFILL_RATE
+//	RATE_LIMITER_TIER_<TIER>_<FIELD>          CAPACITY, REFILL_RATE, MAX_DEBT
+//	RATE_LIMITER_IPS_<FIELD>                  CAPACITY, REFILL_RATE
+//
+// <ENDPOINT> and <TIER> are the configured names as EnvName spells them, e.g.
+// RATE_LIMITER_ENDPOINT_API_UPLOAD_GLOBAL_CAPACITY=20000 for /api/upload.
+const (
+	envNamespace      = "RATE_LIMITER_NAMESPACE"
+	envEndpointPrefix = "RATE_LIMITER_ENDPOINT_"
+	envTierPrefix     = "RATE_LIMITER_TIER_"
+	envIPsPrefix      = "RATE_LIMITER_IPS_"
+)
+
+var envNameSeparators = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// EnvName spells an endpoint path or tier name the way override variables
+// use it: upper case, with each run of other characters turned into one
+// underscore and none at the ends, so "/api/v1/upload" becomes "API_V1_UPLOAD".
+func EnvName(name string) string {
+	return strings.Trim(envNameSeparators.ReplaceAllString(strings.ToUpper(name), "_"), "_")
+}
+
+// ApplyEnvOverrides applies the override variables that are set to rs. It
+// reports every malformed value, and every variable that names no configured
+// endpoint, tier or field, so a typo can't silently leave a limit unchanged.
+func ApplyEnvOverrides(rs *RuleSet) error {
+	pending := make(map[string]string)
+	for _, entry := range os.Environ() {
+		name, value, _ := strings.Cut(entry, "=")
+		if strings.HasPrefix(name, envEndpointPrefix) || strings.HasPrefix(name, envTierPrefix) || strings.HasPrefix(name, envIPsPrefix) {
+			pending[name] = value
+		}
+	}
+	if ns := os.Getenv(envNamespace); ns != "" {
+		rs.Namespace = ns
+	}
+
+	var errs []error
+	// take removes and returns the override for name, if it is set
+	take := func(name string) (string, bool) {
+		value, ok := pending[name]
+		delete(pending, name)
+		return value, ok
+	}
+	overrideInt := func(name string, field *int64) {
+		if raw, ok := take(name); ok {
+			v, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not an integer", name, raw))
+				return
+			}
+			*field = v
+		}
+	}
+	overrideFloat := func(name string, field *float64) {
+		if raw, ok := take(name); ok {
+			v, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a number", name, raw))
+				return
+			}
+			*field = v
+		}
+	}
+
+	// usable reports whether prefix belongs to only one endpoint or tier;
+	// names that spell the same only matter once an override uses them
+	usable := func(prefix string, owners []string) bool {
+		if len(owners) == 1 {
+			return true
+		}
+		for name := range pending {
+			if strings.HasPrefix(name, prefix) {
+				errs = append(errs, fmt.Errorf("%s* is ambiguous: it names '%s'", prefix, strings.Join(owners, "', '")))
+				break
+			}
+		}
+		return false
+	}
+
+	endpoints := envOwners(envEndpointPrefix, sortedKeys(rs.Endpoints))
+	for _, prefix := range sortedKeys(endpoints) {
+		if !usable(prefix, endpoints[prefix]) {
+			continue
+		}
+		path := endpoints[prefix][0]
+		ep := rs.Endpoints[path]
+		overrideInt(prefix+"COST", &ep.Cost)
+		overrideInt(prefix+"MAX_COST", &ep.MaxCost)
+		overrideInt(prefix+"GLOBAL_CAPACITY", &ep.GlobalCapacity)
+		overrideFloat(prefix+"GLOBAL_REFILL_RATE", &ep.GlobalRefillRate)
+		rs.Endpoints[path] = ep
+	}
+	tiers := envOwners(envTierPrefix, sortedKeys(rs.Tiers))
+	for _, prefix := range sortedKeys(tiers) {
+		if !usable(prefix, tiers[prefix]) {
+			continue
+		}
+		name := tiers[prefix][0]
+		tier := rs.Tiers[name]
+		overrideInt(prefix+"CAPACITY", &tier.Capacity)
+		overrideFloat(prefix+"REFILL_RATE", &tier.RefillRate)
+		overrideInt(prefix+"MAX_DEBT", &tier.MaxDebt)
+		rs.Tiers[name] = tier
+	}
+	overrideInt(envIPsPrefix+"CAPACITY", &rs.IPs.Capacity)
+	overrideFloat(envIPsPrefix+"REFILL_RATE", &rs.IPs.RefillRate)
+
+	for _, name := range sortedKeys(pending) {
+		if ambiguous(name, endpoints, tiers) {
+			continue
+		}
+		errs = append(errs, fmt.Errorf("%s does not match any configured endpoint, tier or field", name))
+	}
+	return errors.Join(errs...)
+}
+
+// envOwners groups names by the variable prefix they map to under kind.
+func envOwners(kind string, names []string) map[string][]string {
+	owners := make(map[string][]string, len(names))
+	for _, name := range names {
+		prefix := kind + EnvName(name) + "_"
+		owners[prefix] = append(owners[prefix], name)
+	}
+	return owners
+}
+
+// ambiguous reports whether name was left unapplied because its prefix is
+// shared, which has already been reported.
+func ambiguous(name string, groups ...map[string][]string) bool {
+	for _, owners := range groups {
+		for prefix, names := range owners {
+			if len(names) > 1 && strings.HasPrefix(name, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
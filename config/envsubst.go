@@ -0,0 +1,183 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envRefPattern matches a ${VAR} or ${VAR:-default} reference at the start
+// of a string.
+var envRefPattern = regexp.MustCompile(`^\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// expandEnv replaces ${VAR} and ${VAR:-default} references in the values of
+// a rules file with environment variables before it is parsed, so one file
+// can serve every environment with only the numbers differing. The default
+// is used when VAR is unset or empty, and a reference to an unset variable
+// without one is an error. YAML values in single quotes are literal and
+// never expanded.
+//
+// An expanded YAML value that isn't quoted is typed by what it expands to,
+// as is a quoted YAML or JSON string that is nothing but one reference, so
+// both capacity: ${FREE_CAPACITY:-100} and "capacity": "${FREE_CAPACITY}"
+// set a number.
+func expandEnv(data []byte, format Format) ([]byte, error) {
+	if !bytes.Contains(data, []byte("${")) {
+		return data, nil
+	}
+	if format == FormatJSON {
+		return expandEnvJSON(data)
+	}
+	return expandEnvYAML(data)
+}
+
+func expandEnvYAML(data []byte) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		// Syntax errors are left for the parser to report
+		return data, nil
+	}
+	var errs []error
+	changed := false
+	var expandNode func(node *yaml.Node)
+	expandNode = func(node *yaml.Node) {
+		switch node.Kind {
+		case yaml.ScalarNode:
+			if node.Style&yaml.SingleQuotedStyle != 0 {
+				return
+			}
+			value, found, err := expandRefs(node.Value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("line %d: %w", node.Line, err))
+				return
+			}
+			if !found {
+				return
+			}
+			lone := envRefPattern.FindString(node.Value) == node.Value
+			node.Value = value
+			changed = true
+			// Let the expansion type an unquoted value or a lone reference
+			if node.Style&yaml.DoubleQuotedStyle != 0 && lone {
+				node.Style &^= yaml.DoubleQuotedStyle
+			}
+			if node.Style&(yaml.DoubleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+				node.Tag = ""
+			}
+		case yaml.MappingNode:
+			// Keys are names, not values
+			for i := 1; i < len(node.Content); i += 2 {
+				expandNode(node.Content[i])
+			}
+		default:
+			for _, child := range node.Content {
+				expandNode(child)
+			}
+		}
+	}
+	expandNode(&doc)
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	if !changed {
+		return data, nil
+	}
+	return yaml.Marshal(&doc)
+}
+
+func expandEnvJSON(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return data, nil
+	}
+	var errs []error
+	changed := false
+	var expandValue func(value any) any
+	expandValue = func(value any) any {
+		switch v := value.(type) {
+		case string:
+			expanded, found, err := expandRefs(v)
+			if err != nil {
+				errs = append(errs, err)
+				return v
+			}
+			if !found {
+				return v
+			}
+			changed = true
+			// A lone reference takes the type of a number or boolean value
+			if envRefPattern.FindString(v) == v {
+				var typed any
+				if json.Unmarshal([]byte(expanded), &typed) == nil {
+					switch typed.(type) {
+					case float64:
+						return json.Number(expanded)
+					case bool:
+						return typed
+					}
+				}
+			}
+			return expanded
+		case map[string]any:
+			for key, item := range v {
+				v[key] = expandValue(item)
+			}
+		case []any:
+			for i, item := range v {
+				v[i] = expandValue(item)
+			}
+		}
+		return value
+	}
+	doc = expandValue(doc)
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	if !changed {
+		return data, nil
+	}
+	return json.Marshal(doc)
+}
+
+// expandRefs expands the references in s, reporting whether it had any.
+func expandRefs(s string) (string, bool, error) {
+	var out strings.Builder
+	found := false
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			out.WriteString(s)
+			return out.String(), found, nil
+		}
+		out.WriteString(s[:i])
+		s = s[i:]
+		ref := envRefPattern.FindStringSubmatchIndex(s)
+		if ref == nil {
+			bad := s
+			if end := strings.IndexByte(s, '}'); end >= 0 {
+				bad = s[:end+1]
+			}
+			return "", false, fmt.Errorf("invalid reference %s (want ${VAR} or ${VAR:-default})", bad)
+		}
+		name := s[ref[2]:ref[3]]
+		value, ok := os.LookupEnv(name)
+		if value == "" {
+			if ref[4] >= 0 {
+				value = s[ref[4]:ref[5]]
+			} else if !ok {
+				return "", false, fmt.Errorf("${%s} is not set and has no default", name)
+			}
+		}
+		out.WriteString(value)
+		found = true
+		s = s[ref[1]:]
+	}
+}
@@ -0,0 +1,135 @@
+package config
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// Timeouts for talking to etcd. A watch retries after etcdRetryDelay when
+// its connection or watch fails.
+const (
+	etcdDialTimeout    = 5 * time.Second
+	etcdRequestTimeout = 5 * time.Second
+	etcdRetryDelay     = 2 * time.Second
+)
+
+// ErrEtcdKeyNotFound is returned when the etcd key holds no rules.
+var ErrEtcdKeyNotFound = errors.New("key not found")
+
+func newEtcdClient(endpoints []string, tlsConfig *tls.Config) (*clientv3.Client, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("etcd: no endpoints")
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: etcdDialTimeout,
+		TLS:         tlsConfig,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("etcd: %w", err)
+	}
+	return client, nil
+}
+
+// LoadRuleSetFromEtcd fetches the rules file stored at key, in YAML or JSON
+// like ParseRuleSet, and parses and validates it. tlsConfig may be nil for
+// plain connections.
+func LoadRuleSetFromEtcd(endpoints []string, key string, tlsConfig *tls.Config) (*RuleSet, error) {
+	client, err := newEtcdClient(endpoints, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	rules, _, err := getEtcdRuleSet(context.Background(), client, key)
+	return rules, err
+}
+
+// getEtcdRuleSet reads, parses and validates the rules at key, returning
+// the store revision they were read at.
+func getEtcdRuleSet(ctx context.Context, client *clientv3.Client, key string) (*RuleSet, int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, etcdRequestTimeout)
+	defer cancel()
+	resp, err := client.Get(ctx, key)
+	if err != nil {
+		return nil, 0, fmt.Errorf("etcd key %s: %w", key, err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, resp.Header.Revision, fmt.Errorf("etcd key %s: %w", key, ErrEtcdKeyNotFound)
+	}
+	rules, err := etcdRuleSet(key, resp.Kvs[0].Value)
+	return rules, resp.Header.Revision, err
+}
+
+// etcdRuleSet parses and validates the rules stored at key.
+func etcdRuleSet(key string, value []byte) (*RuleSet, error) {
+	rules, err := ParseRuleSet(value)
+	if err != nil {
+		return nil, fmt.Errorf("etcd key %s: %w", key, err)
+	}
+	if err := ValidateRuleSet(rules); err != nil {
+		return nil, fmt.Errorf("etcd key %s: %w", key, err)
+	}
+	return rules, nil
+}
+
+// WatchRuleSetEtcd calls onChange with the rules at key, then again each
+// time they change, until ctx is done. Rules that fail to parse or validate,
+// a deleted key and connection problems are passed as errors, and callers
+// should keep the rules they have. After a failed watch the key is read
+// again, so no change is missed. tlsConfig may be nil for plain connections.
+func WatchRuleSetEtcd(ctx context.Context, endpoints []string, key string, tlsConfig *tls.Config, onChange func(*RuleSet, error)) error {
+	client, err := newEtcdClient(endpoints, tlsConfig)
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer client.Close()
+		for ctx.Err() == nil {
+			rules, rev, err := getEtcdRuleSet(ctx, client, key)
+			if ctx.Err() != nil {
+				return
+			}
+			if rev == 0 {
+				onChange(nil, err)
+				sleepCtx(ctx, etcdRetryDelay)
+				continue
+			}
+			// A missing key is not worth reporting until it is deleted
+			if !errors.Is(err, ErrEtcdKeyNotFound) {
+				onChange(rules, err)
+			}
+			for resp := range client.Watch(clientv3.WithRequireLeader(ctx), key, clientv3.WithRev(rev+1)) {
+				if err := resp.Err(); err != nil {
+					onChange(nil, fmt.Errorf("etcd key %s: watch: %w", key, err))
+					break
+				}
+				// Only the latest version of the key matters
+				if n := len(resp.Events); n > 0 {
+					event := resp.Events[n-1]
+					if event.Type == clientv3.EventTypeDelete {
+						onChange(nil, fmt.Errorf("etcd key %s was deleted", key))
+					} else {
+						onChange(etcdRuleSet(key, event.Kv.Value))
+					}
+				}
+			}
+			sleepCtx(ctx, etcdRetryDelay)
+		}
+	}()
+	return nil
+}
+
+// sleepCtx waits for d or until ctx is done.
+func sleepCtx(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
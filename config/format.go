@@ -0,0 +1,284 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Format is the syntax a rules file is written in. JSON files use the same
+// field names as YAML ones. Durations are strings such as "5s" in both, and
+// JSON may also give them in nanoseconds, as encoding/json writes them.
+type Format string
+
+const (
+	FormatYAML Format = "YAML"
+	FormatJSON Format = "JSON"
+)
+
+// DetectFormat tells which syntax the rules file at path is written in:
+// JSON for a .json file, YAML for .yaml or .yml, and otherwise JSON when
+// the first non-blank character of data opens an object. path may be empty
+// to go by the content alone.
+func DetectFormat(path string, data []byte) Format {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return FormatJSON
+	case ".yaml", ".yml":
+		return FormatYAML
+	}
+	if trimmed := bytes.TrimLeft(data, " \t\r\n"); len(trimmed) > 0 && trimmed[0] == '{' {
+		return FormatJSON
+	}
+	return FormatYAML
+}
+
+// decodeDocument parses a rules file into its generic form, as used to
+// merge includes. An empty file is an empty document in either format.
+func decodeDocument(data []byte, format Format) (map[string]any, error) {
+	var doc map[string]any
+	if format == FormatYAML {
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		return doc, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var value any
+	if err := dec.Decode(&value); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return nil, jsonError(data, err)
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("line %d: unexpected data after the top-level object", lineAt(data, dec.InputOffset()))
+	}
+	if value == nil {
+		return nil, nil
+	}
+	doc, ok := value.(map[string]any)
+	if !ok {
+		return nil, errors.New("the top level must be an object")
+	}
+	return durationsFromJSON(fromJSON(doc), reflect.TypeOf(RuleSet{})).(map[string]any), nil
+}
+
+// fromJSON turns the numbers in a decoded JSON value into the int64 and
+// float64 values YAML decoding produces.
+func fromJSON(value any) any {
+	switch v := value.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		for key, item := range v {
+			v[key] = fromJSON(item)
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = fromJSON(item)
+		}
+	}
+	return value
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// durationsFromJSON rewrites the integers found at time.Duration fields of
+// typ, by their json names, into duration strings YAML decoding accepts.
+func durationsFromJSON(value any, typ reflect.Type) any {
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	switch {
+	case typ == durationType:
+		if n, ok := value.(int64); ok {
+			return time.Duration(n).String()
+		}
+	case typ.Kind() == reflect.Struct:
+		if m, ok := value.(map[string]any); ok {
+			for i := 0; i < typ.NumField(); i++ {
+				field := typ.Field(i)
+				name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+				if item, ok := m[name]; ok {
+					m[name] = durationsFromJSON(item, field.Type)
+				}
+			}
+		}
+	case typ.Kind() == reflect.Map:
+		if m, ok := value.(map[string]any); ok {
+			for key, item := range m {
+				m[key] = durationsFromJSON(item, typ.Elem())
+			}
+		}
+	case typ.Kind() == reflect.Slice:
+		if items, ok := value.([]any); ok {
+			for i, item := range items {
+				items[i] = durationsFromJSON(item, typ.Elem())
+			}
+		}
+	}
+	return value
+}
+
+// jsonError adds the line and column to a JSON syntax error, which only
+// carries a byte offset.
+func jsonError(data []byte, err error) error {
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		// The offset is just past the offending character
+		line, column := position(data, syntaxErr.Offset-1)
+		return fmt.Errorf("line %d, column %d: %w", line, column, err)
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("line %d: unexpected end of input", lineAt(data, int64(len(data))))
+	}
+	return err
+}
+
+func position(data []byte, offset int64) (line, column int) {
+	offset = min(offset, int64(len(data)))
+	before := data[:offset]
+	line = bytes.Count(before, []byte("\n")) + 1
+	column = int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+func lineAt(data []byte, offset int64) int {
+	line, _ := position(data, offset)
+	return line
+}
+
+// yamlLinePattern matches the line numbers in YAML decoding errors.
+var yamlLinePattern = regexp.MustCompile(`line \d+: `)
+
+// decodeRuleSet decodes a rule set from YAML. Documents converted from JSON
+// pass the JSON format so errors don't cite the converted document's lines,
+// which match nothing the user wrote.
+func decodeRuleSet(data []byte, format Format) (*RuleSet, error) {
+	var ruleSet RuleSet
+	if err := yaml.Unmarshal(data, &ruleSet); err != nil {
+		if format == FormatJSON {
+			return nil, errors.New(yamlLinePattern.ReplaceAllString(err.Error(), ""))
+		}
+		return nil, err
+	}
+	return &ruleSet, nil
+}
+
+// EncodeYAML writes rules back out as a YAML rules file, leaving out the
+// settings that are unset as GET /rules does and giving durations as
+// strings. Shorthands such as limit are kept as written, in place of the
+// capacities and rates loading derived from them. Endpoints are written
+// with their inherited settings, with the template or endpoint they came
+// from in a comment. Loading the result gives the same rules.
+func EncodeYAML(rules *RuleSet) ([]byte, error) {
+	data, err := json.Marshal(rules)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := decodeDocument(data, FormatJSON)
+	if err != nil {
+		return nil, err
+	}
+	dropResolved(doc)
+	origins := dropInheritance(doc)
+	var node yaml.Node
+	if err := node.Encode(doc); err != nil {
+		return nil, err
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value != "endpoints" {
+			continue
+		}
+		endpoints := node.Content[i+1].Content
+		for j := 0; j+1 < len(endpoints); j += 2 {
+			endpoints[j].LineComment = origins[endpoints[j].Value]
+		}
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&node); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), enc.Close()
+}
+
+// dropInheritance removes endpoint_defaults, templates and what each
+// endpoint extends or takes a template from, since the endpoints hold their
+// resolved settings and unset ones would be inherited again on loading. It
+// returns a comment per endpoint naming where its settings came from.
+func dropInheritance(doc map[string]any) map[string]string {
+	delete(doc, "endpoint_defaults")
+	delete(doc, "templates")
+	origins := make(map[string]string)
+	endpoints, _ := doc["endpoints"].(map[string]any)
+	for path, value := range endpoints {
+		endpoint, _ := value.(map[string]any)
+		var from []string
+		for _, key := range []string{"template", "extends"} {
+			if name, ok := endpoint[key].(string); ok {
+				from = append(from, key+": "+name)
+				delete(endpoint, key)
+			}
+		}
+		if from != nil {
+			origins[path] = strings.Join(from, ", ")
+		}
+	}
+	return origins
+}
+
+// dropResolved removes from a rules document the capacities and refill
+// rates that loading derived from a limit, burst or refill interval, which
+// would conflict with them if the document were loaded again.
+func dropResolved(doc map[string]any) {
+	bucket := func(value any, prefix string) {
+		entry, _ := value.(map[string]any)
+		if entry == nil {
+			return
+		}
+		switch {
+		case entry["limit"] != nil:
+			delete(entry, prefix+"capacity")
+			delete(entry, prefix+"refill_rate")
+		case entry["burst"] != nil:
+			delete(entry, prefix+"capacity")
+		}
+		if entry[prefix+"refill_every"] != nil {
+			delete(entry, prefix+"refill_rate")
+		}
+	}
+	entries := func(value any) map[string]any {
+		m, _ := value.(map[string]any)
+		return m
+	}
+	for _, tier := range entries(doc["tiers"]) {
+		bucket(tier, "")
+	}
+	for _, endpoint := range entries(doc["endpoints"]) {
+		bucket(endpoint, "global_")
+		for _, resource := range entries(entries(endpoint)["resources"]) {
+			for _, limit := range entries(entries(resource)["tiers"]) {
+				bucket(limit, "")
+			}
+		}
+	}
+	bucket(doc["ips"], "")
+}
@@ -0,0 +1,230 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RuleFile is one file read while loading a rule set.
+type RuleFile struct {
+	Path   string
+	Data   []byte
+	Format Format
+}
+
+// LoadRuleFiles loads a rules file and every file it includes, returning the
+// merged rule set and the files in the order they were merged.
+//
+// Each file is YAML or JSON, as DetectFormat tells. A file may list other
+// files under include:, as one path or a list, relative
+// to its own directory. Each included file is merged over the including one
+// in order, so later files override earlier ones: mappings such as tiers,
+// endpoints and individual endpoint settings merge key by key, and any other
+// value is replaced. Anchors and aliases work within each file. Including a
+// file that is already being loaded is an error. Environment variable
+// references in each file are expanded as it is read; see expandEnv. Once
+// every file is merged, tiers inherit the tier they extend and endpoints
+// endpoint_defaults and the endpoint they extend; see resolveInheritance.
+// Unknown fields and repeated keys fail the load unless SetLenient says otherwise.
+//
+// path may also be a directory, such as a conf.d that each team adds its own
+// file to. Every rules file in it is loaded in lexical order, with its
+// includes, and merged as includes are, except that a tier or endpoint
+// defined in two of the files fails the load unless SetDirLastWins says
+// otherwise, and ip_overrides lists are joined. Validation then sees the
+// merged rules, so problems across files are caught too.
+func LoadRuleFiles(path string) (*RuleSet, []RuleFile, error) {
+	loader := &includeLoader{}
+	var merged map[string]any
+	var err error
+	if info, statErr := os.Stat(path); statErr == nil && info.IsDir() {
+		merged, err = loader.loadDir(path)
+	} else {
+		merged, err = loader.load(path, nil)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	resolved, err := resolveInheritance(merged)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	// A single YAML file is parsed as written so errors keep its line numbers
+	data, format := loader.expanded, loader.files[0].Format
+	if len(loader.files) > 1 || format != FormatYAML || resolved {
+		if data, err = yaml.Marshal(merged); err != nil {
+			return nil, nil, err
+		}
+	}
+	ruleSet, err := parseRuleSet(data, format, loader.order)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return ruleSet, loader.files, nil
+}
+
+type includeLoader struct {
+	files    []RuleFile
+	expanded []byte   // The first file's data after expandEnv
+	order    []string // Endpoint keys in the order the files declare them
+}
+
+// load reads path and its includes and returns them merged. stack holds the
+// absolute paths of the files including this one, to catch cycles.
+func (l *includeLoader) load(path string, stack []string) (map[string]any, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, including := range stack {
+		if including == abs {
+			return nil, fmt.Errorf("circular include: %s", strings.Join(append(stack, abs), " -> "))
+		}
+	}
+	stack = append(stack[:len(stack):len(stack)], abs)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	format := DetectFormat(path, data)
+	l.files = append(l.files, RuleFile{Path: path, Data: data, Format: format})
+	if data, err = expandEnv(data, format); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(stack) == 1 {
+		l.expanded = data
+	}
+	if err := checkStrict(data); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	l.order = append(l.order, endpointOrder(data)...)
+	doc, err := decodeDocument(data, format)
+	if err != nil {
+		return nil, fmt.Errorf("%s: parsing as %s: %w", path, format, err)
+	}
+	if doc == nil {
+		doc = make(map[string]any)
+	}
+	includes, err := includePaths(doc["include"])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	delete(doc, "include")
+
+	for _, include := range includes {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(path), include)
+		}
+		included, err := l.load(include, stack)
+		if err != nil {
+			return nil, err
+		}
+		mergeYAML(doc, included)
+	}
+	return doc, nil
+}
+
+var dirLastWins atomic.Bool
+
+// SetDirLastWins lets a tier or endpoint be defined in more than one file of
+// a rules directory, the later file's settings merging over the earlier's
+// as an include's would, instead of failing the load.
+func SetDirLastWins(on bool) {
+	dirLastWins.Store(on)
+}
+
+// IsRulesFile reports whether a file in a rules directory is loaded: YAML
+// or JSON by its extension, and not hidden, which skips editor swap files
+// and the ..data links of a Kubernetes ConfigMap.
+func IsRulesFile(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+// loadDir loads the rules files in dir in lexical order and returns them
+// merged.
+func (l *includeLoader) loadDir(dir string) (map[string]any, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	merged := make(map[string]any)
+	defined := make(map[string]string) // "tier 'free'" -> the file defining it
+	for _, entry := range entries {
+		if entry.IsDir() || !IsRulesFile(entry.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		doc, err := l.load(path, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, section := range []struct{ key, kind string }{{"tiers", "tier"}, {"endpoints", "endpoint"}} {
+			names, _ := doc[section.key].(map[string]any)
+			for _, name := range sortedKeys(names) {
+				what := fmt.Sprintf("%s '%s'", section.kind, name)
+				if first, ok := defined[what]; ok && !dirLastWins.Load() {
+					return nil, fmt.Errorf("%s is defined in both %s and %s", what, first, path)
+				}
+				defined[what] = path
+			}
+		}
+		if overrides, ok := doc["ip_overrides"].([]any); ok {
+			if earlier, ok := merged["ip_overrides"].([]any); ok {
+				doc["ip_overrides"] = append(earlier, overrides...)
+			}
+		}
+		mergeYAML(merged, doc)
+	}
+	if len(l.files) == 0 {
+		return nil, fmt.Errorf("%s: no rules files (*.yaml, *.yml or *.json) in the directory", dir)
+	}
+	return merged, nil
+}
+
+// includePaths reads an include: value, which is a path or a list of them.
+func includePaths(value any) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []any:
+		paths := make([]string, 0, len(v))
+		for _, item := range v {
+			path, ok := item.(string)
+			if !ok || path == "" {
+				return nil, fmt.Errorf("include: entries must be file paths, got %v", item)
+			}
+			paths = append(paths, path)
+		}
+		return paths, nil
+	}
+	return nil, fmt.Errorf("include: must be a file path or a list of them")
+}
+
+// mergeYAML merges over into base: mappings merge key by key and anything
+// else in over replaces what base had.
+func mergeYAML(base, over map[string]any) {
+	for key, value := range over {
+		baseMap, baseOK := base[key].(map[string]any)
+		overMap, overOK := value.(map[string]any)
+		if baseOK && overOK {
+			mergeYAML(baseMap, overMap)
+			continue
+		}
+		base[key] = value
+	}
+}
@@ -0,0 +1,23 @@
+// Command schemagen writes the rules file JSON Schema to the path it is
+// given; see config.GenerateJSONSchema. It is run by go generate.
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/AndySung320/rate-limiter/config"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		log.Fatal("usage: schemagen <output file>")
+	}
+	schema, err := config.GenerateJSONSchema()
+	if err != nil {
+		log.Fatalf("generating schema: %v", err)
+	}
+	if err := os.WriteFile(os.Args[1], schema, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+)
+
+// IPOverrideConfig gives an address or range its own IP bucket limits in
+// place of the ips section, e.g. for an office NAT that many users share.
+// Unlimited lets it through the IP+endpoints rule without charging any
+// bucket.
+type IPOverrideConfig struct {
+	Address    string  `yaml:"address" json:"address"` // An IP such as "203.0.113.7" or a CIDR range such as "10.0.0.0/8"
+	Capacity   int64   `yaml:"capacity" json:"capacity,omitempty"`
+	RefillRate float64 `yaml:"refill_rate" json:"refill_rate,omitempty"`
+	Unlimited  bool    `yaml:"unlimited" json:"unlimited,omitempty"`
+}
+
+// ipOverride is an IPOverrideConfig with its address parsed.
+type ipOverride struct {
+	prefix netip.Prefix
+	config IPOverrideConfig
+}
+
+// FindIPOverride returns the override covering ip, the most specific one
+// when ranges overlap, and false when none does or ip doesn't parse.
+func (rs *RuleSet) FindIPOverride(ip string) (IPOverrideConfig, bool) {
+	if len(rs.IPOverrides) == 0 {
+		return IPOverrideConfig{}, false
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return IPOverrideConfig{}, false
+	}
+	addr = addr.Unmap()
+	overrides := rs.ipOverrideList()
+	for _, o := range overrides {
+		if o.prefix.Contains(addr) {
+			return o.config, true
+		}
+	}
+	return IPOverrideConfig{}, false
+}
+
+// ipOverrideList returns the parsed overrides, longest prefix first, as
+// parsed at load time, or parses them now for rule sets built in code.
+func (rs *RuleSet) ipOverrideList() []ipOverride {
+	if rs.ipOverrides != nil {
+		return *rs.ipOverrides
+	}
+	return parseIPOverrides(rs.IPOverrides)
+}
+
+// compileIPOverrides parses the overrides once for every later lookup.
+// Invalid addresses are left out for ValidateRuleSet to report.
+func (rs *RuleSet) compileIPOverrides() {
+	overrides := parseIPOverrides(rs.IPOverrides)
+	rs.ipOverrides = &overrides
+}
+
+func parseIPOverrides(configs []IPOverrideConfig) []ipOverride {
+	overrides := []ipOverride{}
+	for _, c := range configs {
+		if prefix, err := parseIPOverrideAddress(c.Address); err == nil {
+			overrides = append(overrides, ipOverride{prefix, c})
+		}
+	}
+	sort.SliceStable(overrides, func(i, j int) bool {
+		return overrides[i].prefix.Bits() > overrides[j].prefix.Bits()
+	})
+	return overrides
+}
+
+// parseIPOverrideAddress parses an IP as a single-address prefix, or a
+// CIDR range, which may not have bits set past its prefix length.
+func parseIPOverrideAddress(address string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(address); err == nil {
+		if addr.Zone() != "" {
+			return netip.Prefix{}, errors.New("zones are not allowed")
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(address)
+	if err != nil {
+		return netip.Prefix{}, errors.New("want an IP or CIDR range")
+	}
+	if prefix.Addr().Is4In6() {
+		return netip.Prefix{}, errors.New("write IPv4-mapped ranges as IPv4")
+	}
+	if masked := prefix.Masked(); masked != prefix {
+		return netip.Prefix{}, fmt.Errorf("has bits set past the prefix length; did you mean %s?", masked)
+	}
+	return prefix, nil
+}
+
+// validateIPOverrides checks the ip_overrides section against the costs of
+// the IP+endpoints endpoints, whose IP buckets an override replaces.
+func validateIPOverrides(rs *RuleSet, fail func(format string, args ...any)) {
+	var maxCost int64
+	for _, path := range sortedKeys(rs.Endpoints) {
+		if ep := rs.Endpoints[path]; ep.Rule == "IP+endpoints" {
+			maxCost = max(maxCost, ep.Cost)
+		}
+	}
+	seen := make(map[netip.Prefix]string)
+	for i, o := range rs.IPOverrides {
+		prefix, err := parseIPOverrideAddress(o.Address)
+		if err != nil {
+			fail("ip_overrides[%d]: invalid address '%s': %v", i, o.Address, err)
+			continue
+		}
+		if first, ok := seen[prefix]; ok {
+			fail("ip_overrides[%d]: '%s' is already covered by '%s'", i, o.Address, first)
+		}
+		seen[prefix] = o.Address
+		if o.Unlimited {
+			if o.Capacity != 0 || o.RefillRate != 0 {
+				fail("ip_overrides[%d] '%s': unlimited can't be combined with capacity or refill_rate", i, o.Address)
+			}
+			continue
+		}
+		if o.Capacity <= 0 || o.RefillRate <= 0 {
+			fail("ip_overrides[%d] '%s': capacity and refill_rate must be positive", i, o.Address)
+		} else if maxCost > o.Capacity {
+			fail("ip_overrides[%d] '%s': capacity %d is below the cost %d of an IP+endpoints endpoint", i, o.Address, o.Capacity, maxCost)
+		}
+	}
+}
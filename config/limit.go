@@ -0,0 +1,96 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// limitWindows are the units a limit string may be written per.
+var limitWindows = map[string]time.Duration{
+	"s": time.Second, "sec": time.Second, "second": time.Second,
+	"m": time.Minute, "min": time.Minute, "minute": time.Minute,
+	"h": time.Hour, "hour": time.Hour,
+	"d": 24 * time.Hour, "day": 24 * time.Hour,
+}
+
+// parseLimit parses a limit string such as "100/minute" into the amount
+// allowed per window.
+func parseLimit(limit string) (int64, time.Duration, error) {
+	amount, unit, ok := strings.Cut(limit, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("limit %q: expected <count>/<second|minute|hour|day>", limit)
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(amount), 10, 64)
+	if err != nil || n <= 0 {
+		return 0, 0, fmt.Errorf("limit %q: count must be a positive integer", limit)
+	}
+	window, ok := limitWindows[strings.ToLower(strings.TrimSpace(unit))]
+	if !ok {
+		return 0, 0, fmt.Errorf("limit %q: unknown unit %q, use second, minute, hour or day", limit, strings.TrimSpace(unit))
+	}
+	return n, window, nil
+}
+
+// limitBucket resolves an entry's bucket from its limit string and burst.
+// Burst is the capacity, so the refill rate alone sets the sustained rate;
+// without a limit it replaces capacity, which must then be unset. A limit's
+// amount refills evenly over its window, so "30/hour" refills one token
+// every two minutes, and the capacity is burst when given, otherwise the
+// whole window's amount. capacity, rate and every are the entry's other
+// fields, which must be unset when a limit is.
+func limitBucket(limit string, burst, capacity int64, rate float64, every time.Duration, prefix string) (int64, float64, error) {
+	if burst < 0 {
+		return 0, 0, errors.New("burst must be positive")
+	}
+	if limit == "" {
+		if burst == 0 {
+			return capacity, rate, nil
+		}
+		if capacity != 0 {
+			return 0, 0, fmt.Errorf("set either burst or %scapacity, not both", prefix)
+		}
+		return burst, rate, nil
+	}
+	if capacity != 0 || rate != 0 || every != 0 {
+		return 0, 0, fmt.Errorf("set either limit or %scapacity and %srefill_rate, not both", prefix, prefix)
+	}
+	amount, window, err := parseLimit(limit)
+	if err != nil {
+		return 0, 0, err
+	}
+	if burst == 0 {
+		burst = amount
+	}
+	return burst, float64(amount) / window.Seconds(), nil
+}
+
+// resolveLimits converts any limit string and burst into capacity and
+// refill rate. Burst is kept, so the configured burst can still be told
+// apart from a capacity.
+func (rs *RuleSet) resolveLimits() error {
+	for name, tier := range rs.Tiers {
+		capacity, rate, err := limitBucket(tier.Limit, tier.Burst, tier.Capacity, tier.RefillRate, tier.RefillEvery, "")
+		if err != nil {
+			return fmt.Errorf("tier '%s': %w", name, err)
+		}
+		tier.Capacity, tier.RefillRate = capacity, rate
+		rs.Tiers[name] = tier
+	}
+	for path, endpoint := range rs.Endpoints {
+		capacity, rate, err := limitBucket(endpoint.Limit, endpoint.Burst, endpoint.GlobalCapacity, endpoint.GlobalRefillRate, endpoint.GlobalRefillEvery, "global_")
+		if err != nil {
+			return fmt.Errorf("endpoint '%s': %w", path, err)
+		}
+		endpoint.GlobalCapacity, endpoint.GlobalRefillRate = capacity, rate
+		rs.Endpoints[path] = endpoint
+	}
+	capacity, rate, err := limitBucket(rs.IPs.Limit, rs.IPs.Burst, rs.IPs.Capacity, rs.IPs.RefillRate, rs.IPs.RefillEvery, "")
+	if err != nil {
+		return fmt.Errorf("ip config: %w", err)
+	}
+	rs.IPs.Capacity, rs.IPs.RefillRate = capacity, rate
+	return nil
+}
@@ -0,0 +1,190 @@
+package config
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Endpoint match modes. An exact endpoint only matches its own path; a
+// prefix endpoint also matches every path below it, segment by segment, so
+// "/api/users" matches "/api/users/123/comments" but not "/api/usersearch".
+const (
+	MatchExact  = "exact"
+	MatchPrefix = "prefix"
+)
+
+// RegexPrefix marks an endpoint key as a regular expression over the whole
+// request path, e.g. "~/api/v\d+/orgs/(?P<org>[^/]+)/items".
+const RegexPrefix = "~"
+
+// IsRegexEndpoint reports whether an endpoint key is a regular expression.
+func IsRegexEndpoint(path string) bool {
+	return strings.HasPrefix(path, RegexPrefix)
+}
+
+// EndpointMatch is the endpoint a request path matched.
+type EndpointMatch struct {
+	Path     string // The configured endpoint key, which per-key buckets are keyed by
+	Config   EndpointConfig
+	Captures map[string]string // Named groups of a regex endpoint
+}
+
+// placeholderPattern finds the {name} placeholders in a global_key.
+var placeholderPattern = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// BucketPath is what the endpoint's global bucket is keyed by: its
+// global_key with the captures filled in, or else the configured path.
+func (m EndpointMatch) BucketPath() string {
+	if m.Config.GlobalKey == "" {
+		return m.Path
+	}
+	return placeholderPattern.ReplaceAllStringFunc(m.Config.GlobalKey, func(placeholder string) string {
+		return m.Captures[placeholder[1:len(placeholder)-1]]
+	})
+}
+
+// MatchEndpoint finds the endpoint config for a request path; see
+// FindEndpoint. It returns the configured endpoint path that matched, which
+// is what buckets are keyed by.
+func (rs *RuleSet) MatchEndpoint(path string) (string, EndpointConfig, bool) {
+	m, ok := rs.FindEndpoint(path)
+	return m.Path, m.Config, ok
+}
+
+// FindEndpoint finds the endpoint config for a request path. An exact match
+// wins, then the regex endpoints in the order the rules file declares them,
+// and otherwise path segments are stripped from the right until a prefix
+// endpoint matches, so the longest prefix wins.
+func (rs *RuleSet) FindEndpoint(path string) (EndpointMatch, bool) {
+	if ep, ok := rs.Endpoints[path]; ok && !IsRegexEndpoint(path) {
+		return EndpointMatch{Path: path, Config: ep}, true
+	}
+	for _, pattern := range rs.endpointPatterns() {
+		groups := pattern.re.FindStringSubmatch(path)
+		if groups == nil {
+			continue
+		}
+		var captures map[string]string
+		for i, name := range pattern.re.SubexpNames() {
+			if name != "" {
+				if captures == nil {
+					captures = make(map[string]string)
+				}
+				captures[name] = groups[i]
+			}
+		}
+		return EndpointMatch{Path: pattern.key, Config: rs.Endpoints[pattern.key], Captures: captures}, true
+	}
+	prefix := path
+	for {
+		i := strings.LastIndexByte(prefix, '/')
+		if i < 0 {
+			return EndpointMatch{}, false
+		}
+		prefix = prefix[:i]
+		// A prefix endpoint may be written with or without a trailing slash
+		for _, key := range []string{prefix, prefix + "/"} {
+			if ep, ok := rs.Endpoints[key]; ok && ep.MatchMode == MatchPrefix {
+				return EndpointMatch{Path: key, Config: ep}, true
+			}
+		}
+		if prefix == "" {
+			return EndpointMatch{}, false
+		}
+	}
+}
+
+type endpointPattern struct {
+	key string
+	re  *regexp.Regexp
+}
+
+// endpointPatterns returns the rule set's regex endpoints in matching
+// order. Loaded rule sets compile them once, in declaration order; one
+// built in code has no declaration order, so its keys are sorted and the
+// compiled patterns cached.
+func (rs *RuleSet) endpointPatterns() []endpointPattern {
+	if rs.patterns != nil {
+		return *rs.patterns
+	}
+	var patterns []endpointPattern
+	for _, key := range sortedKeys(rs.Endpoints) {
+		if !IsRegexEndpoint(key) {
+			continue
+		}
+		if cached, ok := patternCache.Load(key); ok {
+			patterns = append(patterns, endpointPattern{key, cached.(*regexp.Regexp)})
+		} else if re, err := compileEndpointPattern(key); err == nil {
+			patternCache.Store(key, re)
+			patterns = append(patterns, endpointPattern{key, re})
+		}
+	}
+	return patterns
+}
+
+var patternCache sync.Map // Endpoint key to *regexp.Regexp
+
+// compilePatterns compiles the regex endpoints in order, the endpoint keys
+// as the rules files declare them; any order leaves out go last, sorted.
+// Invalid patterns are left for ValidateRuleSet to report.
+func (rs *RuleSet) compilePatterns(order []string) {
+	patterns := []endpointPattern{}
+	seen := make(map[string]bool)
+	for _, key := range append(append([]string{}, order...), sortedKeys(rs.Endpoints)...) {
+		if _, ok := rs.Endpoints[key]; !ok || !IsRegexEndpoint(key) || seen[key] {
+			continue
+		}
+		seen[key] = true
+		if re, err := compileEndpointPattern(key); err == nil {
+			patterns = append(patterns, endpointPattern{key, re})
+		}
+	}
+	rs.patterns = &patterns
+}
+
+// compileEndpointPattern compiles a regex endpoint key, anchored so it
+// matches the whole path. Errors quote the pattern as written.
+func compileEndpointPattern(key string) (*regexp.Regexp, error) {
+	pattern := strings.TrimPrefix(key, RegexPrefix)
+	if _, err := regexp.Compile(pattern); err != nil {
+		return nil, err
+	}
+	if pattern == "" {
+		return nil, errors.New("empty pattern")
+	}
+	return regexp.Compile(`^(?:` + pattern + `)$`)
+}
+
+// endpointOrder returns the endpoint keys of a rules file in the order it
+// declares them, or nil if it doesn't parse.
+func endpointOrder(data []byte) []string {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil || len(doc.Content) == 0 {
+		return nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil
+	}
+	var order []string
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != "endpoints" {
+			continue
+		}
+		endpoints := root.Content[i+1]
+		for endpoints.Kind == yaml.AliasNode && endpoints.Alias != nil {
+			endpoints = endpoints.Alias
+		}
+		if endpoints.Kind != yaml.MappingNode {
+			return nil
+		}
+		for j := 0; j+1 < len(endpoints.Content); j += 2 {
+			order = append(order, endpoints.Content[j].Value)
+		}
+	}
+	return order
+}
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// peakLayout is the 24-hour HH:MM format of PeakConfig.Start and End.
+const peakLayout = "15:04"
+
+// PeakConfig swaps an endpoint's global bucket for tighter (or looser)
+// limits during a daily window, e.g. 09:00 to 17:00 UTC. The window
+// includes Start and excludes End, and may not wrap past midnight.
+type PeakConfig struct {
+	Start      string  `yaml:"start" json:"start"` // HH:MM, UTC
+	End        string  `yaml:"end" json:"end"`     // HH:MM, UTC; after Start
+	Capacity   int64   `yaml:"capacity" json:"capacity"`
+	RefillRate float64 `yaml:"refill_rate" json:"refill_rate"`
+}
+
+// IsInPeakHours reports whether now falls in the daily window [start, end),
+// both HH:MM times in UTC.
+func IsInPeakHours(now time.Time, start, end string) (bool, error) {
+	from, err := parsePeakTime(start)
+	if err != nil {
+		return false, err
+	}
+	to, err := parsePeakTime(end)
+	if err != nil {
+		return false, err
+	}
+	now = now.UTC()
+	minute := now.Hour()*60 + now.Minute()
+	return from <= minute && minute < to, nil
+}
+
+// parsePeakTime returns the minute of the day an HH:MM time names.
+func parsePeakTime(s string) (int, error) {
+	t, err := time.Parse(peakLayout, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time '%s' (want HH:MM, 24-hour)", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func validatePeak(p PeakConfig, cost int64) error {
+	var errs []error
+	from, startErr := parsePeakTime(p.Start)
+	if startErr != nil {
+		errs = append(errs, fmt.Errorf("start: %w", startErr))
+	}
+	to, endErr := parsePeakTime(p.End)
+	if endErr != nil {
+		errs = append(errs, fmt.Errorf("end: %w", endErr))
+	}
+	if startErr == nil && endErr == nil && from >= to {
+		errs = append(errs, fmt.Errorf("start %s must be before end %s", p.Start, p.End))
+	}
+	if p.Capacity <= 0 {
+		errs = append(errs, errors.New("capacity must be positive"))
+	} else if cost > p.Capacity {
+		errs = append(errs, fmt.Errorf("cost %d exceeds capacity %d, so no request can pass", cost, p.Capacity))
+	}
+	if p.RefillRate <= 0 {
+		errs = append(errs, errors.New("refill_rate must be positive"))
+	}
+	return errors.Join(errs...)
+}
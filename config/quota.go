@@ -0,0 +1,70 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Quota windows.
+const (
+	QuotaDay   = "day"
+	QuotaMonth = "month"
+)
+
+// QuotaConfig caps what a bucket may spend in a calendar day or month, such
+// as "10,000 requests per day". A token bucket smooths bursts but lets a
+// steady client exceed any daily figure; a quota is a hard total that resets
+// at midnight (on the 1st for months) in Timezone.
+type QuotaConfig struct {
+	Amount   int64  `yaml:"amount" json:"amount"`
+	Window   string `yaml:"window" json:"window"`               // "day" or "month"
+	Timezone string `yaml:"timezone" json:"timezone,omitempty"` // IANA name, e.g. "America/New_York"; defaults to UTC
+}
+
+// Location returns the time zone the quota's windows reset in.
+func (q QuotaConfig) Location() (*time.Location, error) {
+	if q.Timezone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(q.Timezone)
+}
+
+func validateQuota(q QuotaConfig, cost int64) error {
+	var errs []error
+	if q.Amount <= 0 {
+		errs = append(errs, errors.New("amount must be positive"))
+	} else if cost > q.Amount {
+		errs = append(errs, fmt.Errorf("cost %d exceeds amount %d, so no request can pass", cost, q.Amount))
+	}
+	if q.Window != QuotaDay && q.Window != QuotaMonth {
+		errs = append(errs, fmt.Errorf("unknown window '%s' (want day or month)", q.Window))
+	}
+	if _, err := q.Location(); err != nil {
+		errs = append(errs, fmt.Errorf("unknown timezone '%s'", q.Timezone))
+	}
+	return errors.Join(errs...)
+}
+
+// WindowCapConfig is a hard ceiling on an endpoint's global bucket over a
+// fixed window, such as 1,000 requests an hour, checked alongside the token
+// bucket. The bucket's capacity sets the burst; the cap keeps a client that
+// stays inside the refill rate under a longer-term total. Windows start
+// every Window since the Unix epoch, so hourly windows start on the hour.
+type WindowCapConfig struct {
+	Amount int64         `yaml:"amount" json:"amount"`
+	Window time.Duration `yaml:"window" json:"window"` // e.g. 1h
+}
+
+func validateWindowCap(c WindowCapConfig, cost int64) error {
+	var errs []error
+	if c.Amount <= 0 {
+		errs = append(errs, errors.New("amount must be positive"))
+	} else if cost > c.Amount {
+		errs = append(errs, fmt.Errorf("cost %d exceeds amount %d, so no request can pass", cost, c.Amount))
+	}
+	if c.Window < time.Second || c.Window%time.Millisecond != 0 {
+		errs = append(errs, fmt.Errorf("window %v must be at least 1s, in whole milliseconds", c.Window))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,30 @@
+package config
+
+import "net/url"
+
+// Redacted returns a copy of rules that is safe to show operators, with any
+// credentials replaced: passwords embedded in jwks_url and the webhook url,
+// and the webhook secret. Fields added later that hold credentials, such as
+// a Redis password, must be cleared here too.
+func (rs *RuleSet) Redacted() *RuleSet {
+	redacted := *rs
+	redacted.JWT.JWKSURL = redactURL(rs.JWT.JWKSURL)
+	redacted.Webhook.URL = redactURL(rs.Webhook.URL)
+	if rs.Webhook.Secret != "" {
+		redacted.Webhook.Secret = "xxxxx"
+	}
+	return &redacted
+}
+
+// redactURL hides the password in raw, and the user too when there is no
+// password, since a lone user is often a token.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	if _, ok := u.User.Password(); !ok {
+		u.User = url.User("xxxxx")
+	}
+	return u.Redacted()
+}
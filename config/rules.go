@@ -1,57 +1,430 @@
 package config
 
 import (
+	"errors"
 	"fmt"
-	"os"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
+// Refill rates are tokens per second and may be fractional (0.5 is one token
+// every two seconds). The *_every fields are an alternative way to write the
+// same thing as one token per interval, e.g. "5s". A limit such as
+// "100/minute" replaces capacity and refill rate altogether; see limitBucket.
+
 type TierConfig struct {
-	Capacity   int64 `yaml:"capacity"`
-	RefillRate int64 `yaml:"refill_rate"`
+	Capacity    int64         `yaml:"capacity" json:"capacity"`
+	RefillRate  float64       `yaml:"refill_rate" json:"refill_rate"`
+	RefillEvery time.Duration `yaml:"refill_every" json:"refill_every,omitempty"`
+	MaxOverfill int64         `yaml:"max_overfill" json:"max_overfill,omitempty"` // Tokens an admin top-up may add above capacity
+	MaxDebt     int64         `yaml:"max_debt" json:"max_debt,omitempty"`         // How far below zero a request may take the balance; 0 disables borrowing
+	Limit       string        `yaml:"limit" json:"limit,omitempty"`               // e.g. "100/minute", instead of capacity and refill_rate
+	Burst       int64         `yaml:"burst" json:"burst,omitempty"`               // Replaces capacity; refill_rate or limit then sets the sustained rate
+	Quota       *QuotaConfig  `yaml:"quota" json:"quota,omitempty"`               // Caps each of the tier's per-key buckets per day or month
+	// BurstMultiplier scales Capacity for short spikes while the refill
+	// rate stays the same, e.g. 2 lets a premium key burst twice its normal
+	// capacity. 0 means 1, no extra burst.
+	BurstMultiplier float64 `yaml:"burst_multiplier" json:"burst_multiplier,omitempty"`
+	// InitialTokens is the balance a new per-key bucket starts with, so
+	// new keys ramp up instead of bursting. Unset means full; 0 is empty.
+	InitialTokens *int64 `yaml:"initial_tokens" json:"initial_tokens,omitempty"`
+	// Schedules change the tier's capacity and refill rate during recurring
+	// windows; the first active one applies
+	Schedules []ScheduleConfig `yaml:"schedules" json:"schedules,omitempty"`
+	// Extends names another tier whose settings this one inherits, resolved
+	// when the rules are loaded
+	Extends string `yaml:"extends" json:"extends,omitempty"`
+}
+
+// DefaultMaxBurstMultiplier is the highest burst_multiplier a tier may set
+// unless the rule set's max_burst_multiplier says otherwise.
+const DefaultMaxBurstMultiplier = 10.0
+
+// EffectiveCapacity is the capacity of the tier's per-key buckets, with its
+// burst multiplier applied.
+func (t TierConfig) EffectiveCapacity() int64 {
+	if t.BurstMultiplier <= 1 {
+		return t.Capacity
+	}
+	return int64(float64(t.Capacity) * t.BurstMultiplier)
 }
 
 type EndpointConfig struct {
-	Rule             string `yaml:"rule"`
-	Cost             int64  `yaml:"cost"`
-	GlobalCapacity   int64  `yaml:"global_capacity"`
-	GlobalRefillRate int64  `yaml:"global_refill_rate"`
+	Rule              string        `yaml:"rule" json:"rule"`
+	Cost              int64         `yaml:"cost" json:"cost"`
+	MaxCost           int64         `yaml:"max_cost" json:"max_cost,omitempty"` // Cap on a per-request cost; 0 accepts any
+	GlobalCapacity    int64         `yaml:"global_capacity" json:"global_capacity"`
+	GlobalRefillRate  float64       `yaml:"global_refill_rate" json:"global_refill_rate"`
+	GlobalRefillEvery time.Duration `yaml:"global_refill_every" json:"global_refill_every,omitempty"`
+	DryRun            bool          `yaml:"dry_run" json:"dry_run,omitempty"` // Evaluate the limit but never deny
+	// CostFrom charges the value of a metadata field, such as the rows an
+	// export returns, in place of cost
+	CostFrom *CostFromConfig `yaml:"cost_from" json:"cost_from,omitempty"`
+	// Limit describes the global bucket as e.g. "1000/minute" instead of
+	// global_capacity and global_refill_rate. Burst is its capacity, in
+	// place of global_capacity, leaving the limit or global_refill_rate as
+	// the sustained rate
+	Limit string `yaml:"limit" json:"limit,omitempty"`
+	Burst int64  `yaml:"burst" json:"burst,omitempty"`
+	// Quota caps the endpoint's global bucket per day or month
+	Quota *QuotaConfig `yaml:"quota" json:"quota,omitempty"`
+	// WindowCap caps the endpoint's global bucket per fixed window, e.g. a
+	// burst of 100 but no more than 1000 an hour
+	WindowCap *WindowCapConfig `yaml:"window_cap" json:"window_cap,omitempty"`
+	// PeakHours replaces the global bucket's capacity and refill rate
+	// during a daily UTC window
+	PeakHours *PeakConfig `yaml:"peak_hours" json:"peak_hours,omitempty"`
+	// Schedules change the global bucket's capacity and refill rate during
+	// recurring windows, like several peak_hours with days and a timezone;
+	// the first active one applies
+	Schedules []ScheduleConfig `yaml:"schedules" json:"schedules,omitempty"`
+	// InitialTokens is the balance a new global bucket starts with. Unset
+	// means full; 0 is empty
+	InitialTokens *int64 `yaml:"initial_tokens" json:"initial_tokens,omitempty"`
+	// MatchMode is "exact" (the default) or "prefix" to also cover every
+	// path below this one; see RuleSet.MatchEndpoint
+	MatchMode string `yaml:"match_mode" json:"match_mode,omitempty"`
+	// Resources are extra budgets a tiers+endpoints request draws on besides
+	// its cost, keyed by resource name
+	Resources map[string]ResourceConfig `yaml:"resources" json:"resources,omitempty"`
+	// GlobalTierShares splits a tiers+endpoints global bucket between the
+	// tiers, each getting its share of the capacity and refill rate as a
+	// bucket of its own, so no tier can take another's. The shares are
+	// keyed by tier, cover every tier and sum to 1
+	GlobalTierShares map[string]float64 `yaml:"global_tier_shares" json:"global_tier_shares,omitempty"`
+	// Extends names another endpoint whose settings this one inherits,
+	// in place of endpoint_defaults, unless it sets its own
+	Extends string `yaml:"extends" json:"extends,omitempty"`
+	// Template names an entry of RuleSet.Templates whose settings this one
+	// takes unless it sets its own. It is kept once resolved, to show where
+	// the settings came from
+	Template string `yaml:"template" json:"template,omitempty"`
+	// GlobalKey replaces a regex endpoint's path in its global bucket key,
+	// with {name} filled in from the pattern's named groups, e.g.
+	// "/api/orgs/{org}/items" gives each org a global bucket of its own
+	GlobalKey string `yaml:"global_key" json:"global_key,omitempty"`
+	// KeyFields names request metadata fields whose values are added to the
+	// per-key bucket's key, e.g. [region] limits each user per region.
+	// Requests must carry every field
+	KeyFields []string `yaml:"key_fields" json:"key_fields,omitempty"`
+	// LimitEnabled set to false allows every request without touching
+	// storage, e.g. as a kill switch during an incident. The other settings
+	// are still validated, ready for it to be switched back on. Unset means
+	// true
+	LimitEnabled *bool `yaml:"limit_enabled" json:"limit_enabled,omitempty"`
+}
+
+// Limited reports whether requests to the endpoint are limited, which they
+// are unless limit_enabled is false.
+func (e EndpointConfig) Limited() bool {
+	return e.LimitEnabled == nil || *e.LimitEnabled
+}
+
+// TierShare returns tier's part of a global bucket with capacity and
+// refillRate under GlobalTierShares, and false if the bucket isn't split.
+// Capacities round down.
+func (e EndpointConfig) TierShare(tier string, capacity int64, refillRate float64) (int64, float64, bool) {
+	share, ok := e.GlobalTierShares[tier]
+	if !ok {
+		return capacity, refillRate, false
+	}
+	// The epsilon keeps 0.29 * 100 from rounding down to 28
+	return int64(math.Floor(float64(capacity)*share + 1e-9)), refillRate * share, true
+}
+
+// ResourceConfig is a named budget such as LLM tokens or spend in cents,
+// with its own per-key bucket for each tier. Requests say how much they use
+// in their costs map.
+type ResourceConfig struct {
+	Cost  int64                    `yaml:"cost" json:"cost,omitempty"` // Charged when a request doesn't say; default 0
+	Tiers map[string]ResourceLimit `yaml:"tiers" json:"tiers"`
+}
+
+type ResourceLimit struct {
+	Capacity    int64         `yaml:"capacity" json:"capacity"`
+	RefillRate  float64       `yaml:"refill_rate" json:"refill_rate"`
+	RefillEvery time.Duration `yaml:"refill_every" json:"refill_every,omitempty"`
 }
 
 type IPConfig struct {
-	Capacity   int64 `yaml:"capacity"`
-	RefillRate int64 `yaml:"refill_rate"`
+	Capacity    int64         `yaml:"capacity" json:"capacity"`
+	RefillRate  float64       `yaml:"refill_rate" json:"refill_rate"`
+	RefillEvery time.Duration `yaml:"refill_every" json:"refill_every,omitempty"`
+	Limit       string        `yaml:"limit" json:"limit,omitempty"` // e.g. "100/minute", instead of capacity and refill_rate
+	Burst       int64         `yaml:"burst" json:"burst,omitempty"` // Replaces capacity; refill_rate or limit then sets the sustained rate
+}
+
+// PenaltyConfig tightens the per-key (user/IP) bucket of keys that keep
+// getting denied. Threshold denials within Window put the key under penalty
+// for Duration, during which its capacity and refill rate are scaled by
+// CapacityMultiplier; a multiplier of 0 blocks the key outright.
+type PenaltyConfig struct {
+	Threshold          int64         `yaml:"threshold" json:"threshold"` // 0 disables penalties
+	Window             time.Duration `yaml:"window" json:"window"`
+	Duration           time.Duration `yaml:"duration" json:"duration"`
+	CapacityMultiplier float64       `yaml:"capacity_multiplier" json:"capacity_multiplier"`
+}
+
+// TierLookupConfig makes tiers+endpoints checks use the tier stored for each
+// key (see storage.Storage.LookupTier), typically populated by billing,
+// instead of trusting the request's user_tier.
+type TierLookupConfig struct {
+	Enabled     bool   `yaml:"enabled" json:"enabled"`
+	DefaultTier string `yaml:"default_tier" json:"default_tier"` // Tier for keys with no stored tier
+	// Strict rejects requests whose user_tier disagrees with the stored
+	// tier; otherwise the request's user_tier is ignored
+	Strict   bool          `yaml:"strict" json:"strict,omitempty"`
+	CacheTTL time.Duration `yaml:"cache_ttl" json:"cache_ttl,omitempty"` // How long lookups are cached in-process; 0 disables caching
+}
+
+// JWTConfig takes the key (and optionally the tier) of /check requests from
+// the claims of a verified "Authorization: Bearer" token instead of the
+// body. HMAC secrets are not kept here; the server reads them from the
+// JWT_HMAC_SECRETS environment variable.
+type JWTConfig struct {
+	Enabled   bool   `yaml:"enabled" json:"enabled"`
+	KeyClaim  string `yaml:"key_claim" json:"key_claim,omitempty"`   // Defaults to "sub"
+	TierClaim string `yaml:"tier_claim" json:"tier_claim,omitempty"` // e.g. "plan"; empty leaves the tier to the request
+	// BodyFields is what happens to a key or user_tier in the body that a
+	// claim supplies: "ignore" (the default) or "reject"
+	BodyFields  string        `yaml:"body_fields" json:"body_fields,omitempty"`
+	ClockSkew   time.Duration `yaml:"clock_skew" json:"clock_skew,omitempty"`     // Leeway for exp and nbf
+	JWKSURL     string        `yaml:"jwks_url" json:"jwks_url,omitempty"`         // Public keys for RS*/ES* tokens
+	JWKSRefresh time.Duration `yaml:"jwks_refresh" json:"jwks_refresh,omitempty"` // Defaults to 10m
 }
 
 type RuleSet struct {
-	Tiers     map[string]TierConfig     `yaml:"tiers"`
-	Endpoints map[string]EndpointConfig `yaml:"endpoints"`
-	IPs       IPConfig                  `yaml:"ips"`
+	Tiers     map[string]TierConfig     `yaml:"tiers" json:"tiers"`
+	Endpoints map[string]EndpointConfig `yaml:"endpoints" json:"endpoints"`
+	// EndpointDefaults holds the settings every endpoint inherits unless it
+	// sets its own. They are merged in when the rules are loaded
+	EndpointDefaults *EndpointConfig `yaml:"endpoint_defaults" json:"endpoint_defaults,omitempty"`
+	// Templates are named bundles of endpoint settings, such as
+	// "expensive_write", that endpoints take by naming one in template.
+	// They are merged in when the rules are loaded
+	Templates map[string]EndpointConfig `yaml:"templates" json:"templates,omitempty"`
+	IPs       IPConfig                  `yaml:"ips" json:"ips"`
+	// IPOverrides replace the ips limits for some addresses and ranges in
+	// IP+endpoints and user+ip checks; the most specific one that covers an
+	// IP applies
+	IPOverrides []IPOverrideConfig `yaml:"ip_overrides" json:"ip_overrides,omitempty"`
+	Namespace   string             `yaml:"namespace" json:"namespace,omitempty"` // Default bucket namespace
+	Penalty     PenaltyConfig      `yaml:"penalty" json:"penalty,omitempty"`
+	TierLookup  TierLookupConfig   `yaml:"tier_lookup" json:"tier_lookup,omitempty"`
+	JWT         JWTConfig          `yaml:"jwt" json:"jwt,omitempty"`
+	CORS        CORSConfig         `yaml:"cors" json:"cors,omitempty"`
+	// SelfProtect limits /check calls per client IP before any rule is
+	// evaluated
+	SelfProtect SelfProtectConfig `yaml:"self_protect" json:"self_protect,omitempty"`
+	// Webhook posts bans, high denial rates and exhausted quotas to a URL
+	Webhook WebhookConfig `yaml:"webhook" json:"webhook,omitempty"`
+	// MaxBurstMultiplier caps every tier's burst_multiplier; 0 means
+	// DefaultMaxBurstMultiplier
+	MaxBurstMultiplier float64 `yaml:"max_burst_multiplier" json:"max_burst_multiplier,omitempty"`
+	// ScheduleTimezone is the IANA timezone schedule windows are written in,
+	// e.g. "America/New_York"; UTC when unset
+	ScheduleTimezone string `yaml:"schedule_timezone" json:"schedule_timezone,omitempty"`
+
+	patterns    *[]endpointPattern // Regex endpoints in declaration order; see endpointPatterns
+	ipOverrides *[]ipOverride      // IPOverrides parsed, longest prefix first; see ipOverrideList
+}
+
+var namespacePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{0,64}$`)
+
+// resourceNamePattern keeps resource names safe to embed in bucket keys.
+var resourceNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// ValidNamespace reports whether ns can be used as a bucket key namespace.
+// Colons are rejected so one namespace can never spell another's keys.
+func ValidNamespace(ns string) bool {
+	return namespacePattern.MatchString(ns)
 }
 
+// LoadRuleSet loads a rules file, merging in any files it includes; see
+// LoadRuleFiles.
 func LoadRuleSet(path string) (*RuleSet, error) {
-	data, err := os.ReadFile(path)
+	ruleSet, _, err := LoadRuleFiles(path)
+	return ruleSet, err
+}
+
+// ParseRuleSet parses a rules file that has already been read, in YAML or
+// JSON as DetectFormat tells from its content, expanding environment
+// variable references as LoadRuleSet does. Includes are resolved relative to
+// a file, so data that has any is rejected; load such files with
+// LoadRuleSet.
+func ParseRuleSet(data []byte) (*RuleSet, error) {
+	format := DetectFormat("", data)
+	data, err := expandEnv(data, format)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkStrict(data); err != nil {
+		return nil, err
+	}
+	order := endpointOrder(data)
+	doc, err := decodeDocument(data, format)
+	if err != nil {
+		return nil, fmt.Errorf("parsing as %s: %w", format, err)
+	}
+	if _, ok := doc["include"]; ok {
+		return nil, errors.New("include: needs the file's path; use LoadRuleSet")
+	}
+	resolved, err := resolveInheritance(doc)
 	if err != nil {
 		return nil, err
 	}
+	if format == FormatJSON || resolved {
+		if data, err = yaml.Marshal(doc); err != nil {
+			return nil, err
+		}
+	}
+	return parseRuleSet(data, format, order)
+}
 
-	var ruleSet RuleSet
-	if err := yaml.Unmarshal(data, &ruleSet); err != nil {
+// parseRuleSet decodes a rule set from YAML, converted from format, and
+// resolves its shorthands. order is the endpoint keys as the rules files
+// declare them, which regex endpoints are matched in.
+func parseRuleSet(data []byte, format Format, order []string) (*RuleSet, error) {
+	ruleSet, err := decodeRuleSet(data, format)
+	if err != nil {
+		return nil, fmt.Errorf("parsing as %s: %w", format, err)
+	}
+	if err := ruleSet.resolveLimits(); err != nil {
 		return nil, err
 	}
+	if err := ruleSet.resolveRefillIntervals(); err != nil {
+		return nil, err
+	}
+	ruleSet.compilePatterns(order)
+	ruleSet.compileIPOverrides()
+
+	return ruleSet, nil
+}
+
+// resolveRefillIntervals converts any *_every interval into the equivalent
+// tokens-per-second refill rate.
+func (rs *RuleSet) resolveRefillIntervals() error {
+	for name, tier := range rs.Tiers {
+		rate, err := refillRateFromInterval(tier.RefillRate, tier.RefillEvery, "refill")
+		if err != nil {
+			return fmt.Errorf("tier '%s': %w", name, err)
+		}
+		tier.RefillRate = rate
+		rs.Tiers[name] = tier
+	}
+	for path, endpoint := range rs.Endpoints {
+		rate, err := refillRateFromInterval(endpoint.GlobalRefillRate, endpoint.GlobalRefillEvery, "global_refill")
+		if err != nil {
+			return fmt.Errorf("endpoint '%s': %w", path, err)
+		}
+		endpoint.GlobalRefillRate = rate
+		for name, resource := range endpoint.Resources {
+			for tierName, limit := range resource.Tiers {
+				rate, err := refillRateFromInterval(limit.RefillRate, limit.RefillEvery, "refill")
+				if err != nil {
+					return fmt.Errorf("endpoint '%s' resource '%s' tier '%s': %w", path, name, tierName, err)
+				}
+				limit.RefillRate = rate
+				resource.Tiers[tierName] = limit
+			}
+		}
+		rs.Endpoints[path] = endpoint
+	}
+	rate, err := refillRateFromInterval(rs.IPs.RefillRate, rs.IPs.RefillEvery, "refill")
+	if err != nil {
+		return fmt.Errorf("ip config: %w", err)
+	}
+	rs.IPs.RefillRate = rate
+	return nil
+}
 
-	return &ruleSet, nil
+func refillRateFromInterval(rate float64, every time.Duration, field string) (float64, error) {
+	if every == 0 {
+		return rate, nil
+	}
+	if rate != 0 {
+		return 0, fmt.Errorf("set either %s_rate or %s_every, not both", field, field)
+	}
+	if every < 0 {
+		return 0, fmt.Errorf("%s_every must be positive", field)
+	}
+	return 1 / every.Seconds(), nil
 }
 
+// LoadAndValidate loads a rules file and validates it, so a bad file fails
+// at startup instead of misbehaving at runtime.
+func LoadAndValidate(path string) (*RuleSet, error) {
+	ruleSet, err := LoadRuleSet(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidateRuleSet(ruleSet); err != nil {
+		return nil, err
+	}
+	return ruleSet, nil
+}
+
+// ValidateRuleSet checks the whole rule set and reports every problem it
+// finds, joined with errors.Join, so a file can be fixed in one pass.
 func ValidateRuleSet(rs *RuleSet) error {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	maxBurst := rs.MaxBurstMultiplier
+	if maxBurst == 0 {
+		maxBurst = DefaultMaxBurstMultiplier
+	} else if maxBurst < 1 {
+		fail("max_burst_multiplier must be at least 1")
+	}
+
 	// Validate tiers
-	for name, tier := range rs.Tiers {
+	for _, name := range sortedKeys(rs.Tiers) {
+		tier := rs.Tiers[name]
 		if tier.Capacity <= 0 {
-			return fmt.Errorf("tier '%s': capacity must be positive", name)
+			fail("tier '%s': capacity must be positive", name)
 		}
 		if tier.RefillRate <= 0 {
-			return fmt.Errorf("tier '%s': refill_rate must be positive", name)
+			fail("tier '%s': refill_rate must be positive", name)
+		}
+		if tier.MaxOverfill < 0 {
+			fail("tier '%s': max_overfill must not be negative", name)
+		}
+		if tier.MaxDebt < 0 {
+			fail("tier '%s': max_debt must not be negative", name)
+		}
+		if tier.BurstMultiplier != 0 && tier.BurstMultiplier < 1 {
+			fail("tier '%s': burst_multiplier must be at least 1", name)
+		} else if tier.BurstMultiplier > maxBurst {
+			fail("tier '%s': burst_multiplier %g exceeds the maximum %g", name, tier.BurstMultiplier, maxBurst)
+		}
+		if n := tier.InitialTokens; n != nil {
+			if *n < 0 {
+				fail("tier '%s': initial_tokens must not be negative", name)
+			} else if *n > tier.EffectiveCapacity() {
+				fail("tier '%s': initial_tokens %d exceeds capacity %d", name, *n, tier.EffectiveCapacity())
+			} else if tier.Quota != nil {
+				fail("tier '%s': initial_tokens can't be combined with a quota, whose script creates buckets full", name)
+			}
+		}
+		if tier.Quota != nil {
+			if err := validateQuota(*tier.Quota, 0); err != nil {
+				fail("tier '%s' quota: %w", name, err)
+			}
+		}
+		if err := validateSchedules(tier.Schedules, 0); err != nil {
+			fail("tier '%s': %w", name, err)
+		}
+	}
+	if rs.ScheduleTimezone != "" {
+		if _, err := time.LoadLocation(rs.ScheduleTimezone); err != nil {
+			fail("schedule_timezone: unknown timezone '%s'", rs.ScheduleTimezone)
 		}
 	}
 
@@ -59,31 +432,360 @@ func ValidateRuleSet(rs *RuleSet) error {
 	validRules := map[string]bool{
 		"tiers+endpoints": true,
 		"IP+endpoints":    true,
+		"user+ip":         true,
 		"endpoint":        true,
 	}
 
-	for path, endpoint := range rs.Endpoints {
+	usesIPs := false
+	for _, path := range sortedKeys(rs.Endpoints) {
+		endpoint := rs.Endpoints[path]
 		if !validRules[endpoint.Rule] {
-			return fmt.Errorf("endpoint '%s': unknown rule '%s'", path, endpoint.Rule)
+			fail("endpoint '%s': unknown rule '%s'", path, endpoint.Rule)
 		}
 		if endpoint.Cost <= 0 {
-			return fmt.Errorf("endpoint '%s': cost must be positive", path)
+			fail("endpoint '%s': cost must be positive", path)
+		}
+		if endpoint.MaxCost < 0 {
+			fail("endpoint '%s': max_cost must not be negative", path)
+		}
+		switch endpoint.MatchMode {
+		case "", MatchExact:
+		case MatchPrefix:
+			if !strings.HasPrefix(path, "/") {
+				fail("endpoint '%s': prefix endpoints must start with '/'", path)
+			}
+			// "/a" and "/a/" would claim the same requests
+			if other, ok := strings.CutSuffix(path, "/"); ok && other != "" && rs.Endpoints[other].MatchMode == MatchPrefix {
+				fail("endpoint '%s': shadows prefix endpoint '%s', which matches the same paths", path, other)
+			}
+		default:
+			fail("endpoint '%s': unknown match_mode '%s' (want exact or prefix)", path, endpoint.MatchMode)
+		}
+		if endpoint.MaxCost > 0 && endpoint.MaxCost < endpoint.Cost {
+			fail("endpoint '%s': max_cost must be at least cost", path)
+		}
+		if endpoint.CostFrom != nil {
+			if err := validateCostFrom(*endpoint.CostFrom); err != nil {
+				fail("endpoint '%s' cost_from: %w", path, err)
+			}
+		}
+		if IsRegexEndpoint(path) {
+			if re, err := compileEndpointPattern(path); err != nil {
+				fail("endpoint '%s': invalid regex %q: %v", path, strings.TrimPrefix(path, RegexPrefix), err)
+			} else if endpoint.GlobalKey != "" {
+				groups := make(map[string]bool)
+				for _, name := range re.SubexpNames() {
+					groups[name] = name != ""
+				}
+				for _, placeholder := range placeholderPattern.FindAllStringSubmatch(endpoint.GlobalKey, -1) {
+					if !groups[placeholder[1]] {
+						fail("endpoint '%s': global_key uses {%s}, which the pattern has no named group for", path, placeholder[1])
+					}
+				}
+			}
+		} else if endpoint.GlobalKey != "" {
+			fail("endpoint '%s': global_key needs a regex endpoint, written %s<pattern>", path, RegexPrefix)
+		}
+		if endpoint.Rule == "user+ip" {
+			// There is no global bucket, so a global limit here would be ignored
+			if endpoint.GlobalCapacity != 0 || endpoint.GlobalRefillRate != 0 {
+				fail("endpoint '%s': rule user+ip has no global bucket; remove global_capacity and global_refill_rate", path)
+			}
+			if endpoint.GlobalKey != "" {
+				fail("endpoint '%s': rule user+ip has no global bucket for global_key to name", path)
+			}
+		} else {
+			if endpoint.GlobalCapacity <= 0 {
+				fail("endpoint '%s': global_capacity must be positive", path)
+			} else if endpoint.Cost > endpoint.GlobalCapacity {
+				fail("endpoint '%s': cost %d exceeds global_capacity %d, so no request can pass", path, endpoint.Cost, endpoint.GlobalCapacity)
+			}
+			if endpoint.GlobalRefillRate <= 0 {
+				fail("endpoint '%s': global_refill_rate must be positive", path)
+			}
+		}
+		if endpoint.Template != "" {
+			if _, ok := rs.Templates[endpoint.Template]; !ok {
+				fail("endpoint '%s': unknown template '%s'", path, endpoint.Template)
+			}
+		}
+		if len(endpoint.KeyFields) > 0 {
+			if endpoint.Rule != "tiers+endpoints" && endpoint.Rule != "user+ip" {
+				fail("endpoint '%s': rule %s has no per-key bucket for key_fields to split", path, endpoint.Rule)
+			}
+			seen := make(map[string]bool)
+			for _, field := range endpoint.KeyFields {
+				if field == "" || strings.ContainsAny(field, ":=") {
+					fail("endpoint '%s': key_fields entry '%s' must be a metadata field name without ':' or '='", path, field)
+				} else if seen[field] {
+					fail("endpoint '%s': key_fields lists '%s' twice", path, field)
+				}
+				seen[field] = true
+			}
+		}
+		if n := endpoint.InitialTokens; n != nil {
+			if endpoint.Rule == "user+ip" {
+				fail("endpoint '%s': rule user+ip has no global bucket for initial_tokens to fill", path)
+			} else if *n < 0 {
+				fail("endpoint '%s': initial_tokens must not be negative", path)
+			} else if endpoint.GlobalCapacity > 0 && *n > endpoint.GlobalCapacity {
+				fail("endpoint '%s': initial_tokens %d exceeds global_capacity %d", path, *n, endpoint.GlobalCapacity)
+			}
+		}
+		if endpoint.Rule == "tiers+endpoints" || endpoint.Rule == "user+ip" {
+			if len(rs.Tiers) == 0 {
+				fail("endpoint '%s': rule %s needs at least one tier", path, endpoint.Rule)
+			} else if !anyTierAffords(rs.Tiers, endpoint.Cost) {
+				fail("endpoint '%s': cost %d exceeds every tier's capacity, so no request can pass", path, endpoint.Cost)
+			}
+			// A burst is what a key can spend at once, so it must cover a request
+			for _, name := range sortedKeys(rs.Tiers) {
+				if tier := rs.Tiers[name]; tier.Burst > 0 && tier.EffectiveCapacity() < endpoint.Cost {
+					fail("tier '%s': burst %d is below the cost %d of endpoint '%s'", name, tier.EffectiveCapacity(), endpoint.Cost, path)
+				}
+			}
+		}
+		if endpoint.Rule == "IP+endpoints" || endpoint.Rule == "user+ip" {
+			usesIPs = true
+			if rs.IPs.Capacity > 0 && endpoint.Cost > rs.IPs.Capacity {
+				fail("endpoint '%s': cost %d exceeds the ip capacity %d, so no request can pass", path, endpoint.Cost, rs.IPs.Capacity)
+			}
+		}
+		if len(endpoint.GlobalTierShares) > 0 {
+			validateTierShares(rs, path, endpoint, fail)
+		}
+		if len(endpoint.Resources) > 0 && endpoint.Rule != "tiers+endpoints" {
+			fail("endpoint '%s': resources need the tiers+endpoints rule", path)
+		}
+		for _, name := range sortedKeys(endpoint.Resources) {
+			if err := validateResource(rs, name, endpoint.Resources[name]); err != nil {
+				fail("endpoint '%s' resource '%s': %w", path, name, err)
+			}
+		}
+		if endpoint.Quota != nil {
+			if endpoint.Rule == "user+ip" {
+				fail("endpoint '%s': rule user+ip has no global bucket to put a quota on", path)
+			} else if err := validateQuota(*endpoint.Quota, endpoint.Cost); err != nil {
+				fail("endpoint '%s' quota: %w", path, err)
+			}
+		}
+		if endpoint.WindowCap != nil {
+			if endpoint.Rule == "user+ip" {
+				fail("endpoint '%s': rule user+ip has no global bucket to put a window_cap on", path)
+			} else if err := validateWindowCap(*endpoint.WindowCap, endpoint.Cost); err != nil {
+				fail("endpoint '%s' window_cap: %w", path, err)
+			}
+		}
+		if endpoint.PeakHours != nil {
+			if endpoint.Rule == "user+ip" {
+				fail("endpoint '%s': rule user+ip has no global bucket for peak_hours to replace", path)
+			} else if err := validatePeak(*endpoint.PeakHours, endpoint.Cost); err != nil {
+				fail("endpoint '%s' peak_hours: %w", path, err)
+			}
+		}
+		if len(endpoint.Schedules) > 0 {
+			if endpoint.Rule == "user+ip" {
+				fail("endpoint '%s': rule user+ip has no global bucket for schedules to change", path)
+			} else if endpoint.PeakHours != nil {
+				fail("endpoint '%s': peak_hours and schedules can't be combined; write peak_hours as a schedule", path)
+			} else if err := validateSchedules(endpoint.Schedules, endpoint.Cost); err != nil {
+				fail("endpoint '%s': %w", path, err)
+			}
+		}
+		// Quotas are checked by their own script, which has no resources and
+		// no user+ip variant
+		if endpoint.Rule == "tiers+endpoints" || endpoint.Rule == "user+ip" {
+			if quotaTiers := tiersWithQuotas(rs.Tiers); len(quotaTiers) > 0 || endpoint.Quota != nil || endpoint.WindowCap != nil {
+				if endpoint.Rule == "user+ip" && len(quotaTiers) > 0 {
+					fail("endpoint '%s': rule user+ip does not support quotas, but tiers %s have one", path, strings.Join(quotaTiers, ", "))
+				} else if len(endpoint.Resources) > 0 {
+					fail("endpoint '%s': resources and quotas can't be combined", path)
+				}
+			}
+		}
+		// Only the plain bucket scripts create buckets at initial_tokens
+		if conflict := initialTokensConflict(endpoint); conflict != "" {
+			if endpoint.InitialTokens != nil && endpoint.Rule != "user+ip" {
+				fail("endpoint '%s': initial_tokens can't be combined with %s, whose script creates buckets full", path, conflict)
+			}
+			if initialTiers := tiersWithInitialTokens(rs.Tiers); len(initialTiers) > 0 && (endpoint.Rule == "tiers+endpoints" || endpoint.Rule == "user+ip") {
+				fail("endpoint '%s': tiers %s set initial_tokens, which can't apply with %s", path, strings.Join(initialTiers, ", "), conflict)
+			}
+		}
+	}
+
+	if p := rs.Penalty; p.Threshold != 0 {
+		if p.Threshold < 0 {
+			fail("penalty: threshold must not be negative")
+		}
+		if p.Window <= 0 || p.Duration <= 0 {
+			fail("penalty: window and duration must be positive")
+		}
+		if p.CapacityMultiplier < 0 || p.CapacityMultiplier >= 1 {
+			fail("penalty: capacity_multiplier must be at least 0 and below 1")
+		}
+	}
+
+	if tl := rs.TierLookup; tl.Enabled {
+		if _, ok := rs.Tiers[tl.DefaultTier]; !ok {
+			fail("tier_lookup: default_tier '%s' is not a configured tier", tl.DefaultTier)
+		}
+		if tl.CacheTTL < 0 {
+			fail("tier_lookup: cache_ttl must not be negative")
+		}
+	}
+
+	if j := rs.JWT; j.Enabled {
+		if j.BodyFields != "" && j.BodyFields != "ignore" && j.BodyFields != "reject" {
+			fail("jwt: body_fields must be 'ignore' or 'reject', got '%s'", j.BodyFields)
+		}
+		if j.ClockSkew < 0 || j.JWKSRefresh < 0 {
+			fail("jwt: clock_skew and jwks_refresh must not be negative")
+		}
+	}
+
+	if err := validateCORS(rs.CORS); err != nil {
+		fail("cors: %w", err)
+	}
+
+	if err := validateSelfProtect(rs.SelfProtect); err != nil {
+		fail("self_protect: %w", err)
+	}
+
+	if err := validateWebhook(rs.Webhook); err != nil {
+		fail("webhook: %w", err)
+	}
+
+	if !ValidNamespace(rs.Namespace) {
+		fail("namespace '%s': only letters, digits, '_' and '-' are allowed (max 64)", rs.Namespace)
+	}
+
+	validateIPOverrides(rs, fail)
+
+	// Validate IPs; an unset ips section is fine unless an endpoint needs it
+	if usesIPs || rs.IPs != (IPConfig{}) {
+		if rs.IPs.Capacity <= 0 {
+			fail("ip config: capacity must be positive")
+		}
+		if rs.IPs.RefillRate <= 0 {
+			fail("ip config: refill_rate must be positive")
 		}
-		if endpoint.GlobalCapacity <= 0 {
-			return fmt.Errorf("endpoint '%s': global_capacity must be positive", path)
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateTierShares checks that an endpoint's global_tier_shares give every
+// tier a positive share, sum to 1 and leave each tier enough to pay the cost.
+func validateTierShares(rs *RuleSet, path string, endpoint EndpointConfig, fail func(string, ...any)) {
+	if endpoint.Rule != "tiers+endpoints" {
+		fail("endpoint '%s': global_tier_shares need the tiers+endpoints rule", path)
+		return
+	}
+	sum := 0.0
+	for _, name := range sortedKeys(endpoint.GlobalTierShares) {
+		share := endpoint.GlobalTierShares[name]
+		sum += share
+		if _, ok := rs.Tiers[name]; !ok {
+			fail("endpoint '%s': global_tier_shares names unknown tier '%s'", path, name)
+		} else if share <= 0 || share > 1 {
+			fail("endpoint '%s': global_tier_shares for tier '%s' must be above 0 and at most 1", path, name)
+		} else if capacity, _, _ := endpoint.TierShare(name, endpoint.GlobalCapacity, 0); endpoint.GlobalCapacity > 0 && capacity < endpoint.Cost {
+			fail("endpoint '%s': tier '%s' gets %d of global_capacity, below the cost %d", path, name, capacity, endpoint.Cost)
 		}
-		if endpoint.GlobalRefillRate <= 0 {
-			return fmt.Errorf("endpoint '%s': global_refill_rate must be positive", path)
+	}
+	for _, name := range sortedKeys(rs.Tiers) {
+		if _, ok := endpoint.GlobalTierShares[name]; !ok {
+			fail("endpoint '%s': global_tier_shares has no share for tier '%s'", path, name)
 		}
 	}
+	if math.Abs(sum-1) > 1e-6 {
+		fail("endpoint '%s': global_tier_shares sum to %.4g, not 1", path, sum)
+	}
+}
 
-	// Validate IPs
-	if rs.IPs.Capacity <= 0 {
-		return fmt.Errorf("ip config: capacity must be positive")
+// anyTierAffords reports whether at least one tier can ever pay cost,
+// counting what it may borrow.
+func anyTierAffords(tiers map[string]TierConfig, cost int64) bool {
+	for _, tier := range tiers {
+		if cost <= tier.EffectiveCapacity()+tier.MaxDebt {
+			return true
+		}
 	}
-	if rs.IPs.RefillRate <= 0 {
-		return fmt.Errorf("ip config: refill_rate must be positive")
+	return false
+}
+
+// tiersWithQuotas returns the names of the tiers that have a quota.
+func tiersWithQuotas(tiers map[string]TierConfig) []string {
+	var names []string
+	for _, name := range sortedKeys(tiers) {
+		if tiers[name].Quota != nil {
+			names = append(names, name)
+		}
 	}
+	return names
+}
+
+func tiersWithInitialTokens(tiers map[string]TierConfig) []string {
+	var names []string
+	for _, name := range sortedKeys(tiers) {
+		if tiers[name].InitialTokens != nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
 
+// initialTokensConflict names what checks an endpoint with a script that
+// creates buckets full, ignoring initial_tokens, or is empty when nothing
+// does.
+func initialTokensConflict(endpoint EndpointConfig) string {
+	switch {
+	case endpoint.Rule == "user+ip":
+		return "rule user+ip"
+	case endpoint.Quota != nil:
+		return "a quota"
+	case endpoint.WindowCap != nil:
+		return "a window_cap"
+	case len(endpoint.Resources) > 0:
+		return "resources"
+	}
+	return ""
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// validateResource requires a limit for every configured tier, so no tier
+// can use a resource unmetered.
+func validateResource(rs *RuleSet, name string, resource ResourceConfig) error {
+	if !resourceNamePattern.MatchString(name) || name == "default" {
+		return fmt.Errorf("name must be letters, digits, '_' or '-' (max 64) and not 'default'")
+	}
+	if resource.Cost < 0 {
+		return fmt.Errorf("cost must not be negative")
+	}
+	for tierName := range rs.Tiers {
+		if _, ok := resource.Tiers[tierName]; !ok {
+			return fmt.Errorf("no limit for tier '%s'", tierName)
+		}
+	}
+	for tierName, limit := range resource.Tiers {
+		if _, ok := rs.Tiers[tierName]; !ok {
+			return fmt.Errorf("tier '%s' is not a configured tier", tierName)
+		}
+		if limit.Capacity <= 0 {
+			return fmt.Errorf("tier '%s': capacity must be positive", tierName)
+		}
+		if limit.RefillRate <= 0 {
+			return fmt.Errorf("tier '%s': refill_rate must be positive", tierName)
+		}
+	}
 	return nil
 }
@@ -0,0 +1,181 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ScheduleConfig overrides a bucket's limits during a recurring window,
+// e.g. bigger bursts overnight while the backend is idle. On a tier it
+// replaces the per-key buckets' capacity and refill rate, on an endpoint
+// its global bucket's. A zero Capacity or RefillRate keeps the base one.
+//
+// Window is "HH:MM-HH:MM" in the rule set's schedule_timezone, including
+// the start and excluding the end. It may wrap past midnight, as in
+// "22:00-06:00", and then belongs to the day it starts on. Days limits it
+// to some days of the week (mon, tue, ... sun); none means every day.
+type ScheduleConfig struct {
+	Name       string   `yaml:"name" json:"name"`
+	Window     string   `yaml:"window" json:"window"`
+	Days       []string `yaml:"days" json:"days,omitempty"`
+	Capacity   int64    `yaml:"capacity" json:"capacity,omitempty"`
+	RefillRate float64  `yaml:"refill_rate" json:"refill_rate,omitempty"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ActiveSchedule returns the first of schedules whose window contains now,
+// judged in loc, and false when none does. Invalid schedules never match;
+// ValidateRuleSet reports them.
+func ActiveSchedule(schedules []ScheduleConfig, now time.Time, loc *time.Location) (ScheduleConfig, bool) {
+	now = now.In(loc)
+	minute := now.Hour()*60 + now.Minute()
+	for _, s := range schedules {
+		from, to, err := parseWindow(s.Window)
+		if err != nil {
+			continue
+		}
+		day := now.Weekday()
+		switch {
+		case from < to && from <= minute && minute < to:
+		case from > to && minute >= from:
+		case from > to && minute < to:
+			// Past midnight, the window belongs to the day before
+			day = (day + 6) % 7
+		default:
+			continue
+		}
+		if onDay(s.Days, day) {
+			return s, true
+		}
+	}
+	return ScheduleConfig{}, false
+}
+
+func onDay(days []string, day time.Weekday) bool {
+	if len(days) == 0 {
+		return true
+	}
+	for _, d := range days {
+		if weekdays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// Scheduled returns the tier with the limits of its schedule active at now
+// applied, and that schedule's name, or "" when none is active. A
+// scheduled capacity is used as is, without the burst multiplier.
+func (t TierConfig) Scheduled(now time.Time, loc *time.Location) (TierConfig, string) {
+	s, ok := ActiveSchedule(t.Schedules, now, loc)
+	if !ok {
+		return t, ""
+	}
+	if s.Capacity > 0 {
+		t.Capacity, t.BurstMultiplier = s.Capacity, 0
+	}
+	if s.RefillRate > 0 {
+		t.RefillRate = s.RefillRate
+	}
+	return t, s.Name
+}
+
+// Scheduled returns the endpoint with the global bucket limits of its
+// schedule active at now applied, and that schedule's name, or "" when
+// none is active.
+func (e EndpointConfig) Scheduled(now time.Time, loc *time.Location) (EndpointConfig, string) {
+	s, ok := ActiveSchedule(e.Schedules, now, loc)
+	if !ok {
+		return e, ""
+	}
+	if s.Capacity > 0 {
+		e.GlobalCapacity = s.Capacity
+	}
+	if s.RefillRate > 0 {
+		e.GlobalRefillRate = s.RefillRate
+	}
+	return e, s.Name
+}
+
+var locationCache sync.Map // Timezone name to *time.Location
+
+// ScheduleLocation is the timezone schedule windows are judged in:
+// schedule_timezone, or UTC when it is unset or invalid.
+func (rs *RuleSet) ScheduleLocation() *time.Location {
+	name := rs.ScheduleTimezone
+	if name == "" {
+		return time.UTC
+	}
+	if loc, ok := locationCache.Load(name); ok {
+		return loc.(*time.Location)
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.UTC
+	}
+	locationCache.Store(name, loc)
+	return loc
+}
+
+// parseWindow returns the start and end minute of the day of an
+// "HH:MM-HH:MM" window.
+func parseWindow(window string) (int, int, error) {
+	start, end, ok := strings.Cut(window, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid window '%s' (want HH:MM-HH:MM)", window)
+	}
+	from, err := parsePeakTime(strings.TrimSpace(start))
+	if err != nil {
+		return 0, 0, err
+	}
+	to, err := parsePeakTime(strings.TrimSpace(end))
+	if err != nil {
+		return 0, 0, err
+	}
+	if from == to {
+		return 0, 0, fmt.Errorf("window '%s' is empty", window)
+	}
+	return from, to, nil
+}
+
+// validateSchedules checks a tier's or endpoint's schedules, whose
+// capacities must pay cost when it is positive.
+func validateSchedules(schedules []ScheduleConfig, cost int64) error {
+	var errs []error
+	names := make(map[string]bool)
+	for i, s := range schedules {
+		fail := func(format string, args ...any) {
+			errs = append(errs, fmt.Errorf("schedule '%s': %s", s.Name, fmt.Sprintf(format, args...)))
+		}
+		if s.Name == "" {
+			errs = append(errs, fmt.Errorf("schedules[%d]: name is required", i))
+		} else if names[s.Name] {
+			fail("defined twice")
+		}
+		names[s.Name] = true
+		if _, _, err := parseWindow(s.Window); err != nil {
+			fail("%v", err)
+		}
+		for _, day := range s.Days {
+			if _, ok := weekdays[strings.ToLower(day)]; !ok {
+				fail("unknown day '%s' (want mon, tue, wed, thu, fri, sat or sun)", day)
+			}
+		}
+		if s.Capacity < 0 || s.RefillRate < 0 {
+			fail("capacity and refill_rate must not be negative")
+		} else if s.Capacity == 0 && s.RefillRate == 0 {
+			fail("set capacity, refill_rate or both")
+		}
+		if s.Capacity > 0 && cost > s.Capacity {
+			fail("cost %d exceeds capacity %d, so no request can pass", cost, s.Capacity)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,247 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+//go:generate go run ./internal/schemagen rules.schema.json
+
+// GenerateJSONSchema returns a JSON Schema (draft-07) for rules files, so
+// editors can complete and check rules.yaml as it is written. It is built
+// from the yaml names and types of RuleSet's fields, and like strict
+// parsing it rejects fields the rules don't define, apart from include:
+// and x-* keys at the top level. Values the schema can't express, such as
+// a limit's syntax or a cost above a capacity, are left to ValidateRuleSet.
+func GenerateJSONSchema() ([]byte, error) {
+	g := &schemaGenerator{definitions: make(map[string]any)}
+	root := g.object(reflect.TypeOf(RuleSet{}))
+	root["$schema"] = "http://json-schema.org/draft-07/schema#"
+	root["$id"] = "https://github.com/AndySung320/rate-limiter/config/rules.schema.json"
+	root["title"] = "Rate limiter rules"
+	root["properties"].(map[string]any)["include"] = map[string]any{
+		"description": "Rules files to merge over this one, relative to its directory",
+		"oneOf": []any{
+			map[string]any{"type": "string"},
+			map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+		},
+	}
+	root["patternProperties"] = map[string]any{
+		"^x-": map[string]any{"description": "Holds anchors for the rest of the file"},
+	}
+	root["definitions"] = g.definitions
+	if len(g.missing) > 0 {
+		sort.Strings(g.missing)
+		return nil, fmt.Errorf("no schema description for %s", strings.Join(g.missing, ", "))
+	}
+	data, err := json.MarshalIndent(root, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+type schemaGenerator struct {
+	definitions map[string]any
+	missing     []string // Fields without an entry in schemaFields
+}
+
+// schema returns the schema for values of typ, with structs as references
+// to their definitions.
+func (g *schemaGenerator) schema(typ reflect.Type) map[string]any {
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	switch {
+	case typ == durationType:
+		return map[string]any{"type": []string{"string", "integer"}, "pattern": `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`}
+	case typ.Kind() == reflect.Struct:
+		if _, ok := g.definitions[typ.Name()]; !ok {
+			// Placeholder so recursive types stop here
+			g.definitions[typ.Name()] = nil
+			g.definitions[typ.Name()] = g.object(typ)
+		}
+		return map[string]any{"$ref": "#/definitions/" + typ.Name()}
+	case typ.Kind() == reflect.Map:
+		values := g.schema(typ.Elem())
+		if _, ok := values["$ref"]; ok {
+			// An entry left empty, such as an endpoint taking every default
+			values = map[string]any{"anyOf": []any{values, map[string]any{"type": "null"}}}
+		}
+		return map[string]any{"type": "object", "additionalProperties": values}
+	case typ.Kind() == reflect.Slice:
+		return map[string]any{"type": "array", "items": g.schema(typ.Elem())}
+	case typ.Kind() == reflect.String:
+		return map[string]any{"type": "string"}
+	case typ.Kind() == reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case typ.Kind() >= reflect.Int && typ.Kind() <= reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case typ.Kind() == reflect.Float32 || typ.Kind() == reflect.Float64:
+		return map[string]any{"type": "number"}
+	}
+	return map[string]any{}
+}
+
+// object returns the schema for the struct typ, describing each field from
+// schemaFields.
+func (g *schemaGenerator) object(typ reflect.Type) map[string]any {
+	properties := make(map[string]any)
+	for name, fieldType := range yamlFields(typ) {
+		property := g.schema(fieldType)
+		field, ok := schemaFields[typ.Name()+"."+name]
+		if !ok {
+			g.missing = append(g.missing, typ.Name()+"."+name)
+		}
+		if _, ok := property["$ref"]; ok {
+			// draft-07 ignores keywords beside $ref
+			property = map[string]any{"allOf": []any{property}}
+		}
+		property["description"] = field.description
+		if field.enum != nil {
+			property["enum"] = field.enum
+		}
+		properties[name] = property
+	}
+	return map[string]any{"type": "object", "properties": properties, "additionalProperties": false}
+}
+
+type schemaField struct {
+	description string
+	enum        []string
+}
+
+// schemaFields describes each rules file field, keyed by struct and yaml
+// name, for editors to show as it is typed. Keep them in step with the
+// field comments.
+var schemaFields = map[string]schemaField{
+	"RuleSet.tiers":                {description: "Per-key bucket limits by user tier"},
+	"RuleSet.endpoints":            {description: "Limits by endpoint path; a path starting with ~ is a regular expression"},
+	"RuleSet.endpoint_defaults":    {description: "Settings every endpoint inherits unless it sets its own"},
+	"RuleSet.templates":            {description: "Named bundles of endpoint settings that endpoints take by naming one in template"},
+	"RuleSet.ips":                  {description: "Per-IP bucket limits for IP+endpoints and user+ip endpoints"},
+	"RuleSet.ip_overrides":         {description: "Replace the ips limits for some addresses and ranges; the most specific one that covers an IP applies"},
+	"RuleSet.namespace":            {description: "Default bucket namespace"},
+	"RuleSet.penalty":              {description: "Temporarily shrinks the buckets of keys that are denied repeatedly"},
+	"RuleSet.tier_lookup":          {description: "Looks up each key's tier in storage instead of trusting the request"},
+	"RuleSet.jwt":                  {description: "Takes the key and tier from a bearer token's claims"},
+	"RuleSet.cors":                 {description: "Lets browsers call the limiter from pages on other origins"},
+	"RuleSet.self_protect":         {description: "Limits /check calls per client IP, in memory, before any rule is evaluated"},
+	"RuleSet.webhook":              {description: "Posts bans, high denial rates and exhausted quotas to a URL"},
+	"RuleSet.max_burst_multiplier": {description: "Caps every tier's burst_multiplier; 0 means the built-in default"},
+	"RuleSet.schedule_timezone":    {description: `IANA timezone schedule windows are written in, e.g. "America/New_York"; UTC when unset`},
+
+	"TierConfig.capacity":         {description: "Most tokens a key's bucket holds"},
+	"TierConfig.refill_rate":      {description: "Tokens added per second"},
+	"TierConfig.refill_every":     {description: "Adds one token this often, e.g. 1m, instead of refill_rate"},
+	"TierConfig.max_overfill":     {description: "Tokens an admin top-up may add above capacity"},
+	"TierConfig.max_debt":         {description: "How far below zero a request may take the balance; 0 disables borrowing"},
+	"TierConfig.limit":            {description: `e.g. "100/minute", instead of capacity and refill_rate`},
+	"TierConfig.burst":            {description: "Replaces capacity; refill_rate or limit then sets the sustained rate"},
+	"TierConfig.quota":            {description: "Caps each of the tier's per-key buckets per day or month"},
+	"TierConfig.burst_multiplier": {description: "Scales capacity for short spikes while the refill rate stays the same; 0 means 1"},
+	"TierConfig.initial_tokens":   {description: "Balance a new per-key bucket starts with; unset means full, 0 is empty"},
+	"TierConfig.schedules":        {description: "Change the capacity and refill rate during recurring windows; the first active one applies"},
+	"TierConfig.extends":          {description: "Another tier whose settings this one inherits"},
+
+	"EndpointConfig.rule":                {description: "Which buckets a request is checked against", enum: []string{"tiers+endpoints", "IP+endpoints", "user+ip", "endpoint"}},
+	"EndpointConfig.cost":                {description: "Tokens a request takes unless it gives its own cost"},
+	"EndpointConfig.max_cost":            {description: "Cap on a per-request cost; 0 accepts any"},
+	"EndpointConfig.cost_from":           {description: "Charges the value of a metadata field in place of cost"},
+	"EndpointConfig.global_capacity":     {description: "Most tokens the endpoint's global bucket holds"},
+	"EndpointConfig.global_refill_rate":  {description: "Tokens added to the global bucket per second"},
+	"EndpointConfig.global_refill_every": {description: "Adds one global token this often, e.g. 1m, instead of global_refill_rate"},
+	"EndpointConfig.dry_run":             {description: "Evaluate the limit but never deny"},
+	"EndpointConfig.limit":               {description: `e.g. "1000/minute", instead of global_capacity and global_refill_rate`},
+	"EndpointConfig.burst":               {description: "Replaces global_capacity; global_refill_rate or limit then sets the sustained rate"},
+	"EndpointConfig.quota":               {description: "Caps the global bucket per day or month"},
+	"EndpointConfig.window_cap":          {description: "Caps the global bucket per fixed window"},
+	"EndpointConfig.peak_hours":          {description: "Replaces the global bucket's capacity and refill rate during a daily UTC window"},
+	"EndpointConfig.schedules":           {description: "Change the global bucket's capacity and refill rate during recurring windows; the first active one applies"},
+	"EndpointConfig.initial_tokens":      {description: "Balance a new global bucket starts with; unset means full, 0 is empty"},
+	"EndpointConfig.match_mode":          {description: "Whether the endpoint also covers every path below it", enum: []string{MatchExact, MatchPrefix}},
+	"EndpointConfig.resources":           {description: "Extra budgets a tiers+endpoints request draws on besides its cost, keyed by resource name"},
+	"EndpointConfig.global_tier_shares":  {description: "Splits a tiers+endpoints global bucket between the tiers; keyed by tier, covering every tier and summing to 1"},
+	"EndpointConfig.extends":             {description: "Another endpoint whose settings this one inherits, in place of endpoint_defaults"},
+	"EndpointConfig.global_key":          {description: "Replaces a regex endpoint's path in its global bucket key, with {name} filled in from the pattern's named groups"},
+	"EndpointConfig.template":            {description: "A template whose settings this endpoint takes unless it sets its own"},
+	"EndpointConfig.key_fields":          {description: "Request metadata fields whose values are added to the per-key bucket's key; requests must carry every one"},
+	"EndpointConfig.limit_enabled":       {description: "false allows every request without touching storage, keeping the other settings for when it is switched back on"},
+
+	"ResourceConfig.cost":  {description: "Charged when a request doesn't say; default 0"},
+	"ResourceConfig.tiers": {description: "The resource's per-key bucket limits by tier"},
+
+	"ResourceLimit.capacity":     {description: "Most of the resource a key's bucket holds"},
+	"ResourceLimit.refill_rate":  {description: "Amount added per second"},
+	"ResourceLimit.refill_every": {description: "Adds one unit this often, e.g. 1m, instead of refill_rate"},
+
+	"IPConfig.capacity":     {description: "Most tokens an IP's bucket holds"},
+	"IPConfig.refill_rate":  {description: "Tokens added per second"},
+	"IPConfig.refill_every": {description: "Adds one token this often, e.g. 1m, instead of refill_rate"},
+	"IPConfig.limit":        {description: `e.g. "100/minute", instead of capacity and refill_rate`},
+	"IPConfig.burst":        {description: "Replaces capacity; refill_rate or limit then sets the sustained rate"},
+
+	"IPOverrideConfig.address":     {description: `An IP such as "203.0.113.7" or a CIDR range such as "10.0.0.0/8"`},
+	"IPOverrideConfig.capacity":    {description: "Most tokens the IP bucket holds"},
+	"IPOverrideConfig.refill_rate": {description: "Tokens added per second"},
+	"IPOverrideConfig.unlimited":   {description: "Let the address through IP+endpoints without charging any bucket"},
+
+	"PenaltyConfig.threshold":           {description: "Denials within window that trigger a penalty; 0 disables penalties"},
+	"PenaltyConfig.window":              {description: "How far back denials are counted"},
+	"PenaltyConfig.duration":            {description: "How long a penalty lasts"},
+	"PenaltyConfig.capacity_multiplier": {description: "Scales a penalized key's capacity and refill rate; 0 blocks it outright"},
+
+	"TierLookupConfig.enabled":      {description: "Look up each key's tier in storage"},
+	"TierLookupConfig.default_tier": {description: "Tier for keys with no stored tier"},
+	"TierLookupConfig.strict":       {description: "Reject requests whose user_tier disagrees with the stored tier instead of ignoring it"},
+	"TierLookupConfig.cache_ttl":    {description: "How long lookups are cached in-process; 0 disables caching"},
+
+	"JWTConfig.enabled":      {description: "Take the key and tier from a bearer token"},
+	"JWTConfig.key_claim":    {description: `Claim holding the key; defaults to "sub"`},
+	"JWTConfig.tier_claim":   {description: `Claim holding the tier, e.g. "plan"; empty leaves the tier to the request`},
+	"JWTConfig.body_fields":  {description: "What happens to a key or user_tier in the body that a claim supplies", enum: []string{"ignore", "reject"}},
+	"JWTConfig.clock_skew":   {description: "Leeway for exp and nbf"},
+	"JWTConfig.jwks_url":     {description: "Public keys for RS* and ES* tokens"},
+	"JWTConfig.jwks_refresh": {description: "How often the keys are fetched again; defaults to 10m"},
+
+	"CORSConfig.allow_origins":     {description: `Origins allowed, e.g. "https://admin.example.com"; "*" allows any. Empty turns CORS off`},
+	"CORSConfig.allow_methods":     {description: "Methods allowed; defaults to GET, POST and DELETE"},
+	"CORSConfig.allow_headers":     {description: "Request headers allowed; defaults to the ones the API reads"},
+	"CORSConfig.allow_credentials": {description: "Let browsers send cookies and Authorization headers; the caller's origin is echoed instead of *"},
+	"CORSConfig.max_age":           {description: "How long browsers may cache a preflight"},
+
+	"SelfProtectConfig.capacity":    {description: "Burst of /check calls each IP may make; 0 turns self-protection off"},
+	"SelfProtectConfig.refill_rate": {description: "/check calls per second each IP may sustain"},
+	"SelfProtectConfig.max_entries": {description: "IPs tracked before the least recently seen is dropped; defaults to 100000"},
+
+	"WebhookConfig.url":    {description: "Where events are posted; empty turns the webhook off"},
+	"WebhookConfig.secret": {description: "Signs each body with HMAC-SHA256 in an X-Signature-256 header"},
+	"WebhookConfig.events": {description: "The events to send, of ban, high_denial_rate and quota_exceeded; empty sends all"},
+
+	"CostFromConfig.metadata":   {description: "The metadata field whose integer value is the cost, e.g. rows"},
+	"CostFromConfig.multiplier": {description: "Scales the value, e.g. 0.01 for one token per hundred; defaults to 1. Costs round up"},
+	"CostFromConfig.min":        {description: "Lower bound on the cost"},
+	"CostFromConfig.max":        {description: "Upper bound on the cost, against absurd values; 0 is unbounded"},
+	"CostFromConfig.strict":     {description: "Reject requests whose field is missing or not an integer instead of charging cost"},
+
+	"QuotaConfig.amount":   {description: "Tokens allowed per window"},
+	"QuotaConfig.window":   {description: "When the quota starts over", enum: []string{"day", "month"}},
+	"QuotaConfig.timezone": {description: `IANA name the window is counted in, e.g. "America/New_York"; defaults to UTC`},
+
+	"WindowCapConfig.amount": {description: "Tokens allowed per window"},
+	"WindowCapConfig.window": {description: "Length of the fixed window, e.g. 1h"},
+
+	"PeakConfig.start":       {description: "HH:MM, UTC"},
+	"PeakConfig.end":         {description: "HH:MM, UTC; after start"},
+	"PeakConfig.capacity":    {description: "Global capacity during the window"},
+	"PeakConfig.refill_rate": {description: "Global refill rate during the window"},
+
+	"ScheduleConfig.name":        {description: "Reported in check responses while the schedule is active"},
+	"ScheduleConfig.window":      {description: `"HH:MM-HH:MM" in schedule_timezone; may wrap past midnight`},
+	"ScheduleConfig.days":        {description: "Days the window starts on, e.g. mon; every day when empty"},
+	"ScheduleConfig.capacity":    {description: "Capacity while active; unset keeps the usual one"},
+	"ScheduleConfig.refill_rate": {description: "Refill rate while active; unset keeps the usual one"},
+}
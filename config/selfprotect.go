@@ -0,0 +1,43 @@
+package config
+
+import "errors"
+
+// DefaultSelfProtectMaxEntries bounds the per-IP buckets self-protection
+// keeps when max_entries is unset.
+const DefaultSelfProtectMaxEntries = 100_000
+
+// SelfProtectConfig limits how often each client IP may call /check, in
+// process memory, so the limiter can't be flooded through its own API even
+// while its storage is slow or down. It is off while Capacity is 0.
+type SelfProtectConfig struct {
+	Capacity   int64 `yaml:"capacity" json:"capacity,omitempty"`
+	RefillRate int64 `yaml:"refill_rate" json:"refill_rate,omitempty"` // Requests per second
+	// MaxEntries bounds the IPs tracked; past it the least recently seen
+	// IP's bucket is dropped and starts over full. Defaults to
+	// DefaultSelfProtectMaxEntries
+	MaxEntries int `yaml:"max_entries" json:"max_entries,omitempty"`
+}
+
+// Enabled reports whether /check calls are limited per IP.
+func (c SelfProtectConfig) Enabled() bool {
+	return c.Capacity > 0
+}
+
+// Entries returns MaxEntries, or its default when unset.
+func (c SelfProtectConfig) Entries() int {
+	if c.MaxEntries == 0 {
+		return DefaultSelfProtectMaxEntries
+	}
+	return c.MaxEntries
+}
+
+func validateSelfProtect(c SelfProtectConfig) error {
+	var errs []error
+	if c.Capacity < 0 || c.RefillRate < 0 || c.MaxEntries < 0 {
+		errs = append(errs, errors.New("capacity, refill_rate and max_entries must not be negative"))
+	}
+	if c.Capacity > 0 && c.RefillRate == 0 {
+		errs = append(errs, errors.New("refill_rate must be positive when capacity is set"))
+	}
+	return errors.Join(errs...)
+}
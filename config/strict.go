@@ -0,0 +1,187 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+var lenient atomic.Bool
+
+// SetLenient turns strict parsing of rules files off or back on. Strict is
+// the default: a field the rules don't define, such as refillRate for
+// refill_rate, or a key given twice in one mapping fails the load. Lenient
+// parsing, for migrating old files, logs unknown fields and ignores them
+// instead. A repeated key still fails a YAML file, while JSON keeps the last.
+func SetLenient(on bool) {
+	lenient.Store(on)
+}
+
+// checkStrict reports the unknown fields and repeated keys in a rules file,
+// with their line numbers. JSON is checked as the YAML it also is, so its
+// line numbers are right too. The top level may also have include: and
+// x-* keys, which hold anchors for the rest of the file.
+func checkStrict(data []byte) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil || len(doc.Content) == 0 {
+		// Syntax errors are left for the parser to report
+		return nil
+	}
+	checker := &strictChecker{seen: make(map[string]bool)}
+	checker.check(doc.Content[0], reflect.TypeOf(RuleSet{}), "")
+	if len(checker.problems) == 0 {
+		return nil
+	}
+	err := errors.Join(checker.problems...)
+	if lenient.Load() {
+		log.Printf("⚠️ Ignoring in lenient mode: %v", strings.ReplaceAll(err.Error(), "\n", "; "))
+		return nil
+	}
+	return err
+}
+
+type strictChecker struct {
+	problems []error
+	seen     map[string]bool // Problems already reported, as aliases revisit nodes
+}
+
+func (c *strictChecker) fail(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if !c.seen[msg] {
+		c.seen[msg] = true
+		c.problems = append(c.problems, errors.New(msg))
+	}
+}
+
+// check compares node with typ, which it decodes into, at path.
+func (c *strictChecker) check(node *yaml.Node, typ reflect.Type, path string) {
+	for node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	switch {
+	case typ == durationType:
+	case typ.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		fields := yamlFields(typ)
+		c.checkMapping(node, path, func(key, value *yaml.Node) {
+			fieldType, ok := fields[key.Value]
+			if ok {
+				c.check(value, fieldType, joinPath(path, key.Value))
+				return
+			}
+			if path == "" && (key.Value == "include" || strings.HasPrefix(key.Value, "x-")) {
+				return
+			}
+			hint := ""
+			if guess := snakeCase(key.Value); guess != key.Value {
+				if _, ok := fields[guess]; ok {
+					hint = fmt.Sprintf(" (did you mean %s?)", guess)
+				}
+			}
+			c.fail("line %d: unknown field %s %s%s", key.Line, key.Value, where(path), hint)
+		}, func(merged *yaml.Node) { c.check(merged, typ, path) })
+	case typ.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		c.checkMapping(node, path, func(key, value *yaml.Node) {
+			c.check(value, typ.Elem(), joinPath(path, key.Value))
+		}, func(merged *yaml.Node) { c.check(merged, typ, path) })
+	case typ.Kind() == reflect.Slice && node.Kind == yaml.SequenceNode:
+		for i, item := range node.Content {
+			c.check(item, typ.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	}
+}
+
+// checkMapping calls each for every key of node with its value, and merge
+// for every mapping merged in with <<, after reporting repeated keys. A key
+// that overrides a merged one is not repeated.
+func (c *strictChecker) checkMapping(node *yaml.Node, path string, each func(key, value *yaml.Node), merge func(*yaml.Node)) {
+	first := make(map[string]int)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if key.Kind == yaml.ScalarNode && key.Tag == "!!merge" {
+			merged := []*yaml.Node{value}
+			if value.Kind == yaml.SequenceNode {
+				merged = value.Content
+			}
+			for _, m := range merged {
+				merge(m)
+			}
+			continue
+		}
+		if line, ok := first[key.Value]; ok {
+			c.fail("line %d: %s (first defined at line %d)", key.Line, duplicate(path, key.Value), line)
+			continue
+		}
+		first[key.Value] = key.Line
+		each(key, value)
+	}
+}
+
+// yamlFields maps the yaml names of typ's fields to their types.
+func yamlFields(typ reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type, typ.NumField())
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		switch name {
+		case "-":
+			continue
+		case "":
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func where(path string) string {
+	if path == "" {
+		return "at the top level"
+	}
+	return "in " + path
+}
+
+// duplicate describes key given twice in the mapping at path, naming tiers
+// and endpoints as such.
+func duplicate(path, key string) string {
+	switch path {
+	case "tiers":
+		return fmt.Sprintf("tier '%s' is defined twice", key)
+	case "endpoints":
+		return fmt.Sprintf("endpoint '%s' is defined twice", key)
+	}
+	return fmt.Sprintf("%s is given twice %s", key, where(path))
+}
+
+// snakeCase turns refillRate or RefillRate into refill_rate.
+func snakeCase(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,52 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+// resolveTemplates fills in each endpoint of a merged rules document that
+// names a template with the template's settings, under its own, so it only
+// needs the settings that differ. It runs before endpoint_defaults and
+// extends are resolved, which then apply beneath the template. An unknown
+// template is left for validation to report. It reports whether any
+// endpoint uses a template.
+func resolveTemplates(doc map[string]any) (bool, error) {
+	var templates map[string]any
+	if value, ok := doc["templates"]; ok && value != nil {
+		if templates, ok = value.(map[string]any); !ok {
+			return false, errors.New("templates: must be a mapping of template names to endpoint settings")
+		}
+	}
+	for _, name := range sortedKeys(templates) {
+		template, _ := templates[name].(map[string]any)
+		for _, key := range []string{"template", "extends"} {
+			if _, ok := template[key]; ok {
+				return false, fmt.Errorf("template '%s': can't set %s", name, key)
+			}
+		}
+	}
+
+	endpoints, _ := doc["endpoints"].(map[string]any)
+	used := false
+	for _, path := range sortedKeys(endpoints) {
+		own, _ := endpoints[path].(map[string]any)
+		value, ok := own["template"]
+		if !ok || value == nil {
+			continue
+		}
+		name, ok := value.(string)
+		if !ok || name == "" {
+			return false, fmt.Errorf("endpoint '%s': template must name a template", path)
+		}
+		template, ok := templates[name].(map[string]any)
+		if !ok {
+			continue
+		}
+		endpoint := copyYAML(template).(map[string]any)
+		mergeYAML(endpoint, own)
+		endpoints[path] = endpoint
+		used = true
+	}
+	return used, nil
+}
@@ -0,0 +1,62 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Warnings reports settings in a rule set that are valid but likely
+// mistakes, one message per line, for tools to show without rejecting the
+// rules: a tier too small to ever pay an endpoint's cost, a max_cost the
+// global bucket can never cover, prefix endpoints nested inside one
+// another, and endpoints with limiting switched off. Run ValidateRuleSet first; problems it rejects aren't repeated.
+func Warnings(rs *RuleSet) []string {
+	var warnings []string
+	warn := func(format string, args ...any) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+	for _, path := range sortedKeys(rs.Endpoints) {
+		endpoint := rs.Endpoints[path]
+		if endpoint.Rule == "tiers+endpoints" || endpoint.Rule == "user+ip" {
+			for _, name := range sortedKeys(rs.Tiers) {
+				// A burst below the cost is already an error
+				if tier := rs.Tiers[name]; tier.Burst == 0 && tier.EffectiveCapacity() < endpoint.Cost {
+					warn("endpoint '%s': cost %d exceeds tier '%s' capacity %d, so the tier's requests are always denied", path, endpoint.Cost, name, tier.EffectiveCapacity())
+				}
+			}
+		}
+		if endpoint.Rule != "user+ip" && endpoint.MaxCost > endpoint.GlobalCapacity && endpoint.GlobalCapacity > 0 {
+			warn("endpoint '%s': max_cost %d exceeds global_capacity %d, so requests costing more are always denied", path, endpoint.MaxCost, endpoint.GlobalCapacity)
+		}
+		if !endpoint.Limited() {
+			warn("endpoint '%s': limit_enabled is false, so its requests are never limited", path)
+		}
+		if endpoint.MatchMode == MatchPrefix {
+			if outer, ok := enclosingPrefix(rs, path); ok {
+				warn("endpoint '%s': prefix overlaps prefix endpoint '%s'; paths below '%s' use the longer one", path, outer, path)
+			}
+		}
+	}
+	return warnings
+}
+
+// enclosingPrefix finds the prefix endpoint that would match path if path
+// weren't configured itself.
+func enclosingPrefix(rs *RuleSet, path string) (string, bool) {
+	prefix := strings.TrimSuffix(path, "/")
+	for {
+		i := strings.LastIndexByte(prefix, '/')
+		if i < 0 {
+			return "", false
+		}
+		prefix = prefix[:i]
+		for _, key := range []string{prefix, prefix + "/"} {
+			if ep, ok := rs.Endpoints[key]; ok && ep.MatchMode == MatchPrefix && key != path {
+				return key, true
+			}
+		}
+		if prefix == "" {
+			return "", false
+		}
+	}
+}
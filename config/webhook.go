@@ -0,0 +1,62 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Webhook events.
+const (
+	// EventBan is sent when a key is penalized with a capacity_multiplier of
+	// 0, blocking it until the penalty ends
+	EventBan = "ban"
+	// EventHighDenialRate is sent when a key is penalized with a smaller
+	// bucket for being denied too often
+	EventHighDenialRate = "high_denial_rate"
+	// EventQuotaExceeded is sent when a check is denied because a quota or
+	// window cap has run out
+	EventQuotaExceeded = "quota_exceeded"
+)
+
+// WebhookEvents are the events Events may list.
+var WebhookEvents = []string{EventBan, EventHighDenialRate, EventQuotaExceeded}
+
+// WebhookConfig posts events operators may want alerting on, such as a key
+// being banned, to a URL. It is off while URL is empty.
+type WebhookConfig struct {
+	URL string `yaml:"url" json:"url,omitempty"`
+	// Secret signs each body with HMAC-SHA256 in an X-Signature-256 header,
+	// as GitHub does; unset sends no signature
+	Secret string   `yaml:"secret" json:"secret,omitempty"`
+	Events []string `yaml:"events" json:"events,omitempty"` // The events to send; empty sends all
+}
+
+// Enabled reports whether events are sent.
+func (c WebhookConfig) Enabled() bool {
+	return c.URL != ""
+}
+
+// Sends reports whether event is posted to the webhook.
+func (c WebhookConfig) Sends(event string) bool {
+	return c.Enabled() && (len(c.Events) == 0 || slices.Contains(c.Events, event))
+}
+
+func validateWebhook(c WebhookConfig) error {
+	var errs []error
+	if c.URL != "" {
+		if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("url '%s' must be an http or https URL", c.URL))
+		}
+	} else if c.Secret != "" || len(c.Events) > 0 {
+		errs = append(errs, errors.New("url is required when secret or events is set"))
+	}
+	for _, event := range c.Events {
+		if !slices.Contains(WebhookEvents, event) {
+			errs = append(errs, fmt.Errorf("unknown event '%s' (want %s)", event, strings.Join(WebhookEvents, ", ")))
+		}
+	}
+	return errors.Join(errs...)
+}
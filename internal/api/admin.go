@@ -0,0 +1,452 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// operatorContextKey is where AdminAuth stores the authenticated operator.
+const operatorContextKey = "operator"
+
+// AdminAuth guards admin routes with bearer tokens. tokens maps each token to
+// the operator it identifies; the operator name is recorded in audit logs.
+// A request without a bearer token gets a 401 and one with an unknown token
+// a 403. With no tokens at all every request gets a 503, so admin routes
+// are never left open by a missing setting.
+func AdminAuth(tokens map[string]string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(tokens) == 0 {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "admin API disabled"})
+			return
+		}
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "admin token required"})
+			return
+		}
+		for candidate, operator := range tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(candidate)) == 1 {
+				c.Set(operatorContextKey, operator)
+				c.Next()
+				return
+			}
+		}
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "invalid admin token"})
+	}
+}
+
+// AdminOperator is the operator name audit logs give the single token of
+// AdminAuthMiddleware.
+const AdminOperator = "admin"
+
+// AdminAuthMiddleware is AdminAuth for a single token, recorded in audit
+// logs as the operator "admin". An empty token disables the admin routes.
+func AdminAuthMiddleware(token string) gin.HandlerFunc {
+	if token == "" {
+		return AdminAuth(nil)
+	}
+	return AdminAuth(map[string]string{token: AdminOperator})
+}
+
+// ParseAdminTokens parses "operator:token" pairs separated by commas, e.g.
+// "alice:s3cret,bob:t0ken", into the token → operator map AdminAuth expects.
+func ParseAdminTokens(raw string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	for _, pair := range strings.Split(raw, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		operator, token, ok := strings.Cut(pair, ":")
+		if !ok || operator == "" || token == "" {
+			return nil, fmt.Errorf("admin token entry %q must be operator:token", pair)
+		}
+		if _, dup := tokens[token]; dup {
+			return nil, fmt.Errorf("admin token for %q is already assigned to another operator", operator)
+		}
+		tokens[token] = operator
+	}
+	return tokens, nil
+}
+
+type TopUpRequest struct {
+	Key           string `json:"key" binding:"required"`
+	Endpoint      string `json:"endpoint" binding:"required"`
+	UserTier      string `json:"user_tier" binding:"required"`
+	Amount        int64  `json:"amount" binding:"required,gt=0"`
+	AllowOverfill bool   `json:"allow_overfill,omitempty"` // Let the balance exceed capacity up to the tier's max_overfill
+	Namespace     string `json:"namespace,omitempty"`
+	// Metadata carries the endpoint's key_fields, which are part of the
+	// bucket's key as in checks
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+type TopUpResponse struct {
+	Balance    int64 `json:"balance"`
+	MaxBalance int64 `json:"maxBalance"`
+}
+
+// TopUpHandler grants bonus tokens to a user's bucket for a tiers+endpoints
+// endpoint, e.g. to compensate a customer after an outage. The top-up runs
+// atomically with concurrent checks.
+func (h *RateLimiterHandler) TopUpHandler(c *gin.Context) {
+	rules := h.Rules()
+	var req TopUpRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeBindError(c, err)
+		return
+	}
+
+	endpoint, ep, ok := rules.MatchEndpoint(req.Endpoint)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown endpoint"})
+		return
+	}
+	if ep.Rule != "tiers+endpoints" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "top-ups only apply to tiers+endpoints rules", "rule": ep.Rule})
+		return
+	}
+	tier, ok := rules.Tiers[req.UserTier]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":       "invalid user_tier",
+			"provided":    req.UserTier,
+			"valid_tiers": getValidTiers(rules.Tiers),
+		})
+		return
+	}
+	namespace := req.Namespace
+	if namespace == "" {
+		namespace = rules.Namespace
+	}
+	if !config.ValidNamespace(namespace) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid namespace"})
+		return
+	}
+
+	bucketKey, err := keyWithFields(req.Key, ep.KeyFields, req.Metadata)
+	if err != nil {
+		writeCheckError(c, err)
+		return
+	}
+
+	// Top up the bucket as checks see it right now
+	tier, _ = tier.Scheduled(h.clock(), rules.ScheduleLocation())
+	capacity := tier.EffectiveCapacity()
+	maxBalance := capacity
+	if req.AllowOverfill {
+		maxBalance += tier.MaxOverfill
+	}
+	userKey := namespacedKey(namespace, h.keys.TransformUserKey(bucketKey, endpoint, req.UserTier))
+	balance, err := h.storage.TopUpBucket(userKey, capacity, tier.RefillRate, req.Amount, maxBalance, bucketTTL(capacity, tier.RefillRate))
+	if err != nil {
+		log.Printf("❌ Top-up failed - key: %s, error: %v", userKey, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Rate limiter unavailable"})
+		return
+	}
+
+	log.Printf("📝 AUDIT top-up operator=%q key=%q endpoint=%q tier=%q namespace=%q amount=%d overfill=%v balance=%d",
+		c.GetString(operatorContextKey), req.Key, req.Endpoint, req.UserTier, namespace, req.Amount, req.AllowOverfill, balance)
+	c.JSON(http.StatusOK, TopUpResponse{Balance: balance, MaxBalance: maxBalance})
+}
+
+type SetBucketRequest struct {
+	// Key is a bucket key without the storage key prefix, e.g.
+	// "user:123:/api/upload:free" or "global:/api/upload"
+	Key    string `json:"key" binding:"required"`
+	Tokens *int64 `json:"tokens" binding:"required,gte=0"`
+	// TTLSeconds is the bucket's expiry. By default it has none until the
+	// next check sets the one it gives every bucket it charges
+	TTLSeconds int64 `json:"ttl_seconds,omitempty" binding:"gte=0"`
+}
+
+// SetBucketHandler sets a bucket to a given balance, so integration tests can
+// start from a known state instead of draining tokens one request at a time,
+// and migrated users can start where their old limiter left them.
+func (h *RateLimiterHandler) SetBucketHandler(c *gin.Context) {
+	var req SetBucketRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeBindError(c, err)
+		return
+	}
+	ttl := time.Duration(req.TTLSeconds) * time.Second
+	if err := h.storage.SetBucketTokens(req.Key, *req.Tokens, ttl); err != nil {
+		log.Printf("❌ Setting bucket failed - key: %s, error: %v", req.Key, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Rate limiter unavailable"})
+		return
+	}
+	log.Printf("📝 AUDIT set bucket operator=%q key=%q tokens=%d ttl=%v", c.GetString(operatorContextKey), req.Key, *req.Tokens, ttl)
+	c.JSON(http.StatusOK, gin.H{"key": req.Key, "tokens": *req.Tokens})
+}
+
+const (
+	defaultResetBatchSize = 500
+	maxResetBatchSize     = 10000
+	defaultResetBatchWait = 50 * time.Millisecond
+)
+
+type ResetBucketsRequest struct {
+	// Pattern is a Redis glob over bucket keys without the storage key
+	// prefix, e.g. "user:*:/api/upload:*"
+	Pattern      string `json:"pattern" binding:"required"`
+	Confirm      bool   `json:"confirm"`         // Must be true; guards against accidental resets
+	Force        bool   `json:"force,omitempty"` // Required for patterns that match every bucket
+	BatchSize    int    `json:"batch_size,omitempty"`
+	BatchDelayMs int64  `json:"batch_delay_ms,omitempty"`
+}
+
+// ResetBucketsHandler deletes every bucket matching a pattern, restoring
+// them to full capacity. Progress is streamed as one JSON object per line
+// ({"matched":n,"deleted":n}) after each batch, ending with a line that has
+// "done": true or "error".
+func (h *RateLimiterHandler) ResetBucketsHandler(c *gin.Context) {
+	var req ResetBucketsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeBindError(c, err)
+		return
+	}
+	if !req.Confirm {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bulk reset requires \"confirm\": true"})
+		return
+	}
+	if matchesEveryBucket(req.Pattern) && !req.Force {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "pattern matches every bucket; set \"force\": true to reset them all"})
+		return
+	}
+	if req.BatchSize < 0 || req.BatchSize > maxResetBatchSize || req.BatchDelayMs < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("batch_size must be 0-%d and batch_delay_ms non-negative", maxResetBatchSize)})
+		return
+	}
+
+	opts := storage.ResetOptions{BatchSize: defaultResetBatchSize, BatchDelay: defaultResetBatchWait}
+	if req.BatchSize > 0 {
+		opts.BatchSize = req.BatchSize
+	}
+	if req.BatchDelayMs > 0 {
+		opts.BatchDelay = time.Duration(req.BatchDelayMs) * time.Millisecond
+	}
+
+	operator := c.GetString(operatorContextKey)
+	log.Printf("📝 AUDIT bucket reset started operator=%q pattern=%q force=%v", operator, req.Pattern, req.Force)
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+	encoder := json.NewEncoder(c.Writer)
+	total, err := h.storage.ResetBuckets(c.Request.Context(), req.Pattern, opts, func(p storage.ResetProgress) {
+		encoder.Encode(p)
+		c.Writer.Flush()
+	})
+	if err != nil {
+		log.Printf("📝 AUDIT bucket reset failed operator=%q pattern=%q matched=%d deleted=%d error=%v", operator, req.Pattern, total.Matched, total.Deleted, err)
+		encoder.Encode(gin.H{"matched": total.Matched, "deleted": total.Deleted, "error": err.Error()})
+		return
+	}
+	log.Printf("📝 AUDIT bucket reset finished operator=%q pattern=%q matched=%d deleted=%d", operator, req.Pattern, total.Matched, total.Deleted)
+	encoder.Encode(gin.H{"matched": total.Matched, "deleted": total.Deleted, "done": true})
+}
+
+type PurgeKeysRequest struct {
+	// Pattern is a Redis glob over keys without the storage key prefix,
+	// e.g. "acme:*" for one namespace
+	Pattern string `json:"pattern" binding:"required"`
+	Confirm bool   `json:"confirm"`         // Must be true; guards against accidental purges
+	Force   bool   `json:"force,omitempty"` // Required for patterns that match every key
+}
+
+type PurgeKeysResponse struct {
+	Deleted int `json:"deleted"`
+}
+
+// PurgeKeysHandler deletes every rate limiter key matching a pattern in one
+// pass and reports how many were removed. Unlike ResetBucketsHandler it does
+// not pause between batches or stream progress, so it suits maintenance
+// windows and small key sets.
+func (h *RateLimiterHandler) PurgeKeysHandler(c *gin.Context) {
+	var req PurgeKeysRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeBindError(c, err)
+		return
+	}
+	if !req.Confirm {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "purge requires \"confirm\": true"})
+		return
+	}
+	if matchesEveryBucket(req.Pattern) && !req.Force {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "pattern matches every key; set \"force\": true to purge them all"})
+		return
+	}
+
+	operator := c.GetString(operatorContextKey)
+	deleted, err := h.storage.PurgeKeys(req.Pattern)
+	if err != nil {
+		log.Printf("📝 AUDIT purge failed operator=%q pattern=%q deleted=%d error=%v", operator, req.Pattern, deleted, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Rate limiter unavailable", "deleted": deleted})
+		return
+	}
+	log.Printf("📝 AUDIT purge operator=%q pattern=%q force=%v deleted=%d", operator, req.Pattern, req.Force, deleted)
+	c.JSON(http.StatusOK, PurgeKeysResponse{Deleted: deleted})
+}
+
+type SetTierRequest struct {
+	Key  string `json:"key" binding:"required"`
+	Tier string `json:"tier" binding:"required"`
+}
+
+type RemoveTierRequest struct {
+	Key string `json:"key" binding:"required"`
+}
+
+// SetTierHandler stores the tier a key is limited under when tier lookup is
+// enabled. Other instances pick the change up once their cache_ttl expires.
+func (h *RateLimiterHandler) SetTierHandler(c *gin.Context) {
+	rules := h.Rules()
+	var req SetTierRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeBindError(c, err)
+		return
+	}
+	if _, ok := rules.Tiers[req.Tier]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":       "invalid tier",
+			"provided":    req.Tier,
+			"valid_tiers": getValidTiers(rules.Tiers),
+		})
+		return
+	}
+	if err := h.storage.SetTier(req.Key, req.Tier); err != nil {
+		log.Printf("❌ Setting tier failed - key: %s, error: %v", req.Key, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Rate limiter unavailable"})
+		return
+	}
+	h.tierCache.Delete(req.Key)
+	log.Printf("📝 AUDIT set tier operator=%q key=%q tier=%q", c.GetString(operatorContextKey), req.Key, req.Tier)
+	c.JSON(http.StatusOK, gin.H{"key": req.Key, "tier": req.Tier})
+}
+
+// RemoveTierHandler deletes a key's stored tier, returning it to the
+// default tier.
+func (h *RateLimiterHandler) RemoveTierHandler(c *gin.Context) {
+	var req RemoveTierRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeBindError(c, err)
+		return
+	}
+	removed, err := h.storage.DeleteTier(req.Key)
+	if err != nil {
+		log.Printf("❌ Removing tier failed - key: %s, error: %v", req.Key, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Rate limiter unavailable"})
+		return
+	}
+	h.tierCache.Delete(req.Key)
+	log.Printf("📝 AUDIT remove tier operator=%q key=%q removed=%v", c.GetString(operatorContextKey), req.Key, removed)
+	c.JSON(http.StatusOK, gin.H{"key": req.Key, "removed": removed})
+}
+
+// bucketInvalidator is implemented by storage that caches buckets in
+// process, such as *storage.LocalCacheStorage, and can tell other instances
+// to drop a bucket.
+type bucketInvalidator interface {
+	PublishInvalidation(key string) error
+}
+
+// DeleteBucketHandler deletes one bucket, named by the path after
+// /admin/buckets/ without the storage key prefix, so it restarts at full
+// capacity. Instances caching buckets locally are told to evict it.
+func (h *RateLimiterHandler) DeleteBucketHandler(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	if key == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing bucket key"})
+		return
+	}
+	deleted, err := h.storage.DeleteBucket(key)
+	if err != nil {
+		log.Printf("❌ Deleting bucket failed - key: %s, error: %v", key, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Rate limiter unavailable"})
+		return
+	}
+	if invalidator, ok := h.storage.(bucketInvalidator); ok {
+		// The bucket is gone either way; other instances catch up when
+		// their cached estimate expires
+		if err := invalidator.PublishInvalidation(key); err != nil {
+			log.Printf("⚠️ Invalidating cached bucket failed - key: %s, error: %v", key, err)
+		}
+	}
+	log.Printf("📝 AUDIT delete bucket operator=%q key=%q deleted=%v", c.GetString(operatorContextKey), key, deleted)
+	c.JSON(http.StatusOK, gin.H{"key": key, "deleted": deleted})
+}
+
+// matchesEveryBucket reports whether pattern has no literal text beyond
+// wildcards and separators, e.g. "*" or "*:*", and so would reset everything.
+func matchesEveryBucket(pattern string) bool {
+	return strings.Trim(pattern, "*?:") == ""
+}
+
+const (
+	defaultTopConsumers = 10
+	maxTopConsumers     = 1000
+)
+
+type TopConsumersResponse struct {
+	Endpoint    string             `json:"endpoint"`
+	WindowStart time.Time          `json:"windowStart"`
+	WindowMs    int64              `json:"windowMs"`
+	Consumers   []storage.Consumer `json:"consumers"`
+}
+
+// TopConsumersHandler lists the keys that consumed the most of an endpoint's
+// global bucket in the current tracking window:
+// GET /admin/top?endpoint=/api/search&n=20. Only dual-bucket rules
+// (tiers+endpoints, IP+endpoints) are tracked.
+func (h *RateLimiterHandler) TopConsumersHandler(c *gin.Context) {
+	rules := h.Rules()
+	matched, ok := rules.FindEndpoint(c.Query("endpoint"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown endpoint", "endpoint": c.Query("endpoint")})
+		return
+	}
+	n := defaultTopConsumers
+	if raw := c.Query("n"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 1 || parsed > maxTopConsumers {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("n must be between 1 and %d", maxTopConsumers)})
+			return
+		}
+		n = parsed
+	}
+	namespace := c.Query("namespace")
+	if namespace == "" {
+		namespace = rules.Namespace
+	}
+	if !config.ValidNamespace(namespace) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid namespace"})
+		return
+	}
+
+	report, err := h.storage.TopConsumers(namespacedKey(namespace, h.keys.TransformGlobalKey(matched.BucketPath())), n)
+	if errors.Is(err, storage.ErrTopConsumersDisabled) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Top consumers failed - endpoint: %s, error: %v", matched.Path, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Rate limiter unavailable"})
+		return
+	}
+	c.JSON(http.StatusOK, TopConsumersResponse{
+		Endpoint:    matched.Path,
+		WindowStart: report.WindowStart,
+		WindowMs:    report.Window.Milliseconds(),
+		Consumers:   report.Consumers,
+	})
+}
@@ -0,0 +1,604 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/mock"
+)
+
+func adminRules() *config.RuleSet {
+	return &config.RuleSet{
+		Tiers: map[string]config.TierConfig{
+			"free": {Capacity: 100, RefillRate: 10, MaxOverfill: 400},
+		},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/upload": {Rule: "tiers+endpoints", Cost: 10, GlobalCapacity: 10000, GlobalRefillRate: 2000},
+			"/api/list":   {Rule: "endpoint", Cost: 10, GlobalCapacity: 10000, GlobalRefillRate: 1000},
+		},
+		IPs: config.IPConfig{Capacity: 500, RefillRate: 50},
+	}
+}
+
+func serveAdmin(handler *RateLimiterHandler, path, token string, body interface{}) *httptest.ResponseRecorder {
+	method := http.MethodPost
+	if body == nil {
+		method = http.MethodGet
+	}
+	return serveAdminMethod(handler, method, path, token, body)
+}
+
+func serveAdminMethod(handler *RateLimiterHandler, method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	admin := router.Group("/admin", AdminAuth(map[string]string{"s3cret": "alice"}))
+	admin.POST("/topup", handler.TopUpHandler)
+	admin.POST("/buckets/reset", handler.ResetBucketsHandler)
+	admin.DELETE("/buckets/*key", handler.DeleteBucketHandler)
+	admin.POST("/purge", handler.PurgeKeysHandler)
+	admin.POST("/set", handler.SetBucketHandler)
+	admin.POST("/simulate", handler.SimulateHandler)
+	admin.POST("/tiers/set", handler.SetTierHandler)
+	admin.POST("/tiers/remove", handler.RemoveTierHandler)
+	admin.GET("/top", handler.TopConsumersHandler)
+
+	payload, _ := json.Marshal(body)
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, bytes.NewBuffer(payload))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestTopUpHandler_Overfill(t *testing.T) {
+	tests := []struct {
+		name           string
+		allowOverfill  bool
+		wantMaxBalance int64
+	}{
+		{"clipped at capacity", false, 100},
+		{"overfill up to cap", true, 500},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage := new(MockRedisStorage)
+			mockStorage.On("TopUpBucket", "user:user123:/api/upload:free", int64(100), float64(10), int64(250), tt.wantMaxBalance, time.Hour).
+				Return(int64(100), nil)
+
+			w := serveAdmin(NewRateLimiterHandler(mockStorage, adminRules()), "/admin/topup", "s3cret", TopUpRequest{
+				Key: "user123", Endpoint: "/api/upload", UserTier: "free", Amount: 250, AllowOverfill: tt.allowOverfill,
+			})
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+			var resp TopUpResponse
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if resp.Balance != 100 || resp.MaxBalance != tt.wantMaxBalance {
+				t.Errorf("unexpected response: %+v", resp)
+			}
+			mockStorage.AssertExpectations(t)
+		})
+	}
+}
+
+func TestAdminAuthMiddleware(t *testing.T) {
+	tests := []struct {
+		name     string
+		token    string // Configured
+		header   string
+		want     int
+		operator string
+	}{
+		{name: "missing header", token: "s3cret", want: http.StatusUnauthorized},
+		{name: "not a bearer token", token: "s3cret", header: "Basic czNjcmV0", want: http.StatusUnauthorized},
+		{name: "wrong token", token: "s3cret", header: "Bearer guess", want: http.StatusForbidden},
+		{name: "correct token", token: "s3cret", header: "Bearer s3cret", want: http.StatusOK, operator: AdminOperator},
+		{name: "disabled", header: "Bearer ", want: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.GET("/admin/top", AdminAuthMiddleware(tt.token), func(c *gin.Context) {
+				c.String(http.StatusOK, c.GetString(operatorContextKey))
+			})
+			req := httptest.NewRequest(http.MethodGet, "/admin/top", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.want {
+				t.Fatalf("expected %d, got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+			if tt.want == http.StatusOK && w.Body.String() != tt.operator {
+				t.Errorf("expected operator %q, got %q", tt.operator, w.Body.String())
+			}
+			if tt.want == http.StatusServiceUnavailable && !strings.Contains(w.Body.String(), `"admin API disabled"`) {
+				t.Errorf("expected the admin API to report itself disabled, got %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestTopUpHandler_Errors(t *testing.T) {
+	tests := []struct {
+		name           string
+		token          string
+		body           TopUpRequest
+		storageErr     error
+		expectedStatus int
+	}{
+		{"missing token", "", TopUpRequest{Key: "u", Endpoint: "/api/upload", UserTier: "free", Amount: 10}, nil, http.StatusUnauthorized},
+		{"wrong token", "guess", TopUpRequest{Key: "u", Endpoint: "/api/upload", UserTier: "free", Amount: 10}, nil, http.StatusForbidden},
+		{"non-positive amount", "s3cret", TopUpRequest{Key: "u", Endpoint: "/api/upload", UserTier: "free", Amount: -5}, nil, http.StatusBadRequest},
+		{"unknown endpoint", "s3cret", TopUpRequest{Key: "u", Endpoint: "/api/nope", UserTier: "free", Amount: 10}, nil, http.StatusBadRequest},
+		{"rule without user bucket", "s3cret", TopUpRequest{Key: "u", Endpoint: "/api/list", UserTier: "free", Amount: 10}, nil, http.StatusBadRequest},
+		{"invalid tier", "s3cret", TopUpRequest{Key: "u", Endpoint: "/api/upload", UserTier: "gold", Amount: 10}, nil, http.StatusBadRequest},
+		{"storage failure", "s3cret", TopUpRequest{Key: "u", Endpoint: "/api/upload", UserTier: "free", Amount: 10}, errors.New("redis down"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage := new(MockRedisStorage)
+			mockStorage.On("TopUpBucket", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+				Return(int64(0), tt.storageErr)
+
+			w := serveAdmin(NewRateLimiterHandler(mockStorage, adminRules()), "/admin/topup", tt.token, tt.body)
+			if w.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+		})
+	}
+}
+
+func TestResetBucketsHandler_StreamsProgress(t *testing.T) {
+	mockStorage := new(MockRedisStorage)
+	mockStorage.On("ResetBuckets", "user:*:/api/upload:*", storage.ResetOptions{BatchSize: 100, BatchDelay: defaultResetBatchWait}).
+		Return(storage.ResetProgress{Matched: 3, Deleted: 3}, nil)
+
+	w := serveAdmin(NewRateLimiterHandler(mockStorage, adminRules()), "/admin/buckets/reset", "s3cret", ResetBucketsRequest{
+		Pattern: "user:*:/api/upload:*", Confirm: true, BatchSize: 100,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected a progress line and a final line, got %q", w.Body.String())
+	}
+	var final map[string]interface{}
+	json.Unmarshal([]byte(lines[1]), &final)
+	if final["done"] != true || final["deleted"] != float64(3) {
+		t.Errorf("unexpected final line: %s", lines[1])
+	}
+	mockStorage.AssertExpectations(t)
+}
+
+func TestResetBucketsHandler_Guards(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           ResetBucketsRequest
+		expectedStatus int
+	}{
+		{"missing confirm", ResetBucketsRequest{Pattern: "user:*"}, http.StatusBadRequest},
+		{"match-all without force", ResetBucketsRequest{Pattern: "*", Confirm: true}, http.StatusBadRequest},
+		{"wildcards only without force", ResetBucketsRequest{Pattern: "*:*", Confirm: true}, http.StatusBadRequest},
+		{"match-all with force", ResetBucketsRequest{Pattern: "*", Confirm: true, Force: true}, http.StatusOK},
+		{"batch too large", ResetBucketsRequest{Pattern: "user:*", Confirm: true, BatchSize: 1000000}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage := new(MockRedisStorage)
+			mockStorage.On("ResetBuckets", mock.Anything, mock.Anything).Return(storage.ResetProgress{}, nil)
+
+			w := serveAdmin(NewRateLimiterHandler(mockStorage, adminRules()), "/admin/buckets/reset", "s3cret", tt.body)
+			if w.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if tt.expectedStatus != http.StatusOK {
+				mockStorage.AssertNotCalled(t, "ResetBuckets", mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
+
+func TestPurgeKeysHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           PurgeKeysRequest
+		storageErr     error
+		expectedStatus int
+	}{
+		{"purges matching keys", PurgeKeysRequest{Pattern: "acme:*", Confirm: true}, nil, http.StatusOK},
+		{"missing confirm", PurgeKeysRequest{Pattern: "acme:*"}, nil, http.StatusBadRequest},
+		{"match-all without force", PurgeKeysRequest{Pattern: "*", Confirm: true}, nil, http.StatusBadRequest},
+		{"match-all with force", PurgeKeysRequest{Pattern: "*", Confirm: true, Force: true}, nil, http.StatusOK},
+		{"storage error", PurgeKeysRequest{Pattern: "acme:*", Confirm: true}, errors.New("connection refused"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage := new(MockRedisStorage)
+			mockStorage.On("PurgeKeys", tt.body.Pattern).Return(7, tt.storageErr)
+
+			w := serveAdmin(NewRateLimiterHandler(mockStorage, adminRules()), "/admin/purge", "s3cret", tt.body)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if tt.expectedStatus == http.StatusBadRequest {
+				mockStorage.AssertNotCalled(t, "PurgeKeys", mock.Anything)
+				return
+			}
+			if tt.expectedStatus == http.StatusOK {
+				var resp PurgeKeysResponse
+				json.Unmarshal(w.Body.Bytes(), &resp)
+				if resp.Deleted != 7 {
+					t.Errorf("expected 7 deleted, got %d", resp.Deleted)
+				}
+			}
+		})
+	}
+}
+
+func TestSetBucketHandler(t *testing.T) {
+	tokens := func(n int64) *int64 { return &n }
+	tests := []struct {
+		name           string
+		body           SetBucketRequest
+		storageErr     error
+		expectedStatus int
+		expectedTTL    time.Duration
+	}{
+		{"sets tokens", SetBucketRequest{Key: "user:1:/api/upload:free", Tokens: tokens(5)}, nil, http.StatusOK, 0},
+		{"empties a bucket", SetBucketRequest{Key: "global:/api/upload", Tokens: tokens(0), TTLSeconds: 60}, nil, http.StatusOK, time.Minute},
+		{"missing tokens", SetBucketRequest{Key: "global:/api/upload"}, nil, http.StatusBadRequest, 0},
+		{"negative tokens", SetBucketRequest{Key: "global:/api/upload", Tokens: tokens(-1)}, nil, http.StatusBadRequest, 0},
+		{"storage error", SetBucketRequest{Key: "global:/api/upload", Tokens: tokens(5)}, errors.New("connection refused"), http.StatusInternalServerError, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage := new(MockRedisStorage)
+			mockStorage.On("SetBucketTokens", tt.body.Key, mock.Anything, tt.expectedTTL).Return(tt.storageErr)
+
+			w := serveAdmin(NewRateLimiterHandler(mockStorage, adminRules()), "/admin/set", "s3cret", tt.body)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if tt.expectedStatus == http.StatusBadRequest {
+				mockStorage.AssertNotCalled(t, "SetBucketTokens", mock.Anything, mock.Anything, mock.Anything)
+				return
+			}
+			mockStorage.AssertCalled(t, "SetBucketTokens", tt.body.Key, *tt.body.Tokens, tt.expectedTTL)
+		})
+	}
+}
+
+// invalidatingStorage records the keys the delete handler asks to invalidate.
+type invalidatingStorage struct {
+	*MockRedisStorage
+	invalidated []string
+}
+
+func (s *invalidatingStorage) PublishInvalidation(key string) error {
+	s.invalidated = append(s.invalidated, key)
+	return nil
+}
+
+func TestDeleteBucketHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		path           string
+		deleted        bool
+		storageErr     error
+		expectedStatus int
+	}{
+		{"deletes a bucket", "/admin/buckets/user:1:/api/upload:free", true, nil, http.StatusOK},
+		{"missing bucket", "/admin/buckets/global:/api/list", false, nil, http.StatusOK},
+		{"missing key", "/admin/buckets/", false, nil, http.StatusBadRequest},
+		{"storage error", "/admin/buckets/global:/api/list", false, errors.New("connection refused"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := strings.TrimPrefix(tt.path, "/admin/buckets/")
+			mockStorage := &invalidatingStorage{MockRedisStorage: new(MockRedisStorage)}
+			mockStorage.On("DeleteBucket", key).Return(tt.deleted, tt.storageErr)
+
+			w := serveAdminMethod(NewRateLimiterHandler(mockStorage, adminRules()), http.MethodDelete, tt.path, "s3cret", nil)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if tt.expectedStatus != http.StatusOK {
+				if len(mockStorage.invalidated) != 0 {
+					t.Errorf("expected no invalidation, got %v", mockStorage.invalidated)
+				}
+				return
+			}
+			var resp struct {
+				Key     string `json:"key"`
+				Deleted bool   `json:"deleted"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if resp.Key != key || resp.Deleted != tt.deleted {
+				t.Errorf("expected key %s deleted=%v, got %+v", key, tt.deleted, resp)
+			}
+			if len(mockStorage.invalidated) != 1 || mockStorage.invalidated[0] != key {
+				t.Errorf("expected %s to be invalidated, got %v", key, mockStorage.invalidated)
+			}
+		})
+	}
+}
+
+func TestSimulateHandler_StricterRulesDeny(t *testing.T) {
+	live := storage.NewMemoryStorage()
+	handler := NewRateLimiterHandler(live, adminRules())
+	// u2 has already spent 90 of its 100 tokens under the current rules
+	for i := 0; i < 9; i++ {
+		if _, err := handler.Check(CheckRequest{Key: "u2", Endpoint: "/api/upload", UserTier: "free"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	stricter := adminRules()
+	stricter.Tiers["free"] = config.TierConfig{Capacity: 30, RefillRate: 0.001}
+	body := SimulateRequest{Rules: *stricter}
+	for i := 0; i < 4; i++ {
+		body.Requests = append(body.Requests, CheckRequest{Key: "u1", Endpoint: "/api/upload", UserTier: "free"})
+	}
+	body.Requests = append(body.Requests,
+		CheckRequest{Key: "u2", Endpoint: "/api/upload", UserTier: "free"},
+		CheckRequest{Key: "u2", Endpoint: "/api/upload", UserTier: "free"},
+		CheckRequest{Key: "u1", Endpoint: "/api/list"},
+		CheckRequest{Key: "u1", Endpoint: "/api/missing"},
+	)
+
+	w := serveAdmin(handler, "/admin/simulate", "s3cret", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var results []SimulateResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	expected := []struct {
+		allowed   bool
+		remaining int64
+		rulePath  string
+		err       string
+	}{
+		{true, 20, "/api/upload", ""},
+		{true, 10, "/api/upload", ""},
+		{true, 0, "/api/upload", ""},
+		{false, 0, "/api/upload", ""},
+		{true, 0, "/api/upload", ""}, // Starts from its live balance of 10
+		{false, 0, "/api/upload", ""},
+		{true, 9990, "/api/list", ""},
+		{false, 0, "", "unknown endpoint"},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results, got %d", len(expected), len(results))
+	}
+	for i, want := range expected {
+		got := results[i]
+		if got.Allowed != want.allowed || got.RemainingTokens != want.remaining || got.RulePath != want.rulePath || got.Error != want.err {
+			t.Errorf("result %d: expected %+v, got %+v", i, want, got)
+		}
+		if got.Request.Key != body.Requests[i].Key {
+			t.Errorf("result %d: expected the request echoed, got %+v", i, got.Request)
+		}
+	}
+
+	// The live buckets are untouched
+	resp, err := handler.Check(CheckRequest{Key: "u1", Endpoint: "/api/upload", UserTier: "free"})
+	if err != nil || resp.UserRemaining != 90 {
+		t.Errorf("expected u1's live bucket to be full before this check, got %+v, %v", resp, err)
+	}
+}
+
+func TestSimulateHandler_SeedsFromRedis(t *testing.T) {
+	server := miniredis.RunT(t)
+	live, err := storage.NewRedisStorageWithOptions(server.Addr(), "", 0, storage.DefaultRedisOptions())
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+	defer live.Close()
+	// Refills are too slow to add a token while the test runs
+	slowRules := func() *config.RuleSet {
+		rules := adminRules()
+		rules.Tiers["free"] = config.TierConfig{Capacity: 100, RefillRate: 0.001}
+		rules.Endpoints["/api/upload"] = config.EndpointConfig{Rule: "tiers+endpoints", Cost: 10, GlobalCapacity: 10000, GlobalRefillRate: 0.001}
+		rules.Endpoints["/api/list"] = config.EndpointConfig{Rule: "endpoint", Cost: 10, GlobalCapacity: 10000, GlobalRefillRate: 0.001}
+		return rules
+	}
+	handler := NewRateLimiterHandler(live, slowRules())
+	// u2 has already spent 90 of its 100 tokens, and /api/list 20 of its 10000
+	for i := 0; i < 9; i++ {
+		if _, err := handler.Check(CheckRequest{Key: "u2", Endpoint: "/api/upload", UserTier: "free"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := handler.Check(CheckRequest{Key: "u2", Endpoint: "/api/list"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	stricter := slowRules()
+	stricter.Tiers["free"] = config.TierConfig{Capacity: 30, RefillRate: 0.001}
+	body := SimulateRequest{Rules: *stricter, Requests: []CheckRequest{
+		{Key: "u1", Endpoint: "/api/upload", UserTier: "free"},
+		{Key: "u2", Endpoint: "/api/upload", UserTier: "free"},
+		{Key: "u2", Endpoint: "/api/upload", UserTier: "free"},
+		{Key: "u1", Endpoint: "/api/list"},
+	}}
+	w := serveAdmin(handler, "/admin/simulate", "s3cret", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var results []SimulateResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	expected := []struct {
+		allowed   bool
+		remaining int64
+	}{
+		{true, 20},   // u1 has no live bucket, so starts full
+		{true, 0},    // u2 starts from its live balance of 10
+		{false, 0},   //
+		{true, 9970}, // The endpoint bucket starts from 9980
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results, got %d: %s", len(expected), len(results), w.Body.String())
+	}
+	for i, want := range expected {
+		if got := results[i]; got.Allowed != want.allowed || got.RemainingTokens != want.remaining {
+			t.Errorf("result %d: expected %+v, got %+v", i, want, got)
+		}
+	}
+
+	// Reading the live buckets neither charged nor created them
+	resp, err := handler.Check(CheckRequest{Key: "u2", Endpoint: "/api/upload", UserTier: "free"})
+	if err != nil || !resp.Allowed || resp.UserRemaining != 0 {
+		t.Errorf("expected u2's live balance of 10 to be untouched, got %+v, %v", resp, err)
+	}
+	if !server.Exists("rate_limit:bucket:user:u2:/api/upload:free") || server.Exists("rate_limit:bucket:user:u1:/api/upload:free") {
+		t.Error("expected u1's live bucket not to be created")
+	}
+}
+
+func TestSimulateHandler_Rejects(t *testing.T) {
+	invalid := adminRules()
+	invalid.Tiers["free"] = config.TierConfig{Capacity: -1, RefillRate: 1}
+	tooMany := SimulateRequest{Rules: *adminRules()}
+	for i := 0; i <= maxSimulateRequests; i++ {
+		tooMany.Requests = append(tooMany.Requests, CheckRequest{Key: "u1", Endpoint: "/api/list"})
+	}
+
+	tests := []struct {
+		name string
+		body SimulateRequest
+	}{
+		{"invalid rules", SimulateRequest{Rules: *invalid, Requests: []CheckRequest{{Key: "u1", Endpoint: "/api/upload"}}}},
+		{"missing requests", SimulateRequest{Rules: *adminRules()}},
+		{"request without key", SimulateRequest{Rules: *adminRules(), Requests: []CheckRequest{{Endpoint: "/api/list"}}}},
+		{"too many requests", tooMany},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Any storage call would fail the test: the mock has no expectations
+			w := serveAdmin(NewRateLimiterHandler(new(MockRedisStorage), adminRules()), "/admin/simulate", "s3cret", tt.body)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected 400, got %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+
+	// Field errors say which request is missing what
+	body := SimulateRequest{Rules: *adminRules(), Requests: []CheckRequest{{Key: "u1", Endpoint: "/api/list"}, {Endpoint: "/api/list"}}}
+	w := serveAdmin(NewRateLimiterHandler(new(MockRedisStorage), adminRules()), "/admin/simulate", "s3cret", body)
+	if !strings.Contains(w.Body.String(), `"fields":{"requests[1].key":"required"}`) {
+		t.Errorf("expected the missing key to be named by position, got %s", w.Body.String())
+	}
+}
+
+func TestSimulateHandler_Fast(t *testing.T) {
+	body := SimulateRequest{Rules: *adminRules()}
+	for i := 0; i < maxSimulateRequests; i++ {
+		body.Requests = append(body.Requests, CheckRequest{Key: fmt.Sprintf("u%d", i%50), Endpoint: "/api/upload", UserTier: "free"})
+	}
+	start := time.Now()
+	w := serveAdmin(NewRateLimiterHandler(new(MockRedisStorage), adminRules()), "/admin/simulate", "s3cret", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected %d requests to simulate quickly, took %v", maxSimulateRequests, elapsed)
+	}
+}
+
+func TestTopConsumersHandler(t *testing.T) {
+	mockStorage := new(MockRedisStorage)
+	mockStorage.On("TopConsumers", "global:/api/upload", 20).Return(storage.TopConsumersReport{
+		WindowStart: time.UnixMilli(1700000040000),
+		Window:      time.Minute,
+		Consumers:   []storage.Consumer{{Key: "user:heavy:/api/upload:free", Tokens: 900}},
+	}, nil)
+
+	w := serveAdmin(NewRateLimiterHandler(mockStorage, adminRules()), "/admin/top?endpoint=/api/upload&n=20", "s3cret", nil)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp TopConsumersResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.WindowMs != 60000 || len(resp.Consumers) != 1 || resp.Consumers[0].Tokens != 900 {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+	mockStorage.AssertExpectations(t)
+}
+
+func TestTopConsumersHandler_Errors(t *testing.T) {
+	tests := []struct {
+		name           string
+		path           string
+		storageErr     error
+		expectedStatus int
+	}{
+		{"unknown endpoint", "/admin/top?endpoint=/api/nope", nil, http.StatusBadRequest},
+		{"invalid n", "/admin/top?endpoint=/api/upload&n=0", nil, http.StatusBadRequest},
+		{"tracking disabled", "/admin/top?endpoint=/api/upload", storage.ErrTopConsumersDisabled, http.StatusNotFound},
+		{"storage failure", "/admin/top?endpoint=/api/upload", errors.New("redis down"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage := new(MockRedisStorage)
+			mockStorage.On("TopConsumers", mock.Anything, mock.Anything).Return(storage.TopConsumersReport{}, tt.storageErr)
+
+			w := serveAdmin(NewRateLimiterHandler(mockStorage, adminRules()), tt.path, "s3cret", nil)
+			if w.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+		})
+	}
+}
+
+func TestParseAdminTokens(t *testing.T) {
+	tokens, err := ParseAdminTokens("alice:s3cret, bob:t0ken")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tokens["s3cret"] != "alice" || tokens["t0ken"] != "bob" {
+		t.Errorf("unexpected tokens: %v", tokens)
+	}
+
+	for _, raw := range []string{"alice", "alice:", ":s3cret", "alice:same,bob:same"} {
+		if _, err := ParseAdminTokens(raw); err == nil {
+			t.Errorf("expected error for %q", raw)
+		}
+	}
+}
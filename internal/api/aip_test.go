@@ -2,6 +2,7 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
@@ -9,12 +10,16 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/AndySung320/rate-limiter/config"
 	"github.com/AndySung320/rate-limiter/internal/storage"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/mock"
 )
 
@@ -23,14 +28,123 @@ type MockRedisStorage struct {
 	mock.Mock
 }
 
-func (m *MockRedisStorage) AtomicTokenBucket(key string, capacity, refillRate int64, cost int64, ttl time.Duration) (bool, int64, error) {
+func (m *MockRedisStorage) AtomicTokenBucket(key string, capacity int64, refillRate float64, cost int64, ttl time.Duration) (storage.BucketResult, error) {
 	args := m.Called(key, capacity, refillRate, cost, ttl)
-	return args.Bool(0), args.Get(1).(int64), args.Error(2)
+	return args.Get(0).(storage.BucketResult), args.Error(1)
 }
 
-func (m *MockRedisStorage) AtomicDualBucket(userKey, globalKey string, globalCap, globalRate, userCap, userRate int64, cost int64, ttl time.Duration) (bool, int64, int64, error) {
-	args := m.Called(userKey, globalKey, globalCap, globalRate, userCap, userRate, cost, ttl)
-	return args.Bool(0), args.Get(1).(int64), args.Get(2).(int64), args.Error(3)
+func (m *MockRedisStorage) AtomicDualBucket(userKey, globalKey string, globalCap int64, globalRate float64, userCap int64, userRate float64, userMaxDebt, cost int64, ttl time.Duration) (storage.BucketResult, error) {
+	args := m.Called(userKey, globalKey, globalCap, globalRate, userCap, userRate, userMaxDebt, cost, ttl)
+	return args.Get(0).(storage.BucketResult), args.Error(1)
+}
+
+func (m *MockRedisStorage) AtomicMultiBucket(userKey, globalKey string, globalCap int64, globalRate float64, userCap int64, userRate float64, userMaxDebt, cost int64, resources []storage.ResourceBucket, ttl time.Duration) (storage.BucketResult, error) {
+	args := m.Called(userKey, globalKey, globalCap, globalRate, userCap, userRate, userMaxDebt, cost, resources, ttl)
+	return args.Get(0).(storage.BucketResult), args.Error(1)
+}
+
+func (m *MockRedisStorage) AtomicQuotaBucket(userKey, globalKey string, globalCap int64, globalRate float64, userCap int64, userRate float64, userMaxDebt, cost int64, quotas []storage.Quota, ttl time.Duration) (storage.BucketResult, error) {
+	args := m.Called(userKey, globalKey, globalCap, globalRate, userCap, userRate, userMaxDebt, cost, quotas, ttl)
+	return args.Get(0).(storage.BucketResult), args.Error(1)
+}
+
+func (m *MockRedisStorage) AtomicInitialBucket(userKey, globalKey string, globalCap int64, globalRate float64, globalInitial int64, userCap int64, userRate float64, userInitial int64, userMaxDebt, cost int64, ttl time.Duration) (storage.BucketResult, error) {
+	args := m.Called(userKey, globalKey, globalCap, globalRate, globalInitial, userCap, userRate, userInitial, userMaxDebt, cost, ttl)
+	return args.Get(0).(storage.BucketResult), args.Error(1)
+}
+
+func (m *MockRedisStorage) ReserveTokenBucket(id string, hold time.Duration, key string, capacity int64, refillRate float64, cost int64, ttl time.Duration) (storage.BucketResult, error) {
+	args := m.Called(id, hold, key, capacity, refillRate, cost, ttl)
+	return args.Get(0).(storage.BucketResult), args.Error(1)
+}
+
+func (m *MockRedisStorage) ReserveDualBucket(id string, hold time.Duration, userKey, globalKey string, globalCap int64, globalRate float64, userCap int64, userRate float64, userMaxDebt, cost int64, ttl time.Duration) (storage.BucketResult, error) {
+	args := m.Called(id, hold, userKey, globalKey, globalCap, globalRate, userCap, userRate, userMaxDebt, cost, ttl)
+	return args.Get(0).(storage.BucketResult), args.Error(1)
+}
+
+func (m *MockRedisStorage) CommitReservation(id string) (bool, error) {
+	args := m.Called(id)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockRedisStorage) ReleaseReservation(id string) (bool, error) {
+	args := m.Called(id)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockRedisStorage) PenaltyStatus(key string) (time.Time, error) {
+	args := m.Called(key)
+	return args.Get(0).(time.Time), args.Error(1)
+}
+
+func (m *MockRedisStorage) RecordDenial(key string, threshold int64, window, duration time.Duration) (time.Time, error) {
+	args := m.Called(key, threshold, window, duration)
+	return args.Get(0).(time.Time), args.Error(1)
+}
+
+func (m *MockRedisStorage) LookupTier(key string) (string, error) {
+	args := m.Called(key)
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockRedisStorage) SetTier(key, tier string) error {
+	args := m.Called(key, tier)
+	return args.Error(0)
+}
+
+func (m *MockRedisStorage) DeleteTier(key string) (bool, error) {
+	args := m.Called(key)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockRedisStorage) TopUpBucket(key string, capacity int64, refillRate float64, amount, maxBalance int64, ttl time.Duration) (int64, error) {
+	args := m.Called(key, capacity, refillRate, amount, maxBalance, ttl)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *MockRedisStorage) ResetBuckets(ctx context.Context, pattern string, opts storage.ResetOptions, progress func(storage.ResetProgress)) (storage.ResetProgress, error) {
+	args := m.Called(pattern, opts)
+	total := args.Get(0).(storage.ResetProgress)
+	if progress != nil {
+		progress(total)
+	}
+	return total, args.Error(1)
+}
+
+func (m *MockRedisStorage) RefundTokens(key string, cost int64, ttl time.Duration) error {
+	args := m.Called(key, cost, ttl)
+	return args.Error(0)
+}
+
+func (m *MockRedisStorage) SetBucketTokens(key string, tokens int64, ttl time.Duration) error {
+	args := m.Called(key, tokens, ttl)
+	return args.Error(0)
+}
+
+func (m *MockRedisStorage) DeleteBucket(key string) (bool, error) {
+	args := m.Called(key)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockRedisStorage) AtomicUserIPBucket(userKey, ipKey string, userCap int64, userRate float64, userMaxDebt int64, ipCap int64, ipRate float64, cost int64, ttl time.Duration) (storage.BucketResult, error) {
+	args := m.Called(userKey, ipKey, userCap, userRate, userMaxDebt, ipCap, ipRate, cost, ttl)
+	return args.Get(0).(storage.BucketResult), args.Error(1)
+}
+
+func (m *MockRedisStorage) PurgeKeys(pattern string) (int, error) {
+	args := m.Called(pattern)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockRedisStorage) TopConsumers(globalKey string, n int) (storage.TopConsumersReport, error) {
+	args := m.Called(globalKey, n)
+	return args.Get(0).(storage.TopConsumersReport), args.Error(1)
+}
+
+func (m *MockRedisStorage) PoolStats() storage.RedisPoolStats {
+	args := m.Called()
+	return args.Get(0).(storage.RedisPoolStats)
 }
 
 func (m *MockRedisStorage) Ping() error {
@@ -77,8 +191,8 @@ func TestTierValidation(t *testing.T) {
 		mock.Anything, mock.Anything,
 		mock.Anything, mock.Anything,
 		mock.Anything, mock.Anything,
-		mock.Anything, mock.Anything,
-	).Return(true, int64(90), int64(9990), nil)
+		mock.Anything, mock.Anything, mock.Anything,
+	).Return(storage.BucketResult{Allowed: true, Remaining: 90, GlobalRemaining: 9990}, nil)
 
 	handler := NewRateLimiterHandler(mockStorage, mockRules)
 
@@ -145,7 +259,7 @@ func TestTierValidation(t *testing.T) {
 				UserTier: "free",
 			},
 			expectedStatus: http.StatusBadRequest,
-			expectedError:  "", // Gin validation error
+			expectedError:  "validation_failed",
 		},
 	}
 
@@ -195,6 +309,56 @@ func TestTierValidation(t *testing.T) {
 	}
 }
 
+func TestCheckHandler_ValidationErrors(t *testing.T) {
+	mockRules := &config.RuleSet{
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/list": {Rule: "endpoint", Cost: 1, GlobalCapacity: 100, GlobalRefillRate: 10},
+		},
+	}
+	tests := []struct {
+		name       string
+		body       string
+		wantFields map[string]any
+		wantError  string
+	}{
+		{"missing key", `{"endpoint": "/api/list"}`, map[string]any{"key": "required"}, "validation_failed"},
+		{"missing endpoint", `{"key": "user123"}`, map[string]any{"endpoint": "required"}, "validation_failed"},
+		{"missing both", `{}`, map[string]any{"key": "required", "endpoint": "required"}, "validation_failed"},
+		{"malformed JSON", `{"key": `, nil, "unexpected EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage := new(MockRedisStorage)
+			handler := NewRateLimiterHandler(mockStorage, mockRules)
+
+			gin.SetMode(gin.TestMode)
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request, _ = http.NewRequest(http.MethodPost, "/check", bytes.NewBufferString(tt.body))
+			c.Request.Header.Set("Content-Type", "application/json")
+
+			handler.CheckHandler(c)
+
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body.String())
+			}
+			var response map[string]any
+			json.Unmarshal(w.Body.Bytes(), &response)
+			if response["error"] != tt.wantError {
+				t.Errorf("expected error %q, got %v", tt.wantError, response["error"])
+			}
+			if tt.wantFields != nil {
+				if !reflect.DeepEqual(response["fields"], tt.wantFields) {
+					t.Errorf("expected fields %v, got %v", tt.wantFields, response["fields"])
+				}
+			} else if _, ok := response["fields"]; ok {
+				t.Errorf("expected no fields for a decoding error, got %v", response["fields"])
+			}
+			mockStorage.AssertNotCalled(t, "AtomicTokenBucket", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+		})
+	}
+}
+
 func contains(s, substr string) bool {
 	return len(s) >= len(substr) && s[:len(substr)] == substr
 }
@@ -300,8 +464,8 @@ func TestCheckHandler_StatusCodes(t *testing.T) {
 				mock.Anything, mock.Anything,
 				mock.Anything, mock.Anything,
 				mock.Anything, mock.Anything,
-				mock.Anything, mock.Anything,
-			).Return(tt.allowed, int64(90), int64(9990), tt.err)
+				mock.Anything, mock.Anything, mock.Anything,
+			).Return(storage.BucketResult{Allowed: tt.allowed, Remaining: 90, GlobalRemaining: 9990}, tt.err)
 
 			mockStorage.On("Ping").Return(nil)
 			mockStorage.On("Close").Return(nil)
@@ -329,6 +493,731 @@ func TestCheckHandler_StatusCodes(t *testing.T) {
 	}
 }
 
+func TestCheckHandler_DryRun(t *testing.T) {
+	mockRules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{
+			"free": {Capacity: 100, RefillRate: 10},
+		},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/upload": {
+				Rule:             "tiers+endpoints",
+				Cost:             10,
+				GlobalCapacity:   10000,
+				GlobalRefillRate: 2000,
+				DryRun:           true,
+			},
+			"/api/list": {
+				Rule:             "endpoint",
+				Cost:             10,
+				GlobalCapacity:   10000,
+				GlobalRefillRate: 1000,
+				DryRun:           true,
+			},
+		},
+	}
+
+	tests := []struct {
+		name          string
+		request       CheckRequest
+		result        storage.BucketResult
+		wantWouldDeny bool
+	}{
+		{
+			name:          "empty user bucket is not denied",
+			request:       CheckRequest{Key: "user123", Endpoint: "/api/upload", UserTier: "free"},
+			result:        storage.BucketResult{Allowed: false, Remaining: 0, GlobalRemaining: 9990, RetryAfter: time.Second},
+			wantWouldDeny: true,
+		},
+		{
+			name:          "empty endpoint bucket is not denied",
+			request:       CheckRequest{Key: "user123", Endpoint: "/api/list"},
+			result:        storage.BucketResult{Allowed: false, Remaining: 0, RetryAfter: time.Second},
+			wantWouldDeny: true,
+		},
+		{
+			name:          "allowed request is not flagged",
+			request:       CheckRequest{Key: "user123", Endpoint: "/api/upload", UserTier: "free"},
+			result:        storage.BucketResult{Allowed: true, Remaining: 90, GlobalRemaining: 9990},
+			wantWouldDeny: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage := new(MockRedisStorage)
+			mockStorage.On("AtomicDualBucket",
+				mock.Anything, mock.Anything,
+				mock.Anything, mock.Anything,
+				mock.Anything, mock.Anything,
+				mock.Anything, mock.Anything, mock.Anything,
+			).Return(tt.result, nil)
+			mockStorage.On("AtomicTokenBucket",
+				mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+			).Return(tt.result, nil)
+
+			handler := NewRateLimiterHandler(mockStorage, mockRules)
+
+			gin.SetMode(gin.TestMode)
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			body, _ := json.Marshal(tt.request)
+			c.Request, _ = http.NewRequest(http.MethodPost, "/check", bytes.NewBuffer(body))
+			c.Request.Header.Set("Content-Type", "application/json")
+
+			handler.CheckHandler(c)
+
+			if w.Code != http.StatusOK {
+				t.Errorf("expected status 200, got %d", w.Code)
+			}
+			var response CheckResponse
+			json.Unmarshal(w.Body.Bytes(), &response)
+			if !response.Allowed {
+				t.Error("expected dry-run response to be allowed")
+			}
+			if response.WouldDeny != tt.wantWouldDeny {
+				t.Errorf("expected wouldDeny=%v, got %v", tt.wantWouldDeny, response.WouldDeny)
+			}
+			if response.UserRemaining+response.GlobalRemaining != tt.result.Remaining+tt.result.GlobalRemaining {
+				t.Errorf("expected real remaining counts, got user=%d global=%d", response.UserRemaining, response.GlobalRemaining)
+			}
+		})
+	}
+}
+
+func TestCheckHandler_ShadowMode(t *testing.T) {
+	mockRules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{
+			"free": {Capacity: 100, RefillRate: 10},
+		},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/shadow": {Rule: "tiers+endpoints", Cost: 10, GlobalCapacity: 10000, GlobalRefillRate: 2000},
+		},
+		// Shadow denials must not count towards a penalty
+		Penalty: config.PenaltyConfig{Threshold: 1, Window: time.Minute, Duration: time.Minute},
+	}
+
+	tests := []struct {
+		name             string
+		result           storage.BucketResult
+		wantShadowDenied bool
+	}{
+		{"denied request is allowed", storage.BucketResult{Allowed: false, Remaining: 0, GlobalRemaining: 9990, RetryAfter: time.Second}, true},
+		{"allowed request is not flagged", storage.BucketResult{Allowed: true, Remaining: 90, GlobalRemaining: 9990}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage := new(MockRedisStorage)
+			mockStorage.On("PenaltyStatus", "user:user123:/api/shadow:free").Return(time.Time{}, nil)
+			mockStorage.On("AtomicDualBucket",
+				mock.Anything, mock.Anything,
+				mock.Anything, mock.Anything,
+				mock.Anything, mock.Anything,
+				mock.Anything, mock.Anything, mock.Anything,
+			).Return(tt.result, nil)
+			handler := NewRateLimiterHandlerWithOptions(mockStorage, mockRules, HandlerOptions{ShadowMode: true})
+			before := testutil.ToFloat64(shadowDeniedTotal.WithLabelValues("/api/shadow", "free"))
+
+			gin.SetMode(gin.TestMode)
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			body, _ := json.Marshal(CheckRequest{Key: "user123", Endpoint: "/api/shadow", UserTier: "free"})
+			c.Request, _ = http.NewRequest(http.MethodPost, "/check", bytes.NewBuffer(body))
+			c.Request.Header.Set("Content-Type", "application/json")
+
+			handler.CheckHandler(c)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+			var response map[string]any
+			json.Unmarshal(w.Body.Bytes(), &response)
+			if response["allowed"] != true {
+				t.Errorf("expected allowed=true, got %v", response["allowed"])
+			}
+			if shadowDenied, _ := response["shadow_denied"].(bool); shadowDenied != tt.wantShadowDenied {
+				t.Errorf("expected shadow_denied=%v, got %v", tt.wantShadowDenied, response["shadow_denied"])
+			}
+			counted := testutil.ToFloat64(shadowDeniedTotal.WithLabelValues("/api/shadow", "free")) - before
+			if want := map[bool]float64{true: 1, false: 0}[tt.wantShadowDenied]; counted != want {
+				t.Errorf("expected the shadow denied counter to grow by %v, got %v", want, counted)
+			}
+			mockStorage.AssertNotCalled(t, "RecordDenial", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestCheckHandler_CostOverride(t *testing.T) {
+	mockRules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{
+			"free": {Capacity: 100000, RefillRate: 1000},
+		},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/upload": {
+				Rule:             "tiers+endpoints",
+				Cost:             10,
+				MaxCost:          50000,
+				GlobalCapacity:   1000000,
+				GlobalRefillRate: 20000,
+			},
+			"/api/list": {
+				Rule:             "endpoint",
+				Cost:             10,
+				GlobalCapacity:   10000,
+				GlobalRefillRate: 1000,
+			},
+		},
+	}
+
+	tests := []struct {
+		name           string
+		request        CheckRequest
+		costHeader     string
+		wantCost       int64 // Cost passed to storage; 0 when storage must not be called
+		expectedStatus int
+	}{
+		{"cost override", CheckRequest{Key: "user123", Endpoint: "/api/upload", UserTier: "free", Cost: 4096}, "", 4096, http.StatusOK},
+		{"zero cost uses endpoint cost", CheckRequest{Key: "user123", Endpoint: "/api/upload", UserTier: "free"}, "", 10, http.StatusOK},
+		{"cost at max", CheckRequest{Key: "user123", Endpoint: "/api/upload", UserTier: "free", Cost: 50000}, "", 50000, http.StatusOK},
+		{"cost exceeding max", CheckRequest{Key: "user123", Endpoint: "/api/upload", UserTier: "free", Cost: 50001}, "", 0, http.StatusBadRequest},
+		{"negative cost", CheckRequest{Key: "user123", Endpoint: "/api/upload", UserTier: "free", Cost: -1}, "", 0, http.StatusBadRequest},
+		{"no max cost accepts any cost", CheckRequest{Key: "user123", Endpoint: "/api/list", Cost: 999999}, "", 999999, http.StatusOK},
+		{"cost header", CheckRequest{Key: "user123", Endpoint: "/api/upload", UserTier: "free"}, "2048", 2048, http.StatusOK},
+		{"body cost wins over the header", CheckRequest{Key: "user123", Endpoint: "/api/upload", UserTier: "free", Cost: 4096}, "2048", 4096, http.StatusOK},
+		{"cost header exceeding max", CheckRequest{Key: "user123", Endpoint: "/api/upload", UserTier: "free"}, "50001", 0, http.StatusBadRequest},
+		{"zero cost header", CheckRequest{Key: "user123", Endpoint: "/api/upload", UserTier: "free"}, "0", 0, http.StatusBadRequest},
+		{"non-numeric cost header", CheckRequest{Key: "user123", Endpoint: "/api/upload", UserTier: "free"}, "lots", 0, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage := new(MockRedisStorage)
+			mockStorage.On("AtomicDualBucket",
+				mock.Anything, mock.Anything,
+				mock.Anything, mock.Anything,
+				mock.Anything, mock.Anything,
+				mock.Anything, tt.wantCost, mock.Anything,
+			).Return(storage.BucketResult{Allowed: true}, nil)
+			mockStorage.On("AtomicTokenBucket",
+				mock.Anything, mock.Anything, mock.Anything, tt.wantCost, mock.Anything,
+			).Return(storage.BucketResult{Allowed: true}, nil)
+
+			handler := NewRateLimiterHandler(mockStorage, mockRules)
+
+			gin.SetMode(gin.TestMode)
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			body, _ := json.Marshal(tt.request)
+			c.Request, _ = http.NewRequest(http.MethodPost, "/check", bytes.NewBuffer(body))
+			c.Request.Header.Set("Content-Type", "application/json")
+			if tt.costHeader != "" {
+				c.Request.Header.Set(CostHeader, tt.costHeader)
+			}
+
+			handler.CheckHandler(c)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if tt.wantCost == 0 {
+				mockStorage.AssertNotCalled(t, "AtomicDualBucket", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+				mockStorage.AssertNotCalled(t, "AtomicTokenBucket", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+				return
+			}
+			if len(mockStorage.Calls) != 1 {
+				t.Errorf("expected one storage call with cost %d, got %d calls", tt.wantCost, len(mockStorage.Calls))
+			}
+		})
+	}
+}
+
+func TestCheck_MaxDebt(t *testing.T) {
+	mockRules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{
+			"free": {Capacity: 100, RefillRate: 10, MaxDebt: 20},
+		},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/checkout": {Rule: "tiers+endpoints", Cost: 10, GlobalCapacity: 10000, GlobalRefillRate: 1000},
+			"/api/ping":     {Rule: "IP+endpoints", Cost: 1, GlobalCapacity: 10000, GlobalRefillRate: 1000},
+		},
+		IPs: config.IPConfig{Capacity: 500, RefillRate: 50},
+	}
+
+	tests := []struct {
+		name         string
+		request      CheckRequest
+		wantMaxDebt  int64
+		result       storage.BucketResult
+		wantInDebt   bool
+		wantUserLeft int64
+	}{
+		{"borrowing", CheckRequest{Key: "user123", Endpoint: "/api/checkout", UserTier: "free"}, 20,
+			storage.BucketResult{Allowed: true, Remaining: -5, GlobalRemaining: 9990}, true, -5},
+		{"not in debt", CheckRequest{Key: "user123", Endpoint: "/api/checkout", UserTier: "free"}, 20,
+			storage.BucketResult{Allowed: true, Remaining: 5, GlobalRemaining: 9990}, false, 5},
+		{"IP buckets never borrow", CheckRequest{Key: "user123", Endpoint: "/api/ping", IPAddress: "198.51.100.9"}, 0,
+			storage.BucketResult{Allowed: true, Remaining: 499, GlobalRemaining: 9999}, false, 499},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage := new(MockRedisStorage)
+			mockStorage.On("AtomicDualBucket",
+				mock.Anything, mock.Anything,
+				mock.Anything, mock.Anything,
+				mock.Anything, mock.Anything,
+				tt.wantMaxDebt, mock.Anything, mock.Anything,
+			).Return(tt.result, nil)
+
+			resp, err := NewRateLimiterHandler(mockStorage, mockRules).Check(tt.request)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if resp.InDebt != tt.wantInDebt || resp.UserRemaining != tt.wantUserLeft {
+				t.Errorf("expected inDebt=%v userRemaining=%d, got %+v", tt.wantInDebt, tt.wantUserLeft, resp)
+			}
+			mockStorage.AssertExpectations(t)
+		})
+	}
+}
+
+func TestCheck_BurstMultiplier(t *testing.T) {
+	mockRules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{
+			"premium": {Capacity: 1000, RefillRate: 100, BurstMultiplier: 2},
+		},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/upload": {Rule: "tiers+endpoints", Cost: 10, GlobalCapacity: 100000, GlobalRefillRate: 2000},
+		},
+	}
+	mockStorage := new(MockRedisStorage)
+	mockStorage.On("AtomicDualBucket",
+		"user:user123:/api/upload:premium", "global:/api/upload",
+		int64(100000), float64(2000),
+		int64(2000), float64(100),
+		int64(0), int64(10), mock.Anything,
+	).Return(storage.BucketResult{Allowed: true, Remaining: 1990, GlobalRemaining: 99990}, nil)
+
+	resp, err := NewRateLimiterHandler(mockStorage, mockRules).Check(CheckRequest{Key: "user123", Endpoint: "/api/upload", UserTier: "premium"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mockStorage.AssertExpectations(t)
+	if resp.Limit != 2000 {
+		t.Errorf("expected the burst capacity as the limit, got %d", resp.Limit)
+	}
+}
+
+func TestCheck_PeakHours(t *testing.T) {
+	mockRules := &config.RuleSet{
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/search": {Rule: "endpoint", Cost: 1, GlobalCapacity: 1000, GlobalRefillRate: 100,
+				PeakHours: &config.PeakConfig{Start: "09:00", End: "17:00", Capacity: 200, RefillRate: 20}},
+		},
+	}
+	tests := []struct {
+		name         string
+		now          time.Time
+		wantCapacity int64
+		wantRate     float64
+	}{
+		{"inside the window", time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC), 200, 20},
+		{"outside the window", time.Date(2025, 3, 10, 20, 0, 0, 0, time.UTC), 1000, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage := new(MockRedisStorage)
+			mockStorage.On("AtomicTokenBucket", "endpoint:/api/search", tt.wantCapacity, tt.wantRate, int64(1), mock.Anything).
+				Return(storage.BucketResult{Allowed: true, Remaining: tt.wantCapacity - 1}, nil)
+
+			handler := NewRateLimiterHandlerWithOptions(mockStorage, mockRules, HandlerOptions{
+				ClockFunc: func() time.Time { return tt.now },
+			})
+			resp, err := handler.Check(CheckRequest{Key: "user123", Endpoint: "/api/search"})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			mockStorage.AssertExpectations(t)
+			if resp.Limit != tt.wantCapacity || resp.SustainedRate != tt.wantRate {
+				t.Errorf("expected limit %d at %g/s, got %d at %g/s", tt.wantCapacity, tt.wantRate, resp.Limit, resp.SustainedRate)
+			}
+		})
+	}
+}
+
+func TestCheckHandler_IPRuleRemaining(t *testing.T) {
+	mockRules := &config.RuleSet{
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/ping": {Rule: "IP+endpoints", Cost: 1, GlobalCapacity: 10000, GlobalRefillRate: 1000},
+		},
+		IPs: config.IPConfig{Capacity: 500, RefillRate: 50},
+	}
+	mockStorage := new(MockRedisStorage)
+	mockStorage.On("AtomicDualBucket", "ip:198.51.100.9:/api/ping", "global:/api/ping", int64(10000), float64(1000), int64(500), float64(50), int64(0), int64(1), time.Hour).
+		Return(storage.BucketResult{Allowed: true, Remaining: 499, GlobalRemaining: 9999}, nil)
+
+	handler := NewRateLimiterHandler(mockStorage, mockRules)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	body, _ := json.Marshal(CheckRequest{Key: "user123", Endpoint: "/api/ping", IPAddress: "198.51.100.9"})
+	c.Request, _ = http.NewRequest(http.MethodPost, "/check", bytes.NewBuffer(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+
+	handler.CheckHandler(c)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp CheckResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.UserRemaining != 499 || resp.GlobalRemaining != 9999 {
+		t.Errorf("expected the IP bucket's 499 as userRemaining and 9999 global, got %+v", resp)
+	}
+	mockStorage.AssertExpectations(t)
+}
+
+func TestCheckHandler_UserIPRule(t *testing.T) {
+	rules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{"free": {Capacity: 5, RefillRate: 0.001}},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/login": {Rule: "user+ip", Cost: 4},
+		},
+		IPs: config.IPConfig{Capacity: 10, RefillRate: 0.001},
+	}
+	handler := NewRateLimiterHandler(storage.NewMemoryStorage(), rules)
+
+	check := func(key, ip string) CheckResponse {
+		t.Helper()
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		body, _ := json.Marshal(CheckRequest{Key: key, Endpoint: "/api/login", UserTier: "free", IPAddress: ip})
+		c.Request, _ = http.NewRequest(http.MethodPost, "/check", bytes.NewBuffer(body))
+		c.Request.Header.Set("Content-Type", "application/json")
+		handler.CheckHandler(c)
+		if w.Code != http.StatusOK && w.Code != http.StatusTooManyRequests {
+			t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+		}
+		var resp CheckResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp
+	}
+
+	// Three users behind one IP each have a full bucket, but the IP's 10
+	// tokens only cover two requests of cost 4
+	for _, key := range []string{"alice", "bob"} {
+		if resp := check(key, "203.0.113.7"); !resp.Allowed || resp.UserRemaining != 1 {
+			t.Fatalf("%s: expected allowed with 1 user token left, got %+v", key, resp)
+		}
+	}
+	resp := check("carol", "203.0.113.7")
+	if resp.Allowed || resp.UserRemaining != 5 || resp.IPRemaining == nil || *resp.IPRemaining != 2 {
+		t.Fatalf("expected carol denied by the shared IP with her own bucket untouched, got %+v", resp)
+	}
+
+	// The same user from another IP is still allowed
+	if resp := check("carol", "198.51.100.1"); !resp.Allowed || *resp.IPRemaining != 6 || resp.GlobalRemaining != 0 {
+		t.Fatalf("expected carol allowed from a fresh IP, got %+v", resp)
+	}
+}
+
+func TestCheck_PrefixEndpoint(t *testing.T) {
+	rules := &config.RuleSet{
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/users": {Rule: "endpoint", Cost: 1, GlobalCapacity: 100, GlobalRefillRate: 10, MatchMode: config.MatchPrefix},
+		},
+	}
+	mockStorage := new(MockRedisStorage)
+	mockStorage.On("AtomicTokenBucket", "endpoint:/api/users", int64(100), float64(10), int64(1), time.Hour).
+		Return(storage.BucketResult{Allowed: true, Remaining: 99}, nil)
+	handler := NewRateLimiterHandler(mockStorage, rules)
+
+	// Every path below the prefix shares its bucket
+	for _, path := range []string{"/api/users/123/comments", "/api/users/7"} {
+		resp, err := handler.Check(CheckRequest{Key: "user123", Endpoint: path})
+		if err != nil || !resp.Allowed || resp.Limit != 100 {
+			t.Fatalf("%s: expected the prefix endpoint's limit, got %+v (err %v)", path, resp, err)
+		}
+	}
+	mockStorage.AssertNumberOfCalls(t, "AtomicTokenBucket", 2)
+
+	var reqErr *RequestError
+	if _, err := handler.Check(CheckRequest{Key: "user123", Endpoint: "/api/usersearch"}); !errors.As(err, &reqErr) || reqErr.Status != http.StatusBadRequest {
+		t.Errorf("expected a 400 for a path outside the prefix, got %v", err)
+	}
+}
+
+func TestCheck_SlowLimitKeepsBucketUntilRefilled(t *testing.T) {
+	rules, err := config.ParseRuleSet([]byte("endpoints:\n  /api/export:\n    rule: endpoint\n    cost: 1\n    limit: 100/day\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Expiring after the usual hour would hand a drained bucket back full
+	mockStorage := new(MockRedisStorage)
+	mockStorage.On("AtomicTokenBucket", "endpoint:/api/export", int64(100), mock.Anything, int64(1), 24*time.Hour).
+		Return(storage.BucketResult{Allowed: true, Remaining: 99}, nil)
+	handler := NewRateLimiterHandler(mockStorage, rules)
+
+	if resp, err := handler.Check(CheckRequest{Key: "user123", Endpoint: "/api/export"}); err != nil || !resp.Allowed {
+		t.Fatalf("expected the check to pass, got %+v (err %v)", resp, err)
+	}
+	mockStorage.AssertExpectations(t)
+}
+
+func TestCheckHandler_LimitAndTier(t *testing.T) {
+	mockRules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{
+			"free":    {Capacity: 100, RefillRate: 10},
+			"premium": {Capacity: 1000, RefillRate: 100},
+		},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/upload": {Rule: "tiers+endpoints", Cost: 10, GlobalCapacity: 10000, GlobalRefillRate: 2000},
+			"/api/ping":   {Rule: "IP+endpoints", Cost: 1, GlobalCapacity: 10000, GlobalRefillRate: 1000},
+			"/api/list":   {Rule: "endpoint", Cost: 1, GlobalCapacity: 3000, GlobalRefillRate: 300},
+		},
+		IPs: config.IPConfig{Capacity: 500, RefillRate: 50},
+	}
+
+	tests := []struct {
+		name      string
+		request   CheckRequest
+		wantLimit int64
+		wantRate  string
+		wantTier  string
+	}{
+		{"tiers+endpoints", CheckRequest{Key: "user123", Endpoint: "/api/upload", UserTier: "premium"}, 1000, "100", "premium"},
+		{"IP+endpoints", CheckRequest{Key: "user123", Endpoint: "/api/ping", IPAddress: "198.51.100.9"}, 500, "50", ""},
+		{"endpoint", CheckRequest{Key: "user123", Endpoint: "/api/list"}, 3000, "300", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage := new(MockRedisStorage)
+			mockStorage.On("AtomicDualBucket", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+				Return(storage.BucketResult{Allowed: true}, nil)
+			mockStorage.On("AtomicTokenBucket", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+				Return(storage.BucketResult{Allowed: true}, nil)
+
+			handler := NewRateLimiterHandler(mockStorage, mockRules)
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			body, _ := json.Marshal(tt.request)
+			c.Request, _ = http.NewRequest(http.MethodPost, "/check", bytes.NewBuffer(body))
+			c.Request.Header.Set("Content-Type", "application/json")
+
+			handler.CheckHandler(c)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+			var resp map[string]interface{}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if resp["limit"] != float64(tt.wantLimit) {
+				t.Errorf("expected limit %d, got %v", tt.wantLimit, resp["limit"])
+			}
+			if tier, _ := resp["tier"].(string); tier != tt.wantTier {
+				t.Errorf("expected tier %q, got %v", tt.wantTier, resp["tier"])
+			}
+			if got := w.Header().Get("X-RateLimit-Burst"); got != strconv.FormatInt(tt.wantLimit, 10) {
+				t.Errorf("expected X-RateLimit-Burst %d, got %q", tt.wantLimit, got)
+			}
+			if got := w.Header().Get("X-RateLimit-Sustained-Rate"); got != tt.wantRate {
+				t.Errorf("expected X-RateLimit-Sustained-Rate %s, got %q", tt.wantRate, got)
+			}
+		})
+	}
+}
+
+func TestCheckHandler_Namespace(t *testing.T) {
+	rules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{
+			"free": {Capacity: 100, RefillRate: 10},
+		},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/upload": {Rule: "tiers+endpoints", Cost: 10, GlobalCapacity: 10000, GlobalRefillRate: 2000},
+			"/api/ping":   {Rule: "IP+endpoints", Cost: 1, GlobalCapacity: 5000, GlobalRefillRate: 1000},
+			"/api/list":   {Rule: "endpoint", Cost: 10, GlobalCapacity: 10000, GlobalRefillRate: 1000},
+		},
+		IPs: config.IPConfig{Capacity: 500, RefillRate: 50},
+	}
+
+	tests := []struct {
+		name             string
+		defaultNamespace string
+		request          CheckRequest
+		wantKeys         []string
+	}{
+		{
+			name:     "no namespace keeps existing key format",
+			request:  CheckRequest{Key: "user123", Endpoint: "/api/upload", UserTier: "free"},
+			wantKeys: []string{"user:user123:/api/upload:free", "global:/api/upload"},
+		},
+		{
+			name:     "request namespace scopes user and global buckets",
+			request:  CheckRequest{Key: "user123", Endpoint: "/api/upload", UserTier: "free", Namespace: "staging"},
+			wantKeys: []string{"staging:user:user123:/api/upload:free", "staging:global:/api/upload"},
+		},
+		{
+			name:             "server default namespace",
+			defaultNamespace: "prod",
+			request:          CheckRequest{Key: "user123", Endpoint: "/api/ping", IPAddress: "10.0.0.1"},
+			wantKeys:         []string{"prod:ip:10.0.0.1:/api/ping", "prod:global:/api/ping"},
+		},
+		{
+			name:             "request namespace overrides server default",
+			defaultNamespace: "prod",
+			request:          CheckRequest{Key: "user123", Endpoint: "/api/list", Namespace: "staging"},
+			wantKeys:         []string{"staging:endpoint:/api/list"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := *rules
+			rs.Namespace = tt.defaultNamespace
+
+			mockStorage := new(MockRedisStorage)
+			if len(tt.wantKeys) == 2 {
+				mockStorage.On("AtomicDualBucket",
+					tt.wantKeys[0], tt.wantKeys[1],
+					mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+				).Return(storage.BucketResult{Allowed: true}, nil)
+			} else {
+				mockStorage.On("AtomicTokenBucket",
+					tt.wantKeys[0], mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+				).Return(storage.BucketResult{Allowed: true}, nil)
+			}
+
+			handler := NewRateLimiterHandler(mockStorage, &rs)
+			if _, err := handler.Check(tt.request); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			mockStorage.AssertExpectations(t)
+		})
+	}
+
+	t.Run("invalid namespace", func(t *testing.T) {
+		handler := NewRateLimiterHandler(new(MockRedisStorage), rules)
+		_, err := handler.Check(CheckRequest{Key: "user123", Endpoint: "/api/list", Namespace: "prod:global"})
+
+		var reqErr *RequestError
+		if !errors.As(err, &reqErr) || reqErr.Status != http.StatusBadRequest {
+			t.Errorf("expected 400 request error, got %v", err)
+		}
+	})
+}
+
+func TestSetRules_AppliesToNextCheck(t *testing.T) {
+	oldRules := &config.RuleSet{
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/list": {Rule: "endpoint", Cost: 1, GlobalCapacity: 100, GlobalRefillRate: 10},
+		},
+	}
+	newRules := &config.RuleSet{
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/list": {Rule: "endpoint", Cost: 5, GlobalCapacity: 300, GlobalRefillRate: 30},
+		},
+	}
+	mockStorage := new(MockRedisStorage)
+	mockStorage.On("AtomicTokenBucket", "endpoint:/api/list", int64(100), float64(10), int64(1), time.Hour).
+		Return(storage.BucketResult{Allowed: true}, nil).Once()
+	mockStorage.On("AtomicTokenBucket", "endpoint:/api/list", int64(300), float64(30), int64(5), time.Hour).
+		Return(storage.BucketResult{Allowed: true}, nil).Once()
+
+	handler := NewRateLimiterHandler(mockStorage, oldRules)
+	req := CheckRequest{Key: "user123", Endpoint: "/api/list"}
+	if _, err := handler.Check(req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	handler.SetRules(newRules)
+	if handler.Rules() != newRules {
+		t.Fatal("expected Rules to return the swapped rule set")
+	}
+	if _, err := handler.Check(req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mockStorage.AssertExpectations(t)
+}
+
+func TestSchemaHandler(t *testing.T) {
+	handler := NewRateLimiterHandler(new(MockRedisStorage), &config.RuleSet{})
+	router := gin.New()
+	router.GET("/admin/schema", handler.SchemaHandler)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/schema", nil))
+
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/schema+json" {
+		t.Fatalf("expected a schema, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	var schema map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &schema); err != nil {
+		t.Fatalf("failed to parse response: %v", err)
+	}
+	if schema["$schema"] != "http://json-schema.org/draft-07/schema#" {
+		t.Errorf("expected a draft-07 schema, got %v", schema["$schema"])
+	}
+}
+
+func TestRulesHandler(t *testing.T) {
+	rules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{
+			"free":    {Capacity: 100, RefillRate: 10},
+			"premium": {Capacity: 1000, RefillRate: 100},
+		},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/upload": {Rule: "tiers+endpoints", Cost: 10, GlobalCapacity: 10000, GlobalRefillRate: 2000},
+			"/api/list":   {Rule: "endpoint", Cost: 10, GlobalCapacity: 10000, GlobalRefillRate: 1000, DryRun: true},
+		},
+		IPs: config.IPConfig{Capacity: 500, RefillRate: 50},
+	}
+	handler := NewRateLimiterHandler(new(MockRedisStorage), rules)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/rules", handler.RulesHandler)
+
+	t.Run("full rule set round-trips", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/rules", nil))
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+		var got config.RuleSet
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("failed to parse response: %v", err)
+		}
+		if !reflect.DeepEqual(&got, rules) {
+			t.Errorf("rules did not round-trip:\n got %+v\nwant %+v", got, *rules)
+		}
+		if !strings.Contains(w.Body.String(), `"refill_rate"`) {
+			t.Error("expected snake_case field names matching rules.yaml")
+		}
+	})
+
+	t.Run("filter by endpoint", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/rules?endpoint=/api/list", nil))
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+		var got config.EndpointConfig
+		json.Unmarshal(w.Body.Bytes(), &got)
+		if !reflect.DeepEqual(got, rules.Endpoints["/api/list"]) {
+			t.Errorf("expected %+v, got %+v", rules.Endpoints["/api/list"], got)
+		}
+	})
+
+	t.Run("unknown endpoint", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/rules?endpoint=/api/nope", nil))
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+}
+
 func TestMain(m *testing.M) {
 	log.SetOutput(io.Discard) // Turn off all the log when testing
 	os.Exit(m.Run())
@@ -0,0 +1,184 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEntry is one rate limit decision as recorded in the audit log.
+type AuditEntry struct {
+	Timestamp       time.Time `json:"timestamp"`
+	Key             string    `json:"key"`
+	Endpoint        string    `json:"endpoint"`
+	Tier            string    `json:"tier,omitempty"`
+	IPAddress       string    `json:"ip_address,omitempty"`
+	Allowed         bool      `json:"allowed"`
+	RemainingTokens int64     `json:"remaining_tokens"` // Balance of the bucket that limits the request
+	Cost            int64     `json:"cost"`
+	RequestID       string    `json:"request_id,omitempty"`
+}
+
+// AuditLogger records every rate limit decision, e.g. for compliance. Log
+// runs on the request path, so it should hand entries off rather than wait
+// on slow storage. An error is logged and the check goes ahead.
+type AuditLogger interface {
+	Log(ctx context.Context, entry AuditEntry) error
+}
+
+// NoopAuditLogger discards every entry.
+type NoopAuditLogger struct{}
+
+func (NoopAuditLogger) Log(context.Context, AuditEntry) error { return nil }
+
+// ErrAuditDropped is returned by FileAuditLogger.Log when an entry can't be
+// queued in time because the writer has fallen behind.
+var ErrAuditDropped = errors.New("audit log queue full, entry dropped")
+
+// ErrAuditClosed is returned by FileAuditLogger.Log after Close.
+var ErrAuditClosed = errors.New("audit log closed")
+
+// Defaults for FileAuditOptions.
+const (
+	defaultAuditBuffer  = 4096
+	defaultAuditTimeout = 10 * time.Millisecond
+)
+
+// FileAuditOptions tunes a FileAuditLogger. Zero fields use defaults.
+type FileAuditOptions struct {
+	// Buffer is how many entries may wait to be written; default 4096
+	Buffer int
+	// Timeout is how long Log waits for room in a full buffer before
+	// dropping the entry; default 10ms
+	Timeout time.Duration
+}
+
+// FileAuditLogger appends entries to a file as newline-delimited JSON. Log
+// only queues the entry; a single goroutine writes the queue out, so slow
+// disks never hold up responses. Close flushes what is queued.
+type FileAuditLogger struct {
+	mu      sync.Mutex // Guards file
+	file    *os.File
+	entries chan AuditEntry
+	timeout time.Duration
+	done    chan struct{} // Closed when the writer has drained entries
+
+	closeMu sync.RWMutex // Held for reading while queueing, so Close can't close entries under Log
+	closed  bool
+}
+
+// NewFileAuditLogger opens path for appending, creating it if needed, and
+// starts writing entries to it.
+func NewFileAuditLogger(path string, opts FileAuditOptions) (*FileAuditLogger, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit log: %w", err)
+	}
+	if opts.Buffer <= 0 {
+		opts.Buffer = defaultAuditBuffer
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultAuditTimeout
+	}
+	a := &FileAuditLogger{
+		file:    file,
+		entries: make(chan AuditEntry, opts.Buffer),
+		timeout: opts.Timeout,
+		done:    make(chan struct{}),
+	}
+	go a.run()
+	return a, nil
+}
+
+// Log queues entry to be written. It returns ErrAuditDropped if the queue
+// stays full for the timeout.
+func (a *FileAuditLogger) Log(ctx context.Context, entry AuditEntry) error {
+	a.closeMu.RLock()
+	defer a.closeMu.RUnlock()
+	if a.closed {
+		return ErrAuditClosed
+	}
+	select {
+	case a.entries <- entry:
+		return nil
+	default:
+	}
+	timer := time.NewTimer(a.timeout)
+	defer timer.Stop()
+	select {
+	case a.entries <- entry:
+		return nil
+	case <-timer.C:
+		auditDroppedTotal.Inc()
+		return ErrAuditDropped
+	case <-ctx.Done():
+		auditDroppedTotal.Inc()
+		return ctx.Err()
+	}
+}
+
+func (a *FileAuditLogger) run() {
+	defer close(a.done)
+	enc := json.NewEncoder(a.file)
+	for entry := range a.entries {
+		a.mu.Lock()
+		err := enc.Encode(entry)
+		a.mu.Unlock()
+		if err != nil {
+			log.Printf("❌ Audit log write failed: %v", err)
+		}
+	}
+}
+
+// Close writes out the queued entries and closes the file. Later calls do
+// nothing.
+func (a *FileAuditLogger) Close() error {
+	a.closeMu.Lock()
+	if a.closed {
+		a.closeMu.Unlock()
+		return nil
+	}
+	a.closed = true
+	close(a.entries)
+	a.closeMu.Unlock()
+
+	<-a.done
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.file.Sync(); err != nil {
+		a.file.Close()
+		return err
+	}
+	return a.file.Close()
+}
+
+// audit records a decision with the audit logger, if there is one.
+func (h *RateLimiterHandler) audit(req CheckRequest, resp CheckResponse, rule string, cost int64) {
+	if h.auditLog == nil {
+		return
+	}
+	// Endpoint rules limit by the global bucket, the others by the per-key one
+	remaining := resp.UserRemaining
+	if rule == "endpoint" {
+		remaining = resp.GlobalRemaining
+	}
+	entry := AuditEntry{
+		Timestamp:       h.clock().UTC(),
+		Key:             req.Key,
+		Endpoint:        req.Endpoint,
+		Tier:            req.UserTier,
+		IPAddress:       req.IPAddress,
+		Allowed:         resp.Allowed,
+		RemainingTokens: remaining,
+		Cost:            cost,
+		RequestID:       req.RequestID,
+	}
+	if err := h.auditLog.Log(context.Background(), entry); err != nil {
+		log.Printf("⚠️ [%s] Audit log failed - key: %s, endpoint: %s, error: %v", req.RequestID, req.Key, req.Endpoint, err)
+	}
+}
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+func auditRules() *config.RuleSet {
+	return &config.RuleSet{
+		Tiers: map[string]config.TierConfig{"free": {Capacity: 20, RefillRate: 0.001}},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/upload": {Rule: "tiers+endpoints", Cost: 10, GlobalCapacity: 1000, GlobalRefillRate: 1},
+			"/api/export": {Rule: "endpoint", Cost: 1, GlobalCapacity: 5, GlobalRefillRate: 1},
+		},
+	}
+}
+
+func readAuditLog(t *testing.T, path string) []AuditEntry {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open audit log: %v", err)
+	}
+	defer file.Close()
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("expected a JSON entry per line, got %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestCheckHandler_AuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := NewFileAuditLogger(path, FileAuditOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	handler := NewRateLimiterHandlerWithOptions(storage.NewMemoryStorage(), auditRules(), HandlerOptions{
+		AuditLogger: auditLog,
+		ClockFunc:   func() time.Time { return now },
+	})
+	router := gin.New()
+	router.POST("/check", handler.CheckHandler)
+
+	body := `{"key": "alice", "endpoint": "/api/upload", "user_tier": "free", "ip_address": "10.0.0.1"}`
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest(http.MethodPost, "/check", strings.NewReader(body))
+		req.Header.Set("X-Request-ID", []string{"req-a", "req-b", "req-c"}[i])
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Fatalf("request %d: expected %d, got %d", i+1, want, w.Code)
+		}
+	}
+	// Invalid requests never reach a decision
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/check", strings.NewReader(`{"key": "alice", "endpoint": "/nope"}`)))
+	if err := auditLog.Close(); err != nil {
+		t.Fatalf("unexpected error closing: %v", err)
+	}
+
+	entries := readAuditLog(t, path)
+	if len(entries) != 3 {
+		t.Fatalf("expected an entry per decision, got %+v", entries)
+	}
+	want := AuditEntry{Timestamp: now, Key: "alice", Endpoint: "/api/upload", Tier: "free", IPAddress: "10.0.0.1", Allowed: true, RemainingTokens: 10, Cost: 10, RequestID: "req-a"}
+	if !entries[0].Timestamp.Equal(want.Timestamp) {
+		t.Errorf("expected timestamp %v, got %v", want.Timestamp, entries[0].Timestamp)
+	}
+	entries[0].Timestamp = now
+	if entries[0] != want {
+		t.Errorf("expected %+v, got %+v", want, entries[0])
+	}
+	if denied := entries[2]; denied.Allowed || denied.RemainingTokens != 0 || denied.RequestID != "req-c" {
+		t.Errorf("expected the denial recorded with nothing left, got %+v", denied)
+	}
+}
+
+// recordingAuditLogger keeps entries in memory.
+type recordingAuditLogger struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+}
+
+func (r *recordingAuditLogger) Log(_ context.Context, entry AuditEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, entry)
+	return nil
+}
+
+func TestCheck_AuditLogEndpointRule(t *testing.T) {
+	recorder := &recordingAuditLogger{}
+	handler := NewRateLimiterHandlerWithOptions(storage.NewMemoryStorage(), auditRules(), HandlerOptions{AuditLogger: recorder})
+	for i := 0; i < 6; i++ {
+		handler.Check(CheckRequest{Key: "bob", Endpoint: "/api/export"})
+	}
+	if len(recorder.entries) != 6 {
+		t.Fatalf("expected 6 entries, got %d", len(recorder.entries))
+	}
+	// Endpoint rules report the global bucket's balance
+	if first := recorder.entries[0]; !first.Allowed || first.RemainingTokens != 4 {
+		t.Errorf("expected the first check allowed with 4 left, got %+v", first)
+	}
+	if last := recorder.entries[5]; last.Allowed {
+		t.Errorf("expected the sixth check denied, got %+v", last)
+	}
+}
+
+func TestFileAuditLogger_Concurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := NewFileAuditLogger(path, FileAuditOptions{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if err := auditLog.Log(context.Background(), AuditEntry{Key: "k", Endpoint: "/e", Allowed: true}); err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	auditLog.Close()
+	if entries := readAuditLog(t, path); len(entries) != 1000 {
+		t.Fatalf("expected 1000 whole entries, got %d", len(entries))
+	}
+}
+
+func TestFileAuditLogger_DropsWhenFull(t *testing.T) {
+	auditLog, err := NewFileAuditLogger(filepath.Join(t.TempDir(), "audit.log"), FileAuditOptions{Buffer: 1, Timeout: time.Millisecond})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Stall the writer so the queue fills
+	auditLog.mu.Lock()
+	var dropped error
+	for i := 0; i < 3 && dropped == nil; i++ {
+		dropped = auditLog.Log(context.Background(), AuditEntry{Key: "k"})
+	}
+	auditLog.mu.Unlock()
+	if !errors.Is(dropped, ErrAuditDropped) {
+		t.Fatalf("expected ErrAuditDropped once the queue is full, got %v", dropped)
+	}
+
+	if err := auditLog.Close(); err != nil {
+		t.Fatalf("unexpected error closing: %v", err)
+	}
+	if err := auditLog.Close(); err != nil {
+		t.Fatalf("expected a second Close to do nothing, got %v", err)
+	}
+	if err := auditLog.Log(context.Background(), AuditEntry{Key: "k"}); !errors.Is(err, ErrAuditClosed) {
+		t.Fatalf("expected ErrAuditClosed after Close, got %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AuthRequestHeaders names the request headers the nginx auth_request mode
+// reads. Empty fields fall back to DefaultAuthRequestHeaders.
+type AuthRequestHeaders struct {
+	Key  string // Rate limit key; the client IP is used when absent
+	URI  string // Original request URI, used as the endpoint
+	Tier string // User tier for tiers+endpoints rules
+	IP   string // Client IP; when empty Gin's ClientIP() is used
+	Cost string // Request cost; the endpoint's cost is used when absent
+}
+
+func DefaultAuthRequestHeaders() AuthRequestHeaders {
+	return AuthRequestHeaders{
+		Key:  "X-RateLimit-Key",
+		URI:  "X-Original-URI",
+		Tier: "X-RateLimit-Tier",
+		Cost: CostHeader,
+	}
+}
+
+// AuthRequestHandler returns a handler for nginx's auth_request subrequests.
+// nginx can only act on the status code, so the decision is a bare 204
+// (allowed) or 429 (denied) with X-RateLimit-* headers nginx can copy to the
+// client. URIs without a configured rule are not limited.
+func (h *RateLimiterHandler) AuthRequestHandler(headers AuthRequestHeaders) gin.HandlerFunc {
+	defaults := DefaultAuthRequestHeaders()
+	if headers.Key == "" {
+		headers.Key = defaults.Key
+	}
+	if headers.URI == "" {
+		headers.URI = defaults.URI
+	}
+	if headers.Tier == "" {
+		headers.Tier = defaults.Tier
+	}
+	if headers.Cost == "" {
+		headers.Cost = defaults.Cost
+	}
+
+	return func(c *gin.Context) {
+		endpoint, _, _ := strings.Cut(c.GetHeader(headers.URI), "?")
+		if endpoint == "" {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		ip := c.ClientIP()
+		if headers.IP != "" && c.GetHeader(headers.IP) != "" {
+			ip = c.GetHeader(headers.IP)
+		}
+		key := c.GetHeader(headers.Key)
+		if key == "" {
+			key = ip
+		}
+
+		if _, _, ok := h.Rules().MatchEndpoint(endpoint); !ok {
+			c.Status(http.StatusNoContent)
+			return
+		}
+
+		var resp CheckResponse
+		cost, err := headerCost(c.GetHeader(headers.Cost))
+		if err == nil {
+			resp, err = h.Check(CheckRequest{
+				Key:       key,
+				Endpoint:  endpoint,
+				Cost:      cost,
+				UserTier:  c.GetHeader(headers.Tier),
+				IPAddress: ip,
+				Header:    c.Request.Header,
+			})
+		}
+		if err != nil {
+			var reqErr *RequestError
+			if errors.As(err, &reqErr) {
+				c.Header("X-RateLimit-Error", reqErr.Message)
+				c.AbortWithStatus(reqErr.Status)
+				return
+			}
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.Header("X-RateLimit-Remaining", strconv.FormatInt(resp.UserRemaining, 10))
+		setLimitHeaders(c, resp)
+		c.Header("X-RateLimit-Global-Remaining", strconv.FormatInt(resp.GlobalRemaining, 10))
+		if !resp.Allowed {
+			if resp.RetryAfterMs > 0 {
+				c.Header("Retry-After", strconv.FormatInt((resp.RetryAfterMs+999)/1000, 10))
+				c.Header("X-RateLimit-Retry-After-Ms", strconv.FormatInt(resp.RetryAfterMs, 10))
+			}
+			c.Status(http.StatusTooManyRequests)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/mock"
+)
+
+func authRequestRules() *config.RuleSet {
+	return &config.RuleSet{
+		Tiers: map[string]config.TierConfig{
+			"free": {Capacity: 100, RefillRate: 10},
+		},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/upload": {Rule: "tiers+endpoints", Cost: 10, GlobalCapacity: 10000, GlobalRefillRate: 2000},
+			"/api/ping":   {Rule: "IP+endpoints", Cost: 1, GlobalCapacity: 5000, GlobalRefillRate: 1000},
+		},
+		IPs: config.IPConfig{Capacity: 500, RefillRate: 50},
+	}
+}
+
+func serveAuthRequest(handler gin.HandlerFunc, headers map[string]string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/check/authrequest", handler)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/check/authrequest", nil)
+	req.RemoteAddr = "203.0.113.7:51234"
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAuthRequestHandler_Allowed(t *testing.T) {
+	mockStorage := new(MockRedisStorage)
+	mockStorage.On("AtomicDualBucket",
+		"user:user123:/api/upload:free", "global:/api/upload",
+		mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+	).Return(storage.BucketResult{Allowed: true, Remaining: 90, GlobalRemaining: 9990}, nil)
+
+	handler := NewRateLimiterHandler(mockStorage, authRequestRules())
+	w := serveAuthRequest(handler.AuthRequestHandler(AuthRequestHeaders{}), map[string]string{
+		"X-RateLimit-Key":  "user123",
+		"X-Original-URI":   "/api/upload?name=file.txt",
+		"X-RateLimit-Tier": "free",
+	})
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", w.Code)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("expected empty body, got %q", w.Body.String())
+	}
+	if got := w.Header().Get("X-RateLimit-Remaining"); got != "90" {
+		t.Errorf("expected X-RateLimit-Remaining 90, got %q", got)
+	}
+	if got := w.Header().Get("X-RateLimit-Global-Remaining"); got != "9990" {
+		t.Errorf("expected X-RateLimit-Global-Remaining 9990, got %q", got)
+	}
+	mockStorage.AssertExpectations(t)
+}
+
+func TestAuthRequestHandler_Denied(t *testing.T) {
+	mockStorage := new(MockRedisStorage)
+	mockStorage.On("AtomicDualBucket",
+		mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+	).Return(storage.BucketResult{Allowed: false, Remaining: 0, GlobalRemaining: 9990, RetryAfter: 1500 * time.Millisecond}, nil)
+
+	handler := NewRateLimiterHandler(mockStorage, authRequestRules())
+	w := serveAuthRequest(handler.AuthRequestHandler(AuthRequestHeaders{}), map[string]string{
+		"X-RateLimit-Key":  "user123",
+		"X-Original-URI":   "/api/upload",
+		"X-RateLimit-Tier": "free",
+	})
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("expected Retry-After 2, got %q", got)
+	}
+	if got := w.Header().Get("X-RateLimit-Retry-After-Ms"); got != "1500" {
+		t.Errorf("expected X-RateLimit-Retry-After-Ms 1500, got %q", got)
+	}
+}
+
+func TestAuthRequestHandler_CostHeader(t *testing.T) {
+	mockStorage := new(MockRedisStorage)
+	mockStorage.On("AtomicDualBucket",
+		"user:user123:/api/upload:free", "global:/api/upload",
+		mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, int64(25), mock.Anything,
+	).Return(storage.BucketResult{Allowed: true, Remaining: 75, GlobalRemaining: 9975}, nil)
+	handler := NewRateLimiterHandler(mockStorage, authRequestRules())
+
+	w := serveAuthRequest(handler.AuthRequestHandler(AuthRequestHeaders{}), map[string]string{
+		"X-RateLimit-Key":  "user123",
+		"X-Original-URI":   "/api/upload",
+		"X-RateLimit-Tier": "free",
+		"X-RateLimit-Cost": "25",
+	})
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", w.Code)
+	}
+	mockStorage.AssertExpectations(t)
+
+	for _, cost := range []string{"-5", "0", "1.5", "ten"} {
+		w := serveAuthRequest(handler.AuthRequestHandler(AuthRequestHeaders{}), map[string]string{
+			"X-Original-URI":   "/api/upload",
+			"X-RateLimit-Tier": "free",
+			"X-RateLimit-Cost": cost,
+		})
+		if w.Code != http.StatusBadRequest || w.Header().Get("X-RateLimit-Error") == "" {
+			t.Errorf("cost %q: expected a 400 with X-RateLimit-Error, got %d", cost, w.Code)
+		}
+	}
+	if len(mockStorage.Calls) != 1 {
+		t.Errorf("expected invalid costs never to reach storage, got %d calls", len(mockStorage.Calls))
+	}
+}
+
+func TestAuthRequestHandler_CustomHeadersAndClientIP(t *testing.T) {
+	mockStorage := new(MockRedisStorage)
+	mockStorage.On("AtomicDualBucket",
+		"ip:198.51.100.9:/api/ping", "global:/api/ping",
+		mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+	).Return(storage.BucketResult{Allowed: true, Remaining: 499, GlobalRemaining: 4999}, nil)
+
+	handler := NewRateLimiterHandler(mockStorage, authRequestRules())
+	w := serveAuthRequest(handler.AuthRequestHandler(AuthRequestHeaders{URI: "X-Forwarded-Uri", IP: "X-Real-IP"}), map[string]string{
+		"X-Forwarded-Uri": "/api/ping",
+		"X-Real-IP":       "198.51.100.9",
+	})
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", w.Code)
+	}
+	mockStorage.AssertExpectations(t)
+}
+
+func TestAuthRequestHandler_Errors(t *testing.T) {
+	tests := []struct {
+		name           string
+		headers        map[string]string
+		storageErr     error
+		expectedStatus int
+	}{
+		{"missing URI header", map[string]string{"X-RateLimit-Key": "user123"}, nil, http.StatusBadRequest},
+		{"unlimited URI passes", map[string]string{"X-Original-URI": "/static/app.js"}, nil, http.StatusNoContent},
+		{"invalid tier", map[string]string{"X-Original-URI": "/api/upload", "X-RateLimit-Tier": "gold"}, nil, http.StatusBadRequest},
+		{"storage failure", map[string]string{"X-Original-URI": "/api/upload", "X-RateLimit-Tier": "free"}, errors.New("redis down"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage := new(MockRedisStorage)
+			mockStorage.On("AtomicDualBucket",
+				mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+			).Return(storage.BucketResult{}, tt.storageErr)
+
+			handler := NewRateLimiterHandler(mockStorage, authRequestRules())
+			w := serveAuthRequest(handler.AuthRequestHandler(AuthRequestHeaders{}), tt.headers)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/AndySung320/rate-limiter/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// The benchmarks run on the in-memory backend, so they measure the handler
+// itself; BenchmarkAtomicTokenBucket in the storage package measures Redis.
+
+var benchBodies = map[string]string{
+	"tiers+endpoints": `{"key": "alice", "endpoint": "/api/upload", "user_tier": "free"}`,
+	"IP+endpoints":    `{"key": "alice", "endpoint": "/api/login", "ip_address": "10.0.0.1"}`,
+	"endpoint":        `{"key": "alice", "endpoint": "/api/export"}`,
+	"user+ip":         `{"key": "alice", "endpoint": "/api/signup", "user_tier": "free", "ip_address": "10.0.0.1"}`,
+}
+
+func newBenchRouter(b *testing.B) *gin.Engine {
+	b.Helper()
+	log.SetOutput(io.Discard)
+	gin.SetMode(gin.TestMode)
+	handler := NewRateLimiterHandler(storage.NewMemoryStorage(), verboseRules())
+	router := gin.New()
+	router.POST("/check", handler.CheckHandler)
+	return router
+}
+
+// BenchmarkCheckHandler is a full POST /check for each rule: JSON binding,
+// the check and the response.
+func BenchmarkCheckHandler(b *testing.B) {
+	for _, rule := range []string{"tiers+endpoints", "IP+endpoints", "endpoint", "user+ip"} {
+		b.Run(rule, func(b *testing.B) {
+			router := newBenchRouter(b)
+			body := benchBodies[rule]
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/check", strings.NewReader(body)))
+				if w.Code != http.StatusOK {
+					b.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCheckHandler_Parallel spreads concurrent requests over many keys,
+// as a busy server sees them.
+func BenchmarkCheckHandler_Parallel(b *testing.B) {
+	router := newBenchRouter(b)
+	bodies := make([]string, 1024)
+	for i := range bodies {
+		bodies[i] = `{"key": "user-` + strconv.Itoa(i) + `", "endpoint": "/api/upload", "user_tier": "free"}`
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/check", strings.NewReader(bodies[i%len(bodies)])))
+			i++
+		}
+	})
+}
+
+// BenchmarkCheck calls Check directly, leaving out HTTP and JSON.
+func BenchmarkCheck(b *testing.B) {
+	log.SetOutput(io.Discard)
+	handler := NewRateLimiterHandler(storage.NewMemoryStorage(), verboseRules())
+	req := CheckRequest{Key: "alice", Endpoint: "/api/upload", UserTier: "free"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := handler.Check(req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
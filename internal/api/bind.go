@@ -0,0 +1,59 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// Validation errors name fields as they appear in the JSON body, so
+// clients can map them back to what they sent.
+func init() {
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(func(f reflect.StructField) string {
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" {
+				return ""
+			}
+			return name
+		})
+	}
+}
+
+// writeBindError writes the 400 response for a request body that failed
+// to bind. Failed binding rules are reported per field, e.g.
+// {"error":"validation_failed","fields":{"key":"required"}}; anything else,
+// such as malformed JSON, keeps its message.
+func writeBindError(c *gin.Context, err error) {
+	var invalid validator.ValidationErrors
+	if !errors.As(err, &invalid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	fields := make(map[string]string, len(invalid))
+	for _, fe := range invalid {
+		rule := fe.Tag()
+		if fe.Param() != "" {
+			rule += "=" + fe.Param()
+		}
+		fields[fieldPath(fe)] = rule
+	}
+	writeValidationFailed(c, fields)
+}
+
+// writeValidationFailed writes a 400 listing the failed rule of each field.
+func writeValidationFailed(c *gin.Context, fields map[string]string) {
+	c.JSON(http.StatusBadRequest, gin.H{"error": "validation_failed", "fields": fields})
+}
+
+// fieldPath is fe's field relative to the request body, such as "key" or
+// "requests[2].endpoint".
+func fieldPath(fe validator.FieldError) string {
+	_, path, _ := strings.Cut(fe.Namespace(), ".")
+	return path
+}
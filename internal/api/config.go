@@ -0,0 +1,78 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/gin-gonic/gin"
+)
+
+// RulesProvenance says where the rules in effect came from, so replicas
+// can be compared with each other and with the rules in version control.
+type RulesProvenance struct {
+	Source     string         `json:"source"`          // The rules file or directory, or e.g. "redis key ratelimiter:rules"
+	Files      []string       `json:"files,omitempty"` // Every file read, includes among them
+	SHA256     string         `json:"sha256"`          // Of the raw rules, before environment overrides
+	LoadedAt   time.Time      `json:"loaded_at"`
+	LastReload *ReloadAttempt `json:"last_reload,omitempty"` // Unset until a reload is attempted
+}
+
+// ReloadAttempt is the outcome of the latest reload. A failed reload keeps
+// the previous rules in effect.
+type ReloadAttempt struct {
+	At        time.Time `json:"at"`
+	Succeeded bool      `json:"succeeded"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type ConfigResponse struct {
+	RulesProvenance
+	Rules *config.RuleSet `json:"rules"`
+}
+
+// ConfigHandler returns a handler that serves the rules in effect with
+// their provenance. Credentials in the rules are redacted. With
+// ?format=yaml the rules are written as a YAML rules file, with the
+// provenance in comments above them, ready to diff against the source.
+func (h *RateLimiterHandler) ConfigHandler(provenance func() RulesProvenance) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		resp := ConfigResponse{RulesProvenance: provenance(), Rules: h.Rules().Redacted()}
+		switch c.DefaultQuery("format", "json") {
+		case "json":
+			c.JSON(http.StatusOK, resp)
+		case "yaml":
+			data, err := config.EncodeYAML(resp.Rules)
+			if err != nil {
+				log.Printf("❌ Encoding rules as YAML failed: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Rate limiter unavailable"})
+				return
+			}
+			c.Data(http.StatusOK, "application/yaml", append([]byte(resp.comment()), data...))
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or yaml"})
+		}
+	}
+}
+
+// comment renders the provenance as a YAML comment block.
+func (p RulesProvenance) comment() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# source: %s\n", p.Source)
+	for _, file := range p.Files {
+		fmt.Fprintf(&b, "#   %s\n", file)
+	}
+	fmt.Fprintf(&b, "# sha256: %s\n", p.SHA256)
+	fmt.Fprintf(&b, "# loaded_at: %s\n", p.LoadedAt.Format(time.RFC3339))
+	if r := p.LastReload; r != nil {
+		outcome := "succeeded"
+		if !r.Succeeded {
+			outcome = "failed: " + strings.ReplaceAll(r.Error, "\n", " ")
+		}
+		fmt.Fprintf(&b, "# last_reload: %s %s\n", r.At.Format(time.RFC3339), outcome)
+	}
+	return b.String()
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Used when the rules' cors section leaves allow_methods or allow_headers
+// unset: the methods the API serves and the request headers it reads.
+var (
+	defaultCORSMethods = []string{http.MethodGet, http.MethodPost, http.MethodDelete}
+	defaultCORSHeaders = []string{"Authorization", "Content-Type", RequestIDHeader, CostHeader}
+)
+
+// corsExposedHeaders are the response headers a browser page may read.
+var corsExposedHeaders = []string{RequestIDHeader, burstHeader, sustainedRateHeader}
+
+// CORSMiddleware answers browsers calling from the origins in the rules'
+// cors section. It reads the rules on every request, so a reload takes
+// effect at once; with no origins allowed it does nothing. Preflights from
+// an allowed origin are answered with 204, those from any other with 403.
+// Other requests from a disallowed origin are served without CORS headers,
+// which leaves the browser to block the page from reading the response.
+//
+// The allowed origin is echoed rather than "*" whenever credentials are
+// allowed, since browsers reject the wildcard with credentials.
+func (h *RateLimiterHandler) CORSMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cors := h.Rules().CORS
+		origin := c.GetHeader("Origin")
+		if origin == "" || !cors.Enabled() {
+			c.Next()
+			return
+		}
+		c.Writer.Header().Add("Vary", "Origin")
+		preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+		if !cors.AllowsOrigin(origin) {
+			if preflight {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			c.Next()
+			return
+		}
+
+		if cors.AllowsAnyOrigin() && !cors.AllowCredentials {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else {
+			c.Header("Access-Control-Allow-Origin", origin)
+		}
+		if cors.AllowCredentials {
+			c.Header("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			c.Header("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+			c.Next()
+			return
+		}
+
+		methods, headers := cors.AllowMethods, cors.AllowHeaders
+		if len(methods) == 0 {
+			methods = defaultCORSMethods
+		}
+		if len(headers) == 0 {
+			headers = defaultCORSHeaders
+		}
+		c.Header("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		c.Header("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+		if cors.MaxAge > 0 {
+			c.Header("Access-Control-Max-Age", strconv.Itoa(int(cors.MaxAge.Seconds())))
+		}
+		c.AbortWithStatus(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/gin-gonic/gin"
+)
+
+func TestCORSMiddleware(t *testing.T) {
+	tests := []struct {
+		name    string
+		cors    config.CORSConfig
+		method  string
+		origin  string
+		code    int
+		headers map[string]string // "" means the header must be absent
+	}{
+		{
+			name:   "preflight",
+			cors:   config.CORSConfig{AllowOrigins: []string{"https://admin.example.com"}, MaxAge: 10 * time.Minute},
+			method: http.MethodOptions,
+			origin: "https://admin.example.com",
+			code:   http.StatusNoContent,
+			headers: map[string]string{
+				"Access-Control-Allow-Origin":      "https://admin.example.com",
+				"Access-Control-Allow-Methods":     "GET, POST, DELETE",
+				"Access-Control-Allow-Headers":     "Authorization, Content-Type, X-Request-ID, X-RateLimit-Cost",
+				"Access-Control-Max-Age":           "600",
+				"Access-Control-Allow-Credentials": "",
+				"Vary":                             "Origin",
+			},
+		},
+		{
+			name:   "preflight with configured methods and headers",
+			cors:   config.CORSConfig{AllowOrigins: []string{"*"}, AllowMethods: []string{"POST"}, AllowHeaders: []string{"Content-Type"}},
+			method: http.MethodOptions,
+			origin: "https://app.example.com",
+			code:   http.StatusNoContent,
+			headers: map[string]string{
+				"Access-Control-Allow-Origin":  "*",
+				"Access-Control-Allow-Methods": "POST",
+				"Access-Control-Allow-Headers": "Content-Type",
+				"Access-Control-Max-Age":       "",
+			},
+		},
+		{
+			name:   "wildcard with credentials echoes the origin",
+			cors:   config.CORSConfig{AllowOrigins: []string{"*"}, AllowCredentials: true},
+			method: http.MethodOptions,
+			origin: "https://app.example.com",
+			code:   http.StatusNoContent,
+			headers: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example.com",
+				"Access-Control-Allow-Credentials": "true",
+			},
+		},
+		{
+			name:    "preflight from a disallowed origin",
+			cors:    config.CORSConfig{AllowOrigins: []string{"https://admin.example.com"}},
+			method:  http.MethodOptions,
+			origin:  "https://evil.example.com",
+			code:    http.StatusForbidden,
+			headers: map[string]string{"Access-Control-Allow-Origin": "", "Access-Control-Allow-Methods": ""},
+		},
+		{
+			name:   "request from an allowed origin",
+			cors:   config.CORSConfig{AllowOrigins: []string{"https://admin.example.com"}},
+			method: http.MethodGet,
+			origin: "https://admin.example.com",
+			code:   http.StatusOK,
+			headers: map[string]string{
+				"Access-Control-Allow-Origin":   "https://admin.example.com",
+				"Access-Control-Expose-Headers": "X-Request-ID, X-RateLimit-Burst, X-RateLimit-Sustained-Rate",
+				"Access-Control-Allow-Methods":  "",
+			},
+		},
+		{
+			name:    "request from a disallowed origin",
+			cors:    config.CORSConfig{AllowOrigins: []string{"https://admin.example.com"}},
+			method:  http.MethodGet,
+			origin:  "https://evil.example.com",
+			code:    http.StatusOK,
+			headers: map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			name:    "off",
+			method:  http.MethodGet,
+			origin:  "https://admin.example.com",
+			code:    http.StatusOK,
+			headers: map[string]string{"Access-Control-Allow-Origin": "", "Vary": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := NewRateLimiterHandler(new(MockRedisStorage), &config.RuleSet{CORS: tt.cors})
+			router := gin.New()
+			router.Use(handler.CORSMiddleware())
+			router.GET("/limits", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			req := httptest.NewRequest(tt.method, "/limits", nil)
+			req.Header.Set("Origin", tt.origin)
+			if tt.method == http.MethodOptions {
+				req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.code {
+				t.Errorf("expected %d, got %d", tt.code, w.Code)
+			}
+			for name, want := range tt.headers {
+				if got := w.Header().Get(name); got != want {
+					t.Errorf("expected %s %q, got %q", name, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestCORSMiddleware_FollowsReload(t *testing.T) {
+	handler := NewRateLimiterHandler(new(MockRedisStorage), &config.RuleSet{})
+	router := gin.New()
+	router.Use(handler.CORSMiddleware())
+	router.GET("/limits", func(c *gin.Context) { c.Status(http.StatusOK) })
+	allowOrigin := func() string {
+		req := httptest.NewRequest(http.MethodGet, "/limits", nil)
+		req.Header.Set("Origin", "https://admin.example.com")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Header().Get("Access-Control-Allow-Origin")
+	}
+
+	if got := allowOrigin(); got != "" {
+		t.Fatalf("expected no CORS headers before the reload, got %q", got)
+	}
+	handler.SetRules(&config.RuleSet{CORS: config.CORSConfig{AllowOrigins: []string{"https://admin.example.com"}}})
+	if got := allowOrigin(); got != "https://admin.example.com" {
+		t.Errorf("expected the reloaded origin to be allowed, got %q", got)
+	}
+}
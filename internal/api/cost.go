@@ -0,0 +1,149 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// CostCalculator derives the tokens a request consumes. baseCost is the
+// endpoint's cost, or the request's own cost when it sets one. An error
+// rejects the request with a 400.
+type CostCalculator interface {
+	ComputeCost(baseCost int64, req CheckRequest) (int64, error)
+}
+
+// FixedCostCalculator charges baseCost unchanged.
+type FixedCostCalculator struct{}
+
+func (FixedCostCalculator) ComputeCost(baseCost int64, req CheckRequest) (int64, error) {
+	return baseCost, nil
+}
+
+// MetadataScaledCostCalculator scales baseCost by a numeric metadata field,
+// e.g. Key "file_size_kb" with Multiplier 0.01 charges baseCost per 100 KB.
+// Requests without the field pay baseCost.
+type MetadataScaledCostCalculator struct {
+	Key        string
+	Multiplier float64
+	MaxCost    int64 // Upper bound on the scaled cost; 0 means unbounded
+}
+
+func (m MetadataScaledCostCalculator) ComputeCost(baseCost int64, req CheckRequest) (int64, error) {
+	raw, ok := req.Metadata[m.Key]
+	if !ok {
+		return baseCost, nil
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || value < 0 || math.IsInf(value, 0) || math.IsNaN(value) {
+		return 0, fmt.Errorf("metadata %q must be a non-negative number, got %q", m.Key, raw)
+	}
+
+	// Round up so a fraction of a token is never free
+	scaled := math.Ceil(float64(baseCost) * value * m.Multiplier)
+	if m.MaxCost > 0 && scaled > float64(m.MaxCost) {
+		return m.MaxCost, nil
+	}
+	if scaled >= math.MaxInt64 {
+		return 0, fmt.Errorf("metadata %q scales the cost out of range", m.Key)
+	}
+	return int64(scaled), nil
+}
+
+// metadataCost is the cost cost_from takes from metadata: the field's
+// integer value times the multiplier, rounded up and clamped to min and
+// max. A missing or non-integer field charges staticCost, or is a 400 when
+// cost_from is strict.
+func metadataCost(from config.CostFromConfig, staticCost int64, metadata map[string]string) (int64, error) {
+	raw, ok := metadata[from.Metadata]
+	value, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+	if !ok || err != nil || value < 0 {
+		if !from.Strict {
+			return staticCost, nil
+		}
+		message := "metadata field required for this endpoint's cost"
+		if ok {
+			message = "metadata field must be a non-negative integer"
+		}
+		return 0, &RequestError{
+			Status:  http.StatusBadRequest,
+			Message: message,
+			Details: gin.H{"field": from.Metadata},
+		}
+	}
+	scaled := math.Ceil(float64(value) * from.Scale())
+	if from.Max > 0 {
+		scaled = min(scaled, float64(from.Max))
+	}
+	scaled = max(scaled, float64(from.Min))
+	if scaled >= math.MaxInt64 {
+		return 0, &RequestError{
+			Status:  http.StatusBadRequest,
+			Message: "metadata field scales the cost out of range",
+			Details: gin.H{"field": from.Metadata},
+		}
+	}
+	return int64(scaled), nil
+}
+
+// resourceBuckets builds the resource buckets a tiers+endpoints request is
+// charged alongside userKey, in name order. Resources the request's costs map
+// leaves out are charged their configured cost.
+func resourceBuckets(ep config.EndpointConfig, req CheckRequest, userKey string) ([]storage.ResourceBucket, []string) {
+	names := make([]string, 0, len(ep.Resources))
+	for name := range ep.Resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buckets := make([]storage.ResourceBucket, len(names))
+	for i, name := range names {
+		resource := ep.Resources[name]
+		cost, ok := req.Costs[name]
+		if !ok {
+			cost = resource.Cost
+		}
+		limit := resource.Tiers[req.UserTier]
+		buckets[i] = storage.ResourceBucket{
+			Key:        userKey + ":resource:" + name,
+			Capacity:   limit.Capacity,
+			RefillRate: limit.RefillRate,
+			Cost:       cost,
+		}
+	}
+	return buckets, names
+}
+
+// validateResourceCosts rejects costs for resources the endpoint doesn't
+// define and negative amounts.
+func validateResourceCosts(ep config.EndpointConfig, costs map[string]int64) error {
+	for name, amount := range costs {
+		if _, ok := ep.Resources[name]; !ok {
+			valid := make([]string, 0, len(ep.Resources))
+			for resource := range ep.Resources {
+				valid = append(valid, resource)
+			}
+			sort.Strings(valid)
+			return &RequestError{
+				Status:  http.StatusBadRequest,
+				Message: "unknown resource",
+				Details: gin.H{"resource": name, "valid_resources": valid},
+			}
+		}
+		if amount < 0 {
+			return &RequestError{
+				Status:  http.StatusBadRequest,
+				Message: "cost must not be negative",
+				Details: gin.H{"resource": name},
+			}
+		}
+	}
+	return nil
+}
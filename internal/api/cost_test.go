@@ -0,0 +1,210 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestMetadataScaledCostCalculator(t *testing.T) {
+	calc := MetadataScaledCostCalculator{Key: "file_size_kb", Multiplier: 0.01, MaxCost: 500}
+
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		want     int64
+		wantErr  bool
+	}{
+		{"nil metadata", nil, 10, false},
+		{"missing key", map[string]string{"other": "5"}, 10, false},
+		{"scaled", map[string]string{"file_size_kb": "2048"}, 205, false}, // 10 * 20.48, rounded up
+		{"zero", map[string]string{"file_size_kb": "0"}, 0, false},
+		{"clamped", map[string]string{"file_size_kb": "1000000"}, 500, false},
+		{"non-numeric", map[string]string{"file_size_kb": "big"}, 0, true},
+		{"negative", map[string]string{"file_size_kb": "-1"}, 0, true},
+		{"not a number", map[string]string{"file_size_kb": "NaN"}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := calc.ComputeCost(10, CheckRequest{Metadata: tt.metadata})
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got cost %d", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expected cost %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestMetadataScaledCostCalculator_UnboundedOverflow(t *testing.T) {
+	calc := MetadataScaledCostCalculator{Key: "n", Multiplier: 1}
+	if _, err := calc.ComputeCost(1<<40, CheckRequest{Metadata: map[string]string{"n": "1e30"}}); err == nil {
+		t.Error("expected an out of range error")
+	}
+}
+
+func TestCheck_CostCalculator(t *testing.T) {
+	rules := &config.RuleSet{
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/upload": {Rule: "endpoint", Cost: 10, MaxCost: 300, GlobalCapacity: 10000, GlobalRefillRate: 1000},
+		},
+	}
+	calc := MetadataScaledCostCalculator{Key: "file_size_kb", Multiplier: 0.01}
+
+	tests := []struct {
+		name       string
+		metadata   map[string]string
+		wantCost   int64 // Cost passed to storage; 0 when storage must not be called
+		wantStatus int
+	}{
+		{"scaled", map[string]string{"file_size_kb": "500"}, 50, 0},
+		{"clamped to endpoint max_cost", map[string]string{"file_size_kb": "100000"}, 300, 0},
+		{"invalid metadata", map[string]string{"file_size_kb": "abc"}, 0, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage := new(MockRedisStorage)
+			mockStorage.On("AtomicTokenBucket", "endpoint:/api/upload", int64(10000), float64(1000), tt.wantCost, time.Hour).
+				Return(storage.BucketResult{Allowed: true}, nil)
+
+			handler := NewRateLimiterHandlerWithOptions(mockStorage, rules, HandlerOptions{CostCalculator: calc})
+			_, err := handler.Check(CheckRequest{Key: "user123", Endpoint: "/api/upload", Metadata: tt.metadata})
+
+			if tt.wantStatus != 0 {
+				reqErr, ok := err.(*RequestError)
+				if !ok || reqErr.Status != tt.wantStatus {
+					t.Fatalf("expected a %d request error, got %v", tt.wantStatus, err)
+				}
+				mockStorage.AssertNotCalled(t, "AtomicTokenBucket", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			mockStorage.AssertExpectations(t)
+		})
+	}
+}
+
+func TestCheck_Resources(t *testing.T) {
+	rules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{"free": {Capacity: 100, RefillRate: 10}},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/llm": {Rule: "tiers+endpoints", Cost: 1, GlobalCapacity: 10000, GlobalRefillRate: 1000, Resources: map[string]config.ResourceConfig{
+				"tokens": {Tiers: map[string]config.ResourceLimit{"free": {Capacity: 50000, RefillRate: 100}}},
+				"spend":  {Cost: 1, Tiers: map[string]config.ResourceLimit{"free": {Capacity: 500, RefillRate: 1}}},
+			}},
+		},
+	}
+
+	t.Run("charges every resource in one call", func(t *testing.T) {
+		mockStorage := new(MockRedisStorage)
+		wantResources := []storage.ResourceBucket{
+			{Key: "user:user123:/api/llm:free:resource:spend", Capacity: 500, RefillRate: 1, Cost: 1},
+			{Key: "user:user123:/api/llm:free:resource:tokens", Capacity: 50000, RefillRate: 100, Cost: 812},
+		}
+		mockStorage.On("AtomicMultiBucket", "user:user123:/api/llm:free", "global:/api/llm", int64(10000), float64(1000), int64(100), float64(10), int64(0), int64(1), wantResources, time.Hour).
+			Return(storage.BucketResult{Allowed: true, Remaining: 99, GlobalRemaining: 9999, Resources: []int64{499, 49188}}, nil)
+
+		handler := NewRateLimiterHandler(mockStorage, rules)
+		resp, err := handler.Check(CheckRequest{Key: "user123", Endpoint: "/api/llm", UserTier: "free", Costs: map[string]int64{"tokens": 812}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		mockStorage.AssertExpectations(t)
+		if resp.ResourceRemaining["spend"] != 499 || resp.ResourceRemaining["tokens"] != 49188 || resp.UserRemaining != 99 {
+			t.Errorf("expected remaining per resource, got %+v", resp)
+		}
+	})
+
+	for _, tt := range []struct {
+		name  string
+		req   CheckRequest
+		check func(*RateLimiterHandler, CheckRequest) (CheckResponse, error)
+	}{
+		{"unknown resource", CheckRequest{Key: "user123", Endpoint: "/api/llm", UserTier: "free", Costs: map[string]int64{"gpu": 1}}, (*RateLimiterHandler).Check},
+		{"negative amount", CheckRequest{Key: "user123", Endpoint: "/api/llm", UserTier: "free", Costs: map[string]int64{"tokens": -1}}, (*RateLimiterHandler).Check},
+		{"reservation", CheckRequest{Key: "user123", Endpoint: "/api/llm", UserTier: "free"}, func(h *RateLimiterHandler, req CheckRequest) (CheckResponse, error) {
+			return h.check(req, &reservation{id: "r1", hold: time.Minute})
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage := new(MockRedisStorage)
+			handler := NewRateLimiterHandler(mockStorage, rules)
+			_, err := tt.check(handler, tt.req)
+			reqErr, ok := err.(*RequestError)
+			if !ok || reqErr.Status != http.StatusBadRequest {
+				t.Fatalf("expected a 400 request error, got %v", err)
+			}
+			mockStorage.AssertNotCalled(t, "AtomicMultiBucket", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestCheck_CostFrom(t *testing.T) {
+	from := config.CostFromConfig{Metadata: "rows", Multiplier: 0.01, Min: 2, Max: 50}
+	strict := from
+	strict.Strict = true
+
+	tests := []struct {
+		name       string
+		costFrom   config.CostFromConfig
+		metadata   map[string]string
+		wantCost   int64 // Cost passed to storage; 0 when storage must not be called
+		wantStatus int
+	}{
+		{"scaled", from, map[string]string{"rows": "1234"}, 13, 0}, // 12.34, rounded up
+		{"clamped to min", from, map[string]string{"rows": "10"}, 2, 0},
+		{"clamped to max", from, map[string]string{"rows": "1000000"}, 50, 0},
+		{"missing falls back to cost", from, nil, 5, 0},
+		{"non-numeric falls back to cost", from, map[string]string{"rows": "many"}, 5, 0},
+		{"strict missing", strict, nil, 0, http.StatusBadRequest},
+		{"strict non-numeric", strict, map[string]string{"rows": "1.5"}, 0, http.StatusBadRequest},
+		{"strict negative", strict, map[string]string{"rows": "-3"}, 0, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := &config.RuleSet{
+				Endpoints: map[string]config.EndpointConfig{
+					"/api/export": {Rule: "endpoint", Cost: 5, GlobalCapacity: 10000, GlobalRefillRate: 1000, CostFrom: &tt.costFrom},
+				},
+			}
+			mockStorage := new(MockRedisStorage)
+			mockStorage.On("AtomicTokenBucket", "endpoint:/api/export", int64(10000), float64(1000), tt.wantCost, time.Hour).
+				Return(storage.BucketResult{Allowed: true}, nil)
+
+			handler := NewRateLimiterHandler(mockStorage, rules)
+			resp, err := handler.Check(CheckRequest{Key: "user123", Endpoint: "/api/export", Metadata: tt.metadata})
+
+			if tt.wantStatus != 0 {
+				reqErr, ok := err.(*RequestError)
+				if !ok || reqErr.Status != tt.wantStatus || reqErr.Details["field"] != "rows" {
+					t.Fatalf("expected a %d request error naming the field, got %v", tt.wantStatus, err)
+				}
+				mockStorage.AssertNotCalled(t, "AtomicTokenBucket", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			mockStorage.AssertExpectations(t)
+			if resp.Cost != tt.wantCost {
+				t.Errorf("expected the response to echo cost %d, got %d", tt.wantCost, resp.Cost)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+func TestCheckHandler_DenyReason(t *testing.T) {
+	rules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{"free": {Capacity: 10, RefillRate: 0.001}},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/upload": {Rule: "tiers+endpoints", Cost: 10, GlobalCapacity: 25, GlobalRefillRate: 0.001},
+		},
+	}
+	handler := NewRateLimiterHandler(storage.NewMemoryStorage(), rules)
+	router := gin.New()
+	router.POST("/check", handler.CheckHandler)
+	check := func(key string) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/check",
+			strings.NewReader(`{"key": "`+key+`", "endpoint": "/api/upload", "user_tier": "free"}`)))
+		var body map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("failed to parse response: %v", err)
+		}
+		return w.Code, body
+	}
+
+	if code, body := check("alice"); code != http.StatusOK || body["deny_reason"] != nil {
+		t.Fatalf("expected an allowed check without a reason, got %d %v", code, body)
+	}
+	if code, body := check("alice"); code != http.StatusTooManyRequests || body["deny_reason"] != "insufficient_user_tokens" {
+		t.Errorf("expected alice's own bucket to deny, got %d %v", code, body)
+	}
+	check("bob")
+	if code, body := check("carol"); code != http.StatusTooManyRequests || body["deny_reason"] != "insufficient_global_tokens" {
+		t.Errorf("expected the global bucket to deny carol, got %d %v", code, body)
+	}
+}
@@ -1,146 +1,812 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AndySung320/rate-limiter/config"
 	"github.com/AndySung320/rate-limiter/internal/storage"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
 type CheckRequest struct {
 	Key      string `json:"key" binding:"required"`
 	Endpoint string `json:"endpoint" binding:"required"`
-	// Cost      int               `json:"cost" binding:"required"`
+	// Cost overrides the endpoint's cost when positive, e.g. an upload's size
+	Cost int64 `json:"cost,omitempty"`
+	// Costs charges the endpoint's named resources, e.g. {"tokens": 812};
+	// resources left out are charged their configured cost
+	Costs     map[string]int64  `json:"costs,omitempty"`
 	UserTier  string            `json:"user_tier,omitempty"`  // Optional
 	IPAddress string            `json:"ip_address,omitempty"` // Optional
 	Metadata  map[string]string `json:"metadata,omitempty"`   // Flexible attributes
+	Namespace string            `json:"namespace,omitempty"`  // Isolates buckets, e.g. "staging"; defaults to the server namespace
+	// Header holds the HTTP request headers when the check arrives over HTTP
+	Header http.Header `json:"-"`
+	// RequestID ties the check's log lines and audit entry together. Over
+	// HTTP it is the X-Request-ID; otherwise one is generated
+	RequestID string `json:"-"`
 }
 
 type CheckResponse struct {
-	Allowed         bool  `json:"allowed"`
+	Allowed bool `json:"allowed"`
+	// UserRemaining is the balance of the per-key bucket: the user's for
+	// tiers+endpoints and user+ip rules and the IP's for IP+endpoints rules.
+	// It is 0 for endpoint rules, which have no per-key bucket
 	UserRemaining   int64 `json:"userRemaining"`
 	GlobalRemaining int64 `json:"globalRemaining"`
+	// IPRemaining is the balance of the IP bucket of user+ip rules, which
+	// have no global bucket
+	IPRemaining *int64 `json:"ipRemaining,omitempty"`
+	// RetryAfterMs is the time until the cost is affordable; -1 means never
+	RetryAfterMs int64 `json:"retryAfterMs,omitempty"`
+	// WouldDeny is set when a dry-run endpoint let through a request it would have denied
+	WouldDeny bool `json:"wouldDeny,omitempty"`
+	// InDebt is set when the user bucket borrowed against the tier's max_debt;
+	// UserRemaining is then negative
+	InDebt bool `json:"inDebt,omitempty"`
+	// Penalized is set while the key is under a penalty for repeated denials,
+	// which ends at PenaltyEndsAtUnixMs
+	Penalized           bool  `json:"penalized,omitempty"`
+	PenaltyEndsAtUnixMs int64 `json:"penaltyEndsAtUnixMs,omitempty"`
+	// ResetAtUnixMs is when the bucket Limit describes will be full again
+	// at SustainedRate. The balance is counted in whole tokens, so it may be
+	// up to one token's refill late. It is unset when storage was degraded
+	ResetAtUnixMs int64 `json:"resetAtUnixMs,omitempty"`
+	// Limit is the configured capacity, or burst, of the bucket the rule
+	// limits by (the tier, IP or endpoint bucket), SustainedRate its refill
+	// rate in tokens per second, and Tier the tier it ran under, if any
+	Limit         int64   `json:"limit"`
+	SustainedRate float64 `json:"sustainedRate"`
+	Tier          string  `json:"tier,omitempty"`
+	// ResourceRemaining is the balance of each named resource bucket
+	ResourceRemaining map[string]int64 `json:"resourceRemaining,omitempty"`
+	// Degraded is set when storage could only check one of the rule's two
+	// buckets; see storage.PartialFailureMode
+	Degraded bool `json:"degraded,omitempty"`
+	// ShadowDenied is set when shadow mode let through a request the limits
+	// would have denied
+	ShadowDenied bool `json:"shadow_denied,omitempty"`
+	// QuotaRemaining is what is left of the tier or endpoint quota closest to
+	// running out, and QuotaResetsAt when its window starts over
+	QuotaRemaining *int64     `json:"quota_remaining,omitempty"`
+	QuotaResetsAt  *time.Time `json:"quota_resets_at,omitempty"`
+	// WindowCapRemaining is what is left of the endpoint's window_cap in the
+	// current window, and WindowCapResetsAt when the next one starts
+	WindowCapRemaining *int64     `json:"window_cap_remaining,omitempty"`
+	WindowCapResetsAt  *time.Time `json:"window_cap_resets_at,omitempty"`
+	// Schedules names the endpoint and tier schedules whose limits applied
+	Schedules []string `json:"schedules,omitempty"`
+	// IPOverride is the address or range of the ip_overrides entry whose
+	// limits replaced the ips section's
+	IPOverride string `json:"ip_override,omitempty"`
+	// DenyReason says why a tiers+endpoints or IP+endpoints check was
+	// denied; see storage.DenyReason. Dry-run and shadow responses keep it
+	// to say why they would have denied
+	DenyReason storage.DenyReason `json:"deny_reason,omitempty"`
+	// Cost is what the check charged, or would have charged when denied,
+	// so clients can verify costs derived from their metadata
+	Cost int64 `json:"cost"`
+	// LimitingDisabled is set when the endpoint's limit_enabled is false, so
+	// the request was allowed without being checked
+	LimitingDisabled bool `json:"limiting_disabled,omitempty"`
 }
 
 type RateLimiterHandler struct {
-	storage storage.Storage
-	rules   *config.RuleSet
+	storage   storage.Storage
+	rules     atomic.Pointer[config.RuleSet] // Swapped by SetRules on reload
+	keys      KeyTransformer
+	costs     CostCalculator
+	tiers     TierExtractor  // Optional; consulted when a request has no user_tier
+	tierCache sync.Map       // Key -> tierCacheEntry, for rules.TierLookup
+	jwt       TokenVerifier  // Optional; takes /check keys from bearer tokens
+	waitSlots chan struct{}  // Bounds concurrent /wait requests that are sleeping
+	shadow    bool           // Allow every request, recording the ones limits would deny
+	verbose   bool           // Log every check's keys and balances
+	clock     ClockFunc      // Picks peak_hours limits and reset times; time.Now unless overridden
+	publisher RulesPublisher // Optional; serves /admin/rules
+	auditLog  AuditLogger    // Optional; records every decision
+	notifier  Notifier       // Optional; told about bans and exhausted quotas
+}
+
+// ClockFunc returns the current time. Tests override it to pin the time
+// peak_hours windows are judged against and reset times count from, and
+// pass the same one to the storage to control refills too.
+type ClockFunc = storage.ClockFunc
+
+// HandlerOptions customizes a RateLimiterHandler. Zero fields use defaults.
+type HandlerOptions struct {
+	// KeyTransformer derives bucket keys; defaults to DefaultKeyTransformer
+	KeyTransformer KeyTransformer
+	// CostCalculator derives each request's cost; defaults to FixedCostCalculator
+	CostCalculator CostCalculator
+	// TierExtractor supplies the tier for requests without user_tier
+	TierExtractor TierExtractor
+	// TokenVerifier requires a bearer token on /check, whose claims supply
+	// the key and tier as configured in the rule set's jwt section
+	TokenVerifier TokenVerifier
+	// ShadowMode evaluates and charges every check as usual but never denies
+	// one, like dry_run on every endpoint. Would-be denials are logged,
+	// counted in rate_limiter_shadow_denied_total and flagged shadow_denied,
+	// e.g. to watch a new limiter's decisions before it enforces them.
+	ShadowMode bool
+	// Verbose logs the keys, limits and balances of every check. It is off
+	// by default, as several lines per request flood logs at high rates
+	Verbose bool
+	// ClockFunc supplies the time of day for endpoints with peak_hours and
+	// for resetAtUnixMs; defaults to time.Now. Refills follow the storage's
+	// own clock, e.g. MemoryOptions.Clock
+	ClockFunc ClockFunc
+	// RulesPublisher stores rules published through /admin/rules for every
+	// replica to load
+	RulesPublisher RulesPublisher
+	// AuditLogger records every decision, allowed or denied, e.g. to a
+	// FileAuditLogger. Checks that fail before a decision aren't recorded
+	AuditLogger AuditLogger
+	// Notifier is told when a key is penalized or runs out of quota, for
+	// the rules' webhook section
+	Notifier Notifier
 }
 
 func NewRateLimiterHandler(storage storage.Storage, rules *config.RuleSet) *RateLimiterHandler {
-	return &RateLimiterHandler{
-		storage: storage,
-		rules:   rules,
+	return NewRateLimiterHandlerWithOptions(storage, rules, HandlerOptions{})
+}
+
+func NewRateLimiterHandlerWithOptions(storage storage.Storage, rules *config.RuleSet, opts HandlerOptions) *RateLimiterHandler {
+	keys := opts.KeyTransformer
+	if keys == nil {
+		keys = DefaultKeyTransformer{}
+	}
+	costs := opts.CostCalculator
+	if costs == nil {
+		costs = FixedCostCalculator{}
+	}
+	clock := opts.ClockFunc
+	if clock == nil {
+		clock = time.Now
+	}
+	h := &RateLimiterHandler{
+		storage:   storage,
+		keys:      keys,
+		costs:     costs,
+		tiers:     opts.TierExtractor,
+		jwt:       opts.TokenVerifier,
+		waitSlots: make(chan struct{}, defaultMaxWaiters),
+		shadow:    opts.ShadowMode,
+		verbose:   opts.Verbose,
+		clock:     clock,
+		publisher: opts.RulesPublisher,
+		auditLog:  opts.AuditLogger,
+		notifier:  opts.Notifier,
+	}
+	h.rules.Store(rules)
+	return h
+}
+
+// globalLimits returns the capacity and refill rate of ep's global bucket
+// right now: its peak_hours limits inside that window, otherwise its own.
+func (h *RateLimiterHandler) globalLimits(ep config.EndpointConfig) (int64, float64, error) {
+	if peak := ep.PeakHours; peak != nil {
+		inPeak, err := config.IsInPeakHours(h.clock(), peak.Start, peak.End)
+		if err != nil {
+			return 0, 0, fmt.Errorf("peak_hours: %w", err)
+		}
+		if inPeak {
+			return peak.Capacity, peak.RefillRate, nil
+		}
 	}
+	return ep.GlobalCapacity, ep.GlobalRefillRate, nil
+}
+
+// Rules returns the rule set currently in effect.
+func (h *RateLimiterHandler) Rules() *config.RuleSet {
+	return h.rules.Load()
+}
+
+// SetRules atomically replaces the rule set, e.g. after a config reload.
+// Checks already running finish under the rules they started with. Callers
+// must validate rules first.
+func (h *RateLimiterHandler) SetRules(rules *config.RuleSet) {
+	h.rules.Store(rules)
+	// Tier lookups may now use a different default tier or cache TTL
+	h.tierCache.Clear()
 }
 
 func (h *RateLimiterHandler) CheckHandler(c *gin.Context) {
-	var req CheckRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	req, ok := h.bindCheckRequest(c)
+	if !ok {
 		return
 	}
 
-	ep, ok := h.rules.Endpoints[req.Endpoint]
+	resp, ok := h.evaluate(c, req)
 	if !ok {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown endpoint"})
 		return
 	}
+	h.debugf("[%s] allowed=%v, userRemaining=%d, globalRemaining=%d", contextRequestID(c), resp.Allowed, resp.UserRemaining, resp.GlobalRemaining)
+	setLimitHeaders(c, resp)
+	if !resp.Allowed {
+		c.JSON(http.StatusTooManyRequests, resp)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// RequestError is a problem with a check request itself, as opposed to a
+// storage failure. It maps to a 4xx response.
+type RequestError struct {
+	Status  int
+	Message string
+	Details gin.H // Extra fields included in the error body
+}
+
+func (e *RequestError) Error() string {
+	return e.Message
+}
+
+// CostHeader carries a request's cost for callers without a JSON body to
+// put it in, such as middleware guarding GET requests. A cost in the body
+// takes precedence.
+const CostHeader = "X-RateLimit-Cost"
+
+// headerCost parses a CostHeader value, returning 0 when it is empty.
+// Anything but a positive integer is a *RequestError.
+func headerCost(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	cost, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || cost <= 0 {
+		return 0, &RequestError{
+			Status:  http.StatusBadRequest,
+			Message: "invalid " + CostHeader + " header: must be a positive integer",
+			Details: gin.H{"value": value},
+		}
+	}
+	return cost, nil
+}
+
+// withRequestHeaders fills in what req takes from c's HTTP headers.
+func withRequestHeaders(c *gin.Context, req CheckRequest) (CheckRequest, error) {
+	req.Header = c.Request.Header
+	req.RequestID = contextRequestID(c)
+	cost, err := headerCost(c.GetHeader(CostHeader))
+	if err != nil {
+		return req, err
+	}
+	if req.Cost == 0 {
+		req.Cost = cost
+	}
+	return req, nil
+}
+
+// evaluate runs Check for req. When it returns false an error response has
+// already been written to c.
+func (h *RateLimiterHandler) evaluate(c *gin.Context, req CheckRequest) (CheckResponse, bool) {
+	req, err := withRequestHeaders(c, req)
+	if err != nil {
+		writeCheckError(c, err)
+		return CheckResponse{}, false
+	}
+	resp, err := h.Check(req)
+	if err != nil {
+		writeCheckError(c, err)
+		return CheckResponse{}, false
+	}
+	return resp, true
+}
+
+// writeCheckError writes the response for an error returned by Check.
+func writeCheckError(c *gin.Context, err error) {
+	var reqErr *RequestError
+	if errors.As(err, &reqErr) {
+		body := gin.H{"error": reqErr.Message}
+		for k, v := range reqErr.Details {
+			body[k] = v
+		}
+		c.JSON(reqErr.Status, body)
+		return
+	}
+	log.Printf("❌ [%s] Check failed: %v", contextRequestID(c), err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Rate limiter unavailable"})
+}
+
+// Check runs the endpoint's rule for req against storage. Invalid requests
+// return a *RequestError; any other error means storage was unavailable.
+func (h *RateLimiterHandler) Check(req CheckRequest) (CheckResponse, error) {
+	return h.check(req, nil)
+}
+
+// reservation marks a check whose tokens are held until committed or
+// released instead of being consumed outright.
+type reservation struct {
+	id   string
+	hold time.Duration
+}
+
+// check runs Check, reserving the tokens under res when it is non-nil.
+func (h *RateLimiterHandler) check(req CheckRequest, res *reservation) (CheckResponse, error) {
+	rules := h.Rules()
+	matched, ok := rules.FindEndpoint(req.Endpoint)
+	if !ok {
+		return CheckResponse{}, &RequestError{Status: http.StatusBadRequest, Message: "unknown endpoint"}
+	}
+	// Paths under a prefix or regex endpoint share its buckets, except the
+	// global ones a global_key splits up by what the pattern captured
+	ep := matched.Config
+	req.Endpoint = matched.Path
+	if req.RequestID == "" {
+		req.RequestID = uuid.NewString()
+	}
+	requestID := req.RequestID
+	if !ep.Limited() {
+		h.debugf("⏸️ [%s] Limiting disabled - key: %s, endpoint: %s", requestID, req.Key, req.Endpoint)
+		resp := CheckResponse{Allowed: true, LimitingDisabled: true}
+		h.audit(req, resp, ep.Rule, 0)
+		return resp, nil
+	}
+	bucketPath := matched.BucketPath()
+	// Schedules are judged once per check so every bucket sees the same hour
+	now, loc := h.clock(), rules.ScheduleLocation()
+	var schedules []string
+	ep, schedule := ep.Scheduled(now, loc)
+	if schedule != "" {
+		schedules = append(schedules, schedule)
+	}
 
-	// log.Printf("DEBUG: ep = %+v", ep)
-	// log.Printf("DEBUG: req.UserTier = %s", req.UserTier)
-	// log.Printf("DEBUG: h.rules.Tiers = %+v", h.rules.Tiers)
+	namespace := req.Namespace
+	if namespace == "" {
+		namespace = rules.Namespace
+	}
+	if !config.ValidNamespace(namespace) {
+		return CheckResponse{}, &RequestError{Status: http.StatusBadRequest, Message: "invalid namespace"}
+	}
+
+	tier, err := h.requestTier(rules, ep, req)
+	if err != nil {
+		return CheckResponse{}, err
+	}
+	req.UserTier = tier
+	// key_fields split the per-key buckets; the key itself is logged as sent
+	bucketKey, err := keyWithFields(req.Key, ep.KeyFields, req.Metadata)
+	if err != nil {
+		return CheckResponse{}, err
+	}
 
 	rule := ep.Rule
-	globalKey := fmt.Sprintf("global:%s", req.Endpoint)
-	cost := ep.Cost
-	globalCapacity := h.rules.Endpoints[req.Endpoint].GlobalCapacity
-	globalRefillrate := h.rules.Endpoints[req.Endpoint].GlobalRefillRate
-	var allowed bool
-	var userRemaining, globalRemaining int64
-	var err error
+	globalKey := namespacedKey(namespace, h.keys.TransformGlobalKey(bucketPath))
+	cost, err := h.requestCost(ep, req)
+	if err != nil {
+		return CheckResponse{}, err
+	}
+	if err := validateResourceCosts(ep, req.Costs); err != nil {
+		return CheckResponse{}, err
+	}
+	if res != nil && len(ep.Resources) > 0 {
+		return CheckResponse{}, &RequestError{Status: http.StatusBadRequest, Message: "reservations are not supported on endpoints with resources"}
+	}
+	if res != nil && ep.Rule == "user+ip" {
+		return CheckResponse{}, &RequestError{Status: http.StatusBadRequest, Message: "reservations are not supported for the user+ip rule"}
+	}
+	if res != nil && ep.InitialTokens != nil {
+		return CheckResponse{}, errInitialReservation
+	}
+	globalCapacity, globalRefillrate, err := h.globalLimits(ep)
+	if err != nil {
+		return CheckResponse{}, fmt.Errorf("endpoint %s: %w", req.Endpoint, err)
+	}
+	var result storage.BucketResult
+	var userRemaining, globalRemaining, limit int64
+	var sustainedRate float64
+	var ipRemaining *int64
+	var tierName string
+	var ipOverride string
+	var resourceNames []string
+	var penalizedUntil time.Time
+	var quotas []storage.Quota
+	// Endpoint quotas count against the global bucket whatever the rule
+	globalQuotaKey := namespacedKey(namespace, "quota:"+h.keys.TransformGlobalKey(bucketPath))
 	switch rule {
 	case "tiers+endpoints":
 		// Validate user tier exists
-		tier, hasTier := h.rules.Tiers[req.UserTier]
+		tier, hasTier := rules.Tiers[req.UserTier]
 		if !hasTier {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error":       "invalid user_tier",
-				"provided":    req.UserTier,
-				"valid_tiers": getValidTiers(h.rules.Tiers), // Helper function
-			})
-			return
+			return CheckResponse{}, invalidTierError(rules, req.UserTier)
+		}
+		tier, schedule := tier.Scheduled(now, loc)
+		if schedule != "" {
+			schedules = append(schedules, schedule)
+		}
+		if res != nil && tier.InitialTokens != nil {
+			return CheckResponse{}, errInitialReservation
 		}
-		userKey := fmt.Sprintf("user:%s:%s:%s", req.Key, req.Endpoint, req.UserTier)
+		transformedUserKey := h.keys.TransformUserKey(bucketKey, req.Endpoint, req.UserTier)
+		userKey := namespacedKey(namespace, transformedUserKey)
 		userRefillrate := tier.RefillRate
-		userCapacity := tier.Capacity
-		log.Printf("user key: %s, user refill rate: %d, user capacity: %d", userKey, userRefillrate, userCapacity)
-		requestID := fmt.Sprintf("%d", time.Now().UnixNano())
-		log.Printf("🔄 [%s] Request START - key: %s, cost: %d", requestID, globalKey, cost)
-		allowed, userRemaining, globalRemaining, err = h.storage.AtomicDualBucket(userKey, globalKey, globalCapacity, globalRefillrate, userCapacity, userRefillrate, cost, time.Hour)
-		log.Printf("💾 [%s] WRITE to Redis - userTokens: %d, endpointTokens: %d, allowed: %v", requestID, userRemaining, globalRemaining, allowed)
-		log.Printf("✅ Request COMPLETE - userRemaining: %d globalRemaining: %d", userRemaining, globalRemaining)
+		userCapacity := tier.EffectiveCapacity()
+		limit, sustainedRate, tierName = userCapacity, userRefillrate, req.UserTier
+		// A split global bucket charges the tier's own part of it
+		globalInitial := ep.InitialTokens
+		if capacity, rate, ok := ep.TierShare(req.UserTier, globalCapacity, globalRefillrate); ok {
+			globalKey = fmt.Sprintf("%s:tier:%s", globalKey, req.UserTier)
+			globalCapacity, globalRefillrate = capacity, rate
+			if globalInitial != nil {
+				initial, _, _ := ep.TierShare(req.UserTier, *globalInitial, 0)
+				globalInitial = &initial
+			}
+		}
+		var resources []storage.ResourceBucket
+		resources, resourceNames = resourceBuckets(ep, req, userKey)
+		quotas, err = quotaCounters(&tier, namespacedKey(namespace, "quota:"+transformedUserKey), ep, globalQuotaKey, now)
+		if err != nil {
+			return CheckResponse{}, fmt.Errorf("rate limiter unavailable: %w", err)
+		}
+		if res != nil && len(quotas) > 0 {
+			return CheckResponse{}, errQuotaReservation
+		}
+		h.debugf("[%s] user key: %s, user refill rate: %g, user capacity: %d", requestID, userKey, userRefillrate, userCapacity)
+		h.debugf("🔄 [%s] Request START - key: %s, cost: %d", requestID, globalKey, cost)
+		result, penalizedUntil, err = h.penalizedDualBucket(res, req, ep.DryRun || h.shadow, userKey, globalKey, globalCapacity, globalRefillrate, userCapacity, userRefillrate, tier.MaxDebt, cost, resources, quotas,
+			bucketStart{user: tier.InitialTokens, global: globalInitial},
+			max(bucketTTL(globalCapacity, globalRefillrate), bucketTTL(userCapacity, userRefillrate)))
+		userRemaining, globalRemaining = result.Remaining, result.GlobalRemaining
+		h.debugf("💾 [%s] WRITE to Redis - userTokens: %d, endpointTokens: %d, allowed: %v", requestID, userRemaining, globalRemaining, result.Allowed)
+		h.debugf("✅ [%s] Request COMPLETE - userRemaining: %d globalRemaining: %d", requestID, userRemaining, globalRemaining)
 
 	case "IP+endpoints":
 		if req.IPAddress == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "ip_address required for this endpoint"})
-			return
+			return CheckResponse{}, &RequestError{Status: http.StatusBadRequest, Message: "ip_address required for this endpoint"}
 		}
 
-		ipKey := fmt.Sprintf("ip:%s:%s", req.IPAddress, req.Endpoint)
-		ipCapacity := h.rules.IPs.Capacity
-		ipRefillrate := h.rules.IPs.RefillRate
+		ipKey := namespacedKey(namespace, fmt.Sprintf("ip:%s:%s", req.IPAddress, req.Endpoint))
+		ipCapacity := rules.IPs.Capacity
+		ipRefillrate := rules.IPs.RefillRate
+		if override, ok := rules.FindIPOverride(req.IPAddress); ok {
+			ipOverride = override.Address
+			h.debugf("[%s] ip override %s applies to %s", requestID, override.Address, req.IPAddress)
+			if override.Unlimited {
+				result = storage.BucketResult{Allowed: true}
+				break
+			}
+			ipCapacity, ipRefillrate = override.Capacity, override.RefillRate
+		}
+		limit, sustainedRate = ipCapacity, ipRefillrate
+		quotas, err = quotaCounters(nil, "", ep, globalQuotaKey, now)
+		if err != nil {
+			return CheckResponse{}, fmt.Errorf("rate limiter unavailable: %w", err)
+		}
+		if res != nil && len(quotas) > 0 {
+			return CheckResponse{}, errQuotaReservation
+		}
 		// Reuse your AtomicDualBucket with IP instead of user
-		var ipRemaining int64
-		allowed, ipRemaining, globalRemaining, err = h.storage.AtomicDualBucket(
+		result, penalizedUntil, err = h.penalizedDualBucket(res, req, ep.DryRun || h.shadow,
 			ipKey, globalKey,
 			globalCapacity, globalRefillrate,
 			ipCapacity, ipRefillrate, // Need to define IP limits in config
-			cost, time.Hour,
+			0, cost, nil, quotas, bucketStart{global: ep.InitialTokens}, max(bucketTTL(globalCapacity, globalRefillrate), bucketTTL(ipCapacity, ipRefillrate)),
 		)
-		requestID := fmt.Sprintf("%d", time.Now().UnixNano())
-		log.Printf("🔄 [%s] Request START - key: %s, cost: %d", requestID, globalKey, cost)
-		log.Printf("💾 [%s] WRITE to Redis - ipTokens: %d, endpointTokens: %d, allowed: %v", requestID, ipRemaining, globalRemaining, allowed)
-		log.Printf("✅ Request COMPLETE - ipRemaining: %d globalRemaining: %d", ipRemaining, globalRemaining)
+		// The IP bucket is this rule's per-key bucket
+		userRemaining, globalRemaining = result.Remaining, result.GlobalRemaining
+		ipRemaining := userRemaining
+		h.debugf("🔄 [%s] Request START - key: %s, cost: %d", requestID, globalKey, cost)
+		h.debugf("💾 [%s] WRITE to Redis - ipTokens: %d, endpointTokens: %d, allowed: %v", requestID, ipRemaining, globalRemaining, result.Allowed)
+		h.debugf("✅ [%s] Request COMPLETE - ipRemaining: %d globalRemaining: %d", requestID, ipRemaining, globalRemaining)
+
+	case "user+ip":
+		tier, hasTier := rules.Tiers[req.UserTier]
+		if !hasTier {
+			return CheckResponse{}, invalidTierError(rules, req.UserTier)
+		}
+		tier, schedule := tier.Scheduled(now, loc)
+		if schedule != "" {
+			schedules = append(schedules, schedule)
+		}
+		if req.IPAddress == "" {
+			return CheckResponse{}, &RequestError{Status: http.StatusBadRequest, Message: "ip_address required for this endpoint"}
+		}
+		userKey := namespacedKey(namespace, h.keys.TransformUserKey(bucketKey, req.Endpoint, req.UserTier))
+		ipKey := namespacedKey(namespace, fmt.Sprintf("ip:%s:%s", req.IPAddress, req.Endpoint))
+		userCapacity := tier.EffectiveCapacity()
+		limit, sustainedRate, tierName = userCapacity, tier.RefillRate, req.UserTier
+		ipCapacity := rules.IPs.Capacity
+		ipRefillrate := rules.IPs.RefillRate
+		if override, ok := rules.FindIPOverride(req.IPAddress); ok {
+			ipOverride = override.Address
+			h.debugf("[%s] ip override %s applies to %s", requestID, override.Address, req.IPAddress)
+			if override.Unlimited {
+				result = storage.BucketResult{Allowed: true}
+				break
+			}
+			ipCapacity, ipRefillrate = override.Capacity, override.RefillRate
+		}
+		ttl := max(bucketTTL(userCapacity, tier.RefillRate), bucketTTL(ipCapacity, ipRefillrate))
+		h.debugf("🔄 [%s] Request START - key: %s, ip key: %s, cost: %d", requestID, userKey, ipKey, cost)
+		result, penalizedUntil, err = h.penalized(req, ep.DryRun || h.shadow, userKey, userCapacity, tier.RefillRate, tier.MaxDebt, func(userCap int64, userRate float64, userMaxDebt int64) (storage.BucketResult, error) {
+			return h.storage.AtomicUserIPBucket(userKey, ipKey, userCap, userRate, userMaxDebt, ipCapacity, ipRefillrate, cost, ttl)
+		})
+		userRemaining, ipRemaining = result.Remaining, &result.IPRemaining
+		h.debugf("✅ [%s] Request COMPLETE - userRemaining: %d ipRemaining: %d allowed: %v", requestID, userRemaining, result.IPRemaining, result.Allowed)
 
 	case "endpoint":
-		endpointKey := fmt.Sprintf("endpoint:%s", req.Endpoint)
-		log.Printf("endPoint key: %s, endPoint refill rate: %d, global capacity: %d", endpointKey, globalRefillrate, globalCapacity)
-		requestID := fmt.Sprintf("%d", time.Now().UnixNano())
-		log.Printf("🔄 [%s] Request START - key: %s, cost: %d", requestID, globalKey, cost)
-		allowed, globalRemaining, err = h.storage.AtomicTokenBucket(endpointKey, globalCapacity, globalRefillrate, cost, time.Hour)
-		log.Printf("💾 [%s] WRITE to Redis - endPointTokens: %d, allowed: %v", requestID, globalRemaining, allowed)
-		log.Printf("✅ Request COMPLETE - globalRemaining: %d", globalRemaining)
-	}
-
-	// Create bucket key (user:endpoint)
-	// bucketKey := req.Key + ":" + req.Endpoint
-	// Create Redis bucket with default settings
-	// TODO: Make these configurable later
-
-	// endPointBucket := ratelimit.NewRedisBucket(req.Endpoint, endPointCapacity, endPointRefillrate, h.storage)
-	// userBucket := ratelimit.NewRedisBucket(bucketKey, userCapacity, userRefillrate, h.storage)
-	// allowed, remaining, err := bucket.Allow(req.Cost)
+		endpointKey := namespacedKey(namespace, fmt.Sprintf("endpoint:%s", bucketPath))
+		limit, sustainedRate = globalCapacity, globalRefillrate
+		h.debugf("[%s] endPoint key: %s, endPoint refill rate: %g, global capacity: %d", requestID, endpointKey, globalRefillrate, globalCapacity)
+		h.debugf("🔄 [%s] Request START - key: %s, cost: %d", requestID, globalKey, cost)
+		quotas, err = quotaCounters(nil, "", ep, globalQuotaKey, now)
+		if err != nil {
+			return CheckResponse{}, fmt.Errorf("rate limiter unavailable: %w", err)
+		}
+		if len(quotas) > 0 {
+			if res != nil {
+				return CheckResponse{}, errQuotaReservation
+			}
+			result, err = h.storage.AtomicQuotaBucket(endpointKey, "", 0, 0, globalCapacity, globalRefillrate, 0, cost, quotas, bucketTTL(globalCapacity, globalRefillrate))
+		} else {
+			result, err = h.tokenBucket(res, endpointKey, globalCapacity, globalRefillrate, ep.InitialTokens, cost, bucketTTL(globalCapacity, globalRefillrate))
+		}
+		globalRemaining = result.Remaining
+		h.debugf("💾 [%s] WRITE to Redis - endPointTokens: %d, allowed: %v", requestID, globalRemaining, result.Allowed)
+		h.debugf("✅ [%s] Request COMPLETE - globalRemaining: %d", requestID, globalRemaining)
+	}
+
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Rate limiter unavailable"})
-		return
+		return CheckResponse{}, fmt.Errorf("rate limiter unavailable: %w", err)
+	}
+	if len(schedules) > 0 {
+		h.debugf("[%s] schedules: %s", requestID, strings.Join(schedules, ", "))
 	}
 
 	resp := CheckResponse{
-		Allowed:         allowed,
+		Allowed:         result.Allowed,
 		UserRemaining:   userRemaining,
 		GlobalRemaining: globalRemaining,
+		IPRemaining:     ipRemaining,
+		RetryAfterMs:    result.RetryAfter.Milliseconds(),
+		InDebt:          userRemaining < 0,
+		Limit:           limit,
+		SustainedRate:   sustainedRate,
+		Tier:            tierName,
+		Degraded:        result.Degraded,
+		Schedules:       schedules,
+		IPOverride:      ipOverride,
+		DenyReason:      result.Reason,
+		Cost:            cost,
 	}
-	log.Printf("allowed=%v, userRemaining=%d, globalRemaining=%d\n", allowed, userRemaining, globalRemaining)
-	if !resp.Allowed {
-		c.JSON(http.StatusTooManyRequests, resp)
+	if !result.Degraded && sustainedRate > 0 {
+		// Endpoint rules limit by the global bucket, the others by the per-key one
+		remaining := userRemaining
+		if rule == "endpoint" {
+			remaining = globalRemaining
+		}
+		resp.ResetAtUnixMs = resetAt(h.clock(), limit, sustainedRate, remaining).UnixMilli()
+	}
+	if len(quotas) > 0 {
+		applyQuotas(&resp, ep, result.Quotas)
+		if !result.Allowed && !ep.DryRun && !h.shadow && quotaExhausted(result.Quotas, cost) {
+			h.notify(config.EventQuotaExceeded, req, map[string]any{"cost": cost})
+		}
+	}
+	if len(resourceNames) > 0 && len(result.Resources) == len(resourceNames) {
+		resp.ResourceRemaining = make(map[string]int64, len(resourceNames))
+		for i, name := range resourceNames {
+			resp.ResourceRemaining[name] = result.Resources[i]
+		}
+	}
+	if !penalizedUntil.IsZero() {
+		resp.Penalized = true
+		resp.PenaltyEndsAtUnixMs = penalizedUntil.UnixMilli()
+	}
+	if ep.DryRun && !resp.Allowed {
+		log.Printf("🧪 [%s] DRY RUN would deny - key: %s, endpoint: %s, tier: %s", requestID, req.Key, req.Endpoint, req.UserTier)
+		resp.Allowed = true
+		resp.WouldDeny = true
+		resp.RetryAfterMs = 0
+	}
+	if h.shadow && !resp.Allowed {
+		log.Printf("👻 [%s] SHADOW would deny key=%q endpoint=%q tier=%q namespace=%q cost=%d retryAfterMs=%d",
+			requestID, req.Key, req.Endpoint, req.UserTier, namespace, cost, resp.RetryAfterMs)
+		shadowDeniedTotal.WithLabelValues(req.Endpoint, req.UserTier).Inc()
+		resp.Allowed = true
+		resp.ShadowDenied = true
+		resp.RetryAfterMs = 0
+	}
+	h.audit(req, resp, rule, cost)
+	return resp, nil
+}
+
+// requestTier is the tier req is checked as on ep: the stored tier when
+// tier_lookup applies, or else the request's, or one the TierExtractor
+// finds when it has none.
+func (h *RateLimiterHandler) requestTier(rules *config.RuleSet, ep config.EndpointConfig, req CheckRequest) (string, error) {
+	if rules.TierLookup.Enabled && (ep.Rule == "tiers+endpoints" || ep.Rule == "user+ip") {
+		return h.resolveTier(req)
+	}
+	if req.UserTier == "" && h.tiers != nil {
+		if tier, ok := h.tiers.ExtractTier(req); ok {
+			return tier, nil
+		}
+	}
+	return req.UserTier, nil
+}
+
+// requestCost is what req is charged on ep: its own cost or the
+// endpoint's, taken from its metadata under cost_from, as the
+// CostCalculator adjusts it, within max_cost.
+func (h *RateLimiterHandler) requestCost(ep config.EndpointConfig, req CheckRequest) (int64, error) {
+	cost := ep.Cost
+	if ep.CostFrom != nil {
+		var err error
+		if cost, err = metadataCost(*ep.CostFrom, ep.Cost, req.Metadata); err != nil {
+			return 0, err
+		}
+	}
+	if req.Cost < 0 {
+		return 0, &RequestError{Status: http.StatusBadRequest, Message: "cost must not be negative"}
+	}
+	if req.Cost > 0 {
+		if ep.MaxCost > 0 && req.Cost > ep.MaxCost {
+			return 0, &RequestError{
+				Status:  http.StatusBadRequest,
+				Message: "cost exceeds max_cost",
+				Details: gin.H{"cost": req.Cost, "max_cost": ep.MaxCost},
+			}
+		}
+		cost = req.Cost
+	}
+	cost, err := h.costs.ComputeCost(cost, req)
+	if err != nil {
+		return 0, &RequestError{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+	if cost < 0 {
+		return 0, &RequestError{Status: http.StatusBadRequest, Message: "cost must not be negative"}
+	}
+	// A calculated cost never exceeds the endpoint's cap
+	if ep.MaxCost > 0 && cost > ep.MaxCost {
+		cost = ep.MaxCost
+	}
+	return cost, nil
+}
+
+// debugf logs a line about a single check when the handler is verbose.
+func (h *RateLimiterHandler) debugf(format string, args ...any) {
+	if h.verbose {
+		log.Printf(format, args...)
+	}
+}
+
+// resetAt is when a bucket of capacity holding remaining tokens, refilling
+// at rate tokens per second, will be full again.
+func resetAt(now time.Time, capacity int64, rate float64, remaining int64) time.Time {
+	if remaining >= capacity {
+		return now
+	}
+	return now.Add(time.Duration(math.Ceil(float64(capacity-remaining)*1000/rate)) * time.Millisecond)
+}
+
+// invalidTierError rejects a user_tier that is not configured.
+func invalidTierError(rules *config.RuleSet, provided string) *RequestError {
+	return &RequestError{
+		Status:  http.StatusBadRequest,
+		Message: "invalid user_tier",
+		Details: gin.H{
+			"provided":    provided,
+			"valid_tiers": getValidTiers(rules.Tiers),
+		},
+	}
+}
+
+// bucketStart holds the configured initial_tokens of a check's per-key and
+// global buckets; nil starts that bucket full.
+type bucketStart struct {
+	user, global *int64
+}
+
+// initialTokens is the balance a new bucket of capacity starts with: the
+// configured initial, capped at capacity, or full when there is none.
+func initialTokens(initial *int64, capacity int64) int64 {
+	if initial == nil {
+		return capacity
+	}
+	return min(*initial, capacity)
+}
+
+// errInitialReservation rejects reservations where a new bucket would start
+// at initial_tokens, as the reserve scripts create buckets full.
+var errInitialReservation = &RequestError{Status: http.StatusBadRequest, Message: "reservations are not supported on endpoints with initial_tokens"}
+
+// tokenBucket consumes from a single bucket, or reserves when res is set.
+// Only a plain check creates the bucket with its initial balance.
+func (h *RateLimiterHandler) tokenBucket(res *reservation, key string, capacity int64, refillRate float64, initial *int64, cost int64, ttl time.Duration) (storage.BucketResult, error) {
+	if res != nil {
+		return h.storage.ReserveTokenBucket(res.id, res.hold, key, capacity, refillRate, cost, ttl)
+	}
+	if initial != nil {
+		return h.storage.AtomicInitialBucket(key, "", 0, 0, 0, capacity, refillRate, initialTokens(initial, capacity), 0, cost, ttl)
+	}
+	return h.storage.AtomicTokenBucket(key, capacity, refillRate, cost, ttl)
+}
+
+// dualBucket consumes from a user and global bucket pair, plus any resource
+// buckets, or reserves when res is set. Only a plain dual check creates the
+// buckets with their initial balances; ValidateRuleSet and check keep
+// initial_tokens away from the rest.
+func (h *RateLimiterHandler) dualBucket(res *reservation, userKey, globalKey string, globalCap int64, globalRate float64, userCap int64, userRate float64, userMaxDebt, cost int64, resources []storage.ResourceBucket, quotas []storage.Quota, start bucketStart, ttl time.Duration) (storage.BucketResult, error) {
+	if len(quotas) > 0 {
+		return h.storage.AtomicQuotaBucket(userKey, globalKey, globalCap, globalRate, userCap, userRate, userMaxDebt, cost, quotas, ttl)
+	}
+	if len(resources) > 0 {
+		return h.storage.AtomicMultiBucket(userKey, globalKey, globalCap, globalRate, userCap, userRate, userMaxDebt, cost, resources, ttl)
+	}
+	if res != nil {
+		return h.storage.ReserveDualBucket(res.id, res.hold, userKey, globalKey, globalCap, globalRate, userCap, userRate, userMaxDebt, cost, ttl)
+	}
+	if start.user != nil || start.global != nil {
+		return h.storage.AtomicInitialBucket(userKey, globalKey, globalCap, globalRate, initialTokens(start.global, globalCap),
+			userCap, userRate, initialTokens(start.user, userCap), userMaxDebt, cost, ttl)
+	}
+	return h.storage.AtomicDualBucket(userKey, globalKey, globalCap, globalRate, userCap, userRate, userMaxDebt, cost, ttl)
+}
+
+// RulesHandler serves the rules currently in effect, with credentials
+// redacted. With ?endpoint= it returns only that endpoint's config.
+func (h *RateLimiterHandler) RulesHandler(c *gin.Context) {
+	if endpoint := c.Query("endpoint"); endpoint != "" {
+		ep, ok := h.Rules().Endpoints[endpoint]
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "unknown endpoint", "endpoint": endpoint})
+			return
+		}
+		c.JSON(http.StatusOK, ep)
 		return
 	}
-	c.JSON(http.StatusOK, resp)
+	c.JSON(http.StatusOK, h.Rules().Redacted())
+}
+
+// rulesSchema is the rules file JSON Schema, generated once as it only
+// changes with the code.
+var rulesSchema = sync.OnceValues(config.GenerateJSONSchema)
+
+// SchemaHandler serves the JSON Schema for rules files, for tooling that
+// checks or completes them; see config.GenerateJSONSchema.
+func (h *RateLimiterHandler) SchemaHandler(c *gin.Context) {
+	schema, err := rulesSchema()
+	if err != nil {
+		log.Printf("❌ Generating rules schema failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Rate limiter unavailable"})
+		return
+	}
+	c.Data(http.StatusOK, "application/schema+json", schema)
+}
+
+// defaultBucketTTL is how long an idle bucket is kept before it starts over
+// full.
+const defaultBucketTTL = time.Hour
+
+// bucketTTL is the expiry for a bucket: defaultBucketTTL, or the time it
+// takes to refill from empty when that is longer, so a slow limit such as
+// "100/day" can't be reset early by waiting for the bucket to expire.
+func bucketTTL(capacity int64, refillRate float64) time.Duration {
+	if refillRate <= 0 {
+		return defaultBucketTTL
+	}
+	return max(defaultBucketTTL, time.Duration(float64(capacity)/refillRate*float64(time.Second)))
+}
+
+// namespacedKey prefixes key with namespace. The empty namespace keeps the
+// original key format so existing buckets stay valid.
+func namespacedKey(namespace, key string) string {
+	if namespace == "" {
+		return key
+	}
+	return namespace + ":" + key
 }
 
 func getValidTiers(tiers map[string]config.TierConfig) []string {
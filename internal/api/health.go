@@ -0,0 +1,78 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultHealthLatencyThreshold is the storage ping latency above which
+// HealthHandler reports the instance as degraded.
+const DefaultHealthLatencyThreshold = 50 * time.Millisecond
+
+// HealthOptions configures HealthHandler.
+type HealthOptions struct {
+	Backend          string                                   // "redis" (the default) or "memory"
+	LatencyThreshold time.Duration                            // DefaultHealthLatencyThreshold when zero
+	RulesStatus      func() (loadedAt time.Time, hash string) // Rules in effect; optional
+}
+
+type HealthResponse struct {
+	Status        string       `json:"status"` // ok, degraded or unhealthy
+	Redis         *RedisHealth `json:"redis,omitempty"`
+	Memory        string       `json:"memory,omitempty"` // "connected" for the in-memory backend
+	RulesLoadedAt *time.Time   `json:"rules_loaded_at,omitempty"`
+	RulesHash     string       `json:"rules_hash,omitempty"`
+}
+
+// RedisHealth is the Redis connection's state, ping latency and pool.
+type RedisHealth struct {
+	Status    string  `json:"status"` // connected or disconnected
+	LatencyMs float64 `json:"latency_ms"`
+	PoolSize  int     `json:"pool_size"`
+	PoolUsed  int     `json:"pool_used"`
+	PoolIdle  int     `json:"pool_idle"`
+}
+
+// HealthHandler returns a handler that pings the storage and reports its
+// latency and connection pool. A failed ping is 503 unhealthy. A ping slower
+// than the threshold is degraded but still 200, so load balancers keep
+// sending traffic to an instance that is only slow.
+func (h *RateLimiterHandler) HealthHandler(opts HealthOptions) gin.HandlerFunc {
+	if opts.LatencyThreshold <= 0 {
+		opts.LatencyThreshold = DefaultHealthLatencyThreshold
+	}
+	return func(c *gin.Context) {
+		resp := HealthResponse{Status: "ok"}
+		if opts.RulesStatus != nil {
+			loadedAt, hash := opts.RulesStatus()
+			resp.RulesLoadedAt, resp.RulesHash = &loadedAt, hash
+		}
+
+		start := time.Now()
+		err := h.storage.Ping()
+		latency := time.Since(start)
+		connection := "connected"
+		status := http.StatusOK
+		if err != nil {
+			resp.Status, connection, status = "unhealthy", "disconnected", http.StatusServiceUnavailable
+		} else if latency > opts.LatencyThreshold {
+			resp.Status = "degraded"
+		}
+
+		if opts.Backend == "memory" {
+			resp.Memory = connection
+		} else {
+			pool := h.storage.PoolStats()
+			resp.Redis = &RedisHealth{
+				Status:    connection,
+				LatencyMs: float64(latency.Microseconds()) / 1000,
+				PoolSize:  pool.Size,
+				PoolUsed:  pool.Used,
+				PoolIdle:  pool.Idle,
+			}
+		}
+		c.JSON(status, resp)
+	}
+}
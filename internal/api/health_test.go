@@ -0,0 +1,105 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+func TestHealthHandler(t *testing.T) {
+	pool := storage.RedisPoolStats{Size: 50, Used: 3, Idle: 7}
+	tests := []struct {
+		name           string
+		pingDelay      time.Duration
+		pingErr        error
+		threshold      time.Duration
+		expectedStatus int
+		expectedHealth string
+		expectedRedis  string
+	}{
+		{"fast ping", 0, nil, 0, http.StatusOK, "ok", "connected"},
+		{"slow ping is degraded but served", 30 * time.Millisecond, nil, 10 * time.Millisecond, http.StatusOK, "degraded", "connected"},
+		{"failed ping", 0, errors.New("connection refused"), 0, http.StatusServiceUnavailable, "unhealthy", "disconnected"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage := new(MockRedisStorage)
+			mockStorage.On("Ping").Return(tt.pingErr).After(tt.pingDelay)
+			mockStorage.On("PoolStats").Return(pool)
+			handler := NewRateLimiterHandler(mockStorage, adminRules())
+			loadedAt := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.GET("/health", handler.HealthHandler(HealthOptions{
+				LatencyThreshold: tt.threshold,
+				RulesStatus:      func() (time.Time, string) { return loadedAt, "abc123" },
+			}))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			var resp HealthResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to parse response: %v", err)
+			}
+			if resp.Status != tt.expectedHealth || resp.Redis == nil || resp.Redis.Status != tt.expectedRedis {
+				t.Fatalf("expected %s with redis %s, got %s", tt.expectedHealth, tt.expectedRedis, w.Body.String())
+			}
+			if resp.Redis.PoolSize != 50 || resp.Redis.PoolUsed != 3 || resp.Redis.PoolIdle != 7 {
+				t.Errorf("expected the pool stats, got %+v", resp.Redis)
+			}
+			if resp.Redis.LatencyMs < float64(tt.pingDelay.Milliseconds()) {
+				t.Errorf("expected latency of at least %v, got %gms", tt.pingDelay, resp.Redis.LatencyMs)
+			}
+			if resp.RulesHash != "abc123" || resp.RulesLoadedAt == nil || !resp.RulesLoadedAt.Equal(loadedAt) {
+				t.Errorf("expected the rules status, got %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestHealthHandler_SnakeCase(t *testing.T) {
+	mockStorage := new(MockRedisStorage)
+	mockStorage.On("Ping").Return(nil)
+	mockStorage.On("PoolStats").Return(storage.RedisPoolStats{Size: 10})
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/health", NewRateLimiterHandler(mockStorage, adminRules()).HealthHandler(HealthOptions{}))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+	var body struct {
+		Redis map[string]any `json:"redis"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	for _, field := range []string{"status", "latency_ms", "pool_size", "pool_used", "pool_idle"} {
+		if _, ok := body.Redis[field]; !ok {
+			t.Errorf("expected redis.%s in %s", field, w.Body.String())
+		}
+	}
+}
+
+func TestHealthHandler_Memory(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/health", NewRateLimiterHandler(storage.NewMemoryStorage(), adminRules()).HealthHandler(HealthOptions{Backend: "memory"}))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+	var resp HealthResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || resp.Status != "ok" || resp.Memory != "connected" || resp.Redis != nil {
+		t.Errorf("expected a healthy memory backend without redis stats, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+)
+
+func TestCheck_InitialTokens(t *testing.T) {
+	tokens := func(n int64) *int64 { return &n }
+	rules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{
+			"onboarding": {Capacity: 100, RefillRate: 0.001, InitialTokens: tokens(20)},
+			"free":       {Capacity: 100, RefillRate: 0.001},
+		},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/upload": {Rule: "tiers+endpoints", Cost: 10, GlobalCapacity: 10000, GlobalRefillRate: 1000, InitialTokens: tokens(5000)},
+			"/api/export": {Rule: "endpoint", Cost: 1, GlobalCapacity: 100, GlobalRefillRate: 0.001, InitialTokens: tokens(0)},
+		},
+	}
+	handler := NewRateLimiterHandler(storage.NewMemoryStorage(), rules)
+
+	t.Run("new keys ramp up", func(t *testing.T) {
+		req := CheckRequest{Key: "noisy", Endpoint: "/api/upload", UserTier: "onboarding"}
+		for i := int64(1); i <= 2; i++ {
+			resp, err := handler.Check(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !resp.Allowed || resp.UserRemaining != 20-10*i {
+				t.Fatalf("request %d: expected allowed with %d left, got %+v", i, 20-10*i, resp)
+			}
+		}
+		if resp, _ := handler.Check(req); resp.Allowed {
+			t.Fatalf("expected the initial fill to run out, got %+v", resp)
+		}
+	})
+
+	t.Run("other tiers start full", func(t *testing.T) {
+		resp, _ := handler.Check(CheckRequest{Key: "regular", Endpoint: "/api/upload", UserTier: "free"})
+		// The global bucket was created with 5000 by the first subtest
+		if !resp.Allowed || resp.UserRemaining != 90 || resp.GlobalRemaining != 4970 {
+			t.Fatalf("expected user 90 and global 4970, got %+v", resp)
+		}
+	})
+
+	t.Run("single bucket starts empty", func(t *testing.T) {
+		if resp, _ := handler.Check(CheckRequest{Key: "anyone", Endpoint: "/api/export"}); resp.Allowed || resp.GlobalRemaining != 0 {
+			t.Fatalf("expected the empty endpoint bucket to deny, got %+v", resp)
+		}
+	})
+}
+
+func TestReserveHandler_RejectsInitialTokens(t *testing.T) {
+	tokens := func(n int64) *int64 { return &n }
+	rules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{
+			"onboarding": {Capacity: 100, RefillRate: 10, InitialTokens: tokens(20)},
+			"free":       {Capacity: 100, RefillRate: 10},
+		},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/upload": {Rule: "tiers+endpoints", Cost: 10, GlobalCapacity: 10000, GlobalRefillRate: 1000},
+			"/api/export": {Rule: "endpoint", Cost: 1, GlobalCapacity: 100, GlobalRefillRate: 10, InitialTokens: tokens(0)},
+		},
+	}
+	// Any storage call would fail the test: the mock has no expectations
+	handler := NewRateLimiterHandler(new(MockRedisStorage), rules)
+
+	// The reserve scripts would create these buckets full
+	for _, req := range []CheckRequest{
+		{Key: "noisy", Endpoint: "/api/upload", UserTier: "onboarding"},
+		{Key: "anyone", Endpoint: "/api/export"},
+	} {
+		w := serveReserve(handler, "/reserve", ReserveRequest{CheckRequest: req})
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "initial_tokens") {
+			t.Errorf("%s: expected a 400 naming initial_tokens, got %d: %s", req.Endpoint, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+)
+
+func TestCheck_IPOverrides(t *testing.T) {
+	rules := &config.RuleSet{
+		IPs: config.IPConfig{Capacity: 2, RefillRate: 0.001},
+		IPOverrides: []config.IPOverrideConfig{
+			{Address: "10.0.0.0/8", Capacity: 100, RefillRate: 10},
+			{Address: "10.9.9.9", Unlimited: true},
+		},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/login": {Rule: "IP+endpoints", Cost: 1, GlobalCapacity: 1000, GlobalRefillRate: 1},
+		},
+	}
+	if err := config.ValidateRuleSet(rules); err != nil {
+		t.Fatalf("invalid rules: %v", err)
+	}
+	handler := NewRateLimiterHandler(storage.NewMemoryStorage(), rules)
+	check := func(ip string) CheckResponse {
+		t.Helper()
+		resp, err := handler.Check(CheckRequest{Key: "k", Endpoint: "/api/login", IPAddress: ip})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return resp
+	}
+
+	// Internet clients get the ips limits
+	check("192.0.2.1")
+	check("192.0.2.1")
+	if resp := check("192.0.2.1"); resp.Allowed || resp.Limit != 2 || resp.IPOverride != "" {
+		t.Errorf("expected the third request from a default IP denied, got %+v", resp)
+	}
+
+	resp := check("10.1.2.3")
+	if !resp.Allowed || resp.Limit != 100 || resp.UserRemaining != 99 || resp.IPOverride != "10.0.0.0/8" {
+		t.Errorf("expected the 10.0.0.0/8 limits, got %+v", resp)
+	}
+	if resp.GlobalRemaining != 997 {
+		t.Errorf("expected the global bucket charged as usual, got %+v", resp)
+	}
+
+	// The unlimited address is more specific than its range, and charges nothing
+	for i := 0; i < 5; i++ {
+		if resp := check("10.9.9.9"); !resp.Allowed || resp.IPOverride != "10.9.9.9" {
+			t.Fatalf("expected the unlimited address allowed, got %+v", resp)
+		}
+	}
+	if resp := check("10.1.2.3"); resp.GlobalRemaining != 996 {
+		t.Errorf("expected the unlimited address to leave the global bucket alone, got %+v", resp)
+	}
+}
+
+func TestCheck_IPOverridesUserIP(t *testing.T) {
+	rules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{"free": {Capacity: 100, RefillRate: 0.001}},
+		IPs:   config.IPConfig{Capacity: 2, RefillRate: 0.001},
+		IPOverrides: []config.IPOverrideConfig{
+			{Address: "10.0.0.0/8", Capacity: 50, RefillRate: 10},
+			{Address: "10.9.9.9", Unlimited: true},
+		},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/login": {Rule: "user+ip", Cost: 1},
+		},
+	}
+	if err := config.ValidateRuleSet(rules); err != nil {
+		t.Fatalf("invalid rules: %v", err)
+	}
+	handler := NewRateLimiterHandler(storage.NewMemoryStorage(), rules)
+	check := func(ip string) CheckResponse {
+		t.Helper()
+		resp, err := handler.Check(CheckRequest{Key: "k", Endpoint: "/api/login", UserTier: "free", IPAddress: ip})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return resp
+	}
+
+	check("192.0.2.1")
+	check("192.0.2.1")
+	if resp := check("192.0.2.1"); resp.Allowed || resp.IPOverride != "" {
+		t.Errorf("expected the third request from a default IP denied, got %+v", resp)
+	}
+
+	resp := check("10.1.2.3")
+	if !resp.Allowed || resp.IPRemaining == nil || *resp.IPRemaining != 49 || resp.IPOverride != "10.0.0.0/8" {
+		t.Errorf("expected the 10.0.0.0/8 IP limits, got %+v", resp)
+	}
+	if resp.UserRemaining != 97 {
+		t.Errorf("expected the user bucket charged as usual, got %+v", resp)
+	}
+
+	// The unlimited address charges neither bucket
+	for i := 0; i < 5; i++ {
+		if resp := check("10.9.9.9"); !resp.Allowed || resp.IPOverride != "10.9.9.9" {
+			t.Fatalf("expected the unlimited address allowed, got %+v", resp)
+		}
+	}
+	if resp := check("10.1.2.3"); resp.UserRemaining != 96 {
+		t.Errorf("expected the unlimited address to leave the user bucket alone, got %+v", resp)
+	}
+}
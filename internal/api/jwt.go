@@ -0,0 +1,111 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/AndySung320/rate-limiter/internal/jwtauth"
+	"github.com/gin-gonic/gin"
+)
+
+// TokenVerifier verifies a bearer token and returns its claims, e.g.
+// *jwtauth.Verifier. Errors should wrap the jwtauth sentinel errors so they
+// map to the right error code.
+type TokenVerifier interface {
+	Verify(token string) (jwtauth.Claims, error)
+}
+
+// tokenErrorCodes are the "code" values of 401 responses, by cause.
+var tokenErrorCodes = []struct {
+	err  error
+	code string
+}{
+	{jwtauth.ErrExpired, "token_expired"},
+	{jwtauth.ErrNotYetValid, "token_not_yet_valid"},
+	{jwtauth.ErrInvalidSignature, "token_invalid_signature"},
+	{jwtauth.ErrMalformed, "token_malformed"},
+}
+
+// bindCheckRequest reads a /check body into a CheckRequest. With a
+// TokenVerifier the bearer token is verified first and the key and tier
+// come from the claims configured in rules.JWT. When it returns false an
+// error response has already been written to c.
+func (h *RateLimiterHandler) bindCheckRequest(c *gin.Context) (CheckRequest, bool) {
+	var req CheckRequest
+	if h.jwt == nil {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			writeBindError(c, err)
+			return req, false
+		}
+		return req, true
+	}
+
+	claims, ok := h.authenticate(c)
+	if !ok {
+		return req, false
+	}
+	// The key is optional in the body here, so skip the binding validation
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return req, false
+	}
+	if req.Endpoint == "" {
+		writeValidationFailed(c, map[string]string{"endpoint": "required"})
+		return req, false
+	}
+
+	cfg := h.Rules().JWT
+	keyClaim := cfg.KeyClaim
+	if keyClaim == "" {
+		keyClaim = "sub"
+	}
+	key, ok := claims.String(keyClaim)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "token has no " + keyClaim + " claim", "code": "token_missing_claim"})
+		return req, false
+	}
+	tier, hasTier := "", false
+	if cfg.TierClaim != "" {
+		tier, hasTier = claims.String(cfg.TierClaim)
+	}
+
+	if cfg.BodyFields == "reject" && (req.Key != "" || (cfg.TierClaim != "" && req.UserTier != "")) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "key and user_tier come from the bearer token and must not be sent"})
+		return req, false
+	}
+	req.Key = key
+	if cfg.TierClaim != "" {
+		// A token without the tier claim leaves the tier to the extractor,
+		// never to the body
+		req.UserTier = ""
+		if hasTier {
+			req.UserTier = tier
+		}
+	}
+	return req, true
+}
+
+// authenticate verifies the request's bearer token, writing a 401 with an
+// error code when it is missing or invalid.
+func (h *RateLimiterHandler) authenticate(c *gin.Context) (jwtauth.Claims, bool) {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "bearer token required", "code": "token_missing"})
+		return nil, false
+	}
+	claims, err := h.jwt.Verify(token)
+	if err != nil {
+		code := "token_invalid"
+		for _, known := range tokenErrorCodes {
+			if errors.Is(err, known.err) {
+				code = known.code
+				break
+			}
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error(), "code": code})
+		return nil, false
+	}
+	return claims, true
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/jwtauth"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/mock"
+)
+
+// fakeVerifier accepts tokens named in claims and fails the rest with err.
+type fakeVerifier struct {
+	claims map[string]jwtauth.Claims
+	err    error
+}
+
+func (f fakeVerifier) Verify(token string) (jwtauth.Claims, error) {
+	if claims, ok := f.claims[token]; ok {
+		return claims, nil
+	}
+	return nil, f.err
+}
+
+func TestCheckHandler_JWT(t *testing.T) {
+	verifier := fakeVerifier{
+		claims: map[string]jwtauth.Claims{
+			"good":    {"sub": "user123", "plan": "free"},
+			"no-sub":  {"plan": "free"},
+			"no-plan": {"sub": "user123"},
+		},
+		err: fmt.Errorf("verify: %w", jwtauth.ErrExpired),
+	}
+
+	tests := []struct {
+		name       string
+		bodyFields string
+		token      string
+		body       map[string]string
+		wantStatus int
+		wantCode   string
+	}{
+		{"claims supply key and tier", "", "good", map[string]string{"endpoint": "/api/upload"}, http.StatusOK, ""},
+		{"body fields ignored", "ignore", "good", map[string]string{"endpoint": "/api/upload", "key": "someone-else", "user_tier": "premium"}, http.StatusOK, ""},
+		{"body fields rejected", "reject", "good", map[string]string{"endpoint": "/api/upload", "key": "someone-else"}, http.StatusBadRequest, ""},
+		{"missing token", "", "", map[string]string{"endpoint": "/api/upload"}, http.StatusUnauthorized, "token_missing"},
+		{"expired token", "", "stale", map[string]string{"endpoint": "/api/upload"}, http.StatusUnauthorized, "token_expired"},
+		{"missing key claim", "", "no-sub", map[string]string{"endpoint": "/api/upload"}, http.StatusUnauthorized, "token_missing_claim"},
+		{"missing tier claim", "", "no-plan", map[string]string{"endpoint": "/api/upload", "user_tier": "free"}, http.StatusBadRequest, ""},
+		{"missing endpoint", "", "good", map[string]string{}, http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := adminRules()
+			rules.JWT = config.JWTConfig{Enabled: true, TierClaim: "plan", BodyFields: tt.bodyFields}
+			mockStorage := new(MockRedisStorage)
+			mockStorage.On("AtomicDualBucket", "user:user123:/api/upload:free", "global:/api/upload",
+				mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+			).Return(storage.BucketResult{Allowed: true}, nil)
+
+			handler := NewRateLimiterHandlerWithOptions(mockStorage, rules, HandlerOptions{TokenVerifier: verifier})
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.POST("/check", handler.CheckHandler)
+			payload, _ := json.Marshal(tt.body)
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/check", bytes.NewBuffer(payload))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			var body map[string]interface{}
+			json.Unmarshal(w.Body.Bytes(), &body)
+			if tt.wantCode != "" && body["code"] != tt.wantCode {
+				t.Errorf("expected code %q, got %v", tt.wantCode, body)
+			}
+			if tt.wantStatus == http.StatusOK {
+				mockStorage.AssertExpectations(t)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// KeyTransformer derives the storage keys of the per-user and global buckets
+// of an endpoint. Namespaces are applied on top of the transformed keys.
+type KeyTransformer interface {
+	TransformUserKey(key, endpoint, tier string) string
+	TransformGlobalKey(endpoint string) string
+}
+
+// DefaultKeyTransformer builds "user:<key>:<endpoint>:<tier>" and
+// "global:<endpoint>" keys.
+type DefaultKeyTransformer struct{}
+
+func (DefaultKeyTransformer) TransformUserKey(key, endpoint, tier string) string {
+	return fmt.Sprintf("user:%s:%s:%s", key, endpoint, tier)
+}
+
+func (DefaultKeyTransformer) TransformGlobalKey(endpoint string) string {
+	return fmt.Sprintf("global:%s", endpoint)
+}
+
+// HashingKeyTransformer replaces the user key with its SHA-256 hex digest, so
+// raw user IDs never reach Redis.
+type HashingKeyTransformer struct{}
+
+func (HashingKeyTransformer) TransformUserKey(key, endpoint, tier string) string {
+	sum := sha256.Sum256([]byte(key))
+	return DefaultKeyTransformer{}.TransformUserKey(hex.EncodeToString(sum[:]), endpoint, tier)
+}
+
+func (HashingKeyTransformer) TransformGlobalKey(endpoint string) string {
+	return DefaultKeyTransformer{}.TransformGlobalKey(endpoint)
+}
+
+type prefixKeyTransformer struct {
+	prefix string
+}
+
+// NewPrefixKeyTransformer returns a transformer that puts prefix in front of
+// the default keys, e.g. "canary:user:<key>:<endpoint>:<tier>".
+func NewPrefixKeyTransformer(prefix string) KeyTransformer {
+	return prefixKeyTransformer{prefix: prefix}
+}
+
+func (t prefixKeyTransformer) TransformUserKey(key, endpoint, tier string) string {
+	return t.prefix + ":" + DefaultKeyTransformer{}.TransformUserKey(key, endpoint, tier)
+}
+
+func (t prefixKeyTransformer) TransformGlobalKey(endpoint string) string {
+	return t.prefix + ":" + DefaultKeyTransformer{}.TransformGlobalKey(endpoint)
+}
+
+// keyWithFields adds the metadata values of an endpoint's key_fields to a
+// request's key, sorted by field so the order they are configured in doesn't
+// matter, e.g. "alice:plan=pro:region=eu". Values are query-escaped, so one
+// can't pass for another field or add glob characters to the key. A missing
+// field is a 400.
+func keyWithFields(key string, fields []string, metadata map[string]string) (string, error) {
+	if len(fields) == 0 {
+		return key, nil
+	}
+	sorted := slices.Sorted(slices.Values(fields))
+	var b strings.Builder
+	b.WriteString(key)
+	for _, field := range sorted {
+		value, ok := metadata[field]
+		if !ok || value == "" {
+			return "", &RequestError{
+				Status:  http.StatusBadRequest,
+				Message: "metadata field required for this endpoint",
+				Details: gin.H{"field": field},
+			}
+		}
+		fmt.Fprintf(&b, ":%s=%s", field, url.QueryEscape(value))
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+)
+
+func TestKeyTransformers_ChangeStorageKeys(t *testing.T) {
+	// sha256("user123")
+	const hashed = "e606e38b0d8c19b24cf0ee3808183162ea7cd63ff7912dbb22b5e803286b4446"
+
+	tests := []struct {
+		name        string
+		transformer KeyTransformer
+		wantUser    string
+		wantGlobal  string
+	}{
+		{"default", nil, "user:user123:/api/upload:free", "global:/api/upload"},
+		{"explicit default", DefaultKeyTransformer{}, "user:user123:/api/upload:free", "global:/api/upload"},
+		{"hashing", HashingKeyTransformer{}, "user:" + hashed + ":/api/upload:free", "global:/api/upload"},
+		{"prefix", NewPrefixKeyTransformer("canary"), "canary:user:user123:/api/upload:free", "canary:global:/api/upload"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage := new(MockRedisStorage)
+			mockStorage.On("AtomicDualBucket", tt.wantUser, tt.wantGlobal,
+				int64(10000), float64(2000), int64(100), float64(10), int64(0), int64(10), time.Hour,
+			).Return(storage.BucketResult{Allowed: true, Remaining: 90, GlobalRemaining: 9990}, nil)
+
+			handler := NewRateLimiterHandlerWithOptions(mockStorage, adminRules(), HandlerOptions{KeyTransformer: tt.transformer})
+			if _, err := handler.Check(CheckRequest{Key: "user123", Endpoint: "/api/upload", UserTier: "free"}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			mockStorage.AssertExpectations(t)
+		})
+	}
+}
+
+func TestTopUpHandler_UsesKeyTransformer(t *testing.T) {
+	mockStorage := new(MockRedisStorage)
+	mockStorage.On("TopUpBucket", "canary:user:user123:/api/upload:free", int64(100), float64(10), int64(50), int64(100), time.Hour).
+		Return(int64(100), nil)
+
+	handler := NewRateLimiterHandlerWithOptions(mockStorage, adminRules(), HandlerOptions{KeyTransformer: NewPrefixKeyTransformer("canary")})
+	w := serveAdmin(handler, "/admin/topup", "s3cret", TopUpRequest{Key: "user123", Endpoint: "/api/upload", UserTier: "free", Amount: 50})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	mockStorage.AssertExpectations(t)
+}
+
+func TestKeyWithFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		fields   []string
+		metadata map[string]string
+		want     string // Empty when the request is rejected
+	}{
+		{"no fields", nil, map[string]string{"region": "eu"}, "alice"},
+		{"one field", []string{"region"}, map[string]string{"region": "eu", "plan": "pro"}, "alice:region=eu"},
+		{"sorted", []string{"region", "plan"}, map[string]string{"region": "eu", "plan": "pro"}, "alice:plan=pro:region=eu"},
+		{"missing", []string{"region", "plan"}, map[string]string{"plan": "pro"}, ""},
+		{"empty", []string{"region"}, map[string]string{"region": ""}, ""},
+		{"escaped", []string{"region"}, map[string]string{"region": "eu*?[x] y"}, "alice:region=eu%2A%3F%5Bx%5D+y"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := keyWithFields("alice", tt.fields, tt.metadata)
+			if tt.want == "" {
+				var reqErr *RequestError
+				if !errors.As(err, &reqErr) || reqErr.Status != http.StatusBadRequest || reqErr.Details["field"] != "region" {
+					t.Errorf("expected a 400 naming region, got %v", err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("expected %q, got %q (err %v)", tt.want, got, err)
+			}
+		})
+	}
+}
+
+func TestKeyWithFields_ValuesCannotCollide(t *testing.T) {
+	// Unescaped, both would be alice:plan=pro:region=eu:region=us
+	fields := []string{"plan", "region"}
+	first, err := keyWithFields("alice", fields, map[string]string{"plan": "pro:region=eu", "region": "us"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second, err := keyWithFields("alice", fields, map[string]string{"plan": "pro", "region": "eu:region=us"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if first == second {
+		t.Errorf("expected different buckets, both got %q", first)
+	}
+	if first != "alice:plan=pro%3Aregion%3Deu:region=us" || second != "alice:plan=pro:region=eu%3Aregion%3Dus" {
+		t.Errorf("unexpected keys %q and %q", first, second)
+	}
+}
+
+func TestCheck_KeyFields(t *testing.T) {
+	rules := adminRules()
+	rules.Endpoints["/api/upload"] = config.EndpointConfig{Rule: "tiers+endpoints", Cost: 10, GlobalCapacity: 10000, GlobalRefillRate: 2000, KeyFields: []string{"region", "app"}}
+	mockStorage := new(MockRedisStorage)
+	mockStorage.On("AtomicDualBucket", "user:user123:app=web:region=eu:/api/upload:free", "global:/api/upload",
+		int64(10000), float64(2000), int64(100), float64(10), int64(0), int64(10), time.Hour,
+	).Return(storage.BucketResult{Allowed: true, Remaining: 90, GlobalRemaining: 9990}, nil)
+	handler := NewRateLimiterHandler(mockStorage, rules)
+
+	req := CheckRequest{Key: "user123", Endpoint: "/api/upload", UserTier: "free", Metadata: map[string]string{"region": "eu", "app": "web", "ignored": "x"}}
+	if _, err := handler.Check(req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mockStorage.AssertExpectations(t)
+
+	delete(req.Metadata, "app")
+	var reqErr *RequestError
+	if _, err := handler.Check(req); !errors.As(err, &reqErr) || reqErr.Status != http.StatusBadRequest {
+		t.Errorf("expected a 400 for a missing field, got %v", err)
+	}
+}
+
+func TestTopUpHandler_KeyFields(t *testing.T) {
+	rules := adminRules()
+	rules.Endpoints["/api/upload"] = config.EndpointConfig{Rule: "tiers+endpoints", Cost: 10, GlobalCapacity: 10000, GlobalRefillRate: 2000, KeyFields: []string{"region", "app"}}
+	mockStorage := new(MockRedisStorage)
+	// The same bucket TestCheck_KeyFields charges
+	mockStorage.On("TopUpBucket", "user:user123:app=web:region=eu:/api/upload:free", int64(100), float64(10), int64(50), int64(100), time.Hour).
+		Return(int64(100), nil)
+	handler := NewRateLimiterHandler(mockStorage, rules)
+
+	req := TopUpRequest{Key: "user123", Endpoint: "/api/upload", UserTier: "free", Amount: 50, Metadata: map[string]string{"region": "eu", "app": "web"}}
+	if w := serveAdmin(handler, "/admin/topup", "s3cret", req); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	mockStorage.AssertExpectations(t)
+
+	delete(req.Metadata, "app")
+	w := serveAdmin(handler, "/admin/topup", "s3cret", req)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"field":"app"`) {
+		t.Errorf("expected a 400 naming the missing field, got %d: %s", w.Code, w.Body.String())
+	}
+	mockStorage.AssertNumberOfCalls(t, "TopUpBucket", 1)
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+func TestCheck_LimitingDisabled(t *testing.T) {
+	rules := adminRules()
+	upload := rules.Endpoints["/api/upload"]
+	upload.LimitEnabled = new(bool)
+	rules.Endpoints["/api/upload"] = upload
+	// No expectations: any storage call fails the test
+	mockStorage := new(MockRedisStorage)
+	audit := new(recordingAuditLogger)
+	handler := NewRateLimiterHandlerWithOptions(mockStorage, rules, HandlerOptions{AuditLogger: audit})
+
+	resp, err := handler.Check(CheckRequest{Key: "user123", Endpoint: "/api/upload", UserTier: "free"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !resp.Allowed || !resp.LimitingDisabled {
+		t.Errorf("expected the request allowed with limiting_disabled, got %+v", resp)
+	}
+	if len(audit.entries) != 1 || !audit.entries[0].Allowed {
+		t.Errorf("expected the decision audited, got %+v", audit.entries)
+	}
+
+	router := gin.New()
+	router.POST("/reserve", handler.ReserveHandler)
+	router.POST("/refund", handler.RefundHandler)
+	for _, path := range []string{"/reserve", "/refund"} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"key":"user123","endpoint":"/api/upload","user_tier":"free"}`))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d: %s", path, w.Code, w.Body.String())
+		}
+	}
+	mockStorage.AssertExpectations(t)
+
+	var limits LimitsResponse
+	w := httptest.NewRecorder()
+	limitsRouter := gin.New()
+	limitsRouter.GET("/limits", handler.LimitsHandler)
+	limitsRouter.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/limits", nil))
+	if err := json.Unmarshal(w.Body.Bytes(), &limits); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !limits.Endpoints["/api/upload"].LimitingDisabled {
+		t.Errorf("expected /limits to show limiting disabled, got %+v", limits.Endpoints["/api/upload"])
+	}
+
+	// Switching it back on takes effect at the next check
+	upload.LimitEnabled = nil
+	handler.SetRules(&config.RuleSet{Tiers: rules.Tiers, Endpoints: map[string]config.EndpointConfig{"/api/upload": upload}})
+	onPenaltyDual(mockStorage, int64(100), float64(10), int64(0), storage.BucketResult{Allowed: true})
+	if resp, err := handler.Check(CheckRequest{Key: "user123", Endpoint: "/api/upload", UserTier: "free"}); err != nil || resp.LimitingDisabled {
+		t.Errorf("expected a normal check once re-enabled, got %+v (err %v)", resp, err)
+	}
+	mockStorage.AssertExpectations(t)
+}
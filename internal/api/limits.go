@@ -0,0 +1,82 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Limit headers let clients pace themselves: a full bucket allows a burst
+// of X-RateLimit-Burst tokens, after which X-RateLimit-Sustained-Rate tokens
+// per second come back.
+const (
+	burstHeader         = "X-RateLimit-Burst"
+	sustainedRateHeader = "X-RateLimit-Sustained-Rate"
+)
+
+// setLimitHeaders reports the burst and sustained rate resp was checked
+// against.
+func setLimitHeaders(c *gin.Context, resp CheckResponse) {
+	c.Header(burstHeader, strconv.FormatInt(resp.Limit, 10))
+	c.Header(sustainedRateHeader, strconv.FormatFloat(resp.SustainedRate, 'g', -1, 64))
+}
+
+// BucketLimits describes a bucket as clients reason about it: how much can
+// be spent at once, and the rate it can be spent at over time.
+type BucketLimits struct {
+	Burst         int64   `json:"burst"`
+	SustainedRate float64 `json:"sustained_rate"` // Tokens per second
+}
+
+// EndpointLimits is what a request to an endpoint costs and the limits of
+// its global bucket, if it has one.
+type EndpointLimits struct {
+	Rule     string        `json:"rule"`
+	Cost     int64         `json:"cost"`
+	Global   *BucketLimits `json:"global,omitempty"`   // Unset for user+ip, which has no global bucket
+	Template string        `json:"template,omitempty"` // The template the settings came from, if any
+	// LimitingDisabled is set while limit_enabled is false and every
+	// request is allowed
+	LimitingDisabled bool `json:"limiting_disabled,omitempty"`
+}
+
+// LimitsResponse is the body of GET /limits.
+type LimitsResponse struct {
+	Tiers     map[string]BucketLimits   `json:"tiers"`
+	Endpoints map[string]EndpointLimits `json:"endpoints"`
+	IPs       *BucketLimits             `json:"ips,omitempty"`
+}
+
+// LimitsHandler serves the burst and sustained rate of every tier, endpoint
+// and the IP bucket under the rules in effect, with any burst multiplier
+// and current peak_hours and schedule limits applied.
+func (h *RateLimiterHandler) LimitsHandler(c *gin.Context) {
+	rules := h.Rules()
+	now, loc := h.clock(), rules.ScheduleLocation()
+	resp := LimitsResponse{
+		Tiers:     make(map[string]BucketLimits, len(rules.Tiers)),
+		Endpoints: make(map[string]EndpointLimits, len(rules.Endpoints)),
+	}
+	for name, tier := range rules.Tiers {
+		tier, _ := tier.Scheduled(now, loc)
+		resp.Tiers[name] = BucketLimits{Burst: tier.EffectiveCapacity(), SustainedRate: tier.RefillRate}
+	}
+	for path, ep := range rules.Endpoints {
+		ep, _ := ep.Scheduled(now, loc)
+		limits := EndpointLimits{Rule: ep.Rule, Cost: ep.Cost, Template: ep.Template, LimitingDisabled: !ep.Limited()}
+		if ep.Rule != "user+ip" {
+			capacity, rate, err := h.globalLimits(ep)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			limits.Global = &BucketLimits{Burst: capacity, SustainedRate: rate}
+		}
+		resp.Endpoints[path] = limits
+	}
+	if rules.IPs.Capacity > 0 {
+		resp.IPs = &BucketLimits{Burst: rules.IPs.Capacity, SustainedRate: rules.IPs.RefillRate}
+	}
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/gin-gonic/gin"
+)
+
+func TestLimitsHandler(t *testing.T) {
+	rules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{
+			"free":    {Capacity: 50, Burst: 50, RefillRate: 0.5},
+			"premium": {Capacity: 1000, RefillRate: 100, BurstMultiplier: 2},
+		},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/upload": {Rule: "tiers+endpoints", Cost: 10, GlobalCapacity: 10000, GlobalRefillRate: 2000},
+			"/api/login":  {Rule: "user+ip", Cost: 1},
+		},
+		IPs: config.IPConfig{Capacity: 500, RefillRate: 50},
+	}
+	handler := NewRateLimiterHandler(new(MockRedisStorage), rules)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/limits", handler.LimitsHandler)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/limits", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	var got LimitsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("failed to parse response: %v", err)
+	}
+	want := LimitsResponse{
+		Tiers: map[string]BucketLimits{
+			"free":    {Burst: 50, SustainedRate: 0.5},
+			"premium": {Burst: 2000, SustainedRate: 100},
+		},
+		Endpoints: map[string]EndpointLimits{
+			"/api/upload": {Rule: "tiers+endpoints", Cost: 10, Global: &BucketLimits{Burst: 10000, SustainedRate: 2000}},
+			"/api/login":  {Rule: "user+ip", Cost: 1},
+		},
+		IPs: &BucketLimits{Burst: 500, SustainedRate: 50},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+}
+
+func TestLimitsHandler_EndpointDefaults(t *testing.T) {
+	rules, err := config.ParseRuleSet([]byte(`
+endpoint_defaults: {rule: endpoint, cost: 2, global_capacity: 500, global_refill_rate: 50}
+endpoints:
+  /api/search:
+  /api/upload: {cost: 10}
+  /api/export: {extends: /api/upload, global_capacity: 100}
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	handler := NewRateLimiterHandler(new(MockRedisStorage), rules)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/limits", handler.LimitsHandler)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/limits", nil))
+
+	var got LimitsResponse
+	json.Unmarshal(w.Body.Bytes(), &got)
+	want := map[string]EndpointLimits{
+		"/api/search": {Rule: "endpoint", Cost: 2, Global: &BucketLimits{Burst: 500, SustainedRate: 50}},
+		"/api/upload": {Rule: "endpoint", Cost: 10, Global: &BucketLimits{Burst: 500, SustainedRate: 50}},
+		"/api/export": {Rule: "endpoint", Cost: 10, Global: &BucketLimits{Burst: 100, SustainedRate: 50}},
+	}
+	if !reflect.DeepEqual(got.Endpoints, want) {
+		t.Errorf("expected the inherited limits %+v, got %s", want, w.Body.String())
+	}
+}
+
+func TestLimitsHandler_Templates(t *testing.T) {
+	rules, err := config.ParseRuleSet([]byte(`
+templates:
+  public_read: {rule: endpoint, cost: 1, limit: 600/minute}
+endpoints:
+  /api/search: {template: public_read}
+  /api/list: {template: public_read, cost: 2}
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	handler := NewRateLimiterHandler(new(MockRedisStorage), rules)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/limits", handler.LimitsHandler)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/limits", nil))
+
+	var got LimitsResponse
+	json.Unmarshal(w.Body.Bytes(), &got)
+	want := map[string]EndpointLimits{
+		"/api/search": {Rule: "endpoint", Cost: 1, Global: &BucketLimits{Burst: 600, SustainedRate: 10}, Template: "public_read"},
+		"/api/list":   {Rule: "endpoint", Cost: 2, Global: &BucketLimits{Burst: 600, SustainedRate: 10}, Template: "public_read"},
+	}
+	if !reflect.DeepEqual(got.Endpoints, want) {
+		t.Errorf("expected the template and its resolved limits %+v, got %s", want, w.Body.String())
+	}
+}
@@ -0,0 +1,32 @@
+package api
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// shadowDeniedTotal counts checks that shadow mode allowed but the limits
+// would have denied.
+var shadowDeniedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "rate_limiter_shadow_denied_total",
+	Help: "Checks allowed by shadow mode that the rate limits would have denied.",
+}, []string{"endpoint", "tier"})
+
+// auditDroppedTotal counts decisions the audit log had no room for.
+var auditDroppedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "rate_limiter_audit_dropped_total",
+	Help: "Rate limit decisions dropped from the audit log because its queue was full.",
+})
+
+// selfProtectDeniedTotal counts requests SelfProtectMiddleware turned away.
+var selfProtectDeniedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "rate_limiter_self_protect_denied_total",
+	Help: "Requests denied by self_protect before any rule was evaluated.",
+})
+
+// inFlightRequests reports the requests InFlightMiddleware is counting.
+var inFlightRequests = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+	Name: "rate_limiter_in_flight_requests",
+	Help: "HTTP requests being served.",
+}, func() float64 { return float64(inFlight.Load()) })
+
+func init() {
+	prometheus.MustRegister(shadowDeniedTotal, auditDroppedTotal, selfProtectDeniedTotal, inFlightRequests)
+}
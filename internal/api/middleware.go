@@ -0,0 +1,82 @@
+package api
+
+import (
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// RequestIDHeader carries the ID that ties a request's log lines, audit
+// entry and response together.
+const RequestIDHeader = "X-Request-ID"
+
+// requestIDContextKey is where RequestIDMiddleware stores the ID in the gin
+// context.
+const requestIDContextKey = "request_id"
+
+// maxRequestIDLen caps caller-supplied IDs, which end up in every log line.
+const maxRequestIDLen = 128
+
+// RequestIDMiddleware gives each request an ID: the caller's X-Request-ID,
+// or a new UUID v4 when it has none or it isn't printable ASCII of at most
+// 128 characters. The ID is stored in the gin context as "request_id", set
+// on the request and response headers, and carried into the check's log
+// lines and audit entry.
+func RequestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		c.Set(requestIDContextKey, id)
+		c.Request.Header.Set(RequestIDHeader, id)
+		c.Header(RequestIDHeader, id)
+		c.Next()
+	}
+}
+
+// validRequestID keeps IDs from splitting or garbling log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// contextRequestID returns the ID RequestIDMiddleware gave c, or the caller's
+// X-Request-ID when the middleware isn't installed.
+func contextRequestID(c *gin.Context) string {
+	if id := c.GetString(requestIDContextKey); id != "" {
+		return id
+	}
+	if id := c.GetHeader(RequestIDHeader); validRequestID(id) {
+		return id
+	}
+	return ""
+}
+
+// inFlight counts the requests InFlightMiddleware has let in that haven't
+// finished yet.
+var inFlight atomic.Int64
+
+// InFlightMiddleware counts the requests being served, exported as the
+// rate_limiter_in_flight_requests gauge so a draining shutdown can be
+// watched.
+func InFlightMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		inFlight.Add(1)
+		defer inFlight.Add(-1)
+		c.Next()
+	}
+}
+
+// InFlightRequests returns how many requests InFlightMiddleware is counting.
+func InFlightRequests() int64 {
+	return inFlight.Load()
+}
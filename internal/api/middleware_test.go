@@ -0,0 +1,137 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AndySung320/rate-limiter/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	router := gin.New()
+	router.Use(RequestIDMiddleware())
+	router.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, "%s|%s", c.GetString("request_id"), c.GetHeader(RequestIDHeader))
+	})
+
+	tests := []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{"none", "", false},
+		{"caller's", "trace-abc-123", true},
+		{"too long", strings.Repeat("a", 129), false},
+		{"line break", "abc\nforged log line", false},
+		{"spaces", "abc def", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set(RequestIDHeader, tt.header)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			id := w.Header().Get(RequestIDHeader)
+			if tt.keep && id != tt.header {
+				t.Fatalf("expected the caller's ID %q, got %q", tt.header, id)
+			}
+			if !tt.keep {
+				if parsed, err := uuid.Parse(id); err != nil || parsed.Version() != 4 {
+					t.Fatalf("expected a generated UUID v4, got %q", id)
+				}
+			}
+			// The handler sees the same ID in the context and request header
+			if w.Body.String() != id+"|"+id {
+				t.Errorf("expected the handler to see %q, got %q", id, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestRequestID_SameInLogsHeaderAndAudit(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(io.Discard) })
+
+	recorder := &recordingAuditLogger{}
+	handler := NewRateLimiterHandlerWithOptions(storage.NewMemoryStorage(), auditRules(), HandlerOptions{
+		AuditLogger: recorder,
+		Verbose:     true,
+	})
+	router := gin.New()
+	router.Use(RequestIDMiddleware())
+	router.POST("/check", handler.CheckHandler)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/check", strings.NewReader(`{"key": "alice", "endpoint": "/api/upload", "user_tier": "free"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	id := w.Header().Get(RequestIDHeader)
+	if id == "" {
+		t.Fatal("expected an X-Request-ID response header")
+	}
+	if len(recorder.entries) != 1 || recorder.entries[0].RequestID != id {
+		t.Errorf("expected the audit entry to carry %q, got %+v", id, recorder.entries)
+	}
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	for _, line := range lines {
+		if !strings.Contains(line, "["+id+"]") {
+			t.Errorf("expected every log line of the request to carry %q, got %q", id, line)
+		}
+	}
+	if len(lines) < 3 {
+		t.Errorf("expected the verbose check lines, got %q", logs.String())
+	}
+}
+
+func TestCheck_GeneratesRequestID(t *testing.T) {
+	recorder := &recordingAuditLogger{}
+	handler := NewRateLimiterHandlerWithOptions(storage.NewMemoryStorage(), auditRules(), HandlerOptions{AuditLogger: recorder})
+	handler.Check(CheckRequest{Key: "alice", Endpoint: "/api/export"})
+	handler.Check(CheckRequest{Key: "alice", Endpoint: "/api/export", RequestID: "from-grpc"})
+	if _, err := uuid.Parse(recorder.entries[0].RequestID); err != nil {
+		t.Errorf("expected checks without an ID to get one, got %q", recorder.entries[0].RequestID)
+	}
+	if recorder.entries[1].RequestID != "from-grpc" {
+		t.Errorf("expected the caller's ID kept, got %q", recorder.entries[1].RequestID)
+	}
+}
+
+func TestInFlightMiddleware(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	router := gin.New()
+	router.Use(InFlightMiddleware())
+	router.GET("/slow", func(c *gin.Context) {
+		close(started)
+		<-release
+		c.Status(http.StatusOK)
+	})
+
+	before := InFlightRequests()
+	done := make(chan struct{})
+	go func() {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+		close(done)
+	}()
+	<-started
+	if got := InFlightRequests(); got != before+1 {
+		t.Errorf("expected %d in flight during the request, got %d", before+1, got)
+	}
+	close(release)
+	<-done
+	if got := InFlightRequests(); got != before {
+		t.Errorf("expected %d in flight once it finished, got %d", before, got)
+	}
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"time"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/notifier"
+)
+
+// Notifier is told about events operators may want alerting on, with the
+// rules' webhook section to send them to, e.g. a notifier.WebhookNotifier.
+// Notify runs on the request path, so it must not block.
+type Notifier interface {
+	Notify(webhook config.WebhookConfig, event notifier.Event)
+}
+
+// notify sends an event about req to the notifier, if there is one.
+func (h *RateLimiterHandler) notify(event string, req CheckRequest, metadata map[string]any) {
+	if h.notifier == nil {
+		return
+	}
+	h.notifier.Notify(h.Rules().Webhook, notifier.Event{
+		Event:     event,
+		Key:       req.Key,
+		Endpoint:  req.Endpoint,
+		Timestamp: h.clock().UTC(),
+		Metadata:  metadata,
+	})
+}
+
+// notifyPenalty reports a penalty that has just started: a ban when it
+// blocks the key, otherwise a high denial rate.
+func (h *RateLimiterHandler) notifyPenalty(req CheckRequest, p config.PenaltyConfig, until time.Time) {
+	event := config.EventHighDenialRate
+	if p.CapacityMultiplier == 0 {
+		event = config.EventBan
+	}
+	h.notify(event, req, map[string]any{
+		"denials":             p.Threshold,
+		"window":              p.Window.String(),
+		"penalty_ends_at":     until.UTC(),
+		"capacity_multiplier": p.CapacityMultiplier,
+	})
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/notifier"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+)
+
+type recordingNotifier struct {
+	mu     sync.Mutex
+	events []notifier.Event
+}
+
+func (n *recordingNotifier) Notify(_ config.WebhookConfig, event notifier.Event) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.events = append(n.events, event)
+}
+
+func (n *recordingNotifier) kinds() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var kinds []string
+	for _, event := range n.events {
+		kinds = append(kinds, event.Event)
+	}
+	return kinds
+}
+
+func TestCheck_NotifiesPenalties(t *testing.T) {
+	tests := []struct {
+		name       string
+		multiplier float64
+		want       string
+	}{
+		{"blocking penalty is a ban", 0, config.EventBan},
+		{"throttling penalty is a high denial rate", 0.5, config.EventHighDenialRate},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := &config.RuleSet{
+				Tiers:     map[string]config.TierConfig{"free": {Capacity: 1, RefillRate: 0.001}},
+				Endpoints: map[string]config.EndpointConfig{"/api/upload": {Rule: "tiers+endpoints", Cost: 1, GlobalCapacity: 10000, GlobalRefillRate: 1000}},
+				Penalty:   config.PenaltyConfig{Threshold: 2, Window: time.Minute, Duration: 10 * time.Minute, CapacityMultiplier: tt.multiplier},
+			}
+			notified := new(recordingNotifier)
+			handler := NewRateLimiterHandlerWithOptions(storage.NewMemoryStorage(), rules, HandlerOptions{Notifier: notified})
+			req := CheckRequest{Key: "user123", Endpoint: "/api/upload", UserTier: "free"}
+
+			for i := 0; i < 5; i++ {
+				if _, err := handler.Check(req); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			if got := notified.kinds(); len(got) != 1 || got[0] != tt.want {
+				t.Fatalf("expected a single %s event when the penalty started, got %v", tt.want, got)
+			}
+			event := notified.events[0]
+			if event.Key != "user123" || event.Endpoint != "/api/upload" || event.Metadata["denials"] != int64(2) {
+				t.Errorf("expected the event to name the key, endpoint and threshold, got %+v", event)
+			}
+		})
+	}
+}
+
+func TestCheck_NotifiesExhaustedQuota(t *testing.T) {
+	rules := &config.RuleSet{
+		Tiers:     map[string]config.TierConfig{"free": {Capacity: 100, RefillRate: 10, Quota: &config.QuotaConfig{Amount: 1, Window: config.QuotaDay}}},
+		Endpoints: map[string]config.EndpointConfig{"/api/report": {Rule: "tiers+endpoints", Cost: 1, GlobalCapacity: 10000, GlobalRefillRate: 1000}},
+	}
+	notified := new(recordingNotifier)
+	handler := NewRateLimiterHandlerWithOptions(storage.NewMemoryStorage(), rules, HandlerOptions{Notifier: notified})
+	req := CheckRequest{Key: "user123", Endpoint: "/api/report", UserTier: "free"}
+
+	if resp, _ := handler.Check(req); !resp.Allowed {
+		t.Fatalf("expected the first request to be allowed, got %+v", resp)
+	}
+	if len(notified.kinds()) != 0 {
+		t.Fatalf("expected no event while the quota lasts, got %v", notified.kinds())
+	}
+	if resp, _ := handler.Check(req); resp.Allowed {
+		t.Fatalf("expected the quota to deny, got %+v", resp)
+	}
+	if got := notified.kinds(); len(got) != 1 || got[0] != config.EventQuotaExceeded {
+		t.Errorf("expected a quota_exceeded event, got %v", got)
+	}
+}
@@ -0,0 +1,613 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+//go:generate go run ../../cmd/generate-openapi ../../api/openapi.yaml
+
+// GenerateOpenAPI returns an OpenAPI 3.0 description of the HTTP API as
+// YAML. Request and response bodies are built from the handlers' types by
+// their json names, so they follow the code; routes, statuses and headers
+// come from apiOperations, which must be kept in step with cmd/server.
+func GenerateOpenAPI() ([]byte, error) {
+	g := &openAPIGenerator{schemas: map[string]any{"Error": errorSchema}}
+	// Referred to by GET /rules and POST /admin/rules without a Go type
+	g.schema(reflect.TypeOf(config.RuleSet{}))
+	g.schema(reflect.TypeOf(config.EndpointConfig{}))
+	paths := make(map[string]map[string]openAPIOperation)
+	for _, op := range apiOperations {
+		if paths[op.path] == nil {
+			paths[op.path] = make(map[string]openAPIOperation)
+		}
+		method := strings.ToLower(op.method)
+		if _, dup := paths[op.path][method]; dup {
+			return nil, fmt.Errorf("%s %s is described twice", op.method, op.path)
+		}
+		paths[op.path][method] = g.operation(op)
+	}
+	doc := openAPIDocument{
+		OpenAPI: "3.0.3",
+		Info: map[string]any{
+			"title":       "Rate limiter",
+			"description": "Token bucket rate limiting over HTTP. Admin routes answer 503 unless ADMIN_TOKENS or RATE_LIMITER_ADMIN_TOKEN is set.",
+			"version":     "1.0.0",
+		},
+		Paths: paths,
+		Components: map[string]any{
+			"schemas":    g.schemas,
+			"headers":    openAPIHeaders,
+			"parameters": map[string]any{"Cost": costParameter},
+			"securitySchemes": map[string]any{
+				"adminToken": map[string]any{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "An operator token from ADMIN_TOKENS, or RATE_LIMITER_ADMIN_TOKEN",
+				},
+				"checkToken": map[string]any{
+					"type":         "http",
+					"scheme":       "bearer",
+					"bearerFormat": "JWT",
+					"description":  "Supplies the key, and optionally the tier, of a check when the rules enable jwt",
+				},
+			},
+		},
+	}
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(doc); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// openAPISpec is the OpenAPI description, generated once as it only changes
+// with the code.
+var openAPISpec = sync.OnceValues(GenerateOpenAPI)
+
+// OpenAPIHandler serves the OpenAPI description of the HTTP API; see
+// GenerateOpenAPI.
+func (h *RateLimiterHandler) OpenAPIHandler(c *gin.Context) {
+	spec, err := openAPISpec()
+	if err != nil {
+		log.Printf("❌ Generating OpenAPI spec failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Rate limiter unavailable"})
+		return
+	}
+	c.Data(http.StatusOK, "application/yaml", spec)
+}
+
+type openAPIDocument struct {
+	OpenAPI    string                                 `yaml:"openapi"`
+	Info       map[string]any                         `yaml:"info"`
+	Paths      map[string]map[string]openAPIOperation `yaml:"paths"`
+	Components map[string]any                         `yaml:"components"`
+}
+
+type openAPIOperation struct {
+	OperationID string                `yaml:"operationId"`
+	Summary     string                `yaml:"summary"`
+	Tags        []string              `yaml:"tags"`
+	Security    []map[string][]string `yaml:"security,omitempty"`
+	Parameters  []any                 `yaml:"parameters,omitempty"`
+	RequestBody map[string]any        `yaml:"requestBody,omitempty"`
+	Responses   map[string]any        `yaml:"responses"`
+}
+
+// apiOperation describes one route.
+type apiOperation struct {
+	method, path string
+	id, summary  string
+	admin        bool  // Served under AdminAuth
+	jwt          bool  // Takes a bearer token when the rules enable jwt
+	parameters   []any // Path, query and header parameters
+	body         any   // Request body type, or a schema; nil for none
+	responses    map[int]apiResponse
+}
+
+type apiResponse struct {
+	description string
+	body        any      // Response body type, or a schema; nil for none
+	contentType string   // Defaults to application/json
+	headers     []string // Keys of openAPIHeaders
+}
+
+type openAPIGenerator struct {
+	schemas map[string]any
+}
+
+// operation returns the OpenAPI form of op. Admin routes get the admin
+// token and its 401, and every response carries the request ID.
+func (g *openAPIGenerator) operation(op apiOperation) openAPIOperation {
+	out := openAPIOperation{
+		OperationID: op.id,
+		Summary:     op.summary,
+		Tags:        []string{"check"},
+		Parameters:  op.parameters,
+		Responses:   make(map[string]any),
+	}
+	if op.body != nil {
+		out.RequestBody = map[string]any{
+			"required": true,
+			"content":  map[string]any{"application/json": map[string]any{"schema": g.bodySchema(op.body)}},
+		}
+	}
+	for status, resp := range op.responses {
+		out.Responses[strconv.Itoa(status)] = g.response(resp)
+	}
+	if op.jwt {
+		// Optional, as it depends on the rules
+		out.Security = []map[string][]string{{}, {"checkToken": {}}}
+	}
+	if op.admin {
+		out.Tags = []string{"admin"}
+		out.Security = []map[string][]string{{"adminToken": {}}}
+		out.Responses[strconv.Itoa(http.StatusUnauthorized)] = g.response(errorResponse("Missing admin token"))
+		out.Responses[strconv.Itoa(http.StatusForbidden)] = g.response(errorResponse("Unknown admin token"))
+		out.Responses[strconv.Itoa(http.StatusServiceUnavailable)] = g.response(errorResponse("No admin tokens are configured"))
+	}
+	return out
+}
+
+func (g *openAPIGenerator) response(resp apiResponse) map[string]any {
+	headers := map[string]any{RequestIDHeader: map[string]any{"$ref": "#/components/headers/" + RequestIDHeader}}
+	for _, name := range resp.headers {
+		headers[name] = map[string]any{"$ref": "#/components/headers/" + name}
+	}
+	response := map[string]any{"description": resp.description, "headers": headers}
+	if resp.body != nil {
+		contentType := resp.contentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		response["content"] = map[string]any{contentType: map[string]any{"schema": g.bodySchema(resp.body)}}
+	}
+	return response
+}
+
+// bodySchema returns body itself when it is already a schema, or else the
+// schema of its type.
+func (g *openAPIGenerator) bodySchema(body any) map[string]any {
+	if schema, ok := body.(map[string]any); ok {
+		return schema
+	}
+	return g.schema(reflect.TypeOf(body))
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	denyReasonType = reflect.TypeOf(storage.DenyReason(""))
+	configPkgPath  = reflect.TypeOf(config.RuleSet{}).PkgPath()
+)
+
+// schema returns the schema for JSON values of typ, with structs as
+// references to their component schemas. Rules types are left opaque, as
+// their fields are described by the rules file JSON Schema.
+func (g *openAPIGenerator) schema(typ reflect.Type) map[string]any {
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	switch {
+	case typ == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case typ == denyReasonType:
+		return map[string]any{"type": "string", "enum": []storage.DenyReason{storage.DenyUserTokens, storage.DenyGlobalTokens, storage.DenyBlocked}}
+	case typ.Kind() == reflect.Struct && typ.PkgPath() == configPkgPath:
+		if _, ok := g.schemas[typ.Name()]; !ok {
+			g.schemas[typ.Name()] = map[string]any{
+				"type":        "object",
+				"description": "config." + typ.Name() + " in JSON, with the field names of a rules file; GET /admin/schema serves their JSON Schema",
+			}
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + typ.Name()}
+	case typ.Kind() == reflect.Struct:
+		if _, ok := g.schemas[typ.Name()]; !ok {
+			// Placeholder so recursive types stop here
+			g.schemas[typ.Name()] = nil
+			g.schemas[typ.Name()] = g.object(typ)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + typ.Name()}
+	case typ.Kind() == reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(typ.Elem())}
+	case typ.Kind() == reflect.Slice:
+		return map[string]any{"type": "array", "items": g.schema(typ.Elem())}
+	case typ.Kind() == reflect.String:
+		return map[string]any{"type": "string"}
+	case typ.Kind() == reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case typ.Kind() == reflect.Int64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case typ.Kind() >= reflect.Int && typ.Kind() <= reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case typ.Kind() == reflect.Float32 || typ.Kind() == reflect.Float64:
+		return map[string]any{"type": "number"}
+	}
+	return map[string]any{}
+}
+
+// object returns the schema for the struct typ. Fields its binding tags
+// require are required.
+func (g *openAPIGenerator) object(typ reflect.Type) map[string]any {
+	properties := make(map[string]any)
+	var required []string
+	for _, field := range jsonFields(typ) {
+		properties[field.name] = g.schema(field.typ)
+		if slices.Contains(strings.Split(field.binding, ","), "required") {
+			required = append(required, field.name)
+		}
+	}
+	schema := map[string]any{"type": "object", "properties": properties}
+	if required != nil {
+		schema["required"] = required
+	}
+	return schema
+}
+
+type jsonField struct {
+	name    string
+	typ     reflect.Type
+	binding string
+}
+
+// jsonFields returns the fields encoding/json writes for typ, with those
+// of embedded structs in line.
+func jsonFields(typ reflect.Type) []jsonField {
+	var fields []jsonField
+	for i := range typ.NumField() {
+		f := typ.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			fields = append(fields, jsonFields(f.Type)...)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, jsonField{name: name, typ: f.Type, binding: f.Tag.Get("binding")})
+	}
+	return fields
+}
+
+// errorSchema is the body of every error response: an error message, the
+// failed rule of each field for validation_failed, and sometimes details.
+var errorSchema = map[string]any{
+	"type":     "object",
+	"required": []string{"error"},
+	"properties": map[string]any{
+		"error":  map[string]any{"type": "string"},
+		"fields": map[string]any{"type": "object", "additionalProperties": map[string]any{"type": "string"}},
+	},
+	"additionalProperties": true,
+}
+
+func errorResponse(description string) apiResponse {
+	return apiResponse{description: description, body: map[string]any{"$ref": "#/components/schemas/Error"}}
+}
+
+// openAPIHeaders are the response headers responses refer to by name.
+var openAPIHeaders = map[string]any{
+	RequestIDHeader:                header("string", "The request's ID, as sent or generated; its log lines and audit entry carry it"),
+	burstHeader:                    header("integer", "Tokens a full bucket allows at once"),
+	sustainedRateHeader:            header("number", "Tokens per second the bucket refills at"),
+	"X-RateLimit-Remaining":        header("integer", "Tokens left in the per-key bucket"),
+	"X-RateLimit-Global-Remaining": header("integer", "Tokens left in the endpoint's global bucket"),
+	"Retry-After":                  header("integer", "Seconds until the request could be allowed"),
+	"X-RateLimit-Retry-After-Ms":   header("integer", "Milliseconds until the request could be allowed"),
+	"X-RateLimit-Error":            header("string", "Why the request was rejected"),
+}
+
+func header(typ, description string) map[string]any {
+	return map[string]any{"description": description, "schema": map[string]any{"type": typ}}
+}
+
+var costParameter = map[string]any{
+	"name":        CostHeader,
+	"in":          "header",
+	"description": "The request's cost, for callers without a body to put it in; a cost in the body takes precedence",
+	"schema":      map[string]any{"type": "integer", "minimum": 1},
+}
+
+func queryParameter(name, description, typ string) map[string]any {
+	return map[string]any{"name": name, "in": "query", "description": description, "schema": map[string]any{"type": typ}}
+}
+
+func headerParameter(name, description string, required bool) map[string]any {
+	return map[string]any{"name": name, "in": "header", "description": description, "required": required, "schema": map[string]any{"type": "string"}}
+}
+
+// objectSchema builds an inline schema for responses written as gin.H.
+func objectSchema(properties map[string]string) map[string]any {
+	props := make(map[string]any, len(properties))
+	for name, typ := range properties {
+		props[name] = map[string]any{"type": typ}
+	}
+	return map[string]any{"type": "object", "properties": props}
+}
+
+var costRef = map[string]any{"$ref": "#/components/parameters/Cost"}
+
+// apiOperations lists every route cmd/server serves.
+var apiOperations = []apiOperation{
+	{
+		method: http.MethodGet, path: "/health", id: "health",
+		summary: "Report the storage's health; a slow ping is degraded but still 200",
+		responses: map[int]apiResponse{
+			http.StatusOK:                 {description: "Healthy or degraded", body: HealthResponse{}},
+			http.StatusServiceUnavailable: {description: "The storage is unreachable", body: HealthResponse{}},
+		},
+	},
+	{
+		method: http.MethodGet, path: "/metrics", id: "metrics",
+		summary: "Prometheus metrics",
+		responses: map[int]apiResponse{
+			http.StatusOK: {description: "Metrics in the Prometheus text format", body: map[string]any{"type": "string"}, contentType: "text/plain"},
+		},
+	},
+	{
+		method: http.MethodPost, path: "/check", id: "check", jwt: true,
+		summary:    "Charge a request's cost to its buckets, or deny it",
+		parameters: []any{costRef},
+		body:       CheckRequest{},
+		responses: map[int]apiResponse{
+			http.StatusOK:                  {description: "Allowed", body: CheckResponse{}, headers: []string{burstHeader, sustainedRateHeader}},
+			http.StatusBadRequest:          errorResponse("Invalid request, e.g. an unknown endpoint or tier"),
+			http.StatusUnauthorized:        errorResponse("Missing or invalid bearer token when the rules enable jwt"),
+			http.StatusTooManyRequests:     {description: "Denied, or the client IP exceeded self_protect, answered with an error and Retry-After instead", body: CheckResponse{}, headers: []string{burstHeader, sustainedRateHeader, "Retry-After"}},
+			http.StatusInternalServerError: errorResponse("Storage unavailable"),
+		},
+	},
+	{
+		method: http.MethodPost, path: "/wait", id: "wait",
+		summary:    "Check, holding a denied request up to max_wait_ms for tokens",
+		parameters: []any{costRef},
+		body:       WaitRequest{},
+		responses: map[int]apiResponse{
+			http.StatusOK:                  {description: "Allowed", body: CheckResponse{}},
+			http.StatusBadRequest:          errorResponse("Invalid request"),
+			http.StatusTooManyRequests:     {description: "Denied, or the tokens wouldn't come back in time; or the client IP exceeded self_protect, answered with an error instead", body: CheckResponse{}, headers: []string{"Retry-After"}},
+			http.StatusInternalServerError: errorResponse("Storage unavailable"),
+		},
+	},
+	{
+		method: http.MethodPost, path: "/reserve", id: "reserve",
+		summary:    "Check, holding the tokens until the reservation is committed or released",
+		parameters: []any{costRef},
+		body:       ReserveRequest{},
+		responses: map[int]apiResponse{
+			http.StatusOK:                  {description: "Allowed; reservationId is set when tokens were reserved", body: ReserveResponse{}},
+			http.StatusBadRequest:          errorResponse("Invalid request"),
+			http.StatusTooManyRequests:     {description: "Denied, or the client IP exceeded self_protect, answered with an error and Retry-After instead", body: ReserveResponse{}},
+			http.StatusInternalServerError: errorResponse("Storage unavailable"),
+		},
+	},
+	{
+		method: http.MethodPost, path: "/commit", id: "commit",
+		summary: "Keep a reservation's tokens spent",
+		body:    SettleRequest{},
+		responses: map[int]apiResponse{
+			http.StatusOK:                  {description: "Settled, or already settled", body: SettleResponse{}},
+			http.StatusBadRequest:          errorResponse("Invalid request"),
+			http.StatusInternalServerError: errorResponse("Storage unavailable"),
+		},
+	},
+	{
+		method: http.MethodPost, path: "/release", id: "release",
+		summary: "Return a reservation's tokens",
+		body:    SettleRequest{},
+		responses: map[int]apiResponse{
+			http.StatusOK:                  {description: "Settled, or already settled", body: SettleResponse{}},
+			http.StatusBadRequest:          errorResponse("Invalid request"),
+			http.StatusInternalServerError: errorResponse("Storage unavailable"),
+		},
+	},
+	{
+		method: http.MethodPost, path: "/refund", id: "refund",
+		summary:    "Return the cost of a check whose work failed, up to each bucket's capacity",
+		parameters: []any{costRef},
+		body:       CheckRequest{},
+		responses: map[int]apiResponse{
+			http.StatusOK:                  {description: "Refunded", body: RefundResponse{}},
+			http.StatusBadRequest:          errorResponse("Invalid request"),
+			http.StatusTooManyRequests:     {description: "The client IP exceeded self_protect", body: map[string]any{"$ref": "#/components/schemas/Error"}, headers: []string{"Retry-After"}},
+			http.StatusInternalServerError: errorResponse("Storage unavailable"),
+		},
+	},
+	{
+		method: http.MethodGet, path: "/check/authrequest", id: "checkAuthRequest",
+		summary: "Check an nginx auth_request subrequest; the header names are configurable",
+		parameters: []any{
+			headerParameter("X-Original-URI", "The original request URI, used as the endpoint", true),
+			headerParameter("X-RateLimit-Key", "The key; the client IP when absent", false),
+			headerParameter("X-RateLimit-Tier", "The user tier", false),
+			costRef,
+		},
+		responses: map[int]apiResponse{
+			http.StatusNoContent: {
+				description: "Allowed, or the URI has no rule",
+				headers:     []string{"X-RateLimit-Remaining", "X-RateLimit-Global-Remaining", burstHeader, sustainedRateHeader},
+			},
+			http.StatusBadRequest: {description: "No URI, or an invalid request", headers: []string{"X-RateLimit-Error"}},
+			http.StatusTooManyRequests: {
+				description: "Denied, or the client IP exceeded self_protect",
+				headers:     []string{"X-RateLimit-Remaining", "X-RateLimit-Global-Remaining", burstHeader, sustainedRateHeader, "Retry-After", "X-RateLimit-Retry-After-Ms"},
+			},
+			http.StatusInternalServerError: {description: "Storage unavailable"},
+		},
+	},
+	{
+		method: http.MethodGet, path: "/rules", id: "rules",
+		summary:    "The rules in effect, or one endpoint's",
+		parameters: []any{queryParameter("endpoint", "Return only this endpoint's config", "string")},
+		responses: map[int]apiResponse{
+			http.StatusOK: {description: "The rules, or the endpoint's config", body: map[string]any{"oneOf": []any{
+				map[string]any{"$ref": "#/components/schemas/RuleSet"},
+				map[string]any{"$ref": "#/components/schemas/EndpointConfig"},
+			}}},
+			http.StatusNotFound: errorResponse("Unknown endpoint"),
+		},
+	},
+	{
+		method: http.MethodGet, path: "/limits", id: "limits",
+		summary: "Each bucket's burst and sustained rate",
+		responses: map[int]apiResponse{
+			http.StatusOK:                  {description: "Limits", body: LimitsResponse{}},
+			http.StatusInternalServerError: errorResponse("The rules have an invalid limit"),
+		},
+	},
+	{
+		method: http.MethodGet, path: "/openapi.yaml", id: "openAPI",
+		summary: "This description",
+		responses: map[int]apiResponse{
+			http.StatusOK: {description: "OpenAPI 3.0 YAML", body: map[string]any{"type": "string"}, contentType: "application/yaml"},
+		},
+	},
+	{
+		method: http.MethodPost, path: "/admin/topup", id: "topUp", admin: true,
+		summary: "Add tokens to a key's tiers+endpoints bucket",
+		body:    TopUpRequest{},
+		responses: map[int]apiResponse{
+			http.StatusOK:                  {description: "The new balance", body: TopUpResponse{}},
+			http.StatusBadRequest:          errorResponse("Invalid request"),
+			http.StatusInternalServerError: errorResponse("Storage unavailable"),
+		},
+	},
+	{
+		method: http.MethodPost, path: "/admin/buckets/reset", id: "resetBuckets", admin: true,
+		summary: "Delete every bucket matching a pattern, streaming progress",
+		body:    ResetBucketsRequest{},
+		responses: map[int]apiResponse{
+			http.StatusOK: {
+				description: "One progress object per batch, then a final one with done or error set",
+				body:        storage.ResetProgress{},
+				contentType: "application/x-ndjson",
+			},
+			http.StatusBadRequest: errorResponse("Unconfirmed, or a pattern matching every bucket without force"),
+		},
+	},
+	{
+		method: http.MethodDelete, path: "/admin/buckets/{key}", id: "deleteBucket", admin: true,
+		summary:    "Delete one bucket",
+		parameters: []any{map[string]any{"name": "key", "in": "path", "required": true, "schema": map[string]any{"type": "string"}}},
+		responses: map[int]apiResponse{
+			http.StatusOK:                  {description: "Whether the bucket existed", body: objectSchema(map[string]string{"key": "string", "deleted": "boolean"})},
+			http.StatusBadRequest:          errorResponse("Missing key"),
+			http.StatusInternalServerError: errorResponse("Storage unavailable"),
+		},
+	},
+	{
+		method: http.MethodPost, path: "/admin/purge", id: "purgeKeys", admin: true,
+		summary: "Delete every key matching a pattern",
+		body:    PurgeKeysRequest{},
+		responses: map[int]apiResponse{
+			http.StatusOK:                  {description: "Keys deleted", body: PurgeKeysResponse{}},
+			http.StatusBadRequest:          errorResponse("Unconfirmed, or a pattern matching every key without force"),
+			http.StatusInternalServerError: errorResponse("Storage unavailable, with the keys deleted so far"),
+		},
+	},
+	{
+		method: http.MethodPost, path: "/admin/set", id: "setBucket", admin: true,
+		summary: "Set a key's balance",
+		body:    SetBucketRequest{},
+		responses: map[int]apiResponse{
+			http.StatusOK:                  {description: "Set", body: objectSchema(map[string]string{"key": "string", "tokens": "integer"})},
+			http.StatusBadRequest:          errorResponse("Invalid request"),
+			http.StatusInternalServerError: errorResponse("Storage unavailable"),
+		},
+	},
+	{
+		method: http.MethodPost, path: "/admin/simulate", id: "simulate", admin: true,
+		summary: "Replay requests against candidate rules in memory",
+		body:    SimulateRequest{},
+		responses: map[int]apiResponse{
+			http.StatusOK:                  {description: "One result per request, in order", body: []SimulateResult{}},
+			http.StatusBadRequest:          errorResponse("Invalid rules, or too many requests"),
+			http.StatusInternalServerError: errorResponse("Simulation failed"),
+		},
+	},
+	{
+		method: http.MethodPost, path: "/admin/tiers/set", id: "setTier", admin: true,
+		summary: "Store a key's tier for tier_lookup",
+		body:    SetTierRequest{},
+		responses: map[int]apiResponse{
+			http.StatusOK:                  {description: "Stored", body: objectSchema(map[string]string{"key": "string", "tier": "string"})},
+			http.StatusBadRequest:          errorResponse("Unknown tier"),
+			http.StatusInternalServerError: errorResponse("Storage unavailable"),
+		},
+	},
+	{
+		method: http.MethodPost, path: "/admin/tiers/remove", id: "removeTier", admin: true,
+		summary: "Remove a key's stored tier",
+		body:    RemoveTierRequest{},
+		responses: map[int]apiResponse{
+			http.StatusOK:                  {description: "Whether a tier was stored", body: objectSchema(map[string]string{"key": "string", "removed": "boolean"})},
+			http.StatusBadRequest:          errorResponse("Invalid request"),
+			http.StatusInternalServerError: errorResponse("Storage unavailable"),
+		},
+	},
+	{
+		method: http.MethodGet, path: "/admin/top", id: "topConsumers", admin: true,
+		summary: "The keys that consumed most of an endpoint's global bucket this window",
+		parameters: []any{
+			map[string]any{"name": "endpoint", "in": "query", "required": true, "schema": map[string]any{"type": "string"}},
+			queryParameter("n", "How many keys to list", "integer"),
+			queryParameter("namespace", "Defaults to the rules' namespace", "string"),
+		},
+		responses: map[int]apiResponse{
+			http.StatusOK:                  {description: "Highest consumption first", body: TopConsumersResponse{}},
+			http.StatusBadRequest:          errorResponse("Unknown endpoint, or n out of range"),
+			http.StatusNotFound:            errorResponse("Consumption isn't tracked"),
+			http.StatusInternalServerError: errorResponse("Storage unavailable"),
+		},
+	},
+	{
+		method: http.MethodGet, path: "/admin/config", id: "config", admin: true,
+		summary:    "The rules in effect, credentials redacted, with where and when they were loaded",
+		parameters: []any{queryParameter("format", "json (the default), or yaml for the rules as a YAML rules file with the provenance in comments", "string")},
+		responses: map[int]apiResponse{
+			http.StatusOK:         {description: "The rules and their provenance", body: ConfigResponse{}},
+			http.StatusBadRequest: errorResponse("Unknown format"),
+		},
+	},
+	{
+		method: http.MethodGet, path: "/admin/schema", id: "rulesSchema", admin: true,
+		summary: "The JSON Schema for rules files",
+		responses: map[int]apiResponse{
+			http.StatusOK: {description: "JSON Schema draft-07", body: map[string]any{"type": "object"}, contentType: "application/schema+json"},
+		},
+	},
+	{
+		method: http.MethodPost, path: "/admin/rules", id: "publishRules", admin: true,
+		summary: "Validate a rules file and publish it for every replica; only served with Redis-stored rules",
+		body:    map[string]any{"$ref": "#/components/schemas/RuleSet"},
+		responses: map[int]apiResponse{
+			http.StatusOK:                  {description: "Published", body: objectSchema(map[string]string{"published": "boolean", "rules_hash": "string"})},
+			http.StatusBadRequest:          errorResponse("Invalid rules"),
+			http.StatusNotFound:            errorResponse("Rules aren't stored centrally"),
+			http.StatusInternalServerError: errorResponse("Storage unavailable"),
+		},
+	},
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/gin-gonic/gin"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"gopkg.in/yaml.v3"
+)
+
+func TestGenerateOpenAPI(t *testing.T) {
+	spec, err := GenerateOpenAPI()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	shipped, err := os.ReadFile("../../api/openapi.yaml")
+	if err != nil {
+		t.Fatalf("failed to read the shipped spec: %v", err)
+	}
+	if !bytes.Equal(spec, shipped) {
+		t.Error("api/openapi.yaml is out of date; run go generate ./internal/api")
+	}
+
+	var doc map[string]any
+	if err := yaml.Unmarshal(spec, &doc); err != nil {
+		t.Fatalf("expected the spec to be YAML, got: %v", err)
+	}
+	if doc["openapi"] != "3.0.3" {
+		t.Errorf("expected OpenAPI 3.0.3, got %v", doc["openapi"])
+	}
+
+	// Every reference resolves
+	var walk func(node any)
+	walk = func(node any) {
+		switch node := node.(type) {
+		case map[string]any:
+			if ref, ok := node["$ref"].(string); ok {
+				var target any = doc
+				for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+					m, _ := target.(map[string]any)
+					target = m[part]
+				}
+				if target == nil {
+					t.Errorf("unresolved reference %s", ref)
+				}
+			}
+			for _, v := range node {
+				walk(v)
+			}
+		case []any:
+			for _, v := range node {
+				walk(v)
+			}
+		}
+	}
+	walk(doc)
+
+	paths := doc["paths"].(map[string]any)
+	check := paths["/check"].(map[string]any)["post"].(map[string]any)
+	for _, status := range []string{"200", "400", "429", "500"} {
+		if _, ok := check["responses"].(map[string]any)[status]; !ok {
+			t.Errorf("expected /check to describe a %s", status)
+		}
+	}
+	if headers := check["responses"].(map[string]any)["429"].(map[string]any)["headers"].(map[string]any); headers[burstHeader] == nil {
+		t.Errorf("expected a denied check to carry %s, got %v", burstHeader, headers)
+	}
+	topUp := paths["/admin/topup"].(map[string]any)["post"].(map[string]any)
+	if topUp["security"] == nil || topUp["responses"].(map[string]any)["401"] == nil {
+		t.Errorf("expected admin routes to require the admin token, got %v", topUp)
+	}
+
+	// The schemas match what the handlers write
+	compiler := jsonschema.NewCompiler()
+	data, _ := json.Marshal(doc)
+	resource, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := compiler.AddResource("openapi.json", resource); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	validate := func(schema string, value any) {
+		t.Helper()
+		compiled, err := compiler.Compile("openapi.json#/components/schemas/" + schema)
+		if err != nil {
+			t.Fatalf("expected %s to compile, got: %v", schema, err)
+		}
+		data, _ := json.Marshal(value)
+		instance, _ := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+		if err := compiled.Validate(instance); err != nil {
+			t.Errorf("expected %s to match its schema, got: %v", schema, err)
+		}
+	}
+	remaining := int64(3)
+	validate("CheckResponse", CheckResponse{Allowed: true, UserRemaining: 9, IPRemaining: &remaining, DenyReason: "blocked"})
+	validate("ReserveResponse", ReserveResponse{CheckResponse: CheckResponse{Allowed: true}, ReservationID: "abc"})
+	validate("CheckRequest", CheckRequest{Key: "alice", Endpoint: "/api/upload", Costs: map[string]int64{"cpu": 2}})
+	validate("LimitsResponse", LimitsResponse{
+		Tiers:     map[string]BucketLimits{"free": {Burst: 10, SustainedRate: 1}},
+		Endpoints: map[string]EndpointLimits{"/api/list": {Rule: "endpoint", Cost: 1, Global: &BucketLimits{Burst: 5}}},
+	})
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	handler := NewRateLimiterHandler(new(MockRedisStorage), &config.RuleSet{})
+	router := gin.New()
+	router.GET("/openapi.yaml", handler.OpenAPIHandler)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/openapi.yaml", nil))
+
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/yaml" {
+		t.Fatalf("expected the spec, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if !strings.HasPrefix(w.Body.String(), "openapi: 3.0.3\n") {
+		t.Errorf("expected an OpenAPI document, got %.40q", w.Body.String())
+	}
+}
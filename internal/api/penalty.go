@@ -0,0 +1,61 @@
+package api
+
+import (
+	"log"
+	"math"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/internal/storage"
+)
+
+// penalizedDualBucket runs a dual check for the per-key bucket key under
+// the rule set's progressive penalty, see penalized.
+func (h *RateLimiterHandler) penalizedDualBucket(res *reservation, req CheckRequest, dryRun bool, key, globalKey string, globalCap int64, globalRate float64, userCap int64, userRate float64, userMaxDebt, cost int64, resources []storage.ResourceBucket, quotas []storage.Quota, start bucketStart, ttl time.Duration) (storage.BucketResult, time.Time, error) {
+	return h.penalized(req, dryRun, key, userCap, userRate, userMaxDebt, func(userCap int64, userRate float64, userMaxDebt int64) (storage.BucketResult, error) {
+		return h.dualBucket(res, key, globalKey, globalCap, globalRate, userCap, userRate, userMaxDebt, cost, resources, quotas, start, ttl)
+	})
+}
+
+// penalized runs charge for the per-key bucket key, applying the rule set's
+// progressive penalty when one is configured: a penalized key gets a
+// scaled-down bucket (or is denied outright), and denials of a key in good
+// standing count towards a penalty, which is reported to the notifier when
+// it starts. It also returns when the key's penalty ends, or the zero time
+// when it is not penalized.
+func (h *RateLimiterHandler) penalized(req CheckRequest, dryRun bool, key string, userCap int64, userRate float64, userMaxDebt int64, charge func(userCap int64, userRate float64, userMaxDebt int64) (storage.BucketResult, error)) (storage.BucketResult, time.Time, error) {
+	p := h.Rules().Penalty
+	if p.Threshold <= 0 {
+		result, err := charge(userCap, userRate, userMaxDebt)
+		return result, time.Time{}, err
+	}
+
+	until, err := h.storage.PenaltyStatus(key)
+	if err != nil {
+		return storage.BucketResult{}, time.Time{}, err
+	}
+	if !until.IsZero() {
+		if p.CapacityMultiplier == 0 {
+			return storage.BucketResult{RetryAfter: until.Sub(h.clock()), Reason: storage.DenyBlocked}, until, nil
+		}
+		userCap = int64(math.Ceil(float64(userCap) * p.CapacityMultiplier))
+		userRate *= p.CapacityMultiplier
+		userMaxDebt = 0 // No borrowing while penalized
+	}
+
+	result, err := charge(userCap, userRate, userMaxDebt)
+	if err != nil || result.Allowed || !until.IsZero() || dryRun {
+		return result, until, err
+	}
+
+	// A failure to count the denial must not fail the check itself
+	until, err = h.storage.RecordDenial(key, p.Threshold, p.Window, p.Duration)
+	if err != nil {
+		log.Printf("❌ Recording denial failed - key: %s, error: %v", key, err)
+		return result, time.Time{}, nil
+	}
+	if !until.IsZero() {
+		log.Printf("🚫 Penalizing key: %s until %s", key, until.Format(time.RFC3339))
+		h.notifyPenalty(req, p, until)
+	}
+	return result, until, nil
+}
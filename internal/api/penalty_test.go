@@ -0,0 +1,164 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+	"github.com/stretchr/testify/mock"
+)
+
+func penaltyRules(multiplier float64) *config.RuleSet {
+	rules := adminRules()
+	rules.Penalty = config.PenaltyConfig{Threshold: 5, Window: time.Minute, Duration: 10 * time.Minute, CapacityMultiplier: multiplier}
+	return rules
+}
+
+var penaltyCheck = CheckRequest{Key: "user123", Endpoint: "/api/upload", UserTier: "free"}
+
+const penaltyUserKey = "user:user123:/api/upload:free"
+
+func onPenaltyDual(m *MockRedisStorage, userCap, userRate, maxDebt interface{}, result storage.BucketResult) {
+	m.On("AtomicDualBucket", penaltyUserKey, "global:/api/upload",
+		int64(10000), float64(2000), userCap, userRate, maxDebt, int64(10), time.Hour,
+	).Return(result, nil)
+}
+
+func TestCheck_PenaltyDisabledSkipsTracking(t *testing.T) {
+	mockStorage := new(MockRedisStorage)
+	onPenaltyDual(mockStorage, int64(100), float64(10), int64(0), storage.BucketResult{Allowed: false})
+
+	resp, err := NewRateLimiterHandler(mockStorage, adminRules()).Check(penaltyCheck)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.Penalized {
+		t.Error("expected no penalty when penalties are disabled")
+	}
+	mockStorage.AssertNotCalled(t, "PenaltyStatus", mock.Anything)
+	mockStorage.AssertNotCalled(t, "RecordDenial", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestCheck_DenialsTriggerPenalty(t *testing.T) {
+	penaltyEnd := time.Now().Add(10 * time.Minute).Truncate(time.Millisecond)
+
+	tests := []struct {
+		name          string
+		allowed       bool
+		recorded      time.Time // Returned by RecordDenial
+		wantRecord    bool
+		wantPenalized bool
+	}{
+		{"allowed requests are not counted", true, time.Time{}, false, false},
+		{"denial below threshold", false, time.Time{}, true, false},
+		{"denial reaching threshold", false, penaltyEnd, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage := new(MockRedisStorage)
+			mockStorage.On("PenaltyStatus", penaltyUserKey).Return(time.Time{}, nil)
+			onPenaltyDual(mockStorage, int64(100), float64(10), int64(0), storage.BucketResult{Allowed: tt.allowed})
+			mockStorage.On("RecordDenial", penaltyUserKey, int64(5), time.Minute, 10*time.Minute).Return(tt.recorded, nil)
+
+			resp, err := NewRateLimiterHandler(mockStorage, penaltyRules(0.5)).Check(penaltyCheck)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantRecord {
+				mockStorage.AssertCalled(t, "RecordDenial", penaltyUserKey, int64(5), time.Minute, 10*time.Minute)
+			} else {
+				mockStorage.AssertNotCalled(t, "RecordDenial", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+			}
+			if resp.Penalized != tt.wantPenalized {
+				t.Errorf("expected penalized=%v, got %+v", tt.wantPenalized, resp)
+			}
+			if tt.wantPenalized && resp.PenaltyEndsAtUnixMs != penaltyEnd.UnixMilli() {
+				t.Errorf("expected penalty to end at %d, got %d", penaltyEnd.UnixMilli(), resp.PenaltyEndsAtUnixMs)
+			}
+		})
+	}
+}
+
+func TestCheck_PenalizedKeyGetsReducedBucket(t *testing.T) {
+	penaltyEnd := time.Now().Add(5 * time.Minute)
+	rules := penaltyRules(0.25)
+	tier := rules.Tiers["free"]
+	tier.MaxDebt = 50
+	rules.Tiers["free"] = tier
+
+	mockStorage := new(MockRedisStorage)
+	mockStorage.On("PenaltyStatus", penaltyUserKey).Return(penaltyEnd, nil)
+	// Capacity 100 -> 25, refill 10 -> 2.5, and no borrowing
+	onPenaltyDual(mockStorage, int64(25), float64(2.5), int64(0), storage.BucketResult{Allowed: false, RetryAfter: time.Second})
+
+	resp, err := NewRateLimiterHandler(mockStorage, rules).Check(penaltyCheck)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !resp.Penalized || resp.PenaltyEndsAtUnixMs != penaltyEnd.UnixMilli() {
+		t.Errorf("expected penalized response ending at %d, got %+v", penaltyEnd.UnixMilli(), resp)
+	}
+	mockStorage.AssertExpectations(t)
+	// Denials while penalized do not extend the penalty
+	mockStorage.AssertNotCalled(t, "RecordDenial", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestCheck_PenaltyBlocksOutright(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	mockStorage := new(MockRedisStorage)
+	mockStorage.On("PenaltyStatus", penaltyUserKey).Return(now.Add(time.Minute), nil)
+
+	handler := NewRateLimiterHandlerWithOptions(mockStorage, penaltyRules(0), HandlerOptions{ClockFunc: func() time.Time { return now }})
+	resp, err := handler.Check(penaltyCheck)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.Allowed || !resp.Penalized || resp.DenyReason != storage.DenyBlocked {
+		t.Errorf("expected a penalized denial, got %+v", resp)
+	}
+	if resp.RetryAfterMs != time.Minute.Milliseconds() {
+		t.Errorf("expected retry when the penalty ends by the handler's clock, got %dms", resp.RetryAfterMs)
+	}
+	mockStorage.AssertNotCalled(t, "AtomicDualBucket", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestCheck_PenaltyAppliesToUserIP(t *testing.T) {
+	penaltyEnd := time.Now().Add(5 * time.Minute)
+	rules := penaltyRules(0.25)
+	rules.Endpoints["/api/login"] = config.EndpointConfig{Rule: "user+ip", Cost: 10}
+	check := CheckRequest{Key: "user123", Endpoint: "/api/login", UserTier: "free", IPAddress: "192.0.2.1"}
+	const userKey = "user:user123:/api/login:free"
+
+	// A key in good standing is charged its full bucket, and its denial counts
+	mockStorage := new(MockRedisStorage)
+	mockStorage.On("PenaltyStatus", userKey).Return(time.Time{}, nil)
+	mockStorage.On("AtomicUserIPBucket", userKey, "ip:192.0.2.1:/api/login", int64(100), float64(10), int64(0), int64(500), float64(50), int64(10), mock.Anything).
+		Return(storage.BucketResult{Allowed: false}, nil)
+	mockStorage.On("RecordDenial", userKey, int64(5), time.Minute, 10*time.Minute).Return(penaltyEnd, nil)
+
+	resp, err := NewRateLimiterHandler(mockStorage, rules).Check(check)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !resp.Penalized || resp.PenaltyEndsAtUnixMs != penaltyEnd.UnixMilli() {
+		t.Errorf("expected the denial to start a penalty, got %+v", resp)
+	}
+	mockStorage.AssertExpectations(t)
+
+	// A penalized key gets a scaled-down user bucket; the IP's is unchanged
+	mockStorage = new(MockRedisStorage)
+	mockStorage.On("PenaltyStatus", userKey).Return(penaltyEnd, nil)
+	mockStorage.On("AtomicUserIPBucket", userKey, "ip:192.0.2.1:/api/login", int64(25), float64(2.5), int64(0), int64(500), float64(50), int64(10), mock.Anything).
+		Return(storage.BucketResult{Allowed: true, Remaining: 15, IPRemaining: 490}, nil)
+
+	resp, err = NewRateLimiterHandler(mockStorage, rules).Check(check)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !resp.Allowed || !resp.Penalized || resp.UserRemaining != 15 {
+		t.Errorf("expected an allowed, penalized response, got %+v", resp)
+	}
+	mockStorage.AssertExpectations(t)
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/gin-gonic/gin"
+)
+
+// RulesPublisher stores a rules file centrally for every replica to load,
+// e.g. *storage.RedisRuleStore.
+type RulesPublisher interface {
+	Publish(data []byte) error
+}
+
+// PublishRulesHandler validates the rules file in the request body, YAML or
+// JSON, and publishes it for every replica. Rules that fail to parse or
+// validate are rejected with every problem found and nothing is published.
+// Replicas apply their own environment overrides when they load the rules.
+func (h *RateLimiterHandler) PublishRulesHandler(c *gin.Context) {
+	if h.publisher == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "rules are not stored centrally"})
+		return
+	}
+	data, err := c.GetRawData()
+	if err != nil || len(data) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "request body must be a rules file"})
+		return
+	}
+	rules, err := config.ParseRuleSet(data)
+	if err == nil {
+		err = config.ValidateRuleSet(rules)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rules", "details": err.Error()})
+		return
+	}
+	if err := h.publisher.Publish(data); err != nil {
+		log.Printf("❌ Publishing rules failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Rate limiter unavailable"})
+		return
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	log.Printf("📝 AUDIT publish rules operator=%q sha256=%s bytes=%d", c.GetString(operatorContextKey), hash, len(data))
+	c.JSON(http.StatusOK, gin.H{"published": true, "rules_hash": hash})
+}
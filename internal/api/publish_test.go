@@ -0,0 +1,97 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+type fakePublisher struct {
+	published [][]byte
+	err       error
+}
+
+func (p *fakePublisher) Publish(data []byte) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.published = append(p.published, data)
+	return nil
+}
+
+func servePublish(handler *RateLimiterHandler, body string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Group("/admin", AdminAuth(map[string]string{"s3cret": "alice"})).POST("/rules", handler.PublishRulesHandler)
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/admin/rules", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer s3cret")
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestPublishRulesHandler(t *testing.T) {
+	publisher := &fakePublisher{}
+	handler := NewRateLimiterHandlerWithOptions(new(MockRedisStorage), adminRules(), HandlerOptions{RulesPublisher: publisher})
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantDetail string // In the details of a rejection
+	}{
+		{"YAML", "ips:\n  capacity: 500\n  refill_rate: 50\n", http.StatusOK, ""},
+		{"JSON", `{"ips": {"capacity": 800, "refill_rate": 80}}`, http.StatusOK, ""},
+		{"invalid rules", "ips:\n  capacity: 0\n  refill_rate: 50\n", http.StatusBadRequest, "ip config: capacity must be positive"},
+		{"unparseable", "ips: [", http.StatusBadRequest, "parsing as YAML"},
+		{"includes", "include: more.yaml\n", http.StatusBadRequest, "include"},
+		{"empty", "", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(publisher.published)
+			w := servePublish(handler, tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			var resp struct {
+				Hash    string `json:"rules_hash"`
+				Details string `json:"details"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if tt.wantStatus != http.StatusOK {
+				if len(publisher.published) != before {
+					t.Error("expected rejected rules not to be published")
+				}
+				if !strings.Contains(resp.Details, tt.wantDetail) {
+					t.Errorf("expected details containing %q, got %q", tt.wantDetail, resp.Details)
+				}
+				return
+			}
+			if len(publisher.published) != before+1 || string(publisher.published[before]) != tt.body {
+				t.Fatalf("expected the body published as sent, got %q", publisher.published)
+			}
+			if len(resp.Hash) != 64 {
+				t.Errorf("expected a sha256 rules_hash, got %q", resp.Hash)
+			}
+		})
+	}
+
+	t.Run("storage failure", func(t *testing.T) {
+		handler := NewRateLimiterHandlerWithOptions(new(MockRedisStorage), adminRules(), HandlerOptions{RulesPublisher: &fakePublisher{err: errors.New("connection refused")}})
+		if w := servePublish(handler, "ips:\n  capacity: 500\n  refill_rate: 50\n"); w.Code != http.StatusInternalServerError {
+			t.Errorf("expected 500, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("not configured", func(t *testing.T) {
+		if w := servePublish(NewRateLimiterHandler(new(MockRedisStorage), adminRules()), "ips:\n  capacity: 500\n  refill_rate: 50\n"); w.Code != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", w.Code)
+		}
+	})
+}
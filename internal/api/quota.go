@@ -0,0 +1,96 @@
+package api
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+)
+
+// quotaLocations caches time zones by name, since loading one reads the
+// zone database.
+var quotaLocations sync.Map
+
+// quotaCounter describes q's counter at key for a check at now. The window
+// boundaries themselves are computed by storage, from the zone's offset.
+func quotaCounter(key string, q *config.QuotaConfig, now time.Time) (storage.Quota, error) {
+	loc, ok := quotaLocations.Load(q.Timezone)
+	if !ok {
+		l, err := q.Location()
+		if err != nil {
+			return storage.Quota{}, err
+		}
+		loc, _ = quotaLocations.LoadOrStore(q.Timezone, l)
+	}
+	_, offset := now.In(loc.(*time.Location)).Zone()
+	return storage.Quota{
+		Key:       key,
+		Amount:    q.Amount,
+		Window:    storage.QuotaWindow(q.Window),
+		UTCOffset: time.Duration(offset) * time.Second,
+	}, nil
+}
+
+// quotaCounters returns the counters a check at now charges: the tier's
+// quota on the per-key bucket at tierKey, when tier is set, and the
+// endpoint's quota and window cap on its global bucket at globalKey. The
+// window cap, if any, comes last.
+func quotaCounters(tier *config.TierConfig, tierKey string, ep config.EndpointConfig, globalKey string, now time.Time) ([]storage.Quota, error) {
+	var quotas []storage.Quota
+	if tier != nil && tier.Quota != nil {
+		quota, err := quotaCounter(tierKey, tier.Quota, now)
+		if err != nil {
+			return nil, err
+		}
+		quotas = append(quotas, quota)
+	}
+	if ep.Quota != nil {
+		quota, err := quotaCounter(globalKey, ep.Quota, now)
+		if err != nil {
+			return nil, err
+		}
+		quotas = append(quotas, quota)
+	}
+	if ep.WindowCap != nil {
+		quotas = append(quotas, storage.Quota{
+			Key:    globalKey + ":cap",
+			Amount: ep.WindowCap.Amount,
+			Window: storage.QuotaFixed,
+			Period: ep.WindowCap.Window,
+		})
+	}
+	return quotas, nil
+}
+
+// applyQuotas reports the quota closest to running out on resp, and ep's
+// window cap, which quotaCounters put last, separately.
+func applyQuotas(resp *CheckResponse, ep config.EndpointConfig, quotas []storage.QuotaResult) {
+	if ep.WindowCap != nil && len(quotas) > 0 {
+		last := quotas[len(quotas)-1]
+		resp.WindowCapRemaining, resp.WindowCapResetsAt = &last.Remaining, &last.ResetsAt
+		quotas = quotas[:len(quotas)-1]
+	}
+	for i, quota := range quotas {
+		if i == 0 || quota.Remaining < *resp.QuotaRemaining {
+			remaining, resetsAt := quota.Remaining, quota.ResetsAt
+			resp.QuotaRemaining, resp.QuotaResetsAt = &remaining, &resetsAt
+		}
+	}
+}
+
+// quotaExhausted reports whether a quota or window cap was too low to pay
+// cost, so it is what denied the check.
+func quotaExhausted(quotas []storage.QuotaResult, cost int64) bool {
+	for _, quota := range quotas {
+		if quota.Remaining < cost {
+			return true
+		}
+	}
+	return false
+}
+
+// errQuotaReservation rejects reservations on endpoints with quotas or a
+// window cap, whose script does not hold tokens.
+var errQuotaReservation = &RequestError{Status: http.StatusBadRequest, Message: "reservations are not supported on endpoints with quotas"}
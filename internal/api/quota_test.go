@@ -0,0 +1,151 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCheck_Quotas(t *testing.T) {
+	rules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{
+			"free": {Capacity: 100, RefillRate: 10, Quota: &config.QuotaConfig{Amount: 2, Window: config.QuotaDay}},
+		},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/report": {Rule: "tiers+endpoints", Cost: 1, GlobalCapacity: 10000, GlobalRefillRate: 1000},
+			"/api/export": {Rule: "endpoint", Cost: 5, GlobalCapacity: 100, GlobalRefillRate: 10, Quota: &config.QuotaConfig{Amount: 10, Window: config.QuotaMonth, Timezone: "Asia/Tokyo"}},
+		},
+	}
+	handler := NewRateLimiterHandler(storage.NewMemoryStorage(), rules)
+
+	t.Run("tier quota caps each key", func(t *testing.T) {
+		req := CheckRequest{Key: "user123", Endpoint: "/api/report", UserTier: "free"}
+		for i := int64(1); i <= 2; i++ {
+			resp, err := handler.Check(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !resp.Allowed || resp.QuotaRemaining == nil || *resp.QuotaRemaining != 2-i {
+				t.Fatalf("request %d: expected allowed with %d left in the quota, got %+v", i, 2-i, resp)
+			}
+		}
+		resp, _ := handler.Check(req)
+		midnight := time.Now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		if resp.Allowed || resp.UserRemaining != 98 || resp.QuotaResetsAt == nil || !resp.QuotaResetsAt.Equal(midnight) {
+			t.Fatalf("expected a denial until midnight UTC, got %+v", resp)
+		}
+		if resp.RetryAfterMs <= 0 {
+			t.Errorf("expected a retry hint, got %d", resp.RetryAfterMs)
+		}
+		if resp, _ := handler.Check(CheckRequest{Key: "user456", Endpoint: "/api/report", UserTier: "free"}); !resp.Allowed {
+			t.Errorf("expected another key to have its own quota, got %+v", resp)
+		}
+	})
+
+	t.Run("endpoint quota resets in its time zone", func(t *testing.T) {
+		resp, err := handler.Check(CheckRequest{Key: "user123", Endpoint: "/api/export"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		tokyo, _ := time.LoadLocation("Asia/Tokyo")
+		now := time.Now().In(tokyo)
+		firstOfNextMonth := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, tokyo)
+		if !resp.Allowed || *resp.QuotaRemaining != 5 || !resp.QuotaResetsAt.Equal(firstOfNextMonth) {
+			t.Fatalf("expected 5 left until %v, got %+v", firstOfNextMonth, resp)
+		}
+	})
+
+	t.Run("reservations are rejected", func(t *testing.T) {
+		_, err := handler.check(CheckRequest{Key: "user123", Endpoint: "/api/report", UserTier: "free"}, &reservation{id: "r1", hold: time.Minute})
+		reqErr, ok := err.(*RequestError)
+		if !ok || reqErr.Status != http.StatusBadRequest {
+			t.Fatalf("expected a 400 request error, got %v", err)
+		}
+	})
+}
+
+func TestCheck_QuotaOffsetFollowsClock(t *testing.T) {
+	rules := &config.RuleSet{
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/export": {Rule: "endpoint", Cost: 1, GlobalCapacity: 100, GlobalRefillRate: 10, Quota: &config.QuotaConfig{Amount: 10, Window: config.QuotaMonth, Timezone: "America/New_York"}},
+		},
+	}
+	// One of these is in the other half of the year from the wall clock, so
+	// the zone's offset has to come from the handler's clock
+	tests := []struct {
+		now    time.Time
+		offset time.Duration
+	}{
+		{time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC), -5 * time.Hour},
+		{time.Date(2024, 7, 15, 12, 0, 0, 0, time.UTC), -4 * time.Hour},
+	}
+	for _, tt := range tests {
+		mockStorage := new(MockRedisStorage)
+		mockStorage.On("AtomicQuotaBucket", "endpoint:/api/export", "", int64(0), float64(0), int64(100), float64(10), int64(0), int64(1),
+			mock.MatchedBy(func(quotas []storage.Quota) bool { return len(quotas) == 1 && quotas[0].UTCOffset == tt.offset }), mock.Anything,
+		).Return(storage.BucketResult{Allowed: true, Remaining: 99}, nil)
+		handler := NewRateLimiterHandlerWithOptions(mockStorage, rules, HandlerOptions{ClockFunc: func() time.Time { return tt.now }})
+
+		if _, err := handler.Check(CheckRequest{Key: "user123", Endpoint: "/api/export"}); err != nil {
+			t.Fatalf("at %v: unexpected error: %v", tt.now, err)
+		}
+		mockStorage.AssertExpectations(t)
+	}
+}
+
+func TestCheck_WindowCap(t *testing.T) {
+	hourly := &config.WindowCapConfig{Amount: 3, Window: time.Hour}
+	rules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{
+			"free": {Capacity: 100, RefillRate: 10, Quota: &config.QuotaConfig{Amount: 1000, Window: config.QuotaDay}},
+		},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/search": {Rule: "endpoint", Cost: 1, GlobalCapacity: 100, GlobalRefillRate: 10, WindowCap: hourly},
+			"/api/report": {Rule: "tiers+endpoints", Cost: 1, GlobalCapacity: 10000, GlobalRefillRate: 1000, WindowCap: hourly},
+		},
+	}
+	handler := NewRateLimiterHandler(storage.NewMemoryStorage(), rules)
+	nextHour := time.Now().Truncate(time.Hour).Add(time.Hour)
+
+	t.Run("cap denies while the bucket still has a burst", func(t *testing.T) {
+		req := CheckRequest{Key: "user123", Endpoint: "/api/search"}
+		for i := int64(1); i <= 3; i++ {
+			resp, err := handler.Check(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !resp.Allowed || resp.GlobalRemaining != 100-i || resp.WindowCapRemaining == nil || *resp.WindowCapRemaining != 3-i {
+				t.Fatalf("request %d: expected allowed with %d tokens and %d left in the cap, got %+v", i, 100-i, 3-i, resp)
+			}
+		}
+		resp, _ := handler.Check(req)
+		if resp.Allowed || resp.GlobalRemaining != 97 || *resp.WindowCapRemaining != 0 || !resp.WindowCapResetsAt.Equal(nextHour) {
+			t.Fatalf("expected the cap to deny until %v without charging the bucket, got %+v", nextHour, resp)
+		}
+		if resp.RetryAfterMs <= 0 {
+			t.Errorf("expected a retry hint, got %d", resp.RetryAfterMs)
+		}
+		if resp.QuotaRemaining != nil {
+			t.Errorf("expected the cap reported apart from quotas, got quota_remaining %d", *resp.QuotaRemaining)
+		}
+	})
+
+	t.Run("cap is shared by every key, beside the tier quota", func(t *testing.T) {
+		for i, key := range []string{"user1", "user2", "user3"} {
+			resp, err := handler.Check(CheckRequest{Key: key, Endpoint: "/api/report", UserTier: "free"})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !resp.Allowed || *resp.WindowCapRemaining != int64(2-i) || *resp.QuotaRemaining != 999 {
+				t.Fatalf("request %d: expected allowed with the cap and quota reported apart, got %+v", i+1, resp)
+			}
+		}
+		if resp, _ := handler.Check(CheckRequest{Key: "user4", Endpoint: "/api/report", UserTier: "free"}); resp.Allowed || resp.UserRemaining != 100 {
+			t.Fatalf("expected the cap to deny a fresh key, got %+v", resp)
+		}
+	})
+}
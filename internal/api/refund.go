@@ -0,0 +1,134 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/gin-gonic/gin"
+)
+
+type RefundResponse struct {
+	// Refunded is the cost returned to each bucket the check charged, less
+	// whatever would have taken a bucket past its capacity
+	Refunded int64 `json:"refunded"`
+	Buckets  int   `json:"buckets"`
+}
+
+// RefundHandler returns the cost of a check whose work then failed, so the
+// client isn't limited for it. It takes the same body as /check and puts
+// the cost back in every bucket that check charges, capped at each one's
+// capacity. Resource costs and quotas stay spent. Like the key and tier of
+// a check, the refund is taken on trust; /reserve and /release return
+// tokens only for checks that were actually made.
+func (h *RateLimiterHandler) RefundHandler(c *gin.Context) {
+	var req CheckRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeBindError(c, err)
+		return
+	}
+	req, err := withRequestHeaders(c, req)
+	if err != nil {
+		writeCheckError(c, err)
+		return
+	}
+	keys, cost, ttl, err := h.refundBuckets(req)
+	if err != nil {
+		writeCheckError(c, err)
+		return
+	}
+	for _, key := range keys {
+		if err := h.storage.RefundTokens(key, cost, ttl); err != nil {
+			log.Printf("❌ [%s] Refund failed - key: %s, error: %v", req.RequestID, key, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Rate limiter unavailable"})
+			return
+		}
+	}
+	log.Printf("↩️ [%s] Refunded key=%s endpoint=%s cost=%d buckets=%d", req.RequestID, req.Key, req.Endpoint, cost, len(keys))
+	c.JSON(http.StatusOK, RefundResponse{Refunded: cost, Buckets: len(keys)})
+}
+
+// refundBuckets returns the keys of the buckets a check of req charges, the
+// cost it charges them and their expiry, found as check finds them.
+func (h *RateLimiterHandler) refundBuckets(req CheckRequest) ([]string, int64, time.Duration, error) {
+	rules := h.Rules()
+	matched, ok := rules.FindEndpoint(req.Endpoint)
+	if !ok {
+		return nil, 0, 0, &RequestError{Status: http.StatusBadRequest, Message: "unknown endpoint"}
+	}
+	now, loc := h.clock(), rules.ScheduleLocation()
+	ep, _ := matched.Config.Scheduled(now, loc)
+	if !ep.Limited() {
+		return nil, 0, 0, nil // Nothing was charged
+	}
+	endpoint, bucketPath := matched.Path, matched.BucketPath()
+	namespace := req.Namespace
+	if namespace == "" {
+		namespace = rules.Namespace
+	}
+	if !config.ValidNamespace(namespace) {
+		return nil, 0, 0, &RequestError{Status: http.StatusBadRequest, Message: "invalid namespace"}
+	}
+	tierName, err := h.requestTier(rules, ep, req)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	cost, err := h.requestCost(ep, req)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	globalCapacity, globalRate, err := h.globalLimits(ep)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("endpoint %s: %w", endpoint, err)
+	}
+	globalKey := namespacedKey(namespace, h.keys.TransformGlobalKey(bucketPath))
+	ipKey := namespacedKey(namespace, fmt.Sprintf("ip:%s:%s", req.IPAddress, endpoint))
+	if (ep.Rule == "IP+endpoints" || ep.Rule == "user+ip") && req.IPAddress == "" {
+		return nil, 0, 0, &RequestError{Status: http.StatusBadRequest, Message: "ip_address required for this endpoint"}
+	}
+
+	switch ep.Rule {
+	case "tiers+endpoints", "user+ip":
+		tier, ok := rules.Tiers[tierName]
+		if !ok {
+			return nil, 0, 0, invalidTierError(rules, tierName)
+		}
+		tier, _ = tier.Scheduled(now, loc)
+		bucketKey, err := keyWithFields(req.Key, ep.KeyFields, req.Metadata)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		userKey := namespacedKey(namespace, h.keys.TransformUserKey(bucketKey, endpoint, tierName))
+		userTTL := bucketTTL(tier.EffectiveCapacity(), tier.RefillRate)
+		if ep.Rule == "user+ip" {
+			ipCapacity, ipRate := rules.IPs.Capacity, rules.IPs.RefillRate
+			if override, ok := rules.FindIPOverride(req.IPAddress); ok {
+				if override.Unlimited {
+					return nil, cost, 0, nil
+				}
+				ipCapacity, ipRate = override.Capacity, override.RefillRate
+			}
+			return []string{userKey, ipKey}, cost, max(userTTL, bucketTTL(ipCapacity, ipRate)), nil
+		}
+		if capacity, rate, ok := ep.TierShare(tierName, globalCapacity, globalRate); ok {
+			globalKey = fmt.Sprintf("%s:tier:%s", globalKey, tierName)
+			globalCapacity, globalRate = capacity, rate
+		}
+		return []string{userKey, globalKey}, cost, max(userTTL, bucketTTL(globalCapacity, globalRate)), nil
+	case "IP+endpoints":
+		ipCapacity, ipRate := rules.IPs.Capacity, rules.IPs.RefillRate
+		if override, ok := rules.FindIPOverride(req.IPAddress); ok {
+			if override.Unlimited {
+				// Checks from it charge nothing
+				return nil, cost, 0, nil
+			}
+			ipCapacity, ipRate = override.Capacity, override.RefillRate
+		}
+		return []string{ipKey, globalKey}, cost, max(bucketTTL(ipCapacity, ipRate), bucketTTL(globalCapacity, globalRate)), nil
+	default:
+		endpointKey := namespacedKey(namespace, fmt.Sprintf("endpoint:%s", bucketPath))
+		return []string{endpointKey}, cost, bucketTTL(globalCapacity, globalRate), nil
+	}
+}
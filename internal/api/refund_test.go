@@ -0,0 +1,73 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+func TestRefundHandler(t *testing.T) {
+	rules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{"free": {Capacity: 100, RefillRate: 0.001}},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/upload": {Rule: "tiers+endpoints", Cost: 30, GlobalCapacity: 1000, GlobalRefillRate: 0.001},
+			"/api/list":   {Rule: "endpoint", Cost: 1, GlobalCapacity: 10, GlobalRefillRate: 0.001},
+		},
+	}
+	handler := NewRateLimiterHandler(storage.NewMemoryStorage(), rules)
+	router := gin.New()
+	router.POST("/refund", handler.RefundHandler)
+	refund := func(body string) (int, RefundResponse) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/refund", bytes.NewBufferString(body)))
+		var resp RefundResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+	check := func(endpoint string, cost int64) CheckResponse {
+		t.Helper()
+		resp, err := handler.Check(CheckRequest{Key: "alice", Endpoint: endpoint, UserTier: "free", Cost: cost})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return resp
+	}
+
+	check("/api/upload", 0)
+	check("/api/upload", 0)
+	code, resp := refund(`{"key": "alice", "endpoint": "/api/upload", "user_tier": "free"}`)
+	if code != http.StatusOK || resp.Refunded != 30 || resp.Buckets != 2 {
+		t.Fatalf("expected 30 refunded to two buckets, got %d %+v", code, resp)
+	}
+	if got := check("/api/upload", 1); got.UserRemaining != 69 || got.GlobalRemaining != 969 {
+		t.Errorf("expected one check's cost back in both buckets, got %+v", got)
+	}
+
+	// A refund can't take a bucket past its capacity
+	refund(`{"key": "alice", "endpoint": "/api/upload", "user_tier": "free", "cost": 500}`)
+	if got := check("/api/upload", 1); got.UserRemaining != 99 || got.GlobalRemaining != 999 {
+		t.Errorf("expected the refund clamped at capacity, got %+v", got)
+	}
+
+	check("/api/list", 4)
+	if code, resp := refund(`{"key": "alice", "endpoint": "/api/list", "cost": 4}`); code != http.StatusOK || resp.Buckets != 1 {
+		t.Fatalf("expected the endpoint bucket refunded, got %d %+v", code, resp)
+	}
+	if got := check("/api/list", 1); got.GlobalRemaining != 9 {
+		t.Errorf("expected the endpoint bucket back to full before this check, got %+v", got)
+	}
+
+	if code, _ := refund(`{"key": "alice", "endpoint": "/api/nope"}`); code != http.StatusBadRequest {
+		t.Errorf("expected an unknown endpoint rejected, got %d", code)
+	}
+	if code, _ := refund(`{"key": "alice", "endpoint": "/api/upload", "user_tier": "gold"}`); code != http.StatusBadRequest {
+		t.Errorf("expected an unknown tier rejected, got %d", code)
+	}
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+)
+
+func TestCheck_RegexEndpointGlobalKey(t *testing.T) {
+	rules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{"free": {Capacity: 100, RefillRate: 0.001}},
+		Endpoints: map[string]config.EndpointConfig{
+			`~/api/v\d+/orgs/(?P<org>[^/]+)/items`: {
+				Rule: "tiers+endpoints", Cost: 1, GlobalCapacity: 2, GlobalRefillRate: 0.001,
+				GlobalKey: "/api/orgs/{org}/items",
+			},
+		},
+	}
+	store := storage.NewMemoryStorage()
+	handler := NewRateLimiterHandler(store, rules)
+
+	check := func(key, path string) CheckResponse {
+		t.Helper()
+		resp, err := handler.Check(CheckRequest{Key: key, Endpoint: path, UserTier: "free"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return resp
+	}
+
+	// Each org drains a global bucket of its own, across API versions
+	check("alice", "/api/v1/orgs/acme/items")
+	check("bob", "/api/v2/orgs/acme/items")
+	if resp := check("carol", "/api/v1/orgs/acme/items"); resp.Allowed {
+		t.Fatalf("expected acme's global bucket to be empty, got %+v", resp)
+	}
+	if resp := check("carol", "/api/v1/orgs/globex/items"); !resp.Allowed || resp.GlobalRemaining != 1 {
+		t.Fatalf("expected globex to have its own global bucket, got %+v", resp)
+	}
+
+	if _, err := handler.Check(CheckRequest{Key: "alice", Endpoint: "/api/v1/orgs/acme/other", UserTier: "free"}); err == nil {
+		t.Fatal("expected a path the pattern doesn't match to be an unknown endpoint")
+	}
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultReservationHold = 30 * time.Second // How long reserved tokens are held when hold_ms is unset
+	maxReservationHold     = 10 * time.Minute // Upper bound on a caller-supplied hold_ms
+)
+
+type ReserveRequest struct {
+	CheckRequest
+	HoldMs int64 `json:"hold_ms,omitempty"` // How long to hold the tokens before they are returned automatically
+}
+
+type ReserveResponse struct {
+	CheckResponse
+	// ReservationID is set when tokens were reserved; pass it to /commit or /release
+	ReservationID string `json:"reservationId,omitempty"`
+}
+
+type SettleRequest struct {
+	ReservationID string `json:"reservation_id" binding:"required"`
+}
+
+type SettleResponse struct {
+	ReservationID string `json:"reservationId"`
+	// Settled is false when the reservation was already committed, released
+	// or expired; repeating a commit or release is harmless
+	Settled bool `json:"settled"`
+}
+
+// ReserveHandler deducts a request's cost like CheckHandler, but holds the
+// tokens under a reservation id. The caller commits the reservation once the
+// work succeeds or releases it to get the tokens back; unsettled reservations
+// are released automatically after hold_ms.
+func (h *RateLimiterHandler) ReserveHandler(c *gin.Context) {
+	var req ReserveRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeBindError(c, err)
+		return
+	}
+	if req.HoldMs < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "hold_ms must not be negative"})
+		return
+	}
+	hold := defaultReservationHold
+	if req.HoldMs > 0 {
+		hold = min(time.Duration(req.HoldMs)*time.Millisecond, maxReservationHold)
+	}
+
+	id, err := newReservationID()
+	if err != nil {
+		log.Printf("❌ [%s] Reservation id generation failed: %v", contextRequestID(c), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Rate limiter unavailable"})
+		return
+	}
+
+	checkReq, err := withRequestHeaders(c, req.CheckRequest)
+	if err != nil {
+		writeCheckError(c, err)
+		return
+	}
+	resp, err := h.check(checkReq, &reservation{id: id, hold: hold})
+	if err != nil {
+		writeCheckError(c, err)
+		return
+	}
+	if !resp.Allowed {
+		c.JSON(http.StatusTooManyRequests, ReserveResponse{CheckResponse: resp})
+		return
+	}
+	// A dry-run endpoint lets denied requests through without reserving
+	// anything, as does one with limiting disabled
+	if resp.WouldDeny || resp.LimitingDisabled {
+		c.JSON(http.StatusOK, ReserveResponse{CheckResponse: resp})
+		return
+	}
+	log.Printf("🔒 [%s] Reserved id=%s key=%s endpoint=%s hold=%s", checkReq.RequestID, id, req.Key, req.Endpoint, hold)
+	c.JSON(http.StatusOK, ReserveResponse{CheckResponse: resp, ReservationID: id})
+}
+
+// CommitHandler finalizes a reservation, keeping its tokens consumed.
+func (h *RateLimiterHandler) CommitHandler(c *gin.Context) {
+	h.settle(c, "commit", h.storage.CommitReservation)
+}
+
+// ReleaseHandler cancels a reservation, returning its tokens to the buckets.
+func (h *RateLimiterHandler) ReleaseHandler(c *gin.Context) {
+	h.settle(c, "release", h.storage.ReleaseReservation)
+}
+
+func (h *RateLimiterHandler) settle(c *gin.Context, action string, settle func(id string) (bool, error)) {
+	var req SettleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeBindError(c, err)
+		return
+	}
+	settled, err := settle(req.ReservationID)
+	if err != nil {
+		log.Printf("❌ [%s] Reservation %s failed - id: %s, error: %v", contextRequestID(c), action, req.ReservationID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Rate limiter unavailable"})
+		return
+	}
+	c.JSON(http.StatusOK, SettleResponse{ReservationID: req.ReservationID, Settled: settled})
+}
+
+// newReservationID returns a random 128-bit id, hex encoded.
+func newReservationID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,176 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/mock"
+)
+
+func serveReserve(handler *RateLimiterHandler, path string, body interface{}) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/reserve", handler.ReserveHandler)
+	router.POST("/commit", handler.CommitHandler)
+	router.POST("/release", handler.ReleaseHandler)
+
+	payload, _ := json.Marshal(body)
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewBuffer(payload))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestReserveHandler_DualBucket(t *testing.T) {
+	mockStorage := new(MockRedisStorage)
+	mockStorage.On("ReserveDualBucket",
+		mock.AnythingOfType("string"), 5*time.Second,
+		"user:user123:/api/upload:free", "global:/api/upload",
+		int64(10000), float64(2000), int64(100), float64(10), int64(0), int64(10), time.Hour,
+	).Return(storage.BucketResult{Allowed: true, Remaining: 90, GlobalRemaining: 9990}, nil)
+
+	w := serveReserve(NewRateLimiterHandler(mockStorage, adminRules()), "/reserve", ReserveRequest{
+		CheckRequest: CheckRequest{Key: "user123", Endpoint: "/api/upload", UserTier: "free"},
+		HoldMs:       5000,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp ReserveResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.ReservationID) != 32 {
+		t.Errorf("expected a 32-char reservation id, got %q", resp.ReservationID)
+	}
+	if resp.UserRemaining != 90 || resp.GlobalRemaining != 9990 {
+		t.Errorf("unexpected remaining: %+v", resp)
+	}
+	// The id handed to storage must be the one returned to the caller
+	if got := mockStorage.Calls[0].Arguments.String(0); got != resp.ReservationID {
+		t.Errorf("storage reserved %q but response returned %q", got, resp.ReservationID)
+	}
+}
+
+func TestReserveHandler_DefaultAndMaxHold(t *testing.T) {
+	tests := []struct {
+		name     string
+		holdMs   int64
+		wantHold time.Duration
+	}{
+		{"default", 0, defaultReservationHold},
+		{"capped", int64(time.Hour / time.Millisecond), maxReservationHold},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage := new(MockRedisStorage)
+			mockStorage.On("ReserveTokenBucket", mock.Anything, tt.wantHold, "endpoint:/api/list",
+				int64(10000), float64(1000), int64(10), time.Hour,
+			).Return(storage.BucketResult{Allowed: true, Remaining: 9990}, nil)
+
+			w := serveReserve(NewRateLimiterHandler(mockStorage, adminRules()), "/reserve", ReserveRequest{
+				CheckRequest: CheckRequest{Key: "user123", Endpoint: "/api/list"},
+				HoldMs:       tt.holdMs,
+			})
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+			mockStorage.AssertExpectations(t)
+		})
+	}
+}
+
+func TestReserveHandler_DeniedHasNoReservation(t *testing.T) {
+	mockStorage := new(MockRedisStorage)
+	mockStorage.On("ReserveTokenBucket", mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+	).Return(storage.BucketResult{Allowed: false, Remaining: 5, RetryAfter: 500 * time.Millisecond}, nil)
+
+	w := serveReserve(NewRateLimiterHandler(mockStorage, adminRules()), "/reserve", ReserveRequest{
+		CheckRequest: CheckRequest{Key: "user123", Endpoint: "/api/list"},
+	})
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp ReserveResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.ReservationID != "" {
+		t.Errorf("expected no reservation id on denial, got %q", resp.ReservationID)
+	}
+	if resp.RetryAfterMs != 500 {
+		t.Errorf("expected retryAfterMs 500, got %d", resp.RetryAfterMs)
+	}
+}
+
+func TestReserveHandler_NegativeHold(t *testing.T) {
+	mockStorage := new(MockRedisStorage)
+
+	w := serveReserve(NewRateLimiterHandler(mockStorage, adminRules()), "/reserve", ReserveRequest{
+		CheckRequest: CheckRequest{Key: "user123", Endpoint: "/api/list"},
+		HoldMs:       -1,
+	})
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", w.Code)
+	}
+	mockStorage.AssertNotCalled(t, "ReserveTokenBucket")
+}
+
+func TestSettleHandlers(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		method      string
+		settled     bool
+		err         error
+		wantStatus  int
+		wantSettled bool
+	}{
+		{"commit", "/commit", "CommitReservation", true, nil, http.StatusOK, true},
+		{"repeated commit", "/commit", "CommitReservation", false, nil, http.StatusOK, false},
+		{"release", "/release", "ReleaseReservation", true, nil, http.StatusOK, true},
+		{"repeated release", "/release", "ReleaseReservation", false, nil, http.StatusOK, false},
+		{"storage error", "/release", "ReleaseReservation", false, errors.New("connection refused"), http.StatusInternalServerError, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage := new(MockRedisStorage)
+			mockStorage.On(tt.method, "abc123").Return(tt.settled, tt.err)
+
+			w := serveReserve(NewRateLimiterHandler(mockStorage, adminRules()), tt.path, SettleRequest{ReservationID: "abc123"})
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var resp SettleResponse
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if resp.Settled != tt.wantSettled || resp.ReservationID != "abc123" {
+				t.Errorf("unexpected response: %+v", resp)
+			}
+		})
+	}
+}
+
+func TestSettleHandlers_MissingID(t *testing.T) {
+	mockStorage := new(MockRedisStorage)
+
+	w := serveReserve(NewRateLimiterHandler(mockStorage, adminRules()), "/commit", gin.H{})
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", w.Code)
+	}
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+)
+
+func TestCheck_ResetAt(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	rules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{"free": {Capacity: 100, RefillRate: 10}},
+		IPs:   config.IPConfig{Capacity: 100, RefillRate: 3},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/upload": {Rule: "tiers+endpoints", Cost: 30, GlobalCapacity: 10000, GlobalRefillRate: 1000},
+			"/api/export": {Rule: "endpoint", Cost: 10, GlobalCapacity: 50, GlobalRefillRate: 5},
+			"/api/login":  {Rule: "IP+endpoints", Cost: 1, GlobalCapacity: 10000, GlobalRefillRate: 1000},
+		},
+	}
+	handler := NewRateLimiterHandlerWithOptions(storage.NewMemoryStorage(), rules, HandlerOptions{
+		ClockFunc: func() time.Time { return now },
+	})
+
+	tests := []struct {
+		name string
+		req  CheckRequest
+		want time.Duration
+	}{
+		{"user bucket 70 of 100 at 10/s", CheckRequest{Key: "alice", Endpoint: "/api/upload", UserTier: "free"}, 3 * time.Second},
+		{"then 40 of 100", CheckRequest{Key: "alice", Endpoint: "/api/upload", UserTier: "free"}, 6 * time.Second},
+		{"endpoint bucket 40 of 50 at 5/s", CheckRequest{Key: "anyone", Endpoint: "/api/export"}, 2 * time.Second},
+		{"IP bucket 99 of 100 rounds up", CheckRequest{Key: "bob", Endpoint: "/api/login", IPAddress: "10.0.0.1"}, 334 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := handler.Check(tt.req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if want := now.Add(tt.want).UnixMilli(); resp.ResetAtUnixMs != want {
+				t.Errorf("expected reset at %d (+%v), got %d (%+v)", want, tt.want, resp.ResetAtUnixMs, resp)
+			}
+		})
+	}
+}
+
+func TestResetAt(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tests := []struct {
+		name      string
+		remaining int64
+		want      time.Duration
+	}{
+		{"full", 100, 0},
+		{"overfilled by a top-up", 150, 0},
+		{"empty", 0, 10 * time.Second},
+		{"in debt", -20, 12 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resetAt(now, 100, 10, tt.remaining); !got.Equal(now.Add(tt.want)) {
+				t.Errorf("expected %v from now, got %v", tt.want, got.Sub(now))
+			}
+		})
+	}
+}
+
+func TestCheck_RefillFollowsClock(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	rules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{"free": {Capacity: 100, RefillRate: 10}},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/upload": {Rule: "tiers+endpoints", Cost: 50, GlobalCapacity: 10000, GlobalRefillRate: 1000},
+		},
+	}
+	handler := NewRateLimiterHandlerWithOptions(storage.NewMemoryStorageWithOptions(storage.MemoryOptions{Clock: clock}), rules, HandlerOptions{
+		ClockFunc: clock,
+	})
+	check := func() CheckResponse {
+		t.Helper()
+		resp, err := handler.Check(CheckRequest{Key: "alice", Endpoint: "/api/upload", UserTier: "free"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return resp
+	}
+
+	check()
+	drained := check()
+	if drained.UserRemaining != 0 || check().Allowed {
+		t.Fatalf("expected the bucket drained, got %+v", drained)
+	}
+
+	// By the reported reset time the bucket is full again
+	now = time.UnixMilli(drained.ResetAtUnixMs).UTC()
+	if resp := check(); !resp.Allowed || resp.UserRemaining != 50 {
+		t.Errorf("expected a full bucket less one cost at the reset time, got %+v", resp)
+	}
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+func TestCheck_Schedules(t *testing.T) {
+	rules := &config.RuleSet{
+		ScheduleTimezone: "America/New_York",
+		Tiers: map[string]config.TierConfig{"free": {Capacity: 100, RefillRate: 1, Schedules: []config.ScheduleConfig{
+			{Name: "overnight", Window: "20:00-08:00", Capacity: 1000, RefillRate: 10},
+		}}},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/search": {Rule: "tiers+endpoints", Cost: 10, GlobalCapacity: 10000, GlobalRefillRate: 100, Schedules: []config.ScheduleConfig{
+				{Name: "weekday-peak", Window: "09:00-17:00", Days: []string{"mon", "tue", "wed", "thu", "fri"}, Capacity: 2000, RefillRate: 20},
+			}},
+		},
+	}
+	if err := config.ValidateRuleSet(rules); err != nil {
+		t.Fatalf("invalid rules: %v", err)
+	}
+	// Wednesday 03:00 in New York
+	now := time.Date(2024, 5, 1, 7, 0, 0, 0, time.UTC)
+	handler := NewRateLimiterHandlerWithOptions(storage.NewMemoryStorage(), rules, HandlerOptions{
+		ClockFunc: func() time.Time { return now },
+	})
+	check := func() CheckResponse {
+		t.Helper()
+		resp, err := handler.Check(CheckRequest{Key: "alice", Endpoint: "/api/search", UserTier: "free"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return resp
+	}
+
+	resp := check()
+	if resp.Limit != 1000 || resp.SustainedRate != 10 || !reflect.DeepEqual(resp.Schedules, []string{"overnight"}) {
+		t.Fatalf("expected the overnight tier limits, got %+v", resp)
+	}
+	if resp.UserRemaining != 990 || resp.GlobalRemaining != 9990 {
+		t.Fatalf("expected 990 and 9990 left, got %+v", resp)
+	}
+
+	// 09:00 shrinks both buckets; their balances are clamped to the new
+	// capacities rather than reset, so the overnight burst doesn't carry over
+	now = time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC)
+	resp = check()
+	if resp.Limit != 100 || !reflect.DeepEqual(resp.Schedules, []string{"weekday-peak"}) {
+		t.Fatalf("expected the tier's own limits under the endpoint's peak schedule, got %+v", resp)
+	}
+	if !resp.Allowed || resp.UserRemaining != 90 || resp.GlobalRemaining != 1990 {
+		t.Errorf("expected the balances clamped to 100 and 2000 at the switch, got %+v", resp)
+	}
+
+	// Saturday has no peak schedule
+	now = time.Date(2024, 5, 4, 16, 0, 0, 0, time.UTC)
+	if resp = check(); resp.Schedules != nil {
+		t.Errorf("expected no schedule on Saturday afternoon, got %v", resp.Schedules)
+	}
+}
+
+func TestLimitsHandler_Schedules(t *testing.T) {
+	rules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{"free": {Capacity: 100, RefillRate: 10, BurstMultiplier: 2, Schedules: []config.ScheduleConfig{
+			{Name: "overnight", Window: "22:00-06:00", Capacity: 500},
+		}}},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/search": {Rule: "endpoint", Cost: 1, GlobalCapacity: 1000, GlobalRefillRate: 100, Schedules: []config.ScheduleConfig{
+				{Name: "overnight", Window: "22:00-06:00", RefillRate: 500},
+			}},
+		},
+	}
+	handler := NewRateLimiterHandlerWithOptions(storage.NewMemoryStorage(), rules, HandlerOptions{
+		ClockFunc: func() time.Time { return time.Date(2024, 5, 1, 23, 0, 0, 0, time.UTC) },
+	})
+	router := gin.New()
+	router.GET("/limits", handler.LimitsHandler)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/limits", nil))
+	var body LimitsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to parse response: %v", err)
+	}
+	if got := body.Tiers["free"]; got != (BucketLimits{Burst: 500, SustainedRate: 10}) {
+		t.Errorf("expected the overnight tier limits, got %+v", got)
+	}
+	if got := body.Endpoints["/api/search"].Global; got == nil || *got != (BucketLimits{Burst: 1000, SustainedRate: 500}) {
+		t.Errorf("expected the overnight endpoint limits, got %+v", got)
+	}
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestSelfProtectMiddleware(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	rules := &config.RuleSet{
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/search": {Rule: "endpoint", Cost: 1, GlobalCapacity: 1000000, GlobalRefillRate: 1000},
+		},
+		SelfProtect: config.SelfProtectConfig{Capacity: 2, RefillRate: 1, MaxEntries: 1},
+	}
+	mockStorage := new(MockRedisStorage)
+	mockStorage.On("AtomicTokenBucket", "endpoint:/api/search", int64(1000000), float64(1000), int64(1), time.Hour).
+		Return(storage.BucketResult{Allowed: true, Remaining: 999999}, nil)
+	handler := NewRateLimiterHandlerWithOptions(mockStorage, rules, HandlerOptions{ClockFunc: func() time.Time { return now }})
+	router := gin.New()
+	router.POST("/check", handler.SelfProtectMiddleware(), handler.CheckHandler)
+	check := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/check", strings.NewReader(`{"key":"user123","endpoint":"/api/search"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := check("10.0.0.1"); w.Code != http.StatusOK {
+			t.Fatalf("request %d: expected 200, got %d: %s", i+1, w.Code, w.Body.String())
+		}
+	}
+	w := check("10.0.0.1")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected 429 with Retry-After 1, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if !strings.Contains(w.Body.String(), "rate limit service overloaded") {
+		t.Errorf("expected the overloaded error, got %s", w.Body.String())
+	}
+	// The rules' own buckets had plenty left: only the allowed requests reached them
+	mockStorage.AssertNumberOfCalls(t, "AtomicTokenBucket", 2)
+
+	if w := check("10.0.0.2"); w.Code != http.StatusOK {
+		t.Errorf("expected another IP to have its own bucket, got %d", w.Code)
+	}
+	// max_entries 1 evicted 10.0.0.1's empty bucket for 10.0.0.2's
+	if w := check("10.0.0.1"); w.Code != http.StatusOK {
+		t.Errorf("expected an evicted IP to start over full, got %d", w.Code)
+	}
+
+	now = now.Add(time.Second)
+	if w := check("10.0.0.1"); w.Code != http.StatusOK {
+		t.Errorf("expected a token back after a second, got %d", w.Code)
+	}
+}
+
+func TestSelfProtectMiddleware_Off(t *testing.T) {
+	mockStorage := new(MockRedisStorage)
+	handler := NewRateLimiterHandler(mockStorage, &config.RuleSet{})
+	router := gin.New()
+	router.GET("/ping", handler.SelfProtectMiddleware(), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ping", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200 without self_protect, got %d", w.Code)
+		}
+	}
+	mockStorage.AssertNotCalled(t, "AtomicTokenBucket", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+)
+
+func TestCheck_GlobalTierShares(t *testing.T) {
+	rules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{
+			"free":    {Capacity: 1000, RefillRate: 0.001},
+			"premium": {Capacity: 1000, RefillRate: 0.001},
+		},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/upload": {
+				Rule: "tiers+endpoints", Cost: 10, GlobalCapacity: 100, GlobalRefillRate: 0.001,
+				GlobalTierShares: map[string]float64{"free": 0.3, "premium": 0.7},
+			},
+		},
+	}
+	handler := NewRateLimiterHandler(storage.NewMemoryStorage(), rules)
+
+	t.Run("a free flood stops at its share", func(t *testing.T) {
+		allowed := 0
+		for i := 0; i < 20; i++ {
+			resp, err := handler.Check(CheckRequest{Key: "flooder", Endpoint: "/api/upload", UserTier: "free"})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if resp.Allowed {
+				allowed++
+			}
+		}
+		if allowed != 3 {
+			t.Fatalf("expected the free tier to get 30 of 100 tokens (3 requests), got %d", allowed)
+		}
+	})
+
+	t.Run("premium keeps its reserved share", func(t *testing.T) {
+		for i := int64(1); i <= 7; i++ {
+			resp, _ := handler.Check(CheckRequest{Key: "customer", Endpoint: "/api/upload", UserTier: "premium"})
+			if !resp.Allowed || resp.GlobalRemaining != 70-10*i {
+				t.Fatalf("request %d: expected allowed with %d of premium's share left, got %+v", i, 70-10*i, resp)
+			}
+		}
+		if resp, _ := handler.Check(CheckRequest{Key: "customer", Endpoint: "/api/upload", UserTier: "premium"}); resp.Allowed {
+			t.Fatalf("expected premium to stop at its own share, got %+v", resp)
+		}
+	})
+}
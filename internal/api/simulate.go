@@ -0,0 +1,185 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// maxSimulateRequests bounds one simulation so it stays well within a
+// request's time budget.
+const maxSimulateRequests = 1000
+
+type SimulateRequest struct {
+	// Rules are the candidate rules, in the form GET /rules returns them
+	Rules    config.RuleSet `json:"rules"`
+	Requests []CheckRequest `json:"requests" binding:"required,dive"`
+}
+
+type SimulateResult struct {
+	Request CheckRequest `json:"request"`
+	// Allowed is whether the candidate rules would let the request through.
+	// A dry-run endpoint reports what it would have done if enforced
+	Allowed bool `json:"allowed"`
+	// RemainingTokens is the balance of the bucket the rule limits by: the
+	// per-key bucket, or the endpoint bucket for endpoint rules
+	RemainingTokens int64 `json:"remainingTokens"`
+	// RulePath is the endpoint rule the request matched
+	RulePath string `json:"rulePath,omitempty"`
+	// Error is why the request could not be evaluated, e.g. an unknown endpoint
+	Error string `json:"error,omitempty"`
+}
+
+// SimulateHandler replays requests against candidate rules so operators can
+// see what a new rules file would deny before rolling it out. Requests are
+// evaluated in order in process memory, never in the live storage, starting
+// from the current balances: a memory backend is copied, and with Redis each
+// token bucket is read the first time a request charges it. Stored tiers are
+// read from the live storage.
+func (h *RateLimiterHandler) SimulateHandler(c *gin.Context) {
+	var req SimulateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeBindError(c, err)
+		return
+	}
+	if len(req.Requests) > maxSimulateRequests {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "too many requests", "max": maxSimulateRequests})
+		return
+	}
+	if err := config.ValidateRuleSet(&req.Rules); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rules", "details": err.Error()})
+		return
+	}
+
+	var scratch *storage.MemoryStorage
+	var reader storage.BucketReader
+	if live, ok := h.storage.(*storage.MemoryStorage); ok {
+		scratch = live.Clone()
+	} else {
+		scratch = storage.NewMemoryStorageWithOptions(storage.MemoryOptions{Clock: h.clock})
+		reader, _ = h.storage.(storage.BucketReader)
+	}
+	defer scratch.Close()
+	sim := NewRateLimiterHandlerWithOptions(&simulationStorage{scratch, h.storage, reader, map[string]bool{}}, &req.Rules, HandlerOptions{
+		KeyTransformer: h.keys,
+		CostCalculator: h.costs,
+		TierExtractor:  h.tiers,
+		ClockFunc:      h.clock,
+	})
+
+	results := make([]SimulateResult, 0, len(req.Requests))
+	for _, checkReq := range req.Requests {
+		result := SimulateResult{Request: checkReq}
+		rulePath, ep, ok := req.Rules.MatchEndpoint(checkReq.Endpoint)
+		if ok {
+			result.RulePath = rulePath
+		}
+		resp, err := sim.Check(checkReq)
+		if err != nil {
+			var reqErr *RequestError
+			if !errors.As(err, &reqErr) {
+				log.Printf("❌ Simulation failed - key: %s, endpoint: %s, error: %v", checkReq.Key, checkReq.Endpoint, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "simulation failed"})
+				return
+			}
+			result.Error = reqErr.Message
+			results = append(results, result)
+			continue
+		}
+		result.Allowed = resp.Allowed && !resp.WouldDeny
+		result.RemainingTokens = resp.UserRemaining
+		if ep.Rule == "endpoint" {
+			result.RemainingTokens = resp.GlobalRemaining
+		}
+		results = append(results, result)
+	}
+	c.JSON(http.StatusOK, results)
+}
+
+// simulationStorage keeps a simulation's buckets in memory but looks tiers up
+// in the live storage, so keys run under the tiers they really have. With a
+// reader, each token bucket starts from its live balance the first time a
+// check charges it; resource buckets and quotas start full.
+type simulationStorage struct {
+	*storage.MemoryStorage
+	live   storage.Storage
+	reader storage.BucketReader // Nil when the live buckets were copied
+	seeded map[string]bool
+}
+
+func (s *simulationStorage) LookupTier(key string) (string, error) {
+	return s.live.LookupTier(key)
+}
+
+// seed copies the live balances of the buckets the simulation hasn't charged
+// yet. Buckets the live storage doesn't have start full, as they would there.
+func (s *simulationStorage) seed(keys ...string) error {
+	if s.reader == nil {
+		return nil
+	}
+	for _, key := range keys {
+		if key == "" || s.seeded[key] {
+			continue
+		}
+		s.seeded[key] = true
+		tokens, ok, err := s.reader.BucketTokens(key)
+		if err != nil {
+			return fmt.Errorf("reading live bucket %s: %w", key, err)
+		}
+		if !ok {
+			continue
+		}
+		if err := s.MemoryStorage.SetBucketTokens(key, tokens, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *simulationStorage) AtomicTokenBucket(key string, capacity int64, refillRate float64, cost int64, ttl time.Duration) (storage.BucketResult, error) {
+	if err := s.seed(key); err != nil {
+		return storage.BucketResult{}, err
+	}
+	return s.MemoryStorage.AtomicTokenBucket(key, capacity, refillRate, cost, ttl)
+}
+
+func (s *simulationStorage) AtomicDualBucket(userKey, globalKey string, globalCap int64, globalRate float64, userCap int64, userRate float64, userMaxDebt, cost int64, ttl time.Duration) (storage.BucketResult, error) {
+	if err := s.seed(userKey, globalKey); err != nil {
+		return storage.BucketResult{}, err
+	}
+	return s.MemoryStorage.AtomicDualBucket(userKey, globalKey, globalCap, globalRate, userCap, userRate, userMaxDebt, cost, ttl)
+}
+
+func (s *simulationStorage) AtomicUserIPBucket(userKey, ipKey string, userCap int64, userRate float64, userMaxDebt int64, ipCap int64, ipRate float64, cost int64, ttl time.Duration) (storage.BucketResult, error) {
+	if err := s.seed(userKey, ipKey); err != nil {
+		return storage.BucketResult{}, err
+	}
+	return s.MemoryStorage.AtomicUserIPBucket(userKey, ipKey, userCap, userRate, userMaxDebt, ipCap, ipRate, cost, ttl)
+}
+
+func (s *simulationStorage) AtomicMultiBucket(userKey, globalKey string, globalCap int64, globalRate float64, userCap int64, userRate float64, userMaxDebt, cost int64, resources []storage.ResourceBucket, ttl time.Duration) (storage.BucketResult, error) {
+	if err := s.seed(userKey, globalKey); err != nil {
+		return storage.BucketResult{}, err
+	}
+	return s.MemoryStorage.AtomicMultiBucket(userKey, globalKey, globalCap, globalRate, userCap, userRate, userMaxDebt, cost, resources, ttl)
+}
+
+func (s *simulationStorage) AtomicQuotaBucket(userKey, globalKey string, globalCap int64, globalRate float64, userCap int64, userRate float64, userMaxDebt, cost int64, quotas []storage.Quota, ttl time.Duration) (storage.BucketResult, error) {
+	if err := s.seed(userKey, globalKey); err != nil {
+		return storage.BucketResult{}, err
+	}
+	return s.MemoryStorage.AtomicQuotaBucket(userKey, globalKey, globalCap, globalRate, userCap, userRate, userMaxDebt, cost, quotas, ttl)
+}
+
+func (s *simulationStorage) AtomicInitialBucket(userKey, globalKey string, globalCap int64, globalRate float64, globalInitial int64, userCap int64, userRate float64, userInitial int64, userMaxDebt, cost int64, ttl time.Duration) (storage.BucketResult, error) {
+	if err := s.seed(userKey, globalKey); err != nil {
+		return storage.BucketResult{}, err
+	}
+	return s.MemoryStorage.AtomicInitialBucket(userKey, globalKey, globalCap, globalRate, globalInitial, userCap, userRate, userInitial, userMaxDebt, cost, ttl)
+}
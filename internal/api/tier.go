@@ -0,0 +1,101 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TierExtractor supplies the user tier for requests that do not set
+// user_tier, e.g. from a claim or header forwarded by a gateway. It reports
+// false when the request carries no tier.
+type TierExtractor interface {
+	ExtractTier(req CheckRequest) (string, bool)
+}
+
+// MetadataTierExtractor reads the tier from req.Metadata[MetadataKey],
+// defaulting to the "tier" key.
+type MetadataTierExtractor struct {
+	MetadataKey string
+}
+
+func (m MetadataTierExtractor) ExtractTier(req CheckRequest) (string, bool) {
+	key := m.MetadataKey
+	if key == "" {
+		key = "tier"
+	}
+	tier, ok := req.Metadata[key]
+	return tier, ok && tier != ""
+}
+
+// HeaderTierExtractor reads the tier from an HTTP request header, e.g.
+// "X-User-Tier". Headers are only available to checks made through the HTTP
+// handlers, so it never finds a tier for gRPC or library calls.
+type HeaderTierExtractor struct {
+	HeaderName string
+}
+
+func (x HeaderTierExtractor) ExtractTier(req CheckRequest) (string, bool) {
+	tier := req.Header.Get(x.HeaderName)
+	return tier, tier != ""
+}
+
+// tierCacheEntry is a cached LookupTier result; tier is "" for keys with no
+// stored tier.
+type tierCacheEntry struct {
+	tier    string
+	expires time.Time
+}
+
+// resolveTier returns the tier a tiers+endpoints check for req runs under
+// when tier lookup is enabled: the tier stored for req.Key, or the default
+// tier. A user_tier in the request is ignored, or rejected in strict mode
+// when it disagrees.
+func (h *RateLimiterHandler) resolveTier(req CheckRequest) (string, error) {
+	rules := h.Rules()
+	lookup := rules.TierLookup
+	tier, err := h.lookupTier(req.Key)
+	if err != nil {
+		return "", fmt.Errorf("rate limiter unavailable: %w", err)
+	}
+	if _, ok := rules.Tiers[tier]; tier != "" && !ok {
+		log.Printf("⚠️ [%s] Stored tier %q for key %s is not configured, using default tier %q", req.RequestID, tier, req.Key, lookup.DefaultTier)
+		tier = ""
+	}
+	if tier == "" {
+		tier = lookup.DefaultTier
+	}
+	if lookup.Strict && req.UserTier != "" && req.UserTier != tier {
+		return "", &RequestError{
+			Status:  http.StatusForbidden,
+			Message: "user_tier does not match the key's tier",
+			Details: gin.H{"provided": req.UserTier},
+		}
+	}
+	return tier, nil
+}
+
+// lookupTier reads key's stored tier, caching it for the configured
+// cache_ttl so checks don't pay an extra Redis round trip each.
+func (h *RateLimiterHandler) lookupTier(key string) (string, error) {
+	rules := h.Rules()
+	ttl := rules.TierLookup.CacheTTL
+	if ttl > 0 {
+		if cached, ok := h.tierCache.Load(key); ok {
+			if entry := cached.(tierCacheEntry); time.Now().Before(entry.expires) {
+				return entry.tier, nil
+			}
+		}
+	}
+	tier, err := h.storage.LookupTier(key)
+	if err != nil {
+		return "", err
+	}
+	if ttl > 0 {
+		h.tierCache.Store(key, tierCacheEntry{tier: tier, expires: time.Now().Add(ttl)})
+	}
+	return tier, nil
+}
@@ -0,0 +1,210 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestTierExtractors(t *testing.T) {
+	tests := []struct {
+		name      string
+		extractor TierExtractor
+		body      CheckRequest
+		header    string // X-User-Tier value
+		wantTier  string // Tier in the storage key; empty when the request must be rejected
+	}{
+		{"explicit user_tier wins", MetadataTierExtractor{}, CheckRequest{UserTier: "free", Metadata: map[string]string{"tier": "premium"}}, "", "free"},
+		{"metadata default key", MetadataTierExtractor{}, CheckRequest{Metadata: map[string]string{"tier": "premium"}}, "", "premium"},
+		{"metadata custom key", MetadataTierExtractor{MetadataKey: "plan"}, CheckRequest{Metadata: map[string]string{"plan": "free"}}, "", "free"},
+		{"metadata missing", MetadataTierExtractor{}, CheckRequest{}, "", ""},
+		{"header", HeaderTierExtractor{HeaderName: "X-User-Tier"}, CheckRequest{}, "premium", "premium"},
+		{"header missing", HeaderTierExtractor{HeaderName: "X-User-Tier"}, CheckRequest{}, "", ""},
+		{"no extractor", nil, CheckRequest{Metadata: map[string]string{"tier": "premium"}}, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := adminRules()
+			rules.Tiers["premium"] = rules.Tiers["free"]
+
+			mockStorage := new(MockRedisStorage)
+			mockStorage.On("AtomicDualBucket", "user:user123:/api/upload:"+tt.wantTier, "global:/api/upload",
+				mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+			).Return(storage.BucketResult{Allowed: true, Remaining: 90, GlobalRemaining: 9990}, nil)
+
+			handler := NewRateLimiterHandlerWithOptions(mockStorage, rules, HandlerOptions{TierExtractor: tt.extractor})
+			gin.SetMode(gin.TestMode)
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			tt.body.Key, tt.body.Endpoint = "user123", "/api/upload"
+			payload, _ := json.Marshal(tt.body)
+			c.Request, _ = http.NewRequest(http.MethodPost, "/check", bytes.NewBuffer(payload))
+			c.Request.Header.Set("Content-Type", "application/json")
+			if tt.header != "" {
+				c.Request.Header.Set("X-User-Tier", tt.header)
+			}
+
+			handler.CheckHandler(c)
+
+			if tt.wantTier == "" {
+				if w.Code != http.StatusBadRequest {
+					t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body.String())
+				}
+				var body map[string]interface{}
+				json.Unmarshal(w.Body.Bytes(), &body)
+				if body["error"] != "invalid user_tier" {
+					t.Errorf("expected invalid user_tier error, got %v", body)
+				}
+				return
+			}
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+			mockStorage.AssertExpectations(t)
+		})
+	}
+}
+
+func TestHeaderTierExtractor_ReserveHandler(t *testing.T) {
+	mockStorage := new(MockRedisStorage)
+	mockStorage.On("ReserveDualBucket", mock.Anything, mock.Anything, "user:user123:/api/upload:free", "global:/api/upload",
+		mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, time.Hour,
+	).Return(storage.BucketResult{Allowed: true}, nil)
+
+	handler := NewRateLimiterHandlerWithOptions(mockStorage, adminRules(), HandlerOptions{TierExtractor: HeaderTierExtractor{HeaderName: "X-User-Tier"}})
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/reserve", handler.ReserveHandler)
+	payload, _ := json.Marshal(ReserveRequest{CheckRequest: CheckRequest{Key: "user123", Endpoint: "/api/upload"}})
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/reserve", bytes.NewBuffer(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-User-Tier", "free")
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	mockStorage.AssertExpectations(t)
+}
+
+func tierLookupRules(strict bool) *config.RuleSet {
+	rules := adminRules()
+	rules.Tiers["premium"] = config.TierConfig{Capacity: 1000, RefillRate: 100}
+	rules.TierLookup = config.TierLookupConfig{Enabled: true, DefaultTier: "free", Strict: strict, CacheTTL: time.Minute}
+	return rules
+}
+
+func onTierDual(m *MockRedisStorage, tier string) {
+	m.On("AtomicDualBucket", "user:user123:/api/upload:"+tier, "global:/api/upload",
+		mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+	).Return(storage.BucketResult{Allowed: true}, nil)
+}
+
+func TestCheck_TierLookup(t *testing.T) {
+	tests := []struct {
+		name       string
+		stored     string // Tier in storage; "" for none
+		requested  string
+		strict     bool
+		wantTier   string
+		wantStatus int // Expected RequestError status, 0 for success
+	}{
+		{"stored tier", "premium", "", false, "premium", 0},
+		{"default tier when unmapped", "", "", false, "free", 0},
+		{"default tier when stored tier is unknown", "gold", "", false, "free", 0},
+		{"mismatching user_tier ignored", "free", "premium", false, "free", 0},
+		{"matching user_tier in strict mode", "premium", "premium", true, "premium", 0},
+		{"mismatching user_tier rejected in strict mode", "free", "premium", true, "", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage := new(MockRedisStorage)
+			mockStorage.On("LookupTier", "user123").Return(tt.stored, nil)
+			onTierDual(mockStorage, tt.wantTier)
+
+			handler := NewRateLimiterHandler(mockStorage, tierLookupRules(tt.strict))
+			_, err := handler.Check(CheckRequest{Key: "user123", Endpoint: "/api/upload", UserTier: tt.requested})
+			if tt.wantStatus != 0 {
+				var reqErr *RequestError
+				if !errors.As(err, &reqErr) || reqErr.Status != tt.wantStatus {
+					t.Fatalf("expected status %d, got %v", tt.wantStatus, err)
+				}
+				mockStorage.AssertNotCalled(t, "AtomicDualBucket", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			mockStorage.AssertExpectations(t)
+		})
+	}
+}
+
+func TestCheck_TierLookupIsCached(t *testing.T) {
+	mockStorage := new(MockRedisStorage)
+	mockStorage.On("LookupTier", "user123").Return("premium", nil).Once()
+	mockStorage.On("SetTier", "user123", "free").Return(nil)
+	onTierDual(mockStorage, "premium")
+	onTierDual(mockStorage, "free")
+
+	handler := NewRateLimiterHandler(mockStorage, tierLookupRules(false))
+	req := CheckRequest{Key: "user123", Endpoint: "/api/upload"}
+	for i := 0; i < 3; i++ {
+		if _, err := handler.Check(req); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	mockStorage.AssertNumberOfCalls(t, "LookupTier", 1)
+
+	// Changing the mapping through the admin API drops the cached tier
+	w := serveAdmin(handler, "/admin/tiers/set", "s3cret", SetTierRequest{Key: "user123", Tier: "free"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	mockStorage.On("LookupTier", "user123").Return("free", nil).Once()
+	if _, err := handler.Check(req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mockStorage.AssertNumberOfCalls(t, "LookupTier", 2)
+	mockStorage.AssertCalled(t, "AtomicDualBucket", "user:user123:/api/upload:free", "global:/api/upload",
+		mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestTierAdminHandlers(t *testing.T) {
+	mockStorage := new(MockRedisStorage)
+	mockStorage.On("DeleteTier", "user123").Return(true, nil)
+	handler := NewRateLimiterHandler(mockStorage, tierLookupRules(false))
+
+	w := serveAdmin(handler, "/admin/tiers/set", "s3cret", SetTierRequest{Key: "user123", Tier: "gold"})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an unknown tier, got %d", w.Code)
+	}
+	mockStorage.AssertNotCalled(t, "SetTier", mock.Anything, mock.Anything)
+
+	w = serveAdmin(handler, "/admin/tiers/remove", "s3cret", RemoveTierRequest{Key: "user123"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var body map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body["removed"] != true {
+		t.Errorf("expected removed=true, got %v", body)
+	}
+
+	w = serveAdmin(handler, "/admin/tiers/remove", "", RemoveTierRequest{Key: "user123"})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 without a token, got %d", w.Code)
+	}
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/mock"
+)
+
+func verboseRules() *config.RuleSet {
+	return &config.RuleSet{
+		Tiers: map[string]config.TierConfig{"free": {Capacity: 1000000, RefillRate: 1000000}},
+		IPs:   config.IPConfig{Capacity: 1000000, RefillRate: 1000000},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/upload": {Rule: "tiers+endpoints", Cost: 1, GlobalCapacity: 1000000, GlobalRefillRate: 1000000},
+			"/api/login":  {Rule: "IP+endpoints", Cost: 1, GlobalCapacity: 1000000, GlobalRefillRate: 1000000},
+			"/api/export": {Rule: "endpoint", Cost: 1, GlobalCapacity: 1000000, GlobalRefillRate: 1000000},
+			"/api/signup": {Rule: "user+ip", Cost: 1},
+		},
+	}
+}
+
+func TestCheckHandler_Verbose(t *testing.T) {
+	bodies := []string{
+		`{"key": "alice", "endpoint": "/api/upload", "user_tier": "free"}`,
+		`{"key": "alice", "endpoint": "/api/login", "ip_address": "10.0.0.1"}`,
+		`{"key": "alice", "endpoint": "/api/export"}`,
+		`{"key": "alice", "endpoint": "/api/signup", "user_tier": "free", "ip_address": "10.0.0.1"}`,
+	}
+	for _, verbose := range []bool{false, true} {
+		var logs bytes.Buffer
+		log.SetOutput(&logs)
+		handler := NewRateLimiterHandlerWithOptions(storage.NewMemoryStorage(), verboseRules(), HandlerOptions{Verbose: verbose})
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		router.POST("/check", handler.CheckHandler)
+		for _, body := range bodies {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/check", strings.NewReader(body)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200 for %s, got %d: %s", body, w.Code, w.Body.String())
+			}
+		}
+		log.SetOutput(io.Discard)
+
+		if verbose && !strings.Contains(logs.String(), "Request COMPLETE") {
+			t.Errorf("expected per-request lines when verbose, got %q", logs.String())
+		}
+		if !verbose && logs.Len() > 0 {
+			t.Errorf("expected no logging when not verbose, got %q", logs.String())
+		}
+	}
+}
+
+func TestCheckHandler_ErrorsLoggedWhenQuiet(t *testing.T) {
+	mockStorage := new(MockRedisStorage)
+	mockStorage.On("AtomicTokenBucket", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(storage.BucketResult{}, errors.New("connection refused"))
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(io.Discard)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/check", NewRateLimiterHandler(mockStorage, verboseRules()).CheckHandler)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/check", strings.NewReader(`{"key": "alice", "endpoint": "/api/export"}`)))
+
+	if w.Code != http.StatusInternalServerError || !strings.Contains(logs.String(), "Check failed") || !strings.Contains(logs.String(), "connection refused") {
+		t.Errorf("expected the storage failure to be logged, got %d and %q", w.Code, logs.String())
+	}
+}
+
+func benchmarkCheckHandler(b *testing.B, verbose bool) {
+	log.SetOutput(io.Discard)
+	handler := NewRateLimiterHandlerWithOptions(storage.NewMemoryStorage(), verboseRules(), HandlerOptions{Verbose: verbose})
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/check", handler.CheckHandler)
+	body := `{"key": "alice", "endpoint": "/api/upload", "user_tier": "free"}`
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/check", strings.NewReader(body)))
+	}
+}
+
+func BenchmarkCheckHandler_Quiet(b *testing.B)   { benchmarkCheckHandler(b, false) }
+func BenchmarkCheckHandler_Verbose(b *testing.B) { benchmarkCheckHandler(b, true) }
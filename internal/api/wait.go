@@ -0,0 +1,93 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultMaxWaiters = 100              // Concurrent /wait requests allowed to sleep
+	maxWaitLimit      = 30 * time.Second // Upper bound on a caller-supplied max_wait_ms
+)
+
+type WaitRequest struct {
+	CheckRequest
+	MaxWaitMs int64 `json:"max_wait_ms"` // How long the caller is willing to be held
+}
+
+// WaitHandler behaves like CheckHandler, but when the request is denied and the
+// cost becomes affordable within max_wait_ms it holds the request for the
+// computed wait and re-checks once before answering.
+func (h *RateLimiterHandler) WaitHandler(c *gin.Context) {
+	var req WaitRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeBindError(c, err)
+		return
+	}
+	if req.MaxWaitMs < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max_wait_ms must not be negative"})
+		return
+	}
+	maxWait := min(time.Duration(req.MaxWaitMs)*time.Millisecond, maxWaitLimit)
+
+	resp, ok := h.evaluate(c, req.CheckRequest)
+	if !ok {
+		return
+	}
+	if resp.Allowed {
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	wait := time.Duration(resp.RetryAfterMs) * time.Millisecond
+	if wait < 0 || wait > maxWait {
+		denyWait(c, resp)
+		return
+	}
+
+	// Never let sleeping requests pile up without bound
+	select {
+	case h.waitSlots <- struct{}{}:
+		defer func() { <-h.waitSlots }()
+	default:
+		log.Printf("[%s] wait queue full, denying key: %s endpoint: %s", contextRequestID(c), req.Key, req.Endpoint)
+		denyWait(c, resp)
+		return
+	}
+
+	start := time.Now()
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-c.Request.Context().Done():
+		// The caller gave up part way; only the rest of the wait is left
+		resp.RetryAfterMs = max(0, (wait - time.Since(start)).Milliseconds())
+		denyWait(c, resp)
+		return
+	case <-timer.C:
+	}
+
+	// One re-check after the computed wait; another caller may have taken the tokens
+	resp, ok = h.evaluate(c, req.CheckRequest)
+	if !ok {
+		return
+	}
+	if !resp.Allowed {
+		denyWait(c, resp)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// denyWait answers a /wait request with a 429 and, when resp says how long
+// the tokens will take, a Retry-After in whole seconds.
+func denyWait(c *gin.Context, resp CheckResponse) {
+	if resp.RetryAfterMs > 0 {
+		c.Header("Retry-After", strconv.FormatInt((resp.RetryAfterMs+999)/1000, 10))
+	}
+	c.JSON(http.StatusTooManyRequests, resp)
+}
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/mock"
+)
+
+func waitTestRules() *config.RuleSet {
+	return &config.RuleSet{
+		Tiers: map[string]config.TierConfig{
+			"free": {Capacity: 100, RefillRate: 10},
+		},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/upload": {
+				Rule:             "tiers+endpoints",
+				Cost:             10,
+				GlobalCapacity:   10000,
+				GlobalRefillRate: 2000,
+			},
+		},
+	}
+}
+
+func doWait(handler *RateLimiterHandler, ctx context.Context, maxWaitMs int64) (*httptest.ResponseRecorder, CheckResponse) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	body, _ := json.Marshal(WaitRequest{
+		CheckRequest: CheckRequest{Key: "user123", Endpoint: "/api/upload", UserTier: "free"},
+		MaxWaitMs:    maxWaitMs,
+	})
+	c.Request, _ = http.NewRequestWithContext(ctx, http.MethodPost, "/wait", bytes.NewBuffer(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+
+	handler.WaitHandler(c)
+
+	var resp CheckResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w, resp
+}
+
+func onDual(m *MockRedisStorage) *mock.Call {
+	return m.On("AtomicDualBucket",
+		mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything, mock.Anything,
+	)
+}
+
+func TestWaitHandler_AllowedImmediately(t *testing.T) {
+	mockStorage := new(MockRedisStorage)
+	onDual(mockStorage).Return(storage.BucketResult{Allowed: true, Remaining: 90, GlobalRemaining: 9990}, nil)
+
+	w, _ := doWait(NewRateLimiterHandler(mockStorage, waitTestRules()), context.Background(), 1000)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", w.Code)
+	}
+	mockStorage.AssertNumberOfCalls(t, "AtomicDualBucket", 1)
+}
+
+func TestWaitHandler_WaitsThenAllows(t *testing.T) {
+	mockStorage := new(MockRedisStorage)
+	onDual(mockStorage).Return(storage.BucketResult{Allowed: false, RetryAfter: 20 * time.Millisecond}, nil).Once()
+	onDual(mockStorage).Return(storage.BucketResult{Allowed: true, Remaining: 0, GlobalRemaining: 9990}, nil).Once()
+
+	start := time.Now()
+	w, resp := doWait(NewRateLimiterHandler(mockStorage, waitTestRules()), context.Background(), 1000)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", w.Code)
+	}
+	if !resp.Allowed {
+		t.Error("expected request to be allowed after waiting")
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("expected handler to wait at least 20ms, waited %v", elapsed)
+	}
+	mockStorage.AssertNumberOfCalls(t, "AtomicDualBucket", 2)
+}
+
+func TestWaitHandler_WaitExceedsMax(t *testing.T) {
+	mockStorage := new(MockRedisStorage)
+	onDual(mockStorage).Return(storage.BucketResult{Allowed: false, RetryAfter: 5 * time.Second}, nil)
+
+	w, resp := doWait(NewRateLimiterHandler(mockStorage, waitTestRules()), context.Background(), 100)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status 429, got %d", w.Code)
+	}
+	if resp.RetryAfterMs != 5000 {
+		t.Errorf("expected retryAfterMs 5000, got %d", resp.RetryAfterMs)
+	}
+	if got := w.Header().Get("Retry-After"); got != "5" {
+		t.Errorf("expected Retry-After 5, got %q", got)
+	}
+	mockStorage.AssertNumberOfCalls(t, "AtomicDualBucket", 1)
+}
+
+func TestWaitHandler_NeverAffordable(t *testing.T) {
+	mockStorage := new(MockRedisStorage)
+	onDual(mockStorage).Return(storage.BucketResult{Allowed: false, RetryAfter: -time.Millisecond}, nil)
+
+	w, _ := doWait(NewRateLimiterHandler(mockStorage, waitTestRules()), context.Background(), 1000)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status 429, got %d", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "" {
+		t.Errorf("expected no Retry-After for a cost that can never be paid, got %q", got)
+	}
+	mockStorage.AssertNumberOfCalls(t, "AtomicDualBucket", 1)
+}
+
+func TestWaitHandler_ContextCancelled(t *testing.T) {
+	mockStorage := new(MockRedisStorage)
+	onDual(mockStorage).Return(storage.BucketResult{Allowed: false, RetryAfter: 500 * time.Millisecond}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	w, resp := doWait(NewRateLimiterHandler(mockStorage, waitTestRules()), ctx, 1000)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status 429, got %d", w.Code)
+	}
+	elapsed := time.Since(start)
+	if elapsed >= 500*time.Millisecond {
+		t.Errorf("expected cancellation to end the wait early, waited %v", elapsed)
+	}
+	// Only what was left of the wait when the caller gave up
+	if resp.RetryAfterMs <= 0 || resp.RetryAfterMs > (500*time.Millisecond-10*time.Millisecond).Milliseconds() {
+		t.Errorf("expected retryAfterMs below the 490ms left, got %d", resp.RetryAfterMs)
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("expected Retry-After 1, got %q", got)
+	}
+	mockStorage.AssertNumberOfCalls(t, "AtomicDualBucket", 1)
+}
+
+func TestWaitHandler_QueueFull(t *testing.T) {
+	mockStorage := new(MockRedisStorage)
+	onDual(mockStorage).Return(storage.BucketResult{Allowed: false, RetryAfter: 10 * time.Millisecond}, nil)
+
+	handler := NewRateLimiterHandler(mockStorage, waitTestRules())
+	for i := 0; i < cap(handler.waitSlots); i++ {
+		handler.waitSlots <- struct{}{}
+	}
+
+	w, _ := doWait(handler, context.Background(), 1000)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status 429, got %d", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("expected Retry-After 1, got %q", got)
+	}
+	mockStorage.AssertNumberOfCalls(t, "AtomicDualBucket", 1)
+}
@@ -0,0 +1,108 @@
+// Package grpclimit applies the rate limiter to gRPC calls, either on the
+// outbound side (to share a budget for third-party APIs) or on the inbound side.
+package grpclimit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/internal/api"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Limiter makes a rate limit decision. It is satisfied by an embedded limiter
+// (direct Storage access) or a remote one calling the limiter's Check service.
+type Limiter interface {
+	Check(ctx context.Context, req api.CheckRequest) (api.CheckResponse, error)
+}
+
+// KeyFunc extracts the rate limit key and user tier for a call from its
+// metadata (outgoing metadata on the client, incoming on the server).
+type KeyFunc func(ctx context.Context, md metadata.MD) (key, tier string, err error)
+
+type Options struct {
+	Limiter Limiter
+	KeyFunc KeyFunc
+	// EndpointFor maps a full method name to the endpoint rule to apply.
+	// Calls it reports false for are not limited. When nil, the full method
+	// name itself is used as the endpoint.
+	EndpointFor func(fullMethod string) (string, bool)
+	// FailOpen lets calls through when the limiter itself errors.
+	FailOpen bool
+}
+
+// UnaryClientInterceptor limits outbound unary calls before they are sent.
+func UnaryClientInterceptor(opts Options) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, callOpts ...grpc.CallOption) error {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		if err := opts.limit(ctx, method, md); err != nil {
+			return err
+		}
+		return invoker(ctx, method, req, reply, cc, callOpts...)
+	}
+}
+
+// UnaryServerInterceptor limits inbound unary calls before the handler runs.
+func UnaryServerInterceptor(opts Options) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if err := opts.limit(ctx, info.FullMethod, md); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func (o Options) limit(ctx context.Context, fullMethod string, md metadata.MD) error {
+	endpoint, ok := fullMethod, true
+	if o.EndpointFor != nil {
+		endpoint, ok = o.EndpointFor(fullMethod)
+	}
+	if !ok {
+		return nil
+	}
+
+	key, tier, err := o.KeyFunc(ctx, md)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "rate limit key: %v", err)
+	}
+
+	resp, err := o.Limiter.Check(ctx, api.CheckRequest{Key: key, Endpoint: endpoint, UserTier: tier})
+	if err != nil {
+		if o.FailOpen {
+			log.Printf("Warning: rate limiter failed for %s, letting call through: %v", fullMethod, err)
+			return nil
+		}
+		if _, isStatus := status.FromError(err); isStatus {
+			return err
+		}
+		return status.Errorf(codes.Unavailable, "rate limiter unavailable: %v", err)
+	}
+	if resp.Allowed {
+		return nil
+	}
+	return exhausted(fullMethod, resp.RetryAfterMs)
+}
+
+// exhausted builds a ResourceExhausted status carrying RetryInfo when the
+// cost will become affordable.
+func exhausted(fullMethod string, retryAfterMs int64) error {
+	st := status.New(codes.ResourceExhausted, fmt.Sprintf("rate limit exceeded for %s", fullMethod))
+	if retryAfterMs <= 0 {
+		return st.Err()
+	}
+	withRetry, err := st.WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(time.Duration(retryAfterMs) * time.Millisecond),
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return withRetry.Err()
+}
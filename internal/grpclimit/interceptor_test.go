@@ -0,0 +1,229 @@
+package grpclimit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/api"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// fakeLimiter records the last request and returns a canned decision.
+type fakeLimiter struct {
+	resp api.CheckResponse
+	err  error
+	last api.CheckRequest
+}
+
+func (f *fakeLimiter) Check(ctx context.Context, req api.CheckRequest) (api.CheckResponse, error) {
+	f.last = req
+	return f.resp, f.err
+}
+
+// fakeStorage always answers with the same bucket result. Methods the
+// limiter never calls are left to the nil embedded Storage.
+type fakeStorage struct {
+	storage.Storage
+	result storage.BucketResult
+}
+
+func (f *fakeStorage) AtomicTokenBucket(key string, capacity int64, refillRate float64, cost int64, ttl time.Duration) (storage.BucketResult, error) {
+	return f.result, nil
+}
+
+func (f *fakeStorage) AtomicDualBucket(userKey, globalKey string, globalCap int64, globalRate float64, userCap int64, userRate float64, userMaxDebt, cost int64, ttl time.Duration) (storage.BucketResult, error) {
+	return f.result, nil
+}
+
+func (f *fakeStorage) Ping() error  { return nil }
+func (f *fakeStorage) Close() error { return nil }
+
+func keyFromMetadata(ctx context.Context, md metadata.MD) (string, string, error) {
+	keys := md.Get("x-api-key")
+	if len(keys) == 0 {
+		return "", "", errors.New("missing x-api-key")
+	}
+	return keys[0], "free", nil
+}
+
+func TestUnaryClientInterceptor_Allowed(t *testing.T) {
+	limiter := &fakeLimiter{resp: api.CheckResponse{Allowed: true}}
+	interceptor := UnaryClientInterceptor(Options{Limiter: limiter, KeyFunc: keyFromMetadata})
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "user123")
+	invoked := false
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		invoked = true
+		return nil
+	}
+
+	if err := interceptor(ctx, "/payments.Gateway/Charge", nil, nil, nil, invoker); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !invoked {
+		t.Error("expected the call to be forwarded")
+	}
+	if limiter.last.Key != "user123" || limiter.last.UserTier != "free" || limiter.last.Endpoint != "/payments.Gateway/Charge" {
+		t.Errorf("unexpected check request: %+v", limiter.last)
+	}
+}
+
+func TestUnaryClientInterceptor_Denied(t *testing.T) {
+	limiter := &fakeLimiter{resp: api.CheckResponse{Allowed: false, RetryAfterMs: 1500}}
+	interceptor := UnaryClientInterceptor(Options{Limiter: limiter, KeyFunc: keyFromMetadata})
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "user123")
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		t.Error("denied call must not be forwarded")
+		return nil
+	}
+
+	err := interceptor(ctx, "/payments.Gateway/Charge", nil, nil, nil, invoker)
+	st, _ := status.FromError(err)
+	if st.Code() != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted, got %v", st.Code())
+	}
+
+	var retry *errdetails.RetryInfo
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			retry = info
+		}
+	}
+	if retry == nil {
+		t.Fatal("expected RetryInfo detail")
+	}
+	if retry.RetryDelay.AsDuration() != 1500*time.Millisecond {
+		t.Errorf("expected retry delay 1.5s, got %v", retry.RetryDelay.AsDuration())
+	}
+}
+
+func TestUnaryClientInterceptor_UnmappedMethodPassesThrough(t *testing.T) {
+	limiter := &fakeLimiter{resp: api.CheckResponse{Allowed: false}}
+	interceptor := UnaryClientInterceptor(Options{
+		Limiter: limiter,
+		KeyFunc: keyFromMetadata,
+		EndpointFor: func(fullMethod string) (string, bool) {
+			endpoint, ok := map[string]string{"/payments.Gateway/Charge": "/api/charge"}[fullMethod]
+			return endpoint, ok
+		},
+	})
+
+	invoked := false
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		invoked = true
+		return nil
+	}
+
+	if err := interceptor(context.Background(), "/payments.Gateway/Refund", nil, nil, nil, invoker); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !invoked {
+		t.Error("expected unmapped method to be forwarded")
+	}
+}
+
+func TestUnaryClientInterceptor_LimiterError(t *testing.T) {
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "user123")
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		return nil
+	}
+
+	closed := UnaryClientInterceptor(Options{Limiter: &fakeLimiter{err: errors.New("redis down")}, KeyFunc: keyFromMetadata})
+	if st, _ := status.FromError(closed(ctx, "/svc/M", nil, nil, nil, invoker)); st.Code() != codes.Unavailable {
+		t.Errorf("expected Unavailable, got %v", st.Code())
+	}
+
+	open := UnaryClientInterceptor(Options{Limiter: &fakeLimiter{err: errors.New("redis down")}, KeyFunc: keyFromMetadata, FailOpen: true})
+	if err := open(ctx, "/svc/M", nil, nil, nil, invoker); err != nil {
+		t.Errorf("expected fail-open to forward the call, got %v", err)
+	}
+}
+
+func TestUnaryServerInterceptor_MissingKey(t *testing.T) {
+	interceptor := UnaryServerInterceptor(Options{Limiter: &fakeLimiter{resp: api.CheckResponse{Allowed: true}}, KeyFunc: keyFromMetadata})
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		t.Error("handler must not run without a key")
+		return nil, nil
+	}
+
+	_, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/svc/M"}, handler)
+	if st, _ := status.FromError(err); st.Code() != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument, got %v", st.Code())
+	}
+}
+
+func TestUnaryServerInterceptor_Denied(t *testing.T) {
+	interceptor := UnaryServerInterceptor(Options{Limiter: &fakeLimiter{resp: api.CheckResponse{Allowed: false}}, KeyFunc: keyFromMetadata})
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-api-key", "user123"))
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		t.Error("handler must not run when denied")
+		return nil, nil
+	}
+
+	_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/svc/M"}, handler)
+	if st, _ := status.FromError(err); st.Code() != codes.ResourceExhausted {
+		t.Errorf("expected ResourceExhausted, got %v", st.Code())
+	}
+}
+
+func TestRemoteLimiter_CallsCheckService(t *testing.T) {
+	rules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{"free": {Capacity: 100, RefillRate: 10}},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/charge": {Rule: "tiers+endpoints", Cost: 10, GlobalCapacity: 1000, GlobalRefillRate: 100},
+		},
+	}
+	local := NewLocalLimiter(&fakeStorage{result: storage.BucketResult{Allowed: true, Remaining: 90, GlobalRemaining: 990}}, rules)
+
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	RegisterCheckService(server, local)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	remote := NewRemoteLimiter(conn)
+
+	resp, err := remote.Check(context.Background(), api.CheckRequest{Key: "user123", Endpoint: "/api/charge", UserTier: "free"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !resp.Allowed || resp.UserRemaining != 90 || resp.GlobalRemaining != 990 {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+
+	_, err = remote.Check(context.Background(), api.CheckRequest{Key: "user123", Endpoint: "/api/unknown"})
+	if st, _ := status.FromError(err); st.Code() != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for unknown endpoint, got %v", st.Code())
+	}
+}
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard) // Turn off all the log when testing
+	os.Exit(m.Run())
+}
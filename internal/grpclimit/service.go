@@ -0,0 +1,113 @@
+package grpclimit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/AndySung320/rate-limiter/config"
+	"github.com/AndySung320/rate-limiter/internal/api"
+	"github.com/AndySung320/rate-limiter/internal/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+)
+
+// The Check service carries api.CheckRequest/CheckResponse as JSON, so it
+// needs no generated protobuf code. Clients select the codec with
+// grpc.CallContentSubtype(codecName).
+const (
+	codecName       = "json"
+	checkFullMethod = "/ratelimiter.RateLimiter/Check"
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                               { return codecName }
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// localLimiter checks directly against Storage, in-process.
+type localLimiter struct {
+	handler *api.RateLimiterHandler
+}
+
+// NewLocalLimiter returns an embedded Limiter backed directly by st.
+func NewLocalLimiter(st storage.Storage, rules *config.RuleSet) Limiter {
+	return &localLimiter{handler: api.NewRateLimiterHandler(st, rules)}
+}
+
+// NewHandlerLimiter returns an embedded Limiter that shares h, and so its
+// rules and any reloads of them, with the HTTP API.
+func NewHandlerLimiter(h *api.RateLimiterHandler) Limiter {
+	return &localLimiter{handler: h}
+}
+
+func (l *localLimiter) Check(ctx context.Context, req api.CheckRequest) (api.CheckResponse, error) {
+	resp, err := l.handler.Check(req)
+	var reqErr *api.RequestError
+	if errors.As(err, &reqErr) {
+		return resp, status.Error(codes.InvalidArgument, reqErr.Message)
+	}
+	return resp, err
+}
+
+// remoteLimiter calls the Check service of a running limiter.
+type remoteLimiter struct {
+	conn grpc.ClientConnInterface
+}
+
+// NewRemoteLimiter returns a Limiter that calls the limiter's Check service over conn.
+func NewRemoteLimiter(conn grpc.ClientConnInterface) Limiter {
+	return &remoteLimiter{conn: conn}
+}
+
+func (r *remoteLimiter) Check(ctx context.Context, req api.CheckRequest) (api.CheckResponse, error) {
+	var resp api.CheckResponse
+	err := r.conn.Invoke(ctx, checkFullMethod, &req, &resp, grpc.CallContentSubtype(codecName))
+	return resp, err
+}
+
+// RegisterCheckService exposes l as the ratelimiter.RateLimiter/Check gRPC method.
+func RegisterCheckService(s *grpc.Server, l Limiter) {
+	s.RegisterService(&checkServiceDesc, l)
+}
+
+var checkServiceDesc = grpc.ServiceDesc{
+	ServiceName: "ratelimiter.RateLimiter",
+	HandlerType: (*Limiter)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Check",
+			Handler:    checkHandler,
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+func checkHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	var req api.CheckRequest
+	if err := dec(&req); err != nil {
+		return nil, err
+	}
+	check := func(ctx context.Context, in interface{}) (interface{}, error) {
+		resp, err := srv.(Limiter).Check(ctx, *in.(*api.CheckRequest))
+		if err != nil {
+			if _, isStatus := status.FromError(err); isStatus {
+				return nil, err
+			}
+			return nil, status.Errorf(codes.Unavailable, "rate limiter unavailable: %v", err)
+		}
+		return &resp, nil
+	}
+	if interceptor == nil {
+		return check(ctx, &req)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: checkFullMethod}
+	return interceptor(ctx, &req, info, check)
+}
@@ -0,0 +1,131 @@
+package jwtauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+)
+
+// maxJWKSSize bounds how much of a JWKS response is read.
+const maxJWKSSize = 1 << 20
+
+// jwk is a parsed JWKS entry.
+type jwk struct {
+	kid    string
+	public crypto.PublicKey // *rsa.PublicKey or *ecdsa.PublicKey
+}
+
+// rawJWK is a JWKS entry as published (RFC 7517).
+type rawJWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// refreshKeys fetches the JWKS and replaces the cached keys.
+func (v *Verifier) refreshKeys(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.jwksURL, nil)
+	if err != nil {
+		return fmt.Errorf("jwt: bad JWKS URL: %w", err)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("jwt: fetching JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("jwt: fetching JWKS: status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []rawJWK `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJWKSSize)).Decode(&set); err != nil {
+		return fmt.Errorf("jwt: decoding JWKS: %w", err)
+	}
+	keys := make([]jwk, 0, len(set.Keys))
+	for _, raw := range set.Keys {
+		if raw.Use != "" && raw.Use != "sig" {
+			continue
+		}
+		public, err := raw.publicKey()
+		if err != nil {
+			// One unusable key should not take the others down with it
+			log.Printf("⚠️ Skipping JWKS key %q: %v", raw.Kid, err)
+			continue
+		}
+		keys = append(keys, jwk{kid: raw.Kid, public: public})
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("jwt: JWKS has no usable signing keys")
+	}
+
+	v.keysMu.Lock()
+	v.keys = keys
+	v.keysMu.Unlock()
+	return nil
+}
+
+func (k rawJWK) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("unsupported RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{
+			"P-256": elliptic.P256(),
+			"P-384": elliptic.P384(),
+			"P-521": elliptic.P521(),
+		}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(raw) == 0 {
+		return nil, fmt.Errorf("bad key parameter encoding")
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
@@ -0,0 +1,261 @@
+// Package jwtauth verifies the JWTs a gateway forwards to the limiter, so
+// the key and tier a request is limited under can come from signed claims.
+// HMAC tokens (HS256/384/512) are checked against shared secrets and
+// RSA/ECDSA tokens (RS256/384/512, ES256/384/512) against a JWKS.
+package jwtauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // Register the hashes used by the supported algorithms
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrMalformed        = errors.New("malformed token")
+	ErrInvalidSignature = errors.New("invalid token signature")
+	ErrExpired          = errors.New("token expired")
+	ErrNotYetValid      = errors.New("token not valid yet")
+)
+
+const defaultJWKSRefresh = 10 * time.Minute
+
+// Claims is a verified token's payload.
+type Claims map[string]interface{}
+
+// String returns the claim name as a string, reporting false when it is
+// missing, empty or not a string.
+func (c Claims) String(name string) (string, bool) {
+	s, ok := c[name].(string)
+	return s, ok && s != ""
+}
+
+type Options struct {
+	// HMACSecrets verify HS* tokens; listing several allows rotation
+	HMACSecrets [][]byte
+	// JWKSURL is fetched for the public keys that verify RS* and ES* tokens
+	JWKSURL string
+	// JWKSRefresh is how often the JWKS is refetched; defaults to 10m
+	JWKSRefresh time.Duration
+	// ClockSkew is the leeway applied to exp and nbf
+	ClockSkew  time.Duration
+	HTTPClient *http.Client // Defaults to a client with a 10s timeout
+}
+
+// Verifier checks token signatures and validity windows. It is safe for
+// concurrent use.
+type Verifier struct {
+	secrets   [][]byte
+	clockSkew time.Duration
+	now       func() time.Time
+
+	jwksURL string
+	client  *http.Client
+	keysMu  sync.RWMutex
+	keys    []jwk
+	stop    context.CancelFunc
+	stopped chan struct{}
+}
+
+// NewVerifier builds a Verifier from opts. With a JWKS URL it fetches the
+// key set before returning and refreshes it in the background until Close.
+func NewVerifier(opts Options) (*Verifier, error) {
+	if len(opts.HMACSecrets) == 0 && opts.JWKSURL == "" {
+		return nil, errors.New("jwt: at least one HMAC secret or a JWKS URL is required")
+	}
+	if opts.ClockSkew < 0 || opts.JWKSRefresh < 0 {
+		return nil, errors.New("jwt: clock skew and JWKS refresh must not be negative")
+	}
+	v := &Verifier{
+		secrets:   opts.HMACSecrets,
+		clockSkew: opts.ClockSkew,
+		now:       time.Now,
+		jwksURL:   opts.JWKSURL,
+		client:    opts.HTTPClient,
+	}
+	if v.jwksURL == "" {
+		return v, nil
+	}
+	if v.client == nil {
+		v.client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if err := v.refreshKeys(context.Background()); err != nil {
+		return nil, err
+	}
+
+	refresh := opts.JWKSRefresh
+	if refresh == 0 {
+		refresh = defaultJWKSRefresh
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	v.stop = cancel
+	v.stopped = make(chan struct{})
+	go v.refreshLoop(ctx, refresh)
+	return v, nil
+}
+
+// Close stops the background JWKS refresh.
+func (v *Verifier) Close() {
+	if v.stop != nil {
+		v.stop()
+		<-v.stopped
+	}
+}
+
+func (v *Verifier) refreshLoop(ctx context.Context, every time.Duration) {
+	defer close(v.stopped)
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// Keep verifying with the last good key set if the fetch fails
+			if err := v.refreshKeys(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("❌ JWKS refresh failed: %v", err)
+			}
+		}
+	}
+}
+
+// Verify checks token's signature and its exp and nbf claims, returning its
+// claims. Errors wrap ErrMalformed, ErrInvalidSignature, ErrExpired or
+// ErrNotYetValid.
+func (v *Verifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad signature encoding", ErrMalformed)
+	}
+	if err := v.verifySignature(header.Alg, header.Kid, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	now := v.now()
+	if exp, ok := claims["exp"].(float64); ok && now.After(unixTime(exp).Add(v.clockSkew)) {
+		return nil, ErrExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.clockSkew).Before(unixTime(nbf)) {
+		return nil, ErrNotYetValid
+	}
+	return claims, nil
+}
+
+func (v *Verifier) verifySignature(alg, kid, signed string, signature []byte) error {
+	var hash crypto.Hash
+	if len(alg) == 5 {
+		hash = algHashes[alg[2:]]
+	}
+	if hash == 0 {
+		return fmt.Errorf("%w: unsupported alg %q", ErrInvalidSignature, alg)
+	}
+
+	switch alg[:2] {
+	case "HS":
+		for _, secret := range v.secrets {
+			mac := hmac.New(hash.New, secret)
+			mac.Write([]byte(signed))
+			if hmac.Equal(mac.Sum(nil), signature) {
+				return nil
+			}
+		}
+		return ErrInvalidSignature
+	case "RS", "ES":
+	default:
+		return fmt.Errorf("%w: unsupported alg %q", ErrInvalidSignature, alg)
+	}
+
+	digest := hash.New()
+	digest.Write([]byte(signed))
+	sum := digest.Sum(nil)
+	for _, key := range v.candidateKeys(kid) {
+		switch pub := key.public.(type) {
+		case *rsa.PublicKey:
+			if alg[0] == 'R' && rsa.VerifyPKCS1v15(pub, hash, sum, signature) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			if alg[0] == 'E' && verifyECDSA(pub, sum, signature) {
+				return nil
+			}
+		}
+	}
+	return ErrInvalidSignature
+}
+
+var algHashes = map[string]crypto.Hash{
+	"256": crypto.SHA256,
+	"384": crypto.SHA384,
+	"512": crypto.SHA512,
+}
+
+// verifyECDSA checks a JWS ECDSA signature, which is r and s concatenated
+// as fixed-size big-endian integers.
+func verifyECDSA(pub *ecdsa.PublicKey, sum, signature []byte) bool {
+	size := (pub.Curve.Params().BitSize + 7) / 8
+	if len(signature) != 2*size {
+		return false
+	}
+	r := new(big.Int).SetBytes(signature[:size])
+	s := new(big.Int).SetBytes(signature[size:])
+	return ecdsa.Verify(pub, sum, r, s)
+}
+
+// candidateKeys returns the JWKS keys that may have signed a token: the key
+// with the token's kid, or every key when the token names none.
+func (v *Verifier) candidateKeys(kid string) []jwk {
+	v.keysMu.RLock()
+	defer v.keysMu.RUnlock()
+	if kid == "" {
+		return v.keys
+	}
+	for _, key := range v.keys {
+		if key.kid == kid {
+			return []jwk{key}
+		}
+	}
+	return nil
+}
+
+func decodeSegment(segment string, into interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("%w: bad base64", ErrMalformed)
+	}
+	if err := json.Unmarshal(raw, into); err != nil {
+		return fmt.Errorf("%w: bad json", ErrMalformed)
+	}
+	return nil
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.UnixMilli(int64(seconds * 1000))
+}
@@ -0,0 +1,162 @@
+package jwtauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func segment(v interface{}) string {
+	raw, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func signHS256(secret string, claims map[string]interface{}) string {
+	signed := segment(map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + segment(claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signRS256(key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	signed := segment(map[string]string{"alg": "RS256", "kid": kid}) + "." + segment(claims)
+	sum := sha256.Sum256([]byte(signed))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func signES256(key *ecdsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	signed := segment(map[string]string{"alg": "ES256", "kid": kid}) + "." + segment(claims)
+	sum := sha256.Sum256([]byte(signed))
+	r, s, _ := ecdsa.Sign(rand.Reader, key, sum[:])
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func rsaJWK(kid string, key *rsa.PrivateKey) map[string]string {
+	return map[string]string{"kty": "RSA", "kid": kid, "n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes())}
+}
+
+func ecJWK(kid string, key *ecdsa.PrivateKey) map[string]string {
+	return map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": b64(key.X.FillBytes(make([]byte, 32))), "y": b64(key.Y.FillBytes(make([]byte, 32)))}
+}
+
+func TestVerify_HMAC(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	v, err := NewVerifier(Options{HMACSecrets: [][]byte{[]byte("old"), []byte("new")}, ClockSkew: 30 * time.Second})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	v.now = func() time.Time { return now }
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"valid", signHS256("new", map[string]interface{}{"sub": "user123", "exp": now.Unix() + 60}), nil},
+		{"rotated secret", signHS256("old", map[string]interface{}{"sub": "user123"}), nil},
+		{"expired within skew", signHS256("new", map[string]interface{}{"exp": now.Unix() - 10}), nil},
+		{"expired", signHS256("new", map[string]interface{}{"exp": now.Unix() - 60}), ErrExpired},
+		{"not yet valid", signHS256("new", map[string]interface{}{"nbf": now.Unix() + 60}), ErrNotYetValid},
+		{"wrong secret", signHS256("guess", map[string]interface{}{"sub": "user123"}), ErrInvalidSignature},
+		{"alg none", segment(map[string]string{"alg": "none"}) + "." + segment(map[string]string{"sub": "admin"}) + ".", ErrInvalidSignature},
+		{"not a jwt", "abc.def", ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := v.Verify(tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if err == nil && tt.name == "valid" {
+				if sub, _ := claims.String("sub"); sub != "user123" {
+					t.Errorf("expected sub user123, got %v", claims)
+				}
+			}
+		})
+	}
+}
+
+func TestVerify_JWKS(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rotatedKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys := []map[string]string{rsaJWK("rsa-1", rsaKey), ecJWK("ec-1", ecKey)}
+		if fetches.Add(1) > 1 {
+			keys = append(keys, rsaJWK("rsa-2", rotatedKey))
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	defer server.Close()
+
+	v, err := NewVerifier(Options{JWKSURL: server.URL, JWKSRefresh: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer v.Close()
+
+	claims := map[string]interface{}{"sub": "user123", "plan": "premium"}
+	if _, err := v.Verify(signRS256(rsaKey, "rsa-1", claims)); err != nil {
+		t.Errorf("expected RS256 token to verify, got %v", err)
+	}
+	if _, err := v.Verify(signES256(ecKey, "ec-1", claims)); err != nil {
+		t.Errorf("expected ES256 token to verify, got %v", err)
+	}
+	if _, err := v.Verify(signRS256(rsaKey, "ec-1", claims)); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected a key of the wrong type to be rejected, got %v", err)
+	}
+	// An HS256 token must not be accepted just because JWKS keys exist
+	if _, err := v.Verify(signHS256("", claims)); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected HS256 token to be rejected without secrets, got %v", err)
+	}
+
+	// Keys published after startup are picked up by the background refresh
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, err := v.Verify(signRS256(rotatedKey, "rsa-2", claims))
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("rotated key never accepted: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewVerifier_JWKSUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	if _, err := NewVerifier(Options{JWKSURL: server.URL}); err == nil {
+		t.Fatal("expected an error when the JWKS cannot be fetched")
+	}
+	if _, err := NewVerifier(Options{}); err == nil {
+		t.Fatal("expected an error without secrets or a JWKS URL")
+	}
+}
@@ -0,0 +1,200 @@
+// Package notifier sends events operators may want alerting on, such as a
+// key being banned, to a webhook.
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/config"
+)
+
+// SignatureHeader carries the hex HMAC-SHA256 of the body, prefixed with
+// "sha256=", when the webhook has a secret.
+const SignatureHeader = "X-Signature-256"
+
+// Event is the JSON body posted for each event.
+type Event struct {
+	Event     string         `json:"event"` // One of config.WebhookEvents
+	Key       string         `json:"key"`
+	Endpoint  string         `json:"endpoint"`
+	Timestamp time.Time      `json:"timestamp"`
+	Metadata  map[string]any `json:"metadata,omitempty"`
+}
+
+// Defaults for WebhookOptions.
+const (
+	defaultWebhookBuffer  = 1024
+	defaultWebhookRetries = 3
+	defaultWebhookBackoff = 500 * time.Millisecond
+	defaultWebhookTimeout = 5 * time.Second
+)
+
+// WebhookOptions tunes a WebhookNotifier. Zero fields use defaults.
+type WebhookOptions struct {
+	// Buffer is how many events may wait to be sent; default 1024. Events
+	// arriving while it is full are dropped
+	Buffer int
+	// Retries is how many times a failed post is tried again; default 3
+	Retries int
+	// Backoff is the wait before the first retry, doubling for each one
+	// after; default 500ms
+	Backoff time.Duration
+	// Client sends the posts; defaults to one with a 5s timeout
+	Client *http.Client
+}
+
+// WebhookNotifier posts events to the webhook in the rules' webhook
+// section. Notify only queues an event; a single goroutine posts the queue,
+// retrying non-2xx responses with exponential backoff, so a slow or failing
+// receiver never holds up checks. Close sends what is queued.
+type WebhookNotifier struct {
+	client  *http.Client
+	retries int
+	backoff time.Duration
+	queue   chan delivery
+	stop    context.Context // Cancelled by Close to stop retrying
+	cancel  context.CancelFunc
+	done    chan struct{} // Closed when the sender has drained queue
+
+	closeMu sync.RWMutex // Held for reading while queueing, so Close can't close queue under Notify
+	closed  bool
+}
+
+// delivery is an event with the webhook it goes to, taken when it was
+// queued so a reload can't send it somewhere else.
+type delivery struct {
+	webhook config.WebhookConfig
+	event   Event
+}
+
+// NewWebhookNotifier starts sending the events it is given.
+func NewWebhookNotifier(opts WebhookOptions) *WebhookNotifier {
+	if opts.Buffer <= 0 {
+		opts.Buffer = defaultWebhookBuffer
+	}
+	if opts.Retries <= 0 {
+		opts.Retries = defaultWebhookRetries
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = defaultWebhookBackoff
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: defaultWebhookTimeout}
+	}
+	stop, cancel := context.WithCancel(context.Background())
+	n := &WebhookNotifier{
+		client:  opts.Client,
+		retries: opts.Retries,
+		backoff: opts.Backoff,
+		queue:   make(chan delivery, opts.Buffer),
+		stop:    stop,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	go n.run()
+	return n
+}
+
+// Notify queues event for webhook if it sends events of that kind. It
+// never blocks: when the queue is full the event is dropped and logged.
+func (n *WebhookNotifier) Notify(webhook config.WebhookConfig, event Event) {
+	if !webhook.Sends(event.Event) {
+		return
+	}
+	n.closeMu.RLock()
+	defer n.closeMu.RUnlock()
+	if n.closed {
+		return
+	}
+	select {
+	case n.queue <- delivery{webhook: webhook, event: event}:
+	default:
+		log.Printf("⚠️ Webhook queue full, dropped %s event - key: %s, endpoint: %s", event.Event, event.Key, event.Endpoint)
+	}
+}
+
+func (n *WebhookNotifier) run() {
+	defer close(n.done)
+	for d := range n.queue {
+		if err := n.deliver(d); err != nil {
+			log.Printf("❌ Webhook %s event for key %s not delivered: %v", d.event.Event, d.event.Key, err)
+		}
+	}
+}
+
+// deliver posts d, trying again after each failure up to n.retries times.
+func (n *WebhookNotifier) deliver(d delivery) error {
+	body, err := json.Marshal(d.event)
+	if err != nil {
+		return err
+	}
+	wait := n.backoff
+	for attempt := 0; ; attempt++ {
+		err = n.post(d.webhook, body)
+		if err == nil || attempt == n.retries || n.stop.Err() != nil {
+			return err
+		}
+		select {
+		case <-time.After(wait):
+		case <-n.stop.Done():
+			return fmt.Errorf("%w (shutting down)", err)
+		}
+		wait *= 2
+	}
+}
+
+func (n *WebhookNotifier) post(webhook config.WebhookConfig, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if webhook.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(webhook.Secret, body))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body) // Lets the connection be reused
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the X-Signature-256 value for body: "sha256=" and the hex
+// HMAC-SHA256 of body keyed with secret. Receivers should compare it with
+// hmac.Equal.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Close posts the queued events, each once without retries, and stops the
+// sender. Later calls do nothing.
+func (n *WebhookNotifier) Close() {
+	n.closeMu.Lock()
+	if n.closed {
+		n.closeMu.Unlock()
+		return
+	}
+	n.closed = true
+	close(n.queue)
+	n.closeMu.Unlock()
+	n.cancel()
+	<-n.done
+}
@@ -0,0 +1,144 @@
+package notifier
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AndySung320/rate-limiter/config"
+)
+
+// receiver records the bodies and signatures posted to it, failing the
+// first failures posts.
+type receiver struct {
+	mu         sync.Mutex
+	failures   int
+	attempts   int
+	bodies     [][]byte
+	signatures []string
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.attempts++
+	if r.attempts <= r.failures {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	r.bodies = append(r.bodies, body)
+	r.signatures = append(r.signatures, req.Header.Get(SignatureHeader))
+}
+
+func (r *receiver) counts() (attempts, delivered int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.attempts, len(r.bodies)
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	recv := &receiver{failures: 2}
+	server := httptest.NewServer(recv)
+	defer server.Close()
+	n := NewWebhookNotifier(WebhookOptions{Backoff: time.Millisecond})
+	webhook := config.WebhookConfig{URL: server.URL, Secret: "s3cret", Events: []string{config.EventBan}}
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	n.Notify(webhook, Event{Event: config.EventQuotaExceeded, Key: "user123", Endpoint: "/api/report", Timestamp: at})
+	n.Notify(webhook, Event{Event: config.EventBan, Key: "user123", Endpoint: "/api/upload", Timestamp: at, Metadata: map[string]any{"denials": 5}})
+	waitFor(t, func() bool { _, delivered := recv.counts(); return delivered > 0 })
+	n.Close()
+
+	attempts, delivered := recv.counts()
+	if attempts != 3 || delivered != 1 {
+		t.Fatalf("expected the ban delivered on the third attempt and the unsubscribed event skipped, got %d attempts and %d deliveries", attempts, delivered)
+	}
+	var event Event
+	if err := json.Unmarshal(recv.bodies[0], &event); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if event.Event != config.EventBan || event.Key != "user123" || event.Endpoint != "/api/upload" || !event.Timestamp.Equal(at) || event.Metadata["denials"] != float64(5) {
+		t.Errorf("expected the ban event, got %+v", event)
+	}
+	if recv.signatures[0] != Sign("s3cret", recv.bodies[0]) {
+		t.Errorf("expected the body signed with the secret, got %q", recv.signatures[0])
+	}
+}
+
+func TestWebhookNotifier_GivesUpAfterRetries(t *testing.T) {
+	recv := &receiver{failures: 100}
+	server := httptest.NewServer(recv)
+	defer server.Close()
+	n := NewWebhookNotifier(WebhookOptions{Backoff: time.Millisecond})
+
+	n.Notify(config.WebhookConfig{URL: server.URL}, Event{Event: config.EventBan, Key: "user123"})
+	waitFor(t, func() bool { attempts, _ := recv.counts(); return attempts >= 4 })
+	time.Sleep(20 * time.Millisecond) // Long enough for a fifth attempt to show up
+	n.Close()
+
+	if attempts, _ := recv.counts(); attempts != 4 {
+		t.Errorf("expected the first attempt and 3 retries, got %d attempts", attempts)
+	}
+}
+
+func TestWebhookNotifier_NeverBlocks(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { <-release }))
+	defer server.Close()
+	defer close(release)
+	n := NewWebhookNotifier(WebhookOptions{Buffer: 1})
+	webhook := config.WebhookConfig{URL: server.URL}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			n.Notify(webhook, Event{Event: config.EventBan, Key: "user123"})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected Notify to drop events rather than wait for a stuck receiver")
+	}
+}
+
+func TestWebhookNotifier_CloseSkipsRetries(t *testing.T) {
+	recv := &receiver{failures: 100}
+	server := httptest.NewServer(recv)
+	defer server.Close()
+	n := NewWebhookNotifier(WebhookOptions{Backoff: time.Hour})
+
+	n.Notify(config.WebhookConfig{URL: server.URL}, Event{Event: config.EventBan, Key: "user123"})
+	n.Notify(config.WebhookConfig{URL: server.URL}, Event{Event: config.EventBan, Key: "user456"})
+	n.Close()
+
+	if attempts, _ := recv.counts(); attempts > 2 {
+		t.Errorf("expected each queued event tried at most once on Close, got %d attempts", attempts)
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after 5s.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSign(t *testing.T) {
+	// The example from GitHub's webhook documentation
+	got := Sign("It's a Secret to Everybody", []byte("Hello, World!"))
+	if want := "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17"; got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
@@ -9,12 +9,12 @@ import (
 type RedisBucket struct {
 	key        string
 	capacity   int64
-	refillRate int64
+	refillRate float64
 	storage    *storage.RedisStorage
 	ttl        time.Duration
 }
 
-func NewRedisBucket(key string, capacity, refillRate int64, storage *storage.RedisStorage) *RedisBucket {
+func NewRedisBucket(key string, capacity int64, refillRate float64, storage *storage.RedisStorage) *RedisBucket {
 	return &RedisBucket{
 		key:        key,
 		capacity:   capacity,
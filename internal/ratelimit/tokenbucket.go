@@ -5,18 +5,22 @@ import (
 	"time"
 )
 
+// TokenBucket is a standalone in-process token bucket.
+//
+// Deprecated: use storage.MemoryTokenBucket, or storage.MemoryStorage where
+// a Storage is needed.
 type TokenBucket struct {
 	capacity   int64
-	tokens     int64
-	refillRate int64 // tokens per second
+	tokens     float64 // Fractional so slow refill rates don't lose partial tokens
+	refillRate float64 // tokens per second, may be fractional
 	lastRefill time.Time
 	mutex      sync.Mutex
 }
 
-func NewTokenBucket(capacity, refillRate int64) *TokenBucket {
+func NewTokenBucket(capacity int64, refillRate float64) *TokenBucket {
 	return &TokenBucket{
 		capacity:   capacity,
-		tokens:     capacity,
+		tokens:     float64(capacity),
 		refillRate: refillRate,
 		lastRefill: time.Now(),
 	}
@@ -27,18 +31,55 @@ func (tb *TokenBucket) Allow(cost int) (bool, int64) {
 	tb.mutex.Lock()
 	defer tb.mutex.Unlock()
 
-	now := time.Now()
-	if tb.tokens < tb.capacity {
-		delta := now.Sub(tb.lastRefill).Seconds()
-		added := int64(delta * float64(tb.refillRate))
-		if added > 0 {
-			tb.tokens = min(tb.capacity, tb.tokens+added)
-			tb.lastRefill = now
-		}
+	tb.refill()
+	if float64(cost) <= tb.tokens {
+		tb.tokens -= float64(cost)
+		return true, int64(tb.tokens)
+	}
+	return false, int64(tb.tokens)
+}
+
+// Reset refills the bucket to capacity.
+func (tb *TokenBucket) Reset() {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	tb.tokens = float64(tb.capacity)
+	tb.lastRefill = time.Now()
+}
+
+// Tokens returns the whole tokens available now, after refill.
+func (tb *TokenBucket) Tokens() int64 {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	tb.refill()
+	return int64(tb.tokens)
+}
+
+// TimeToFull returns how long until the bucket is back at capacity at the
+// current refill rate. It is zero for a full bucket and negative when the
+// bucket never refills (a zero rate).
+func (tb *TokenBucket) TimeToFull() time.Duration {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	tb.refill()
+	missing := float64(tb.capacity) - tb.tokens
+	if missing <= 0 {
+		return 0
 	}
-	if int64(cost) <= tb.tokens {
-		tb.tokens -= int64(cost)
-		return true, tb.tokens
+	if tb.refillRate <= 0 {
+		return -1
 	}
-	return false, tb.tokens
+	return time.Duration(missing / tb.refillRate * float64(time.Second))
+}
+
+// refill credits the tokens earned since the last refill. Callers must hold
+// tb.mutex.
+func (tb *TokenBucket) refill() {
+	now := time.Now()
+	delta := now.Sub(tb.lastRefill).Seconds()
+	tb.tokens = min(float64(tb.capacity), tb.tokens+delta*tb.refillRate)
+	tb.lastRefill = now
 }
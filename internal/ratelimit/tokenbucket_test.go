@@ -0,0 +1,88 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket_FractionalRefillRate(t *testing.T) {
+	// One token every five seconds; an integer rate would round this to zero
+	tb := NewTokenBucket(1, 0.2)
+
+	if allowed, _ := tb.Allow(1); !allowed {
+		t.Fatal("expected first request to be allowed")
+	}
+	if allowed, _ := tb.Allow(1); allowed {
+		t.Fatal("expected second request to be denied")
+	}
+
+	// Pretend five seconds have passed
+	tb.lastRefill = tb.lastRefill.Add(-5 * time.Second)
+
+	allowed, remaining := tb.Allow(1)
+	if !allowed {
+		t.Error("expected request to be allowed after one refill interval")
+	}
+	if remaining != 0 {
+		t.Errorf("expected 0 remaining, got %d", remaining)
+	}
+}
+
+func TestTokenBucket_KeepsFractionalRemainder(t *testing.T) {
+	tb := NewTokenBucket(100, 1)
+	tb.tokens = 0
+
+	// 100 calls 150ms apart add 15 tokens; truncating each refill would
+	// drop 0.05 tokens every seventh call and end up with 14
+	for i := 0; i < 100; i++ {
+		tb.lastRefill = tb.lastRefill.Add(-150 * time.Millisecond)
+		tb.Allow(0)
+	}
+
+	_, remaining := tb.Allow(0)
+	if remaining != 15 {
+		t.Errorf("expected 15 accumulated tokens, got %d", remaining)
+	}
+}
+
+func TestTokenBucket_IdleFullBucketDoesNotBankRefill(t *testing.T) {
+	tb := NewTokenBucket(10, 1)
+
+	// A full bucket sitting idle must not credit that time after it is drained
+	tb.lastRefill = tb.lastRefill.Add(-time.Minute)
+	if allowed, _ := tb.Allow(10); !allowed {
+		t.Fatal("expected full bucket to allow its capacity")
+	}
+	if allowed, remaining := tb.Allow(1); allowed {
+		t.Errorf("expected drained bucket to deny, got %d remaining", remaining)
+	}
+}
+
+func TestTokenBucket_ResetAndTokens(t *testing.T) {
+	tb := NewTokenBucket(10, 0.001)
+
+	tb.Allow(7)
+	if got := tb.Tokens(); got != 3 {
+		t.Errorf("expected 3 tokens, got %d", got)
+	}
+
+	tb.Reset()
+	if got := tb.Tokens(); got != 10 {
+		t.Errorf("expected 10 tokens after reset, got %d", got)
+	}
+}
+
+func TestTokenBucket_TimeToFull(t *testing.T) {
+	tb := NewTokenBucket(10, 2)
+
+	if got := tb.TimeToFull(); got != 0 {
+		t.Errorf("expected full bucket to need 0, got %v", got)
+	}
+
+	tb.Allow(10)
+	// 10 tokens at 2/s; allow a little slack for time passing during the test
+	got := tb.TimeToFull()
+	if got > 5*time.Second || got < 5*time.Second-50*time.Millisecond {
+		t.Errorf("expected ~5s to refill, got %v", got)
+	}
+}
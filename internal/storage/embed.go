@@ -0,0 +1,9 @@
+package storage
+
+import "embed"
+
+// luaFS holds the token bucket scripts so the binary does not depend on the
+// source tree being present at runtime.
+//
+//go:embed *.lua
+var luaFS embed.FS
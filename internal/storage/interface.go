@@ -2,24 +2,247 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
+// ClockFunc returns the current time. Storages compute refills from it, so
+// tests can move time forward instead of sleeping.
+type ClockFunc func() time.Time
+
+// Now returns f's time, or the wall clock's when f is nil.
+func (f ClockFunc) Now() time.Time {
+	if f == nil {
+		return time.Now()
+	}
+	return f()
+}
+
+// BucketResult is the outcome of a single atomic bucket evaluation.
+type BucketResult struct {
+	Allowed bool
+	// Remaining is the balance of the only bucket for single-bucket checks,
+	// or of the per-key (user/IP) bucket for dual checks. It is negative while
+	// a dual check's per-key bucket is in debt.
+	Remaining int64
+	// GlobalRemaining is the balance of the shared bucket for dual checks.
+	GlobalRemaining int64
+	// IPRemaining is the balance of AtomicUserIPBucket's IP bucket.
+	IPRemaining int64
+	// RetryAfter is how long until the cost becomes affordable. It is zero
+	// when the request was allowed and negative when the cost can never be
+	// paid because it exceeds a bucket's capacity.
+	RetryAfter time.Duration
+	// Resources holds the balances of AtomicMultiBucket's resource buckets,
+	// in the order they were given.
+	Resources []int64
+	// Degraded is set when a dual check fell back to checking one of its
+	// buckets under a PartialFailureMode. The other bucket's balance is 0.
+	Degraded bool
+	// Quotas holds the standing of AtomicQuotaBucket's quotas, in the order
+	// they were given.
+	Quotas []QuotaResult
+	// Reason says which bucket denied a dual check (AtomicDualBucket,
+	// AtomicInitialBucket or ReserveDualBucket). It is empty when the check
+	// was allowed.
+	Reason DenyReason
+}
+
+// DenyReason says why a check was denied.
+type DenyReason string
+
+const (
+	// DenyUserTokens means the per-key bucket (the user's, or the IP's for
+	// IP+endpoints rules) couldn't pay the cost. It is reported even when
+	// the global bucket couldn't either.
+	DenyUserTokens DenyReason = "insufficient_user_tokens"
+	// DenyGlobalTokens means only the shared bucket couldn't pay the cost.
+	DenyGlobalTokens DenyReason = "insufficient_global_tokens"
+	// DenyBlocked means the key wasn't checked at all because it is blocked,
+	// e.g. penalized with a capacity_multiplier of 0.
+	DenyBlocked DenyReason = "blocked"
+)
+
+// QuotaWindow is the period a Quota counts over.
+type QuotaWindow string
+
+const (
+	QuotaDay   QuotaWindow = "day"
+	QuotaMonth QuotaWindow = "month"
+	// QuotaFixed windows are Period long, back to back from the Unix epoch
+	QuotaFixed QuotaWindow = "fixed"
+)
+
+// Quota is a fixed-window counter charged by AtomicQuotaBucket, such as
+// 10,000 requests a day. Windows start at midnight, on the 1st for months,
+// in the time zone that is UTCOffset from UTC at the time of the check;
+// QuotaFixed windows ignore UTCOffset and start every Period.
+type Quota struct {
+	Key       string
+	Amount    int64
+	Window    QuotaWindow
+	UTCOffset time.Duration
+	Period    time.Duration // QuotaFixed only
+}
+
+// QuotaResult is what is left of a quota and when its window resets.
+type QuotaResult struct {
+	Remaining int64
+	ResetsAt  time.Time
+}
+
+// ResourceBucket is an extra per-key bucket charged by AtomicMultiBucket,
+// such as LLM tokens or spend in cents.
+type ResourceBucket struct {
+	Key        string
+	Capacity   int64
+	RefillRate float64
+	Cost       int64
+}
+
 type Storage interface {
-	AtomicTokenBucket(key string, capacity, refillRate int64, cost int64, ttl time.Duration) (bool, int64, error)
-	AtomicDualBucket(userKey, globalKey string, globalCap, globalRate, userCap, userRate int64, cost int64, ttl time.Duration) (bool, int64, int64, error)
+	AtomicTokenBucket(key string, capacity int64, refillRate float64, cost int64, ttl time.Duration) (BucketResult, error)
+	// AtomicDualBucket deducts cost from both buckets or neither. The per-key
+	// bucket may go as low as -userMaxDebt; refills pay the debt down first.
+	AtomicDualBucket(userKey, globalKey string, globalCap int64, globalRate float64, userCap int64, userRate float64, userMaxDebt, cost int64, ttl time.Duration) (BucketResult, error)
+	// AtomicUserIPBucket deducts cost from a user and an IP bucket, both or
+	// neither, with no global bucket. The user bucket may go as low as
+	// -userMaxDebt; the IP bucket never borrows.
+	AtomicUserIPBucket(userKey, ipKey string, userCap int64, userRate float64, userMaxDebt int64, ipCap int64, ipRate float64, cost int64, ttl time.Duration) (BucketResult, error)
+	// AtomicMultiBucket is AtomicDualBucket that also deducts each
+	// resource's cost from its bucket, all or nothing. Resource buckets never
+	// borrow.
+	AtomicMultiBucket(userKey, globalKey string, globalCap int64, globalRate float64, userCap int64, userRate float64, userMaxDebt, cost int64, resources []ResourceBucket, ttl time.Duration) (BucketResult, error)
+	// AtomicQuotaBucket charges cost to a token bucket and to each quota, all
+	// or nothing. With a globalKey it is AtomicDualBucket's check; with an
+	// empty one it is AtomicTokenBucket's on userKey, using userCap and
+	// userRate. Quotas never borrow.
+	AtomicQuotaBucket(userKey, globalKey string, globalCap int64, globalRate float64, userCap int64, userRate float64, userMaxDebt, cost int64, quotas []Quota, ttl time.Duration) (BucketResult, error)
+	// AtomicInitialBucket is AtomicDualBucket, or AtomicTokenBucket on
+	// userKey using userCap and userRate when globalKey is empty, except
+	// that a bucket it creates starts with userInitial or globalInitial
+	// tokens instead of its capacity, so new keys ramp up. Existing buckets
+	// are unaffected.
+	AtomicInitialBucket(userKey, globalKey string, globalCap int64, globalRate float64, globalInitial int64, userCap int64, userRate float64, userInitial int64, userMaxDebt, cost int64, ttl time.Duration) (BucketResult, error)
+	// ReserveTokenBucket and ReserveDualBucket deduct cost like their Atomic
+	// counterparts, but hold the tokens under reservation id until
+	// CommitReservation keeps them or ReleaseReservation returns them. A
+	// reservation left unsettled for hold is returned automatically the next
+	// time its buckets are checked.
+	ReserveTokenBucket(id string, hold time.Duration, key string, capacity int64, refillRate float64, cost int64, ttl time.Duration) (BucketResult, error)
+	ReserveDualBucket(id string, hold time.Duration, userKey, globalKey string, globalCap int64, globalRate float64, userCap int64, userRate float64, userMaxDebt, cost int64, ttl time.Duration) (BucketResult, error)
+	// CommitReservation and ReleaseReservation report false when the
+	// reservation was already settled or has expired, so repeats are no-ops.
+	CommitReservation(id string) (bool, error)
+	ReleaseReservation(id string) (bool, error)
+	// PenaltyStatus returns when key's penalty ends, or the zero time when the
+	// key is not penalized.
+	PenaltyStatus(key string) (time.Time, error)
+	// RecordDenial counts a denial of key. Once threshold denials fall within
+	// window the key is penalized for duration, and the penalty's end is
+	// returned; otherwise the zero time.
+	RecordDenial(key string, threshold int64, window, duration time.Duration) (time.Time, error)
+	// LookupTier returns the tier mapped to key, or "" when it has none.
+	// SetTier and DeleteTier maintain the mapping; DeleteTier reports false
+	// when key had no mapping.
+	LookupTier(key string) (string, error)
+	SetTier(key, tier string) error
+	DeleteTier(key string) (bool, error)
+	// TopUpBucket adds amount tokens to a per-key bucket of a dual check,
+	// letting the balance grow up to maxBalance (which may exceed capacity).
+	// It returns the new balance.
+	TopUpBucket(key string, capacity int64, refillRate float64, amount, maxBalance int64, ttl time.Duration) (int64, error)
+	// RefundTokens returns cost tokens to the bucket at key, e.g. when the
+	// work a check paid for failed, without taking the balance past the
+	// capacity the bucket was last checked with. A bucket that doesn't exist
+	// is already full and is left alone. The bucket's expiry is extended to
+	// ttl from now if that is later.
+	RefundTokens(key string, cost int64, ttl time.Duration) error
+	// SetBucketTokens sets key's balance to tokens, refilling from now on,
+	// and its expiry to ttl from now (zero means never). A bucket that does
+	// not exist yet takes its capacity and rate from the first check.
+	SetBucketTokens(key string, tokens int64, ttl time.Duration) error
+	// DeleteBucket deletes the bucket at key, with any reservations held on
+	// it, so it starts over at full capacity. It reports whether there was
+	// one.
+	DeleteBucket(key string) (bool, error)
+	// ResetBuckets deletes every bucket whose key matches the glob pattern,
+	// a batch at a time, reporting running totals to progress after each
+	// batch. Deleted buckets start over at full capacity.
+	ResetBuckets(ctx context.Context, pattern string, opts ResetOptions, progress func(ResetProgress)) (ResetProgress, error)
+	// PurgeKeys deletes every key matching the glob pattern in one unpaced
+	// pass, for maintenance, and returns how many were removed.
+	PurgeKeys(pattern string) (int, error)
+	// TopConsumers returns the n per-key buckets that consumed the most
+	// tokens from globalKey's bucket in the current tracking window.
+	TopConsumers(globalKey string, n int) (TopConsumersReport, error)
+	// PoolStats describes the Redis connection pool, or is zero for storage
+	// without one.
+	PoolStats() RedisPoolStats
 	Ping() error
 	Close() error
 }
 
+// BucketReader is implemented by storages that can read a bucket without
+// charging it, such as RedisStorage.
+type BucketReader interface {
+	// BucketTokens returns key's balance with the refill owed so far, and
+	// false when the bucket doesn't exist, so the next check starts it full.
+	BucketTokens(key string) (int64, bool, error)
+}
+
+// ErrTopConsumersDisabled is returned by TopConsumers when tracking is off.
+var ErrTopConsumersDisabled = errors.New("top consumers tracking is disabled")
+
+// Consumer is one per-key bucket and the tokens it consumed in a window.
+type Consumer struct {
+	Key    string `json:"key"`
+	Tokens int64  `json:"tokens"`
+}
+
+type TopConsumersReport struct {
+	WindowStart time.Time
+	Window      time.Duration
+	Consumers   []Consumer // Highest consumption first
+}
+
+// ResetOptions paces a bulk reset so it doesn't monopolise Redis.
+type ResetOptions struct {
+	BatchSize  int           // Keys scanned per batch (a SCAN COUNT hint)
+	BatchDelay time.Duration // Pause between batches
+}
+
+// ResetProgress holds a bulk reset's running totals. Matched may count a key
+// twice if it is rehashed during the scan; Deleted is exact.
+type ResetProgress struct {
+	Matched int64 `json:"matched"`
+	Deleted int64 `json:"deleted"`
+}
+
+// RedisPoolStats is a snapshot of a Redis connection pool.
+type RedisPoolStats struct {
+	Size int // Most connections the pool may open
+	Used int // Open connections in use
+	Idle int // Open connections waiting to be used
+}
+
 type RedisClient interface {
 	EvalSha(ctx context.Context, sha string, keys []string, args ...interface{}) *redis.Cmd
 	ScriptLoad(ctx context.Context, script string) *redis.StringCmd
+	Scan(ctx context.Context, cursor uint64, match string, count int64) *redis.ScanCmd
+	Unlink(ctx context.Context, keys ...string) *redis.IntCmd
+	Expire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd
+	ZRevRangeWithScores(ctx context.Context, key string, start, stop int64) *redis.ZSliceCmd
+	HGet(ctx context.Context, key, field string) *redis.StringCmd
+	HSet(ctx context.Context, key string, values ...interface{}) *redis.IntCmd
+	HDel(ctx context.Context, key string, fields ...string) *redis.IntCmd
 	Ping(ctx context.Context) *redis.StatusCmd
 	Close() error
 }
 
 var _ Storage = (*RedisStorage)(nil)
+var _ Storage = (*LocalCacheStorage)(nil)
+var _ Storage = (*MemoryStorage)(nil)
 var _ RedisClient = (*redis.Client)(nil)
@@ -0,0 +1,347 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// LocalCacheOptions tunes how far a LocalCacheStorage may drift from the
+// inner storage.
+type LocalCacheOptions struct {
+	// FlushThreshold is how many tokens a key may consume locally before the
+	// consumption is written through to the inner storage. Default 10.
+	FlushThreshold int64
+	// MaxAge is how long a cached estimate is trusted before it is synced
+	// with the inner storage regardless of consumption. Default 1s.
+	MaxAge time.Duration
+	// Clock supplies the time estimates refill from; nil means time.Now.
+	// It should match the inner storage's.
+	Clock ClockFunc
+}
+
+// LocalCacheStorage keeps an in-process estimate of each bucket in front of
+// another Storage (normally Redis) so most checks skip the round trip.
+//
+// The inner storage stays the source of truth: a cache miss or expired entry
+// always goes to it, and locally consumed tokens are written back in batches.
+// Dual checks share one estimate of each global bucket between all their
+// keys and are denied locally once it runs out, so an instance never admits
+// more from a global bucket than its last sync left, however many keys use
+// it. The trade-off is accuracy: an instance only sees other instances'
+// consumption when it syncs (at most every MaxAge). Until then each
+// instance may admit what another already took from a global bucket, and up
+// to FlushThreshold tokens per single or per-key bucket that the shared
+// bucket would have denied. Use it for hot keys where a small overshoot is
+// acceptable.
+type LocalCacheStorage struct {
+	Storage // Inner storage; methods other than the bucket checks pass straight through
+	opts    LocalCacheOptions
+	entries sync.Map // string -> *cacheEntry
+	globals sync.Map // Global key -> *globalEstimate, shared by dual checks
+
+	// Set by EnablePubSubInvalidation
+	pubsubMu  sync.Mutex
+	publisher pubSubClient
+	channel   string
+	pubsub    *redis.PubSub
+	done      chan struct{} // Closed when the subscriber goroutine exits
+}
+
+type cacheEntry struct {
+	mu         sync.Mutex
+	remaining  float64 // Estimated tokens in the single/per-key bucket
+	pending    int64   // Consumed locally, not yet written through
+	lastRefill time.Time
+	expiry     time.Time
+}
+
+// globalEstimate is the estimate of a global bucket that every dual check
+// on it consumes from, whatever its per-key bucket.
+type globalEstimate struct {
+	mu         sync.Mutex
+	remaining  float64 // Estimated tokens, less those consumed locally
+	pending    int64   // Consumed locally by any key, not yet written through
+	lastRefill time.Time
+	expiry     time.Time
+}
+
+func NewLocalCacheStorage(inner Storage, opts LocalCacheOptions) *LocalCacheStorage {
+	if opts.FlushThreshold <= 0 {
+		opts.FlushThreshold = 10
+	}
+	if opts.MaxAge <= 0 {
+		opts.MaxAge = time.Second
+	}
+	return &LocalCacheStorage{Storage: inner, opts: opts}
+}
+
+func (l *LocalCacheStorage) AtomicTokenBucket(key string, capacity int64, refillRate float64, cost int64, ttl time.Duration) (BucketResult, error) {
+	return l.check(key, "", capacity, refillRate, 0, 0, cost, func(c int64) (BucketResult, error) {
+		return l.Storage.AtomicTokenBucket(key, capacity, refillRate, c, ttl)
+	})
+}
+
+func (l *LocalCacheStorage) AtomicDualBucket(userKey, globalKey string, globalCap int64, globalRate float64, userCap int64, userRate float64, userMaxDebt, cost int64, ttl time.Duration) (BucketResult, error) {
+	return l.check(userKey+"|"+globalKey, globalKey, userCap, userRate, globalCap, globalRate, cost, func(c int64) (BucketResult, error) {
+		return l.Storage.AtomicDualBucket(userKey, globalKey, globalCap, globalRate, userCap, userRate, userMaxDebt, c, ttl)
+	})
+}
+
+// Invalidate drops the cached estimate for a bucket key (single-bucket key,
+// global key, or "userKey|globalKey" for dual checks) without flushing it.
+func (l *LocalCacheStorage) Invalidate(key string) {
+	l.entries.Delete(key)
+	l.globals.Delete(key)
+}
+
+// evict drops the cached estimate of every check on bucket key, alone or as
+// either half of a dual check, without flushing it.
+func (l *LocalCacheStorage) evict(key string) {
+	l.entries.Delete(key)
+	l.globals.Delete(key)
+	l.entries.Range(func(cacheKey, _ any) bool {
+		if userKey, globalKey, ok := strings.Cut(cacheKey.(string), "|"); ok && (userKey == key || globalKey == key) {
+			l.entries.Delete(cacheKey)
+		}
+		return true
+	})
+}
+
+// EnablePubSubInvalidation subscribes to channel on the inner storage, which
+// must be a *RedisStorage, and evicts every bucket key published to it, as
+// PublishInvalidation does, so instances that share Redis stop serving
+// estimates of a bucket another instance deleted. The subscription is in
+// place when it returns and lasts until Close.
+func (l *LocalCacheStorage) EnablePubSubInvalidation(channel string) error {
+	inner, ok := l.Storage.(*RedisStorage)
+	if !ok {
+		return errors.New("pub/sub invalidation needs Redis storage")
+	}
+	client, ok := inner.client.(pubSubClient)
+	if !ok {
+		return errors.New("redis client does not support pub/sub")
+	}
+	l.pubsubMu.Lock()
+	defer l.pubsubMu.Unlock()
+	if l.pubsub != nil {
+		return fmt.Errorf("already invalidating on channel %s", l.channel)
+	}
+	pubsub := client.Subscribe(inner.ctx, channel)
+	// Wait for the confirmation so no invalidation published after this
+	// returns is missed
+	if _, err := pubsub.Receive(inner.ctx); err != nil {
+		pubsub.Close()
+		return fmt.Errorf("subscribing to %s: %w", channel, err)
+	}
+	l.publisher, l.channel, l.pubsub, l.done = client, channel, pubsub, make(chan struct{})
+	go func(messages <-chan *redis.Message, done chan struct{}) {
+		defer close(done)
+		for msg := range messages {
+			l.evict(msg.Payload)
+		}
+	}(pubsub.Channel(), l.done)
+	return nil
+}
+
+// PublishInvalidation evicts bucket key here and, once
+// EnablePubSubInvalidation is on, tells every instance to evict it too.
+// Call it after changing the bucket in the inner storage.
+func (l *LocalCacheStorage) PublishInvalidation(key string) error {
+	l.evict(key)
+	l.pubsubMu.Lock()
+	publisher, channel := l.publisher, l.channel
+	l.pubsubMu.Unlock()
+	if publisher == nil {
+		return nil
+	}
+	if err := publisher.Publish(context.Background(), channel, key).Err(); err != nil {
+		return fmt.Errorf("publishing invalidation of %s: %w", key, err)
+	}
+	return nil
+}
+
+// Close stops any pub/sub invalidation, waiting for its subscriber to exit,
+// then closes the inner storage.
+func (l *LocalCacheStorage) Close() error {
+	l.pubsubMu.Lock()
+	pubsub, done := l.pubsub, l.done
+	l.publisher, l.pubsub = nil, nil
+	l.pubsubMu.Unlock()
+	if pubsub != nil {
+		// Closing the subscription closes its message channel
+		pubsub.Close()
+		<-done
+	}
+	return l.Storage.Close()
+}
+
+// DeleteBucket deletes the bucket in the inner storage and drops the cached
+// estimates that use it. Other instances keep theirs until told with
+// PublishInvalidation.
+func (l *LocalCacheStorage) DeleteBucket(key string) (bool, error) {
+	l.evict(key)
+	deleted, err := l.Storage.DeleteBucket(key)
+	l.evict(key)
+	return deleted, err
+}
+
+// ResetBuckets resets matching buckets in the inner storage and drops every
+// cached estimate so this instance stops serving and flushing stale balances.
+func (l *LocalCacheStorage) ResetBuckets(ctx context.Context, pattern string, opts ResetOptions, progress func(ResetProgress)) (ResetProgress, error) {
+	l.clear()
+	total, err := l.Storage.ResetBuckets(ctx, pattern, opts, progress)
+	l.clear()
+	return total, err
+}
+
+// SetBucketTokens sets the balance in the inner storage and drops every
+// cached estimate, since dual estimates are cached under both keys together.
+func (l *LocalCacheStorage) SetBucketTokens(key string, tokens int64, ttl time.Duration) error {
+	l.clear()
+	err := l.Storage.SetBucketTokens(key, tokens, ttl)
+	l.clear()
+	return err
+}
+
+// PurgeKeys purges matching keys in the inner storage and drops every cached
+// estimate, like ResetBuckets.
+func (l *LocalCacheStorage) PurgeKeys(pattern string) (int, error) {
+	l.clear()
+	deleted, err := l.Storage.PurgeKeys(pattern)
+	l.clear()
+	return deleted, err
+}
+
+// clear drops every cached estimate without flushing it.
+func (l *LocalCacheStorage) clear() {
+	l.entries.Clear()
+	l.globals.Clear()
+}
+
+func (l *LocalCacheStorage) check(cacheKey, globalKey string, capacity int64, rate float64, globalCap int64, globalRate float64, cost int64, consume func(int64) (BucketResult, error)) (BucketResult, error) {
+	value, _ := l.entries.LoadOrStore(cacheKey, &cacheEntry{})
+	entry := value.(*cacheEntry)
+	var global *globalEstimate // Nil for single-bucket checks
+	if globalKey != "" {
+		value, _ := l.globals.LoadOrStore(globalKey, &globalEstimate{})
+		global = value.(*globalEstimate)
+	}
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	now := l.opts.Clock.Now()
+	if !entry.expiry.IsZero() && now.Before(entry.expiry) {
+		elapsed := now.Sub(entry.lastRefill).Seconds()
+		entry.remaining = min(float64(capacity), entry.remaining+elapsed*rate)
+		entry.lastRefill = now
+
+		if float64(cost) <= entry.remaining {
+			taken, globalRemaining, fresh := global.take(now, globalCap, globalRate, cost)
+			if taken {
+				entry.remaining -= float64(cost)
+				entry.pending += cost
+				result := BucketResult{Allowed: true, Remaining: int64(entry.remaining), GlobalRemaining: int64(globalRemaining)}
+				if entry.pending >= l.opts.FlushThreshold {
+					l.flush(entry, global, consume)
+				}
+				return result, nil
+			}
+			// The inner storage hasn't seen what other keys consumed locally,
+			// so only the shared estimate can tell the global bucket is empty
+			if fresh {
+				result := BucketResult{Remaining: int64(entry.remaining), GlobalRemaining: int64(globalRemaining), Reason: DenyGlobalTokens}
+				if globalRate > 0 {
+					result.RetryAfter = time.Duration((float64(cost) - globalRemaining) / globalRate * float64(time.Second))
+				}
+				return result, nil
+			}
+		}
+	}
+
+	// Miss, expiry or local estimate exhausted: ask the source of truth
+	l.flush(entry, global, consume)
+	result, err := consume(cost)
+	if err != nil {
+		entry.expiry = time.Time{}
+		return result, err
+	}
+	l.sync(entry, global, result, now)
+	return result, nil
+}
+
+// flush writes locally consumed tokens through to the inner storage. If the
+// shared bucket can no longer cover them the overshoot is dropped; the fresh
+// balance still resyncs the estimate.
+func (l *LocalCacheStorage) flush(entry *cacheEntry, global *globalEstimate, consume func(int64) (BucketResult, error)) {
+	if entry.pending == 0 {
+		return
+	}
+	flushed := entry.pending
+	result, err := consume(flushed)
+	entry.pending = 0
+	global.written(flushed)
+	if err != nil {
+		entry.expiry = time.Time{}
+		return
+	}
+	l.sync(entry, global, result, l.opts.Clock.Now())
+}
+
+func (l *LocalCacheStorage) sync(entry *cacheEntry, global *globalEstimate, result BucketResult, now time.Time) {
+	entry.remaining = float64(result.Remaining)
+	entry.lastRefill = now
+	entry.expiry = now.Add(l.opts.MaxAge)
+	global.sync(result.GlobalRemaining, now, l.opts.MaxAge)
+}
+
+// take consumes cost from the estimate if it is fresh and can cover it,
+// returning what is left either way. A nil estimate, for single-bucket
+// checks, always can.
+func (g *globalEstimate) take(now time.Time, capacity int64, rate float64, cost int64) (taken bool, remaining float64, fresh bool) {
+	if g == nil {
+		return true, 0, true
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.expiry.IsZero() || !now.Before(g.expiry) {
+		return false, 0, false
+	}
+	g.remaining = min(float64(capacity), g.remaining+now.Sub(g.lastRefill).Seconds()*rate)
+	g.lastRefill = now
+	if float64(cost) > g.remaining {
+		return false, g.remaining, true
+	}
+	g.remaining -= float64(cost)
+	g.pending += cost
+	return true, g.remaining, true
+}
+
+// written records tokens a key has written through, successfully or not.
+func (g *globalEstimate) written(tokens int64) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	// An estimate replaced by an eviction never saw the tokens
+	g.pending = max(0, g.pending-tokens)
+}
+
+// sync resets the estimate to the inner storage's balance, less what other
+// keys have consumed locally and not yet written through.
+func (g *globalEstimate) sync(remaining int64, now time.Time, maxAge time.Duration) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.remaining = float64(remaining - g.pending)
+	g.lastRefill = now
+	g.expiry = now.Add(maxAge)
+}
@@ -0,0 +1,366 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingStorage is a minimal in-memory bucket that counts round trips and
+// can simulate network latency. Methods the cache never calls are left to
+// the nil embedded Storage.
+type countingStorage struct {
+	Storage
+	mu      sync.Mutex
+	tokens  map[string]float64
+	calls   atomic.Int64
+	latency time.Duration
+	err     error
+}
+
+func newCountingStorage(latency time.Duration) *countingStorage {
+	return &countingStorage{tokens: map[string]float64{}, latency: latency}
+}
+
+func (s *countingStorage) take(key string, capacity int64, cost int64) (bool, int64) {
+	tokens, ok := s.tokens[key]
+	if !ok {
+		tokens = float64(capacity)
+	}
+	allowed := float64(cost) <= tokens
+	if allowed {
+		tokens -= float64(cost)
+	}
+	s.tokens[key] = tokens
+	return allowed, int64(tokens)
+}
+
+func (s *countingStorage) AtomicTokenBucket(key string, capacity int64, refillRate float64, cost int64, ttl time.Duration) (BucketResult, error) {
+	s.calls.Add(1)
+	time.Sleep(s.latency)
+	if s.err != nil {
+		return BucketResult{}, s.err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	allowed, remaining := s.take(key, capacity, cost)
+	return BucketResult{Allowed: allowed, Remaining: remaining}, nil
+}
+
+func (s *countingStorage) AtomicDualBucket(userKey, globalKey string, globalCap int64, globalRate float64, userCap int64, userRate float64, userMaxDebt, cost int64, ttl time.Duration) (BucketResult, error) {
+	s.calls.Add(1)
+	time.Sleep(s.latency)
+	if s.err != nil {
+		return BucketResult{}, s.err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.tokens[userKey]
+	if !ok {
+		user = float64(userCap)
+	}
+	global, ok := s.tokens[globalKey]
+	if !ok {
+		global = float64(globalCap)
+	}
+	allowed := float64(cost) <= user && float64(cost) <= global
+	if allowed {
+		user -= float64(cost)
+		global -= float64(cost)
+	}
+	s.tokens[userKey], s.tokens[globalKey] = user, global
+	return BucketResult{Allowed: allowed, Remaining: int64(user), GlobalRemaining: int64(global)}, nil
+}
+
+func (s *countingStorage) ResetBuckets(ctx context.Context, pattern string, opts ResetOptions, progress func(ResetProgress)) (ResetProgress, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deleted := int64(len(s.tokens))
+	s.tokens = map[string]float64{}
+	return ResetProgress{Matched: deleted, Deleted: deleted}, nil
+}
+
+func (s *countingStorage) PurgeKeys(pattern string) (int, error) {
+	total, err := s.ResetBuckets(context.Background(), pattern, ResetOptions{}, nil)
+	return int(total.Deleted), err
+}
+
+func (s *countingStorage) Ping() error  { return nil }
+func (s *countingStorage) Close() error { return nil }
+
+func TestLocalCacheStorage_BatchesRoundTrips(t *testing.T) {
+	inner := newCountingStorage(0)
+	cache := NewLocalCacheStorage(inner, LocalCacheOptions{FlushThreshold: 10, MaxAge: time.Minute})
+
+	for i := 0; i < 100; i++ {
+		result, err := cache.AtomicTokenBucket("hot", 1000, 0, 1, time.Minute)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !result.Allowed {
+			t.Fatalf("request %d unexpectedly denied", i)
+		}
+	}
+
+	// One miss, then one flush per 10 locally consumed tokens
+	if calls := inner.calls.Load(); calls > 11 {
+		t.Errorf("expected at most 11 inner calls, got %d", calls)
+	}
+	// The miss consumed 1, nine flushes wrote 90 and 9 tokens are still pending
+	if got := inner.tokens["hot"]; got != 909 {
+		t.Errorf("expected inner bucket to hold 909 tokens after flushes, got %v", got)
+	}
+}
+
+func TestLocalCacheStorage_DeniesFromSourceOfTruth(t *testing.T) {
+	inner := newCountingStorage(0)
+	cache := NewLocalCacheStorage(inner, LocalCacheOptions{FlushThreshold: 100, MaxAge: time.Minute})
+
+	allowed := 0
+	for i := 0; i < 8; i++ {
+		result, err := cache.AtomicTokenBucket("small", 5, 0, 1, time.Minute)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if result.Allowed {
+			allowed++
+		}
+	}
+
+	if allowed != 5 {
+		t.Errorf("expected exactly 5 allowed requests, got %d", allowed)
+	}
+	if got := inner.tokens["small"]; got != 0 {
+		t.Errorf("expected pending tokens to be flushed before denying, got %v left", got)
+	}
+}
+
+func TestLocalCacheStorage_ResyncsOnExpiry(t *testing.T) {
+	inner := newCountingStorage(0)
+	cache := NewLocalCacheStorage(inner, LocalCacheOptions{FlushThreshold: 100, MaxAge: 10 * time.Millisecond})
+
+	cache.AtomicTokenBucket("k", 100, 0, 1, time.Minute)
+	cache.AtomicTokenBucket("k", 100, 0, 1, time.Minute)
+	if calls := inner.calls.Load(); calls != 1 {
+		t.Fatalf("expected second check to be served locally, got %d inner calls", calls)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	cache.AtomicTokenBucket("k", 100, 0, 1, time.Minute)
+
+	// Expired entry flushes its pending token, then re-checks against the inner storage
+	if calls := inner.calls.Load(); calls != 3 {
+		t.Errorf("expected 3 inner calls after expiry, got %d", calls)
+	}
+	if got := inner.tokens["k"]; got != 97 {
+		t.Errorf("expected 97 tokens in inner bucket, got %v", got)
+	}
+}
+
+func TestLocalCacheStorage_DualBucket(t *testing.T) {
+	inner := newCountingStorage(0)
+	cache := NewLocalCacheStorage(inner, LocalCacheOptions{FlushThreshold: 10, MaxAge: time.Minute})
+
+	var result BucketResult
+	for i := 0; i < 5; i++ {
+		var err error
+		result, err = cache.AtomicDualBucket("user:a", "global:/x", 3, 0, 100, 0, 0, 1, time.Minute)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// The global bucket only holds 3 tokens, so the local estimate must deny
+	if result.Allowed {
+		t.Error("expected global bucket exhaustion to deny")
+	}
+	if result.GlobalRemaining != 0 {
+		t.Errorf("expected global remaining 0, got %d", result.GlobalRemaining)
+	}
+}
+
+func TestLocalCacheStorage_DualBucketSharesGlobalEstimate(t *testing.T) {
+	inner := newCountingStorage(0)
+	cache := NewLocalCacheStorage(inner, LocalCacheOptions{FlushThreshold: 100, MaxAge: time.Hour})
+
+	// Four keys share a 15 token global bucket; each key's local spending
+	// must come out of the same estimate, so together they get 15
+	allowed := 0
+	for i := 0; i < 40; i++ {
+		userKey := fmt.Sprintf("user:%d", i%4)
+		result, err := cache.AtomicDualBucket(userKey, "global:/x", 15, 0, 100, 0, 0, 1, time.Hour)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if result.Allowed {
+			allowed++
+		}
+	}
+	if allowed != 15 {
+		t.Errorf("expected the keys to share 15 global tokens, got %d allowed", allowed)
+	}
+}
+
+func TestLocalCacheStorage_InnerError(t *testing.T) {
+	inner := newCountingStorage(0)
+	inner.err = errors.New("redis down")
+	cache := NewLocalCacheStorage(inner, LocalCacheOptions{})
+
+	if _, err := cache.AtomicTokenBucket("k", 10, 1, 1, time.Minute); err == nil {
+		t.Fatal("expected inner error to propagate")
+	}
+
+	// A failed miss must not leave a trusted entry behind
+	inner.err = nil
+	cache.AtomicTokenBucket("k", 10, 1, 1, time.Minute)
+	if calls := inner.calls.Load(); calls != 2 {
+		t.Errorf("expected retry to reach inner storage, got %d calls", calls)
+	}
+}
+
+func TestLocalCacheStorage_ResetDropsEstimates(t *testing.T) {
+	inner := newCountingStorage(0)
+	cache := NewLocalCacheStorage(inner, LocalCacheOptions{FlushThreshold: 100, MaxAge: time.Minute})
+
+	for i := 0; i < 5; i++ {
+		cache.AtomicTokenBucket("k", 5, 0, 1, time.Minute)
+	}
+	if _, err := cache.ResetBuckets(context.Background(), "*", ResetOptions{}, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Without dropping the estimate this would be denied locally
+	result, _ := cache.AtomicTokenBucket("k", 5, 0, 1, time.Minute)
+	if !result.Allowed || result.Remaining != 4 {
+		t.Errorf("expected reset bucket to allow with 4 remaining, got %+v", result)
+	}
+}
+
+func TestLocalCacheStorage_PurgeDropsEstimates(t *testing.T) {
+	inner := newCountingStorage(0)
+	cache := NewLocalCacheStorage(inner, LocalCacheOptions{FlushThreshold: 100, MaxAge: time.Minute})
+
+	for i := 0; i < 5; i++ {
+		cache.AtomicTokenBucket("k", 5, 0, 1, time.Minute)
+	}
+	if _, err := cache.PurgeKeys("*"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	result, _ := cache.AtomicTokenBucket("k", 5, 0, 1, time.Minute)
+	if !result.Allowed || result.Remaining != 4 {
+		t.Errorf("expected purged bucket to allow with 4 remaining, got %+v", result)
+	}
+}
+
+func TestLocalCacheStorage_PubSubInvalidation(t *testing.T) {
+	first, server := newMiniredisStorage(t)
+	second, err := NewRedisStorageWithOptions(server.Addr(), "", 0, DefaultRedisOptions())
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+	opts := LocalCacheOptions{FlushThreshold: 100, MaxAge: time.Minute}
+	a, b := NewLocalCacheStorage(first, opts), NewLocalCacheStorage(second, opts)
+	for _, cache := range []*LocalCacheStorage{a, b} {
+		if err := cache.EnablePubSubInvalidation("rate_limit:invalidate"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := a.EnablePubSubInvalidation("rate_limit:invalidate"); err == nil {
+		t.Error("expected a second subscription to be refused")
+	}
+
+	for i := 0; i < 5; i++ {
+		b.AtomicDualBucket("user:a", "global:/x", 100, 0, 5, 0, 0, 1, time.Minute)
+	}
+	if result, _ := b.AtomicDualBucket("user:a", "global:/x", 100, 0, 5, 0, 0, 1, time.Minute); result.Allowed {
+		t.Fatalf("expected the local estimate to deny, got %+v", result)
+	}
+
+	// Deleting on one instance evicts the estimate on the other
+	a.DeleteBucket("user:a")
+	start := time.Now()
+	if err := a.PublishInvalidation("user:a"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for {
+		if _, ok := b.entries.Load("user:a|global:/x"); !ok {
+			break
+		}
+		if time.Since(start) > 50*time.Millisecond {
+			t.Fatal("expected the invalidation to reach the other instance within 50ms")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if result, _ := b.AtomicDualBucket("user:a", "global:/x", 100, 0, 5, 0, 0, 1, time.Minute); !result.Allowed || result.Remaining != 4 {
+		t.Errorf("expected the deleted bucket to start full, got %+v", result)
+	}
+
+	// Close stops the subscriber and closes the inner storage
+	if err := b.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := second.Ping(); err == nil {
+		t.Error("expected the inner storage to be closed")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for server.PubSubNumSub("rate_limit:invalidate")["rate_limit:invalidate"] != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected only the open instance to stay subscribed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLocalCacheStorage_PubSubNeedsRedis(t *testing.T) {
+	cache := NewLocalCacheStorage(newCountingStorage(0), LocalCacheOptions{})
+	if err := cache.EnablePubSubInvalidation("rate_limit:invalidate"); err == nil {
+		t.Error("expected storage other than Redis to be refused")
+	}
+	// Without a subscription, publishing only evicts locally
+	if err := cache.PublishInvalidation("k"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// The benchmarks compare checking a hot key against miniredis directly with
+// going through the cache in front of it. With the default threshold of 10
+// the cached path runs the Lua script for roughly one check in ten, so it
+// should manage at least 5x the checks per second; a real Redis, with a
+// network round trip per script, widens the gap further.
+func benchmarkLocalCache(b *testing.B, run func(b *testing.B, s Storage)) {
+	redisStorage, _ := newMiniredisStorage(b)
+	for _, bench := range []struct {
+		name    string
+		storage Storage
+	}{{"direct", redisStorage}, {"cached", NewLocalCacheStorage(redisStorage, LocalCacheOptions{})}} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			run(b, bench.storage)
+		})
+	}
+}
+
+func BenchmarkLocalCacheStorage_SingleKey(b *testing.B) {
+	benchmarkLocalCache(b, func(b *testing.B, s Storage) {
+		for i := 0; i < b.N; i++ {
+			if _, err := s.AtomicTokenBucket("endpoint:/api/bench", 1<<40, 1e9, 1, time.Hour); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkLocalCacheStorage_DualBucket(b *testing.B) {
+	benchmarkLocalCache(b, func(b *testing.B, s Storage) {
+		for i := 0; i < b.N; i++ {
+			if _, err := s.AtomicDualBucket("user:alice:/api/bench:free", "global:/api/bench", 1<<40, 1e9, 1<<40, 1e9, 0, 1, time.Hour); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lruMap is a mutex-guarded map that remembers the order its keys were last
+// used in. With a positive capacity, adding a key to a full map evicts the
+// least recently used one and passes it to onEvict. Callbacks and Range's
+// function run without the map's lock held, so they may use the map.
+type lruMap[K comparable, V comparable] struct {
+	mu       sync.Mutex
+	capacity int // 0 means unbounded
+	items    map[K]*list.Element
+	order    *list.List // Of *lruEntry, most recently used first
+	onEvict  func(K, V)
+}
+
+type lruEntry[K comparable, V comparable] struct {
+	key   K
+	value V
+}
+
+func newLRUMap[K comparable, V comparable](capacity int, onEvict func(K, V)) *lruMap[K, V] {
+	return &lruMap[K, V]{
+		capacity: capacity,
+		items:    make(map[K]*list.Element),
+		order:    list.New(),
+		onEvict:  onEvict,
+	}
+}
+
+// Load returns key's value and marks it most recently used.
+func (l *lruMap[K, V]) Load(key K) (V, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	elem, ok := l.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	l.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry[K, V]).value, true
+}
+
+// LoadOrStore returns key's value if present, otherwise stores value. Either
+// way key becomes the most recently used.
+func (l *lruMap[K, V]) LoadOrStore(key K, value V) (actual V, loaded bool) {
+	l.mu.Lock()
+	if elem, ok := l.items[key]; ok {
+		l.order.MoveToFront(elem)
+		actual = elem.Value.(*lruEntry[K, V]).value
+		l.mu.Unlock()
+		return actual, true
+	}
+	evicted := l.insert(key, value)
+	l.mu.Unlock()
+	l.evicted(evicted)
+	return value, false
+}
+
+// Swap stores value for key and returns the previous value, if any.
+func (l *lruMap[K, V]) Swap(key K, value V) (previous V, loaded bool) {
+	l.mu.Lock()
+	if elem, ok := l.items[key]; ok {
+		entry := elem.Value.(*lruEntry[K, V])
+		previous, entry.value = entry.value, value
+		l.order.MoveToFront(elem)
+		l.mu.Unlock()
+		return previous, true
+	}
+	evicted := l.insert(key, value)
+	l.mu.Unlock()
+	l.evicted(evicted)
+	return previous, false
+}
+
+// CompareAndDelete deletes key if its value is still old.
+func (l *lruMap[K, V]) CompareAndDelete(key K, old V) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	elem, ok := l.items[key]
+	if !ok || elem.Value.(*lruEntry[K, V]).value != old {
+		return false
+	}
+	l.order.Remove(elem)
+	delete(l.items, key)
+	return true
+}
+
+// Range calls fn for a snapshot of the entries, most recently used first,
+// until fn returns false. It does not change the usage order.
+func (l *lruMap[K, V]) Range(fn func(K, V) bool) {
+	l.mu.Lock()
+	entries := make([]lruEntry[K, V], 0, len(l.items))
+	for elem := l.order.Front(); elem != nil; elem = elem.Next() {
+		entries = append(entries, *elem.Value.(*lruEntry[K, V]))
+	}
+	l.mu.Unlock()
+	for _, entry := range entries {
+		if !fn(entry.key, entry.value) {
+			return
+		}
+	}
+}
+
+func (l *lruMap[K, V]) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.items)
+}
+
+// insert adds a new key, evicting the least recently used entry first when
+// the map is full. Callers must hold l.mu and pass the result to evicted.
+func (l *lruMap[K, V]) insert(key K, value V) []lruEntry[K, V] {
+	var evicted []lruEntry[K, V]
+	for l.capacity > 0 && len(l.items) >= l.capacity {
+		oldest := l.order.Back()
+		entry := oldest.Value.(*lruEntry[K, V])
+		l.order.Remove(oldest)
+		delete(l.items, entry.key)
+		evicted = append(evicted, *entry)
+	}
+	l.items[key] = l.order.PushFront(&lruEntry[K, V]{key: key, value: value})
+	return evicted
+}
+
+// evicted reports evicted entries to onEvict. Callers must not hold l.mu.
+func (l *lruMap[K, V]) evicted(entries []lruEntry[K, V]) {
+	if l.onEvict == nil {
+		return
+	}
+	for _, entry := range entries {
+		l.onEvict(entry.key, entry.value)
+	}
+}
@@ -0,0 +1,53 @@
+package storage
+
+import "testing"
+
+func TestLRUMap_EvictsLeastRecentlyUsed(t *testing.T) {
+	var evicted []string
+	m := newLRUMap(2, func(key string, _ int) { evicted = append(evicted, key) })
+
+	m.LoadOrStore("a", 1)
+	m.LoadOrStore("b", 2)
+	m.Load("a") // b is now the least recently used
+	m.LoadOrStore("c", 3)
+
+	if len(evicted) != 1 || evicted[0] != "b" {
+		t.Fatalf("expected b evicted, got %v", evicted)
+	}
+	if _, ok := m.Load("a"); !ok {
+		t.Error("expected recently used a to survive")
+	}
+	if m.Len() != 2 {
+		t.Errorf("expected 2 entries, got %d", m.Len())
+	}
+
+	// Swapping an existing key replaces it without evicting
+	if previous, loaded := m.Swap("c", 30); !loaded || previous != 3 {
+		t.Errorf("expected previous value 3, got %d (loaded %v)", previous, loaded)
+	}
+	if len(evicted) != 1 {
+		t.Errorf("expected no eviction on swap, got %v", evicted)
+	}
+
+	if m.CompareAndDelete("a", 99) {
+		t.Error("expected delete with a stale value to fail")
+	}
+	if !m.CompareAndDelete("a", 1) || m.Len() != 1 {
+		t.Error("expected a to be deleted")
+	}
+}
+
+func TestLRUMap_Unbounded(t *testing.T) {
+	m := newLRUMap[string, int](0, func(string, int) { t.Fatal("unexpected eviction") })
+	for i, key := range []string{"a", "b", "c", "d"} {
+		m.LoadOrStore(key, i)
+	}
+	var keys []string
+	m.Range(func(key string, _ int) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if len(keys) != 4 || keys[0] != "d" {
+		t.Errorf("expected all 4 keys, most recent first, got %v", keys)
+	}
+}
@@ -0,0 +1,1028 @@
+package storage
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MemoryTokenBucket is an in-process token bucket with the same semantics as
+// the Redis scripts: tokens are fractional so slow refills accumulate, only
+// whole tokens pay for a request, and a balance above capacity (a top-up) or
+// below zero (debt) is kept until spent or paid down by refills.
+type MemoryTokenBucket struct {
+	mu         sync.Mutex
+	capacity   int64
+	refillRate float64 // Tokens per second, may be fractional
+	tokens     float64
+	lastRefill time.Time
+	expiry     time.Time // Zero means never; an expired bucket starts over full
+	held       []heldTokens
+	deleted    atomic.Bool // Removed from its MemoryStorage; callers must look it up again
+}
+
+// heldTokens are tokens deducted under a reservation that is not settled yet.
+type heldTokens struct {
+	id      string
+	cost    int64
+	expires time.Time
+}
+
+func NewMemoryTokenBucket(capacity int64, refillRate float64) *MemoryTokenBucket {
+	return &MemoryTokenBucket{
+		capacity:   capacity,
+		refillRate: refillRate,
+		tokens:     float64(capacity),
+		lastRefill: time.Now(),
+	}
+}
+
+// Allow deducts cost when the bucket can pay it.
+func (b *MemoryTokenBucket) Allow(cost int64) BucketResult {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.settle(now)
+	allowed := b.affords(cost, 0)
+	if allowed {
+		b.tokens -= float64(cost)
+	}
+	return BucketResult{Allowed: allowed, Remaining: b.remaining(), RetryAfter: b.retryAfter(allowed, cost, 0)}
+}
+
+// Refill credits the tokens earned since the last refill, capped at capacity.
+func (b *MemoryTokenBucket) Refill() {
+	b.refill(time.Now())
+}
+
+func (b *MemoryTokenBucket) refill(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.settle(now)
+}
+
+// Tokens returns the whole tokens available now, after refill.
+func (b *MemoryTokenBucket) Tokens() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.settle(time.Now())
+	return b.remaining()
+}
+
+// configure applies the capacity and rate of the current check, starting
+// the bucket over when it has expired. A capacity that shrank, e.g. at the
+// end of a schedule, clamps the balance to it rather than resetting it; only
+// what a top-up added above the old capacity is kept on top. Callers must
+// hold b.mu.
+func (b *MemoryTokenBucket) configure(capacity int64, refillRate float64, now time.Time) {
+	if !b.expiry.IsZero() && !now.Before(b.expiry) {
+		b.tokens = float64(capacity)
+		b.lastRefill = now
+		b.held = nil
+	}
+	if capacity < b.capacity && b.tokens > float64(capacity) {
+		b.tokens = float64(capacity) + math.Max(0, b.tokens-float64(b.capacity))
+	}
+	b.capacity = capacity
+	b.refillRate = refillRate
+}
+
+// settle credits the refill earned since the last one and returns tokens
+// held by reservations that expired unsettled. Callers must hold b.mu.
+func (b *MemoryTokenBucket) settle(now time.Time) {
+	if now.After(b.lastRefill) {
+		if b.tokens < float64(b.capacity) {
+			b.tokens = math.Min(float64(b.capacity), b.tokens+now.Sub(b.lastRefill).Seconds()*b.refillRate)
+		}
+		b.lastRefill = now
+	}
+	kept := b.held[:0]
+	for _, h := range b.held {
+		if now.Before(h.expires) {
+			kept = append(kept, h)
+			continue
+		}
+		b.refund(h.cost)
+	}
+	b.held = kept
+}
+
+// refund returns cost tokens without pushing the balance past capacity, or
+// lowering one that is already above it. Callers must hold b.mu.
+func (b *MemoryTokenBucket) refund(cost int64) {
+	b.tokens = math.Max(b.tokens, math.Min(float64(b.capacity), b.tokens+float64(cost)))
+}
+
+// affords reports whether whole tokens, plus up to maxDebt borrowed ones,
+// cover cost. Callers must hold b.mu.
+func (b *MemoryTokenBucket) affords(cost, maxDebt int64) bool {
+	return cost <= int64(math.Floor(b.tokens))+maxDebt
+}
+
+func (b *MemoryTokenBucket) remaining() int64 {
+	return int64(math.Floor(b.tokens))
+}
+
+// retryAfter is how long until cost becomes affordable: zero when allowed,
+// -1ms when it exceeds what the bucket can ever hold. Callers must hold b.mu.
+func (b *MemoryTokenBucket) retryAfter(allowed bool, cost, maxDebt int64) time.Duration {
+	if allowed {
+		return 0
+	}
+	if cost > b.capacity+maxDebt {
+		return -time.Millisecond
+	}
+	wait := math.Max(0, (float64(cost-maxDebt)-b.tokens)*1000/b.refillRate)
+	return time.Duration(math.Ceil(wait)) * time.Millisecond
+}
+
+// hold records cost as reserved under id until expires. Callers must hold b.mu.
+func (b *MemoryTokenBucket) hold(id string, cost int64, expires time.Time) {
+	b.held = append(b.held, heldTokens{id: id, cost: cost, expires: expires})
+	if b.expiry.Before(expires) {
+		b.expiry = expires
+	}
+}
+
+// unhold drops id's reservation, reporting whether it was still held.
+// Callers must hold b.mu.
+func (b *MemoryTokenBucket) unhold(id string) bool {
+	for i, h := range b.held {
+		if h.id == id {
+			b.held = append(b.held[:i], b.held[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// MemoryStorage implements Storage in process memory for tests, local
+// development and single-instance deployments. State is not shared between
+// instances and is lost on restart unless saved with PersistToFile.
+type MemoryStorage struct {
+	buckets   *lruMap[string, *MemoryTokenBucket]
+	lastSweep time.Time
+	sweepMu   sync.Mutex // Guards lastSweep; held while sweeping
+
+	mu           sync.Mutex // Guards the maps below
+	reservations map[string]memoryReservation
+	penalties    map[string]time.Time // Key -> penalty end
+	denials      map[string]denialCount
+	tiers        map[string]string
+	quotas       map[string]memoryQuota
+	top          map[string]*topWindow // Global key -> consumption in the current window
+	topWindow    time.Duration
+	clock        ClockFunc // Nil means time.Now
+
+	stopRefill context.CancelFunc // Stops the eager refill loop; nil without one
+	refillDone chan struct{}
+	closeOnce  sync.Once
+}
+
+// MemoryOptions configures a MemoryStorage.
+type MemoryOptions struct {
+	// EagerRefill refills every bucket from a background goroutine each
+	// RefillInterval instead of only when a bucket is checked, so a quiet
+	// bucket's balance stays current for anything reading it.
+	EagerRefill    bool
+	RefillInterval time.Duration // Defaults to 100ms
+	// MaxBuckets bounds memory use: when it is reached, the least recently
+	// used bucket is evicted and starts over full if it is used again. 0
+	// means unbounded.
+	MaxBuckets int
+	// Clock supplies the time refills are computed from; nil means
+	// time.Now. Tests use a fake one to refill buckets without sleeping.
+	Clock ClockFunc
+}
+
+// DefaultMemoryRefillInterval is the eager refill tick when none is set.
+const DefaultMemoryRefillInterval = 100 * time.Millisecond
+
+type memoryReservation struct {
+	keys    []string
+	cost    int64
+	expires time.Time
+}
+
+// memoryQuota is a quota counter and the window it counts.
+type memoryQuota struct {
+	windowStart time.Time
+	used        int64
+	expires     time.Time
+}
+
+type denialCount struct {
+	count   int64
+	expires time.Time
+}
+
+type topWindow struct {
+	start  time.Time
+	tokens map[string]int64
+}
+
+// memorySweepInterval is how often expired buckets are dropped.
+const memorySweepInterval = time.Minute
+
+func NewMemoryStorage() *MemoryStorage {
+	return NewMemoryStorageWithOptions(MemoryOptions{})
+}
+
+func NewMemoryStorageWithOptions(opts MemoryOptions) *MemoryStorage {
+	m := &MemoryStorage{
+		buckets: newLRUMap(opts.MaxBuckets, func(_ string, bucket *MemoryTokenBucket) {
+			bucket.deleted.Store(true)
+		}),
+		lastSweep:    opts.Clock.Now(),
+		clock:        opts.Clock,
+		reservations: make(map[string]memoryReservation),
+		penalties:    make(map[string]time.Time),
+		denials:      make(map[string]denialCount),
+		tiers:        make(map[string]string),
+		quotas:       make(map[string]memoryQuota),
+		top:          make(map[string]*topWindow),
+		topWindow:    defaultTopWindow,
+	}
+	if opts.EagerRefill {
+		interval := opts.RefillInterval
+		if interval <= 0 {
+			interval = DefaultMemoryRefillInterval
+		}
+		m.startRefillLoop(interval)
+	}
+	return m
+}
+
+// startRefillLoop refills every bucket each interval until Close.
+func (m *MemoryStorage) startRefillLoop(interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.stopRefill = cancel
+	m.refillDone = make(chan struct{})
+	go func() {
+		defer close(m.refillDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				now := m.clock.Now()
+				m.buckets.Range(func(_ string, bucket *MemoryTokenBucket) bool {
+					bucket.refill(now)
+					return true
+				})
+			}
+		}
+	}()
+}
+
+// lock returns key's bucket locked, creating it full when missing.
+func (m *MemoryStorage) lock(key string, capacity int64, refillRate float64, now time.Time) *MemoryTokenBucket {
+	for {
+		bucket, ok := m.buckets.Load(key)
+		if !ok {
+			bucket, _ = m.buckets.LoadOrStore(key, &MemoryTokenBucket{capacity: capacity, refillRate: refillRate, tokens: float64(capacity), lastRefill: now})
+		}
+		bucket.mu.Lock()
+		if !bucket.deleted.Load() {
+			bucket.configure(capacity, refillRate, now)
+			return bucket
+		}
+		bucket.mu.Unlock()
+	}
+}
+
+// lockPair locks two distinct buckets in key order so concurrent dual
+// checks sharing a bucket can't deadlock.
+func (m *MemoryStorage) lockPair(userKey, globalKey string, userCap int64, userRate float64, globalCap int64, globalRate float64, now time.Time) (user, global *MemoryTokenBucket) {
+	if userKey < globalKey {
+		user = m.lock(userKey, userCap, userRate, now)
+		global = m.lock(globalKey, globalCap, globalRate, now)
+	} else {
+		global = m.lock(globalKey, globalCap, globalRate, now)
+		user = m.lock(userKey, userCap, userRate, now)
+	}
+	return user, global
+}
+
+func (m *MemoryStorage) AtomicTokenBucket(key string, capacity int64, refillRate float64, cost int64, ttl time.Duration) (BucketResult, error) {
+	return m.tokenBucket("", 0, key, capacity, refillRate, cost, ttl)
+}
+
+func (m *MemoryStorage) ReserveTokenBucket(id string, hold time.Duration, key string, capacity int64, refillRate float64, cost int64, ttl time.Duration) (BucketResult, error) {
+	return m.tokenBucket(id, hold, key, capacity, refillRate, cost, ttl)
+}
+
+func (m *MemoryStorage) tokenBucket(id string, hold time.Duration, key string, capacity int64, refillRate float64, cost int64, ttl time.Duration) (BucketResult, error) {
+	now := m.clock.Now()
+	m.sweep(now)
+	bucket := m.lock(key, capacity, refillRate, now)
+	defer bucket.mu.Unlock()
+
+	bucket.settle(now)
+	allowed := bucket.affords(cost, 0)
+	if allowed {
+		bucket.tokens -= float64(cost)
+	}
+	bucket.expiry = now.Add(ttl)
+	if allowed && id != "" {
+		bucket.hold(id, cost, now.Add(hold))
+		m.reserve(id, []string{key}, cost, now.Add(hold))
+	}
+	return BucketResult{Allowed: allowed, Remaining: bucket.remaining(), RetryAfter: bucket.retryAfter(allowed, cost, 0)}, nil
+}
+
+func (m *MemoryStorage) AtomicDualBucket(userKey, globalKey string, globalCap int64, globalRate float64, userCap int64, userRate float64, userMaxDebt, cost int64, ttl time.Duration) (BucketResult, error) {
+	return m.dualBucket("", 0, userKey, globalKey, globalCap, globalRate, userCap, userRate, userMaxDebt, cost, ttl)
+}
+
+func (m *MemoryStorage) ReserveDualBucket(id string, hold time.Duration, userKey, globalKey string, globalCap int64, globalRate float64, userCap int64, userRate float64, userMaxDebt, cost int64, ttl time.Duration) (BucketResult, error) {
+	return m.dualBucket(id, hold, userKey, globalKey, globalCap, globalRate, userCap, userRate, userMaxDebt, cost, ttl)
+}
+
+func (m *MemoryStorage) dualBucket(id string, hold time.Duration, userKey, globalKey string, globalCap int64, globalRate float64, userCap int64, userRate float64, userMaxDebt, cost int64, ttl time.Duration) (BucketResult, error) {
+	now := m.clock.Now()
+	m.sweep(now)
+	user, global := m.lockPair(userKey, globalKey, userCap, userRate, globalCap, globalRate, now)
+	defer user.mu.Unlock()
+	defer global.mu.Unlock()
+
+	user.settle(now)
+	global.settle(now)
+	allowed := user.affords(cost, userMaxDebt) && global.affords(cost, 0)
+	if allowed {
+		user.tokens -= float64(cost)
+		global.tokens -= float64(cost)
+	}
+	user.expiry = now.Add(ttl)
+	global.expiry = now.Add(ttl)
+	if allowed && id != "" {
+		user.hold(id, cost, now.Add(hold))
+		global.hold(id, cost, now.Add(hold))
+		m.reserve(id, []string{userKey, globalKey}, cost, now.Add(hold))
+	}
+	if allowed {
+		m.recordConsumption(globalKey, userKey, cost, now)
+	}
+
+	result := BucketResult{Allowed: allowed, Remaining: user.remaining(), GlobalRemaining: global.remaining()}
+	if !allowed {
+		result.Reason = DenyGlobalTokens
+		if !user.affords(cost, userMaxDebt) {
+			result.Reason = DenyUserTokens
+		}
+		userWait, globalWait := user.retryAfter(false, cost, userMaxDebt), global.retryAfter(false, cost, 0)
+		if userWait < 0 || globalWait < 0 {
+			result.RetryAfter = -time.Millisecond
+		} else {
+			result.RetryAfter = max(userWait, globalWait)
+		}
+	}
+	return result, nil
+}
+
+func (m *MemoryStorage) AtomicInitialBucket(userKey, globalKey string, globalCap int64, globalRate float64, globalInitial int64, userCap int64, userRate float64, userInitial int64, userMaxDebt, cost int64, ttl time.Duration) (BucketResult, error) {
+	now := m.clock.Now()
+	m.prime(userKey, userCap, userRate, userInitial, now)
+	if globalKey == "" {
+		return m.tokenBucket("", 0, userKey, userCap, userRate, cost, ttl)
+	}
+	m.prime(globalKey, globalCap, globalRate, globalInitial, now)
+	return m.dualBucket("", 0, userKey, globalKey, globalCap, globalRate, userCap, userRate, userMaxDebt, cost, ttl)
+}
+
+// prime makes a bucket that doesn't exist yet, or has expired, start with
+// initial tokens instead of full.
+func (m *MemoryStorage) prime(key string, capacity int64, refillRate float64, initial int64, now time.Time) {
+	for {
+		bucket, loaded := m.buckets.LoadOrStore(key, &MemoryTokenBucket{capacity: capacity, refillRate: refillRate, tokens: float64(initial), lastRefill: now})
+		if !loaded {
+			return
+		}
+		bucket.mu.Lock()
+		if bucket.deleted.Load() {
+			bucket.mu.Unlock()
+			continue
+		}
+		if !bucket.expiry.IsZero() && !now.Before(bucket.expiry) {
+			bucket.tokens = float64(initial)
+			bucket.lastRefill = now
+			bucket.held = nil
+			bucket.expiry = time.Time{}
+		}
+		bucket.mu.Unlock()
+		return
+	}
+}
+
+func (m *MemoryStorage) AtomicUserIPBucket(userKey, ipKey string, userCap int64, userRate float64, userMaxDebt int64, ipCap int64, ipRate float64, cost int64, ttl time.Duration) (BucketResult, error) {
+	now := m.clock.Now()
+	m.sweep(now)
+	user, ip := m.lockPair(userKey, ipKey, userCap, userRate, ipCap, ipRate, now)
+	defer user.mu.Unlock()
+	defer ip.mu.Unlock()
+
+	user.settle(now)
+	ip.settle(now)
+	allowed := user.affords(cost, userMaxDebt) && ip.affords(cost, 0)
+	if allowed {
+		user.tokens -= float64(cost)
+		ip.tokens -= float64(cost)
+	}
+	user.expiry = now.Add(ttl)
+	ip.expiry = now.Add(ttl)
+
+	result := BucketResult{Allowed: allowed, Remaining: user.remaining(), IPRemaining: ip.remaining()}
+	if !allowed {
+		userWait, ipWait := user.retryAfter(false, cost, userMaxDebt), ip.retryAfter(false, cost, 0)
+		if userWait < 0 || ipWait < 0 {
+			result.RetryAfter = -time.Millisecond
+		} else {
+			result.RetryAfter = max(userWait, ipWait)
+		}
+	}
+	return result, nil
+}
+
+func (m *MemoryStorage) AtomicMultiBucket(userKey, globalKey string, globalCap int64, globalRate float64, userCap int64, userRate float64, userMaxDebt, cost int64, resources []ResourceBucket, ttl time.Duration) (BucketResult, error) {
+	now := m.clock.Now()
+	m.sweep(now)
+	specs := []ResourceBucket{
+		{Key: userKey, Capacity: userCap, RefillRate: userRate, Cost: cost},
+		{Key: globalKey, Capacity: globalCap, RefillRate: globalRate, Cost: cost},
+	}
+	specs = append(specs, resources...)
+	buckets := m.lockAll(specs, now)
+	defer func() {
+		for _, bucket := range buckets {
+			bucket.mu.Unlock()
+		}
+	}()
+
+	allowed := true
+	for i, bucket := range buckets {
+		bucket.settle(now)
+		maxDebt := int64(0)
+		if i == 0 {
+			maxDebt = userMaxDebt
+		}
+		if !bucket.affords(specs[i].Cost, maxDebt) {
+			allowed = false
+		}
+	}
+	for i, bucket := range buckets {
+		if allowed {
+			bucket.tokens -= float64(specs[i].Cost)
+		}
+		bucket.expiry = now.Add(ttl)
+	}
+	if allowed {
+		m.recordConsumption(globalKey, userKey, cost, now)
+	}
+
+	result := BucketResult{Allowed: allowed, Remaining: buckets[0].remaining(), GlobalRemaining: buckets[1].remaining()}
+	for _, bucket := range buckets[2:] {
+		result.Resources = append(result.Resources, bucket.remaining())
+	}
+	if !allowed {
+		for i, bucket := range buckets {
+			maxDebt := int64(0)
+			if i == 0 {
+				maxDebt = userMaxDebt
+			}
+			wait := bucket.retryAfter(false, specs[i].Cost, maxDebt)
+			if wait < 0 {
+				result.RetryAfter = -time.Millisecond
+				break
+			}
+			result.RetryAfter = max(result.RetryAfter, wait)
+		}
+	}
+	return result, nil
+}
+
+func (m *MemoryStorage) AtomicQuotaBucket(userKey, globalKey string, globalCap int64, globalRate float64, userCap int64, userRate float64, userMaxDebt, cost int64, quotas []Quota, ttl time.Duration) (BucketResult, error) {
+	now := m.clock.Now()
+	m.sweep(now)
+	dual := globalKey != ""
+	var user, global *MemoryTokenBucket
+	if dual {
+		user, global = m.lockPair(userKey, globalKey, userCap, userRate, globalCap, globalRate, now)
+		defer global.mu.Unlock()
+		global.settle(now)
+	} else {
+		user = m.lock(userKey, userCap, userRate, now)
+		userMaxDebt = 0
+	}
+	defer user.mu.Unlock()
+	user.settle(now)
+
+	// Taken after the bucket locks, as everywhere else
+	m.mu.Lock()
+	starts := make([]time.Time, len(quotas))
+	ends := make([]time.Time, len(quotas))
+	used := make([]int64, len(quotas))
+	allowed := user.affords(cost, userMaxDebt) && (!dual || global.affords(cost, 0))
+	for i, quota := range quotas {
+		starts[i], ends[i] = quotaWindow(quota, now)
+		if counter, ok := m.quotas[quota.Key]; ok && counter.windowStart.Equal(starts[i]) && now.Before(counter.expires) {
+			used[i] = counter.used
+		}
+		if used[i]+cost > quota.Amount {
+			allowed = false
+		}
+	}
+	if allowed {
+		user.tokens -= float64(cost)
+		if dual {
+			global.tokens -= float64(cost)
+		}
+		for i := range used {
+			used[i] += cost
+		}
+	}
+	user.expiry = now.Add(ttl)
+	result := BucketResult{Allowed: allowed, Remaining: user.remaining()}
+	if dual {
+		global.expiry = now.Add(ttl)
+		result.GlobalRemaining = global.remaining()
+	}
+	for i, quota := range quotas {
+		m.quotas[quota.Key] = memoryQuota{windowStart: starts[i], used: used[i], expires: ends[i].Add(24 * time.Hour)}
+		result.Quotas = append(result.Quotas, QuotaResult{Remaining: quota.Amount - used[i], ResetsAt: ends[i]})
+	}
+	m.mu.Unlock()
+	if allowed && dual {
+		m.recordConsumption(globalKey, userKey, cost, now)
+	}
+
+	if !allowed {
+		result.RetryAfter = user.retryAfter(false, cost, userMaxDebt)
+		if dual {
+			if wait := global.retryAfter(false, cost, 0); wait < 0 || result.RetryAfter < 0 {
+				result.RetryAfter = -time.Millisecond
+			} else {
+				result.RetryAfter = max(result.RetryAfter, wait)
+			}
+		}
+		for i, quota := range quotas {
+			if cost > quota.Amount {
+				result.RetryAfter = -time.Millisecond
+			} else if result.RetryAfter >= 0 && used[i]+cost > quota.Amount {
+				result.RetryAfter = max(result.RetryAfter, ends[i].Sub(now))
+			}
+		}
+	}
+	return result, nil
+}
+
+// quotaWindow returns the bounds of quota's window containing now, matching
+// quota.lua: midnight to midnight, or the 1st to the 1st, at the quota's
+// offset from UTC, or the Period-long slot since the epoch.
+func quotaWindow(quota Quota, now time.Time) (time.Time, time.Time) {
+	if quota.Window == QuotaFixed {
+		period := quota.Period.Milliseconds()
+		ms := now.UnixMilli()
+		start := time.UnixMilli(ms - ms%period)
+		return start, start.Add(quota.Period)
+	}
+	local := now.In(time.FixedZone("", int(quota.UTCOffset.Seconds())))
+	if quota.Window == QuotaMonth {
+		start := time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, local.Location())
+		return start, start.AddDate(0, 1, 0)
+	}
+	start := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, local.Location())
+	return start, start.AddDate(0, 0, 1)
+}
+
+// lockAll locks the buckets described by specs in key order, returning them
+// in specs order. Keys must be distinct.
+func (m *MemoryStorage) lockAll(specs []ResourceBucket, now time.Time) []*MemoryTokenBucket {
+	order := make([]int, len(specs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return specs[order[a]].Key < specs[order[b]].Key })
+	buckets := make([]*MemoryTokenBucket, len(specs))
+	for _, i := range order {
+		buckets[i] = m.lock(specs[i].Key, specs[i].Capacity, specs[i].RefillRate, now)
+	}
+	return buckets
+}
+
+func (m *MemoryStorage) reserve(id string, keys []string, cost int64, expires time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reservations[id] = memoryReservation{keys: keys, cost: cost, expires: expires}
+}
+
+func (m *MemoryStorage) CommitReservation(id string) (bool, error) {
+	return m.settleReservation(id, false), nil
+}
+
+func (m *MemoryStorage) ReleaseReservation(id string) (bool, error) {
+	return m.settleReservation(id, true), nil
+}
+
+// settleReservation drops id's holds, returning the tokens when refund is
+// set. An expired reservation reports false; its tokens are returned by the
+// next check of its buckets.
+func (m *MemoryStorage) settleReservation(id string, refund bool) bool {
+	now := m.clock.Now()
+	m.mu.Lock()
+	res, ok := m.reservations[id]
+	delete(m.reservations, id)
+	m.mu.Unlock()
+	if !ok || !now.Before(res.expires) {
+		return false
+	}
+	for _, key := range res.keys {
+		bucket, ok := m.buckets.Load(key)
+		if !ok {
+			continue
+		}
+		bucket.mu.Lock()
+		if bucket.unhold(id) && refund {
+			bucket.refund(res.cost)
+		}
+		bucket.mu.Unlock()
+	}
+	return true
+}
+
+func (m *MemoryStorage) PenaltyStatus(key string) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.activePenalty(key, m.clock.Now()), nil
+}
+
+func (m *MemoryStorage) RecordDenial(key string, threshold int64, window, duration time.Duration) (time.Time, error) {
+	now := m.clock.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if until := m.activePenalty(key, now); !until.IsZero() {
+		return until, nil
+	}
+
+	// Fixed window, as in penalty.lua
+	denials := m.denials[key]
+	if !now.Before(denials.expires) {
+		denials = denialCount{expires: now.Add(window)}
+	}
+	denials.count++
+	if denials.count < threshold {
+		m.denials[key] = denials
+		return time.Time{}, nil
+	}
+	delete(m.denials, key)
+	until := now.Add(duration)
+	m.penalties[key] = until
+	return until, nil
+}
+
+// activePenalty returns when key's penalty ends, or the zero time. Callers
+// must hold m.mu.
+func (m *MemoryStorage) activePenalty(key string, now time.Time) time.Time {
+	until, ok := m.penalties[key]
+	if !ok {
+		return time.Time{}
+	}
+	if !now.Before(until) {
+		delete(m.penalties, key)
+		return time.Time{}
+	}
+	return until
+}
+
+func (m *MemoryStorage) LookupTier(key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.tiers[key], nil
+}
+
+func (m *MemoryStorage) SetTier(key, tier string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tiers[key] = tier
+	return nil
+}
+
+func (m *MemoryStorage) DeleteTier(key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.tiers[key]
+	delete(m.tiers, key)
+	return ok, nil
+}
+
+func (m *MemoryStorage) TopUpBucket(key string, capacity int64, refillRate float64, amount, maxBalance int64, ttl time.Duration) (int64, error) {
+	now := m.clock.Now()
+	bucket := m.lock(key, capacity, refillRate, now)
+	defer bucket.mu.Unlock()
+
+	bucket.settle(now)
+	if bucket.tokens < float64(maxBalance) {
+		bucket.tokens = math.Min(float64(maxBalance), bucket.tokens+float64(amount))
+	}
+	// Keep the longer expiry so a bonus outlives a short bucket TTL
+	if expiry := now.Add(ttl); bucket.expiry.Before(expiry) {
+		bucket.expiry = expiry
+	}
+	return bucket.remaining(), nil
+}
+
+func (m *MemoryStorage) RefundTokens(key string, cost int64, ttl time.Duration) error {
+	now := m.clock.Now()
+	bucket, ok := m.buckets.Load(key)
+	if !ok {
+		return nil
+	}
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	// A deleted or expired bucket starts over full
+	if bucket.deleted.Load() || (!bucket.expiry.IsZero() && !now.Before(bucket.expiry)) {
+		return nil
+	}
+	bucket.settle(now)
+	bucket.refund(cost)
+	if expiry := now.Add(ttl); !bucket.expiry.IsZero() && bucket.expiry.Before(expiry) {
+		bucket.expiry = expiry
+	}
+	return nil
+}
+
+func (m *MemoryStorage) SetBucketTokens(key string, tokens int64, ttl time.Duration) error {
+	now := m.clock.Now()
+	m.sweep(now)
+	for {
+		bucket, _ := m.buckets.LoadOrStore(key, &MemoryTokenBucket{capacity: tokens, lastRefill: now})
+		bucket.mu.Lock()
+		if bucket.deleted.Load() {
+			bucket.mu.Unlock()
+			continue
+		}
+		bucket.tokens = float64(tokens)
+		bucket.lastRefill = now
+		bucket.expiry = time.Time{}
+		if ttl > 0 {
+			bucket.expiry = now.Add(ttl)
+		}
+		bucket.mu.Unlock()
+		return nil
+	}
+}
+
+// ResetBuckets deletes matching buckets, quota counters, penalties
+// ("penalty:<key>") and denial counts ("denials:<key>") in one pass, so
+// progress is reported once.
+func (m *MemoryStorage) ResetBuckets(ctx context.Context, pattern string, opts ResetOptions, progress func(ResetProgress)) (ResetProgress, error) {
+	if err := ctx.Err(); err != nil {
+		return ResetProgress{}, err
+	}
+	var total ResetProgress
+	m.buckets.Range(func(key string, bucket *MemoryTokenBucket) bool {
+		if globMatch(pattern, key) {
+			total.Matched++
+			bucket.mu.Lock()
+			bucket.deleted.Store(true)
+			bucket.mu.Unlock()
+			if m.buckets.CompareAndDelete(key, bucket) {
+				total.Deleted++
+			}
+		}
+		return true
+	})
+
+	m.mu.Lock()
+	for key := range m.quotas {
+		if globMatch(pattern, key) {
+			total.Matched++
+			total.Deleted++
+			delete(m.quotas, key)
+		}
+	}
+	for key := range m.penalties {
+		if globMatch(pattern, "penalty:"+key) {
+			total.Matched++
+			total.Deleted++
+			delete(m.penalties, key)
+		}
+	}
+	for key := range m.denials {
+		if globMatch(pattern, "denials:"+key) {
+			total.Matched++
+			total.Deleted++
+			delete(m.denials, key)
+		}
+	}
+	m.mu.Unlock()
+
+	if progress != nil {
+		progress(total)
+	}
+	return total, nil
+}
+
+func (m *MemoryStorage) DeleteBucket(key string) (bool, error) {
+	total, err := m.ResetBuckets(context.Background(), escapeGlob(key), ResetOptions{}, nil)
+	return total.Deleted > 0, err
+}
+
+// escapeGlob quotes the wildcards in key so a glob matches it literally.
+func escapeGlob(key string) string {
+	var b strings.Builder
+	for _, c := range key {
+		if strings.ContainsRune(`*?[]\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (m *MemoryStorage) PurgeKeys(pattern string) (int, error) {
+	total, err := m.ResetBuckets(context.Background(), pattern, ResetOptions{}, nil)
+	return int(total.Deleted), err
+}
+
+// recordConsumption counts cost against userKey in globalKey's current top
+// consumers window.
+func (m *MemoryStorage) recordConsumption(globalKey, userKey string, cost int64, now time.Time) {
+	start := now.Truncate(m.topWindow)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	window := m.top[globalKey]
+	if window == nil || !window.start.Equal(start) {
+		window = &topWindow{start: start, tokens: make(map[string]int64)}
+		m.top[globalKey] = window
+	}
+	window.tokens[userKey] += cost
+}
+
+func (m *MemoryStorage) TopConsumers(globalKey string, n int) (TopConsumersReport, error) {
+	start := m.clock.Now().Truncate(m.topWindow)
+	report := TopConsumersReport{WindowStart: start, Window: m.topWindow, Consumers: []Consumer{}}
+
+	m.mu.Lock()
+	if window := m.top[globalKey]; window != nil && window.start.Equal(start) {
+		for key, tokens := range window.tokens {
+			report.Consumers = append(report.Consumers, Consumer{Key: key, Tokens: tokens})
+		}
+	}
+	m.mu.Unlock()
+
+	sort.Slice(report.Consumers, func(i, j int) bool {
+		a, b := report.Consumers[i], report.Consumers[j]
+		return a.Tokens > b.Tokens || (a.Tokens == b.Tokens && a.Key > b.Key)
+	})
+	if len(report.Consumers) > n {
+		report.Consumers = report.Consumers[:n]
+	}
+	return report, nil
+}
+
+// sweep drops expired buckets at most once per memorySweepInterval, the way
+// Redis expires bucket keys.
+func (m *MemoryStorage) sweep(now time.Time) {
+	if !m.sweepMu.TryLock() {
+		return
+	}
+	defer m.sweepMu.Unlock()
+	if now.Sub(m.lastSweep) < memorySweepInterval {
+		return
+	}
+	m.lastSweep = now
+
+	m.buckets.Range(func(key string, bucket *MemoryTokenBucket) bool {
+		bucket.mu.Lock()
+		expired := !bucket.expiry.IsZero() && !now.Before(bucket.expiry)
+		if expired {
+			bucket.deleted.Store(true)
+		}
+		bucket.mu.Unlock()
+		if expired {
+			m.buckets.CompareAndDelete(key, bucket)
+		}
+		return true
+	})
+
+	m.mu.Lock()
+	for id, res := range m.reservations {
+		if !now.Before(res.expires) {
+			delete(m.reservations, id)
+		}
+	}
+	for key, until := range m.penalties {
+		if !now.Before(until) {
+			delete(m.penalties, key)
+		}
+	}
+	for key, denials := range m.denials {
+		if !now.Before(denials.expires) {
+			delete(m.denials, key)
+		}
+	}
+	for key, quota := range m.quotas {
+		if !now.Before(quota.expires) {
+			delete(m.quotas, key)
+		}
+	}
+	m.mu.Unlock()
+}
+
+// PoolStats is zero: there is no connection pool.
+func (m *MemoryStorage) PoolStats() RedisPoolStats {
+	return RedisPoolStats{}
+}
+
+func (m *MemoryStorage) Ping() error {
+	return nil
+}
+
+// Close stops the eager refill loop, if any. The buckets stay usable.
+func (m *MemoryStorage) Close() error {
+	m.closeOnce.Do(func() {
+		if m.stopRefill != nil {
+			m.stopRefill()
+			<-m.refillDone
+		}
+	})
+	return nil
+}
+
+// globMatch reports whether s matches a Redis glob pattern: '*' matches any
+// run of characters (including '/' and ':'), '?' any single character,
+// "[...]" a character class and '\' escapes the next character.
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		case '[':
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 || s == "" {
+				return false
+			}
+			if !classMatch(pattern[1:end+1], s[0]) {
+				return false
+			}
+			pattern, s = pattern[end+2:], s[1:]
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			if s == "" || pattern[0] != s[0] {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+	return s == ""
+}
+
+// classMatch reports whether c is in a glob character class such as "a-z"
+// or "^0-9".
+func classMatch(class string, c byte) bool {
+	negate := strings.HasPrefix(class, "^")
+	if negate {
+		class = class[1:]
+	}
+	matched := false
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			if class[i] <= c && c <= class[i+2] {
+				matched = true
+			}
+			i += 2
+			continue
+		}
+		if class[i] == c {
+			matched = true
+		}
+	}
+	return matched != negate
+}
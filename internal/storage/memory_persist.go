@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// memorySnapshot is the on-disk form of a MemoryStorage's buckets.
+type memorySnapshot struct {
+	SavedAt time.Time              `json:"saved_at"`
+	Buckets []memoryBucketSnapshot `json:"buckets"`
+}
+
+type memoryBucketSnapshot struct {
+	Key        string    `json:"key"`
+	Tokens     float64   `json:"tokens"`
+	LastRefill time.Time `json:"last_refill"`
+	Capacity   int64     `json:"capacity"`
+	RefillRate float64   `json:"refill_rate"`
+	Expiry     time.Time `json:"expiry"`
+}
+
+// PersistToFile writes every live bucket to path as JSON so a restarted
+// instance can pick up where this one stopped. Tokens held by unsettled
+// reservations are saved as returned, since reservations are not persisted.
+// The file is replaced atomically.
+func (m *MemoryStorage) PersistToFile(path string) error {
+	data, err := json.Marshal(m.snapshot(m.clock.Now()))
+	if err != nil {
+		return fmt.Errorf("failed to encode bucket state: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write bucket state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write bucket state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write bucket state: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write bucket state: %w", err)
+	}
+	return nil
+}
+
+// RestoreFromFile loads buckets saved by PersistToFile, replacing any with
+// the same key. Each bucket is credited the refill it earned while the
+// process was down, and buckets that expired in the meantime are skipped.
+func (m *MemoryStorage) RestoreFromFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read bucket state: %w", err)
+	}
+	var snapshot memorySnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("failed to decode bucket state %s: %w", path, err)
+	}
+
+	m.restore(snapshot, m.clock.Now())
+	return nil
+}
+
+// Clone returns an independent MemoryStorage starting from m's current
+// bucket balances and tier mappings, e.g. to try rules out without touching
+// live state. Reservations, penalties and top consumers are not copied.
+func (m *MemoryStorage) Clone() *MemoryStorage {
+	clone := NewMemoryStorageWithOptions(MemoryOptions{Clock: m.clock})
+	clone.restore(m.snapshot(m.clock.Now()), m.clock.Now())
+	m.mu.Lock()
+	for key, tier := range m.tiers {
+		clone.tiers[key] = tier
+	}
+	m.mu.Unlock()
+	return clone
+}
+
+// snapshot captures every live bucket. Tokens held by unsettled reservations
+// are counted as returned.
+func (m *MemoryStorage) snapshot(now time.Time) memorySnapshot {
+	snapshot := memorySnapshot{SavedAt: now, Buckets: []memoryBucketSnapshot{}}
+	m.buckets.Range(func(key string, bucket *MemoryTokenBucket) bool {
+		bucket.mu.Lock()
+		defer bucket.mu.Unlock()
+		if bucket.deleted.Load() || (!bucket.expiry.IsZero() && !now.Before(bucket.expiry)) {
+			return true
+		}
+		tokens := bucket.tokens
+		for _, h := range bucket.held {
+			tokens = math.Max(tokens, math.Min(float64(bucket.capacity), tokens+float64(h.cost)))
+		}
+		snapshot.Buckets = append(snapshot.Buckets, memoryBucketSnapshot{
+			Key:        key,
+			Tokens:     tokens,
+			LastRefill: bucket.lastRefill,
+			Capacity:   bucket.capacity,
+			RefillRate: bucket.refillRate,
+			Expiry:     bucket.expiry,
+		})
+		return true
+	})
+	return snapshot
+}
+
+// restore loads snapshot's buckets, replacing any with the same key, and
+// credits each the refill it earned since it was saved.
+func (m *MemoryStorage) restore(snapshot memorySnapshot, now time.Time) {
+	for _, saved := range snapshot.Buckets {
+		if !saved.Expiry.IsZero() && !now.Before(saved.Expiry) {
+			continue
+		}
+		bucket := &MemoryTokenBucket{
+			capacity:   saved.Capacity,
+			refillRate: saved.RefillRate,
+			tokens:     saved.Tokens,
+			lastRefill: saved.LastRefill,
+			expiry:     saved.Expiry,
+		}
+		bucket.settle(now)
+		if previous, loaded := m.buckets.Swap(saved.Key, bucket); loaded {
+			previous.mu.Lock()
+			previous.deleted.Store(true)
+			previous.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,430 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMemoryStorage_TokenBucket(t *testing.T) {
+	m := NewMemoryStorage()
+
+	for i := 0; i < 3; i++ {
+		result, _ := m.AtomicTokenBucket("endpoint:/api/list", 30, 10, 10, time.Hour)
+		if !result.Allowed || result.Remaining != int64(20-10*i) {
+			t.Fatalf("request %d: expected allowed with %d left, got %+v", i, 20-10*i, result)
+		}
+	}
+	result, _ := m.AtomicTokenBucket("endpoint:/api/list", 30, 10, 10, time.Hour)
+	if result.Allowed {
+		t.Fatalf("expected empty bucket to deny, got %+v", result)
+	}
+	if result.RetryAfter <= 0 || result.RetryAfter > time.Second {
+		t.Errorf("expected retry within 1s at 10 tokens/s, got %v", result.RetryAfter)
+	}
+	if result, _ := m.AtomicTokenBucket("endpoint:/api/list", 30, 10, 31, time.Hour); result.RetryAfter >= 0 {
+		t.Errorf("expected negative retry for a cost above capacity, got %v", result.RetryAfter)
+	}
+}
+
+func TestMemoryStorage_DualBucket(t *testing.T) {
+	m := NewMemoryStorage()
+
+	// The user bucket may borrow up to max_debt
+	result, _ := m.AtomicDualBucket("user:a", "global:/x", 1000, 100, 10, 1, 5, 15, time.Hour)
+	if !result.Allowed || result.Remaining != -5 || result.GlobalRemaining != 985 {
+		t.Fatalf("expected borrowing to 5 in debt, got %+v", result)
+	}
+	result, _ = m.AtomicDualBucket("user:a", "global:/x", 1000, 100, 10, 1, 5, 1, time.Hour)
+	if result.Allowed {
+		t.Fatalf("expected denial beyond max_debt, got %+v", result)
+	}
+
+	// A global denial consumes nothing from the user bucket
+	result, _ = m.AtomicDualBucket("user:b", "global:/y", 5, 1, 100, 10, 0, 10, time.Hour)
+	if result.Allowed || result.Remaining != 100 || result.GlobalRemaining != 5 {
+		t.Fatalf("expected denial by the global bucket with nothing consumed, got %+v", result)
+	}
+}
+
+func TestMemoryStorage_DualBucketIsAtomic(t *testing.T) {
+	m := NewMemoryStorage()
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Two users share the global bucket
+			user := "user:a"
+			if i%2 == 0 {
+				user = "user:z"
+			}
+			for j := 0; j < 20; j++ {
+				result, _ := m.AtomicDualBucket(user, "global:/x", 100, 0.001, 1000, 0.001, 0, 1, time.Hour)
+				if result.Allowed {
+					allowed.Add(1)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if got := allowed.Load(); got != 100 {
+		t.Errorf("expected exactly the global capacity of 100 allowed, got %d", got)
+	}
+}
+
+func TestMemoryStorage_Reservations(t *testing.T) {
+	m := NewMemoryStorage()
+
+	m.ReserveDualBucket("r1", time.Minute, "user:a", "global:/x", 100, 1, 10, 1, 0, 4, time.Hour)
+	if ok, _ := m.ReleaseReservation("r1"); !ok {
+		t.Fatal("expected release to succeed")
+	}
+	if ok, _ := m.ReleaseReservation("r1"); ok {
+		t.Error("expected a second release to be a no-op")
+	}
+	result, _ := m.AtomicDualBucket("user:a", "global:/x", 100, 1, 10, 1, 0, 0, time.Hour)
+	if result.Remaining != 10 || result.GlobalRemaining != 100 {
+		t.Errorf("expected released tokens back in both buckets, got %+v", result)
+	}
+
+	m.ReserveTokenBucket("r2", time.Minute, "endpoint:/y", 10, 1, 4, time.Hour)
+	if ok, _ := m.CommitReservation("r2"); !ok {
+		t.Fatal("expected commit to succeed")
+	}
+	if result, _ := m.AtomicTokenBucket("endpoint:/y", 10, 1, 0, time.Hour); result.Remaining != 6 {
+		t.Errorf("expected committed tokens to stay spent, got %+v", result)
+	}
+
+	// Unsettled reservations return their tokens once the hold expires
+	m.ReserveTokenBucket("r3", 20*time.Millisecond, "endpoint:/z", 10, 0.001, 4, time.Hour)
+	time.Sleep(30 * time.Millisecond)
+	if ok, _ := m.CommitReservation("r3"); ok {
+		t.Error("expected an expired reservation not to commit")
+	}
+	if result, _ := m.AtomicTokenBucket("endpoint:/z", 10, 0.001, 0, time.Hour); result.Remaining != 10 {
+		t.Errorf("expected expired hold to be returned, got %+v", result)
+	}
+}
+
+func TestMemoryStorage_PenaltyAndTopUp(t *testing.T) {
+	m := NewMemoryStorage()
+
+	for i := 1; i <= 3; i++ {
+		until, _ := m.RecordDenial("user:a", 3, time.Minute, time.Minute)
+		if (i == 3) != !until.IsZero() {
+			t.Fatalf("denial %d: unexpected penalty end %v", i, until)
+		}
+	}
+	if until, _ := m.PenaltyStatus("user:a"); until.IsZero() {
+		t.Error("expected key to be penalized")
+	}
+
+	m.AtomicDualBucket("user:b", "global:/x", 100, 1, 10, 0.001, 0, 10, time.Hour)
+	if balance, _ := m.TopUpBucket("user:b", 10, 0.001, 50, 40, time.Hour); balance != 40 {
+		t.Errorf("expected top-up clamped to max balance 40, got %d", balance)
+	}
+}
+
+func TestMemoryStorage_SetBucketTokens(t *testing.T) {
+	m := NewMemoryStorage()
+
+	m.SetBucketTokens("user:a", 3, time.Minute)
+	result, _ := m.AtomicDualBucket("user:a", "global:/x", 1000, 0, 100, 0, 0, 2, time.Hour)
+	if !result.Allowed || result.Remaining != 1 {
+		t.Fatalf("expected the primed bucket to have 1 left, got %+v", result)
+	}
+	m.SetBucketTokens("user:a", 0, time.Minute)
+	if result, _ := m.AtomicDualBucket("user:a", "global:/x", 1000, 0, 100, 0, 0, 1, time.Hour); result.Allowed {
+		t.Fatalf("expected the emptied bucket to deny, got %+v", result)
+	}
+}
+
+func TestMemoryStorage_InitialBucket(t *testing.T) {
+	m := NewMemoryStorage()
+
+	// A new single bucket starts empty and earns its first tokens by refilling
+	if result, _ := m.AtomicInitialBucket("endpoint:/x", "", 0, 0, 0, 100, 0, 0, 0, 1, time.Hour); result.Allowed || result.Remaining != 0 {
+		t.Fatalf("expected the new bucket to start empty, got %+v", result)
+	}
+	// New dual buckets start partly filled
+	result, _ := m.AtomicInitialBucket("user:a", "global:/x", 1000, 0, 500, 100, 0, 20, 0, 5, time.Hour)
+	if !result.Allowed || result.Remaining != 15 || result.GlobalRemaining != 495 {
+		t.Fatalf("expected user 15 and global 495, got %+v", result)
+	}
+	// Existing buckets are left as they are
+	m.AtomicTokenBucket("user:b", 100, 0, 10, time.Hour)
+	if result, _ := m.AtomicInitialBucket("user:b", "global:/x", 1000, 0, 0, 100, 0, 0, 0, 10, time.Hour); !result.Allowed || result.Remaining != 80 {
+		t.Errorf("expected the existing bucket to keep its balance, got %+v", result)
+	}
+}
+
+func TestMemoryStorage_DeleteBucket(t *testing.T) {
+	m := NewMemoryStorage()
+
+	m.AtomicTokenBucket("user:a*", 5, 0, 5, time.Hour)
+	m.AtomicTokenBucket("user:ab", 5, 0, 5, time.Hour)
+	if deleted, err := m.DeleteBucket("user:a*"); err != nil || !deleted {
+		t.Fatalf("expected the bucket to be deleted, got %v (err %v)", deleted, err)
+	}
+	if result, _ := m.AtomicTokenBucket("user:a*", 5, 0, 1, time.Hour); !result.Allowed || result.Remaining != 4 {
+		t.Errorf("expected the deleted bucket to start full, got %+v", result)
+	}
+	// The key is not a pattern
+	if result, _ := m.AtomicTokenBucket("user:ab", 5, 0, 1, time.Hour); result.Allowed {
+		t.Errorf("expected a similar key to be untouched, got %+v", result)
+	}
+	if deleted, _ := m.DeleteBucket("user:missing"); deleted {
+		t.Error("expected nothing to delete")
+	}
+}
+
+func TestMemoryStorage_ResetAndTopConsumers(t *testing.T) {
+	m := NewMemoryStorage()
+	m.AtomicDualBucket("user:a:/api/upload:free", "global:/api/upload", 100, 1, 10, 1, 0, 3, time.Hour)
+	m.AtomicDualBucket("user:b:/api/upload:free", "global:/api/upload", 100, 1, 10, 1, 0, 5, time.Hour)
+
+	report, _ := m.TopConsumers("global:/api/upload", 1)
+	if len(report.Consumers) != 1 || report.Consumers[0] != (Consumer{Key: "user:b:/api/upload:free", Tokens: 5}) {
+		t.Errorf("expected user b as top consumer, got %+v", report.Consumers)
+	}
+
+	total, err := m.ResetBuckets(context.Background(), "user:*:/api/upload:*", ResetOptions{}, nil)
+	if err != nil || total.Deleted != 2 {
+		t.Fatalf("expected 2 user buckets reset, got %+v (err %v)", total, err)
+	}
+	result, _ := m.AtomicDualBucket("user:a:/api/upload:free", "global:/api/upload", 100, 1, 10, 1, 0, 0, time.Hour)
+	if result.Remaining != 10 || result.GlobalRemaining >= 100 {
+		t.Errorf("expected only the user bucket reset, got %+v", result)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "user:a:/api/upload:free", true},
+		{"user:*:/api/upload:*", "user:a:/api/upload:free", true},
+		{"user:*:/api/upload:*", "ip:1.2.3.4:/api/upload", false},
+		{"user:?", "user:a", true},
+		{"user:?", "user:ab", false},
+		{"user:[a-c]", "user:b", true},
+		{"user:[^a-c]", "user:b", false},
+		{`user:\*`, "user:*", true},
+		{`user:\*`, "user:a", false},
+	}
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryStorage_PersistRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buckets.json")
+	m := NewMemoryStorage()
+	m.AtomicDualBucket("user:a", "global:/x", 1000, 0.001, 100, 0.001, 0, 40, time.Hour)
+	m.ReserveTokenBucket("r1", time.Minute, "endpoint:/y", 10, 0.001, 4, time.Hour)
+	if err := m.PersistToFile(path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	restored := NewMemoryStorage()
+	if err := restored.RestoreFromFile(path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	result, _ := restored.AtomicDualBucket("user:a", "global:/x", 1000, 0.001, 100, 0.001, 0, 0, time.Hour)
+	if result.Remaining != 60 || result.GlobalRemaining != 960 {
+		t.Errorf("expected restored balances 60 and 960, got %+v", result)
+	}
+	// Reservations are not persisted, so their held tokens come back
+	if result, _ := restored.AtomicTokenBucket("endpoint:/y", 10, 0.001, 0, time.Hour); result.Remaining != 10 {
+		t.Errorf("expected held tokens returned on restore, got %+v", result)
+	}
+}
+
+func TestMemoryStorage_Clone(t *testing.T) {
+	m := NewMemoryStorage()
+	m.AtomicDualBucket("user:a", "global:/x", 1000, 0.001, 100, 0.001, 0, 40, time.Hour)
+	m.SetTier("user:a", "pro")
+
+	clone := m.Clone()
+	if result, _ := clone.AtomicDualBucket("user:a", "global:/x", 1000, 0.001, 100, 0.001, 0, 10, time.Hour); result.Remaining != 50 || result.GlobalRemaining != 950 {
+		t.Errorf("expected the clone to start from 60 and 960, got %+v", result)
+	}
+	if tier, _ := clone.LookupTier("user:a"); tier != "pro" {
+		t.Errorf("expected the tier mapping copied, got %q", tier)
+	}
+	if result, _ := m.AtomicDualBucket("user:a", "global:/x", 1000, 0.001, 100, 0.001, 0, 0, time.Hour); result.Remaining != 60 || result.GlobalRemaining != 960 {
+		t.Errorf("expected the original untouched by the clone, got %+v", result)
+	}
+}
+
+func TestMemoryStorage_RestoreAppliesStaleRefill(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buckets.json")
+	now := time.Now()
+	state := `{"buckets":[` +
+		`{"key":"user:a","tokens":0,"last_refill":"` + now.Add(-3*time.Second).Format(time.RFC3339Nano) + `","capacity":100,"refill_rate":10,"expiry":"` + now.Add(time.Hour).Format(time.RFC3339Nano) + `"},` +
+		`{"key":"user:b","tokens":0,"last_refill":"` + now.Add(-time.Hour).Format(time.RFC3339Nano) + `","capacity":100,"refill_rate":10,"expiry":"0001-01-01T00:00:00Z"},` +
+		`{"key":"user:c","tokens":0,"last_refill":"` + now.Add(-2*time.Hour).Format(time.RFC3339Nano) + `","capacity":100,"refill_rate":0.001,"expiry":"` + now.Add(-time.Hour).Format(time.RFC3339Nano) + `"}]}`
+	if err := os.WriteFile(path, []byte(state), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMemoryStorage()
+	if err := m.RestoreFromFile(path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result, _ := m.AtomicTokenBucket("user:a", 100, 10, 0, time.Hour); result.Remaining < 30 || result.Remaining > 31 {
+		t.Errorf("expected about 30 tokens refilled over 3s downtime, got %+v", result)
+	}
+	if result, _ := m.AtomicTokenBucket("user:b", 100, 10, 0, time.Hour); result.Remaining != 100 {
+		t.Errorf("expected refill capped at capacity, got %+v", result)
+	}
+	// Expired while down: starts over full like a fresh bucket
+	if result, _ := m.AtomicTokenBucket("user:c", 100, 0.001, 0, time.Hour); result.Remaining != 100 {
+		t.Errorf("expected expired bucket skipped, got %+v", result)
+	}
+
+	if err := m.RestoreFromFile(filepath.Join(t.TempDir(), "missing.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected a not-exist error for a missing file, got %v", err)
+	}
+}
+
+func TestMemoryStorage_MultiBucket(t *testing.T) {
+	m := NewMemoryStorage()
+	resources := []ResourceBucket{
+		{Key: "user:a:resource:spend", Capacity: 50, RefillRate: 0.001, Cost: 20},
+		{Key: "user:a:resource:tokens", Capacity: 1000, RefillRate: 0.001, Cost: 600},
+	}
+
+	result, _ := m.AtomicMultiBucket("user:a", "global:/llm", 100, 0.001, 10, 0.001, 0, 1, resources, time.Hour)
+	if !result.Allowed || result.Remaining != 9 || result.GlobalRemaining != 99 {
+		t.Fatalf("expected allowed, got %+v", result)
+	}
+	if len(result.Resources) != 2 || result.Resources[0] != 30 || result.Resources[1] != 400 {
+		t.Fatalf("expected resource balances [30 400], got %v", result.Resources)
+	}
+
+	// Tokens can no longer pay, so nothing is charged anywhere
+	result, _ = m.AtomicMultiBucket("user:a", "global:/llm", 100, 0.001, 10, 0.001, 0, 1, resources, time.Hour)
+	if result.Allowed || result.Remaining != 9 || result.GlobalRemaining != 99 || result.Resources[0] != 30 || result.Resources[1] != 400 {
+		t.Fatalf("expected an all-or-nothing denial, got %+v", result)
+	}
+	if result.RetryAfter <= 0 {
+		t.Errorf("expected a wait for the tokens bucket, got %v", result.RetryAfter)
+	}
+
+	resources[1].Cost = 1001
+	if result, _ := m.AtomicMultiBucket("user:a", "global:/llm", 100, 0.001, 10, 0.001, 0, 1, resources, time.Hour); result.RetryAfter >= 0 {
+		t.Errorf("expected negative retry for a resource cost above capacity, got %v", result.RetryAfter)
+	}
+}
+
+func TestMemoryStorage_EagerRefill(t *testing.T) {
+	m := NewMemoryStorageWithOptions(MemoryOptions{EagerRefill: true, RefillInterval: 20 * time.Millisecond})
+	defer m.Close()
+
+	m.AtomicTokenBucket("endpoint:/api/list", 100, 100, 100, time.Hour)
+	bucket, _ := m.buckets.Load("endpoint:/api/list")
+
+	// No requests while waiting; only the background loop can add tokens
+	time.Sleep(200 * time.Millisecond)
+	bucket.mu.Lock()
+	tokens := bucket.tokens
+	bucket.mu.Unlock()
+	if tokens < 10 || tokens > 30 {
+		t.Errorf("expected about 20 tokens refilled in the background, got %v", tokens)
+	}
+
+	m.Close()
+	bucket.mu.Lock()
+	stopped := bucket.tokens
+	bucket.mu.Unlock()
+	time.Sleep(60 * time.Millisecond)
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	if bucket.tokens != stopped {
+		t.Errorf("expected no refills after Close, got %v then %v", stopped, bucket.tokens)
+	}
+}
+
+func TestMemoryStorage_MaxBuckets(t *testing.T) {
+	m := NewMemoryStorageWithOptions(MemoryOptions{MaxBuckets: 2})
+
+	m.AtomicTokenBucket("endpoint:/a", 10, 0.001, 5, time.Hour)
+	m.AtomicTokenBucket("endpoint:/b", 10, 0.001, 5, time.Hour)
+	// Use /a again so /b is the least recently used
+	m.AtomicTokenBucket("endpoint:/a", 10, 0.001, 1, time.Hour)
+	m.AtomicTokenBucket("endpoint:/c", 10, 0.001, 5, time.Hour)
+
+	if n := m.buckets.Len(); n != 2 {
+		t.Fatalf("expected eviction to keep 2 buckets, got %d", n)
+	}
+	if _, ok := m.buckets.Load("endpoint:/b"); ok {
+		t.Error("expected the least recently used bucket to be evicted")
+	}
+	if result, _ := m.AtomicTokenBucket("endpoint:/a", 10, 0.001, 0, time.Hour); result.Remaining != 4 {
+		t.Errorf("expected recently used bucket to keep its balance of 4, got %+v", result)
+	}
+	if result, _ := m.AtomicTokenBucket("endpoint:/b", 10, 0.001, 0, time.Hour); result.Remaining != 10 {
+		t.Errorf("expected evicted bucket to start over full, got %+v", result)
+	}
+}
+
+func TestMemoryStorage_QuotaBucket(t *testing.T) {
+	m := NewMemoryStorage()
+	quotas := []Quota{
+		{Key: "quota:user:a", Amount: 2, Window: QuotaDay},
+		{Key: "quota:global:/x", Amount: 100, Window: QuotaMonth},
+	}
+
+	for i := int64(1); i <= 2; i++ {
+		result, _ := m.AtomicQuotaBucket("user:a", "global:/x", 1000, 100, 100, 10, 0, 1, quotas, time.Hour)
+		if !result.Allowed || result.Quotas[0].Remaining != 2-i || result.Quotas[1].Remaining != 100-i {
+			t.Fatalf("request %d: expected allowed, got %+v", i, result)
+		}
+	}
+
+	// The exhausted daily quota denies and nothing is charged
+	result, _ := m.AtomicQuotaBucket("user:a", "global:/x", 1000, 100, 100, 10, 0, 1, quotas, time.Hour)
+	if result.Allowed || result.Remaining != 98 || result.GlobalRemaining != 998 || result.Quotas[1].Remaining != 98 {
+		t.Fatalf("expected an all-or-nothing denial, got %+v", result)
+	}
+	if result.RetryAfter <= 0 || result.RetryAfter > 24*time.Hour {
+		t.Errorf("expected to wait for the next day, got %v", result.RetryAfter)
+	}
+	if result, _ := m.AtomicQuotaBucket("user:b", "", 0, 0, 100, 10, 0, 3, quotas[:1], time.Hour); result.RetryAfter >= 0 {
+		t.Errorf("expected negative retry for a cost above the quota, got %v", result.RetryAfter)
+	}
+}
+
+func TestQuotaWindow(t *testing.T) {
+	newYearsEve := time.Date(2025, time.December, 31, 22, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		quota      Quota
+		start, end time.Time
+	}{
+		{"day in UTC", Quota{Window: QuotaDay}, time.Date(2025, time.December, 31, 0, 0, 0, 0, time.UTC), time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"month in UTC", Quota{Window: QuotaMonth}, time.Date(2025, time.December, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"day ahead of UTC", Quota{Window: QuotaDay, UTCOffset: 9 * time.Hour}, time.Date(2025, time.December, 31, 15, 0, 0, 0, time.UTC), time.Date(2026, time.January, 1, 15, 0, 0, 0, time.UTC)},
+		{"month ahead of UTC", Quota{Window: QuotaMonth, UTCOffset: 9 * time.Hour}, time.Date(2025, time.December, 31, 15, 0, 0, 0, time.UTC), time.Date(2026, time.January, 31, 15, 0, 0, 0, time.UTC)},
+		{"day behind UTC", Quota{Window: QuotaDay, UTCOffset: -5 * time.Hour}, time.Date(2025, time.December, 31, 5, 0, 0, 0, time.UTC), time.Date(2026, time.January, 1, 5, 0, 0, 0, time.UTC)},
+		{"fixed hour", Quota{Window: QuotaFixed, Period: time.Hour}, time.Date(2025, time.December, 31, 22, 0, 0, 0, time.UTC), time.Date(2025, time.December, 31, 23, 0, 0, 0, time.UTC)},
+		{"fixed 90 minutes ignores the offset", Quota{Window: QuotaFixed, Period: 90 * time.Minute, UTCOffset: 9 * time.Hour}, time.Date(2025, time.December, 31, 21, 0, 0, 0, time.UTC), time.Date(2025, time.December, 31, 22, 30, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		start, end := quotaWindow(tt.quota, newYearsEve)
+		if !start.Equal(tt.start) || !end.Equal(tt.end) {
+			t.Errorf("%s: expected [%v, %v), got [%v, %v)", tt.name, tt.start, tt.end, start.UTC(), end.UTC())
+		}
+	}
+}
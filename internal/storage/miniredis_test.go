@@ -0,0 +1,679 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newMiniredisStorage runs a RedisStorage against an in-process miniredis, so
+// the Lua scripts really execute without needing Docker.
+func newMiniredisStorage(t testing.TB, opts ...RedisStorageOption) (*RedisStorage, *miniredis.Miniredis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	storage, err := NewRedisStorageWithOptions(server.Addr(), "", 0, DefaultRedisOptions(), opts...)
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+	t.Cleanup(func() { storage.Close() })
+	return storage, server
+}
+
+func TestMiniredis_TokenBucketAllowsThenDenies(t *testing.T) {
+	storage, _ := newMiniredisStorage(t)
+
+	for i := 1; i <= 3; i++ {
+		result, err := storage.AtomicTokenBucket("endpoint:/api/list", 30, 1, 10, time.Hour)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !result.Allowed || result.Remaining != int64(30-10*i) {
+			t.Fatalf("request %d: expected allowed with %d left, got %+v", i, 30-10*i, result)
+		}
+	}
+
+	result, err := storage.AtomicTokenBucket("endpoint:/api/list", 30, 1, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Allowed {
+		t.Fatalf("expected an empty bucket to deny, got %+v", result)
+	}
+	if result.RetryAfter < 9*time.Second || result.RetryAfter > 10*time.Second {
+		t.Errorf("expected about 10s until 10 tokens refill at 1/s, got %v", result.RetryAfter)
+	}
+
+	result, _ = storage.AtomicTokenBucket("endpoint:/api/list", 30, 1, 31, time.Hour)
+	if result.Allowed || result.RetryAfter >= 0 {
+		t.Errorf("expected a cost above capacity to never be allowed, got %+v", result)
+	}
+}
+
+func TestMiniredis_TokenBucketRefillsOverTime(t *testing.T) {
+	storage, _ := newMiniredisStorage(t)
+
+	// Drain the bucket, then wait for 100 tokens/s to earn back at least 10
+	storage.AtomicTokenBucket("endpoint:/api/fast", 20, 100, 20, time.Hour)
+	if result, _ := storage.AtomicTokenBucket("endpoint:/api/fast", 20, 100, 10, time.Hour); result.Allowed {
+		t.Fatalf("expected a drained bucket to deny, got %+v", result)
+	}
+	time.Sleep(150 * time.Millisecond)
+	result, err := storage.AtomicTokenBucket("endpoint:/api/fast", 20, 100, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !result.Allowed {
+		t.Fatalf("expected refilled tokens to pay for the request, got %+v", result)
+	}
+
+	// Refill never exceeds capacity
+	time.Sleep(300 * time.Millisecond)
+	result, _ = storage.AtomicTokenBucket("endpoint:/api/fast", 20, 100, 0, time.Hour)
+	if result.Remaining != 20 {
+		t.Errorf("expected a full bucket of 20, got %+v", result)
+	}
+}
+
+func TestMiniredis_DualBucket(t *testing.T) {
+	storage, server := newMiniredisStorage(t)
+
+	result, err := storage.AtomicDualBucket("user:a:/api/upload:free", "global:/api/upload", 100, 1, 10, 1, 0, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !result.Allowed || result.Remaining != 0 || result.GlobalRemaining != 90 {
+		t.Fatalf("expected both buckets charged, got %+v", result)
+	}
+
+	// The user bucket is empty; the global bucket must not be charged
+	result, _ = storage.AtomicDualBucket("user:a:/api/upload:free", "global:/api/upload", 100, 1, 10, 1, 0, 10, time.Hour)
+	if result.Allowed || result.GlobalRemaining != 90 {
+		t.Fatalf("expected a user denial that leaves the global bucket alone, got %+v", result)
+	}
+
+	// Another user still draws on the shared global bucket
+	result, _ = storage.AtomicDualBucket("user:b:/api/upload:free", "global:/api/upload", 100, 1, 10, 1, 0, 5, time.Hour)
+	if !result.Allowed || result.Remaining != 5 || result.GlobalRemaining != 85 {
+		t.Fatalf("expected user b allowed from the shared bucket, got %+v", result)
+	}
+
+	if !server.Exists("rate_limit:bucket:user:a:/api/upload:free") || server.TTL("rate_limit:bucket:global:/api/upload") != time.Hour {
+		t.Error("expected buckets stored under the key prefix with the requested TTL")
+	}
+}
+
+func TestDualBucket_DenyReason(t *testing.T) {
+	redisStorage, _ := newMiniredisStorage(t)
+	for _, tt := range []struct {
+		name    string
+		storage Storage
+	}{{"miniredis", redisStorage}, {"memory", NewMemoryStorage()}} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.storage
+			// User a has 10 tokens of a global 25
+			if result, _ := s.AtomicDualBucket("user:a", "global:/x", 25, 0.001, 10, 0.001, 0, 10, time.Hour); !result.Allowed || result.Reason != "" {
+				t.Fatalf("expected an allowed check without a reason, got %+v", result)
+			}
+			if result, _ := s.AtomicDualBucket("user:a", "global:/x", 25, 0.001, 10, 0.001, 0, 10, time.Hour); result.Allowed || result.Reason != DenyUserTokens {
+				t.Errorf("expected user a's empty bucket to deny, got %+v", result)
+			}
+			s.AtomicDualBucket("user:b", "global:/x", 25, 0.001, 10, 0.001, 0, 10, time.Hour)
+			// 5 global tokens are left for user c's 10
+			if result, _ := s.AtomicDualBucket("user:c", "global:/x", 25, 0.001, 10, 0.001, 0, 10, time.Hour); result.Allowed || result.Reason != DenyGlobalTokens {
+				t.Errorf("expected the global bucket to deny, got %+v", result)
+			}
+			// The user bucket is reported when neither can pay
+			if result, _ := s.AtomicDualBucket("user:a", "global:/x", 25, 0.001, 10, 0.001, 0, 10, time.Hour); result.Reason != DenyUserTokens {
+				t.Errorf("expected the user bucket reported when both are short, got %+v", result)
+			}
+		})
+	}
+}
+
+func TestRefundTokens(t *testing.T) {
+	redisStorage, _ := newMiniredisStorage(t)
+	for _, tt := range []struct {
+		name    string
+		storage Storage
+	}{{"miniredis", redisStorage}, {"memory", NewMemoryStorage()}} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.storage
+			s.AtomicTokenBucket("endpoint:/x", 10, 0.001, 8, time.Hour)
+			if err := s.RefundTokens("endpoint:/x", 5, time.Hour); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result, _ := s.AtomicTokenBucket("endpoint:/x", 10, 0.001, 0, time.Hour); result.Remaining != 7 {
+				t.Errorf("expected 7 tokens after refunding 5 of 8, got %+v", result)
+			}
+
+			// A refund larger than what was taken stops at capacity
+			s.RefundTokens("endpoint:/x", 100, time.Hour)
+			if result, _ := s.AtomicTokenBucket("endpoint:/x", 10, 0.001, 0, time.Hour); result.Remaining != 10 {
+				t.Errorf("expected the refund clamped at capacity 10, got %+v", result)
+			}
+
+			// Both buckets of a dual check, including one in debt
+			s.AtomicDualBucket("user:a", "global:/y", 100, 0.001, 10, 0.001, 5, 15, time.Hour)
+			s.RefundTokens("user:a", 15, time.Hour)
+			s.RefundTokens("global:/y", 15, time.Hour)
+			if result, _ := s.AtomicDualBucket("user:a", "global:/y", 100, 0.001, 10, 0.001, 5, 0, time.Hour); result.Remaining != 10 || result.GlobalRemaining != 100 {
+				t.Errorf("expected both buckets back to full, got %+v", result)
+			}
+
+			// A bucket that was never checked is full already
+			if err := s.RefundTokens("user:nobody", 5, time.Hour); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result, _ := s.AtomicTokenBucket("user:nobody", 3, 0.001, 3, time.Hour); !result.Allowed || result.Remaining != 0 {
+				t.Errorf("expected the refund to leave a new bucket alone, got %+v", result)
+			}
+		})
+	}
+}
+
+func TestClock_RefillsWithoutSleeping(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	clock := func() time.Time { return now }
+	server := miniredis.RunT(t)
+	redisStorage, err := NewRedisStorageWithOptions(server.Addr(), "", 0, DefaultRedisOptions(), WithClock(clock))
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+	t.Cleanup(func() { redisStorage.Close() })
+
+	for _, tt := range []struct {
+		name    string
+		storage Storage
+	}{{"miniredis", redisStorage}, {"memory", NewMemoryStorageWithOptions(MemoryOptions{Clock: clock})}} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.storage
+			now = start
+			if result, _ := s.AtomicTokenBucket("endpoint:/x", 100, 10, 100, time.Hour); !result.Allowed || result.Remaining != 0 {
+				t.Fatalf("expected the bucket drained, got %+v", result)
+			}
+
+			// Two seconds at 10 tokens a second
+			now = now.Add(2 * time.Second)
+			if result, _ := s.AtomicTokenBucket("endpoint:/x", 100, 10, 10, time.Hour); !result.Allowed || result.Remaining != 10 {
+				t.Errorf("expected 20 tokens refilled less a cost of 10, got %+v", result)
+			}
+			// No time passes, so nothing is refilled
+			if result, _ := s.AtomicTokenBucket("endpoint:/x", 100, 10, 20, time.Hour); result.Allowed || result.Remaining != 10 || result.RetryAfter != time.Second {
+				t.Errorf("expected a denial one second short, got %+v", result)
+			}
+
+			s.AtomicDualBucket("user:a", "global:/y", 50, 5, 10, 1, 0, 10, time.Hour)
+			now = now.Add(3 * time.Second)
+			if result, _ := s.AtomicDualBucket("user:a", "global:/y", 50, 5, 10, 1, 0, 0, time.Hour); result.Remaining != 3 || result.GlobalRemaining != 50 {
+				t.Errorf("expected 3 user tokens and a full global bucket, got %+v", result)
+			}
+		})
+	}
+}
+
+func TestShrinkingCapacityClamps(t *testing.T) {
+	redisStorage, _ := newMiniredisStorage(t)
+
+	for _, tt := range []struct {
+		name    string
+		storage Storage
+	}{{"miniredis", redisStorage}, {"memory", NewMemoryStorage()}} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.storage
+			// Refills are too slow to add a token between these calls
+			// A bucket filled under a capacity of 1000 is clamped, not reset,
+			// when the capacity drops to 100
+			s.AtomicDualBucket("user:a", "global:/x", 10000, 0.001, 1000, 0.001, 0, 10, time.Hour)
+			result, _ := s.AtomicDualBucket("user:a", "global:/x", 2000, 0.001, 100, 0.001, 0, 10, time.Hour)
+			if !result.Allowed || result.Remaining != 90 || result.GlobalRemaining != 1990 {
+				t.Errorf("expected user 90 and global 1990, got %+v", result)
+			}
+			if result, _ := s.AtomicTokenBucket("endpoint:/x", 1000, 0.001, 0, time.Hour); result.Remaining != 1000 {
+				t.Fatalf("expected a full bucket, got %+v", result)
+			}
+			if result, _ := s.AtomicTokenBucket("endpoint:/x", 100, 0.001, 0, time.Hour); result.Remaining != 100 {
+				t.Errorf("expected the single bucket clamped to 100, got %+v", result)
+			}
+			// Growing back doesn't restore what was clamped
+			if result, _ := s.AtomicTokenBucket("endpoint:/x", 1000, 0.001, 0, time.Hour); result.Remaining != 100 {
+				t.Errorf("expected 100 tokens after growing back, got %+v", result)
+			}
+
+			// The user+ip, quota and multi-resource scripts clamp the same way
+			s.AtomicUserIPBucket("user:c", "ip:c", 1000, 0.001, 0, 500, 0.001, 10, time.Hour)
+			if result, _ := s.AtomicUserIPBucket("user:c", "ip:c", 100, 0.001, 0, 50, 0.001, 10, time.Hour); result.Remaining != 90 || result.IPRemaining != 40 {
+				t.Errorf("expected user 90 and ip 40, got %+v", result)
+			}
+			quotas := []Quota{{Key: "quota:user:d", Amount: 1000, Window: QuotaDay}}
+			s.AtomicQuotaBucket("user:d", "global:/q", 10000, 0.001, 1000, 0.001, 0, 10, quotas, time.Hour)
+			if result, _ := s.AtomicQuotaBucket("user:d", "global:/q", 2000, 0.001, 100, 0.001, 0, 10, quotas, time.Hour); result.Remaining != 90 || result.GlobalRemaining != 1990 {
+				t.Errorf("expected user 90 and global 1990 with a quota, got %+v", result)
+			}
+			resources := []ResourceBucket{{Key: "gpu:e", Capacity: 50, RefillRate: 0.001, Cost: 1}}
+			s.AtomicMultiBucket("user:e", "global:/m", 10000, 0.001, 1000, 0.001, 0, 10, resources, time.Hour)
+			if result, _ := s.AtomicMultiBucket("user:e", "global:/m", 2000, 0.001, 100, 0.001, 0, 10, resources, time.Hour); result.Remaining != 90 || result.GlobalRemaining != 1990 {
+				t.Errorf("expected user 90 and global 1990 with resources, got %+v", result)
+			}
+
+			// What a top-up added above the old capacity survives the clamp
+			if balance, _ := s.TopUpBucket("user:b", 100, 0.001, 50, 150, time.Hour); balance != 150 {
+				t.Fatalf("expected a balance of 150, got %d", balance)
+			}
+			result, _ = s.AtomicDualBucket("user:b", "global:/x", 2000, 0.001, 50, 0.001, 0, 10, time.Hour)
+			if !result.Allowed || result.Remaining != 90 {
+				t.Errorf("expected the 50 token bonus kept on top of the new capacity of 50, less 10, got %+v", result)
+			}
+		})
+	}
+}
+
+func TestMiniredis_DualBucketDebt(t *testing.T) {
+	storage, _ := newMiniredisStorage(t)
+
+	result, _ := storage.AtomicDualBucket("user:a", "global:/x", 1000, 100, 10, 1, 5, 15, time.Hour)
+	if !result.Allowed || result.Remaining != -5 {
+		t.Fatalf("expected borrowing 5 tokens, got %+v", result)
+	}
+	result, _ = storage.AtomicDualBucket("user:a", "global:/x", 1000, 100, 10, 1, 5, 1, time.Hour)
+	if result.Allowed {
+		t.Fatalf("expected denial beyond max_debt, got %+v", result)
+	}
+}
+
+func TestMiniredis_DegradedCheckKeepsDualState(t *testing.T) {
+	storage, _ := newMiniredisStorage(t)
+
+	storage.AtomicDualBucket("user:a", "global:/x", 100, 1, 100, 1, 0, 10, time.Hour)
+
+	// A global-only fallback charges the global bucket where the dual check left it
+	result, err := storage.tokenBucket("global:/x", 100, 1, 10, time.Hour, "", "", "", "global_")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !result.Allowed || result.Remaining != 80 {
+		t.Fatalf("expected the fallback to continue from 90 tokens, got %+v", result)
+	}
+
+	// And the next dual check continues from the fallback's balance
+	result, _ = storage.AtomicDualBucket("user:a", "global:/x", 100, 1, 100, 1, 0, 10, time.Hour)
+	if !result.Allowed || result.Remaining != 80 || result.GlobalRemaining != 70 {
+		t.Fatalf("expected user 80 and global 70, got %+v", result)
+	}
+}
+
+func TestMiniredis_SetBucketTokens(t *testing.T) {
+	storage, server := newMiniredisStorage(t)
+
+	// A new bucket is primed for whichever check reads it first
+	if err := storage.SetBucketTokens("endpoint:/api/list", 5, time.Minute); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result, _ := storage.AtomicTokenBucket("endpoint:/api/list", 100, 0, 5, time.Hour); !result.Allowed || result.Remaining != 0 {
+		t.Fatalf("expected the primed 5 tokens to be spent, got %+v", result)
+	}
+	storage.SetBucketTokens("user:a", 3, time.Minute)
+	storage.SetBucketTokens("global:/x", 50, time.Minute)
+	result, _ := storage.AtomicDualBucket("user:a", "global:/x", 100, 0, 100, 0, 0, 2, time.Hour)
+	if !result.Allowed || result.Remaining != 1 || result.GlobalRemaining != 48 {
+		t.Fatalf("expected user 1 and global 48, got %+v", result)
+	}
+
+	// An existing bucket keeps its format, so the dual check still reads it
+	storage.SetBucketTokens("user:a", 0, time.Minute)
+	if result, _ := storage.AtomicDualBucket("user:a", "global:/x", 100, 0, 100, 0, 0, 1, time.Hour); result.Allowed || result.Remaining != 0 {
+		t.Fatalf("expected the emptied user bucket to deny, got %+v", result)
+	}
+	if ttl := server.TTL("rate_limit:bucket:user:a"); ttl != time.Hour {
+		t.Errorf("expected the check to set its own TTL afterwards, got %v", ttl)
+	}
+}
+
+func TestMiniredis_BucketTokens(t *testing.T) {
+	storage, server := newMiniredisStorage(t)
+
+	if _, ok, err := storage.BucketTokens("endpoint:/x"); err != nil || ok {
+		t.Fatalf("expected a missing bucket to read as absent, got %v, %v", ok, err)
+	}
+
+	// Each format is read as it was left, and left as it was. Refills are too
+	// slow to add a token while the test runs
+	storage.AtomicTokenBucket("endpoint:/x", 100, 0.001, 70, time.Hour)
+	storage.AtomicDualBucket("user:a", "global:/y", 50, 0.001, 10, 0.001, 0, 7, time.Hour)
+	for key, want := range map[string]int64{"endpoint:/x": 30, "user:a": 3, "global:/y": 43} {
+		before, _ := server.Get("rate_limit:bucket:" + key)
+		if tokens, ok, err := storage.BucketTokens(key); err != nil || !ok || tokens != want {
+			t.Errorf("%s: expected %d tokens, got %d, %v, %v", key, want, tokens, ok, err)
+		}
+		if after, _ := server.Get("rate_limit:bucket:" + key); after != before {
+			t.Errorf("%s: expected reading to leave the bucket alone, got %s from %s", key, after, before)
+		}
+	}
+
+	// The refill owed since the last check is included, up to capacity
+	lastRefill := time.Now().Add(-3 * time.Second).UnixMilli()
+	server.Set("rate_limit:bucket:user:b", fmt.Sprintf(`{"user_tokens":2,"user_last_refill":%d,"user_capacity":10,"user_refill_rate":1}`, lastRefill))
+	server.Set("rate_limit:bucket:global:/z", fmt.Sprintf(`{"global_tokens":45,"global_last_refill":%d,"global_capacity":50,"global_refill_rate":5}`, lastRefill))
+	if tokens, _, err := storage.BucketTokens("user:b"); err != nil || tokens != 5 {
+		t.Errorf("expected 3 tokens of refill, got %d, %v", tokens, err)
+	}
+	if tokens, _, err := storage.BucketTokens("global:/z"); err != nil || tokens != 50 {
+		t.Errorf("expected the refill to stop at capacity, got %d, %v", tokens, err)
+	}
+
+	// A bucket only primed by SetBucketTokens reads as primed
+	storage.SetBucketTokens("user:c", 7, time.Minute)
+	if tokens, ok, err := storage.BucketTokens("user:c"); err != nil || !ok || tokens != 7 {
+		t.Errorf("expected 7 primed tokens, got %d, %v, %v", tokens, ok, err)
+	}
+}
+
+func TestMiniredis_InitialBucket(t *testing.T) {
+	storage, _ := newMiniredisStorage(t)
+
+	if result, _ := storage.AtomicInitialBucket("endpoint:/x", "", 0, 0, 0, 100, 0, 0, 0, 1, time.Hour); result.Allowed || result.Remaining != 0 {
+		t.Fatalf("expected the new bucket to start empty, got %+v", result)
+	}
+	result, _ := storage.AtomicInitialBucket("user:a", "global:/x", 1000, 0, 500, 100, 0, 20, 0, 5, time.Hour)
+	if !result.Allowed || result.Remaining != 15 || result.GlobalRemaining != 495 {
+		t.Fatalf("expected user 15 and global 495, got %+v", result)
+	}
+	// The buckets are in the dual format, so a plain dual check reads them
+	if result, _ := storage.AtomicDualBucket("user:a", "global:/x", 1000, 0, 100, 0, 0, 5, time.Hour); !result.Allowed || result.Remaining != 10 || result.GlobalRemaining != 490 {
+		t.Errorf("expected user 10 and global 490, got %+v", result)
+	}
+	// Existing buckets are left as they are
+	if result, _ := storage.AtomicInitialBucket("user:a", "global:/x", 1000, 0, 0, 100, 0, 0, 0, 5, time.Hour); !result.Allowed || result.Remaining != 5 {
+		t.Errorf("expected the existing bucket to keep its balance, got %+v", result)
+	}
+}
+
+func TestMiniredis_DeleteBucket(t *testing.T) {
+	storage, server := newMiniredisStorage(t)
+
+	storage.ReserveTokenBucket("r1", time.Minute, "endpoint:/api/list", 5, 0, 5, time.Hour)
+	if deleted, err := storage.DeleteBucket("endpoint:/api/list"); err != nil || !deleted {
+		t.Fatalf("expected the bucket to be deleted, got %v (err %v)", deleted, err)
+	}
+	if server.Exists("rate_limit:bucket:endpoint:/api/list:res") {
+		t.Error("expected the bucket's reservations to be deleted with it")
+	}
+	if result, _ := storage.AtomicTokenBucket("endpoint:/api/list", 5, 0, 1, time.Hour); !result.Allowed || result.Remaining != 4 {
+		t.Errorf("expected the deleted bucket to start full, got %+v", result)
+	}
+	if deleted, _ := storage.DeleteBucket("endpoint:/api/missing"); deleted {
+		t.Error("expected nothing to delete")
+	}
+}
+
+func TestMiniredis_UserIPBucket(t *testing.T) {
+	storage, server := newMiniredisStorage(t)
+
+	// Users sharing an IP are each under their own limit, but the IP's 10
+	// tokens only cover two requests of cost 4
+	for _, user := range []string{"user:a", "user:b"} {
+		result, err := storage.AtomicUserIPBucket(user, "ip:203.0.113.7", 5, 1, 0, 10, 1, 4, time.Hour)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !result.Allowed || result.Remaining != 1 {
+			t.Fatalf("%s: expected allowed with 1 left, got %+v", user, result)
+		}
+	}
+	result, _ := storage.AtomicUserIPBucket("user:c", "ip:203.0.113.7", 5, 1, 0, 10, 1, 4, time.Hour)
+	if result.Allowed || result.Remaining != 5 || result.IPRemaining != 2 || result.RetryAfter <= 0 {
+		t.Fatalf("expected a denial by the IP bucket, got %+v", result)
+	}
+	if server.Exists("rate_limit:bucket:user:c") {
+		t.Error("expected a denial to write nothing")
+	}
+
+	// The user bucket may borrow; the IP bucket never does
+	result, _ = storage.AtomicUserIPBucket("user:d", "ip:198.51.100.1", 5, 1, 3, 10, 1, 8, time.Hour)
+	if !result.Allowed || result.Remaining != -3 || result.IPRemaining != 2 {
+		t.Fatalf("expected the user bucket to borrow 3, got %+v", result)
+	}
+	result, _ = storage.AtomicUserIPBucket("user:e", "ip:198.51.100.2", 20, 1, 0, 10, 1, 11, time.Hour)
+	if result.Allowed || result.RetryAfter >= 0 {
+		t.Fatalf("expected a cost above the IP capacity to never pass, got %+v", result)
+	}
+}
+
+func TestMiniredis_ReservationRelease(t *testing.T) {
+	storage, _ := newMiniredisStorage(t)
+
+	result, err := storage.ReserveDualBucket("r1", time.Minute, "user:a", "global:/x", 100, 1, 10, 1, 0, 4, time.Hour)
+	if err != nil || !result.Allowed {
+		t.Fatalf("expected reservation, got %+v (err %v)", result, err)
+	}
+	if ok, err := storage.ReleaseReservation("r1"); err != nil || !ok {
+		t.Fatalf("expected release, got %v (err %v)", ok, err)
+	}
+	result, _ = storage.AtomicDualBucket("user:a", "global:/x", 100, 1, 10, 1, 0, 0, time.Hour)
+	if result.Remaining != 10 || result.GlobalRemaining != 100 {
+		t.Errorf("expected released tokens back in both buckets, got %+v", result)
+	}
+}
+
+func TestMiniredis_MultiBucket(t *testing.T) {
+	storage, server := newMiniredisStorage(t)
+	resources := []ResourceBucket{
+		{Key: "user:a:/llm:free:resource:spend", Capacity: 50, RefillRate: 0.001, Cost: 20},
+		{Key: "user:a:/llm:free:resource:tokens", Capacity: 1000, RefillRate: 0.001, Cost: 600},
+	}
+
+	result, err := storage.AtomicMultiBucket("user:a:/llm:free", "global:/llm", 100, 0.001, 10, 0.001, 0, 1, resources, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !result.Allowed || result.Remaining != 9 || result.GlobalRemaining != 99 || len(result.Resources) != 2 || result.Resources[0] != 30 || result.Resources[1] != 400 {
+		t.Fatalf("expected every bucket charged, got %+v", result)
+	}
+
+	// The tokens resource can't pay; no bucket may be charged
+	result, _ = storage.AtomicMultiBucket("user:a:/llm:free", "global:/llm", 100, 0.001, 10, 0.001, 0, 1, resources, time.Hour)
+	if result.Allowed || result.Remaining != 9 || result.GlobalRemaining != 99 || result.Resources[0] != 30 || result.Resources[1] != 400 {
+		t.Fatalf("expected an all-or-nothing denial, got %+v", result)
+	}
+	if result.RetryAfter <= 0 {
+		t.Errorf("expected a wait for the tokens bucket, got %v", result.RetryAfter)
+	}
+
+	// Resource buckets share the single-bucket format, so the plain script
+	// reads the same balance
+	single, _ := storage.AtomicTokenBucket("user:a:/llm:free:resource:spend", 50, 0.001, 0, time.Hour)
+	if single.Remaining != 30 {
+		t.Errorf("expected spend balance 30 via the single-bucket script, got %+v", single)
+	}
+	if !server.Exists("rate_limit:bucket:user:a:/llm:free:resource:tokens") {
+		t.Error("expected resource buckets stored under the key prefix")
+	}
+}
+
+func TestMiniredis_QuotaBucket(t *testing.T) {
+	// A fixed clock keeps the buckets from refilling between checks
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	storage, server := newMiniredisStorage(t, WithClock(func() time.Time { return now }))
+	daily := Quota{Key: "quota:user:a", Amount: 3, Window: QuotaDay}
+
+	// The bucket has plenty, so the quota is what runs out
+	for i := int64(1); i <= 3; i++ {
+		result, err := storage.AtomicQuotaBucket("user:a", "global:/x", 1000, 100, 100, 10, 0, 1, []Quota{daily}, time.Hour)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !result.Allowed || len(result.Quotas) != 1 || result.Quotas[0].Remaining != 3-i {
+			t.Fatalf("request %d: expected allowed with %d left in the quota, got %+v", i, 3-i, result)
+		}
+	}
+	result, _ := storage.AtomicQuotaBucket("user:a", "global:/x", 1000, 100, 100, 10, 0, 1, []Quota{daily}, time.Hour)
+	midnight := time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)
+	if result.Allowed || result.Remaining != 97 || result.GlobalRemaining != 997 {
+		t.Fatalf("expected a denial that charges neither bucket, got %+v", result)
+	}
+	if !result.Quotas[0].ResetsAt.Equal(midnight) {
+		t.Errorf("expected the quota to reset at %v, got %v", midnight, result.Quotas[0].ResetsAt)
+	}
+	if wait := midnight.Sub(now); result.RetryAfter != wait {
+		t.Errorf("expected to retry at midnight (%v), got %v", wait, result.RetryAfter)
+	}
+
+	// A counter from an earlier window starts over
+	server.Set("rate_limit:bucket:quota:user:a", `{"window_start":0,"used":3}`)
+	if result, _ := storage.AtomicQuotaBucket("user:a", "global:/x", 1000, 100, 100, 10, 0, 1, []Quota{daily}, time.Hour); !result.Allowed || result.Quotas[0].Remaining != 2 {
+		t.Errorf("expected a new window after rollover, got %+v", result)
+	}
+
+	// Without a global key the bucket is a single one in the plain format
+	result, _ = storage.AtomicQuotaBucket("endpoint:/y", "", 0, 0, 10, 1, 0, 4, []Quota{{Key: "quota:global:/y", Amount: 100, Window: QuotaMonth}}, time.Hour)
+	if !result.Allowed || result.Remaining != 6 || result.Quotas[0].Remaining != 96 {
+		t.Fatalf("expected a single bucket check, got %+v", result)
+	}
+	if single, _ := storage.AtomicTokenBucket("endpoint:/y", 10, 1, 0, time.Hour); single.Remaining != 6 {
+		t.Errorf("expected the single bucket script to see the same state, got %+v", single)
+	}
+}
+
+func TestMiniredis_FixedWindowCap(t *testing.T) {
+	storage, _ := newMiniredisStorage(t)
+	hourly := Quota{Key: "quota:endpoint:/search:cap", Amount: 5, Window: QuotaFixed, Period: time.Hour}
+
+	// A burst of 100 tokens, but only 5 requests an hour
+	for i := int64(1); i <= 5; i++ {
+		result, err := storage.AtomicQuotaBucket("endpoint:/search", "", 0, 0, 100, 1, 0, 1, []Quota{hourly}, time.Hour)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !result.Allowed || result.Remaining != 100-i || result.Quotas[0].Remaining != 5-i {
+			t.Fatalf("request %d: expected allowed, got %+v", i, result)
+		}
+	}
+	result, _ := storage.AtomicQuotaBucket("endpoint:/search", "", 0, 0, 100, 1, 0, 1, []Quota{hourly}, time.Hour)
+	if result.Allowed || result.Remaining != 95 || result.Quotas[0].Remaining != 0 {
+		t.Fatalf("expected the cap to deny with tokens left in the bucket, got %+v", result)
+	}
+	nextHour := time.Now().Truncate(time.Hour).Add(time.Hour)
+	if !result.Quotas[0].ResetsAt.Equal(nextHour) {
+		t.Errorf("expected the cap to reset at %v, got %v", nextHour, result.Quotas[0].ResetsAt)
+	}
+	if wait := time.Until(nextHour); result.RetryAfter < wait-time.Second || result.RetryAfter > wait+time.Second {
+		t.Errorf("expected to retry at the next window (%v), got %v", wait, result.RetryAfter)
+	}
+}
+
+func TestMiniredis_QuotaWindowsMatchMemory(t *testing.T) {
+	storage, _ := newMiniredisStorage(t)
+	offsets := []time.Duration{0, -5 * time.Hour, 9 * time.Hour, 5*time.Hour + 30*time.Minute, -14 * time.Hour, 14 * time.Hour}
+	for _, window := range []QuotaWindow{QuotaDay, QuotaMonth} {
+		for _, offset := range offsets {
+			quota := Quota{Key: fmt.Sprintf("quota:%s:%v", window, offset), Amount: 10, Window: window, UTCOffset: offset}
+			result, err := storage.AtomicQuotaBucket("endpoint:/z", "", 0, 0, 100, 1, 0, 1, []Quota{quota}, time.Hour)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			_, end := quotaWindow(quota, time.Now())
+			if !result.Quotas[0].ResetsAt.Equal(end) {
+				t.Errorf("%s at UTC%+v: script resets at %v, memory at %v", window, offset, result.Quotas[0].ResetsAt.UTC(), end.UTC())
+			}
+		}
+	}
+	for _, period := range []time.Duration{time.Second, 90 * time.Minute, 7 * 24 * time.Hour} {
+		quota := Quota{Key: fmt.Sprintf("quota:fixed:%v", period), Amount: 10, Window: QuotaFixed, Period: period}
+		result, err := storage.AtomicQuotaBucket("endpoint:/z", "", 0, 0, 100, 1, 0, 1, []Quota{quota}, time.Hour)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// The script and this check may straddle a one-second boundary
+		_, end := quotaWindow(quota, time.Now())
+		if got := result.Quotas[0].ResetsAt; !got.Equal(end) && !(period == time.Second && end.Sub(got) == time.Second) {
+			t.Errorf("fixed %v: script resets at %v, memory at %v", period, got.UTC(), end.UTC())
+		}
+	}
+}
+
+func TestMiniredis_PoolStats(t *testing.T) {
+	storage, _ := newMiniredisStorage(t)
+	if err := storage.Ping(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stats := storage.PoolStats()
+	if stats.Size != DefaultRedisOptions().PoolSize || stats.Used != 0 || stats.Idle != 1 {
+		t.Errorf("expected one idle connection in a pool of %d, got %+v", DefaultRedisOptions().PoolSize, stats)
+	}
+}
+
+func TestMiniredis_RuleStore(t *testing.T) {
+	storage, server := newMiniredisStorage(t)
+	store, err := storage.RuleStore("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if data, err := store.Load(); err != nil || data != nil {
+		t.Fatalf("expected no rules before a publish, got %q (err %v)", data, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := store.Subscribe(ctx)
+	// The subscription is registered asynchronously
+	deadline := time.Now().Add(2 * time.Second)
+	for server.PubSubNumSub(DefaultRulesKey + ":updates")[DefaultRulesKey+":updates"] == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected a subscriber")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rules := []byte("ips:\n  capacity: 500\n  refill_rate: 50\n")
+	if err := store.Publish(rules); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	select {
+	case <-updates:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a notification for the published rules")
+	}
+	if data, err := store.Load(); err != nil || string(data) != string(rules) {
+		t.Errorf("expected the published rules back, got %q (err %v)", data, err)
+	}
+}
+
+// The benchmarks run the Lua scripts on miniredis, which is slower than a
+// real Redis and counts its own allocations in with the client's, but
+// catches regressions without Docker. MemoryStorage is the same call
+// without a round trip.
+func benchmarkStorages(b *testing.B, run func(b *testing.B, s Storage)) {
+	redisStorage, _ := newMiniredisStorage(b)
+	for _, bench := range []struct {
+		name    string
+		storage Storage
+	}{{"miniredis", redisStorage}, {"memory", NewMemoryStorage()}} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			run(b, bench.storage)
+		})
+	}
+}
+
+func BenchmarkAtomicTokenBucket(b *testing.B) {
+	benchmarkStorages(b, func(b *testing.B, s Storage) {
+		for i := 0; i < b.N; i++ {
+			if _, err := s.AtomicTokenBucket("endpoint:/api/bench", 1<<40, 1e9, 1, time.Hour); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkAtomicDualBucket(b *testing.B) {
+	benchmarkStorages(b, func(b *testing.B, s Storage) {
+		for i := 0; i < b.N; i++ {
+			if _, err := s.AtomicDualBucket("user:alice:/api/bench:free", "global:/api/bench", 1<<40, 1e9, 1<<40, 1e9, 0, 1, time.Hour); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,37 @@
+-- peek.lua: read a bucket's balance, with the refill owed so far, without
+-- charging or rewriting it. Works on buckets in any script's state format.
+-- Returns false for a bucket that doesn't exist, as the next check starts it
+-- full.
+local key = KEYS[1]
+local now = tonumber(ARGV[1])
+
+local state = redis.call('GET', key)
+if not state then
+    return false
+end
+local decoded = cjson.decode(state)
+
+-- Single-bucket, dual per-key and dual global fields respectively. A bucket
+-- only set by /admin/set has every format's tokens and no capacity yet
+local prefix
+for _, candidate in ipairs({'', 'user_', 'global_'}) do
+    if decoded[candidate .. 'capacity'] ~= nil then
+        prefix = candidate
+        break
+    end
+end
+if prefix == nil then
+    if decoded['tokens'] == nil then
+        return false
+    end
+    return math.floor(decoded['tokens'])
+end
+
+local tokens = decoded[prefix .. 'tokens']
+local last_refill = decoded[prefix .. 'last_refill']
+local capacity = decoded[prefix .. 'capacity']
+local refill_rate = decoded[prefix .. 'refill_rate']
+if now > last_refill and tokens < capacity then
+    tokens = math.min(capacity, tokens + (now - last_refill) * refill_rate / 1000)
+end
+return math.floor(tokens)
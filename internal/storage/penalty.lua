@@ -0,0 +1,33 @@
+-- penalty.lua: track denials of a per-key bucket and put repeat offenders
+-- under penalty. Returns the penalty's end (unix ms), or 0 when none applies.
+local penalty_key = KEYS[1]
+local denials_key = KEYS[2]
+local mode = ARGV[1] -- 'status' only reads, 'deny' records a denial
+local now = tonumber(ARGV[2])
+
+local penalized_until = tonumber(redis.call('GET', penalty_key))
+if penalized_until and penalized_until > now then
+    return penalized_until
+end
+if mode ~= 'deny' then
+    return 0
+end
+
+local threshold = tonumber(ARGV[3])
+local window = tonumber(ARGV[4])
+local duration = tonumber(ARGV[5])
+
+-- Fixed window: the count expires with the window, so keys that back off
+-- start over
+local denials = redis.call('INCR', denials_key)
+if denials == 1 then
+    redis.call('PEXPIRE', denials_key, window)
+end
+if denials < threshold then
+    return 0
+end
+
+penalized_until = now + duration
+redis.call('SET', penalty_key, penalized_until, 'PX', duration)
+redis.call('DEL', denials_key)
+return penalized_until
@@ -0,0 +1,236 @@
+-- quota.lua: a single or dual token bucket check plus fixed-window quotas
+-- (e.g. 10,000 requests a day), all charged or none.
+local user_key = KEYS[1]
+
+local global_capacity = tonumber(ARGV[1])
+local global_refill_rate = tonumber(ARGV[2])
+local user_capacity = tonumber(ARGV[3])
+local user_refill_rate = tonumber(ARGV[4])
+local cost = tonumber(ARGV[5])
+local now = tonumber(ARGV[6])
+local ttl = tonumber(ARGV[7])
+local user_max_debt = tonumber(ARGV[8]) or 0
+-- ARGV[9] is the top consumers member
+local dual = ARGV[10] == '1'
+local quota_count = tonumber(ARGV[11])
+-- With dual set, KEYS[2] is the global bucket and KEYS[1] the per-key bucket
+-- in the dual state format; otherwise KEYS[1] is a single bucket. The quota
+-- counters follow, described by amount, window ("day", "month" or "fixed"),
+-- UTC offset in ms and fixed window length in ms from ARGV[12]; the last key
+-- is the optional top consumers window.
+local first_quota = dual and 3 or 2
+
+local DAY = 86400000
+
+-- Days since 1970-01-01 of a civil date, and back (proleptic Gregorian)
+local function days_from_civil(y, m, d)
+    if m <= 2 then
+        y = y - 1
+    end
+    local era = math.floor(y / 400)
+    local yoe = y - era * 400
+    local mp = m > 2 and m - 3 or m + 9
+    local doy = math.floor((153 * mp + 2) / 5) + d - 1
+    local doe = yoe * 365 + math.floor(yoe / 4) - math.floor(yoe / 100) + doy
+    return era * 146097 + doe - 719468
+end
+
+local function civil_from_days(days)
+    local z = days + 719468
+    local era = math.floor(z / 146097)
+    local doe = z - era * 146097
+    local yoe = math.floor((doe - math.floor(doe / 1460) + math.floor(doe / 36524) - math.floor(doe / 146096)) / 365)
+    local y = yoe + era * 400
+    local doy = doe - (365 * yoe + math.floor(yoe / 4) - math.floor(yoe / 100))
+    local mp = math.floor((5 * doy + 2) / 153)
+    local m = mp < 10 and mp + 3 or mp - 9
+    if m <= 2 then
+        y = y + 1
+    end
+    return y, m
+end
+
+-- The window containing now, as unix ms, computed here so every instance
+-- agrees on the boundaries
+local function window_bounds(window, offset, period)
+    if window == 'fixed' then
+        local start = now - now % period
+        return start, start + period
+    end
+    local local_now = now + offset
+    local start, finish
+    if window == 'month' then
+        local y, m = civil_from_days(math.floor(local_now / DAY))
+        start = days_from_civil(y, m, 1) * DAY
+        if m == 12 then
+            finish = days_from_civil(y + 1, 1, 1) * DAY
+        else
+            finish = days_from_civil(y, m + 1, 1) * DAY
+        end
+    else
+        start = local_now - local_now % DAY
+        finish = start + DAY
+    end
+    return start - offset, finish - offset
+end
+
+-- A capacity that shrank since the bucket was written, e.g. at the end of a
+-- schedule, clamps the balance to it rather than resetting it. Only what a
+-- top-up added above the old capacity is kept on top.
+local function clamp(tokens, old_capacity, capacity)
+    if old_capacity ~= nil and capacity < old_capacity and tokens > capacity then
+        return capacity + math.max(0, tokens - old_capacity)
+    end
+    return tokens
+end
+
+local function refill(tokens, last_refill, capacity, refill_rate)
+    if now > last_refill then
+        if tokens < capacity then
+            tokens = math.min(capacity, tokens + (now - last_refill) * refill_rate / 1000)
+        end
+        last_refill = now
+    end
+    return tokens, last_refill
+end
+
+-- Return tokens held by reservations that expired without commit/release.
+-- Members are "<id>:<cost>" scored by their expiry time.
+local function release_expired(bucket_key, tokens, capacity)
+    local reservations_key = bucket_key .. ':res'
+    local expired = redis.call('ZRANGEBYSCORE', reservations_key, '-inf', now)
+    if #expired > 0 then
+        for _, member in ipairs(expired) do
+            local held = tonumber(string.match(member, ':(%d+)$'))
+            tokens = math.max(tokens, math.min(capacity, tokens + held))
+        end
+        redis.call('ZREMRANGEBYSCORE', reservations_key, '-inf', now)
+    end
+    return tokens
+end
+
+-- A single bucket uses the plain state format, a dual pair the prefixed one
+local user_prefix = dual and 'user_' or ''
+local user_tokens, user_last_refill = user_capacity, now
+local user_state = redis.call('GET', user_key)
+if user_state then
+    local decoded = cjson.decode(user_state)
+    user_tokens = clamp(decoded[user_prefix .. 'tokens'], decoded[user_prefix .. 'capacity'], user_capacity)
+    user_last_refill = decoded[user_prefix .. 'last_refill']
+end
+user_tokens, user_last_refill = refill(user_tokens, user_last_refill, user_capacity, user_refill_rate)
+user_tokens = release_expired(user_key, user_tokens, user_capacity)
+
+local global_tokens, global_last_refill
+if dual then
+    global_tokens, global_last_refill = global_capacity, now
+    local global_state = redis.call('GET', KEYS[2])
+    if global_state then
+        local decoded = cjson.decode(global_state)
+        global_tokens, global_last_refill = clamp(decoded.global_tokens, decoded.global_capacity, global_capacity), decoded.global_last_refill
+    end
+    global_tokens, global_last_refill = refill(global_tokens, global_last_refill, global_capacity, global_refill_rate)
+    global_tokens = release_expired(KEYS[2], global_tokens, global_capacity)
+end
+
+-- Each counter holds the start of the window it counts; a counter from an
+-- earlier window starts over
+local quotas = {}
+for i = 1, quota_count do
+    local base = 11 + (i - 1) * 4
+    local q = {
+        key = KEYS[first_quota + i - 1],
+        amount = tonumber(ARGV[base + 1]),
+        window = ARGV[base + 2],
+        used = 0
+    }
+    q.start, q.finish = window_bounds(q.window, tonumber(ARGV[base + 3]), tonumber(ARGV[base + 4]))
+    local state = redis.call('GET', q.key)
+    if state then
+        local decoded = cjson.decode(state)
+        if decoded.window_start == q.start then
+            q.used = decoded.used
+        end
+    end
+    quotas[i] = q
+end
+
+-- Only whole tokens pay, only the per-key bucket of a dual pair may borrow,
+-- and quotas never do
+local allowed = cost <= math.floor(user_tokens) + (dual and user_max_debt or 0)
+if dual and cost > math.floor(global_tokens) then
+    allowed = false
+end
+for _, q in ipairs(quotas) do
+    if q.used + cost > q.amount then
+        allowed = false
+    end
+end
+if allowed then
+    user_tokens = user_tokens - cost
+    if dual then
+        global_tokens = global_tokens - cost
+    end
+    for _, q in ipairs(quotas) do
+        q.used = q.used + cost
+    end
+end
+
+redis.call('SET', user_key, cjson.encode({
+    [user_prefix .. 'tokens'] = user_tokens,
+    [user_prefix .. 'last_refill'] = user_last_refill,
+    [user_prefix .. 'capacity'] = user_capacity,
+    [user_prefix .. 'refill_rate'] = user_refill_rate
+}), 'EX', ttl)
+if dual then
+    redis.call('SET', KEYS[2], cjson.encode({
+        global_tokens = global_tokens,
+        global_last_refill = global_last_refill,
+        global_capacity = global_capacity,
+        global_refill_rate = global_refill_rate
+    }), 'EX', ttl)
+end
+-- Counters outlive their window by a day so a rollover is always noticed
+for _, q in ipairs(quotas) do
+    redis.call('SET', q.key, cjson.encode({window_start = q.start, used = q.used}),
+        'PX', q.finish - now + DAY)
+end
+
+local top_key = KEYS[first_quota + quota_count]
+if allowed and dual and top_key then
+    redis.call('ZINCRBY', top_key, cost, ARGV[9])
+end
+
+-- Milliseconds until everything can afford the cost; -1 when something never
+-- will. A quota that is used up waits for its window to reset.
+local retry_after = 0
+if not allowed then
+    local wait = 0
+    local user_debt = dual and user_max_debt or 0
+    if cost > user_capacity + user_debt or (dual and cost > global_capacity) then
+        wait = -1
+    else
+        wait = math.max(0, (cost - user_debt - user_tokens) * 1000 / user_refill_rate)
+        if dual then
+            wait = math.max(wait, (cost - global_tokens) * 1000 / global_refill_rate)
+        end
+    end
+    for _, q in ipairs(quotas) do
+        if cost > q.amount then
+            wait = -1
+        elseif wait >= 0 and q.used + cost > q.amount then
+            wait = math.max(wait, q.finish - now)
+        end
+    end
+    retry_after = wait < 0 and -1 or math.ceil(wait)
+end
+
+-- Return: [allowed (1/0), remaining per-key or single tokens, remaining
+-- global tokens (0 without dual), retry after ms, then each quota's remaining
+-- amount and window end in unix ms, in order]
+local reply = {allowed and 1 or 0, math.floor(user_tokens), dual and math.floor(global_tokens) or 0, retry_after}
+for _, q in ipairs(quotas) do
+    reply[#reply + 1] = q.amount - q.used
+    reply[#reply + 1] = q.finish
+end
+return reply
@@ -2,21 +2,32 @@ package storage
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
-	"os"
-	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
 type RedisStorage struct {
-	client  RedisClient
-	ctx     context.Context
-	scripts map[string]*ScriptInfo // Registry of all scripts
+	client      RedisClient
+	replica     RedisClient // Optional; serves read-only calls, see read
+	ctx         context.Context
+	scripts     map[string]*ScriptInfo // Registry of all scripts
+	scriptsMu   sync.RWMutex           // Guards scripts and their SHAs
+	pingTimeout time.Duration
+	keyPrefix   string // Prepended to every bucket key, e.g. "rate_limit:bucket"
+	tierHashKey string // Hash of key -> tier, e.g. "rate_limit:tiers"
+	topWindow   time.Duration
+	partial     PartialFailureMode
+	clock       ClockFunc // Nil means time.Now
+	topExpired  sync.Map  // globalKey -> window start (unix ms) whose sorted set has an expiry
+	closeOnce   sync.Once
 }
 
 type ScriptInfo struct {
@@ -26,112 +37,828 @@ type ScriptInfo struct {
 	LoadedAt time.Time
 }
 
-func NewRedisStorage(addr, password string, db int) *RedisStorage {
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     addr,
-		Password: password,
-		DB:       db,
-	})
+const (
+	defaultPingTimeout = 2 * time.Second
+	defaultKeyPrefix   = "rate_limit:bucket"
+	defaultTierHashKey = "rate_limit:tiers"
+	defaultTopWindow   = time.Minute
+	maxKeyPrefixLen    = 64
+)
+
+// PartialFailureMode decides what AtomicDualBucket does when the dual check
+// fails, e.g. because one of its two keys lives on an unreachable shard of a
+// Redis Cluster or proxy. With a single Redis both keys fail together, so a
+// fallback mode only adds a second failed attempt.
+type PartialFailureMode string
+
+const (
+	// PartialFailureFail returns the error, so nothing is enforced wrongly
+	// but the request fails. This is the default.
+	PartialFailureFail PartialFailureMode = "fail"
+	// PartialFailureGlobalOnly checks only the shared bucket. The endpoint
+	// stays protected, but one key may use up all of it.
+	PartialFailureGlobalOnly PartialFailureMode = "global"
+	// PartialFailureKeyOnly checks only the per-key bucket. Each key keeps
+	// its own limit, but their sum may exceed the endpoint's capacity.
+	PartialFailureKeyOnly PartialFailureMode = "key"
+)
+
+// RedisOptions holds connection settings for NewRedisStorageWithOptions.
+// Start from DefaultRedisOptions and override what you need.
+type RedisOptions struct {
+	TLSConfig *tls.Config // Enables TLS (and mTLS when it carries certificates)
+
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	PoolSize     int
+	MinIdleConns int
+	MaxRetries   int           // -1 disables retries
+	PoolTimeout  time.Duration // How long to wait for a free connection
+	PingTimeout  time.Duration // Deadline for Ping (health checks)
+
+	// KeyPrefix namespaces every bucket key so several teams can share one
+	// Redis, e.g. "team_a:rate_limit". Buckets are stored as "<prefix>:<key>".
+	KeyPrefix string
+
+	// TierHashKey is the hash mapping keys to tiers, kept outside KeyPrefix
+	// so bucket resets never clear it. It is written by SetTier or directly
+	// by a billing system with HSET.
+	TierHashKey string
+
+	// TopConsumersWindow is the length of the windows in which per-key
+	// consumption of each global bucket is counted. Zero disables tracking
+	// and its extra write per allowed dual check.
+	TopConsumersWindow time.Duration
+
+	// PartialFailureMode is how dual checks degrade when they fail.
+	PartialFailureMode PartialFailureMode
+
+	// ReplicaAddr is a read replica for calls that never consume tokens:
+	// TopConsumers, LookupTier and BucketTokens. It shares the primary's password,
+	// database, TLS and pool settings. Empty reads from the primary.
+	ReplicaAddr string
+
+	// Clock supplies the time passed to the scripts for refills; nil means
+	// time.Now. Key expiry still follows Redis's own clock.
+	Clock ClockFunc
+}
+
+// RedisStorageOption adjusts RedisOptions when constructing a RedisStorage.
+type RedisStorageOption func(*RedisOptions)
+
+// WithKeyPrefix stores buckets under prefix instead of "rate_limit:bucket".
+func WithKeyPrefix(prefix string) RedisStorageOption {
+	return func(o *RedisOptions) {
+		o.KeyPrefix = prefix
+	}
+}
+
+// WithClock computes refills from clock instead of the wall clock.
+func WithClock(clock ClockFunc) RedisStorageOption {
+	return func(o *RedisOptions) {
+		o.Clock = clock
+	}
+}
+
+// DefaultRedisOptions mirrors go-redis defaults, made explicit so they can be tuned.
+func DefaultRedisOptions() RedisOptions {
+	return RedisOptions{
+		DialTimeout:  5 * time.Second,
+		ReadTimeout:  3 * time.Second,
+		WriteTimeout: 3 * time.Second,
+		PoolSize:     10 * runtime.GOMAXPROCS(0),
+		MinIdleConns: 0,
+		MaxRetries:   3,
+		PoolTimeout:  4 * time.Second,
+		PingTimeout:  defaultPingTimeout,
+		KeyPrefix:    defaultKeyPrefix,
+		TierHashKey:  defaultTierHashKey,
+
+		TopConsumersWindow: defaultTopWindow,
+		PartialFailureMode: PartialFailureFail,
+	}
+}
+
+func (o RedisOptions) validate() error {
+	if o.PoolSize <= 0 {
+		return fmt.Errorf("redis pool size must be positive, got %d", o.PoolSize)
+	}
+	if o.MinIdleConns < 0 || o.MinIdleConns > o.PoolSize {
+		return fmt.Errorf("redis min idle conns must be between 0 and pool size %d, got %d", o.PoolSize, o.MinIdleConns)
+	}
+	if o.MaxRetries < -1 {
+		return fmt.Errorf("redis max retries must be -1 (disabled) or more, got %d", o.MaxRetries)
+	}
+	timeouts := map[string]time.Duration{
+		"dial timeout":  o.DialTimeout,
+		"read timeout":  o.ReadTimeout,
+		"write timeout": o.WriteTimeout,
+		"pool timeout":  o.PoolTimeout,
+		"ping timeout":  o.PingTimeout,
+	}
+	for name, d := range timeouts {
+		if d <= 0 {
+			return fmt.Errorf("redis %s must be positive, got %v", name, d)
+		}
+	}
+	if o.TopConsumersWindow < 0 {
+		return fmt.Errorf("redis top consumers window must not be negative, got %v", o.TopConsumersWindow)
+	}
+	if o.KeyPrefix == "" || len(o.KeyPrefix) > maxKeyPrefixLen {
+		return fmt.Errorf("redis key prefix must be 1-%d characters, got %q", maxKeyPrefixLen, o.KeyPrefix)
+	}
+	if strings.HasPrefix(o.KeyPrefix, ":") || strings.HasSuffix(o.KeyPrefix, ":") {
+		return fmt.Errorf("redis key prefix must not start or end with ':', got %q", o.KeyPrefix)
+	}
+	if o.TierHashKey == "" {
+		return fmt.Errorf("redis tier hash key must not be empty")
+	}
+	switch o.PartialFailureMode {
+	case PartialFailureFail, PartialFailureGlobalOnly, PartialFailureKeyOnly:
+	default:
+		return fmt.Errorf("redis partial failure mode must be %q, %q or %q, got %q",
+			PartialFailureFail, PartialFailureGlobalOnly, PartialFailureKeyOnly, o.PartialFailureMode)
+	}
+	return nil
+}
+
+func NewRedisStorage(addr, password string, db int, options ...RedisStorageOption) *RedisStorage {
+	storage, err := NewRedisStorageWithOptions(addr, password, db, DefaultRedisOptions(), options...)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	return storage
+}
+
+func NewRedisStorageWithOptions(addr, password string, db int, opts RedisOptions, options ...RedisStorageOption) (*RedisStorage, error) {
+	for _, option := range options {
+		option(&opts)
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	rdb := redis.NewClient(clientOptions(addr, password, db, opts))
 
 	storage := &RedisStorage{
-		client:  rdb,
-		ctx:     context.Background(),
-		scripts: make(map[string]*ScriptInfo),
+		client:      rdb,
+		ctx:         context.Background(),
+		scripts:     make(map[string]*ScriptInfo),
+		pingTimeout: opts.PingTimeout,
+		keyPrefix:   opts.KeyPrefix,
+		tierHashKey: opts.TierHashKey,
+		topWindow:   opts.TopConsumersWindow,
+		partial:     opts.PartialFailureMode,
+		clock:       opts.Clock,
+	}
+	if opts.ReplicaAddr != "" {
+		storage.replica = redis.NewClient(clientOptions(opts.ReplicaAddr, password, db, opts))
 	}
 	// Load all scripts at startup
 	if err := storage.LoadScript("endpoint_only", "tokenbucket.lua"); err != nil {
-		log.Fatalf("❌ Failed to load script endpoint_only: %v", err)
+		storage.Close()
+		return nil, fmt.Errorf("failed to load script endpoint_only: %w", err)
 	}
 	if err := storage.LoadScript("tier_endpoint", "tokenbucket_dual.lua"); err != nil {
-		log.Fatalf("❌ Failed to load script tier_endpoint: %v", err)
+		storage.Close()
+		return nil, fmt.Errorf("failed to load script tier_endpoint: %w", err)
+	}
+	if err := storage.LoadScript("user_ip", "tokenbucket_dual_nocheck_global.lua"); err != nil {
+		storage.Close()
+		return nil, fmt.Errorf("failed to load script user_ip: %w", err)
+	}
+	if err := storage.LoadScript("multi_resource", "tokenbucket_multi.lua"); err != nil {
+		storage.Close()
+		return nil, fmt.Errorf("failed to load script multi_resource: %w", err)
+	}
+	if err := storage.LoadScript("quota", "quota.lua"); err != nil {
+		storage.Close()
+		return nil, fmt.Errorf("failed to load script quota: %w", err)
+	}
+	if err := storage.LoadScript("topup", "topup.lua"); err != nil {
+		storage.Close()
+		return nil, fmt.Errorf("failed to load script topup: %w", err)
+	}
+	if err := storage.LoadScript("refund", "refund.lua"); err != nil {
+		storage.Close()
+		return nil, fmt.Errorf("failed to load script refund: %w", err)
+	}
+	if err := storage.LoadScript("set_tokens", "setbucket.lua"); err != nil {
+		storage.Close()
+		return nil, fmt.Errorf("failed to load script set_tokens: %w", err)
+	}
+	if err := storage.LoadScript("peek", "peek.lua"); err != nil {
+		storage.Close()
+		return nil, fmt.Errorf("failed to load script peek: %w", err)
+	}
+	if err := storage.LoadScript("reservation", "reservation.lua"); err != nil {
+		storage.Close()
+		return nil, fmt.Errorf("failed to load script reservation: %w", err)
+	}
+	if err := storage.LoadScript("penalty", "penalty.lua"); err != nil {
+		storage.Close()
+		return nil, fmt.Errorf("failed to load script penalty: %w", err)
+	}
+	if storage.replica != nil {
+		// Read-only scripts run on the replica too; a failure here only sends
+		// their reads to the primary, see read
+		if err := storage.loadReplicaScript("peek"); err != nil {
+			log.Printf("⚠️ Failed to load script peek on the read replica: %v", err)
+		}
 	}
 
 	for name, script := range storage.scripts {
 		log.Printf("✅ Script loaded: %s (SHA=%s, len=%d)", name, script.SHA, len(script.Content))
 	}
-	return storage
+	return storage, nil
+}
+
+func clientOptions(addr, password string, db int, opts RedisOptions) *redis.Options {
+	return &redis.Options{
+		Addr:         addr,
+		Password:     password,
+		DB:           db,
+		TLSConfig:    opts.TLSConfig,
+		DialTimeout:  opts.DialTimeout,
+		ReadTimeout:  opts.ReadTimeout,
+		WriteTimeout: opts.WriteTimeout,
+		PoolSize:     opts.PoolSize,
+		MinIdleConns: opts.MinIdleConns,
+		MaxRetries:   opts.MaxRetries,
+		PoolTimeout:  opts.PoolTimeout,
+	}
 }
 
 func (r *RedisStorage) LoadScript(name, luaScriptName string) error {
-	_, file, _, _ := runtime.Caller(0)
-	baseDir := filepath.Dir(file) // internal/storage
-	scriptPath := filepath.Join(baseDir, luaScriptName)
-	log.Printf("DEBUG: LoadScript from %s", scriptPath)
-	content, err := os.ReadFile(scriptPath)
+	content, err := readScript(luaScriptName)
 	if err != nil {
-		return fmt.Errorf("failed to read lua script (%s): %w", scriptPath, err)
+		return fmt.Errorf("failed to read lua script (%s): %w", luaScriptName, err)
 	}
 	sha, err := r.client.ScriptLoad(r.ctx, string(content)).Result()
 	if err != nil {
 		return fmt.Errorf("failed to load script into redis: %w", err)
 	}
 
+	r.scriptsMu.Lock()
 	r.scripts[name] = &ScriptInfo{
 		Name:     name,
 		SHA:      sha,
 		Content:  string(content),
 		LoadedAt: time.Now(),
 	}
+	r.scriptsMu.Unlock()
 
-	log.Printf("Loaded script '%s' from %s (SHA: %s)", name, scriptPath, sha)
+	log.Printf("Loaded script '%s' from %s (SHA: %s)", name, luaScriptName, sha)
 	return nil
 }
 
+// loadReplicaScript loads an already loaded, read-only script into the
+// replica, so readScript can run it there.
+func (r *RedisStorage) loadReplicaScript(name string) error {
+	r.scriptsMu.RLock()
+	content := r.scripts[name].Content
+	r.scriptsMu.RUnlock()
+	return r.replica.ScriptLoad(r.ctx, content).Err()
+}
+
 func (r *RedisStorage) ExecuteScript(scriptName string, keys []string, args ...interface{}) (interface{}, error) {
+	return r.executeScript(r.client, scriptName, keys, args...)
+}
+
+// readScript runs a read-only script through read, on the replica when one
+// is configured.
+func (r *RedisStorage) readScript(scriptName string, keys []string, args ...interface{}) (interface{}, error) {
+	var result interface{}
+	err := r.read(func(client RedisClient) error {
+		var err error
+		result, err = r.executeScript(client, scriptName, keys, args...)
+		return err
+	})
+	return result, err
+}
+
+func (r *RedisStorage) executeScript(client RedisClient, scriptName string, keys []string, args ...interface{}) (interface{}, error) {
+	r.scriptsMu.RLock()
 	script, exists := r.scripts[scriptName]
+	var sha string
+	if exists {
+		sha = script.SHA
+	}
+	r.scriptsMu.RUnlock()
 	if !exists {
 		return nil, fmt.Errorf("script '%s' not found", scriptName)
 	}
 
-	result, err := r.client.EvalSha(r.ctx, script.SHA, keys, args...).Result()
-
+	result, err := client.EvalSha(r.ctx, sha, keys, args...).Result()
 	if err != nil && strings.Contains(err.Error(), "NOSCRIPT") {
-		// Reload and retry
-		log.Printf("Reloading script '%s'...", scriptName)
-		sha, err := r.client.ScriptLoad(r.ctx, r.scripts[scriptName].Content).Result()
+		// Redis lost the script (restart, SCRIPT FLUSH); reload and retry once
+		sha, err = r.reloadScript(client, scriptName, sha)
 		if err != nil {
 			return nil, err
 		}
-		r.scripts[scriptName].SHA = sha
-		log.Printf("New script SHA after reload: %s", sha)
+		result, err = client.EvalSha(r.ctx, sha, keys, args...).Result()
+	}
+
+	return result, err
+}
+
+// reloadScript loads the script into client again and returns its new SHA.
+// If another request already replaced staleSHA, that SHA is returned instead.
+func (r *RedisStorage) reloadScript(client RedisClient, scriptName, staleSHA string) (string, error) {
+	r.scriptsMu.Lock()
+	defer r.scriptsMu.Unlock()
+
+	script := r.scripts[scriptName]
+	if script.SHA != staleSHA {
+		return script.SHA, nil
+	}
 
-		result, err = r.client.EvalSha(r.ctx, script.SHA, keys, args...).Result()
+	log.Printf("Reloading script '%s'...", scriptName)
+	sha, err := client.ScriptLoad(r.ctx, script.Content).Result()
+	if err != nil {
+		return "", fmt.Errorf("failed to reload script '%s': %w", scriptName, err)
 	}
+	script.SHA = sha
+	script.LoadedAt = time.Now()
+	log.Printf("New script SHA after reload: %s", sha)
+	return sha, nil
+}
+
+func (r *RedisStorage) AtomicTokenBucket(key string, capacity int64, refillRate float64, cost int64, ttl time.Duration) (BucketResult, error) {
+	return r.tokenBucket(key, capacity, refillRate, cost, ttl)
+}
 
+func (r *RedisStorage) ReserveTokenBucket(id string, hold time.Duration, key string, capacity int64, refillRate float64, cost int64, ttl time.Duration) (BucketResult, error) {
+	return r.tokenBucket(key, capacity, refillRate, cost, ttl, r.reservationKey(id), id, hold.Milliseconds())
+}
+
+// tokenBucket runs the single-bucket script. reservation, when given, is the
+// record key, reservation id and hold in ms, optionally followed by the state
+// field prefix of one bucket of a dual pair and a new bucket's balance.
+func (r *RedisStorage) tokenBucket(key string, capacity int64, refillRate float64, cost int64, ttl time.Duration, reservation ...interface{}) (BucketResult, error) {
+	now := r.clock.Now().UnixMilli()
+	args := append([]interface{}{capacity, refillRate, cost, now, int(ttl.Seconds())}, reservation...)
+	result, err := r.ExecuteScript("endpoint_only", []string{r.bucketKey(key)}, args...)
+	if err != nil {
+		return BucketResult{}, err
+	}
+	values := result.([]interface{})
+	return BucketResult{
+		Allowed:    values[0].(int64) == 1,
+		Remaining:  values[1].(int64),
+		RetryAfter: time.Duration(values[2].(int64)) * time.Millisecond,
+	}, nil
+}
+
+func (r *RedisStorage) AtomicDualBucket(userKey, globalKey string, globalCap int64, globalRate float64, userCap int64, userRate float64, userMaxDebt, cost int64, ttl time.Duration) (BucketResult, error) {
+	result, err := r.dualBucket(userKey, globalKey, globalCap, globalRate, userCap, userRate, userMaxDebt, cost, ttl)
+	if err != nil && r.partial != "" && r.partial != PartialFailureFail {
+		return r.degradedDualBucket(err, userKey, globalKey, globalCap, globalRate, userCap, userRate, cost, ttl)
+	}
 	return result, err
 }
 
-func (r *RedisStorage) AtomicTokenBucket(key string, capacity, refillRate int64, cost int64, ttl time.Duration) (bool, int64, error) {
-	now := time.Now().UnixMilli()
-	result, err := r.ExecuteScript("endpoint_only",
-		[]string{r.bucketKey(key)},
-		capacity, refillRate, cost, now, int(ttl.Seconds()))
+// degradedDualBucket checks the one bucket of a failed dual check that the
+// PartialFailureMode keeps, in place and in the dual state format. The kept
+// bucket never borrows. When it fails too, both errors are returned.
+func (r *RedisStorage) degradedDualBucket(cause error, userKey, globalKey string, globalCap int64, globalRate float64, userCap int64, userRate float64, cost int64, ttl time.Duration) (BucketResult, error) {
+	key, field, capacity, rate := globalKey, "global_", globalCap, globalRate
+	if r.partial == PartialFailureKeyOnly {
+		key, field, capacity, rate = userKey, "user_", userCap, userRate
+	}
+	single, err := r.tokenBucket(key, capacity, rate, cost, ttl, "", "", "", field)
+	if err != nil {
+		return BucketResult{}, errors.Join(cause, err)
+	}
+	log.Printf("⚠️ Dual check of %s and %s failed, checked %s only: %v", userKey, globalKey, key, cause)
+	result := BucketResult{Allowed: single.Allowed, RetryAfter: single.RetryAfter, Degraded: true}
+	if r.partial == PartialFailureKeyOnly {
+		result.Remaining = single.Remaining
+		if !single.Allowed {
+			result.Reason = DenyUserTokens
+		}
+	} else {
+		result.GlobalRemaining = single.Remaining
+		if !single.Allowed {
+			result.Reason = DenyGlobalTokens
+		}
+	}
+	return result, nil
+}
+
+func (r *RedisStorage) AtomicInitialBucket(userKey, globalKey string, globalCap int64, globalRate float64, globalInitial int64, userCap int64, userRate float64, userInitial int64, userMaxDebt, cost int64, ttl time.Duration) (BucketResult, error) {
+	if globalKey == "" {
+		return r.tokenBucket(userKey, userCap, userRate, cost, ttl, "", "", "", "", userInitial)
+	}
+	result, err := r.dualBucket(userKey, globalKey, globalCap, globalRate, userCap, userRate, userMaxDebt, cost, ttl, "", "", "", userInitial, globalInitial)
+	if err != nil && r.partial != "" && r.partial != PartialFailureFail {
+		return r.degradedDualBucket(err, userKey, globalKey, globalCap, globalRate, userCap, userRate, cost, ttl)
+	}
+	return result, err
+}
+
+func (r *RedisStorage) ReserveDualBucket(id string, hold time.Duration, userKey, globalKey string, globalCap int64, globalRate float64, userCap int64, userRate float64, userMaxDebt, cost int64, ttl time.Duration) (BucketResult, error) {
+	return r.dualBucket(userKey, globalKey, globalCap, globalRate, userCap, userRate, userMaxDebt, cost, ttl, r.reservationKey(id), id, hold.Milliseconds())
+}
+
+// dualBucket runs the dual-bucket script. reservation, when given, is the
+// record key, reservation id and hold in ms, optionally followed by new user
+// and global buckets' balances.
+func (r *RedisStorage) dualBucket(userKey, globalKey string, globalCap int64, globalRate float64, userCap int64, userRate float64, userMaxDebt, cost int64, ttl time.Duration, reservation ...interface{}) (BucketResult, error) {
+	now := r.clock.Now().UnixMilli()
+	keys := []string{r.bucketKey(userKey), r.bucketKey(globalKey)}
+	var windowStart int64
+	if r.topWindow > 0 {
+		windowStart = now - now%r.topWindow.Milliseconds()
+		keys = append(keys, r.topKey(globalKey, windowStart))
+	}
+	args := append([]interface{}{globalCap, globalRate, userCap, userRate, cost, now, int(ttl.Seconds()), userMaxDebt, userKey}, reservation...)
+	result, err := r.ExecuteScript("tier_endpoint", keys, args...)
+	if err != nil {
+		return BucketResult{}, err
+	}
+	values := result.([]interface{})
+	bucket := BucketResult{
+		Allowed:         values[0].(int64) == 1,
+		Remaining:       values[1].(int64),
+		GlobalRemaining: values[2].(int64),
+		RetryAfter:      time.Duration(values[3].(int64)) * time.Millisecond,
+	}
+	if len(values) > 4 {
+		bucket.Reason = dualDenyReason(values[4].(int64))
+	}
+	if bucket.Allowed && r.topWindow > 0 {
+		r.expireTopWindow(globalKey, windowStart)
+	}
+	return bucket, nil
+}
+
+// dualDenyReason maps the dual script's reason code to a DenyReason.
+func dualDenyReason(code int64) DenyReason {
+	switch code {
+	case 1:
+		return DenyUserTokens
+	case 2:
+		return DenyGlobalTokens
+	}
+	return ""
+}
+
+func (r *RedisStorage) AtomicUserIPBucket(userKey, ipKey string, userCap int64, userRate float64, userMaxDebt int64, ipCap int64, ipRate float64, cost int64, ttl time.Duration) (BucketResult, error) {
+	now := r.clock.Now().UnixMilli()
+	result, err := r.ExecuteScript("user_ip",
+		[]string{r.bucketKey(userKey), r.bucketKey(ipKey)},
+		userCap, userRate, ipCap, ipRate, cost, now, int(ttl.Seconds()), userMaxDebt)
+	if err != nil {
+		return BucketResult{}, err
+	}
 	values := result.([]interface{})
-	allowed := values[0].(int64) == 1
-	globalRemaining := values[1].(int64)
-	return allowed, globalRemaining, err
+	return BucketResult{
+		Allowed:     values[0].(int64) == 1,
+		Remaining:   values[1].(int64),
+		IPRemaining: values[2].(int64),
+		RetryAfter:  time.Duration(values[3].(int64)) * time.Millisecond,
+	}, nil
 }
 
-func (r *RedisStorage) AtomicDualBucket(userKey, globalKey string, globalCap, globalRate, userCap, userRate int64, cost int64, ttl time.Duration) (bool, int64, int64, error) {
-	now := time.Now().UnixMilli()
-	result, err := r.ExecuteScript("tier_endpoint",
-		[]string{r.bucketKey(userKey), r.bucketKey(globalKey)},
-		globalCap, globalRate, userCap, userRate, cost, now, int(ttl.Seconds()))
+func (r *RedisStorage) AtomicMultiBucket(userKey, globalKey string, globalCap int64, globalRate float64, userCap int64, userRate float64, userMaxDebt, cost int64, resources []ResourceBucket, ttl time.Duration) (BucketResult, error) {
+	now := r.clock.Now().UnixMilli()
+	keys := []string{r.bucketKey(userKey), r.bucketKey(globalKey)}
+	args := []interface{}{globalCap, globalRate, userCap, userRate, cost, now, int(ttl.Seconds()), userMaxDebt, userKey, len(resources)}
+	for _, resource := range resources {
+		keys = append(keys, r.bucketKey(resource.Key))
+		args = append(args, resource.Capacity, resource.RefillRate, resource.Cost)
+	}
+	var windowStart int64
+	if r.topWindow > 0 {
+		windowStart = now - now%r.topWindow.Milliseconds()
+		keys = append(keys, r.topKey(globalKey, windowStart))
+	}
+	result, err := r.ExecuteScript("multi_resource", keys, args...)
+	if err != nil {
+		return BucketResult{}, err
+	}
 	values := result.([]interface{})
-	allowed := values[0].(int64) == 1
-	userRemaining := values[1].(int64)
-	globalRemaining := values[2].(int64)
-	return allowed, userRemaining, globalRemaining, err
+	bucket := BucketResult{
+		Allowed:         values[0].(int64) == 1,
+		Remaining:       values[1].(int64),
+		GlobalRemaining: values[2].(int64),
+		RetryAfter:      time.Duration(values[3].(int64)) * time.Millisecond,
+		Resources:       make([]int64, len(resources)),
+	}
+	for i := range resources {
+		bucket.Resources[i] = values[4+i].(int64)
+	}
+	if bucket.Allowed && r.topWindow > 0 {
+		r.expireTopWindow(globalKey, windowStart)
+	}
+	return bucket, nil
+}
+
+func (r *RedisStorage) AtomicQuotaBucket(userKey, globalKey string, globalCap int64, globalRate float64, userCap int64, userRate float64, userMaxDebt, cost int64, quotas []Quota, ttl time.Duration) (BucketResult, error) {
+	now := r.clock.Now().UnixMilli()
+	dual := globalKey != ""
+	keys := []string{r.bucketKey(userKey)}
+	if dual {
+		keys = append(keys, r.bucketKey(globalKey))
+	}
+	args := []interface{}{globalCap, globalRate, userCap, userRate, cost, now, int(ttl.Seconds()), userMaxDebt, userKey, 0, len(quotas)}
+	if dual {
+		args[9] = 1
+	}
+	for _, quota := range quotas {
+		keys = append(keys, r.bucketKey(quota.Key))
+		args = append(args, quota.Amount, string(quota.Window), quota.UTCOffset.Milliseconds(), quota.Period.Milliseconds())
+	}
+	var windowStart int64
+	if dual && r.topWindow > 0 {
+		windowStart = now - now%r.topWindow.Milliseconds()
+		keys = append(keys, r.topKey(globalKey, windowStart))
+	}
+	result, err := r.ExecuteScript("quota", keys, args...)
+	if err != nil {
+		return BucketResult{}, err
+	}
+	values := result.([]interface{})
+	bucket := BucketResult{
+		Allowed:         values[0].(int64) == 1,
+		Remaining:       values[1].(int64),
+		GlobalRemaining: values[2].(int64),
+		RetryAfter:      time.Duration(values[3].(int64)) * time.Millisecond,
+		Quotas:          make([]QuotaResult, len(quotas)),
+	}
+	for i := range quotas {
+		bucket.Quotas[i] = QuotaResult{
+			Remaining: values[4+2*i].(int64),
+			ResetsAt:  time.UnixMilli(values[5+2*i].(int64)),
+		}
+	}
+	if bucket.Allowed && dual && r.topWindow > 0 {
+		r.expireTopWindow(globalKey, windowStart)
+	}
+	return bucket, nil
+}
+
+// expireTopWindow gives a window's sorted set an expiry the first time this
+// instance writes to it, keeping the script itself to a single extra write.
+func (r *RedisStorage) expireTopWindow(globalKey string, windowStart int64) {
+	if last, ok := r.topExpired.Load(globalKey); ok && last.(int64) == windowStart {
+		return
+	}
+	// Keep the previous window around briefly for reports around a rollover
+	if err := r.client.Expire(r.ctx, r.topKey(globalKey, windowStart), 2*r.topWindow).Err(); err != nil {
+		log.Printf("Failed to set expiry on top consumers window for %s: %v", globalKey, err)
+		return
+	}
+	r.topExpired.Store(globalKey, windowStart)
+}
+
+func (r *RedisStorage) TopConsumers(globalKey string, n int) (TopConsumersReport, error) {
+	if r.topWindow <= 0 {
+		return TopConsumersReport{}, ErrTopConsumersDisabled
+	}
+	now := r.clock.Now().UnixMilli()
+	windowStart := now - now%r.topWindow.Milliseconds()
+	var entries []redis.Z
+	err := r.read(func(client RedisClient) (err error) {
+		entries, err = client.ZRevRangeWithScores(r.ctx, r.topKey(globalKey, windowStart), 0, int64(n)-1).Result()
+		return err
+	})
+	if err != nil {
+		return TopConsumersReport{}, fmt.Errorf("failed to read top consumers: %w", err)
+	}
+
+	report := TopConsumersReport{
+		WindowStart: time.UnixMilli(windowStart),
+		Window:      r.topWindow,
+		Consumers:   make([]Consumer, 0, len(entries)),
+	}
+	for _, entry := range entries {
+		member, _ := entry.Member.(string)
+		report.Consumers = append(report.Consumers, Consumer{Key: member, Tokens: int64(entry.Score)})
+	}
+	return report, nil
+}
+
+func (r *RedisStorage) CommitReservation(id string) (bool, error) {
+	return r.settleReservation(id, "commit")
+}
+
+func (r *RedisStorage) ReleaseReservation(id string) (bool, error) {
+	return r.settleReservation(id, "release")
+}
+
+func (r *RedisStorage) settleReservation(id, mode string) (bool, error) {
+	result, err := r.ExecuteScript("reservation", []string{r.reservationKey(id)}, mode)
+	if err != nil {
+		return false, err
+	}
+	return result.(int64) == 1, nil
+}
+
+func (r *RedisStorage) reservationKey(id string) string {
+	return r.bucketKey("reservation:" + id)
+}
+
+func (r *RedisStorage) PenaltyStatus(key string) (time.Time, error) {
+	return r.penalty(key, "status")
+}
+
+func (r *RedisStorage) RecordDenial(key string, threshold int64, window, duration time.Duration) (time.Time, error) {
+	return r.penalty(key, "deny", threshold, window.Milliseconds(), duration.Milliseconds())
+}
+
+func (r *RedisStorage) penalty(key, mode string, args ...interface{}) (time.Time, error) {
+	keys := []string{r.bucketKey("penalty:" + key), r.bucketKey("denials:" + key)}
+	result, err := r.ExecuteScript("penalty", keys, append([]interface{}{mode, r.clock.Now().UnixMilli()}, args...)...)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if until := result.(int64); until > 0 {
+		return time.UnixMilli(until), nil
+	}
+	return time.Time{}, nil
+}
+
+func (r *RedisStorage) LookupTier(key string) (string, error) {
+	var tier string
+	err := r.read(func(client RedisClient) (err error) {
+		tier, err = client.HGet(r.ctx, r.tiersKey(), key).Result()
+		return err
+	})
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return tier, err
+}
+
+func (r *RedisStorage) SetTier(key, tier string) error {
+	return r.client.HSet(r.ctx, r.tiersKey(), key, tier).Err()
+}
+
+func (r *RedisStorage) DeleteTier(key string) (bool, error) {
+	removed, err := r.client.HDel(r.ctx, r.tiersKey(), key).Result()
+	return removed > 0, err
+}
+
+func (r *RedisStorage) tiersKey() string {
+	if r.tierHashKey == "" {
+		return defaultTierHashKey
+	}
+	return r.tierHashKey
+}
+
+func (r *RedisStorage) TopUpBucket(key string, capacity int64, refillRate float64, amount, maxBalance int64, ttl time.Duration) (int64, error) {
+	now := r.clock.Now().UnixMilli()
+	result, err := r.ExecuteScript("topup",
+		[]string{r.bucketKey(key)},
+		capacity, refillRate, amount, maxBalance, now, int(ttl.Seconds()))
+	if err != nil {
+		return 0, err
+	}
+	return result.(int64), nil
+}
+
+func (r *RedisStorage) RefundTokens(key string, cost int64, ttl time.Duration) error {
+	_, err := r.ExecuteScript("refund", []string{r.bucketKey(key)}, cost, r.clock.Now().UnixMilli(), int(ttl.Seconds()))
+	return err
+}
+
+func (r *RedisStorage) SetBucketTokens(key string, tokens int64, ttl time.Duration) error {
+	_, err := r.ExecuteScript("set_tokens", []string{r.bucketKey(key)}, tokens, r.clock.Now().UnixMilli(), int(ttl.Seconds()))
+	return err
+}
+
+// BucketTokens returns key's balance with the refill owed so far, without
+// charging it, and false when the bucket doesn't exist. It reads from the
+// replica when one is configured.
+func (r *RedisStorage) BucketTokens(key string) (int64, bool, error) {
+	result, err := r.readScript("peek", []string{r.bucketKey(key)}, r.clock.Now().UnixMilli())
+	if errors.Is(err, redis.Nil) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return result.(int64), true, nil
+}
+
+func (r *RedisStorage) ResetBuckets(ctx context.Context, pattern string, opts ResetOptions, progress func(ResetProgress)) (ResetProgress, error) {
+	var total ResetProgress
+	var cursor uint64
+	for {
+		keys, next, err := r.client.Scan(ctx, cursor, r.bucketKey(pattern), int64(opts.BatchSize)).Result()
+		if err != nil {
+			return total, fmt.Errorf("failed to scan buckets: %w", err)
+		}
+		total.Matched += int64(len(keys))
+		if len(keys) > 0 {
+			// UNLINK frees memory in the background instead of blocking Redis
+			deleted, err := r.client.Unlink(ctx, keys...).Result()
+			if err != nil {
+				return total, fmt.Errorf("failed to delete buckets: %w", err)
+			}
+			total.Deleted += deleted
+		}
+		if progress != nil {
+			progress(total)
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return total, nil
+		}
+		if opts.BatchDelay > 0 {
+			select {
+			case <-ctx.Done():
+				return total, ctx.Err()
+			case <-time.After(opts.BatchDelay):
+			}
+		}
+	}
+}
+
+func (r *RedisStorage) DeleteBucket(key string) (bool, error) {
+	deleted, err := r.client.Unlink(r.ctx, r.bucketKey(key), r.bucketKey(key)+":res").Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete bucket: %w", err)
+	}
+	return deleted > 0, nil
+}
+
+// purgeBatchSize is how many keys PurgeKeys scans and unlinks at a time.
+const purgeBatchSize = 1000
+
+func (r *RedisStorage) PurgeKeys(pattern string) (int, error) {
+	total, err := r.ResetBuckets(r.ctx, pattern, ResetOptions{BatchSize: purgeBatchSize}, nil)
+	return int(total.Deleted), err
 }
 
 func (r *RedisStorage) Ping() error {
-	return r.client.Ping(r.ctx).Err()
+	timeout := r.pingTimeout
+	if timeout <= 0 {
+		timeout = defaultPingTimeout
+	}
+	ctx, cancel := context.WithTimeout(r.ctx, timeout)
+	defer cancel()
+	return r.client.Ping(ctx).Err()
 }
 
+func (r *RedisStorage) PoolStats() RedisPoolStats {
+	client, ok := r.client.(*redis.Client)
+	if !ok {
+		return RedisPoolStats{}
+	}
+	stats := client.PoolStats()
+	return RedisPoolStats{
+		Size: client.Options().PoolSize,
+		Used: int(stats.TotalConns - stats.IdleConns),
+		Idle: int(stats.IdleConns),
+	}
+}
+
+// Close closes the connections to Redis and its replica. Only the first
+// call closes them; later calls return nil, so shutdown code and deferred
+// cleanups may both call it.
 func (r *RedisStorage) Close() error {
-	return r.client.Close()
+	var err error
+	r.closeOnce.Do(func() {
+		if r.replica != nil {
+			if err = r.replica.Close(); err != nil {
+				r.client.Close()
+				return
+			}
+		}
+		err = r.client.Close()
+	})
+	return err
+}
+
+// read runs a read-only command on the replica, or on the primary when no
+// replica is configured. A replica that fails, rather than answering
+// redis.Nil, is retried on the primary, so a lagging or unreachable replica
+// only costs an extra round trip. Reads may see the replica's lag.
+func (r *RedisStorage) read(do func(client RedisClient) error) error {
+	if r.replica != nil {
+		err := do(r.replica)
+		if err == nil || errors.Is(err, redis.Nil) {
+			return err
+		}
+		log.Printf("⚠️ Read replica failed, reading from the primary: %v", err)
+	}
+	return do(r.client)
+}
+
+// topKey names the sorted set counting per-key consumption of globalKey's
+// bucket in the window starting at windowStart (unix ms).
+func (r *RedisStorage) topKey(globalKey string, windowStart int64) string {
+	return r.bucketKey(fmt.Sprintf("top:%s:%d", globalKey, windowStart))
 }
 
 func (r *RedisStorage) bucketKey(key string) string {
-	return fmt.Sprintf("rate_limit:bucket:%s", key)
+	prefix := r.keyPrefix
+	if prefix == "" {
+		prefix = defaultKeyPrefix
+	}
+	return fmt.Sprintf("%s:%s", prefix, key)
 }
@@ -2,9 +2,12 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"io"
 	"log"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -27,6 +30,41 @@ func (m *MockRedisClient) ScriptLoad(ctx context.Context, script string) *redis.
 	return mockArgs.Get(0).(*redis.StringCmd)
 }
 
+func (m *MockRedisClient) Scan(ctx context.Context, cursor uint64, match string, count int64) *redis.ScanCmd {
+	mockArgs := m.Called(ctx, cursor, match, count)
+	return mockArgs.Get(0).(*redis.ScanCmd)
+}
+
+func (m *MockRedisClient) Unlink(ctx context.Context, keys ...string) *redis.IntCmd {
+	mockArgs := m.Called(ctx, keys)
+	return mockArgs.Get(0).(*redis.IntCmd)
+}
+
+func (m *MockRedisClient) Expire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd {
+	mockArgs := m.Called(ctx, key, expiration)
+	return mockArgs.Get(0).(*redis.BoolCmd)
+}
+
+func (m *MockRedisClient) ZRevRangeWithScores(ctx context.Context, key string, start, stop int64) *redis.ZSliceCmd {
+	mockArgs := m.Called(ctx, key, start, stop)
+	return mockArgs.Get(0).(*redis.ZSliceCmd)
+}
+
+func (m *MockRedisClient) HGet(ctx context.Context, key, field string) *redis.StringCmd {
+	mockArgs := m.Called(ctx, key, field)
+	return mockArgs.Get(0).(*redis.StringCmd)
+}
+
+func (m *MockRedisClient) HSet(ctx context.Context, key string, values ...interface{}) *redis.IntCmd {
+	mockArgs := m.Called(ctx, key, values)
+	return mockArgs.Get(0).(*redis.IntCmd)
+}
+
+func (m *MockRedisClient) HDel(ctx context.Context, key string, fields ...string) *redis.IntCmd {
+	mockArgs := m.Called(ctx, key, fields)
+	return mockArgs.Get(0).(*redis.IntCmd)
+}
+
 func (m *MockRedisClient) Ping(ctx context.Context) *redis.StatusCmd {
 	mockArgs := m.Called(ctx)
 	return mockArgs.Get(0).(*redis.StatusCmd)
@@ -53,7 +91,7 @@ func TestAtomicTokenBucket_AllowsRequest(t *testing.T) {
 
 	// Mock successful Redis response
 	cmd := redis.NewCmd(context.Background())
-	cmd.SetVal([]interface{}{int64(1), int64(90)}) // allowed=1, remaining=90
+	cmd.SetVal([]interface{}{int64(1), int64(90), int64(0)}) // allowed=1, remaining=90, retry_after=0
 
 	mockClient.On("EvalSha",
 		mock.Anything,
@@ -63,17 +101,17 @@ func TestAtomicTokenBucket_AllowsRequest(t *testing.T) {
 	).Return(cmd)
 
 	// Test
-	allowed, remaining, err := storage.AtomicTokenBucket("test_key", 100, 10, 10, time.Hour)
+	result, err := storage.AtomicTokenBucket("test_key", 100, 10, 10, time.Hour)
 
 	// Assert
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
-	if !allowed {
+	if !result.Allowed {
 		t.Error("expected request to be allowed")
 	}
-	if remaining != 90 {
-		t.Errorf("expected 90 remaining, got %d", remaining)
+	if result.Remaining != 90 {
+		t.Errorf("expected 90 remaining, got %d", result.Remaining)
 	}
 
 	mockClient.AssertExpectations(t)
@@ -92,20 +130,23 @@ func TestAtomicTokenBucket_DeniesRequest(t *testing.T) {
 
 	// Mock Redis response for denied request
 	cmd := redis.NewCmd(context.Background())
-	cmd.SetVal([]interface{}{int64(0), int64(0)}) // allowed=0, remaining=0
+	cmd.SetVal([]interface{}{int64(0), int64(0), int64(1000)}) // allowed=0, remaining=0, retry_after=1000
 
 	mockClient.On("EvalSha", mock.Anything, "abc123", mock.Anything, mock.Anything).Return(cmd)
 
-	allowed, remaining, err := storage.AtomicTokenBucket("test_key", 100, 10, 10, time.Hour)
+	result, err := storage.AtomicTokenBucket("test_key", 100, 10, 10, time.Hour)
 
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
-	if allowed {
+	if result.Allowed {
 		t.Error("expected request to be denied")
 	}
-	if remaining != 0 {
-		t.Errorf("expected 0 remaining, got %d", remaining)
+	if result.Remaining != 0 {
+		t.Errorf("expected 0 remaining, got %d", result.Remaining)
+	}
+	if result.RetryAfter != time.Second {
+		t.Errorf("expected retry after 1s, got %v", result.RetryAfter)
 	}
 }
 
@@ -122,31 +163,797 @@ func TestAtomicDualBucket_BothBucketsChecked(t *testing.T) {
 
 	// Mock dual bucket success
 	cmd := redis.NewCmd(context.Background())
-	cmd.SetVal([]interface{}{int64(1), int64(90), int64(9990)}) // allowed, user_remaining, global_remaining
+	cmd.SetVal([]interface{}{int64(1), int64(90), int64(9990), int64(0)}) // allowed, user_remaining, global_remaining, retry_after
 
 	mockClient.On("EvalSha", mock.Anything, "def456", mock.Anything, mock.Anything).Return(cmd)
 
-	allowed, userRemaining, globalRemaining, err := storage.AtomicDualBucket(
+	result, err := storage.AtomicDualBucket(
 		"user:123", "global:/api/test",
 		10000, 1000, 100, 10,
-		10, time.Hour,
+		0, 10, time.Hour,
 	)
 
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
-	if !allowed {
+	if !result.Allowed {
 		t.Error("expected request to be allowed")
 	}
-	if userRemaining != 90 {
-		t.Errorf("expected user remaining 90, got %d", userRemaining)
+	if result.Remaining != 90 {
+		t.Errorf("expected user remaining 90, got %d", result.Remaining)
+	}
+	if result.GlobalRemaining != 9990 {
+		t.Errorf("expected global remaining 9990, got %d", result.GlobalRemaining)
+	}
+}
+
+func TestAtomicDualBucket_PartialFailureFallsBack(t *testing.T) {
+	tests := []struct {
+		mode       PartialFailureMode
+		reachable  string // The only key the single-bucket fallback can reach
+		wantErr    bool
+		wantUser   int64
+		wantGlobal int64
+	}{
+		{PartialFailureFail, "global:/api/test", true, 0, 0},
+		{PartialFailureGlobalOnly, "global:/api/test", false, 0, 9990},
+		{PartialFailureKeyOnly, "user:123", false, 9990, 0},
+		{PartialFailureGlobalOnly, "user:123", true, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode)+"/"+tt.reachable, func(t *testing.T) {
+			mockClient := new(MockRedisClient)
+			storage := &RedisStorage{
+				client:    mockClient,
+				ctx:       context.Background(),
+				keyPrefix: "rl",
+				partial:   tt.mode,
+				scripts: map[string]*ScriptInfo{
+					"endpoint_only": {SHA: "abc123"},
+					"tier_endpoint": {SHA: "def456"},
+				},
+			}
+
+			// The dual check touches both keys, so it fails with the unreachable one
+			down := redis.NewCmd(context.Background())
+			down.SetErr(errors.New("CLUSTERDOWN The cluster is down"))
+			mockClient.On("EvalSha", mock.Anything, "def456", mock.Anything, mock.Anything).Return(down)
+
+			up := redis.NewCmd(context.Background())
+			up.SetVal([]interface{}{int64(1), int64(9990), int64(0)})
+			reachable := []string{"rl:" + tt.reachable}
+			mockClient.On("EvalSha", mock.Anything, "abc123", reachable, mock.Anything).Return(up)
+			mockClient.On("EvalSha", mock.Anything, "abc123", mock.Anything, mock.Anything).Return(down)
+
+			result, err := storage.AtomicDualBucket("user:123", "global:/api/test", 10000, 1000, 10000, 10, 0, 10, time.Hour)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !result.Allowed || !result.Degraded || result.Remaining != tt.wantUser || result.GlobalRemaining != tt.wantGlobal {
+				t.Errorf("expected a degraded allow with user %d and global %d, got %+v", tt.wantUser, tt.wantGlobal, result)
+			}
+		})
+	}
+}
+
+func TestAtomicTokenBucket_PassesFractionalRefillRate(t *testing.T) {
+	mockClient := new(MockRedisClient)
+
+	storage := &RedisStorage{
+		client:  mockClient,
+		ctx:     context.Background(),
+		scripts: map[string]*ScriptInfo{"endpoint_only": {SHA: "abc123"}},
+	}
+
+	cmd := redis.NewCmd(context.Background())
+	cmd.SetVal([]interface{}{int64(1), int64(0), int64(0)})
+	mockClient.On("EvalSha", mock.Anything, "abc123", mock.Anything, mock.MatchedBy(func(args []interface{}) bool {
+		return args[1] == 0.2
+	})).Return(cmd)
+
+	if _, err := storage.AtomicTokenBucket("test_key", 1, 0.2, 1, time.Hour); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	mockClient.AssertExpectations(t)
+}
+
+func TestAtomicDualBucket_TracksTopConsumers(t *testing.T) {
+	mockClient := new(MockRedisClient)
+
+	storage := &RedisStorage{
+		client:    mockClient,
+		ctx:       context.Background(),
+		scripts:   map[string]*ScriptInfo{"tier_endpoint": {SHA: "def456"}},
+		topWindow: time.Minute,
+	}
+
+	cmd := redis.NewCmd(context.Background())
+	cmd.SetVal([]interface{}{int64(1), int64(90), int64(9990), int64(0)})
+	isTopKey := func(key string) bool {
+		return strings.HasPrefix(key, "rate_limit:bucket:top:global:/api/search:")
+	}
+	mockClient.On("EvalSha", mock.Anything, "def456",
+		mock.MatchedBy(func(keys []string) bool { return len(keys) == 3 && isTopKey(keys[2]) }),
+		mock.MatchedBy(func(args []interface{}) bool { return args[len(args)-1] == "user:u1:/api/search:free" }),
+	).Return(cmd)
+	expire := redis.NewBoolCmd(context.Background())
+	expire.SetVal(true)
+	mockClient.On("Expire", mock.Anything, mock.MatchedBy(isTopKey), 2*time.Minute).Return(expire).Once()
+
+	// The window's expiry is only set once per instance
+	for i := 0; i < 3; i++ {
+		if _, err := storage.AtomicDualBucket("user:u1:/api/search:free", "global:/api/search", 10000, 2000, 100, 10, 0, 10, time.Hour); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	mockClient.AssertExpectations(t)
+}
+
+func TestTopConsumers(t *testing.T) {
+	mockClient := new(MockRedisClient)
+	storage := &RedisStorage{client: mockClient, ctx: context.Background(), topWindow: time.Minute}
+
+	cmd := redis.NewZSliceCmd(context.Background())
+	cmd.SetVal([]redis.Z{{Score: 500, Member: "user:heavy:/api/search:free"}, {Score: 20, Member: "ip:10.0.0.1:/api/search"}})
+	mockClient.On("ZRevRangeWithScores", mock.Anything, mock.MatchedBy(func(key string) bool {
+		return strings.HasPrefix(key, "rate_limit:bucket:top:global:/api/search:")
+	}), int64(0), int64(19)).Return(cmd)
+
+	report, err := storage.TopConsumers("global:/api/search", 20)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(report.Consumers) != 2 || report.Consumers[0] != (Consumer{Key: "user:heavy:/api/search:free", Tokens: 500}) {
+		t.Errorf("unexpected consumers: %+v", report.Consumers)
+	}
+	if report.Window != time.Minute || report.WindowStart.UnixMilli()%time.Minute.Milliseconds() != 0 {
+		t.Errorf("unexpected window: start=%v length=%v", report.WindowStart, report.Window)
+	}
+
+	storage.topWindow = 0
+	if _, err := storage.TopConsumers("global:/api/search", 20); !errors.Is(err, ErrTopConsumersDisabled) {
+		t.Errorf("expected ErrTopConsumersDisabled, got %v", err)
+	}
+}
+
+func TestTopUpBucket_ReturnsNewBalance(t *testing.T) {
+	mockClient := new(MockRedisClient)
+
+	storage := &RedisStorage{
+		client:  mockClient,
+		ctx:     context.Background(),
+		scripts: map[string]*ScriptInfo{"topup": {SHA: "topup123"}},
+	}
+
+	cmd := redis.NewCmd(context.Background())
+	cmd.SetVal(int64(150))
+	mockClient.On("EvalSha", mock.Anything, "topup123",
+		[]string{"rate_limit:bucket:user:u1:/api/upload:free"},
+		mock.MatchedBy(func(args []interface{}) bool {
+			// capacity, refill rate, amount, max balance
+			return args[0] == int64(100) && args[2] == int64(50) && args[3] == int64(200)
+		}),
+	).Return(cmd)
+
+	balance, err := storage.TopUpBucket("user:u1:/api/upload:free", 100, 10, 50, 200, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if balance != 150 {
+		t.Errorf("expected balance 150, got %d", balance)
 	}
-	if globalRemaining != 9990 {
-		t.Errorf("expected global remaining 9990, got %d", globalRemaining)
+	mockClient.AssertExpectations(t)
+}
+
+func TestReserveTokenBucket_PassesReservation(t *testing.T) {
+	mockClient := new(MockRedisClient)
+
+	storage := &RedisStorage{
+		client:  mockClient,
+		ctx:     context.Background(),
+		scripts: map[string]*ScriptInfo{"endpoint_only": {SHA: "abc123"}},
 	}
+
+	cmd := redis.NewCmd(context.Background())
+	cmd.SetVal([]interface{}{int64(1), int64(90), int64(0)})
+	mockClient.On("EvalSha", mock.Anything, "abc123",
+		[]string{"rate_limit:bucket:endpoint:/api/list"},
+		mock.MatchedBy(func(args []interface{}) bool {
+			// record key, reservation id and hold in ms follow the bucket args
+			return len(args) == 8 && args[5] == "rate_limit:bucket:reservation:r1" && args[6] == "r1" && args[7] == int64(5000)
+		}),
+	).Return(cmd)
+
+	result, err := storage.ReserveTokenBucket("r1", 5*time.Second, "endpoint:/api/list", 100, 10, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !result.Allowed || result.Remaining != 90 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	mockClient.AssertExpectations(t)
+}
+
+func TestSettleReservation(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		reply   int64
+		settled bool
+	}{
+		{"commit", "commit", 1, true},
+		{"release", "release", 1, true},
+		{"already settled", "release", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient := new(MockRedisClient)
+			storage := &RedisStorage{
+				client:  mockClient,
+				ctx:     context.Background(),
+				scripts: map[string]*ScriptInfo{"reservation": {SHA: "res123"}},
+			}
+
+			cmd := redis.NewCmd(context.Background())
+			cmd.SetVal(tt.reply)
+			mockClient.On("EvalSha", mock.Anything, "res123",
+				[]string{"rate_limit:bucket:reservation:r1"},
+				[]interface{}{tt.mode},
+			).Return(cmd)
+
+			var settled bool
+			var err error
+			if tt.mode == "commit" {
+				settled, err = storage.CommitReservation("r1")
+			} else {
+				settled, err = storage.ReleaseReservation("r1")
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if settled != tt.settled {
+				t.Errorf("expected settled %v, got %v", tt.settled, settled)
+			}
+			mockClient.AssertExpectations(t)
+		})
+	}
+}
+
+func TestRecordDenial_ReturnsPenaltyEnd(t *testing.T) {
+	mockClient := new(MockRedisClient)
+
+	storage := &RedisStorage{
+		client:  mockClient,
+		ctx:     context.Background(),
+		scripts: map[string]*ScriptInfo{"penalty": {SHA: "pen123"}},
+	}
+
+	until := time.Now().Add(time.Minute).UnixMilli()
+	cmd := redis.NewCmd(context.Background())
+	cmd.SetVal(until)
+	mockClient.On("EvalSha", mock.Anything, "pen123",
+		[]string{"rate_limit:bucket:penalty:user:u1", "rate_limit:bucket:denials:user:u1"},
+		mock.MatchedBy(func(args []interface{}) bool {
+			// mode, now, threshold, window ms, duration ms
+			return args[0] == "deny" && args[2] == int64(5) && args[3] == int64(10000) && args[4] == int64(60000)
+		}),
+	).Return(cmd)
+
+	got, err := storage.RecordDenial("user:u1", 5, 10*time.Second, time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.UnixMilli() != until {
+		t.Errorf("expected penalty to end at %d, got %d", until, got.UnixMilli())
+	}
+	mockClient.AssertExpectations(t)
+}
+
+func TestPenaltyStatus_NotPenalized(t *testing.T) {
+	mockClient := new(MockRedisClient)
+
+	storage := &RedisStorage{
+		client:  mockClient,
+		ctx:     context.Background(),
+		scripts: map[string]*ScriptInfo{"penalty": {SHA: "pen123"}},
+	}
+
+	cmd := redis.NewCmd(context.Background())
+	cmd.SetVal(int64(0))
+	mockClient.On("EvalSha", mock.Anything, "pen123", mock.Anything,
+		mock.MatchedBy(func(args []interface{}) bool { return len(args) == 2 && args[0] == "status" }),
+	).Return(cmd)
+
+	got, err := storage.PenaltyStatus("user:u1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !got.IsZero() {
+		t.Errorf("expected zero time, got %v", got)
+	}
+}
+
+func TestResetBuckets_DeletesInBatches(t *testing.T) {
+	mockClient := new(MockRedisClient)
+	storage := &RedisStorage{client: mockClient, ctx: context.Background()}
+
+	match := "rate_limit:bucket:user:*:/api/upload:*"
+	first := redis.NewScanCmd(context.Background(), nil)
+	first.SetVal([]string{"rate_limit:bucket:user:a:/api/upload:free", "rate_limit:bucket:user:b:/api/upload:free"}, 42)
+	second := redis.NewScanCmd(context.Background(), nil)
+	second.SetVal([]string{"rate_limit:bucket:user:c:/api/upload:premium"}, 0)
+	mockClient.On("Scan", mock.Anything, uint64(0), match, int64(2)).Return(first)
+	mockClient.On("Scan", mock.Anything, uint64(42), match, int64(2)).Return(second)
+
+	firstDel := redis.NewIntCmd(context.Background())
+	firstDel.SetVal(2)
+	secondDel := redis.NewIntCmd(context.Background())
+	secondDel.SetVal(1)
+	mockClient.On("Unlink", mock.Anything, []string{"rate_limit:bucket:user:a:/api/upload:free", "rate_limit:bucket:user:b:/api/upload:free"}).Return(firstDel)
+	mockClient.On("Unlink", mock.Anything, []string{"rate_limit:bucket:user:c:/api/upload:premium"}).Return(secondDel)
+
+	var reports []ResetProgress
+	total, err := storage.ResetBuckets(context.Background(), "user:*:/api/upload:*", ResetOptions{BatchSize: 2, BatchDelay: time.Millisecond}, func(p ResetProgress) {
+		reports = append(reports, p)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if total != (ResetProgress{Matched: 3, Deleted: 3}) {
+		t.Errorf("unexpected totals: %+v", total)
+	}
+	if len(reports) != 2 || reports[0] != (ResetProgress{Matched: 2, Deleted: 2}) {
+		t.Errorf("unexpected progress reports: %+v", reports)
+	}
+	mockClient.AssertExpectations(t)
+}
+
+func TestPurgeKeys_ScansWithPrefixAndUnlinks(t *testing.T) {
+	mockClient := new(MockRedisClient)
+	storage := &RedisStorage{client: mockClient, ctx: context.Background(), keyPrefix: "tenantA:rate_limit"}
+
+	match := "tenantA:rate_limit:acme:*"
+	first := redis.NewScanCmd(context.Background(), nil)
+	first.SetVal([]string{"tenantA:rate_limit:acme:user:a", "tenantA:rate_limit:acme:global:/x"}, 7)
+	empty := redis.NewScanCmd(context.Background(), nil)
+	empty.SetVal(nil, 0)
+	mockClient.On("Scan", mock.Anything, uint64(0), match, int64(purgeBatchSize)).Return(first)
+	mockClient.On("Scan", mock.Anything, uint64(7), match, int64(purgeBatchSize)).Return(empty)
+
+	deleted := redis.NewIntCmd(context.Background())
+	deleted.SetVal(2)
+	mockClient.On("Unlink", mock.Anything, []string{"tenantA:rate_limit:acme:user:a", "tenantA:rate_limit:acme:global:/x"}).Return(deleted).Once()
+
+	count, err := storage.PurgeKeys("acme:*")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("expected 2 keys purged, got %d", count)
+	}
+	mockClient.AssertExpectations(t)
+}
+
+func TestResetBuckets_StopsWhenCancelled(t *testing.T) {
+	mockClient := new(MockRedisClient)
+	storage := &RedisStorage{client: mockClient, ctx: context.Background()}
+
+	page := redis.NewScanCmd(context.Background(), nil)
+	page.SetVal(nil, 7)
+	mockClient.On("Scan", mock.Anything, uint64(0), mock.Anything, mock.Anything).Return(page).Once()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := storage.ResetBuckets(ctx, "user:*", ResetOptions{BatchSize: 10, BatchDelay: time.Hour}, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	mockClient.AssertExpectations(t)
+}
+
+func TestExecuteScript_ReloadsOnNoScript(t *testing.T) {
+	mockClient := new(MockRedisClient)
+
+	storage := &RedisStorage{
+		client: mockClient,
+		ctx:    context.Background(),
+		scripts: map[string]*ScriptInfo{
+			"endpoint_only": {Name: "endpoint_only", SHA: "old-sha", Content: "return 1"},
+		},
+	}
+
+	noScript := redis.NewCmd(context.Background())
+	noScript.SetErr(errors.New("NOSCRIPT No matching script. Please use EVAL."))
+	mockClient.On("EvalSha", mock.Anything, "old-sha", mock.Anything, mock.Anything).Return(noScript).Once()
+
+	loaded := redis.NewStringCmd(context.Background())
+	loaded.SetVal("new-sha")
+	mockClient.On("ScriptLoad", mock.Anything, "return 1").Return(loaded).Once()
+
+	ok := redis.NewCmd(context.Background())
+	ok.SetVal([]interface{}{int64(1), int64(90), int64(0)})
+	mockClient.On("EvalSha", mock.Anything, "new-sha", mock.Anything, mock.Anything).Return(ok).Once()
+
+	result, err := storage.AtomicTokenBucket("test_key", 100, 10, 10, time.Hour)
+
+	if err != nil {
+		t.Fatalf("expected retry to succeed, got: %v", err)
+	}
+	if !result.Allowed || result.Remaining != 90 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if storage.scripts["endpoint_only"].SHA != "new-sha" {
+		t.Errorf("expected stored SHA to be updated, got %s", storage.scripts["endpoint_only"].SHA)
+	}
+	mockClient.AssertExpectations(t)
+}
+
+func TestExecuteScript_ConcurrentReloadLoadsOnce(t *testing.T) {
+	mockClient := new(MockRedisClient)
+
+	storage := &RedisStorage{
+		client: mockClient,
+		ctx:    context.Background(),
+		scripts: map[string]*ScriptInfo{
+			"endpoint_only": {Name: "endpoint_only", SHA: "old-sha", Content: "return 1"},
+		},
+	}
+
+	noScript := redis.NewCmd(context.Background())
+	noScript.SetErr(errors.New("NOSCRIPT No matching script. Please use EVAL."))
+	mockClient.On("EvalSha", mock.Anything, "old-sha", mock.Anything, mock.Anything).Return(noScript)
+
+	loaded := redis.NewStringCmd(context.Background())
+	loaded.SetVal("new-sha")
+	mockClient.On("ScriptLoad", mock.Anything, "return 1").Return(loaded)
+
+	ok := redis.NewCmd(context.Background())
+	ok.SetVal([]interface{}{int64(1), int64(90), int64(0)})
+	mockClient.On("EvalSha", mock.Anything, "new-sha", mock.Anything, mock.Anything).Return(ok)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := storage.ExecuteScript("endpoint_only", []string{"k"}, 1)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	mockClient.AssertNumberOfCalls(t, "ScriptLoad", 1)
+}
+
+func TestLoadScript_ReadsEmbeddedScript(t *testing.T) {
+	mockClient := new(MockRedisClient)
+
+	storage := &RedisStorage{
+		client:  mockClient,
+		ctx:     context.Background(),
+		scripts: make(map[string]*ScriptInfo),
+	}
+
+	cmd := redis.NewStringCmd(context.Background())
+	cmd.SetVal("sha-embedded")
+	mockClient.On("ScriptLoad", mock.Anything, mock.Anything).Return(cmd)
+
+	if err := storage.LoadScript("endpoint_only", "tokenbucket.lua"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	script, ok := storage.scripts["endpoint_only"]
+	if !ok {
+		t.Fatal("expected script to be registered")
+	}
+	if script.SHA != "sha-embedded" {
+		t.Errorf("expected SHA sha-embedded, got %s", script.SHA)
+	}
+	embedded, _ := luaFS.ReadFile("tokenbucket.lua")
+	if script.Content != string(embedded) {
+		t.Error("expected script content to match the embedded file")
+	}
+}
+
+func TestLoadScript_UnknownScript(t *testing.T) {
+	storage := &RedisStorage{
+		client:  new(MockRedisClient),
+		ctx:     context.Background(),
+		scripts: make(map[string]*ScriptInfo),
+	}
+
+	if err := storage.LoadScript("missing", "missing.lua"); err == nil {
+		t.Error("expected error for a script that is not embedded")
+	}
+}
+
+func TestNewRedisStorageWithOptions_InvalidOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(*RedisOptions)
+		errorMsg string
+	}{
+		{"zero pool size", func(o *RedisOptions) { o.PoolSize = 0 }, "pool size must be positive"},
+		{"negative pool size", func(o *RedisOptions) { o.PoolSize = -5 }, "pool size must be positive"},
+		{"min idle above pool size", func(o *RedisOptions) { o.PoolSize = 2; o.MinIdleConns = 3 }, "min idle conns"},
+		{"invalid max retries", func(o *RedisOptions) { o.MaxRetries = -2 }, "max retries"},
+		{"zero read timeout", func(o *RedisOptions) { o.ReadTimeout = 0 }, "read timeout must be positive"},
+		{"zero ping timeout", func(o *RedisOptions) { o.PingTimeout = 0 }, "ping timeout must be positive"},
+		{"negative top consumers window", func(o *RedisOptions) { o.TopConsumersWindow = -time.Second }, "top consumers window"},
+		{"empty key prefix", func(o *RedisOptions) { o.KeyPrefix = "" }, "key prefix must be 1-64 characters"},
+		{"long key prefix", func(o *RedisOptions) { o.KeyPrefix = strings.Repeat("a", 65) }, "key prefix must be 1-64 characters"},
+		{"key prefix with leading colon", func(o *RedisOptions) { o.KeyPrefix = ":team_a" }, "must not start or end with ':'"},
+		{"key prefix with trailing colon", func(o *RedisOptions) { o.KeyPrefix = "team_a:" }, "must not start or end with ':'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultRedisOptions()
+			tt.modify(&opts)
+
+			storage, err := NewRedisStorageWithOptions("localhost:0", "", 0, opts)
+			if err == nil {
+				t.Fatal("expected error but got none")
+			}
+			if storage != nil {
+				t.Error("expected nil storage on error")
+			}
+			if !strings.Contains(err.Error(), tt.errorMsg) {
+				t.Errorf("expected error containing '%s', got '%s'", tt.errorMsg, err.Error())
+			}
+		})
+	}
+}
+
+func TestNewRedisStorageWithOptions_KeyPrefixOptionValidated(t *testing.T) {
+	_, err := NewRedisStorageWithOptions("localhost:0", "", 0, DefaultRedisOptions(), WithKeyPrefix("team_a:"))
+	if err == nil || !strings.Contains(err.Error(), "key prefix") {
+		t.Errorf("expected key prefix error, got %v", err)
+	}
+}
+
+func TestBucketKey_UsesPrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"", "rate_limit:bucket:user:u1"},
+		{"team_a:rate_limit", "team_a:rate_limit:user:u1"},
+	}
+
+	for _, tt := range tests {
+		storage := &RedisStorage{keyPrefix: tt.prefix}
+		if got := storage.bucketKey("user:u1"); got != tt.want {
+			t.Errorf("prefix %q: expected %q, got %q", tt.prefix, tt.want, got)
+		}
+	}
+}
+
+func TestKeyPrefix_AppliedToSingleAndDualBuckets(t *testing.T) {
+	mockClient := new(MockRedisClient)
+
+	storage := &RedisStorage{
+		client:    mockClient,
+		ctx:       context.Background(),
+		scripts:   map[string]*ScriptInfo{"endpoint_only": {SHA: "abc123"}, "tier_endpoint": {SHA: "def456"}},
+		keyPrefix: "tenantA:rate_limit:bucket",
+	}
+
+	single := redis.NewCmd(context.Background())
+	single.SetVal([]interface{}{int64(1), int64(90), int64(0)})
+	mockClient.On("EvalSha", mock.Anything, "abc123",
+		[]string{"tenantA:rate_limit:bucket:endpoint:/api/list"}, mock.Anything,
+	).Return(single)
+	dual := redis.NewCmd(context.Background())
+	dual.SetVal([]interface{}{int64(1), int64(90), int64(9990), int64(0)})
+	mockClient.On("EvalSha", mock.Anything, "def456",
+		[]string{"tenantA:rate_limit:bucket:user:u1:/api/test:free", "tenantA:rate_limit:bucket:global:/api/test"}, mock.Anything,
+	).Return(dual)
+
+	if _, err := storage.AtomicTokenBucket("endpoint:/api/list", 100, 10, 10, time.Hour); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := storage.AtomicDualBucket("user:u1:/api/test:free", "global:/api/test", 10000, 1000, 100, 10, 0, 10, time.Hour); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mockClient.AssertExpectations(t)
+}
+
+func TestClientOptions_PoolSettings(t *testing.T) {
+	opts := DefaultRedisOptions()
+	opts.PoolSize = 42
+	opts.MinIdleConns = 4
+	opts.MaxRetries = -1
+	opts.ReadTimeout = 250 * time.Millisecond
+	opts.PoolTimeout = time.Second
+
+	redisOpts := clientOptions("localhost:6379", "", 0, opts)
+
+	if redisOpts.PoolSize != 42 || redisOpts.MinIdleConns != 4 || redisOpts.MaxRetries != -1 {
+		t.Errorf("pool settings not applied: %+v", redisOpts)
+	}
+	if redisOpts.ReadTimeout != 250*time.Millisecond || redisOpts.PoolTimeout != time.Second {
+		t.Errorf("timeouts not applied: %+v", redisOpts)
+	}
+}
+
+func TestPing_UsesTimeout(t *testing.T) {
+	mockClient := new(MockRedisClient)
+	storage := &RedisStorage{
+		client:      mockClient,
+		ctx:         context.Background(),
+		pingTimeout: 50 * time.Millisecond,
+	}
+
+	cmd := redis.NewStatusCmd(context.Background())
+	mockClient.On("Ping", mock.MatchedBy(func(ctx context.Context) bool {
+		deadline, ok := ctx.Deadline()
+		return ok && time.Until(deadline) <= 50*time.Millisecond
+	})).Return(cmd)
+
+	if err := storage.Ping(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	mockClient.AssertExpectations(t)
 }
 
 func TestMain(m *testing.M) {
 	log.SetOutput(io.Discard) // Turn off all the log when testing
 	os.Exit(m.Run())
 }
+
+func TestTierMapping_UsesTierHash(t *testing.T) {
+	mockClient := new(MockRedisClient)
+	storage := &RedisStorage{client: mockClient, ctx: context.Background(), tierHashKey: "billing:tiers"}
+
+	found := redis.NewStringCmd(context.Background())
+	found.SetVal("premium")
+	missing := redis.NewStringCmd(context.Background())
+	missing.SetErr(redis.Nil)
+	mockClient.On("HGet", mock.Anything, "billing:tiers", "user123").Return(found)
+	mockClient.On("HGet", mock.Anything, "billing:tiers", "nobody").Return(missing)
+	mockClient.On("HSet", mock.Anything, "billing:tiers", []interface{}{"user123", "free"}).Return(redis.NewIntCmd(context.Background()))
+	removed := redis.NewIntCmd(context.Background())
+	removed.SetVal(1)
+	mockClient.On("HDel", mock.Anything, "billing:tiers", []string{"user123"}).Return(removed)
+
+	if tier, err := storage.LookupTier("user123"); err != nil || tier != "premium" {
+		t.Errorf("expected premium, got %q (err %v)", tier, err)
+	}
+	if tier, err := storage.LookupTier("nobody"); err != nil || tier != "" {
+		t.Errorf("expected no tier for an unmapped key, got %q (err %v)", tier, err)
+	}
+	if err := storage.SetTier("user123", "free"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if ok, err := storage.DeleteTier("user123"); err != nil || !ok {
+		t.Errorf("expected mapping removed, got %v (err %v)", ok, err)
+	}
+	mockClient.AssertExpectations(t)
+}
+
+func TestReadReplica_RoutesReadsOnly(t *testing.T) {
+	primary, replica := new(MockRedisClient), new(MockRedisClient)
+	storage := &RedisStorage{
+		client:      primary,
+		replica:     replica,
+		ctx:         context.Background(),
+		tierHashKey: "billing:tiers",
+		topWindow:   time.Minute,
+		scripts:     map[string]*ScriptInfo{"endpoint_only": {SHA: "abc123"}, "peek": {SHA: "peek123"}},
+	}
+
+	tier := redis.NewStringCmd(context.Background())
+	tier.SetVal("premium")
+	replica.On("HGet", mock.Anything, "billing:tiers", "user123").Return(tier)
+	missing := redis.NewStringCmd(context.Background())
+	missing.SetErr(redis.Nil)
+	replica.On("HGet", mock.Anything, "billing:tiers", "nobody").Return(missing)
+	replica.On("ZRevRangeWithScores", mock.Anything, mock.Anything, int64(0), int64(9)).Return(redis.NewZSliceCmd(context.Background()))
+	consumed := redis.NewCmd(context.Background())
+	consumed.SetVal([]interface{}{int64(1), int64(90), int64(0)})
+	primary.On("EvalSha", mock.Anything, "abc123", mock.Anything, mock.Anything).Return(consumed)
+	balance := redis.NewCmd(context.Background())
+	balance.SetVal(int64(42))
+	replica.On("EvalSha", mock.Anything, "peek123", []string{"rate_limit:bucket:user:user123:/api/search"}, mock.Anything).Return(balance)
+	primary.On("HSet", mock.Anything, "billing:tiers", []interface{}{"user123", "free"}).Return(redis.NewIntCmd(context.Background()))
+
+	if got, err := storage.LookupTier("user123"); err != nil || got != "premium" {
+		t.Errorf("expected premium from the replica, got %q (err %v)", got, err)
+	}
+	// A missing key is an answer, not a replica failure
+	if got, err := storage.LookupTier("nobody"); err != nil || got != "" {
+		t.Errorf("expected no tier, got %q (err %v)", got, err)
+	}
+	if _, err := storage.TopConsumers("global:/api/search", 10); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := storage.AtomicTokenBucket("endpoint:/api/search", 100, 10, 10, time.Hour); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := storage.SetTier("user123", "free"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if tokens, ok, err := storage.BucketTokens("user:user123:/api/search"); err != nil || !ok || tokens != 42 {
+		t.Errorf("expected 42 tokens from the replica, got %d, %v (err %v)", tokens, ok, err)
+	}
+	primary.AssertExpectations(t)
+	replica.AssertExpectations(t)
+	primary.AssertNotCalled(t, "HGet", mock.Anything, mock.Anything, mock.Anything)
+	primary.AssertNotCalled(t, "EvalSha", mock.Anything, "peek123", mock.Anything, mock.Anything)
+	replica.AssertNotCalled(t, "EvalSha", mock.Anything, "abc123", mock.Anything, mock.Anything)
+}
+
+func TestReadReplica_FallsBackToPrimary(t *testing.T) {
+	primary, replica := new(MockRedisClient), new(MockRedisClient)
+	failed := redis.NewStringCmd(context.Background())
+	failed.SetErr(errors.New("connection refused"))
+	replica.On("HGet", mock.Anything, "billing:tiers", "user123").Return(failed)
+	tier := redis.NewStringCmd(context.Background())
+	tier.SetVal("premium")
+	primary.On("HGet", mock.Anything, "billing:tiers", "user123").Return(tier)
+
+	storage := &RedisStorage{client: primary, replica: replica, ctx: context.Background(), tierHashKey: "billing:tiers"}
+	if got, err := storage.LookupTier("user123"); err != nil || got != "premium" {
+		t.Errorf("expected the primary to answer for a failed replica, got %q (err %v)", got, err)
+	}
+
+	// Without a replica every read goes to the primary
+	storage.replica = nil
+	if got, err := storage.LookupTier("user123"); err != nil || got != "premium" {
+		t.Errorf("expected premium from the primary, got %q (err %v)", got, err)
+	}
+	primary.AssertNumberOfCalls(t, "HGet", 2)
+	replica.AssertNumberOfCalls(t, "HGet", 1)
+
+	primary.On("Close").Return(nil)
+	replica.On("Close").Return(nil)
+	storage.replica = replica
+	if err := storage.Close(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	primary.AssertCalled(t, "Close")
+	replica.AssertCalled(t, "Close")
+}
+
+func TestClose_Twice(t *testing.T) {
+	primary, replica := new(MockRedisClient), new(MockRedisClient)
+	primary.On("Close").Return(nil).Once()
+	replica.On("Close").Return(nil).Once()
+	storage := &RedisStorage{client: primary, replica: replica, ctx: context.Background()}
+
+	for i := 0; i < 2; i++ {
+		if err := storage.Close(); err != nil {
+			t.Errorf("close %d: unexpected error: %v", i+1, err)
+		}
+	}
+	primary.AssertNumberOfCalls(t, "Close", 1)
+	replica.AssertNumberOfCalls(t, "Close", 1)
+}
+
+func TestClose_TwiceAfterError(t *testing.T) {
+	mockClient := new(MockRedisClient)
+	mockClient.On("Close").Return(errors.New("connection reset")).Once()
+	storage := &RedisStorage{client: mockClient, ctx: context.Background()}
+
+	if err := storage.Close(); err == nil {
+		t.Error("expected the first Close to report the client's error")
+	}
+	if err := storage.Close(); err != nil {
+		t.Errorf("expected nil from a second Close, got %v", err)
+	}
+	mockClient.AssertNumberOfCalls(t, "Close", 1)
+}
@@ -0,0 +1,60 @@
+-- refund.lua: return tokens a check took for work that then failed. Works on
+-- buckets in any script's state format, capped at the capacity the last check
+-- stored. A bucket that doesn't exist is full already, so there is nothing to
+-- return to it.
+local key = KEYS[1]
+local cost = tonumber(ARGV[1])
+local now = tonumber(ARGV[2])
+local ttl = tonumber(ARGV[3])
+
+local state = redis.call('GET', key)
+if not state then
+    return -1
+end
+local decoded = cjson.decode(state)
+
+-- Single-bucket, dual per-key and dual global fields respectively
+local prefix
+for _, candidate in ipairs({'', 'user_', 'global_'}) do
+    if decoded[candidate .. 'capacity'] ~= nil then
+        prefix = candidate
+        break
+    end
+end
+-- Only set by /admin/set and never checked, so never charged either
+if prefix == nil then
+    return -1
+end
+
+local tokens = decoded[prefix .. 'tokens']
+local last_refill = decoded[prefix .. 'last_refill']
+local capacity = decoded[prefix .. 'capacity']
+local refill_rate = decoded[prefix .. 'refill_rate']
+
+-- Settle the refill owed so far, so the cap applies to the current balance
+if now > last_refill then
+    if tokens < capacity then
+        local tokens_to_add = (now - last_refill) * refill_rate / 1000
+        tokens = math.min(capacity, tokens + tokens_to_add)
+    end
+    last_refill = now
+end
+
+-- Never push the balance past capacity, or lower one already above it
+tokens = math.max(tokens, math.min(capacity, tokens + cost))
+
+decoded[prefix .. 'tokens'] = tokens
+decoded[prefix .. 'last_refill'] = last_refill
+
+-- Keep the longer expiry, as a refund shouldn't shorten a bucket's life
+local current_ttl = redis.call('TTL', key)
+if current_ttl == -1 or current_ttl > ttl then
+    ttl = current_ttl
+end
+if ttl > 0 then
+    redis.call('SET', key, cjson.encode(decoded), 'EX', ttl)
+else
+    redis.call('SET', key, cjson.encode(decoded))
+end
+
+return math.floor(tokens)
@@ -0,0 +1,26 @@
+-- reservation.lua: commit or release a reservation made by the bucket scripts
+local reservation_key = KEYS[1]
+local mode = ARGV[1] -- 'commit' keeps the tokens spent, 'release' returns them
+
+local record = redis.call('GET', reservation_key)
+if not record then
+    -- Already committed, released or expired (expiry returns the tokens)
+    return 0
+end
+local reservation = cjson.decode(record)
+
+for _, bucket in ipairs(reservation.buckets) do
+    local removed = redis.call('ZREM', bucket.key .. ':res', reservation.member)
+    if removed == 1 and mode == 'release' then
+        local state = redis.call('GET', bucket.key)
+        if state then
+            local decoded = cjson.decode(state)
+            local tokens = decoded[bucket.field]
+            decoded[bucket.field] = math.max(tokens, math.min(bucket.capacity, tokens + reservation.cost))
+            redis.call('SET', bucket.key, cjson.encode(decoded), 'KEEPTTL')
+        end
+    end
+end
+
+redis.call('DEL', reservation_key)
+return 1
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultRulesKey is where RuleStore keeps the published rules.
+const DefaultRulesKey = "rate_limit:rules"
+
+// pubSubClient is the part of *redis.Client used for pub/sub.
+type pubSubClient interface {
+	Publish(ctx context.Context, channel string, message interface{}) *redis.IntCmd
+	Subscribe(ctx context.Context, channels ...string) *redis.PubSub
+}
+
+// ruleClient is the part of *redis.Client a RedisRuleStore needs.
+type ruleClient interface {
+	pubSubClient
+	Get(ctx context.Context, key string) *redis.StringCmd
+	TxPipelined(ctx context.Context, fn func(redis.Pipeliner) error) ([]redis.Cmder, error)
+}
+
+// RedisRuleStore keeps a rules file (YAML or JSON) in a Redis key so that
+// every replica runs the same rules, and announces each new version on a
+// pub/sub channel named after the key.
+type RedisRuleStore struct {
+	client  ruleClient
+	ctx     context.Context
+	key     string
+	channel string
+}
+
+// RuleStore returns the store for rules kept at key, DefaultRulesKey when
+// empty, in r's database.
+func (r *RedisStorage) RuleStore(key string) (*RedisRuleStore, error) {
+	client, ok := r.client.(ruleClient)
+	if !ok {
+		return nil, errors.New("redis client does not support pub/sub")
+	}
+	if key == "" {
+		key = DefaultRulesKey
+	}
+	return &RedisRuleStore{client: client, ctx: r.ctx, key: key, channel: key + ":updates"}, nil
+}
+
+// Key returns the Redis key the rules are kept at.
+func (s *RedisRuleStore) Key() string {
+	return s.key
+}
+
+// Load returns the published rules, or nil when none have been published.
+func (s *RedisRuleStore) Load() ([]byte, error) {
+	data, err := s.client.Get(s.ctx, s.key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Publish stores data as the rules and notifies subscribers, in one
+// transaction. Callers must validate data first.
+func (s *RedisRuleStore) Publish(data []byte) error {
+	sum := sha256.Sum256(data)
+	_, err := s.client.TxPipelined(s.ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(s.ctx, s.key, data, 0)
+		pipe.Publish(s.ctx, s.channel, hex.EncodeToString(sum[:]))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("publishing rules to %s: %w", s.key, err)
+	}
+	return nil
+}
+
+// Subscribe returns a channel that receives a value whenever new rules are
+// published, until ctx is done. Notifications sent while the subscription
+// is reconnecting are lost, so callers should also poll Load.
+func (s *RedisRuleStore) Subscribe(ctx context.Context) <-chan struct{} {
+	pubsub := s.client.Subscribe(ctx, s.channel)
+	updates := make(chan struct{}, 1)
+	go func() {
+		defer pubsub.Close()
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-messages:
+				if !ok {
+					return
+				}
+				// A pending notification already covers this one
+				select {
+				case updates <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return updates
+}
@@ -0,0 +1,22 @@
+//go:build luadev
+
+package storage
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// readScript prefers an on-disk copy of the script from LUA_SCRIPT_DIR so
+// scripts can be edited without rebuilding. Build with -tags=luadev to enable.
+func readScript(name string) ([]byte, error) {
+	if dir := os.Getenv("LUA_SCRIPT_DIR"); dir != "" {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err == nil {
+			return content, nil
+		}
+		log.Printf("DEBUG: falling back to embedded %s: %v", name, err)
+	}
+	return luaFS.ReadFile(name)
+}
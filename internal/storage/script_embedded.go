@@ -0,0 +1,8 @@
+//go:build !luadev
+
+package storage
+
+// readScript returns the embedded copy of a Lua script.
+func readScript(name string) ([]byte, error) {
+	return luaFS.ReadFile(name)
+}
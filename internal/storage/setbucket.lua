@@ -0,0 +1,36 @@
+-- setbucket.lua: set a bucket's balance, e.g. to prime it for a test or for
+-- users migrating onto the limiter. An existing bucket keeps its state format
+-- and settings; a new one gets the token fields of every format, so whichever
+-- script checks it first finds its own and rewrites it in that format.
+local key = KEYS[1]
+local tokens = tonumber(ARGV[1])
+local now = tonumber(ARGV[2])
+local ttl = tonumber(ARGV[3])
+
+local decoded = {}
+local state = redis.call('GET', key)
+if state then
+    decoded = cjson.decode(state)
+end
+
+-- Single-bucket, dual per-key and dual global fields respectively
+local formats = {}
+for _, prefix in ipairs({'', 'user_', 'global_'}) do
+    if decoded[prefix .. 'tokens'] ~= nil then
+        formats[#formats + 1] = prefix
+    end
+end
+if #formats == 0 then
+    formats = {'', 'user_', 'global_'}
+end
+for _, prefix in ipairs(formats) do
+    decoded[prefix .. 'tokens'] = tokens
+    decoded[prefix .. 'last_refill'] = now
+end
+
+if ttl > 0 then
+    redis.call('SET', key, cjson.encode(decoded), 'EX', ttl)
+else
+    redis.call('SET', key, cjson.encode(decoded))
+end
+return tokens
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSignedCert writes a self-signed cert/key pair into dir and returns their paths.
+func writeSelfSignedCert(t *testing.T, dir string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "redis.test"},
+		DNSNames:              []string{"redis.test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func TestTLSFromFiles_ClientCertAndCA(t *testing.T) {
+	certFile, keyFile := writeSelfSignedCert(t, t.TempDir())
+
+	// The self-signed cert doubles as the pinned CA
+	tlsConfig, err := TLSFromFiles(certFile, keyFile, certFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(tlsConfig.Certificates) != 1 {
+		t.Fatalf("expected 1 client certificate, got %d", len(tlsConfig.Certificates))
+	}
+	if tlsConfig.RootCAs == nil {
+		t.Fatal("expected RootCAs to be pinned")
+	}
+	if tlsConfig.MinVersion != tls.VersionTLS12 {
+		t.Errorf("expected MinVersion TLS 1.2, got %x", tlsConfig.MinVersion)
+	}
+
+	leaf, err := x509.ParseCertificate(tlsConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("failed to parse loaded certificate: %v", err)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: tlsConfig.RootCAs, DNSName: "redis.test"}); err != nil {
+		t.Errorf("expected certificate to verify against pinned CA: %v", err)
+	}
+}
+
+func TestTLSFromFiles_CAOnly(t *testing.T) {
+	certFile, _ := writeSelfSignedCert(t, t.TempDir())
+
+	tlsConfig, err := TLSFromFiles("", "", certFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(tlsConfig.Certificates) != 0 {
+		t.Errorf("expected no client certificates, got %d", len(tlsConfig.Certificates))
+	}
+	if tlsConfig.RootCAs == nil {
+		t.Error("expected RootCAs to be pinned")
+	}
+}
+
+func TestTLSFromFiles_Errors(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeSelfSignedCert(t, dir)
+	badCA := filepath.Join(dir, "bad.pem")
+	os.WriteFile(badCA, []byte("not a certificate"), 0600)
+
+	tests := []struct {
+		name                      string
+		certFile, keyFile, caFile string
+	}{
+		{"cert without key", certFile, "", ""},
+		{"key without cert", "", keyFile, ""},
+		{"missing cert file", filepath.Join(dir, "nope.crt"), keyFile, ""},
+		{"missing CA file", "", "", filepath.Join(dir, "nope.pem")},
+		{"CA file without certificates", "", "", badCA},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := TLSFromFiles(tt.certFile, tt.keyFile, tt.caFile); err == nil {
+				t.Error("expected error but got none")
+			}
+		})
+	}
+}
+
+func TestClientOptions_SetsTLSConfig(t *testing.T) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS13}
+
+	withTLS := clientOptions("redis:6380", "secret", 2, RedisOptions{TLSConfig: tlsConfig})
+	if withTLS.TLSConfig != tlsConfig {
+		t.Error("expected TLS config to be set on redis options")
+	}
+	if withTLS.Addr != "redis:6380" || withTLS.Password != "secret" || withTLS.DB != 2 {
+		t.Errorf("unexpected connection settings: %+v", withTLS)
+	}
+
+	plain := clientOptions("localhost:6379", "", 0, RedisOptions{})
+	if plain.TLSConfig != nil {
+		t.Error("expected no TLS config when none is given")
+	}
+}
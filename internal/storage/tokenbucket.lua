@@ -5,38 +5,98 @@ local refill_rate = tonumber(ARGV[2])
 local cost = tonumber(ARGV[3])
 local now = tonumber(ARGV[4])
 local ttl = tonumber(ARGV[5])
+-- Optional reservation: record key, reservation id and hold in ms
+local reservation_key = ARGV[6]
+local reservation_id = ARGV[7]
+local hold = tonumber(ARGV[8])
+if reservation_id == '' then
+    reservation_id = nil
+end
+-- Optional state field prefix ("user_" or "global_") for checking one bucket
+-- of a dual pair on its own, in the dual script's state format
+local prefix = ARGV[9] or ''
+-- Optional balance a new bucket starts with instead of capacity
+local initial_tokens = tonumber(ARGV[10])
+
+-- A capacity that shrank since the bucket was written, e.g. at the end of a
+-- schedule, clamps the balance to it rather than resetting it. Only what a
+-- top-up added above the old capacity is kept on top.
+local function clamp(tokens, old_capacity, capacity)
+    if old_capacity ~= nil and capacity < old_capacity and tokens > capacity then
+        return capacity + math.max(0, tokens - old_capacity)
+    end
+    return tokens
+end
 
 local state = redis.call('GET', key)
-local tokens = capacity
+local tokens = initial_tokens or capacity
 local last_refill = now
 
 if state then
     local decoded = cjson.decode(state)
-    tokens = decoded.tokens
-    last_refill = decoded.last_refill
+    tokens = clamp(decoded[prefix .. 'tokens'], decoded[prefix .. 'capacity'], capacity)
+    last_refill = decoded[prefix .. 'last_refill']
 end
 
-if tokens < capacity then
-    local delta = (now - last_refill) / 1000
-    local tokens_to_add = delta * refill_rate
-    if tokens_to_add > 0 then
+-- Tokens are kept fractional so sub-second refills accumulate across calls;
+-- last_refill always advances so time spent full is never credited later.
+-- A balance above capacity (an admin top-up) is otherwise left as is.
+if now > last_refill then
+    if tokens < capacity then
+        local tokens_to_add = (now - last_refill) * refill_rate / 1000
         tokens = math.min(capacity, tokens + tokens_to_add)
-        last_refill = now
     end
+    last_refill = now
+end
+
+-- Return tokens held by reservations that expired without commit/release.
+-- Members are "<id>:<cost>" scored by their expiry time.
+local reservations_key = key .. ':res'
+local expired = redis.call('ZRANGEBYSCORE', reservations_key, '-inf', now)
+if #expired > 0 then
+    for _, member in ipairs(expired) do
+        local held = tonumber(string.match(member, ':(%d+)$'))
+        tokens = math.max(tokens, math.min(capacity, tokens + held))
+    end
+    redis.call('ZREMRANGEBYSCORE', reservations_key, '-inf', now)
 end
 
+-- Only whole tokens can pay for a request
 local allowed = false
-if cost <= tokens then
+if cost <= math.floor(tokens) then
     tokens = tokens - cost
     allowed = true
 end
 
 local new_state = cjson.encode({
-    tokens = tokens,
-    last_refill = last_refill,
-    capacity = capacity,
-    refill_rate = refill_rate
+    [prefix .. 'tokens'] = tokens,
+    [prefix .. 'last_refill'] = last_refill,
+    [prefix .. 'capacity'] = capacity,
+    [prefix .. 'refill_rate'] = refill_rate
 })
 
 redis.call('SET', key, new_state, 'EX', ttl)
-return {allowed and 1 or 0, math.floor(tokens)}
\ No newline at end of file
+
+-- Hold the deducted tokens under a reservation until commit, release or expiry
+if allowed and reservation_id then
+    local member = reservation_id .. ':' .. cost
+    redis.call('ZADD', reservations_key, now + hold, member)
+    redis.call('EXPIRE', reservations_key, math.max(ttl, math.ceil(hold / 1000)))
+    redis.call('SET', reservation_key, cjson.encode({
+        member = member,
+        cost = cost,
+        buckets = {{key = key, field = prefix .. 'tokens', capacity = capacity}}
+    }), 'PX', hold)
+end
+
+-- Milliseconds until the cost is affordable; -1 when it never will be
+local retry_after = 0
+if not allowed then
+    if cost > capacity then
+        retry_after = -1
+    else
+        retry_after = math.ceil((cost - tokens) * 1000 / refill_rate)
+    end
+end
+
+return {allowed and 1 or 0, math.floor(tokens), retry_after}
\ No newline at end of file
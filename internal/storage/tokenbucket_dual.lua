@@ -8,18 +8,41 @@ local user_refill_rate = tonumber(ARGV[4])
 local cost = tonumber(ARGV[5])
 local now = tonumber(ARGV[6])
 local ttl = tonumber(ARGV[7])
+-- How far below zero a request may take the user balance
+local user_max_debt = tonumber(ARGV[8]) or 0
+-- ARGV[9] is the top consumers member; optional reservation: record key,
+-- reservation id and hold in ms
+local reservation_key = ARGV[10]
+local reservation_id = ARGV[11]
+local hold = tonumber(ARGV[12])
+if reservation_id == '' then
+    reservation_id = nil
+end
+-- Optional balances new buckets start with instead of their capacity
+local user_initial = tonumber(ARGV[13])
+local global_initial = tonumber(ARGV[14])
+
+-- A capacity that shrank since the bucket was written, e.g. at the end of a
+-- schedule, clamps the balance to it rather than resetting it. Only what a
+-- top-up added above the old capacity is kept on top.
+local function clamp(tokens, old_capacity, capacity)
+    if old_capacity ~= nil and capacity < old_capacity and tokens > capacity then
+        return capacity + math.max(0, tokens - old_capacity)
+    end
+    return tokens
+end
 
 -- Initialize default state
-local user_tokens = user_capacity
+local user_tokens = user_initial or user_capacity
 local user_last_refill = now
-local global_tokens = global_capacity
+local global_tokens = global_initial or global_capacity
 local global_last_refill = now
 
 -- Read user bucket state from Redis
 local user_state = redis.call('GET', user_key)
 if user_state then
     local decoded = cjson.decode(user_state)
-    user_tokens = decoded.user_tokens
+    user_tokens = clamp(decoded.user_tokens, decoded.user_capacity, user_capacity)
     user_last_refill = decoded.user_last_refill
 end
 
@@ -27,38 +50,69 @@ end
 local global_state = redis.call('GET', global_key)
 if global_state then
     local decoded = cjson.decode(global_state)
-    global_tokens = decoded.global_tokens
+    global_tokens = clamp(decoded.global_tokens, decoded.global_capacity, global_capacity)
     global_last_refill = decoded.global_last_refill
 end
 
--- Refill user tokens based on elapsed time
-if user_tokens < user_capacity then
-    local delta = (now - user_last_refill) / 1000
-    local tokens_to_add = delta * user_refill_rate
-    if tokens_to_add > 0 then
+-- Refill user tokens based on elapsed time. Tokens stay fractional so
+-- sub-second refills accumulate; last_refill always advances so time spent
+-- full is never credited later. A topped-up balance above capacity is kept,
+-- and a negative (borrowed) balance is paid down before it grows again.
+if now > user_last_refill then
+    if user_tokens < user_capacity then
+        local tokens_to_add = (now - user_last_refill) * user_refill_rate / 1000
         user_tokens = math.min(user_capacity, user_tokens + tokens_to_add)
-        user_last_refill = now
     end
+    user_last_refill = now
 end
 
--- Refill global tokens based on elapsed timeif global_tokens < global_capacity then
-if global_tokens < global_capacity then
-    local delta = (now - global_last_refill) / 1000
-    local tokens_to_add = delta * global_refill_rate
-    if tokens_to_add > 0 then
+-- Refill global tokens based on elapsed time
+if now > global_last_refill then
+    if global_tokens < global_capacity then
+        local tokens_to_add = (now - global_last_refill) * global_refill_rate / 1000
         global_tokens = math.min(global_capacity, global_tokens + tokens_to_add)
-        global_last_refill = now
     end
+    global_last_refill = now
 end
 
--- Check both user and global buckets for availability
+-- Return tokens held by reservations that expired without commit/release.
+-- Members are "<id>:<cost>" scored by their expiry time.
+local function release_expired(bucket_key, tokens, capacity)
+    local reservations_key = bucket_key .. ':res'
+    local expired = redis.call('ZRANGEBYSCORE', reservations_key, '-inf', now)
+    if #expired > 0 then
+        for _, member in ipairs(expired) do
+            local held = tonumber(string.match(member, ':(%d+)$'))
+            tokens = math.max(tokens, math.min(capacity, tokens + held))
+        end
+        redis.call('ZREMRANGEBYSCORE', reservations_key, '-inf', now)
+    end
+    return tokens
+end
+
+user_tokens = release_expired(user_key, user_tokens, user_capacity)
+global_tokens = release_expired(global_key, global_tokens, global_capacity)
+
+-- Check both user and global buckets for availability; only whole tokens pay.
+-- The user bucket may borrow up to user_max_debt tokens; the global one never.
 local allowed = false
-if cost <= user_tokens and cost <= global_tokens then
+if cost <= math.floor(user_tokens) + user_max_debt and cost <= math.floor(global_tokens) then
     user_tokens = user_tokens - cost
     global_tokens = global_tokens - cost
     allowed = true
 end
 
+-- Why a request was denied: 1 when the user bucket can't pay, whether or not
+-- the global one can, 2 when only the global one can't; 0 when allowed
+local reason = 0
+if not allowed then
+    if cost > math.floor(user_tokens) + user_max_debt then
+        reason = 1
+    else
+        reason = 2
+    end
+end
+
 -- Save updated user state
 local user_new_state = cjson.encode({
     user_tokens = user_tokens,
@@ -78,5 +132,42 @@ local global_new_state = cjson.encode({
 redis.call('SET', user_key, user_new_state, 'EX', ttl)
 redis.call('SET', global_key, global_new_state, 'EX', ttl)
 
--- Return: [allowed (1/0), remaining user tokens, remaining global tokens]
-return {allowed and 1 or 0, math.floor(user_tokens), math.floor(global_tokens)}
\ No newline at end of file
+-- Hold the deducted tokens under a reservation until commit, release or expiry
+if allowed and reservation_id then
+    local member = reservation_id .. ':' .. cost
+    local hold_ttl = math.max(ttl, math.ceil(hold / 1000))
+    redis.call('ZADD', user_key .. ':res', now + hold, member)
+    redis.call('EXPIRE', user_key .. ':res', hold_ttl)
+    redis.call('ZADD', global_key .. ':res', now + hold, member)
+    redis.call('EXPIRE', global_key .. ':res', hold_ttl)
+    redis.call('SET', reservation_key, cjson.encode({
+        member = member,
+        cost = cost,
+        buckets = {
+            {key = user_key, field = 'user_tokens', capacity = user_capacity},
+            {key = global_key, field = 'global_tokens', capacity = global_capacity}
+        }
+    }), 'PX', hold)
+end
+
+-- Optional top-consumers tracking: KEYS[3] is the current window's sorted set
+-- and ARGV[9] the consumer; costs one extra write per allowed request
+if allowed and KEYS[3] then
+    redis.call('ZINCRBY', KEYS[3], cost, ARGV[9])
+end
+
+-- Milliseconds until both buckets can afford the cost; -1 when they never will
+local retry_after = 0
+if not allowed then
+    if cost > user_capacity + user_max_debt or cost > global_capacity then
+        retry_after = -1
+    else
+        local user_wait = math.max(0, (cost - user_max_debt - user_tokens) * 1000 / user_refill_rate)
+        local global_wait = math.max(0, (cost - global_tokens) * 1000 / global_refill_rate)
+        retry_after = math.ceil(math.max(user_wait, global_wait))
+    end
+end
+
+-- Return: [allowed (1/0), remaining user tokens (negative while in debt),
+-- remaining global tokens, retry after ms, deny reason]
+return {allowed and 1 or 0, math.floor(user_tokens), math.floor(global_tokens), retry_after, reason}
\ No newline at end of file
@@ -0,0 +1,78 @@
+-- tokenbucket_dual_nocheck_global.lua: a user bucket and an IP bucket with no
+-- global endpoint bucket, for the user+ip rule. Both are per-key buckets and
+-- use the dual script's user_* state format.
+local user_key = KEYS[1]
+local ip_key = KEYS[2]
+
+local user_capacity = tonumber(ARGV[1])
+local user_refill_rate = tonumber(ARGV[2])
+local ip_capacity = tonumber(ARGV[3])
+local ip_refill_rate = tonumber(ARGV[4])
+local cost = tonumber(ARGV[5])
+local now = tonumber(ARGV[6])
+local ttl = tonumber(ARGV[7])
+-- How far below zero a request may take the user balance
+local user_max_debt = tonumber(ARGV[8]) or 0
+
+-- A capacity that shrank since the bucket was written, e.g. at the end of a
+-- schedule, clamps the balance to it rather than resetting it. Only what a
+-- top-up added above the old capacity is kept on top.
+local function clamp(tokens, old_capacity, capacity)
+    if old_capacity ~= nil and capacity < old_capacity and tokens > capacity then
+        return capacity + math.max(0, tokens - old_capacity)
+    end
+    return tokens
+end
+
+-- Read a bucket and credit the refill earned since it was last written. A
+-- balance above capacity is otherwise kept and a negative one is paid down
+-- first.
+local function load(key, capacity, refill_rate)
+    local tokens, last_refill = capacity, now
+    local state = redis.call('GET', key)
+    if state then
+        local decoded = cjson.decode(state)
+        tokens, last_refill = clamp(decoded.user_tokens, decoded.user_capacity, capacity), decoded.user_last_refill
+    end
+    if now > last_refill then
+        if tokens < capacity then
+            tokens = math.min(capacity, tokens + (now - last_refill) * refill_rate / 1000)
+        end
+        last_refill = now
+    end
+    return tokens, last_refill
+end
+
+local user_tokens, user_last_refill = load(user_key, user_capacity, user_refill_rate)
+local ip_tokens, ip_last_refill = load(ip_key, ip_capacity, ip_refill_rate)
+
+-- Only whole tokens pay; the user bucket may borrow, the IP bucket never.
+-- A denial writes nothing: the refill is recomputed from last_refill next time.
+if cost > math.floor(user_tokens) + user_max_debt or cost > math.floor(ip_tokens) then
+    local retry_after = -1
+    if cost <= user_capacity + user_max_debt and cost <= ip_capacity then
+        local user_wait = math.max(0, (cost - user_max_debt - user_tokens) * 1000 / user_refill_rate)
+        local ip_wait = math.max(0, (cost - ip_tokens) * 1000 / ip_refill_rate)
+        retry_after = math.ceil(math.max(user_wait, ip_wait))
+    end
+    return {0, math.floor(user_tokens), math.floor(ip_tokens), retry_after}
+end
+
+user_tokens = user_tokens - cost
+ip_tokens = ip_tokens - cost
+redis.call('SET', user_key, cjson.encode({
+    user_tokens = user_tokens,
+    user_last_refill = user_last_refill,
+    user_capacity = user_capacity,
+    user_refill_rate = user_refill_rate
+}), 'EX', ttl)
+redis.call('SET', ip_key, cjson.encode({
+    user_tokens = ip_tokens,
+    user_last_refill = ip_last_refill,
+    user_capacity = ip_capacity,
+    user_refill_rate = ip_refill_rate
+}), 'EX', ttl)
+
+-- Return: [allowed (1/0), remaining user tokens (negative while in debt),
+-- remaining IP tokens, retry after ms]
+return {1, math.floor(user_tokens), math.floor(ip_tokens), 0}
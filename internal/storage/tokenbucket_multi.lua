@@ -0,0 +1,164 @@
+-- tokenbucket_multi.lua: the dual check plus extra per-key resource buckets
+-- (e.g. LLM tokens or spend), all charged or none.
+local user_key = KEYS[1]
+local global_key = KEYS[2]
+
+local global_capacity = tonumber(ARGV[1])
+local global_refill_rate = tonumber(ARGV[2])
+local user_capacity = tonumber(ARGV[3])
+local user_refill_rate = tonumber(ARGV[4])
+local cost = tonumber(ARGV[5])
+local now = tonumber(ARGV[6])
+local ttl = tonumber(ARGV[7])
+local user_max_debt = tonumber(ARGV[8]) or 0
+-- ARGV[9] is the top consumers member
+local resource_count = tonumber(ARGV[10])
+-- KEYS[3..2+resource_count] are the resource buckets, described by
+-- capacity, refill rate and cost triples from ARGV[11]; KEYS[3+resource_count]
+-- is the optional top consumers window
+
+-- A capacity that shrank since the bucket was written, e.g. at the end of a
+-- schedule, clamps the balance to it rather than resetting it. Only what a
+-- top-up added above the old capacity is kept on top.
+local function clamp(tokens, old_capacity, capacity)
+    if old_capacity ~= nil and capacity < old_capacity and tokens > capacity then
+        return capacity + math.max(0, tokens - old_capacity)
+    end
+    return tokens
+end
+
+-- Credit the refill earned since last_refill. Tokens stay fractional, a
+-- balance above capacity is kept and a negative one is paid down first.
+local function refill(tokens, last_refill, capacity, refill_rate)
+    if now > last_refill then
+        if tokens < capacity then
+            tokens = math.min(capacity, tokens + (now - last_refill) * refill_rate / 1000)
+        end
+        last_refill = now
+    end
+    return tokens, last_refill
+end
+
+-- Return tokens held by reservations that expired without commit/release.
+-- Members are "<id>:<cost>" scored by their expiry time.
+local function release_expired(bucket_key, tokens, capacity)
+    local reservations_key = bucket_key .. ':res'
+    local expired = redis.call('ZRANGEBYSCORE', reservations_key, '-inf', now)
+    if #expired > 0 then
+        for _, member in ipairs(expired) do
+            local held = tonumber(string.match(member, ':(%d+)$'))
+            tokens = math.max(tokens, math.min(capacity, tokens + held))
+        end
+        redis.call('ZREMRANGEBYSCORE', reservations_key, '-inf', now)
+    end
+    return tokens
+end
+
+local user_tokens, user_last_refill = user_capacity, now
+local user_state = redis.call('GET', user_key)
+if user_state then
+    local decoded = cjson.decode(user_state)
+    user_tokens, user_last_refill = clamp(decoded.user_tokens, decoded.user_capacity, user_capacity), decoded.user_last_refill
+end
+user_tokens, user_last_refill = refill(user_tokens, user_last_refill, user_capacity, user_refill_rate)
+user_tokens = release_expired(user_key, user_tokens, user_capacity)
+
+local global_tokens, global_last_refill = global_capacity, now
+local global_state = redis.call('GET', global_key)
+if global_state then
+    local decoded = cjson.decode(global_state)
+    global_tokens, global_last_refill = clamp(decoded.global_tokens, decoded.global_capacity, global_capacity), decoded.global_last_refill
+end
+global_tokens, global_last_refill = refill(global_tokens, global_last_refill, global_capacity, global_refill_rate)
+global_tokens = release_expired(global_key, global_tokens, global_capacity)
+
+-- Resource buckets use the single-bucket state format
+local resources = {}
+for i = 1, resource_count do
+    local base = 10 + (i - 1) * 3
+    local r = {
+        key = KEYS[2 + i],
+        capacity = tonumber(ARGV[base + 1]),
+        refill_rate = tonumber(ARGV[base + 2]),
+        cost = tonumber(ARGV[base + 3]),
+        tokens = tonumber(ARGV[base + 1]),
+        last_refill = now
+    }
+    local state = redis.call('GET', r.key)
+    if state then
+        local decoded = cjson.decode(state)
+        r.tokens, r.last_refill = decoded.tokens, decoded.last_refill
+    end
+    r.tokens, r.last_refill = refill(r.tokens, r.last_refill, r.capacity, r.refill_rate)
+    resources[i] = r
+end
+
+-- Every bucket must afford its cost; only whole tokens pay and only the user
+-- bucket may borrow
+local allowed = cost <= math.floor(user_tokens) + user_max_debt and cost <= math.floor(global_tokens)
+for _, r in ipairs(resources) do
+    if r.cost > math.floor(r.tokens) then
+        allowed = false
+    end
+end
+if allowed then
+    user_tokens = user_tokens - cost
+    global_tokens = global_tokens - cost
+    for _, r in ipairs(resources) do
+        r.tokens = r.tokens - r.cost
+    end
+end
+
+redis.call('SET', user_key, cjson.encode({
+    user_tokens = user_tokens,
+    user_last_refill = user_last_refill,
+    user_capacity = user_capacity,
+    user_refill_rate = user_refill_rate
+}), 'EX', ttl)
+redis.call('SET', global_key, cjson.encode({
+    global_tokens = global_tokens,
+    global_last_refill = global_last_refill,
+    global_capacity = global_capacity,
+    global_refill_rate = global_refill_rate
+}), 'EX', ttl)
+for _, r in ipairs(resources) do
+    redis.call('SET', r.key, cjson.encode({
+        tokens = r.tokens,
+        last_refill = r.last_refill,
+        capacity = r.capacity,
+        refill_rate = r.refill_rate
+    }), 'EX', ttl)
+end
+
+local top_key = KEYS[3 + resource_count]
+if allowed and top_key then
+    redis.call('ZINCRBY', top_key, cost, ARGV[9])
+end
+
+-- Milliseconds until every bucket can afford its cost; -1 when one never will
+local retry_after = 0
+if not allowed then
+    local wait = 0
+    if cost > user_capacity + user_max_debt or cost > global_capacity then
+        wait = -1
+    else
+        wait = math.max(0, (cost - user_max_debt - user_tokens) * 1000 / user_refill_rate,
+            (cost - global_tokens) * 1000 / global_refill_rate)
+    end
+    for _, r in ipairs(resources) do
+        if r.cost > r.capacity then
+            wait = -1
+        elseif wait >= 0 then
+            wait = math.max(wait, (r.cost - r.tokens) * 1000 / r.refill_rate)
+        end
+    end
+    retry_after = wait < 0 and -1 or math.ceil(wait)
+end
+
+-- Return: [allowed (1/0), remaining user tokens, remaining global tokens,
+-- retry after ms, remaining tokens of each resource in order]
+local reply = {allowed and 1 or 0, math.floor(user_tokens), math.floor(global_tokens), retry_after}
+for _, r in ipairs(resources) do
+    reply[#reply + 1] = math.floor(r.tokens)
+end
+return reply
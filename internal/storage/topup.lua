@@ -0,0 +1,57 @@
+-- topup.lua: grant bonus tokens to a per-key bucket written by tokenbucket_dual.lua
+local key = KEYS[1]
+local capacity = tonumber(ARGV[1])
+local refill_rate = tonumber(ARGV[2])
+local amount = tonumber(ARGV[3])
+local max_balance = tonumber(ARGV[4])
+local now = tonumber(ARGV[5])
+local ttl = tonumber(ARGV[6])
+
+-- A capacity that shrank since the bucket was written, e.g. at the end of a
+-- schedule, clamps the balance to it rather than resetting it. Only what a
+-- top-up added above the old capacity is kept on top.
+local function clamp(tokens, old_capacity, capacity)
+    if old_capacity ~= nil and capacity < old_capacity and tokens > capacity then
+        return capacity + math.max(0, tokens - old_capacity)
+    end
+    return tokens
+end
+
+local tokens = capacity
+local last_refill = now
+
+local state = redis.call('GET', key)
+if state then
+    local decoded = cjson.decode(state)
+    tokens = clamp(decoded.user_tokens, decoded.user_capacity, capacity)
+    last_refill = decoded.user_last_refill
+end
+
+-- Settle the refill owed so far before adding the bonus
+if now > last_refill then
+    if tokens < capacity then
+        local tokens_to_add = (now - last_refill) * refill_rate / 1000
+        tokens = math.min(capacity, tokens + tokens_to_add)
+    end
+    last_refill = now
+end
+
+-- Never clip a balance that is already above the cap
+if tokens < max_balance then
+    tokens = math.min(max_balance, tokens + amount)
+end
+
+-- Keep the longer expiry so a bonus outlives a short bucket TTL
+local current_ttl = redis.call('TTL', key)
+if current_ttl > ttl then
+    ttl = current_ttl
+end
+
+redis.call('SET', key, cjson.encode({
+    user_tokens = tokens,
+    user_last_refill = last_refill,
+    user_capacity = capacity,
+    user_refill_rate = refill_rate
+}), 'EX', ttl)
+
+return math.floor(tokens)
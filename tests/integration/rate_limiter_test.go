@@ -128,7 +128,10 @@ func TestRateLimiter_TokenRefill(t *testing.T) {
 	redisAddr, cleanup := setupRedisContainer(t)
 	defer cleanup()
 
-	redisStorage := storage.NewRedisStorage(redisAddr, "", 0)
+	// Refills follow a fake clock, so the test needn't sleep for them
+	now := time.Now()
+	clock := func() time.Time { return now }
+	redisStorage := storage.NewRedisStorage(redisAddr, "", 0, storage.WithClock(clock))
 	defer redisStorage.Close()
 
 	time.Sleep(100 * time.Millisecond)
@@ -148,7 +151,7 @@ func TestRateLimiter_TokenRefill(t *testing.T) {
 		IPs: config.IPConfig{Capacity: 500, RefillRate: 50},
 	}
 
-	handler := api.NewRateLimiterHandler(redisStorage, rules)
+	handler := api.NewRateLimiterHandlerWithOptions(redisStorage, rules, api.HandlerOptions{ClockFunc: clock})
 
 	gin.SetMode(gin.TestMode)
 	router := gin.New()
@@ -163,8 +166,8 @@ func TestRateLimiter_TokenRefill(t *testing.T) {
 		})
 	}
 
-	// Wait 2 seconds (should refill 20 tokens)
-	time.Sleep(2 * time.Second)
+	// 2 seconds pass (should refill 20 tokens)
+	now = now.Add(2 * time.Second)
 
 	resp := makeRequest(t, router, api.CheckRequest{
 		Key:      "user456",
@@ -181,9 +184,8 @@ func TestRateLimiter_TokenRefill(t *testing.T) {
 		t.Error("request should be allowed after refill")
 	}
 
-	// Allow some tolerance for timing
-	if resp.UserRemaining < expectedRemaining-5 || resp.UserRemaining > expectedRemaining+5 {
-		t.Errorf("expected ~%d remaining after refill, got %d", expectedRemaining, resp.UserRemaining)
+	if resp.UserRemaining != expectedRemaining {
+		t.Errorf("expected %d remaining after refill, got %d", expectedRemaining, resp.UserRemaining)
 	}
 }
 
@@ -317,6 +319,491 @@ func TestRateLimiter_MultipleInstances(t *testing.T) {
 	}
 }
 
+func TestRateLimiter_TopUpOverfill(t *testing.T) {
+	redisAddr, cleanup := setupRedisContainer(t)
+	defer cleanup()
+
+	redisStorage := storage.NewRedisStorage(redisAddr, "", 0)
+	defer redisStorage.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	rules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{
+			"free": {Capacity: 100, RefillRate: 10, MaxOverfill: 100},
+		},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/test": {
+				Rule:             "tiers+endpoints",
+				Cost:             10,
+				GlobalCapacity:   10000,
+				GlobalRefillRate: 1000,
+			},
+		},
+		IPs: config.IPConfig{Capacity: 500, RefillRate: 50},
+	}
+
+	// Without overfill the bonus is clipped at capacity
+	balance, err := redisStorage.TopUpBucket("user:user_clip:/api/test:free", 100, 10, 50, 100, time.Hour)
+	if err != nil || balance != 100 {
+		t.Errorf("expected clipped balance 100, got %d (err=%v)", balance, err)
+	}
+
+	balance, err = redisStorage.TopUpBucket("user:user_bonus:/api/test:free", 100, 10, 50, 200, time.Hour)
+	if err != nil || balance != 150 {
+		t.Fatalf("expected balance 150, got %d (err=%v)", balance, err)
+	}
+
+	handler := api.NewRateLimiterHandler(redisStorage, rules)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/check", handler.CheckHandler)
+
+	// The refill logic must not clip the bonus on the next check
+	resp := makeRequest(t, router, api.CheckRequest{
+		Key:      "user_bonus",
+		Endpoint: "/api/test",
+		UserTier: "free",
+	})
+	if !resp.Allowed || resp.UserRemaining != 140 {
+		t.Errorf("expected allowed with 140 remaining, got allowed=%v remaining=%d", resp.Allowed, resp.UserRemaining)
+	}
+}
+
+func TestRateLimiter_KeyPrefixIsolation(t *testing.T) {
+	redisAddr, cleanup := setupRedisContainer(t)
+	defer cleanup()
+
+	// Two teams sharing one Redis with different key prefixes
+	teamA := storage.NewRedisStorage(redisAddr, "", 0, storage.WithKeyPrefix("team_a:rate_limit"))
+	defer teamA.Close()
+	teamB := storage.NewRedisStorage(redisAddr, "", 0, storage.WithKeyPrefix("team_b:rate_limit"))
+	defer teamB.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		if _, err := teamA.AtomicTokenBucket("endpoint:/api/list", 100, 1, 10, time.Hour); err != nil {
+			t.Fatalf("team A request failed: %v", err)
+		}
+	}
+
+	resultB, err := teamB.AtomicTokenBucket("endpoint:/api/list", 100, 1, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("team B request failed: %v", err)
+	}
+	if resultB.Remaining != 90 {
+		t.Errorf("team B should have its own bucket with 90 remaining, got %d", resultB.Remaining)
+	}
+
+	resultA, err := teamA.AtomicTokenBucket("endpoint:/api/list", 100, 1, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("team A request failed: %v", err)
+	}
+	if resultA.Remaining != 40 {
+		t.Errorf("team A should have 40 remaining, got %d", resultA.Remaining)
+	}
+
+	// A reset through one prefix must leave the other team's buckets alone
+	if _, err := teamA.ResetBuckets(context.Background(), "endpoint:*", storage.ResetOptions{BatchSize: 100}, nil); err != nil {
+		t.Fatalf("reset failed: %v", err)
+	}
+	resultB, _ = teamB.AtomicTokenBucket("endpoint:/api/list", 100, 1, 10, time.Hour)
+	if resultB.Remaining != 80 {
+		t.Errorf("team B bucket should be untouched by team A's reset, got %d remaining", resultB.Remaining)
+	}
+}
+
+func TestRateLimiter_SubSecondRefill(t *testing.T) {
+	redisAddr, cleanup := setupRedisContainer(t)
+	defer cleanup()
+
+	redisStorage := storage.NewRedisStorage(redisAddr, "", 0)
+	defer redisStorage.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Drain a 1 token/sec bucket
+	if result, err := redisStorage.AtomicTokenBucket("endpoint:/api/slow", 2, 1, 2, time.Hour); err != nil || !result.Allowed {
+		t.Fatalf("expected initial request to drain the bucket, got %+v (err=%v)", result, err)
+	}
+
+	// Half a token is not enough, but it must be kept for the next call
+	time.Sleep(600 * time.Millisecond)
+	result, err := redisStorage.AtomicTokenBucket("endpoint:/api/slow", 2, 1, 1, time.Hour)
+	if err != nil || result.Allowed {
+		t.Fatalf("expected denial after 600ms, got %+v (err=%v)", result, err)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	result, err = redisStorage.AtomicTokenBucket("endpoint:/api/slow", 2, 1, 1, time.Hour)
+	if err != nil || !result.Allowed {
+		t.Errorf("expected the two partial refills to add up to a token, got %+v (err=%v)", result, err)
+	}
+
+	// The same holds for the per-key bucket of a dual check
+	if result, err := redisStorage.AtomicDualBucket("user:slow", "global:/api/slow", 100, 100, 2, 1, 0, 2, time.Hour); err != nil || !result.Allowed {
+		t.Fatalf("expected initial dual request to drain the user bucket, got %+v (err=%v)", result, err)
+	}
+	time.Sleep(600 * time.Millisecond)
+	redisStorage.AtomicDualBucket("user:slow", "global:/api/slow", 100, 100, 2, 1, 0, 1, time.Hour)
+	time.Sleep(500 * time.Millisecond)
+	result, err = redisStorage.AtomicDualBucket("user:slow", "global:/api/slow", 100, 100, 2, 1, 0, 1, time.Hour)
+	if err != nil || !result.Allowed {
+		t.Errorf("expected dual user bucket to accumulate partial refills, got %+v (err=%v)", result, err)
+	}
+}
+
+func TestRateLimiter_IdleFullBucketDoesNotBankRefill(t *testing.T) {
+	redisAddr, cleanup := setupRedisContainer(t)
+	defer cleanup()
+
+	redisStorage := storage.NewRedisStorage(redisAddr, "", 0)
+	defer redisStorage.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Create a full bucket (an unaffordable cost consumes nothing), leave it
+	// idle, then drain it; the idle time must not be credited afterwards
+	redisStorage.AtomicTokenBucket("endpoint:/api/idle", 10, 1, 11, time.Hour)
+	time.Sleep(1500 * time.Millisecond)
+	if result, _ := redisStorage.AtomicTokenBucket("endpoint:/api/idle", 10, 1, 10, time.Hour); !result.Allowed {
+		t.Fatal("expected the full bucket to allow its capacity")
+	}
+
+	result, err := redisStorage.AtomicTokenBucket("endpoint:/api/idle", 10, 1, 1, time.Hour)
+	if err != nil || result.Allowed {
+		t.Errorf("expected drained bucket to deny, got %+v (err=%v)", result, err)
+	}
+}
+
+func TestRateLimiter_TopConsumers(t *testing.T) {
+	redisAddr, cleanup := setupRedisContainer(t)
+	defer cleanup()
+
+	redisStorage := storage.NewRedisStorage(redisAddr, "", 0)
+	defer redisStorage.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		redisStorage.AtomicDualBucket("user:heavy:/api/search:free", "global:/api/search", 10000, 100, 100, 10, 0, 10, time.Hour)
+	}
+	redisStorage.AtomicDualBucket("user:light:/api/search:free", "global:/api/search", 10000, 100, 100, 10, 0, 5, time.Hour)
+	// Denied requests consume nothing and are not counted
+	redisStorage.AtomicDualBucket("user:light:/api/search:free", "global:/api/search", 10000, 100, 100, 10, 0, 500, time.Hour)
+
+	report, err := redisStorage.TopConsumers("global:/api/search", 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []storage.Consumer{
+		{Key: "user:heavy:/api/search:free", Tokens: 30},
+		{Key: "user:light:/api/search:free", Tokens: 5},
+	}
+	if len(report.Consumers) != len(want) || report.Consumers[0] != want[0] || report.Consumers[1] != want[1] {
+		t.Errorf("expected %+v, got %+v", want, report.Consumers)
+	}
+}
+
+func TestRateLimiter_ReserveCommitRelease(t *testing.T) {
+	redisAddr, cleanup := setupRedisContainer(t)
+	defer cleanup()
+
+	redisStorage := storage.NewRedisStorage(redisAddr, "", 0)
+	defer redisStorage.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// A near-zero refill rate keeps balances exact across the test
+	reserve := func(id, user string, hold time.Duration) storage.BucketResult {
+		t.Helper()
+		result, err := redisStorage.ReserveDualBucket(id, hold, "user:"+user+":/api/job:free", "global:/api/job", 1000, 0.001, 100, 0.001, 0, 30, time.Hour)
+		if err != nil || !result.Allowed {
+			t.Fatalf("expected reservation %s to be allowed, got %+v (err=%v)", id, result, err)
+		}
+		return result
+	}
+
+	// Release returns the tokens to both buckets, once
+	if result := reserve("r1", "alice", time.Minute); result.Remaining != 70 || result.GlobalRemaining != 970 {
+		t.Errorf("expected 70/970 remaining after reserving, got %+v", result)
+	}
+	if released, err := redisStorage.ReleaseReservation("r1"); err != nil || !released {
+		t.Fatalf("expected release to settle, got %v (err=%v)", released, err)
+	}
+	if released, _ := redisStorage.ReleaseReservation("r1"); released {
+		t.Error("expected a repeated release to be a no-op")
+	}
+	if committed, _ := redisStorage.CommitReservation("r1"); committed {
+		t.Error("expected commit after release to be a no-op")
+	}
+	if result, _ := redisStorage.AtomicDualBucket("user:alice:/api/job:free", "global:/api/job", 1000, 0.001, 100, 0.001, 0, 100, time.Hour); !result.Allowed {
+		t.Errorf("expected released tokens to be back, got %+v", result)
+	}
+
+	// Commit keeps the tokens consumed
+	reserve("r2", "bob", time.Minute)
+	if committed, err := redisStorage.CommitReservation("r2"); err != nil || !committed {
+		t.Fatalf("expected commit to settle, got %v (err=%v)", committed, err)
+	}
+	if released, _ := redisStorage.ReleaseReservation("r2"); released {
+		t.Error("expected release after commit to be a no-op")
+	}
+	if result, _ := redisStorage.AtomicDualBucket("user:bob:/api/job:free", "global:/api/job", 1000, 0.001, 100, 0.001, 0, 71, time.Hour); result.Allowed {
+		t.Errorf("expected committed tokens to stay consumed, got %+v", result)
+	}
+
+	// An unsettled reservation is returned on the next access after its hold
+	reserve("r3", "carol", 200*time.Millisecond)
+	time.Sleep(300 * time.Millisecond)
+	if result, _ := redisStorage.AtomicDualBucket("user:carol:/api/job:free", "global:/api/job", 1000, 0.001, 100, 0.001, 0, 100, time.Hour); !result.Allowed {
+		t.Errorf("expected expired reservation to be released, got %+v", result)
+	}
+	if committed, _ := redisStorage.CommitReservation("r3"); committed {
+		t.Error("expected commit of an expired reservation to be a no-op")
+	}
+}
+
+func TestRateLimiter_MaxDebtRecoversThroughRefill(t *testing.T) {
+	redisAddr, cleanup := setupRedisContainer(t)
+	defer cleanup()
+
+	redisStorage := storage.NewRedisStorage(redisAddr, "", 0)
+	defer redisStorage.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Capacity 10, 10 tokens/sec, may borrow up to 5
+	check := func(cost int64) storage.BucketResult {
+		t.Helper()
+		result, err := redisStorage.AtomicDualBucket("user:borrower:/api/checkout:free", "global:/api/checkout", 1000, 1000, 10, 10, 5, cost, time.Hour)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return result
+	}
+
+	if result := check(10); !result.Allowed || result.Remaining != 0 {
+		t.Fatalf("expected the full bucket to be drained, got %+v", result)
+	}
+	if result := check(5); !result.Allowed || result.Remaining != -5 {
+		t.Fatalf("expected to borrow down to -5, got %+v", result)
+	}
+	if result := check(1); result.Allowed || result.Remaining > -4 || result.RetryAfter <= 0 {
+		t.Fatalf("expected borrowing past max_debt to be denied, got %+v", result)
+	}
+
+	// 600ms refills ~6 tokens: the debt of 5 is paid first, leaving ~1
+	time.Sleep(600 * time.Millisecond)
+	if result := check(1); !result.Allowed || result.Remaining < 0 || result.Remaining > 1 {
+		t.Errorf("expected refill to pay down the debt, got %+v", result)
+	}
+
+	// Recovery stops at capacity, not capacity + max_debt
+	time.Sleep(1500 * time.Millisecond)
+	if result := check(100); result.Allowed || result.Remaining != 10 || result.RetryAfter >= 0 {
+		t.Errorf("expected a full bucket of 10 that can never pay 100, got %+v", result)
+	}
+}
+
+func TestRateLimiter_PenaltyDecays(t *testing.T) {
+	redisAddr, cleanup := setupRedisContainer(t)
+	defer cleanup()
+
+	redisStorage := storage.NewRedisStorage(redisAddr, "", 0)
+	defer redisStorage.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	rules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{
+			"free": {Capacity: 1, RefillRate: 0.001},
+		},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/test": {Rule: "tiers+endpoints", Cost: 1, GlobalCapacity: 10000, GlobalRefillRate: 1000},
+		},
+		IPs:     config.IPConfig{Capacity: 500, RefillRate: 50},
+		Penalty: config.PenaltyConfig{Threshold: 3, Window: time.Minute, Duration: 500 * time.Millisecond},
+	}
+	handler := api.NewRateLimiterHandler(redisStorage, rules)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/check", handler.CheckHandler)
+	req := api.CheckRequest{Key: "hammer", Endpoint: "/api/test", UserTier: "free"}
+
+	// Drain the bucket, then keep hammering through the 429s
+	makeRequest(t, router, req)
+	for i := 0; i < 2; i++ {
+		if resp := makeRequest(t, router, req); resp.Allowed || resp.Penalized {
+			t.Fatalf("denial %d: expected a plain denial, got %+v", i+1, resp)
+		}
+	}
+	resp := makeRequest(t, router, req)
+	if !resp.Penalized || resp.PenaltyEndsAtUnixMs <= time.Now().UnixMilli() {
+		t.Fatalf("expected the third denial to start a penalty, got %+v", resp)
+	}
+
+	// Other instances see the penalty too
+	status, err := redisStorage.PenaltyStatus("user:hammer:/api/test:free")
+	if err != nil || status.IsZero() {
+		t.Errorf("expected the penalty to be stored in Redis, got %v (err=%v)", status, err)
+	}
+
+	// Backing off lets the penalty lapse
+	time.Sleep(600 * time.Millisecond)
+	if resp := makeRequest(t, router, req); resp.Penalized {
+		t.Errorf("expected the penalty to have decayed, got %+v", resp)
+	}
+}
+
+func TestRateLimiter_BurstMultiplier(t *testing.T) {
+	redisAddr, cleanup := setupRedisContainer(t)
+	defer cleanup()
+
+	redisStorage := storage.NewRedisStorage(redisAddr, "", 0)
+	defer redisStorage.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Both tiers refill too slowly to matter; premium bursts to twice its capacity
+	rules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{
+			"free":    {Capacity: 50, RefillRate: 0.001},
+			"premium": {Capacity: 50, RefillRate: 0.001, BurstMultiplier: 2},
+		},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/test": {Rule: "tiers+endpoints", Cost: 10, GlobalCapacity: 10000, GlobalRefillRate: 1000},
+		},
+	}
+	handler := api.NewRateLimiterHandler(redisStorage, rules)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/check", handler.CheckHandler)
+
+	burst := func(tier string) int {
+		allowed := 0
+		for i := 0; i < 20; i++ {
+			if resp := makeRequest(t, router, api.CheckRequest{Key: "burster", Endpoint: "/api/test", UserTier: tier}); resp.Allowed {
+				allowed++
+			}
+		}
+		return allowed
+	}
+	if allowed := burst("free"); allowed != 5 {
+		t.Errorf("expected the free tier to allow 5 requests in a burst, got %d", allowed)
+	}
+	if allowed := burst("premium"); allowed != 10 {
+		t.Errorf("expected burst_multiplier 2 to allow 10 requests in a burst, got %d", allowed)
+	}
+}
+
+func TestRateLimiter_InitialTokens(t *testing.T) {
+	redisAddr, cleanup := setupRedisContainer(t)
+	defer cleanup()
+
+	redisStorage := storage.NewRedisStorage(redisAddr, "", 0)
+	defer redisStorage.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Refill is too slow to matter; onboarding keys start with 2 requests' worth
+	initial := int64(20)
+	empty := int64(0)
+	rules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{
+			"onboarding": {Capacity: 100, RefillRate: 0.001, InitialTokens: &initial},
+			"free":       {Capacity: 100, RefillRate: 0.001},
+		},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/test":   {Rule: "tiers+endpoints", Cost: 10, GlobalCapacity: 10000, GlobalRefillRate: 1000},
+			"/api/export": {Rule: "endpoint", Cost: 1, GlobalCapacity: 100, GlobalRefillRate: 0.001, InitialTokens: &empty},
+		},
+	}
+	handler := api.NewRateLimiterHandler(redisStorage, rules)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/check", handler.CheckHandler)
+
+	allowed := func(req api.CheckRequest) int {
+		n := 0
+		for i := 0; i < 20; i++ {
+			if makeRequest(t, router, req).Allowed {
+				n++
+			}
+		}
+		return n
+	}
+	if n := allowed(api.CheckRequest{Key: "newcomer", Endpoint: "/api/test", UserTier: "onboarding"}); n != 2 {
+		t.Errorf("expected a fresh onboarding key to allow 2 requests, got %d", n)
+	}
+	if n := allowed(api.CheckRequest{Key: "regular", Endpoint: "/api/test", UserTier: "free"}); n != 10 {
+		t.Errorf("expected a fresh free key to start full and allow 10 requests, got %d", n)
+	}
+	if resp := makeRequest(t, router, api.CheckRequest{Key: "anyone", Endpoint: "/api/export"}); resp.Allowed || resp.GlobalRemaining != 0 {
+		t.Errorf("expected the fresh endpoint bucket to start empty, got %+v", resp)
+	}
+}
+
+func TestRateLimiter_LocalCacheInvalidation(t *testing.T) {
+	redisAddr, cleanup := setupRedisContainer(t)
+	defer cleanup()
+
+	// Two instances that serve checks from their local caches
+	opts := storage.LocalCacheOptions{FlushThreshold: 1000, MaxAge: time.Minute}
+	cache1 := storage.NewLocalCacheStorage(storage.NewRedisStorage(redisAddr, "", 0), opts)
+	defer cache1.Close()
+	cache2 := storage.NewLocalCacheStorage(storage.NewRedisStorage(redisAddr, "", 0), opts)
+	defer cache2.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	for _, cache := range []*storage.LocalCacheStorage{cache1, cache2} {
+		if err := cache.EnablePubSubInvalidation("rate_limit:invalidate"); err != nil {
+			t.Fatalf("failed to subscribe: %v", err)
+		}
+	}
+
+	rules := &config.RuleSet{
+		Tiers: map[string]config.TierConfig{
+			"free": {Capacity: 50, RefillRate: 0.001},
+		},
+		Endpoints: map[string]config.EndpointConfig{
+			"/api/test": {Rule: "tiers+endpoints", Cost: 10, GlobalCapacity: 10000, GlobalRefillRate: 1000},
+		},
+	}
+	gin.SetMode(gin.TestMode)
+	router1 := gin.New()
+	router1.Group("/admin", api.AdminAuth(map[string]string{"s3cret": "alice"})).
+		DELETE("/buckets/*key", api.NewRateLimiterHandler(cache1, rules).DeleteBucketHandler)
+	router2 := gin.New()
+	router2.POST("/check", api.NewRateLimiterHandler(cache2, rules).CheckHandler)
+
+	req := api.CheckRequest{Key: "cached", Endpoint: "/api/test", UserTier: "free"}
+	for i := 0; i < 5; i++ {
+		makeRequest(t, router2, req)
+	}
+	if resp := makeRequest(t, router2, req); resp.Allowed {
+		t.Fatal("expected instance 2 to deny from its local estimate")
+	}
+
+	// Deleting the bucket on instance 1 evicts it from instance 2's cache
+	w := httptest.NewRecorder()
+	httpReq, _ := http.NewRequest(http.MethodDelete, "/admin/buckets/user:cached:/api/test:free", nil)
+	httpReq.Header.Set("Authorization", "Bearer s3cret")
+	start := time.Now()
+	router1.ServeHTTP(w, httpReq)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the delete to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	for !makeRequest(t, router2, req).Allowed {
+		if time.Since(start) > 50*time.Millisecond {
+			t.Fatal("expected the invalidation to reach instance 2 within 50ms")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
 func makeRequest(t *testing.T, router *gin.Engine, req api.CheckRequest) api.CheckResponse {
 	body, _ := json.Marshal(req)
 